@@ -0,0 +1,382 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+)
+
+// adminFulfillmentStates are the fulfillment states an admin can set on an
+// order, the same ones OrderUpdate accepts
+var adminFulfillmentStates = []string{"pending", "shipping", "shipped"}
+
+// AdminUI serves the admin dashboard, a single page that browses orders,
+// refunds payments and updates the fulfillment of an order. The page holds no
+// data, it asks for an admin JWT and calls the API with it, so everything it
+// shows is protected by the admin group claim like any other admin request.
+func (a *API) AdminUI(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	nonce, err := adminNonce()
+	if err != nil {
+		internalServerError(w, "Error rendering the admin dashboard")
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Referrer-Policy", "no-referrer")
+	header.Set("Content-Security-Policy", "default-src 'none'; script-src 'nonce-"+nonce+"'; style-src 'nonce-"+nonce+"'; "+
+		"connect-src 'self'; img-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'")
+
+	err = adminPage.Execute(w, map[string]interface{}{
+		"Nonce":             nonce,
+		"AdminGroup":        getConfig(ctx).JWT.AdminGroupName,
+		"Reasons":           cancellationReasons(getConfig(ctx)),
+		"FulfillmentStates": adminFulfillmentStates,
+	})
+	if err != nil {
+		getLogger(ctx).WithError(err).Warn("Failed to render the admin dashboard")
+	}
+}
+
+// adminNonce allows the inline script and styles of a single response
+func adminNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// adminPage is the whole dashboard, bundled into the binary so it's served
+// by any deployment without extra assets. It routes on the URL fragment, so
+// reloading keeps the order that was open.
+var adminPage = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>GoCommerce admin</title>
+<style nonce="{{.Nonce}}">
+body { font: 14px/1.4 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 0; color: #222; background: #f6f6f6; }
+header { display: flex; align-items: center; justify-content: space-between; padding: 12px 24px; background: #222; color: #fff; }
+header a { color: #fff; }
+main { max-width: 1100px; margin: 24px auto; padding: 0 24px; }
+section { background: #fff; border: 1px solid #ddd; border-radius: 4px; padding: 16px; margin-bottom: 16px; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: 6px 8px; border-bottom: 1px solid #eee; vertical-align: top; }
+th { font-weight: 600; color: #555; }
+tr.order { cursor: pointer; }
+tr.order:hover { background: #f0f4ff; }
+form { display: flex; flex-wrap: wrap; gap: 8px; align-items: flex-end; }
+label { display: flex; flex-direction: column; font-size: 12px; color: #555; }
+input, select, button, textarea { font: inherit; padding: 4px 6px; }
+textarea { width: 100%; min-height: 80px; }
+.error { color: #b00020; }
+.notice { color: #1b5e20; }
+.muted { color: #777; }
+.hidden { display: none; }
+</style>
+</head>
+<body>
+<header>
+  <strong>GoCommerce admin</strong>
+  <span><a href="#" id="signout" class="hidden">Sign out</a></span>
+</header>
+<main>
+  <p id="message" role="status"></p>
+
+  <section id="signin" class="hidden">
+    <h2>Sign in</h2>
+    <p>Paste a JWT with the <code>{{.AdminGroup}}</code> role, or a role with the <code>orders:read</code> scope. It's kept in this tab only.</p>
+    <form id="signin-form">
+      <textarea id="token" required autocomplete="off" spellcheck="false"></textarea>
+      <button type="submit">Sign in</button>
+    </form>
+  </section>
+
+  <section id="orders" class="hidden">
+    <h2>Orders</h2>
+    <form id="filters">
+      <label>Email <input name="email" type="email"></label>
+      <label>State
+        <select name="state"><option value="">any</option><option>pending</option><option>paid</option><option>failed</option><option>cancelled</option></select>
+      </label>
+      <label>Payment
+        <select name="payment_state"><option value="">any</option><option>pending</option><option>paid</option><option>failed</option></select>
+      </label>
+      <label>Fulfillment
+        <select name="fulfillment_state"><option value="">any</option>{{range .FulfillmentStates}}<option>{{.}}</option>{{end}}</select>
+      </label>
+      <button type="submit">Filter</button>
+    </form>
+    <table>
+      <thead><tr><th>Created</th><th>Order</th><th>Email</th><th>Total</th><th>State</th><th>Payment</th><th>Fulfillment</th></tr></thead>
+      <tbody id="order-rows"></tbody>
+    </table>
+    <p><button id="prev">Previous</button> <span id="page" class="muted"></span> <button id="next">Next</button></p>
+  </section>
+
+  <section id="order" class="hidden">
+    <p><a href="#/orders">&larr; All orders</a></p>
+    <h2 id="order-title"></h2>
+    <table><tbody id="order-details"></tbody></table>
+
+    <h3>Line items</h3>
+    <table>
+      <thead><tr><th>SKU</th><th>Title</th><th>Quantity</th><th>Price</th></tr></thead>
+      <tbody id="order-items"></tbody>
+    </table>
+
+    <h3>Fulfillment</h3>
+    <form id="fulfillment-form">
+      <label>State <select name="fulfillment_state">{{range .FulfillmentStates}}<option>{{.}}</option>{{end}}</select></label>
+      <label>Carrier <input name="carrier"></label>
+      <label>Tracking number <input name="tracking_number"></label>
+      <label>Tracking URL <input name="tracking_url" type="url"></label>
+      <button type="submit">Save</button>
+    </form>
+
+    <h3>Payments</h3>
+    <table>
+      <thead><tr><th>Created</th><th>Type</th><th>Status</th><th>Amount</th><th>Reason</th><th></th></tr></thead>
+      <tbody id="order-payments"></tbody>
+    </table>
+    <form id="refund-form" class="hidden">
+      <input type="hidden" name="payment_id">
+      <label>Refund amount <input name="amount" type="number" min="0.01" step="0.01" required></label>
+      <label>Reason <select name="reason">{{range .Reasons}}<option>{{.}}</option>{{end}}</select></label>
+      <button type="submit">Refund</button>
+      <button type="button" id="refund-cancel">Cancel</button>
+    </form>
+  </section>
+</main>
+<script nonce="{{.Nonce}}">
+"use strict";
+(function() {
+  var API = location.pathname.replace(/\/admin\/?$/, "") + "/v1";
+  var PER_PAGE = 50;
+  var state = { page: 1, filters: {}, order: null };
+
+  function $(id) { return document.getElementById(id); }
+
+  function el(tag, text, attrs) {
+    var node = document.createElement(tag);
+    if (text !== undefined && text !== null) node.textContent = String(text);
+    for (var name in attrs || {}) node.setAttribute(name, attrs[name]);
+    return node;
+  }
+
+  function row(cells, attrs) {
+    var tr = el("tr", null, attrs);
+    cells.forEach(function(cell) {
+      var td = el("td");
+      if (cell instanceof Node) td.appendChild(cell); else td.textContent = cell === undefined || cell === null ? "" : String(cell);
+      tr.appendChild(td);
+    });
+    return tr;
+  }
+
+  function clear(node) { while (node.firstChild) node.removeChild(node.firstChild); }
+
+  function money(amount, currency) {
+    return (amount / 100).toFixed(2) + " " + (currency || "");
+  }
+
+  function date(value) { return value ? new Date(value).toLocaleString() : ""; }
+
+  function message(text, isError) {
+    var node = $("message");
+    node.textContent = text || "";
+    node.className = isError ? "error" : "notice";
+  }
+
+  function token() { return sessionStorage.getItem("gocommerce.admin.token"); }
+
+  function signOut() {
+    sessionStorage.removeItem("gocommerce.admin.token");
+    show("signin");
+  }
+
+  function show(id) {
+    ["signin", "orders", "order"].forEach(function(section) {
+      $(section).classList.toggle("hidden", section !== id);
+    });
+    $("signout").classList.toggle("hidden", id === "signin");
+  }
+
+  function request(method, path, body) {
+    var headers = { "Authorization": "Bearer " + token(), "Accept": "application/json" };
+    if (body) headers["Content-Type"] = "application/json";
+    return fetch(API + path, { method: method, headers: headers, body: body ? JSON.stringify(body) : undefined, credentials: "omit" })
+      .then(function(rsp) {
+        return rsp.text().then(function(text) {
+          var data = text ? JSON.parse(text) : null;
+          // reads are refused when the token is no good, writes also for a
+          // role without the scope, which keeps the dashboard usable
+          if (rsp.status === 401 && method === "GET") {
+            signOut();
+            throw new Error((data && data.msg) || "Sign in with an admin token");
+          }
+          if (!rsp.ok) throw new Error((data && data.msg) || rsp.statusText);
+          return { data: data, total: parseInt(rsp.headers.get("X-Total-Count") || "0", 10) };
+        });
+      });
+  }
+
+  function fail(err) { message(err.message, true); }
+
+  function loadOrders() {
+    var params = new URLSearchParams(state.filters);
+    params.set("page", state.page);
+    params.set("per_page", PER_PAGE);
+    return request("GET", "/users/all/orders?" + params.toString()).then(function(rsp) {
+      var rows = $("order-rows");
+      clear(rows);
+      (rsp.data || []).forEach(function(order) {
+        var tr = row([date(order.created_at), order.ref || order.id, order.email, money(order.total, order.currency),
+          order.state, order.payment_state, order.fulfillment_state], { "class": "order" });
+        tr.addEventListener("click", function() { location.hash = "#/orders/" + encodeURIComponent(order.id); });
+        rows.appendChild(tr);
+      });
+      var pages = Math.max(1, Math.ceil(rsp.total / PER_PAGE));
+      $("page").textContent = "Page " + state.page + " of " + pages + " (" + rsp.total + " orders)";
+      $("prev").disabled = state.page <= 1;
+      $("next").disabled = state.page >= pages;
+      show("orders");
+    });
+  }
+
+  function loadOrder(id) {
+    return request("GET", "/orders/" + encodeURIComponent(id)).then(function(rsp) {
+      var order = state.order = rsp.data;
+      $("order-title").textContent = "Order " + (order.ref || order.id);
+
+      var details = $("order-details");
+      clear(details);
+      [["Created", date(order.created_at)], ["Email", order.email], ["State", order.state],
+       ["Payment", order.payment_state], ["Fulfillment", order.fulfillment_state],
+       ["Subtotal", money(order.subtotal, order.currency)], ["Discount", money(order.discount, order.currency)],
+       ["Taxes", money(order.taxes, order.currency)], ["Total", money(order.total, order.currency)],
+       ["Cancellation", order.cancellation_reason]].forEach(function(pair) {
+        if (pair[1]) details.appendChild(row(pair));
+      });
+
+      var items = $("order-items");
+      clear(items);
+      (order.line_items || []).forEach(function(item) {
+        items.appendChild(row([item.sku, item.title, item.quantity, money(item.price, order.currency)]));
+      });
+
+      var form = $("fulfillment-form");
+      form.fulfillment_state.value = order.fulfillment_state || "pending";
+      form.carrier.value = order.carrier || "";
+      form.tracking_number.value = order.tracking_number || "";
+      form.tracking_url.value = order.tracking_url || "";
+
+      var payments = $("order-payments");
+      clear(payments);
+      $("refund-form").classList.add("hidden");
+      (order.transactions || []).forEach(function(tx) {
+        var action = "";
+        if (tx.type === "charge" && tx.status === "paid") {
+          action = el("button", "Refund", { type: "button" });
+          action.addEventListener("click", function() { openRefund(tx); });
+        }
+        payments.appendChild(row([date(tx.created_at), tx.type, tx.status, money(tx.amount, tx.currency), tx.reason, action]));
+      });
+      show("order");
+    });
+  }
+
+  function refunded() {
+    return (state.order.transactions || []).reduce(function(sum, tx) {
+      return tx.type === "refund" && tx.status !== "failed" ? sum + tx.amount : sum;
+    }, 0);
+  }
+
+  function openRefund(charge) {
+    var form = $("refund-form");
+    form.payment_id.value = charge.id;
+    form.dataset.currency = charge.currency;
+    form.amount.value = (Math.max(0, charge.amount - refunded()) / 100).toFixed(2);
+    form.amount.max = (charge.amount / 100).toFixed(2);
+    form.classList.remove("hidden");
+  }
+
+  function route() {
+    message("");
+    if (!token()) return show("signin");
+    var match = location.hash.match(/^#\/orders\/(.+)$/);
+    (match ? loadOrder(decodeURIComponent(match[1])) : loadOrders()).catch(fail);
+  }
+
+  $("signin-form").addEventListener("submit", function(e) {
+    e.preventDefault();
+    sessionStorage.setItem("gocommerce.admin.token", $("token").value.trim());
+    $("token").value = "";
+    // listing the orders of all users takes the orders:read scope
+    request("GET", "/users/all/orders?per_page=1").then(route).catch(function(err) {
+      signOut();
+      fail(err);
+    });
+  });
+
+  $("signout").addEventListener("click", function(e) {
+    e.preventDefault();
+    signOut();
+    message("");
+  });
+
+  $("filters").addEventListener("submit", function(e) {
+    e.preventDefault();
+    state.filters = {};
+    new FormData(e.target).forEach(function(value, name) { if (value) state.filters[name] = value; });
+    state.page = 1;
+    loadOrders().catch(fail);
+  });
+
+  $("prev").addEventListener("click", function() { state.page--; loadOrders().catch(fail); });
+  $("next").addEventListener("click", function() { state.page++; loadOrders().catch(fail); });
+
+  $("fulfillment-form").addEventListener("submit", function(e) {
+    e.preventDefault();
+    var form = e.target;
+    request("PUT", "/orders/" + encodeURIComponent(state.order.id), {
+      fulfillment_state: form.fulfillment_state.value,
+      carrier: form.carrier.value,
+      tracking_number: form.tracking_number.value,
+      tracking_url: form.tracking_url.value
+    }).then(function() {
+      return loadOrder(state.order.id);
+    }).then(function() { message("Saved the fulfillment"); }).catch(fail);
+  });
+
+  $("refund-form").addEventListener("submit", function(e) {
+    e.preventDefault();
+    var form = e.target;
+    var amount = Math.round(parseFloat(form.amount.value) * 100);
+    if (!confirm("Refund " + money(amount, form.dataset.currency) + "?")) return;
+    request("POST", "/payments/" + encodeURIComponent(form.payment_id.value) + "/refund", {
+      amount: amount,
+      currency: form.dataset.currency,
+      reason: form.reason.value
+    }).then(function() {
+      return loadOrder(state.order.id);
+    }).then(function() { message("Refunded " + money(amount, form.dataset.currency)); }).catch(fail);
+  });
+
+  $("refund-cancel").addEventListener("click", function() { $("refund-form").classList.add("hidden"); });
+
+  window.addEventListener("hashchange", route);
+  route();
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestAdminUI(t *testing.T) {
+	db, config := db(t)
+	config.Cancellations.Reasons = []string{"damaged_item", "customer_request"}
+	api := NewAPI(config, db, nil, nil, nil)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+
+	csp := w.Header().Get("Content-Security-Policy")
+	assert.Contains(t, csp, "default-src 'none'")
+	assert.Contains(t, csp, "frame-ancestors 'none'")
+	body := w.Body.String()
+	assert.Contains(t, body, "<option>damaged_item</option><option>customer_request</option>")
+	assert.Contains(t, body, "<code>"+config.JWT.AdminGroupName+"</code>")
+	assert.NotContains(t, body, firstOrder.Email, "the page holds no data")
+
+	second := httptest.NewRecorder()
+	api.handler.ServeHTTP(second, httptest.NewRequest("GET", "/admin", nil))
+	assert.NotEqual(t, csp, second.Header().Get("Content-Security-Policy"), "every response has its own nonce")
+}
+
+func TestOrderListByEmail(t *testing.T) {
+	db, config := db(t)
+	other := models.NewOrder("session3", "alfred@wayneindustries.com", "usd")
+	assert.NoError(t, db.Create(other).Error)
+	defer db.Unscoped().Delete(other)
+
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+	ctx = kami.SetParam(ctx, "user_id", "all")
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "https://not-real/orders?email=alfred@wayneindustries.com", nil)
+	NewAPI(config, db, nil, nil, nil).OrderList(ctx, recorder, req)
+	orders := []models.Order{}
+	extractPayload(t, 200, recorder, &orders)
+	if assert.Len(t, orders, 1) {
+		assert.Equal(t, other.ID, orders[0].ID)
+	}
+}
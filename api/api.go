@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -17,27 +18,64 @@ import (
 
 	"github.com/netlify/gocommerce/assetstores"
 	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/events"
 	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/refs"
+	"github.com/netlify/gocommerce/tracing"
 
 	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
 )
 
+const requestIDHeader = "X-Request-ID"
+
 var (
-	defaultVersion = "unknown version"
-	bearerRegexp   = regexp.MustCompile(`^(?:B|b)earer (\S+$)`)
+	defaultVersion  = "unknown version"
+	bearerRegexp    = regexp.MustCompile(`^(?:B|b)earer (\S+$)`)
+	requestIDRegexp = regexp.MustCompile(`^[\w\-.:/+=@]{1,200}$`)
+	// eventStreamPath is the order event stream, the only route that takes
+	// the token from the query
+	eventStreamPath = regexp.MustCompile(`^(/v\d+)?/orders/[^/]+/events$`)
 )
 
 // API is the main REST API
 type API struct {
 	handler    http.Handler
+	server     *http.Server
+	serverLock sync.Mutex
+	// stopped is set by Shutdown, so a server that wasn't started yet
+	// isn't started anymore
+	stopped    bool
 	db         *gorm.DB
 	paypal     *paypalsdk.Client
 	config     *conf.Configuration
+	configLock sync.RWMutex
 	mailer     *mailer.Mailer
 	httpClient *http.Client
 	log        *logrus.Entry
 	assets     assetstores.Store
-	version    string
+	build      BuildInfo
+	readOnly   *readOnlyState
+	refs       refs.Encoder
+
+	orderEvents *orderNotifier
+	events      *events.Bus
+	instances   *instanceCache
+	settings    *settingsCache
+	vatCache    *vatCache
+	rateCache   *rateCache
+	reportCache *reportCache
+	logLevel    *logLevelState
+
+	// background are the subscribers of the events that run in a worker
+	background map[string][]backgroundSubscriber
+
+	// policies are the authorization policies of the routes, by method and
+	// path
+	policies map[string]policy
+
+	// trustedProxies are the load balancers that tell the client's address
+	trustedProxies conf.Networks
 }
 
 type JWTClaims struct {
@@ -45,13 +83,26 @@ type JWTClaims struct {
 	Email        string                 `json:"email"`
 	AppMetaData  map[string]interface{} `json:"app_metadata"`
 	UserMetaData map[string]interface{} `json:"user_metadata"`
+	Audience     Audience               `json:"aud,omitempty"`
 	*jwt.StandardClaims
 }
 
 func (a *API) withToken(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if a.currentConfig().MultiInstance.Enabled && a.operatorToken(r) {
+		return withOperator(ctx)
+	}
+
 	log := getLogger(ctx)
 	config := getConfig(ctx)
 	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" && r.Method == http.MethodGet && eventStreamPath.MatchString(r.URL.Path) {
+		// EventSource can't set headers, so the event stream takes the token
+		// from the query. Other routes don't, so tokens don't end up in the
+		// logs and browser history of any URL.
+		if token := r.URL.Query().Get("access_token"); token != "" {
+			authHeader = "Bearer " + token
+		}
+	}
 	if authHeader == "" {
 		log.Info("Making unauthenticated request")
 		return ctx
@@ -64,11 +115,20 @@ func (a *API) withToken(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		return nil
 	}
 
+	if models.IsAPIKey(matches[1]) {
+		return a.withAPIKey(ctx, w, r, matches[1])
+	}
+
 	token, err := jwt.ParseWithClaims(matches[1], &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if token.Header["alg"] != jwt.SigningMethodHS256.Name {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(config.JWT.Secret), nil
+		kid, _ := token.Header["kid"].(string)
+		secret, ok := config.JWTSecret(kid)
+		if !ok {
+			return nil, fmt.Errorf("Unknown key ID: %v", kid)
+		}
+		return []byte(secret), nil
 	})
 	if err != nil {
 		log.Infof("Invalid token: %v", err)
@@ -83,8 +143,14 @@ func (a *API) withToken(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		unauthorizedError(w, msg)
 		return nil
 	}
+	if err := verifyAudienceAndIssuer(config, claims); err != nil {
+		log.Infof("Invalid token: %v", err)
+		unauthorizedError(w, "Invalid token: %v", err)
+		return nil
+	}
 
 	isAdmin := false
+	roleNames := []string{}
 	roles, ok := claims.AppMetaData["roles"]
 	if ok {
 		roleStrings, _ := roles.([]interface{})
@@ -92,28 +158,154 @@ func (a *API) withToken(ctx context.Context, w http.ResponseWriter, r *http.Requ
 			role, _ := data.(string)
 			if role == config.JWT.AdminGroupName {
 				isAdmin = true
-				break
 			}
+			roleNames = append(roleNames, role)
 		}
 	}
+	scopes := config.ScopesForRoles(roleNames)
 
 	log = log.WithFields(logrus.Fields{
+		"user_id":      claims.ID,
 		"claims_id":    claims.ID,
 		"claims_email": claims.Email,
 		"roles":        roles,
 		"is_admin":     isAdmin,
 	})
+	if !isAdmin && len(scopes) > 0 {
+		log = log.WithField("scopes", scopeList(scopes))
+	}
 
 	log.Info("successfully parsed claims")
 	ctx = withAdminFlag(ctx, isAdmin)
+	ctx = withScopes(ctx, scopes)
+	ctx = withLogger(ctx, log)
+
+	return withToken(ctx, token)
+}
+
+// withAPIKey authenticates a server-to-server caller. The key acts as an admin
+// token, with writes refused for read-only keys.
+func (a *API) withAPIKey(ctx context.Context, w http.ResponseWriter, r *http.Request, raw string) context.Context {
+	log := getLogger(ctx)
+
+	key, err := models.FindAPIKey(a.dbFor(ctx), raw)
+	if err != nil {
+		log.WithError(err).Warn("Error while querying for API key")
+		internalServerError(w, "Error during database query: %v", err)
+		return nil
+	}
+	if key == nil {
+		log.Info("Invalid API key")
+		unauthorizedError(w, "Invalid API key")
+		return nil
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"api_key_id":    key.ID,
+		"api_key_scope": key.Scope,
+	})
+
+	if !key.AllowsMethod(r.Method) {
+		log.Info("Write attempted with read-only API key")
+		unauthorizedError(w, "This API key only allows read access")
+		return nil
+	}
+
+	now := time.Now()
+	if rsp := a.dbFor(ctx).Model(key).UpdateColumn("last_used_at", &now); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to record API key usage")
+	}
+
+	token := &jwt.Token{
+		Valid: true,
+		Claims: &JWTClaims{
+			ID:             key.ID,
+			AppMetaData:    map[string]interface{}{"api_key": key.Name},
+			StandardClaims: &jwt.StandardClaims{Subject: key.ID},
+		},
+	}
+
+	log.Info("successfully authenticated API key")
+	ctx = withAdminFlag(ctx, true)
+	ctx = withAPIKey(ctx, key)
 	ctx = withLogger(ctx, log)
 
 	return withToken(ctx, token)
 }
 
-// ListenAndServe starts the REST API
+// dbFor returns the database handle for a request, so its queries are traced
+// as part of the request
+func (a *API) dbFor(ctx context.Context) *gorm.DB {
+	db := models.WithContext(tracing.WithContext(a.db, ctx), ctx)
+	if instance := getInstance(ctx); instance != nil {
+		db = models.ForInstance(db, instance.ID)
+	}
+	return db
+}
+
+// ListenAndServe starts the REST API, over HTTPS when TLS is configured. It
+// returns nil once the API has been shut down.
 func (a *API) ListenAndServe(hostAndPort string) error {
-	return http.ListenAndServe(hostAndPort, a.handler)
+	tlsConf, err := tlsConfig(a.currentConfig())
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:         hostAndPort,
+		Handler:      a.handler,
+		TLSConfig:    tlsConf,
+		ReadTimeout:  a.currentConfig().API.ReadTimeout,
+		WriteTimeout: a.currentConfig().API.WriteTimeout,
+		IdleTimeout:  a.currentConfig().API.IdleTimeout,
+	}
+	a.serverLock.Lock()
+	if a.stopped {
+		a.serverLock.Unlock()
+		return nil
+	}
+	a.server = server
+	a.serverLock.Unlock()
+
+	if tlsConf != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to
+// finish, or for ctx to be done. It can be called while ListenAndServe is
+// still starting the server.
+func (a *API) Shutdown(ctx context.Context) error {
+	a.serverLock.Lock()
+	a.stopped = true
+	server := a.server
+	a.serverLock.Unlock()
+	if server == nil {
+		return nil
+	}
+	err := server.Shutdown(ctx)
+	a.events.Wait()
+	return err
+}
+
+// Reload replaces the configuration with a reloaded one. Requests that are
+// under way keep the configuration they started with.
+func (a *API) Reload(config *conf.Configuration) {
+	a.configLock.Lock()
+	a.config = config
+	a.configLock.Unlock()
+}
+
+func (a *API) currentConfig() *conf.Configuration {
+	a.configLock.RLock()
+	defer a.configLock.RUnlock()
+	return a.config
 }
 
 func NewAPI(config *conf.Configuration, db *gorm.DB, paypal *paypalsdk.Client, mailer *mailer.Mailer, store assetstores.Store) *API {
@@ -122,15 +314,42 @@ func NewAPI(config *conf.Configuration, db *gorm.DB, paypal *paypalsdk.Client, m
 
 // NewAPIWithVersion instantiates a new REST API
 func NewAPIWithVersion(config *conf.Configuration, db *gorm.DB, paypal *paypalsdk.Client, mailer *mailer.Mailer, assets assetstores.Store, version string) *API {
+	return NewAPIWithBuild(config, db, paypal, mailer, assets, BuildInfo{Version: version})
+}
+
+// NewAPIWithBuild instantiates a new REST API that serves its build info
+func NewAPIWithBuild(config *conf.Configuration, db *gorm.DB, paypal *paypalsdk.Client, mailer *mailer.Mailer, assets assetstores.Store, build BuildInfo) *API {
 	api := &API{
 		log:        logrus.WithField("component", "api"),
 		config:     config,
 		db:         db,
 		paypal:     paypal,
 		mailer:     mailer,
-		httpClient: &http.Client{},
+		httpClient: config.HTTPClient(config.Timeouts.Site),
 		assets:     assets,
-		version:    version,
+		build:      buildInfo(build),
+		refs:       refs.NewObfuscator(config.OrderRefs.Salt, config.OrderRefs.Alphabet),
+
+		orderEvents: newOrderNotifier(),
+		background:  map[string][]backgroundSubscriber{},
+		instances:   newInstanceCache(),
+		settings:    newSettingsCache(),
+		vatCache:    newVATCache(),
+		rateCache:   newRateCache(),
+		reportCache: newReportCache(),
+		logLevel:    &logLevelState{},
+		policies:    map[string]policy{},
+	}
+	// the proxies were validated with the configuration, if they can't be
+	// parsed the client is whoever connects
+	api.trustedProxies, _ = conf.ParseNetworks(config.API.TrustedProxies)
+	api.events = events.NewBus(api.log.WithField("component", "events"))
+	api.subscribe()
+
+	api.readOnly = &readOnlyState{log: api.log.WithField("component", "read_only")}
+	if db != nil {
+		api.readOnly.register(db)
+		tracing.RegisterCallbacks(db)
 	}
 
 	mux := kami.New()
@@ -140,54 +359,146 @@ func NewAPIWithVersion(config *conf.Configuration, db *gorm.DB, paypal *paypalsd
 
 	// endpoints
 	mux.Get("/", api.Index)
+	mux.Get("/debug/vars", api.enforce(admin(), api.DebugVars))
+	mux.Get("/health", api.Health)
+	mux.Get("/version", api.Version)
+	mux.Get("/admin", api.AdminUI)
+
+	v1 := newRouter(api, mux, "v1")
+	v1.Get("/orders", authenticated(), api.OrderList)
+	v1.Post("/orders", public(), api.OrderCreate)
+	v1.Get("/orders/:id", all(authenticated(), ownerOr(orderOwner("id"), conf.ScopeOrdersRead)), api.OrderView)
+	v1.Put("/orders/:id", scope(conf.ScopeOrdersWrite), api.OrderUpdate)
+	v1.Delete("/orders/:id", admin(), api.OrderDelete)
+	v1.Get("/orders/:id/events", all(authenticated(), ownerOr(orderOwner("id"), conf.ScopeOrdersRead)), api.OrderEvents)
+	v1.Get("/orders/:order_id/payments", all(authenticated(), ownerOr(orderUser("order_id"), conf.ScopeOrdersRead)), api.PaymentListForOrder)
+	v1.Post("/orders/:order_id/payments", owner(orderOwner("order_id")), api.PaymentCreate)
+	v1.Post("/orders/:order_id/receipt", ownerOr(orderOwner("order_id"), conf.ScopeOrdersWrite), api.ResendOrderReceipt)
+	v1.Get("/orders/:order_id/payment_status", ownerOr(orderOwner("order_id"), conf.ScopeOrdersRead), api.OrderPaymentStatus)
+	v1.Post("/orders/:order_id/cancel", scope(conf.ScopeOrdersWrite), api.OrderCancel)
+	v1.Get("/orders/:order_id/review", scope(conf.ScopeOrdersRead), api.OrderRiskView)
+	v1.Post("/orders/:order_id/review", scope(conf.ScopeOrdersWrite), api.OrderReview)
+	v1.Post("/orders/:order_id/goodwill", scope(conf.ScopeRefundsCreate), api.OrderGoodwill)
+	v1.Put("/orders/:order_id/components/:component_id", scope(conf.ScopeOrdersWrite), api.ComponentUpdate)
+	v1.Get("/orders/:order_id/webhooks", admin(), api.WebhookDeliveryList)
+	v1.Get("/orders/:order_id/emails", scope(conf.ScopeOrdersRead), api.OrderEmailList)
+	v1.Post("/orders/:order_id/emails/:type/resend", scope(conf.ScopeOrdersWrite), api.OrderEmailResend)
+
+	v1.Get("/users", scope(conf.ScopeUsersRead), api.UserList)
+	v1.Get("/users/:user_id", ownerOr(userInPath(), conf.ScopeUsersRead), api.UserView)
+	v1.Get("/users/:user_id/payments", ownerOr(userInPath(), conf.ScopeOrdersRead), api.PaymentListForUser)
+	v1.Delete("/users/:user_id", scope(conf.ScopeUsersWrite), api.UserDelete)
+	v1.Get("/users/:user_id/addresses", ownerOr(userInPath(), conf.ScopeUsersRead), api.AddressList)
+	v1.Get("/users/:user_id/addresses/:addr_id", ownerOr(userInPath(), conf.ScopeUsersRead), api.AddressView)
+	v1.Delete("/users/:user_id/addresses/:addr_id", scope(conf.ScopeUsersWrite), api.AddressDelete)
+	v1.Get("/users/:user_id/orders", ownerOr(userInPath(), conf.ScopeOrdersRead), api.OrderList)
+	v1.Get("/users/:user_id/referral", ownerOr(userInPath(), conf.ScopeUsersRead), api.ReferralView)
+	v1.Post("/users/:user_id/referral", ownerOr(userInPath(), conf.ScopeUsersWrite), api.ReferralCreate)
+
+	v1.Get("/deleted/orders", admin(), api.DeletedOrderList)
+	v1.Post("/deleted/orders/:order_id/restore", admin(), api.OrderRestore)
+	v1.Get("/deleted/users", admin(), api.DeletedUserList)
+	v1.Post("/deleted/users/:user_id/restore", admin(), api.UserRestore)
+	v1.Get("/deleted/addresses", admin(), api.DeletedAddressList)
+	v1.Post("/deleted/addresses/:addr_id/restore", admin(), api.AddressRestore)
+
+	v1.Get("/downloads/:id", ownerOr(downloadOwner("id"), conf.ScopeOrdersRead), api.DownloadURL)
+	v1.Get("/downloads", authenticated(), api.DownloadList)
+	v1.Get("/orders/:order_id/downloads", ownerOr(orderOwner("order_id"), conf.ScopeOrdersRead), api.DownloadList)
+
+	v1.Get("/vatnumbers/:number", public(), api.VatnumberLookup)
+
+	v1.Get("/payments", scope(conf.ScopeOrdersRead), api.PaymentList)
+	v1.Get("/payments/:pay_id", scope(conf.ScopeOrdersRead), api.PaymentView)
+	v1.Post("/payments/:pay_id/refund", scope(conf.ScopeRefundsCreate), api.PaymentRefund)
+
+	// signed by stripe
+	v1.Post("/stripe/events", public(), api.StripeEvents)
+
+	v1.Post("/paypal", public(), api.PaypalCreatePayment)
+	v1.Get("/paypal/:payment_id", public(), api.PaypalGetPayment)
+
+	v1.Get("/reports/sales", scope(conf.ScopeReportsRead), api.SalesReport)
+	v1.Get("/reports/sales/periods", scope(conf.ScopeReportsRead), api.SalesPeriodsReport)
+	v1.Get("/reports/products", scope(conf.ScopeReportsRead), api.ProductsReport)
+	v1.Get("/reports/cancellations", scope(conf.ScopeReportsRead), api.CancellationsReport)
+	v1.Get("/reports/tax_liability", scope(conf.ScopeReportsRead), api.TaxLiabilityReport)
+	v1.Get("/reports/taxes", scope(conf.ScopeReportsRead), api.TaxSummaryReport)
+	v1.Get("/reports/oss", scope(conf.ScopeReportsRead), api.OSSReport)
+	v1.Get("/reports/coupons", scope(conf.ScopeReportsRead), api.CouponsReport)
+
+	v1.Get("/coupons", scope(conf.ScopeCouponsRead), api.CouponList)
+	v1.Post("/coupons", scope(conf.ScopeCouponsWrite), api.CouponCreate)
+	v1.Get("/coupons/:code", public(), api.CouponView)
+	v1.Put("/coupons/:code", scope(conf.ScopeCouponsWrite), api.CouponUpdate)
+	v1.Delete("/coupons/:code", scope(conf.ScopeCouponsWrite), api.CouponDelete)
+
+	v1.Get("/inventory", scope(conf.ScopeInventoryRead), api.InventoryList)
+	v1.Put("/inventory/:sku", scope(conf.ScopeInventoryWrite), api.InventoryUpdate)
+
+	v1.Post("/claim", authenticated(), api.ClaimOrders)
+
+	v1.Get("/mail/bounces", admin(), api.MailBounceList)
+	// signed by the mail provider
+	v1.Post("/mail/bounces", public(), api.MailBounceWebhook)
+	v1.Get("/mail/suppressions", admin(), api.MailSuppressionList)
+	v1.Post("/mail/suppressions", admin(), api.MailSuppressionCreate)
+	v1.Delete("/mail/suppressions/:email", admin(), api.MailSuppressionDelete)
+	v1.Get("/emails/preview/:template", admin(), api.EmailPreviewView)
+	// signed links from the mails
+	v1.Get("/emails/unsubscribe", public(), api.EmailUnsubscribe)
+	v1.Post("/emails/unsubscribe", public(), api.EmailUnsubscribe)
+
+	v1.Get("/webhooks/verify.js", public(), api.WebhookVerifierJS)
+	v1.Get("/webhooks/endpoints", admin(), api.WebhookEndpointList)
+	v1.Post("/webhooks/deliveries/:hook_id/replay", admin(), api.WebhookDeliveryReplay)
+	v1.Post("/webhooks/test", admin(), api.WebhookTest)
+	v1.Get("/webhooks/subscriptions", admin(), api.WebhookSubscriptionList)
+	v1.Post("/webhooks/subscriptions", adminUser(), api.WebhookSubscriptionCreate)
+	v1.Get("/webhooks/subscriptions/:subscription_id", admin(), api.WebhookSubscriptionView)
+	v1.Put("/webhooks/subscriptions/:subscription_id", adminUser(), api.WebhookSubscriptionUpdate)
+	v1.Delete("/webhooks/subscriptions/:subscription_id", adminUser(), api.WebhookSubscriptionDelete)
+
+	v1.Get("/api_keys", adminUser(), api.APIKeyList)
+	v1.Post("/api_keys", adminUser(), api.APIKeyCreate)
+	v1.Delete("/api_keys/:key_id", adminUser(), api.APIKeyDelete)
+
+	v1.Delete("/test_orders", adminUser(), api.PurgeTestOrders)
+
+	v1.Post("/bulk/fulfillment", scope(conf.ScopeOrdersWrite), api.BulkFulfillment)
+	v1.Post("/bulk/refunds", scope(conf.ScopeRefundsCreate), api.BulkRefund)
+
+	v1.Get("/audit_logs", admin(), api.AuditLogList)
+
+	v1.Get("/config", admin(), api.ConfigView)
+	v1.Get("/log_level", deploymentAdmin(), api.LogLevelView)
+	v1.Put("/log_level", deploymentAdmin(), api.LogLevelUpdate)
+	v1.Get("/settings", admin(), api.SettingsView)
+	v1.Post("/settings/refresh", admin(), api.SettingsRefresh)
+
+	v1.Get("/instances", operator(), api.InstanceList)
+	v1.Post("/instances", operator(), api.InstanceCreate)
+	v1.Get("/instances/:instance_id", operator(), api.InstanceView)
+	v1.Put("/instances/:instance_id", operator(), api.InstanceUpdate)
+	v1.Delete("/instances/:instance_id", operator(), api.InstanceDelete)
+
+	corsHandler := cors.New(corsOptions(config))
+
+	api.handler = tracing.Middleware(corsHandler.Handler(api.withReadOnlyGuard(mux)))
 
-	mux.Get("/orders", api.OrderList)
-	mux.Post("/orders", api.OrderCreate)
-	mux.Get("/orders/:id", api.OrderView)
-	mux.Put("/orders/:id", api.OrderUpdate)
-	mux.Get("/orders/:order_id/payments", api.PaymentListForOrder)
-	mux.Post("/orders/:order_id/payments", api.PaymentCreate)
-	mux.Post("/orders/:order_id/receipt", api.ResendOrderReceipt)
-
-	mux.Get("/users", api.UserList)
-	mux.Get("/users/:user_id", api.UserView)
-	mux.Get("/users/:user_id/payments", api.PaymentListForUser)
-	mux.Delete("/users/:user_id", api.UserDelete)
-	mux.Get("/users/:user_id/addresses", api.AddressList)
-	mux.Get("/users/:user_id/addresses/:addr_id", api.AddressView)
-	mux.Delete("/users/:user_id/addresses/:addr_id", api.AddressDelete)
-	mux.Get("/users/:user_id/orders", api.OrderList)
-
-	mux.Get("/downloads/:id", api.DownloadURL)
-	mux.Get("/downloads", api.DownloadList)
-	mux.Get("/orders/:order_id/downloads", api.DownloadList)
-
-	mux.Get("/vatnumbers/:number", api.VatnumberLookup)
-
-	mux.Get("/payments", api.PaymentList)
-	mux.Get("/payments/:pay_id", api.PaymentView)
-	mux.Post("/payments/:pay_id/refund", api.PaymentRefund)
-
-	mux.Post("/paypal", api.PaypalCreatePayment)
-	mux.Get("/paypal/:payment_id", api.PaypalGetPayment)
-
-	mux.Get("/reports/sales", api.SalesReport)
-	mux.Get("/reports/products", api.ProductsReport)
-
-	mux.Get("/coupons/:code", api.CouponView)
-
-	mux.Post("/claim", api.ClaimOrders)
+	return api
+}
 
-	corsHandler := cors.New(cors.Options{
+// corsOptions allows the configured origins, or all of them when none are configured
+func corsOptions(config *conf.Configuration) cors.Options {
+	return cors.Options{
+		AllowedOrigins:   config.API.CORS.AllowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link", "X-Total-Count"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "If-None-Match", requestIDHeader, instanceHeader},
+		ExposedHeaders:   append([]string{"ETag", "Link", "X-Total-Count", requestIDHeader}, config.API.CORS.ExposedHeaders...),
+		MaxAge:           config.API.CORS.MaxAge,
 		AllowCredentials: true,
-	})
-
-	api.handler = corsHandler.Handler(mux)
-
-	return api
+	}
 }
 
 func (a *API) logCompleted(ctx context.Context, wp mutil.WriterProxy, r *http.Request) {
@@ -201,8 +512,39 @@ func (a *API) logCompleted(ctx context.Context, wp mutil.WriterProxy, r *http.Re
 	log.Infof("Completed request %s. path: %s, method: %s, status: %d", getRequestID(ctx), r.URL.Path, r.Method, wp.Status())
 }
 
+// validRequestID checks that an incoming request ID is safe to log and pass on
+func validRequestID(id string) bool {
+	return requestIDRegexp.MatchString(id)
+}
+
+// get fetches a url from the site, passing on the request ID and trace
+func (a *API) get(ctx context.Context, url string) (*http.Response, error) {
+	return a.getWithHeader(ctx, url, nil)
+}
+
+// getWithHeader fetches a url from the site with extra headers, like the ones
+// of a conditional request
+func (a *API) getWithHeader(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if id := getRequestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	tracing.Inject(ctx, req.Header)
+	return a.httpClient.Do(req.WithContext(ctx))
+}
+
 func (a *API) populateContext(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
-	id := uuid.NewRandom().String()
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.NewRandom().String()
+	}
+	w.Header().Set(requestIDHeader, id)
 	log := a.log.WithField("request_id", id)
 
 	log = log.WithFields(logrus.Fields{
@@ -212,11 +554,20 @@ func (a *API) populateContext(ctx context.Context, w http.ResponseWriter, r *htt
 
 	ctx = withRequestID(ctx, id)
 	ctx = withLogger(ctx, log)
-	ctx = withConfig(ctx, a.config)
+	ctx = withConfig(ctx, a.currentConfig())
 	ctx = withStartTime(ctx, time.Now())
+	ctx = withClientIP(ctx, clientIP(r, a.trustedProxies))
+	if a.currentConfig().API.MaxBodySize > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, a.currentConfig().API.MaxBodySize)
+	}
 	ctx = withPayer(ctx, PaypalChargerType, &paypalProvider{a.paypal})
 	ctx = withPayer(ctx, StripeChargerType, &stripeProvider{})
-	ctx = withCoupons(ctx, a.config)
+	ctx = withCoupons(ctx, a.currentConfig())
+	if a.currentConfig().MultiInstance.Enabled && !deploymentPaths[r.URL.Path] {
+		if ctx = a.withInstance(ctx, w, r); ctx == nil {
+			return nil
+		}
+	}
 
 	log.Info("request started")
 	return ctx
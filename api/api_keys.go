@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/guregu/kami"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// APIKeyParams holds the parameters for creating an API key
+type APIKeyParams struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// CreatedAPIKey is returned once when a key is created, it's the only time
+// the key itself is available.
+type CreatedAPIKey struct {
+	*models.APIKey
+	Key string `json:"key"`
+}
+
+// APIKeyList lists the API keys that haven't been revoked
+func (a *API) APIKeyList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).Model(&models.APIKey{})
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	keys := []models.APIKey{}
+	if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&keys); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for API keys")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, 200, keys)
+}
+
+// APIKeyCreate creates a new API key with either the admin or read_only scope
+func (a *API) APIKeyCreate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := new(APIKeyParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		log.WithError(err).Infof("Failed to deserialize API key params: %s", err.Error())
+		readError(w, "API key params", err)
+		return
+	}
+
+	if params.Name == "" {
+		badRequestError(w, "An API key requires a name")
+		return
+	}
+	if params.Scope == "" {
+		params.Scope = models.ReadOnlyScope
+	}
+	if !models.ValidAPIKeyScope(params.Scope) {
+		badRequestError(w, "Unknown API key scope '%s', must be one of: %s, %s", params.Scope, models.AdminScope, models.ReadOnlyScope)
+		return
+	}
+
+	apiKey, key, err := models.NewAPIKey(params.Name, params.Scope)
+	if err != nil {
+		log.WithError(err).Warn("Failed to generate API key")
+		internalServerError(w, "Failed to generate API key")
+		return
+	}
+
+	if rsp := a.dbFor(ctx).Create(apiKey); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to store API key")
+		internalServerError(w, "Failed to store API key")
+		return
+	}
+
+	a.audit(ctx, a.dbFor(ctx), r, "api_key.create", "api_key", apiKey.ID, nil, models.Snapshot(apiKey))
+	log.WithField("api_key_id", apiKey.ID).Infof("Created %s API key '%s'", apiKey.Scope, apiKey.Name)
+	sendJSON(w, 201, &CreatedAPIKey{APIKey: apiKey, Key: key})
+}
+
+// APIKeyDelete revokes an API key
+func (a *API) APIKeyDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := kami.Param(ctx, "key_id")
+	log := getLogger(ctx).WithField("api_key_id", id)
+	apiKey := &models.APIKey{}
+	if rsp := a.dbFor(ctx).First(apiKey, "id = ?", id); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			notFoundError(w, "API key not found")
+		} else {
+			log.WithError(rsp.Error).Warn("Error while querying for API key")
+			internalServerError(w, "Error during database query: %v", rsp.Error)
+		}
+		return
+	}
+
+	if rsp := a.dbFor(ctx).Delete(apiKey); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to revoke API key")
+		internalServerError(w, "Failed to revoke API key")
+		return
+	}
+
+	a.audit(ctx, a.dbFor(ctx), r, "api_key.delete", "api_key", apiKey.ID, models.Snapshot(apiKey), nil)
+	log.Info("Revoked API key")
+}
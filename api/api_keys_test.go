@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestAPIKeyCreate(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"name": "nightly export", "scope": "read_only"}`))
+	NewAPI(config, db, nil, nil, nil).APIKeyCreate(ctx, w, r)
+
+	created := &CreatedAPIKey{}
+	extractPayload(t, 201, w, created)
+	assert.True(t, strings.HasPrefix(created.Key, models.APIKeyPrefix))
+	assert.Equal(t, models.ReadOnlyScope, created.Scope)
+
+	stored := &models.APIKey{}
+	assert.NoError(t, db.First(stored, "id = ?", created.ID).Error)
+	assert.Equal(t, models.HashAPIKey(created.Key), stored.KeyHash)
+	assert.NotContains(t, stored.KeyHash, created.Key)
+}
+
+func TestAPIKeyCreateBadScope(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"name": "cron", "scope": "superuser"}`))
+	NewAPI(config, db, nil, nil, nil).APIKeyCreate(ctx, w, r)
+	validateError(t, 400, w)
+}
+
+func TestAPIKeyCreateAsNonAdmin(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken(testUser.ID, ""), config, false)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"name": "cron"}`))
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "POST /api_keys", api.APIKeyCreate)(ctx, w, r)
+	validateError(t, 401, w)
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+
+	adminKey, adminSecret := createTestAPIKey(t, db, models.AdminScope)
+	_, readSecret := createTestAPIKey(t, db, models.ReadOnlyScope)
+	revokedKey, revokedSecret := createTestAPIKey(t, db, models.AdminScope)
+	db.Delete(revokedKey)
+
+	do := func(method, path, key string) int {
+		r, _ := http.NewRequest(method, server.URL+path, strings.NewReader(`{"name": "minted"}`))
+		r.Header.Set("Authorization", "Bearer "+key)
+		rsp, err := http.DefaultClient.Do(r)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	assert.Equal(t, 200, do("GET", "/v1/users", adminSecret))
+	assert.Equal(t, 200, do("GET", "/v1/users", readSecret))
+	assert.Equal(t, 401, do("POST", "/v1/orders/"+firstOrder.ID+"/cancel", readSecret))
+	assert.Equal(t, 401, do("GET", "/v1/users", revokedSecret))
+	assert.Equal(t, 401, do("GET", "/v1/users", models.APIKeyPrefix+"not-a-real-key"))
+	assert.Equal(t, 401, do("POST", "/v1/api_keys", adminSecret))
+
+	used := &models.APIKey{}
+	db.First(used, "id = ?", adminKey.ID)
+	assert.NotNil(t, used.LastUsedAt)
+}
+
+func createTestAPIKey(t *testing.T, db *gorm.DB, scope string) (*models.APIKey, string) {
+	apiKey, key, err := models.NewAPIKey("test "+scope, scope)
+	if !assert.NoError(t, err) || !assert.NoError(t, db.Create(apiKey).Error) {
+		t.FailNow()
+	}
+	return apiKey, key
+}
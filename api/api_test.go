@@ -1,15 +1,20 @@
 package api
 
 import (
+	"context"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/Sirupsen/logrus/hooks/test"
+	"github.com/guregu/kami"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
 )
 
 func TestTraceWrapper(t *testing.T) {
@@ -47,3 +52,189 @@ func TestTraceWrapper(t *testing.T) {
 		}
 	}
 }
+
+func TestVersionedRoutes(t *testing.T) {
+	api := NewAPI(new(conf.Configuration), nil, nil, nil, nil)
+
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+
+	client := http.Client{}
+	for path, code := range map[string]int{
+		"/v1/orders": 401,
+		"/orders":    401,
+		"/v2/orders": 404,
+	} {
+		rsp, err := client.Get(server.URL + path)
+		if assert.NoError(t, err) {
+			assert.Equal(t, code, rsp.StatusCode, "unexpected status for "+path)
+		}
+	}
+}
+
+func TestWebhookVerifierJS(t *testing.T) {
+	api := NewAPI(new(conf.Configuration), nil, nil, nil, nil)
+
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+
+	rsp, err := http.Get(server.URL + "/v1/webhooks/verify.js")
+	if assert.NoError(t, err) {
+		defer rsp.Body.Close()
+		body, _ := ioutil.ReadAll(rsp.Body)
+		assert.Equal(t, 200, rsp.StatusCode)
+		assert.Equal(t, "application/javascript", rsp.Header.Get("Content-Type"))
+		assert.Contains(t, string(body), `const SIGNATURE_HEADER = "X-Commerce-Signature";`)
+		assert.Contains(t, string(body), `const DELIVERY_HEADER = "X-Commerce-Delivery";`)
+	}
+}
+
+func TestRouteLogFields(t *testing.T) {
+	l, hook := test.NewNullLogger()
+
+	api := NewAPI(new(conf.Configuration), nil, nil, nil, nil)
+	api.log = logrus.NewEntry(l)
+
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+
+	rsp, err := http.Get(server.URL + "/v1/orders/first-order/payments")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 401, rsp.StatusCode)
+
+		found := false
+		for _, entry := range hook.Entries {
+			if entry.Data["route"] == "/orders/:order_id/payments" {
+				found = true
+				assert.Equal(t, "first-order", entry.Data["order_id"])
+			}
+		}
+		assert.True(t, found, "expected a log entry with the route")
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	api := NewAPI(new(conf.Configuration), nil, nil, nil, nil)
+
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+
+	for incoming, echoed := range map[string]bool{
+		"upstream-1234":      true,
+		"":                   false,
+		"bad id with spaces": false,
+	} {
+		r, _ := http.NewRequest("GET", server.URL, nil)
+		if incoming != "" {
+			r.Header.Set("X-Request-ID", incoming)
+		}
+		rsp, err := http.DefaultClient.Do(r)
+		if assert.NoError(t, err) {
+			id := rsp.Header.Get("X-Request-ID")
+			assert.NotEmpty(t, id)
+			assert.Equal(t, echoed, id == incoming, "unexpected request id for '"+incoming+"': "+id)
+		}
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+	config := new(conf.Configuration)
+	config.API.CORS.AllowedOrigins = []string{"https://shop.example.com"}
+	config.API.CORS.MaxAge = 600
+	config.API.CORS.ExposedHeaders = []string{"X-Custom"}
+	api := NewAPI(config, nil, nil, nil, nil)
+
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest("OPTIONS", server.URL+"/v1/orders", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		rsp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return rsp
+	}
+
+	rsp := preflight("https://shop.example.com")
+	assert.Equal(t, "https://shop.example.com", rsp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "600", rsp.Header.Get("Access-Control-Max-Age"))
+
+	rsp = preflight("https://evil.example.com")
+	assert.Empty(t, rsp.Header.Get("Access-Control-Allow-Origin"))
+
+	req, _ := http.NewRequest("GET", server.URL+"/", nil)
+	req.Header.Set("Origin", "https://shop.example.com")
+	rsp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Contains(t, rsp.Header.Get("Access-Control-Expose-Headers"), "X-Custom")
+	}
+}
+
+func TestQueriesStopWithTheRequest(t *testing.T) {
+	db, config := db(t)
+	ctx, cancel := context.WithCancel(testContext(testToken(testUser.ID, ""), config, false))
+	ctx = kami.SetParam(ctx, "id", firstOrder.ID)
+	cancel()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", urlForFirstOrder, nil)
+	NewAPI(config, db, nil, nil, nil).OrderView(ctx, w, r)
+	validateError(t, http.StatusInternalServerError, w)
+}
+
+func TestReportQueriesStopWithTheRequest(t *testing.T) {
+	db, config := db(t)
+	ctx, cancel := context.WithCancel(testContext(testToken("magical-unicorn", ""), config, true))
+	cancel()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/reports/tax_liability", nil)
+	NewAPI(config, db, nil, nil, nil).TaxLiabilityReport(ctx, w, r)
+	validateError(t, http.StatusInternalServerError, w)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	_, config := db(t)
+	config.DB.Automigrate = false
+	config.DB.QueryTimeout = 50 * time.Millisecond
+	db, err := models.Connect(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	start := time.Now()
+	count := 0
+	err = db.Raw("WITH RECURSIVE numbers(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM numbers) SELECT count(*) FROM numbers").Row().Scan(&count)
+	assert.Error(t, err, "the query never ends on its own")
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	order := &models.Order{}
+	assert.NoError(t, db.Preload("LineItems").First(order, "id = ?", firstOrder.ID).Error)
+	assert.Len(t, order.LineItems, 1)
+
+	tx := db.Begin()
+	assert.NoError(t, tx.Model(order).Update("email", "changed@example.com").Error)
+	assert.NoError(t, tx.Commit().Error)
+}
+
+func TestShutdownWhileStarting(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- api.ListenAndServe("127.0.0.1:0")
+	}()
+	assert.NoError(t, api.Shutdown(context.Background()))
+
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the server kept running after the shutdown")
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// audit records a change made by an admin in db, which is the transaction of
+// the change when there is one. before and after are snapshots of the
+// record, nil when it was created or deleted.
+func (a *API) audit(ctx context.Context, db *gorm.DB, r *http.Request, action, targetType, targetID string, before, after map[string]interface{}) {
+	if !isAdmin(ctx) {
+		return
+	}
+
+	entry := &models.AuditLog{
+		ActorType:  models.UserActor,
+		IP:         r.RemoteAddr,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Changes:    models.AuditDiff(before, after),
+	}
+	if claims := getClaims(ctx); claims != nil {
+		entry.ActorID = claims.ID
+		entry.ActorEmail = claims.Email
+	}
+	if key := getAPIKey(ctx); key != nil {
+		entry.ActorType = models.APIKeyActor
+		entry.ActorID = key.ID
+	}
+
+	if rsp := db.Create(entry); rsp.Error != nil {
+		getLogger(ctx).WithError(rsp.Error).WithField("action", action).Error("Failed to record audit log")
+	}
+}
+
+// AuditLogList lists the changes made by admins, the latest first. It
+// supports the filters:
+// actor_id     id of the user or API key
+// action       like order.update
+// target_type  like order
+// target_id    id
+// since        iso8601 date
+// before       iso8601 date
+func (a *API) AuditLogList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).Model(&models.AuditLog{})
+	params := r.URL.Query()
+	for _, field := range []string{"actor_id", "action", "target_type", "target_id"} {
+		if value := params.Get(field); value != "" {
+			query = query.Where(field+" = ?", value)
+		}
+	}
+	for param, op := range map[string]string{"since": ">=", "before": "<"} {
+		if value := params.Get(param); value != "" {
+			date, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				badRequestError(w, "Bad %s date, must be iso8601: %v", param, err)
+				return
+			}
+			query = query.Where("created_at "+op+" ?", date)
+		}
+	}
+
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	logs := []models.AuditLog{}
+	if rsp := query.Order("created_at desc, id desc").Offset(offset).Limit(limit).Find(&logs); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for audit logs")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, logs)
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestAuditOrderUpdate(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	ctx := testContext(testToken("magical-unicorn", "admin@example.com"), config, true)
+	ctx = kami.SetParam(ctx, "id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", urlForFirstOrder, strings.NewReader(`{"email": "changed@example.com", "fulfillment_state": "shipped"}`))
+	r.RemoteAddr = "10.0.0.1:1234"
+	api.OrderUpdate(ctx, w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/audit_logs?target_id="+firstOrder.ID, nil)
+	api.AuditLogList(ctx, w, r)
+	logs := []models.AuditLog{}
+	extractPayload(t, http.StatusOK, w, &logs)
+	if !assert.Len(t, logs, 1) {
+		return
+	}
+	entry := logs[0]
+	assert.Equal(t, "order.update", entry.Action)
+	assert.Equal(t, "order", entry.TargetType)
+	assert.Equal(t, models.UserActor, entry.ActorType)
+	assert.Equal(t, "magical-unicorn", entry.ActorID)
+	assert.Equal(t, "admin@example.com", entry.ActorEmail)
+	assert.Equal(t, "10.0.0.1:1234", entry.IP)
+	assert.Equal(t, models.AuditChange{Before: firstOrder.Email, After: "changed@example.com"}, entry.Changes["email"])
+	assert.Equal(t, "shipped", entry.Changes["fulfillment_state"].After)
+	assert.NotContains(t, entry.Changes, "updated_at")
+	assert.NotContains(t, entry.Changes, "currency", "only the changed fields are recorded")
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/audit_logs?action=payment.refund", nil)
+	api.AuditLogList(ctx, w, r)
+	extractPayload(t, http.StatusOK, w, &logs)
+	assert.Len(t, logs, 0)
+}
+
+func TestAuditAPIKeyActor(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	key, secret := createTestAPIKey(t, db, models.AdminScope)
+
+	r := httptest.NewRequest("PUT", "/v1/inventory/sku-1", strings.NewReader(`{"quantity": 5}`))
+	r.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	entry := &models.AuditLog{}
+	if assert.NoError(t, db.First(entry, "action = ?", "inventory.update").Error) {
+		assert.Equal(t, models.APIKeyActor, entry.ActorType)
+		assert.Equal(t, key.ID, entry.ActorID)
+		assert.Equal(t, "sku-1", entry.TargetID)
+		assert.Equal(t, models.AuditChange{After: float64(5)}, entry.Changes["quantity"])
+	}
+}
+
+func TestAuditLogListAsNonAdmin(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken(testUser.ID, ""), config, false)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/audit_logs", nil)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /audit_logs", api.AuditLogList)(ctx, w, r)
+	validateError(t, http.StatusUnauthorized, w)
+}
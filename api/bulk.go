@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// MaxBulkItems limits how many items a single bulk request can change
+const MaxBulkItems = 500
+
+// The outcomes of the items in a bulk request
+const (
+	BulkOK      = "ok"
+	BulkFailed  = "failed"
+	BulkSkipped = "skipped"
+)
+
+// BulkFulfillmentParams sets the fulfillment state of a set of orders
+type BulkFulfillmentParams struct {
+	OrderIDs         []string `json:"order_ids"`
+	FulfillmentState string   `json:"fulfillment_state"`
+}
+
+// BulkRefundParams refunds a set of payments
+type BulkRefundParams struct {
+	Refunds []struct {
+		PaymentID string `json:"payment_id"`
+		PaymentParams
+	} `json:"refunds"`
+}
+
+// BulkResult is the outcome of one item of a bulk request
+type BulkResult struct {
+	ID     string      `json:"id"`
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// BulkReport lists the outcome of every item. Committed is false when the
+// request was rolled back and nothing changed.
+type BulkReport struct {
+	Committed bool          `json:"committed"`
+	Results   []*BulkResult `json:"results"`
+}
+
+// failed marks the items that didn't fail as skipped, since none of them
+// were applied
+func (r *BulkReport) failed() bool {
+	failed := false
+	for _, result := range r.Results {
+		if result.Status == BulkFailed {
+			failed = true
+		}
+	}
+	if failed {
+		for _, result := range r.Results {
+			if result.Status != BulkFailed {
+				result.Status = BulkSkipped
+				result.Result = nil
+			}
+		}
+	}
+	return failed
+}
+
+// BulkFulfillment sets the fulfillment state of up to MaxBulkItems orders in
+// one transaction. If any of the orders can't be updated none of them are.
+func (a *API) BulkFulfillment(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := new(BulkFulfillmentParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		readError(w, "params", err)
+		return
+	}
+	if httpErr := validateBulkSize(len(params.OrderIDs)); httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	if !inList([]string{models.PendingState, models.ShippingState, models.ShippedState}, params.FulfillmentState) {
+		badRequestError(w, "Bad fulfillment state: %v", params.FulfillmentState)
+		return
+	}
+
+	claims := getClaims(ctx)
+	report := &BulkReport{}
+	tx := a.dbFor(ctx).Begin()
+	batch := a.events.Begin(tx)
+	for _, id := range params.OrderIDs {
+		result := &BulkResult{ID: id, Status: BulkOK}
+		report.Results = append(report.Results, result)
+
+		order := &models.Order{}
+		if rsp := tx.First(order, "id = ?", id); rsp.Error != nil {
+			result.Status = BulkFailed
+			if rsp.RecordNotFound() {
+				result.Error = "Order not found"
+			} else {
+				log.WithError(rsp.Error).WithField("order_id", id).Warn("Error while querying for order")
+				result.Error = "Error during database query"
+			}
+			continue
+		}
+		if order.State == models.CancelledState {
+			result.Status = BulkFailed
+			result.Error = "Order has been cancelled"
+			continue
+		}
+
+		before := models.Snapshot(order)
+		order.FulfillmentState = params.FulfillmentState
+		if rsp := tx.Model(order).UpdateColumn("fulfillment_state", order.FulfillmentState); rsp.Error != nil {
+			log.WithError(rsp.Error).WithField("order_id", id).Warn("Error while updating order")
+			result.Status = BulkFailed
+			result.Error = "Error saving order"
+			continue
+		}
+		models.LogEvent(tx, r.RemoteAddr, claims.ID, order.ID, models.EventUpdated, []string{"fulfillment_state"})
+		a.audit(ctx, tx, r, "order.update", "order", order.ID, before, models.Snapshot(order))
+		a.publish(ctx, batch, &events.Event{Type: webhooks.FulfillmentEvent, UserID: order.UserID, Payload: order})
+		result.Result = order
+	}
+
+	if report.failed() {
+		batch.Rollback()
+		sendJSON(w, http.StatusBadRequest, report)
+		return
+	}
+	if rsp := batch.Commit(); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to commit bulk fulfillment update")
+		internalServerError(w, "Error committing order updates")
+		return
+	}
+	report.Committed = true
+
+	log.Infof("Set the fulfillment state of %d orders to %s", len(params.OrderIDs), params.FulfillmentState)
+	sendJSON(w, http.StatusOK, report)
+}
+
+// BulkRefund refunds up to MaxBulkItems payments. All refunds are validated
+// first and nothing is refunded if any of them is invalid. Since refunds go
+// out to the payment provider one by one, a refund that is then rejected by
+// the provider doesn't undo the others, its result has the failed refund.
+func (a *API) BulkRefund(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := new(BulkRefundParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		readError(w, "params", err)
+		return
+	}
+	if httpErr := validateBulkSize(len(params.Refunds)); httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	config := getConfig(ctx)
+	report := &BulkReport{}
+	charges := []*models.Transaction{}
+	requested := map[string]uint64{}
+	for i := range params.Refunds {
+		item := &params.Refunds[i]
+		result := &BulkResult{ID: item.PaymentID, Status: BulkOK}
+		report.Results = append(report.Results, result)
+
+		charge := &models.Transaction{}
+		if rsp := a.dbFor(ctx).First(charge, "id = ?", item.PaymentID); rsp.Error != nil {
+			result.Status = BulkFailed
+			if rsp.RecordNotFound() {
+				result.Error = "Transaction not found"
+			} else {
+				log.WithError(rsp.Error).WithField("payment_id", item.PaymentID).Warn("Error while querying for transaction")
+				result.Error = "Error during database query"
+			}
+			continue
+		}
+		if item.Currency == "" {
+			item.Currency = charge.Currency
+		}
+		if httpErr := validateRefund(config, charge, &item.PaymentParams); httpErr != nil {
+			result.Status = BulkFailed
+			result.Error = httpErr.Message
+			continue
+		}
+		requested[charge.ID] += item.Amount
+		if requested[charge.ID] > charge.Amount {
+			result.Status = BulkFailed
+			result.Error = "The refunds of this payment add up to more than its amount"
+			continue
+		}
+		charges = append(charges, charge)
+	}
+	if report.failed() {
+		sendJSON(w, http.StatusBadRequest, report)
+		return
+	}
+
+	for i, charge := range charges {
+		m := newRefund(charge, &params.Refunds[i].PaymentParams)
+		batch := a.events.Begin(a.dbFor(ctx).Begin())
+		a.issueRefund(ctx, batch, charge, m)
+		a.audit(ctx, batch.Tx(), r, "payment.refund", "transaction", m.ID, nil, models.Snapshot(m))
+		batch.Commit()
+
+		result := report.Results[i]
+		result.Result = m
+		if m.Status == models.FailedState {
+			result.Status = BulkFailed
+			result.Error = m.FailureDescription
+		}
+	}
+	report.Committed = true
+
+	log.Infof("Made %d refunds", len(charges))
+	sendJSON(w, http.StatusOK, report)
+}
+
+func validateBulkSize(n int) *HTTPError {
+	if n == 0 {
+		return httpError(400, "Nothing to do, the request has no items")
+	}
+	if n > MaxBulkItems {
+		return httpError(400, "A bulk request can have at most %d items", MaxBulkItems)
+	}
+	return nil
+}
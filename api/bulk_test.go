@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestBulkFulfillment(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+
+	body := `{"order_ids": ["` + firstOrder.ID + `", "` + secondOrder.ID + `"], "fulfillment_state": "shipped"}`
+	r, _ := http.NewRequest("POST", "https://not-real/bulk/fulfillment", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	NewAPI(config, db, nil, nil, nil).BulkFulfillment(ctx, w, r)
+
+	report := new(BulkReport)
+	extractPayload(t, 200, w, report)
+	assert.True(t, report.Committed)
+	if assert.Len(t, report.Results, 2) {
+		assert.Equal(t, BulkOK, report.Results[0].Status)
+		assert.Equal(t, BulkOK, report.Results[1].Status)
+	}
+
+	for _, id := range []string{firstOrder.ID, secondOrder.ID} {
+		order := &models.Order{}
+		db.First(order, "id = ?", id)
+		assert.Equal(t, models.ShippedState, order.FulfillmentState)
+	}
+}
+
+func TestBulkFulfillmentRollsBack(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+
+	body := `{"order_ids": ["` + firstOrder.ID + `", "missing"], "fulfillment_state": "shipped"}`
+	r, _ := http.NewRequest("POST", "https://not-real/bulk/fulfillment", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	NewAPI(config, db, nil, nil, nil).BulkFulfillment(ctx, w, r)
+
+	report := new(BulkReport)
+	extractPayload(t, 400, w, report)
+	assert.False(t, report.Committed)
+	if assert.Len(t, report.Results, 2) {
+		assert.Equal(t, BulkSkipped, report.Results[0].Status)
+		assert.Equal(t, BulkFailed, report.Results[1].Status)
+		assert.Equal(t, "Order not found", report.Results[1].Error)
+	}
+
+	order := &models.Order{}
+	db.First(order, "id = ?", firstOrder.ID)
+	assert.Equal(t, firstOrder.FulfillmentState, order.FulfillmentState)
+}
+
+func TestBulkFulfillmentAsStranger(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("stranger", "stranger@example.com"), config, false)
+
+	r, _ := http.NewRequest("POST", "https://not-real/bulk/fulfillment", bytes.NewBufferString(`{}`))
+	w := httptest.NewRecorder()
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "POST /bulk/fulfillment", api.BulkFulfillment)(ctx, w, r)
+	validateError(t, 401, w)
+}
+
+func TestBulkRefund(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+	ctx = withPayer(ctx, StripeChargerType, &memProvider{})
+
+	body := `{"refunds": [{"payment_id": "` + firstTransaction.ID + `", "amount": 10, "reason": "customer_request"}]}`
+	r, _ := http.NewRequest("POST", "https://not-real/bulk/refunds", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	NewAPI(config, db, nil, nil, nil).BulkRefund(ctx, w, r)
+
+	report := new(BulkReport)
+	extractPayload(t, 200, w, report)
+	assert.True(t, report.Committed)
+	if assert.Len(t, report.Results, 1) {
+		assert.Equal(t, BulkOK, report.Results[0].Status)
+	}
+
+	refunds := []models.Transaction{}
+	db.Find(&refunds, "order_id = ? AND type = ?", firstOrder.ID, models.RefundTransactionType)
+	if assert.Len(t, refunds, 1) {
+		assert.EqualValues(t, 10, refunds[0].Amount)
+		assert.Equal(t, models.PaidState, refunds[0].Status)
+	}
+}
+
+func TestBulkRefundValidatesAllFirst(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+	ctx = withPayer(ctx, StripeChargerType, &memProvider{})
+
+	body := `{"refunds": [
+		{"payment_id": "` + firstTransaction.ID + `", "amount": 10, "reason": "customer_request"},
+		{"payment_id": "` + firstTransaction.ID + `", "amount": 10000, "reason": "customer_request"}
+	]}`
+	r, _ := http.NewRequest("POST", "https://not-real/bulk/refunds", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	NewAPI(config, db, nil, nil, nil).BulkRefund(ctx, w, r)
+
+	report := new(BulkReport)
+	extractPayload(t, 400, w, report)
+	assert.False(t, report.Committed)
+	if assert.Len(t, report.Results, 2) {
+		assert.Equal(t, BulkSkipped, report.Results[0].Status)
+		assert.Equal(t, BulkFailed, report.Results[1].Status)
+	}
+
+	var count int
+	db.Model(&models.Transaction{}).Where("order_id = ? AND type = ?", firstOrder.ID, models.RefundTransactionType).Count(&count)
+	assert.Equal(t, 0, count)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// CancelParams holds the parameters for cancelling an order
+type CancelParams struct {
+	Reason string `json:"reason"`
+}
+
+// OrderCancel cancels an order. It requires admin access and a reason code
+// from the configured cancellation reasons.
+// Orders that have already shipped can't be cancelled, and cancelling a paid
+// order doesn't refund it - that's done through the payment refund endpoint.
+// Whatever the order took out of stock is restocked.
+func (a *API) OrderCancel(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	orderID := kami.Param(ctx, "order_id")
+	log := getLogger(ctx).WithField("order_id", orderID)
+	claims := getClaims(ctx)
+
+	params := new(CancelParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		log.WithError(err).Infof("Failed to deserialize cancel params: %s", err.Error())
+		readError(w, "cancel params", err)
+		return
+	}
+
+	reasons := cancellationReasons(getConfig(ctx))
+	if !inList(reasons, params.Reason) {
+		badRequestError(w, "A cancellation requires a reason, must be one of: %v", strings.Join(reasons, ", "))
+		return
+	}
+
+	// the order is locked and read in the transaction, so a cancel racing
+	// another one or the expiry of the order doesn't restock it twice
+	tx := a.dbFor(ctx).Begin()
+	order := &models.Order{}
+	rsp := models.LockOrder(tx, orderID)
+	if rsp.Error == nil {
+		rsp = orderQuery(tx).First(order, "id = ?", orderID)
+	}
+	if rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			log.Warn("Cancel attempted for order that doesn't exist")
+			notFoundError(w, "Failed to find order with id '%s'", orderID)
+		} else {
+			log.WithError(rsp.Error).Warnf("Failed to query for id '%s'", orderID)
+			internalServerError(w, "Error while querying for order")
+		}
+		return
+	}
+
+	if order.State == models.CancelledState {
+		tx.Rollback()
+		badRequestError(w, "This order has already been cancelled")
+		return
+	}
+
+	if order.FulfillmentState == models.ShippedState {
+		tx.Rollback()
+		badRequestError(w, "Can't cancel an order that has been shipped")
+		return
+	}
+
+	before := models.Snapshot(order)
+	now := time.Now()
+	rsp = tx.Model(order).Updates(map[string]interface{}{
+		"state":               models.CancelledState,
+		"cancellation_reason": params.Reason,
+		"cancelled_at":        &now,
+	})
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Problem while cancelling order")
+		internalServerError(w, "Error cancelling order")
+		tx.Rollback()
+		return
+	}
+
+	if err := order.ReleaseInventory(tx); err != nil {
+		log.WithError(err).Warn("Problem while restocking cancelled order")
+		internalServerError(w, "Error restocking order")
+		tx.Rollback()
+		return
+	}
+
+	if err := models.ReverseReferralCredit(tx, order, order.Total); err != nil {
+		log.WithError(err).Warn("Problem while reversing the referral credit of cancelled order")
+		internalServerError(w, "Error reversing referral credit")
+		tx.Rollback()
+		return
+	}
+
+	models.LogEvent(tx, r.RemoteAddr, claims.ID, order.ID, models.EventUpdated, []string{"state", "cancellation_reason"})
+	a.audit(ctx, tx, r, "order.cancel", "order", order.ID, before, models.Snapshot(order))
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.CancellationEvent, UserID: order.UserID, Payload: order})
+	a.publishStock(ctx, batch, order)
+	if rsp := batch.Commit(); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Problem while committing order cancellation")
+		internalServerError(w, "Error committing order cancellation")
+		return
+	}
+
+	log.WithField("reason", params.Reason).Info("Cancelled order")
+	sendJSON(w, 200, order)
+}
+
+func cancellationReasons(config *conf.Configuration) []string {
+	if config != nil && len(config.Cancellations.Reasons) > 0 {
+		return config.Cancellations.Reasons
+	}
+	return conf.DefaultCancellationReasons
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderCancel(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"reason": "fraud"}`))
+
+	NewAPI(config, db, nil, nil, nil).OrderCancel(ctx, w, r)
+
+	order := &models.Order{}
+	extractPayload(t, 200, w, order)
+	assert.Equal(t, models.CancelledState, order.State)
+	assert.Equal(t, "fraud", order.CancellationReason)
+	assert.NotNil(t, order.CancelledAt)
+
+	stored := &models.Order{}
+	db.First(stored, "id = ?", firstOrder.ID)
+	assert.Equal(t, models.CancelledState, stored.State)
+	assert.Equal(t, "fraud", stored.CancellationReason)
+}
+
+func TestOrderCancelRestocksOnce(t *testing.T) {
+	db, config := db(t)
+	assert.NoError(t, db.Create(&models.InventoryItem{Sku: firstLineItem.Sku, Quantity: 10}).Error)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	cancel := func() *httptest.ResponseRecorder {
+		ctx := testContext(testToken("magical-unicorn", ""), config, true)
+		ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"reason": "fraud"}`))
+		api.OrderCancel(ctx, w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, cancel().Code)
+	validateError(t, http.StatusBadRequest, cancel())
+
+	item := &models.InventoryItem{}
+	assert.NoError(t, db.First(item, "sku = ?", firstLineItem.Sku).Error)
+	assert.Equal(t, int64(10+firstLineItem.Quantity), item.Quantity)
+}
+
+func TestOrderCancelUnknownReason(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"reason": "felt like it"}`))
+
+	NewAPI(config, db, nil, nil, nil).OrderCancel(ctx, w, r)
+	validateError(t, 400, w)
+}
+
+func TestOrderCancelAsNonAdmin(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken(testUser.ID, ""), config, false)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"reason": "fraud"}`))
+
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "POST /orders/:order_id/cancel", api.OrderCancel)(ctx, w, r)
+	validateError(t, 401, w)
+}
+
+func TestCancellationsReport(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"reason": "out_of_stock"}`))
+	api.OrderCancel(ctx, httptest.NewRecorder(), r)
+
+	w := httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://something?interval=day", nil)
+	api.CancellationsReport(ctx, w, r)
+
+	rows := []CancellationsRow{}
+	extractPayload(t, 200, w, &rows)
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, "cancellation", rows[0].Type)
+		assert.Equal(t, "out_of_stock", rows[0].Reason)
+		assert.EqualValues(t, 1, rows[0].Count)
+		assert.Equal(t, firstOrder.Total, rows[0].Amount)
+	}
+}
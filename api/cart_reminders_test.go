@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+func cartReminderConfig(config *conf.Configuration) {
+	config.JWT.Secret = "testsecret"
+	config.API.PublicURL = "https://api.example.com"
+	config.AbandonedCarts.RemindAfter = time.Hour
+	config.AbandonedCarts.MaxAge = 24 * time.Hour
+}
+
+func TestCartReminders(t *testing.T) {
+	db, config := db(t)
+	cartReminderConfig(config)
+	payFirstOrder(db)
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	// not abandoned yet
+	assert.Equal(t, 0, m.SendCartReminders(db, testLogger, time.Now()))
+
+	later := time.Now().Add(2 * time.Hour)
+	assert.Equal(t, 1, m.SendCartReminders(db, testLogger, later))
+	if assert.Len(t, sender.messages, 1) {
+		msg := sender.messages[0]
+		assert.Equal(t, secondOrder.Email, msg.To)
+		assert.Contains(t, msg.HTML, "utility belt")
+		assert.Contains(t, msg.HTML, "https://api.example.com/v1/emails/unsubscribe?")
+	}
+	order := &models.Order{}
+	db.First(order, "id = ?", secondOrder.ID)
+	assert.NotNil(t, order.ReminderSentAt)
+
+	// one reminder per order
+	assert.Equal(t, 0, m.SendCartReminders(db, testLogger, later))
+
+	// too old for a reminder
+	assert.NoError(t, db.Model(order).UpdateColumn("reminder_sent_at", nil).Error)
+	assert.Equal(t, 0, m.SendCartReminders(db, testLogger, time.Now().Add(48*time.Hour)))
+}
+
+func TestCartRemindersUnsubscribe(t *testing.T) {
+	db, config := db(t)
+	cartReminderConfig(config)
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	link, err := url.Parse(m.UnsubscribeURL(testUser.Email))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/emails/unsubscribe?email="+url.QueryEscape(testUser.Email)+"&token=forged", nil)
+	NewAPI(config, db, nil, m, nil).EmailUnsubscribe(testContext(nil, config, false), w, r)
+	validateError(t, 400, w)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/emails/unsubscribe?"+link.RawQuery, nil)
+	NewAPI(config, db, nil, m, nil).EmailUnsubscribe(testContext(nil, config, false), w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Regexp(t, regexp.MustCompile("won't get any more reminders"), w.Body.String())
+
+	optedOut, err := models.OptedOut(db, testUser.Email)
+	assert.NoError(t, err)
+	assert.True(t, optedOut)
+
+	assert.Equal(t, 0, m.SendCartReminders(db, testLogger, time.Now().Add(2*time.Hour)))
+	assert.Empty(t, sender.messages)
+}
+
+func TestCartRemindersUnsubscribePerInstance(t *testing.T) {
+	db, config := db(t)
+	cartReminderConfig(config)
+	config.MultiInstance.Enabled = true
+	assert.NoError(t, db.Create(&models.Instance{ID: "instance-a", Hostname: "a.example.com", Config: map[string]interface{}{
+		"jwt": map[string]interface{}{"secret": "secret-a"},
+	}}).Error)
+	api := NewAPI(config, db, nil, testMailerWith(config, &testSender{}), nil)
+	stores, err := api.MailStores(db)()
+	if !assert.NoError(t, err) || !assert.Len(t, stores, 1) {
+		return
+	}
+
+	link, err := url.Parse(stores[0].Mailer.UnsubscribeURL(testUser.Email))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "instance-a", link.Query().Get("instance"))
+	assert.True(t, mailer.ValidUnsubscribeToken("secret-a", testUser.Email, link.Query().Get("token")))
+
+	r := httptest.NewRequest("GET", "/v1/emails/unsubscribe?"+link.RawQuery, nil)
+	r.Host = "api.example.com"
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code, "the link reaches the instance through the API of the deployment")
+}
+
+func TestUnsubscribeToken(t *testing.T) {
+	token := mailer.UnsubscribeToken("secret", "Joe@Example.com")
+	assert.True(t, mailer.ValidUnsubscribeToken("secret", "joe@example.com", token))
+	assert.False(t, mailer.ValidUnsubscribeToken("other", "joe@example.com", token))
+	assert.False(t, mailer.ValidUnsubscribeToken("", "joe@example.com", mailer.UnsubscribeToken("", "joe@example.com")))
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// clientIP is the address the request comes from. Behind trusted proxies
+// it's the last address of X-Forwarded-For that isn't one of the proxies,
+// since clients can put anything they want before that.
+func clientIP(r *http.Request, proxies conf.Networks) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !proxies.Contains(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !proxies.Contains(hop) {
+			break
+		}
+	}
+	return ip
+}
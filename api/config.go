@@ -0,0 +1,21 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// ConfigView shows the effective configuration with its secrets redacted,
+// and which settings came from environment variables
+func (a *API) ConfigView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	inspection, err := conf.Inspect(getConfig(ctx))
+	if err != nil {
+		log.WithError(err).Error("Failed to inspect the configuration")
+		internalServerError(w, "Failed to inspect the configuration")
+		return
+	}
+	sendJSON(w, http.StatusOK, inspection)
+}
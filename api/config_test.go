@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+func TestConfigView(t *testing.T) {
+	db, config := db(t)
+	config.JWT.Secret = "jwt-secret"
+	config.Payment.Stripe.SecretKey = "sk_test_secret"
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/config", nil)
+	NewAPI(config, db, nil, nil, nil).ConfigView(ctx, w, r)
+
+	assert.NotContains(t, w.Body.String(), "sk_test_secret")
+	inspection := &conf.Inspection{}
+	extractPayload(t, http.StatusOK, w, inspection)
+	assert.Equal(t, "[redacted]", inspection.Config.JWT.Secret)
+	assert.Equal(t, "[redacted]", inspection.Config.Payment.Stripe.SecretKey)
+	assert.Equal(t, config.DB.Driver, inspection.Config.DB.Driver)
+}
+
+func TestConfigViewAsNonAdmin(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken(testUser.ID, ""), config, false)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/config", nil)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /config", api.ConfigView)(ctx, w, r)
+	validateError(t, http.StatusUnauthorized, w)
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"net"
+	"sort"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -8,6 +10,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
 )
 
 const (
@@ -18,7 +21,12 @@ const (
 	requestIDKey = "request_id"
 	startKey     = "request_start_time"
 	adminFlagKey = "is_admin"
+	scopesKey    = "scopes"
 	payerKey     = "payer_interface"
+	apiKeyKey    = "api_key"
+	instanceKey  = "instance"
+	operatorKey  = "is_operator"
+	clientIPKey  = "client_ip"
 )
 
 type ChargerType string
@@ -38,7 +46,12 @@ func withConfig(ctx context.Context, config *conf.Configuration) context.Context
 	return context.WithValue(ctx, configKey, config)
 }
 
+// withCoupons sets up the coupons at the coupons.url, the coupons of the
+// store don't need it
 func withCoupons(ctx context.Context, config *conf.Configuration) context.Context {
+	if config.Coupons.URL == "" {
+		return ctx
+	}
 	return context.WithValue(ctx, couponsKey, NewCouponCacheFromUrl(config))
 }
 
@@ -128,6 +141,42 @@ func isAdmin(ctx context.Context) bool {
 	return obj.(bool)
 }
 
+func withScopes(ctx context.Context, scopes map[string]bool) context.Context {
+	return context.WithValue(ctx, scopesKey, scopes)
+}
+
+// hasScope tells if the request was granted scope by the roles of its token.
+// Admins have every scope.
+func hasScope(ctx context.Context, scope string) bool {
+	if isAdmin(ctx) {
+		return true
+	}
+	scopes, _ := ctx.Value(scopesKey).(map[string]bool)
+	return scopes[scope]
+}
+
+// scopeList is the sorted list of the scopes, for the logs
+func scopeList(scopes map[string]bool) []string {
+	list := make([]string, 0, len(scopes))
+	for scope := range scopes {
+		list = append(list, scope)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func withAPIKey(ctx context.Context, key *models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyKey, key)
+}
+
+func getAPIKey(ctx context.Context) *models.APIKey {
+	obj := ctx.Value(apiKeyKey)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*models.APIKey)
+}
+
 func getLogger(ctx context.Context) *logrus.Entry {
 	obj := ctx.Value(loggerKey)
 	if obj == nil {
@@ -135,3 +184,47 @@ func getLogger(ctx context.Context) *logrus.Entry {
 	}
 	return obj.(*logrus.Entry)
 }
+
+func withInstance(ctx context.Context, state *instanceState) context.Context {
+	return context.WithValue(ctx, instanceKey, state)
+}
+
+func getInstanceState(ctx context.Context) *instanceState {
+	obj := ctx.Value(instanceKey)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*instanceState)
+}
+
+// getInstance returns the instance of a request in multi-instance mode
+func getInstance(ctx context.Context) *models.Instance {
+	if state := getInstanceState(ctx); state != nil {
+		return state.instance
+	}
+	return nil
+}
+
+func withOperator(ctx context.Context) context.Context {
+	return context.WithValue(ctx, operatorKey, true)
+}
+
+func isOperator(ctx context.Context) bool {
+	obj := ctx.Value(operatorKey)
+	if obj == nil {
+		return false
+	}
+	return obj.(bool)
+}
+
+func withClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+func getClientIP(ctx context.Context) net.IP {
+	obj := ctx.Value(clientIPKey)
+	if obj == nil {
+		return nil
+	}
+	return obj.(net.IP)
+}
@@ -1,17 +1,22 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
-	"golang.org/x/net/context"
 )
 
 const CacheTime = 1 * time.Minute
@@ -51,7 +56,7 @@ func NewCouponCacheFromUrl(config *conf.Configuration) CouponCache {
 		user:     config.Coupons.User,
 		password: config.Coupons.Password,
 		coupons:  map[string]*models.Coupon{},
-		client:   &http.Client{},
+		client:   config.HTTPClient(config.Timeouts.Coupons),
 	}
 }
 
@@ -101,17 +106,28 @@ func (c *CouponCacheFromURL) Lookup(code string) (*models.Coupon, error) {
 	return nil, &CouponNotFound{}
 }
 
+// lookupCoupon finds a coupon in the store, or else at the coupons.url
 func (a *API) lookupCoupon(ctx context.Context, w http.ResponseWriter, code string) (*models.Coupon, error) {
+	stored := &models.Coupon{}
+	rsp := a.dbFor(ctx).First(stored, "code = ?", code)
+	if rsp.Error == nil {
+		return stored, nil
+	}
+	if !rsp.RecordNotFound() {
+		internalServerError(w, "Error fetching coupon: %v", rsp.Error)
+		return nil, rsp.Error
+	}
+
 	coupons := getCoupons(ctx)
 	if coupons == nil {
-		notFoundError(w, "No coupons available")
-		return nil, errors.New("No coupons available")
+		notFoundError(w, CouponNotFound{}.Error())
+		return nil, CouponNotFound{}
 	}
 
 	coupon, err := coupons.Lookup(code)
 	if err != nil {
 		switch v := err.(type) {
-		case CouponNotFound:
+		case *CouponNotFound:
 			notFoundError(w, v.Error())
 		default:
 			internalServerError(w, "Error fetching coupon: %v", err)
@@ -127,7 +143,310 @@ func (a *API) CouponView(ctx context.Context, w http.ResponseWriter, r *http.Req
 	coupon, err := a.lookupCoupon(ctx, w, code)
 	if err != nil {
 		a.log.WithError(err).Infof("error loading coupon %v", err)
+		return
+	}
+	if !isAdmin(ctx) && (coupon.UserID != "" || coupon.Email != "") {
+		// who a coupon is for isn't told to whoever has its code
+		shown := *coupon
+		shown.UserID, shown.Email = "", ""
+		coupon = &shown
 	}
 
 	sendJSON(w, 200, coupon)
 }
+
+// checkCouponUses refuses coupons bound to another customer, referral codes
+// of returning customers, and coupons that were used as often as they can
+// be, overall or by the customer
+func checkCouponUses(db *gorm.DB, coupon *models.Coupon, userID, email string) *HTTPError {
+	if !coupon.ValidForUser(userID, email) {
+		return httpError(http.StatusBadRequest, "This coupon is for another customer")
+	}
+	if httpErr := checkReferral(db, coupon, userID, email); httpErr != nil {
+		return httpErr
+	}
+	if coupon.MaxUses == 0 && coupon.MaxUsesPerUser == 0 {
+		return nil
+	}
+	total, byUser, err := models.CountCouponRedemptions(db, coupon.Code, userID, email)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, "Error counting the coupon's redemptions: %v", err)
+	}
+	if coupon.MaxUses > 0 && total >= coupon.MaxUses {
+		return httpError(http.StatusBadRequest, "This coupon has been used up")
+	}
+	if coupon.MaxUsesPerUser > 0 && byUser >= coupon.MaxUsesPerUser {
+		return httpError(http.StatusBadRequest, "You have already used this coupon")
+	}
+	return nil
+}
+
+// redeemCoupon takes a redemption of the coupon of the order before it's
+// charged. The coupon is locked until the transaction ends, so concurrent
+// payments can't go past its limits.
+func redeemCoupon(tx *gorm.DB, order *models.Order) *HTTPError {
+	if order.Coupon == nil {
+		return nil
+	}
+	redeemed := 0
+	if err := tx.Model(&models.CouponRedemption{}).Where("order_id = ?", order.ID).Count(&redeemed).Error; err != nil {
+		return httpError(http.StatusInternalServerError, "Error during database query: %v", err)
+	}
+	if redeemed > 0 {
+		return nil
+	}
+	if err := models.LockCoupon(tx, order.CouponCode); err != nil {
+		return httpError(http.StatusInternalServerError, "Error locking the coupon: %v", err)
+	}
+	if httpErr := checkCouponUses(tx, order.Coupon, order.UserID, order.Email); httpErr != nil {
+		return httpErr
+	}
+	redemption := &models.CouponRedemption{
+		CouponCode: order.CouponCode,
+		OrderID:    order.ID,
+		UserID:     order.UserID,
+		Email:      strings.ToLower(order.Email),
+	}
+	if err := tx.Create(redemption).Error; err != nil {
+		return httpError(http.StatusInternalServerError, "Error recording the coupon redemption: %v", err)
+	}
+	return nil
+}
+
+// CouponStats is a coupon of the store with the number of orders paid with
+// it
+type CouponStats struct {
+	*models.Coupon
+	Redemptions uint64 `json:"redemptions"`
+}
+
+// couponStats counts the redemptions of the coupons
+func couponStats(db *gorm.DB, coupons ...*models.Coupon) ([]*CouponStats, error) {
+	codes := make([]string, len(coupons))
+	for i, coupon := range coupons {
+		codes[i] = coupon.Code
+	}
+	counts, err := models.CouponRedemptionCounts(db, codes)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]*CouponStats, len(coupons))
+	for i, coupon := range coupons {
+		stats[i] = &CouponStats{Coupon: coupon, Redemptions: counts[coupon.Code]}
+	}
+	return stats, nil
+}
+
+// couponCodePattern are the characters of coupon codes
+var couponCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// CouponParams holds the parameters for creating or updating a coupon
+type CouponParams struct {
+	Code         string                 `json:"code"`
+	Percentage   uint64                 `json:"percentage"`
+	FixedAmount  uint64                 `json:"fixed_amount"`
+	Currency     string                 `json:"currency"`
+	ProductTypes []string               `json:"product_types"`
+	StartDate    *time.Time             `json:"start_date"`
+	EndDate      *time.Time             `json:"end_date"`
+	Claims       map[string]interface{} `json:"claims"`
+
+	MaxUses        uint64 `json:"max_uses"`
+	MaxUsesPerUser uint64 `json:"max_uses_per_user"`
+
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// validate checks the coupon takes off either a percentage or an amount in a
+// currency
+func (p *CouponParams) validate() error {
+	switch {
+	case p.Percentage > 0 && p.FixedAmount > 0:
+		return fmt.Errorf("A coupon takes off either a percentage or a fixed amount")
+	case p.Percentage == 0 && p.FixedAmount == 0:
+		return fmt.Errorf("A coupon needs a percentage or a fixed amount")
+	case p.Percentage > 100:
+		return fmt.Errorf("The percentage can't be more than 100")
+	case p.FixedAmount > 0 && len(p.Currency) != 3:
+		return fmt.Errorf("A fixed amount needs the currency code it's in")
+	case p.StartDate != nil && p.EndDate != nil && !p.EndDate.After(*p.StartDate):
+		return fmt.Errorf("The end date has to be after the start date")
+	}
+	if p.Email != "" {
+		if _, err := mail.ParseAddress(p.Email); err != nil {
+			return fmt.Errorf("The email isn't a valid email address")
+		}
+	}
+	return nil
+}
+
+func (p *CouponParams) apply(coupon *models.Coupon) {
+	coupon.Percentage = p.Percentage
+	coupon.FixedAmount = p.FixedAmount
+	coupon.Currency = ""
+	if p.FixedAmount > 0 {
+		coupon.Currency = p.Currency
+	}
+	coupon.ProductTypes = p.ProductTypes
+	coupon.StartDate = p.StartDate
+	coupon.EndDate = p.EndDate
+	coupon.Claims = p.Claims
+	coupon.MaxUses = p.MaxUses
+	coupon.MaxUsesPerUser = p.MaxUsesPerUser
+	coupon.UserID = p.UserID
+	coupon.Email = p.Email
+}
+
+// CouponList lists the coupons of the store with their redemptions, the
+// ones at the coupons.url aren't included
+func (a *API) CouponList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).Model(&models.Coupon{})
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	coupons := []*models.Coupon{}
+	if rsp := query.Order("code asc").Offset(offset).Limit(limit).Find(&coupons); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for coupons")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+	stats, err := couponStats(a.dbFor(ctx), coupons...)
+	if err != nil {
+		log.WithError(err).Warn("Error while counting coupon redemptions")
+		internalServerError(w, "Error during database query: %v", err)
+		return
+	}
+
+	sendJSON(w, 200, stats)
+}
+
+// CouponCreate adds a coupon to the store
+func (a *API) CouponCreate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := new(CouponParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		readError(w, "coupon params", err)
+		return
+	}
+	if !couponCodePattern.MatchString(params.Code) {
+		badRequestError(w, "A coupon code has up to 64 letters, digits, dashes and underscores")
+		return
+	}
+	if err := params.validate(); err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+
+	tx := a.dbFor(ctx).Begin()
+	existing := 0
+	if rsp := tx.Model(&models.Coupon{}).Where("code = ?", params.Code).Count(&existing); rsp.Error != nil {
+		cleanup(tx, w, httpError(http.StatusInternalServerError, "Error during database query: %v", rsp.Error))
+		return
+	}
+	if existing > 0 {
+		cleanup(tx, w, httpError(http.StatusConflict, "There's already a coupon with the code '%s'", params.Code))
+		return
+	}
+
+	coupon := &models.Coupon{ID: uuid.NewRandom().String(), Code: params.Code}
+	params.apply(coupon)
+	if rsp := tx.Create(coupon); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to store coupon")
+		cleanup(tx, w, httpError(http.StatusInternalServerError, "Failed to store coupon"))
+		return
+	}
+	a.audit(ctx, tx, r, "coupon.create", "coupon", coupon.Code, nil, models.Snapshot(coupon))
+	if rsp := tx.Commit(); rsp.Error != nil {
+		internalServerError(w, "Failed to store coupon")
+		return
+	}
+
+	log.WithField("coupon", coupon.Code).Info("Created coupon")
+	sendJSON(w, 201, &CouponStats{Coupon: coupon})
+}
+
+// findStoredCoupon loads the coupon of the code in the path from the store,
+// the transaction is rolled back when it can't
+func (a *API) findStoredCoupon(ctx context.Context, tx *gorm.DB, w http.ResponseWriter) *models.Coupon {
+	code := kami.Param(ctx, "code")
+	coupon := &models.Coupon{}
+	if rsp := tx.First(coupon, "code = ?", code); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			cleanup(tx, w, httpError(http.StatusNotFound, "Coupon not found"))
+		} else {
+			getLogger(ctx).WithError(rsp.Error).Warn("Error while querying for coupon")
+			cleanup(tx, w, httpError(http.StatusInternalServerError, "Error during database query: %v", rsp.Error))
+		}
+		return nil
+	}
+	return coupon
+}
+
+// CouponUpdate replaces the discount, product types and dates of a coupon of
+// the store. The code can't be changed.
+func (a *API) CouponUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := new(CouponParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		readError(w, "coupon params", err)
+		return
+	}
+	if err := params.validate(); err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+
+	tx := a.dbFor(ctx).Begin()
+	coupon := a.findStoredCoupon(ctx, tx, w)
+	if coupon == nil {
+		return
+	}
+	before := models.Snapshot(coupon)
+	params.apply(coupon)
+	if rsp := tx.Save(coupon); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to update coupon")
+		cleanup(tx, w, httpError(http.StatusInternalServerError, "Failed to update coupon"))
+		return
+	}
+	a.audit(ctx, tx, r, "coupon.update", "coupon", coupon.Code, before, models.Snapshot(coupon))
+	if rsp := tx.Commit(); rsp.Error != nil {
+		internalServerError(w, "Failed to update coupon")
+		return
+	}
+
+	log.WithField("coupon", coupon.Code).Info("Updated coupon")
+	stats, err := couponStats(a.dbFor(ctx), coupon)
+	if err != nil {
+		internalServerError(w, "Error during database query: %v", err)
+		return
+	}
+	sendJSON(w, 200, stats[0])
+}
+
+// CouponDelete removes a coupon from the store. Orders keep the coupon they
+// were placed with.
+func (a *API) CouponDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	tx := a.dbFor(ctx).Begin()
+	coupon := a.findStoredCoupon(ctx, tx, w)
+	if coupon == nil {
+		return
+	}
+	if rsp := tx.Delete(coupon); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to delete coupon")
+		cleanup(tx, w, httpError(http.StatusInternalServerError, "Failed to delete coupon"))
+		return
+	}
+	a.audit(ctx, tx, r, "coupon.delete", "coupon", coupon.Code, models.Snapshot(coupon), nil)
+	if rsp := tx.Commit(); rsp.Error != nil {
+		internalServerError(w, "Failed to delete coupon")
+		return
+	}
+
+	log.WithField("coupon", coupon.Code).Info("Deleted coupon")
+}
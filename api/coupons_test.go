@@ -2,9 +2,11 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/guregu/kami"
@@ -63,3 +65,186 @@ func startTestCouponURLs(config *conf.Configuration) {
 
 	config.Coupons.URL = ts.URL
 }
+
+func runCouponRequest(t *testing.T, api *API, route, code, body string) *httptest.ResponseRecorder {
+	ctx := testContext(testToken("magical-unicorn", ""), api.config, true)
+	if code != "" {
+		ctx = kami.SetParam(ctx, "code", code)
+	}
+	handlers := map[string]kami.HandlerFunc{
+		"GET /coupons":          api.CouponList,
+		"POST /coupons":         api.CouponCreate,
+		"GET /coupons/:code":    api.CouponView,
+		"PUT /coupons/:code":    api.CouponUpdate,
+		"DELETE /coupons/:code": api.CouponDelete,
+	}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(strings.Fields(route)[0], "https://example.org", strings.NewReader(body))
+	guarded(t, api, route, handlers[route])(ctx, w, r)
+	return w
+}
+
+func TestCouponStore(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	created := &models.Coupon{}
+	extractPayload(t, http.StatusCreated, runCouponRequest(t, api, "POST /coupons", "", `{
+		"code": "SUMMER-10", "fixed_amount": 1000, "currency": "USD", "product_types": ["book"]
+	}`), created)
+	assert.Equal(t, "SUMMER-10", created.Code)
+	assert.Equal(t, uint64(1000), created.FixedDiscount())
+
+	validateError(t, http.StatusConflict, runCouponRequest(t, api, "POST /coupons", "", `{"code": "SUMMER-10", "percentage": 10}`))
+	validateError(t, http.StatusBadRequest, runCouponRequest(t, api, "POST /coupons", "", `{"code": "no spaces", "percentage": 10}`))
+	validateError(t, http.StatusBadRequest, runCouponRequest(t, api, "POST /coupons", "", `{"code": "BOTH", "percentage": 10, "fixed_amount": 100, "currency": "USD"}`))
+	validateError(t, http.StatusBadRequest, runCouponRequest(t, api, "POST /coupons", "", `{"code": "NO-CURRENCY", "fixed_amount": 100}`))
+
+	viewed := &models.Coupon{}
+	extractPayload(t, http.StatusOK, runCouponRequest(t, api, "GET /coupons/:code", "SUMMER-10", ""), viewed)
+	assert.Equal(t, []string{"book"}, viewed.ProductTypes)
+
+	updated := &models.Coupon{}
+	extractPayload(t, http.StatusOK, runCouponRequest(t, api, "PUT /coupons/:code", "SUMMER-10", `{"percentage": 15}`), updated)
+	assert.Equal(t, uint64(15), updated.Percentage)
+	assert.Equal(t, uint64(0), updated.FixedAmount)
+	assert.Empty(t, updated.ProductTypes)
+
+	list := []models.Coupon{}
+	extractPayload(t, http.StatusOK, runCouponRequest(t, api, "GET /coupons", "", ""), &list)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, uint64(15), list[0].Percentage)
+	}
+
+	assert.Equal(t, http.StatusOK, runCouponRequest(t, api, "DELETE /coupons/:code", "SUMMER-10", "").Code)
+	validateError(t, http.StatusNotFound, runCouponRequest(t, api, "GET /coupons/:code", "SUMMER-10", ""))
+	validateError(t, http.StatusNotFound, runCouponRequest(t, api, "DELETE /coupons/:code", "SUMMER-10", ""))
+}
+
+func TestStoredCouponsBeforeCouponURL(t *testing.T) {
+	db, config := db(t)
+	startTestCouponURLs(config)
+	assert.NoError(t, db.Create(&models.Coupon{ID: "stored", Code: "coupon-code", Percentage: 20}).Error)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	ctx := withCoupons(testContext(nil, config, false), config)
+	coupon, err := api.lookupCoupon(ctx, httptest.NewRecorder(), "coupon-code")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(20), coupon.Percentage)
+	}
+
+	assert.NoError(t, db.Delete(&models.Coupon{ID: "stored"}).Error)
+	coupon, err = api.lookupCoupon(ctx, httptest.NewRecorder(), "coupon-code")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(15), coupon.Percentage, "codes not in the store are looked up at the URL")
+	}
+
+	w := httptest.NewRecorder()
+	_, err = api.lookupCoupon(ctx, w, "unknown")
+	assert.Error(t, err)
+	validateError(t, http.StatusNotFound, w)
+}
+
+func runOrderCreateWithCoupon(t *testing.T, api *API, ctx context.Context, code string) *httptest.ResponseRecorder {
+	startTestSite(api.config)
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "https://not-real", strings.NewReader(`{
+		"email": "info@example.com",
+		"coupon": "`+code+`",
+		"shipping_address": {
+			"first_name": "Test", "last_name": "User",
+			"address1": "610 22nd Street",
+			"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`))
+	api.OrderCreate(ctx, recorder, req)
+	return recorder
+}
+
+func TestOrderCreationWithFixedCoupon(t *testing.T) {
+	db, config := db(t)
+	assert.NoError(t, db.Create(&models.Coupon{ID: "fixed", Code: "FIVE-OFF", FixedAmount: 500, Currency: "USD"}).Error)
+
+	order := &models.Order{}
+	api := NewAPI(config, db, nil, nil, nil)
+	extractPayload(t, http.StatusCreated, runOrderCreateWithCoupon(t, api, testContext(nil, config, false), "FIVE-OFF"), order)
+	assert.Equal(t, "FIVE-OFF", order.CouponCode)
+	assert.Equal(t, uint64(500), order.Discount)
+	assert.Equal(t, uint64(499), order.Total)
+}
+
+func TestCouponMaxUses(t *testing.T) {
+	db, config := db(t)
+	assert.NoError(t, db.Create(&models.Coupon{ID: "once", Code: "ONCE", Percentage: 10, MaxUses: 1}).Error)
+	assert.NoError(t, db.Model(secondOrder).Updates(map[string]interface{}{
+		"coupon_code": "ONCE",
+		"raw_coupon":  `{"code": "ONCE", "percentage": 10, "max_uses": 1}`,
+	}).Error)
+	api := NewAPI(config, db, nil, nil, nil)
+	redemptions := func() (count int) {
+		db.Model(&models.CouponRedemption{}).Where("coupon_code = ?", "ONCE").Count(&count)
+		return
+	}
+
+	validateError(t, http.StatusInternalServerError, runPaymentCreate(t, db, config, &chargeProvider{err: errors.New("card declined")}))
+	assert.Equal(t, 0, redemptions(), "a failed charge gives the redemption back")
+
+	assert.Equal(t, http.StatusOK, runPaymentCreate(t, db, config, &chargeProvider{id: "ch_123"}).Code)
+	assert.Equal(t, 1, redemptions())
+
+	validateError(t, http.StatusBadRequest, runOrderCreateWithCoupon(t, api, testContext(nil, config, false), "ONCE"))
+
+	list := []CouponStats{}
+	extractPayload(t, http.StatusOK, runCouponRequest(t, api, "GET /coupons", "", ""), &list)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "ONCE", list[0].Code)
+		assert.Equal(t, uint64(1), list[0].Redemptions)
+	}
+}
+
+func TestCouponMaxUsesPerUser(t *testing.T) {
+	db, config := db(t)
+	assert.NoError(t, db.Create(&models.Coupon{ID: "welcome", Code: "WELCOME", Percentage: 10, MaxUsesPerUser: 1}).Error)
+	redemption := &models.CouponRedemption{CouponCode: "WELCOME", OrderID: firstOrder.ID, UserID: testUser.ID, Email: "Info@Example.com"}
+	assert.NoError(t, db.Create(redemption).Error)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	userCtx := testContext(testToken(testUser.ID, testUser.Email), config, false)
+	validateError(t, http.StatusBadRequest, runOrderCreateWithCoupon(t, api, userCtx, "WELCOME"))
+	validateError(t, http.StatusBadRequest, runOrderCreateWithCoupon(t, api, testContext(nil, config, false), "WELCOME"))
+
+	assert.NoError(t, db.Model(redemption).UpdateColumn("email", testUser.Email).Error)
+	validateError(t, http.StatusBadRequest, runOrderCreateWithCoupon(t, api, userCtx, "WELCOME"))
+	assert.Equal(t, http.StatusCreated, runOrderCreateWithCoupon(t, api, testContext(nil, config, false), "WELCOME").Code)
+	otherCtx := testContext(testToken("another-user", "other@example.com"), config, false)
+	assert.Equal(t, http.StatusCreated, runOrderCreateWithCoupon(t, api, otherCtx, "WELCOME").Code)
+}
+
+func TestTargetedCoupons(t *testing.T) {
+	db, config := db(t)
+	assert.NoError(t, db.Create(&models.Coupon{ID: "sorry", Code: "SORRY", Percentage: 20, Email: "Sorry@example.com"}).Error)
+	assert.NoError(t, db.Create(&models.Coupon{ID: "winback", Code: "WINBACK", Percentage: 20, UserID: testUser.ID}).Error)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	userCtx := testContext(testToken(testUser.ID, testUser.Email), config, false)
+	assert.Equal(t, http.StatusCreated, runOrderCreateWithCoupon(t, api, userCtx, "WINBACK").Code)
+	validateError(t, http.StatusBadRequest, runOrderCreateWithCoupon(t, api, testContext(nil, config, false), "WINBACK"))
+	validateError(t, http.StatusBadRequest, runOrderCreateWithCoupon(t, api, userCtx, "SORRY"))
+
+	viewed := &models.Coupon{}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://example.org", nil)
+	api.CouponView(kami.SetParam(testContext(nil, config, false), "code", "SORRY"), w, r)
+	extractPayload(t, http.StatusOK, w, viewed)
+	assert.Equal(t, uint64(20), viewed.Percentage)
+	assert.Empty(t, viewed.Email, "who the coupon is for isn't shown")
+
+	assert.NoError(t, db.Model(secondOrder).Updates(map[string]interface{}{
+		"coupon_code": "WINBACK",
+		"raw_coupon":  `{"code": "WINBACK", "percentage": 20, "user_id": "someone-else"}`,
+	}).Error)
+	provider := &chargeProvider{id: "ch_123"}
+	validateError(t, http.StatusBadRequest, runPaymentCreate(t, db, config, provider))
+	assert.Equal(t, 0, provider.calls)
+}
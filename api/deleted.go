@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// OrderDelete soft deletes an order along with its line items and downloads.
+// It requires admin access, and can be undone with OrderRestore.
+func (a *API) OrderDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := kami.Param(ctx, "id")
+	log := getLogger(ctx).WithField("order_id", id)
+	order := &models.Order{}
+	if rsp := a.dbFor(ctx).First(order, "id = ?", id); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			notFoundError(w, "Order not found")
+		} else {
+			log.WithError(rsp.Error).Warn("Error while querying for order")
+			internalServerError(w, "Error during database query: %v", rsp.Error)
+		}
+		return
+	}
+
+	tx := a.dbFor(ctx).Begin()
+	if err := models.DeleteOrder(tx, order); err != nil {
+		tx.Rollback()
+		log.WithError(err).Warn("Failed to delete order")
+		internalServerError(w, "Failed to delete order")
+		return
+	}
+	models.LogEvent(tx, r.RemoteAddr, getClaims(ctx).ID, order.ID, models.EventDeleted, nil)
+	a.audit(ctx, tx, r, "order.delete", "order", order.ID, models.Snapshot(order), nil)
+	tx.Commit()
+
+	log.Info("Deleted order")
+}
+
+// DeletedOrderList lists the deleted orders, the most recently deleted
+// first. It requires admin access, and can be filtered by user_id.
+func (a *API) DeletedOrderList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	orders := []models.Order{}
+	a.listDeleted(ctx, w, r, &models.Order{}, &orders, true)
+}
+
+// DeletedUserList lists the deleted users, the most recently deleted first.
+// It requires admin access.
+func (a *API) DeletedUserList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	users := []models.User{}
+	a.listDeleted(ctx, w, r, &models.User{}, &users, false)
+}
+
+// DeletedAddressList lists the deleted addresses, the most recently deleted
+// first. It requires admin access, and can be filtered by user_id.
+func (a *API) DeletedAddressList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	addresses := []models.Address{}
+	a.listDeleted(ctx, w, r, &models.Address{}, &addresses, true)
+}
+
+func (a *API) listDeleted(ctx context.Context, w http.ResponseWriter, r *http.Request, model interface{}, records interface{}, byUser bool) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).Unscoped().Model(model).Where("deleted_at IS NOT NULL")
+	if userID := r.URL.Query().Get("user_id"); byUser && userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	if rsp := query.Order("deleted_at desc").Offset(offset).Limit(limit).Find(records); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for deleted records")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, records)
+}
+
+// OrderRestore undeletes an order along with the line items and downloads
+// that were deleted with it. It requires admin access.
+func (a *API) OrderRestore(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	order := &models.Order{}
+	a.restore(ctx, w, r, "order", kami.Param(ctx, "order_id"), order, func(tx *gorm.DB) error {
+		if err := models.RestoreOrder(tx, order); err != nil {
+			return err
+		}
+		models.LogEvent(tx, r.RemoteAddr, getClaims(ctx).ID, order.ID, models.EventUpdated, []string{"deleted_at"})
+		return nil
+	})
+}
+
+// UserRestore undeletes a user along with the orders, transactions, notes
+// and addresses that were deleted with it. It requires admin access.
+func (a *API) UserRestore(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	user := &models.User{}
+	a.restore(ctx, w, r, "user", kami.Param(ctx, "user_id"), user, func(tx *gorm.DB) error {
+		return models.RestoreUser(tx, user)
+	})
+}
+
+// AddressRestore undeletes an address. It requires admin access.
+func (a *API) AddressRestore(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	address := &models.Address{}
+	a.restore(ctx, w, r, "address", kami.Param(ctx, "addr_id"), address, func(tx *gorm.DB) error {
+		return models.RestoreAddress(tx, address)
+	})
+}
+
+// restore loads the deleted record with id and restores it in a transaction
+func (a *API) restore(ctx context.Context, w http.ResponseWriter, r *http.Request, recordType, id string, record interface{}, restore func(tx *gorm.DB) error) {
+	log := getLogger(ctx).WithField("record_id", id)
+	rsp := a.dbFor(ctx).Unscoped().Where("deleted_at IS NOT NULL").First(record, "id = ?", id)
+	if rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			notFoundError(w, "No deleted record with id %s", id)
+		} else {
+			log.WithError(rsp.Error).Warn("Error while querying for deleted record")
+			internalServerError(w, "Error during database query: %v", rsp.Error)
+		}
+		return
+	}
+
+	before := models.Snapshot(record)
+	tx := a.dbFor(ctx).Begin()
+	if err := restore(tx); err != nil {
+		tx.Rollback()
+		log.WithError(err).Warn("Failed to restore deleted record")
+		internalServerError(w, "Failed to restore record")
+		return
+	}
+	a.audit(ctx, tx, r, recordType+".restore", recordType, id, before, models.Snapshot(record))
+	if err := tx.Commit().Error; err != nil {
+		log.WithError(err).Warn("Failed to restore deleted record")
+		internalServerError(w, "Failed to restore record")
+		return
+	}
+
+	log.Info("Restored deleted record")
+	sendJSON(w, http.StatusOK, record)
+}
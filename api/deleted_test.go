@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderDeleteAndRestore(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("DELETE", urlForFirstOrder, nil)
+	api.OrderDelete(kami.SetParam(ctx, "id", firstOrder.ID), w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.True(t, db.First(&models.Order{}, "id = ?", firstOrder.ID).RecordNotFound())
+	assert.True(t, db.First(&models.LineItem{}, "id = ?", firstLineItem.ID).RecordNotFound())
+	stored := &models.Order{}
+	if assert.NoError(t, db.Unscoped().First(stored, "id = ?", firstOrder.ID).Error) {
+		assert.NotNil(t, stored.DeletedAt, "the order is only soft deleted")
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/deleted/orders", nil)
+	api.DeletedOrderList(ctx, w, r)
+	deleted := []models.Order{}
+	extractPayload(t, http.StatusOK, w, &deleted)
+	if assert.Len(t, deleted, 1) {
+		assert.Equal(t, firstOrder.ID, deleted[0].ID)
+		assert.NotNil(t, deleted[0].DeletedAt)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/deleted/orders/"+firstOrder.ID+"/restore", nil)
+	api.OrderRestore(kami.SetParam(ctx, "order_id", firstOrder.ID), w, r)
+	restored := &models.Order{}
+	extractPayload(t, http.StatusOK, w, restored)
+	assert.Nil(t, restored.DeletedAt)
+
+	assert.NoError(t, db.First(&models.Order{}, "id = ?", firstOrder.ID).Error)
+	assert.NoError(t, db.First(&models.LineItem{}, "id = ?", firstLineItem.ID).Error)
+
+	w = httptest.NewRecorder()
+	api.OrderRestore(kami.SetParam(ctx, "order_id", firstOrder.ID), w, r)
+	validateError(t, http.StatusNotFound, w)
+}
+
+func TestUserRestore(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+
+	// deleted before the user, so it stays deleted
+	removed := getTestAddress()
+	removed.UserID = testUser.ID
+	db.Create(removed)
+	db.Delete(removed)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("DELETE", urlWithUserID, nil)
+	api.UserDelete(kami.SetParam(ctx, "user_id", testUser.ID), w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, getUser(db, testUser.ID))
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/deleted/users", nil)
+	api.DeletedUserList(ctx, w, r)
+	users := []models.User{}
+	extractPayload(t, http.StatusOK, w, &users)
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, testUser.ID, users[0].ID)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/deleted/users/"+testUser.ID+"/restore", nil)
+	api.UserRestore(kami.SetParam(ctx, "user_id", testUser.ID), w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.NotNil(t, getUser(db, testUser.ID))
+	assert.NoError(t, db.First(&models.Order{}, "id = ?", secondOrder.ID).Error)
+	assert.NoError(t, db.First(&models.LineItem{}, "id = ?", secondLineItem1.ID).Error)
+	assert.NoError(t, db.First(&models.Address{}, "id = ?", testAddress.ID).Error)
+	assert.True(t, db.First(&models.Address{}, "id = ?", removed.ID).RecordNotFound())
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/deleted/addresses?user_id="+testUser.ID, nil)
+	api.DeletedAddressList(ctx, w, r)
+	addresses := []models.Address{}
+	extractPayload(t, http.StatusOK, w, &addresses)
+	if assert.Len(t, addresses, 1) {
+		assert.Equal(t, removed.ID, addresses[0].ID)
+	}
+
+	w = httptest.NewRecorder()
+	api.AddressRestore(kami.SetParam(ctx, "addr_id", removed.ID), w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, db.First(&models.Address{}, "id = ?", removed.ID).Error)
+}
+
+func TestDeletedAsNonAdmin(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	ctx := testContext(testToken(testUser.ID, ""), config, false)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/deleted/users", nil)
+	guarded(t, api, "GET /deleted/users", api.DeletedUserList)(ctx, w, r)
+	validateError(t, http.StatusUnauthorized, w)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", urlForFirstOrder, nil)
+	guarded(t, api, "DELETE /orders/:id", api.OrderDelete)(kami.SetParam(ctx, "id", firstOrder.ID), w, r)
+	validateError(t, http.StatusUnauthorized, w)
+}
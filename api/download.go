@@ -7,7 +7,9 @@ import (
 
 	"github.com/guregu/kami"
 	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/events"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
 )
 
 const MaxIPsPerDay = 50
@@ -15,10 +17,13 @@ const MaxIPsPerDay = 50
 func (a *API) DownloadURL(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	id := kami.Param(ctx, "id")
 	log := getLogger(ctx).WithField("download_id", id)
-	claims := getClaims(ctx)
+	userID := ""
+	if claims := getClaims(ctx); claims != nil {
+		userID = claims.ID
+	}
 
 	download := &models.Download{}
-	if result := a.db.Where("id = ?", id).First(download); result.Error != nil {
+	if result := a.dbFor(ctx).Where("id = ?", id).First(download); result.Error != nil {
 		if result.RecordNotFound() {
 			log.Debug("Requested record that doesn't exist")
 			notFoundError(w, "Download not found")
@@ -30,7 +35,7 @@ func (a *API) DownloadURL(ctx context.Context, w http.ResponseWriter, r *http.Re
 	}
 
 	order := &models.Order{}
-	if result := a.db.Where("id = ?", download.OrderID).First(order); result.Error != nil {
+	if result := a.dbFor(ctx).Where("id = ?", download.OrderID).First(order); result.Error != nil {
 		if result.RecordNotFound() {
 			log.Debug("Requested record that doesn't exist")
 			notFoundError(w, "Download order not found")
@@ -41,19 +46,12 @@ func (a *API) DownloadURL(ctx context.Context, w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	if order.UserID != "" {
-		if (order.UserID != claims.ID) && isAdmin(ctx) {
-			unauthorizedError(w, "Not Authorized to access this download")
-			return
-		}
-	}
-
 	if order.PaymentState != "paid" {
 		unauthorizedError(w, "This download has not been paid yet")
 		return
 	}
 
-	rows, err := a.db.Model(&models.Event{}).
+	rows, err := a.dbFor(ctx).Model(&models.Event{}).
 		Select("count(distinct(ip))").
 		Where("order_id = ? and created_at > ? and changes = 'download'", order.ID, time.Now().Add(-24*time.Hour)).
 		Rows()
@@ -77,10 +75,20 @@ func (a *API) DownloadURL(ctx context.Context, w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	tx := a.db.Begin()
+	tx := a.dbFor(ctx).Begin()
 	tx.Model(download).Updates(map[string]interface{}{"download_count": gorm.Expr("download_count + 1")})
-	models.LogEvent(tx, r.RemoteAddr, claims.ID, order.ID, models.EventUpdated, []string{"download"})
-	tx.Commit()
+	models.LogEvent(tx, r.RemoteAddr, userID, order.ID, models.EventUpdated, []string{"download"})
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.DownloadEvent, UserID: order.UserID, Payload: &DownloadAccess{
+		DownloadID: download.ID,
+		OrderID:    order.ID,
+		UserID:     order.UserID,
+		Sku:        download.Sku,
+		Title:      download.Title,
+		IP:         r.RemoteAddr,
+		Downloads:  download.DownloadCount + 1,
+	}})
+	batch.Commit()
 
 	sendJSON(w, 200, download)
 }
@@ -93,14 +101,16 @@ func (a *API) DownloadList(ctx context.Context, w http.ResponseWriter, r *http.R
 	}
 	claims := getClaims(ctx)
 
-	if orderID == "" && (claims == nil || claims.ID == "") {
+	// the route policy requires a token, but one without an ID would list
+	// the downloads of every anonymous order
+	if orderID == "" && claims.ID == "" {
 		unauthorizedError(w, "Listing all downloads requires authentication")
 		return
 	}
 
 	order := &models.Order{}
 	if orderID != "" {
-		if result := a.db.Where("id = ?", orderID).First(order); result.Error != nil {
+		if result := a.dbFor(ctx).Where("id = ?", orderID).First(order); result.Error != nil {
 			if result.RecordNotFound() {
 				log.Debug("Requested record that doesn't exist")
 				notFoundError(w, "Download order not found")
@@ -114,11 +124,6 @@ func (a *API) DownloadList(ctx context.Context, w http.ResponseWriter, r *http.R
 		order = nil
 	}
 
-	if order != nil && order.UserID != "" && order.UserID != claims.ID {
-		unauthorizedError(w, "You don't have permission to access this order")
-		return
-	}
-
 	if order != nil && order.PaymentState != "paid" {
 		unauthorizedError(w, "This order has not been completed yet")
 		return
@@ -127,7 +132,7 @@ func (a *API) DownloadList(ctx context.Context, w http.ResponseWriter, r *http.R
 	orderTable := models.Order{}.TableName()
 	downloadsTable := models.Download{}.TableName()
 
-	query := a.db.Joins("join " + orderTable + " as orders ON " + downloadsTable + ".order_id = orders.id and orders.payment_state = 'paid'")
+	query := a.dbFor(ctx).Joins("join " + orderTable + " as orders ON " + downloadsTable + ".order_id = orders.id and orders.payment_state = 'paid'")
 	if order != nil {
 		query = query.Where("orders.id = ?", order.ID)
 	} else {
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+// EmailPreview is a rendered mail that wasn't sent
+type EmailPreview struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+	// Attachments are the file names of the attachments
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// EmailPreviewView renders one of the mails about an order without sending
+// it. The mail is about the ?order_id, or else about a sample order.
+// With ?format=html the mail itself is returned, to view it in a browser, and
+// with ?format=text its plain text alternative.
+func (a *API) EmailPreviewView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	m := a.mailerFor(ctx)
+	if m == nil {
+		m = mailer.NewMailer(getConfig(ctx))
+	}
+
+	transaction := sampleTransaction()
+	if id := r.URL.Query().Get("order_id"); id != "" {
+		order := &models.Order{}
+		if result := orderQuery(a.dbFor(ctx)).First(order, "id = ? OR ref = ?", id, id); result.Error != nil {
+			if result.RecordNotFound() {
+				notFoundError(w, "Order not found")
+			} else {
+				log.WithError(result.Error).Warnf("Error while querying database: %s", result.Error.Error())
+				internalServerError(w, "Error during database query: %v", result.Error)
+			}
+			return
+		}
+		transaction = models.NewTransaction(order)
+		for _, t := range order.Transactions {
+			if t.Type == models.ChargeTransactionType {
+				transaction = t
+				transaction.Order = order
+				break
+			}
+		}
+	}
+
+	name := kami.Param(ctx, "template")
+	msg, err := m.PreviewOrderMail(name, transaction)
+	if err != nil {
+		log.WithError(err).Infof("Failed to render the %s mail", name)
+		badRequestError(w, "Failed to render the %s mail: %v", name, err)
+		return
+	}
+	if msg == nil {
+		notFoundError(w, "Unknown mail '%s', must be one of: %s", name, strings.Join(mailer.OrderMails(), ", "))
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(msg.HTML))
+		return
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(msg.Text))
+		return
+	}
+	preview := &EmailPreview{To: msg.To, Subject: msg.Subject, HTML: msg.HTML, Text: msg.Text}
+	for _, attachment := range msg.Attachments {
+		preview.Attachments = append(preview.Attachments, attachment.Filename)
+	}
+	sendJSON(w, http.StatusOK, preview)
+}
+
+// sampleTransaction is a paid order to preview mails with when no real order
+// is given
+func sampleTransaction() *models.Transaction {
+	order := models.NewOrder("", "customer@example.com", "USD")
+	order.ID = "sample-order"
+	order.Ref = "SAMPLE-1"
+	order.CreatedAt = time.Now()
+	order.LineItems = []*models.LineItem{
+		{Title: "Sample T-Shirt", Sku: "sample-shirt", Type: "apparel", Price: 2500, Quantity: 2},
+		{Title: "Sample E-Book", Sku: "sample-book", Type: "book", Price: 999, Quantity: 1},
+	}
+	order.CalculateTotal(&calculator.Settings{})
+	order.ShippingAddress = models.Address{AddressRequest: models.AddressRequest{
+		FirstName: "Jane",
+		LastName:  "Doe",
+		Address1:  "1 Sample Street",
+		City:      "San Francisco",
+		State:     "CA",
+		Zip:       "94107",
+		Country:   "USA",
+	}}
+	order.BillingAddress = order.ShippingAddress
+	order.PaymentState = models.PaidState
+	order.FulfillmentState = models.ShippedState
+	order.Carrier = "UPS"
+	order.TrackingNumber = "1Z999AA10123456784"
+	order.TrackingURL = "https://www.ups.com/track?tracknum=1Z999AA10123456784"
+
+	transaction := models.NewTransaction(order)
+	transaction.Status = models.PaidState
+	order.Transactions = []*models.Transaction{transaction}
+	return transaction
+}
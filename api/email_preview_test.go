@@ -0,0 +1,84 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailPreviewSampleOrder(t *testing.T) {
+	db, config := db(t)
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "template", "order_confirmation")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/emails/preview/order_confirmation", nil)
+	NewAPI(config, db, nil, m, nil).EmailPreviewView(ctx, w, r)
+
+	preview := &EmailPreview{}
+	extractPayload(t, 200, w, preview)
+	assert.Equal(t, "customer@example.com", preview.To)
+	assert.Equal(t, "Order Confirmation", preview.Subject)
+	assert.Contains(t, preview.HTML, "Sample T-Shirt")
+	assert.Contains(t, preview.HTML, "SAMPLE-1")
+	assert.Empty(t, sender.messages)
+}
+
+func TestEmailPreviewRealOrder(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "template", "order_received")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/emails/preview/order_received?order_id="+firstOrder.ID+"&format=html", nil)
+	NewAPI(config, db, nil, nil, nil).EmailPreviewView(ctx, w, r)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "Order Received From "+firstOrder.Email)
+	assert.Contains(t, w.Body.String(), "batwing")
+}
+
+func TestEmailPreviewErrors(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "template", "newsletter")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/emails/preview/newsletter", nil)
+	NewAPI(config, db, nil, nil, nil).EmailPreviewView(ctx, w, r)
+	validateError(t, 404, w)
+
+	ctx = kami.SetParam(ctx, "template", "order_confirmation")
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/emails/preview/order_confirmation?order_id=nope", nil)
+	NewAPI(config, db, nil, nil, nil).EmailPreviewView(ctx, w, r)
+	validateError(t, 404, w)
+
+	ctx = testContext(testToken("stranger", "stranger@example.com"), config, false)
+	ctx = kami.SetParam(ctx, "template", "order_confirmation")
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/emails/preview/order_confirmation", nil)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /emails/preview/:template", api.EmailPreviewView)(ctx, w, r)
+	validateError(t, 401, w)
+}
+
+func TestEmailPreviewRefund(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "template", "refund_confirmation")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/emails/preview/refund_confirmation", nil)
+	NewAPI(config, db, nil, nil, nil).EmailPreviewView(ctx, w, r)
+
+	preview := &EmailPreview{}
+	extractPayload(t, 200, w, preview)
+	// the sample order of $59.99 gets a refund of half of it
+	assert.Equal(t, "Your refund of $29.99", preview.Subject)
+	assert.Contains(t, preview.HTML, "remaining balance of the order is <strong>$30.00</strong>")
+}
@@ -12,6 +12,20 @@ func badRequestError(w http.ResponseWriter, fmtString string, args ...interface{
 	return err
 }
 
+// errBodyTooLarge is what reading a body past its limit fails with
+const errBodyTooLarge = "http: request body too large"
+
+// readError answers a request whose body couldn't be read, with a 413 when it
+// was over the limit
+func readError(w http.ResponseWriter, what string, err error) *HTTPError {
+	if err.Error() == errBodyTooLarge {
+		e := httpError(http.StatusRequestEntityTooLarge, "The request body is too large")
+		sendJSON(w, e.Code, e)
+		return e
+	}
+	return badRequestError(w, "Could not read %s: %v", what, err)
+}
+
 func unprocessableEntity(w http.ResponseWriter, fmtString string, args ...interface{}) *HTTPError {
 	err := httpError(422, fmtString, args...)
 	sendJSON(w, err.Code, err)
@@ -40,6 +54,14 @@ func unauthorizedError(w http.ResponseWriter, fmtString string, args ...interfac
 type HTTPError struct {
 	Code    int    `json:"code"`
 	Message string `json:"msg"`
+	// Errors tell which fields of the request are invalid
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is an invalid field of a request, like line_items[0].quantity
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"msg"`
 }
 
 func (e HTTPError) Error() string {
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// eventsMetric counts the committed events by type
+var eventsMetric = expvar.NewMap("events")
+
+// eventPayload is implemented by the payloads the order of an event can't
+// otherwise be told from
+type eventPayload interface {
+	eventOrderID() string
+}
+
+// subscribe sets up the side effects of the events the handlers publish
+func (a *API) subscribe() {
+	a.events.SubscribeTx(events.All, a.queueHooks)
+	a.events.Subscribe(events.All, a.notifyOrderStreams)
+	a.events.Subscribe(events.All, countEvent)
+	if a.mailer != nil {
+		a.subscribeBackground(webhooks.PaymentEvent, "order_confirmation_mail", a.sendOrderConfirmationMail)
+		a.subscribeBackground(webhooks.PaymentEvent, "order_received_mail", a.sendOrderReceivedMail)
+		a.subscribeBackground(webhooks.FulfillmentEvent, "shipping_mail", a.sendShippingMail)
+		a.subscribeBackground(webhooks.RefundEvent, "refund_mail", a.sendRefundMail)
+	}
+	if a.currentConfig().Worker.Enabled {
+		a.events.SubscribeTx(events.All, a.queueEventJob)
+	}
+}
+
+// publish fills in the order and request of an event and adds it to the
+// batch of the transaction
+func (a *API) publish(ctx context.Context, batch *events.Batch, e *events.Event) {
+	if e.OrderID == "" {
+		switch p := e.Payload.(type) {
+		case *models.Order:
+			e.OrderID = p.ID
+		case *models.Transaction:
+			e.OrderID = p.OrderID
+		case eventPayload:
+			e.OrderID = p.eventOrderID()
+		}
+	}
+	e.RequestID = getRequestID(ctx)
+	if instance := getInstance(ctx); instance != nil {
+		e.InstanceID = instance.ID
+	}
+	batch.Publish(ctx, e)
+}
+
+// notifyOrderStreams wakes up the event streams of the order
+func (a *API) notifyOrderStreams(e *events.Event) {
+	if e.OrderID != "" {
+		a.orderEvents.notify(e.OrderID)
+	}
+}
+
+// sendOrderConfirmationMail sends the order confirmation to the customer
+func (a *API) sendOrderConfirmationMail(e *events.Event) error {
+	if e.Transaction == nil || e.Transaction.Order == nil {
+		return nil
+	}
+	m := a.eventMailer(e)
+	if m == nil {
+		return nil
+	}
+	if err := m.OrderConfirmationMail(e.Transaction); err != nil {
+		return fmt.Errorf("Error sending order confirmation mail: %v", err)
+	}
+	return nil
+}
+
+// sendOrderReceivedMail lets the shop know about the order
+func (a *API) sendOrderReceivedMail(e *events.Event) error {
+	if e.Transaction == nil || e.Transaction.Order == nil {
+		return nil
+	}
+	m := a.eventMailer(e)
+	if m == nil {
+		return nil
+	}
+	if err := m.OrderReceivedMail(e.Transaction); err != nil {
+		return fmt.Errorf("Error sending order received mail: %v", err)
+	}
+	return nil
+}
+
+// sendShippingMail sends the shipping confirmation when an order has shipped
+// or its tracking changed after it shipped
+func (a *API) sendShippingMail(e *events.Event) error {
+	payload, ok := e.Payload.(*models.Order)
+	if !ok || payload.FulfillmentState != models.ShippedState {
+		return nil
+	}
+	m := a.eventMailer(e)
+	if m == nil {
+		return nil
+	}
+
+	// the order in the event may come without its line items and addresses
+	order := &models.Order{}
+	if rsp := orderQuery(models.ForInstance(a.db, e.InstanceID)).First(order, "id = ?", payload.ID); rsp.Error != nil {
+		return fmt.Errorf("Error loading order for the shipping confirmation: %v", rsp.Error)
+	}
+	if err := m.ShippingConfirmationMail(order); err != nil {
+		return fmt.Errorf("Error sending shipping confirmation mail: %v", err)
+	}
+	return nil
+}
+
+// sendRefundMail lets the customer know about a refund that went through.
+// Store credits don't get a mail.
+func (a *API) sendRefundMail(e *events.Event) error {
+	refund := e.Transaction
+	if refund == nil || refund.Type != models.RefundTransactionType || refund.Status != models.PaidState {
+		return nil
+	}
+	m := a.eventMailer(e)
+	if m == nil {
+		return nil
+	}
+
+	order := &models.Order{}
+	if rsp := orderQuery(models.ForInstance(a.db, e.InstanceID)).First(order, "id = ?", refund.OrderID); rsp.Error != nil {
+		return fmt.Errorf("Error loading order for the refund confirmation: %v", rsp.Error)
+	}
+	mailed := *refund
+	mailed.Order = order
+	if err := m.RefundConfirmationMail(&mailed); err != nil {
+		return fmt.Errorf("Error sending refund confirmation mail: %v", err)
+	}
+	return nil
+}
+
+func countEvent(e *events.Event) {
+	eventsMetric.Add(e.Type, 1)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+func TestCommittedEventsReachSubscribers(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	received := make(chan *events.Event, 10)
+	api.events.Subscribe(webhooks.CancellationEvent, func(e *events.Event) {
+		received <- e
+	})
+	before := eventCount(webhooks.CancellationEvent)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	ctx = withRequestID(ctx, "test-request")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"reason": "fraud"}`))
+	api.OrderCancel(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+	api.events.Wait()
+
+	if assert.Len(t, received, 1) {
+		e := <-received
+		assert.Equal(t, firstOrder.ID, e.OrderID)
+		assert.Equal(t, "test-request", e.RequestID)
+	}
+	assert.Equal(t, before+1, eventCount(webhooks.CancellationEvent))
+}
+
+func TestFailedRequestsPublishNothing(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	received := make(chan *events.Event, 10)
+	api.events.Subscribe(events.All, func(e *events.Event) {
+		received <- e
+	})
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"reason": "not-a-reason"}`))
+	api.OrderCancel(ctx, w, r)
+	validateError(t, 400, w)
+	api.events.Wait()
+
+	assert.Len(t, received, 0)
+}
+
+func TestShippingConfirmationMail(t *testing.T) {
+	db, config := db(t)
+	sender := &testSender{}
+	api := NewAPI(config, db, nil, testMailerWith(config, sender), nil)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "http://something", strings.NewReader(`{"fulfillment_state": "shipping"}`))
+	api.OrderUpdate(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+	api.events.Wait()
+	assert.Empty(t, sender.messages)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "http://something", strings.NewReader(
+		`{"fulfillment_state": "shipped", "carrier": "UPS", "tracking_number": "1Z999", "tracking_url": "https://ups.example.com/track/1Z999"}`))
+	api.OrderUpdate(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+	api.events.Wait()
+
+	if assert.Len(t, sender.messages, 1) {
+		msg := sender.messages[0]
+		assert.Equal(t, firstOrder.Email, msg.To)
+		assert.Equal(t, "Your order has shipped", msg.Subject)
+		assert.Contains(t, msg.HTML, `<a href="https://ups.example.com/track/1Z999">1Z999</a>`)
+		assert.Contains(t, msg.HTML, "with UPS")
+		assert.Contains(t, msg.HTML, "batwing")
+	}
+
+	// sending the same tracking again doesn't mail the customer again
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "http://something", strings.NewReader(
+		`{"fulfillment_state": "shipped", "carrier": "UPS", "tracking_number": "1Z999", "tracking_url": "https://ups.example.com/track/1Z999"}`))
+	api.OrderUpdate(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+	api.events.Wait()
+	assert.Len(t, sender.messages, 1)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "http://something", strings.NewReader(`{"tracking_url": "javascript:alert(1)"}`))
+	api.OrderUpdate(ctx, w, r)
+	validateError(t, 400, w)
+}
+
+func TestRefundConfirmationMail(t *testing.T) {
+	db, config := db(t)
+	payFirstOrder(db)
+	config.Mailer.RefundSettlement = "3 days"
+	sender := &testSender{}
+	api := NewAPI(config, db, nil, testMailerWith(config, sender), nil)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "pay_id", firstTransaction.ID)
+	ctx = withPayer(ctx, StripeChargerType, &memProvider{})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"amount": 40, "currency": "usd", "reason": "customer_request"}`))
+	api.PaymentRefund(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+	api.events.Wait()
+
+	if assert.Len(t, sender.messages, 1) {
+		msg := sender.messages[0]
+		assert.Equal(t, firstOrder.Email, msg.To)
+		assert.Equal(t, "Your refund of $0.40", msg.Subject)
+		assert.Contains(t, msg.HTML, "within 3 days")
+		assert.Contains(t, msg.HTML, "remaining balance of the order is <strong>$0.60</strong>")
+	}
+
+	// store credits don't get a refund mail
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "http://something", strings.NewReader(`{"type": "credit", "amount": 10, "reason": "damaged_item"}`))
+	api.OrderGoodwill(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+	api.events.Wait()
+	assert.Len(t, sender.messages, 1)
+}
+
+func eventCount(eventType string) int64 {
+	if v, ok := eventsMetric.Get(eventType).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+var errNoRates = errors.New("No exchange rate provider is configured")
+
+// exchangeRates are the units of every currency for one unit of the base
+// currency
+type exchangeRates struct {
+	Base  string             `json:"base"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// rate is the units of one currency for one unit of the other, crossed
+// through the base currency
+func (r *exchangeRates) rate(from, to string) (float64, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	if from == to {
+		return 1, nil
+	}
+	perBase := func(currency string) (float64, error) {
+		if currency == strings.ToUpper(r.Base) {
+			return 1, nil
+		}
+		if rate := r.Rates[currency]; rate > 0 {
+			return rate, nil
+		}
+		return 0, fmt.Errorf("No exchange rate for %v", currency)
+	}
+	fromRate, err := perBase(from)
+	if err != nil {
+		return 0, err
+	}
+	toRate, err := perBase(to)
+	if err != nil {
+		return 0, err
+	}
+	return toRate / fromRate, nil
+}
+
+// rateProvider fetches the latest exchange rates
+type rateProvider interface {
+	latestRates(ctx context.Context) (*exchangeRates, error)
+}
+
+// rateProviderFor is the provider set up in the configuration, nil if there
+// is none
+func rateProviderFor(config *conf.Configuration) rateProvider {
+	rates := config.Currencies.Rates
+	client := config.HTTPClient(config.Timeouts.Rates)
+	switch rates.Provider {
+	case conf.ECBRates:
+		return &ecbProvider{url: rates.URL, client: client}
+	case conf.OpenExchangeRatesRates:
+		return &openExchangeRatesProvider{url: rates.URL, appID: rates.APIKey, client: client}
+	}
+	return nil
+}
+
+func getRates(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Fetching exchange rates failed with status %v", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// ecbProvider reads the daily reference rates of the European Central Bank,
+// against the euro
+type ecbProvider struct {
+	url    string
+	client *http.Client
+}
+
+type ecbEnvelope struct {
+	Cube struct {
+		Cube struct {
+			Rates []struct {
+				Currency string  `xml:"currency,attr"`
+				Rate     float64 `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube"`
+	} `xml:"Cube"`
+}
+
+func (p *ecbProvider) latestRates(ctx context.Context) (*exchangeRates, error) {
+	resp, err := getRates(ctx, p.client, p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	envelope := &ecbEnvelope{}
+	if err := xml.NewDecoder(resp.Body).Decode(envelope); err != nil {
+		return nil, fmt.Errorf("Error parsing the ECB rates: %v", err)
+	}
+	rates := &exchangeRates{Base: "EUR", Rates: map[string]float64{}}
+	for _, rate := range envelope.Cube.Cube.Rates {
+		rates.Rates[strings.ToUpper(rate.Currency)] = rate.Rate
+	}
+	if len(rates.Rates) == 0 {
+		return nil, errors.New("The ECB sent no rates")
+	}
+	return rates, nil
+}
+
+// openExchangeRatesProvider reads the latest rates of Open Exchange Rates,
+// against the base currency of the plan
+type openExchangeRatesProvider struct {
+	url    string
+	appID  string
+	client *http.Client
+}
+
+func (p *openExchangeRatesProvider) latestRates(ctx context.Context) (*exchangeRates, error) {
+	u, err := url.Parse(p.url)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("app_id", p.appID)
+	u.RawQuery = query.Encode()
+
+	resp, err := getRates(ctx, p.client, u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	rates := &exchangeRates{}
+	if err := json.NewDecoder(resp.Body).Decode(rates); err != nil {
+		return nil, fmt.Errorf("Error parsing the Open Exchange Rates rates: %v", err)
+	}
+	if rates.Base == "" || len(rates.Rates) == 0 {
+		return nil, errors.New("Open Exchange Rates sent no rates")
+	}
+	return rates, nil
+}
+
+// rateCache keeps the last rates of every provider URL. They're used for
+// currencies.rates.cache_ttl, so orders don't fetch them every time, and
+// for currencies.rates.max_stale while the provider fails.
+type rateCache struct {
+	mutex   sync.Mutex
+	entries map[string]*cachedRates
+}
+
+type cachedRates struct {
+	rates     *exchangeRates
+	fetchedAt time.Time
+}
+
+func newRateCache() *rateCache {
+	return &rateCache{entries: map[string]*cachedRates{}}
+}
+
+// get is the rates of the URL fetched at most maxAge before now
+func (c *rateCache) get(url string, now time.Time, maxAge time.Duration) *exchangeRates {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached := c.entries[url]
+	if cached == nil || now.Sub(cached.fetchedAt) > maxAge {
+		return nil
+	}
+	return cached.rates
+}
+
+func (c *rateCache) put(url string, rates *exchangeRates, fetchedAt time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[url] = &cachedRates{rates: rates, fetchedAt: fetchedAt}
+}
+
+// exchangeRates are the latest rates of the configured provider, from the
+// cache while they're fresh. When the provider fails, the last rates it
+// sent are used until they're older than currencies.rates.max_stale.
+func (a *API) exchangeRates(ctx context.Context) (*exchangeRates, error) {
+	config := getConfig(ctx)
+	provider := rateProviderFor(config)
+	if provider == nil {
+		return nil, errNoRates
+	}
+	settings := config.Currencies.Rates
+	now := time.Now()
+	if rates := a.rateCache.get(settings.URL, now, settings.CacheTTL); rates != nil {
+		return rates, nil
+	}
+	rates, err := provider.latestRates(ctx)
+	if err != nil {
+		if stale := a.rateCache.get(settings.URL, now, settings.MaxStale); stale != nil {
+			getLogger(ctx).WithError(err).Warn("Failed to fetch the exchange rates, using the last ones")
+			return stale, nil
+		}
+		return nil, err
+	}
+	a.rateCache.put(settings.URL, rates, now)
+	return rates, nil
+}
+
+// convertPrices gives the product and its addons prices in the currency,
+// converted from their other prices, if they have none in it. Prices in
+// the settlement currency are converted first.
+func (a *API) convertPrices(ctx context.Context, currency string, meta *models.LineItemMetadata) error {
+	if getConfig(ctx).Currencies.Rates.Provider == "" {
+		return nil
+	}
+	var rates *exchangeRates
+	convert := func(prices []models.PriceMetadata) ([]models.PriceMetadata, error) {
+		if len(prices) == 0 {
+			return prices, nil
+		}
+		for _, price := range prices {
+			if price.Currency == currency {
+				return prices, nil
+			}
+		}
+		if rates == nil {
+			var err error
+			if rates, err = a.exchangeRates(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return convertedPrices(prices, currency, getConfig(ctx).Currencies.Settlement, rates)
+	}
+
+	var err error
+	if meta.Prices, err = convert(meta.Prices); err != nil {
+		return err
+	}
+	for i := range meta.Addons {
+		if meta.Addons[i].Prices, err = convert(meta.Addons[i].Prices); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertedPrices adds the prices of one of the other currencies, converted
+// to the currency and rounded to its minor unit, to the prices
+func convertedPrices(prices []models.PriceMetadata, currency, settlement string, rates *exchangeRates) ([]models.PriceMetadata, error) {
+	source := ""
+	for _, price := range prices {
+		if _, err := rates.rate(price.Currency, currency); err != nil {
+			continue
+		}
+		if source == "" || strings.EqualFold(price.Currency, settlement) {
+			source = price.Currency
+		}
+	}
+	if source == "" {
+		return nil, fmt.Errorf("No price can be converted to %v", currency)
+	}
+	rate, _ := rates.rate(source, currency)
+
+	decimals := models.CurrencyDecimals(currency)
+	convert := func(amount string) (string, error) {
+		value, err := strconv.ParseFloat(amount, 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(value*rate, 'f', decimals, 64), nil
+	}
+	converted := append([]models.PriceMetadata{}, prices...)
+	for _, price := range prices {
+		if price.Currency != source {
+			continue
+		}
+		amount, err := convert(price.Amount)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]models.PriceMetaItem, len(price.Items))
+		for i, item := range price.Items {
+			items[i] = item
+			if items[i].Amount, err = convert(item.Amount); err != nil {
+				return nil, err
+			}
+		}
+		converted = append(converted, models.PriceMetadata{Amount: amount, Currency: currency, VAT: price.VAT, Items: items})
+	}
+	return converted, nil
+}
+
+// settleOrder stores the amounts of the order in the settlement currency,
+// if the shop has one
+func (a *API) settleOrder(ctx context.Context, order *models.Order) error {
+	settlement := getConfig(ctx).Currencies.Settlement
+	if settlement == "" {
+		return nil
+	}
+	rate := 1.0
+	if !strings.EqualFold(order.Currency, settlement) {
+		rates, err := a.exchangeRates(ctx)
+		if err != nil {
+			return err
+		}
+		if rate, err = rates.rate(order.Currency, settlement); err != nil {
+			return err
+		}
+	}
+	order.SetSettlement(strings.ToUpper(settlement), rate)
+	return nil
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// startECBServer serves the ECB rates of a euro for 1.25 dollars and 0.8
+// pounds, counting the requests
+func startECBServer(config *conf.Configuration, requests *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		fmt.Fprintln(w, `<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+	<gesmes:subject>Reference rates</gesmes:subject>
+	<Cube>
+		<Cube time="2026-10-15">
+			<Cube currency="USD" rate="1.25"/>
+			<Cube currency="GBP" rate="0.8"/>
+		</Cube>
+	</Cube>
+</gesmes:Envelope>`)
+	}))
+	config.Currencies.Rates.Provider = conf.ECBRates
+	config.Currencies.Rates.URL = server.URL
+	return server
+}
+
+func TestECBRates(t *testing.T) {
+	_, config := db(t)
+	requests := 0
+	server := startECBServer(config, &requests)
+	defer server.Close()
+	config.Currencies.Rates.CacheTTL = time.Hour
+	api := NewAPI(config, nil, nil, nil, nil)
+	ctx := testContext(nil, config, false)
+
+	rates, err := api.exchangeRates(ctx)
+	if assert.NoError(t, err) {
+		rate, err := rates.rate("usd", "GBP")
+		assert.NoError(t, err)
+		assert.InDelta(t, 0.64, rate, 0.0001, "rates cross through the euro")
+		rate, err = rates.rate("GBP", "EUR")
+		assert.NoError(t, err)
+		assert.InDelta(t, 1.25, rate, 0.0001)
+		_, err = rates.rate("EUR", "JPY")
+		assert.Error(t, err)
+	}
+
+	_, err = api.exchangeRates(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests, "the rates are cached")
+
+	server.Close()
+	config.Currencies.Rates.CacheTTL = 0
+	_, err = api.exchangeRates(ctx)
+	assert.Error(t, err)
+	config.Currencies.Rates.MaxStale = time.Hour
+	_, err = api.exchangeRates(ctx)
+	assert.NoError(t, err, "the last rates are used while the provider fails")
+}
+
+func TestOpenExchangeRates(t *testing.T) {
+	_, config := db(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("app_id") != "secret-app" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, `{"base": "USD", "rates": {"EUR": 0.8, "GBP": 0.64}}`)
+	}))
+	defer server.Close()
+	config.Currencies.Rates.Provider = conf.OpenExchangeRatesRates
+	config.Currencies.Rates.URL = server.URL
+	api := NewAPI(config, nil, nil, nil, nil)
+	ctx := testContext(nil, config, false)
+
+	_, err := api.exchangeRates(ctx)
+	assert.Error(t, err)
+
+	config.Currencies.Rates.APIKey = "secret-app"
+	rates, err := api.exchangeRates(ctx)
+	if assert.NoError(t, err) {
+		rate, err := rates.rate("EUR", "GBP")
+		assert.NoError(t, err)
+		assert.InDelta(t, 0.8, rate, 0.0001)
+	}
+}
+
+func TestConvertedPrices(t *testing.T) {
+	rates := &exchangeRates{Base: "EUR", Rates: map[string]float64{"USD": 1.25, "GBP": 0.8}}
+	prices := []models.PriceMetadata{
+		{Amount: "10.00", Currency: "USD"},
+		{Amount: "8.00", Currency: "GBP", Items: []models.PriceMetaItem{{Amount: "5.00", Type: "book"}}},
+	}
+
+	converted, err := convertedPrices(prices, "EUR", "GBP", rates)
+	if assert.NoError(t, err) && assert.Len(t, converted, 3) {
+		assert.Equal(t, prices, converted[:2], "the prices of the product are kept")
+		assert.Equal(t, models.PriceMetadata{
+			Amount: "10.00", Currency: "EUR",
+			Items: []models.PriceMetaItem{{Amount: "6.25", Type: "book"}},
+		}, converted[2], "prices in the settlement currency are converted first")
+	}
+
+	rates.Rates["JPY"], rates.Rates["KWD"] = 160, 0.33
+	dollars := []models.PriceMetadata{{Amount: "10.00", Currency: "USD"}}
+	converted, err = convertedPrices(dollars, "JPY", "", rates)
+	if assert.NoError(t, err) && assert.Len(t, converted, 2) {
+		assert.Equal(t, "1280", converted[1].Amount, "yens have no decimals")
+	}
+	converted, err = convertedPrices(dollars, "KWD", "", rates)
+	if assert.NoError(t, err) && assert.Len(t, converted, 2) {
+		assert.Equal(t, "2.640", converted[1].Amount, "dinars have three")
+	}
+
+	_, err = convertedPrices([]models.PriceMetadata{{Amount: "10.00", Currency: "CHF"}}, "EUR", "", rates)
+	assert.Error(t, err)
+}
+
+func TestOrderCreateInOtherCurrency(t *testing.T) {
+	db, config := db(t)
+	requests := 0
+	defer startECBServer(config, &requests).Close()
+	config.Currencies.Settlement = "GBP"
+	startTestSite(config)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "https://not-real", strings.NewReader(`{
+		"email": "info@example.com",
+		"currency": "EUR",
+		"shipping_address": {
+			"first_name": "Test", "last_name": "User",
+			"address1": "610 22nd Street",
+			"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 2}]
+	}`))
+	api.OrderCreate(testContext(nil, config, false), recorder, req)
+
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+	assert.Equal(t, "EUR", order.Currency)
+	assert.Equal(t, uint64(799), order.LineItems[0].Price, "9.99 dollars are 7.99 euros")
+	assert.Equal(t, uint64(1598), order.Total)
+	assert.Equal(t, "GBP", order.SettlementCurrency)
+	assert.InDelta(t, 0.8, order.ExchangeRate, 0.0001)
+	assert.Equal(t, uint64(1278), order.SettlementSubTotal)
+	assert.Equal(t, uint64(1278), order.SettlementTotal)
+
+	stored := &models.Order{}
+	assert.NoError(t, db.First(stored, "id = ?", order.ID).Error)
+	assert.Equal(t, uint64(1278), stored.SettlementTotal)
+}
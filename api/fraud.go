@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// fraudScore is how risky an order looks, and why
+type fraudScore struct {
+	Score   int      `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+func (s *fraudScore) add(other *fraudScore) {
+	s.Score += other.Score
+	s.Reasons = append(s.Reasons, other.Reasons...)
+}
+
+// fraudScorer scores an order before it's charged
+type fraudScorer interface {
+	score(ctx context.Context, tx *gorm.DB, order *models.Order) (*fraudScore, error)
+}
+
+// fraudScorers are the scorers set up in the configuration
+func fraudScorers(config *conf.Configuration) []fraudScorer {
+	scorers := []fraudScorer{&fraudRules{config}}
+	if config.Fraud.URL != "" {
+		scorers = append(scorers, &fraudEndpoint{
+			url:    config.Fraud.URL,
+			secret: config.Fraud.Secret,
+			client: config.HTTPClient(config.Timeouts.Fraud),
+		})
+	}
+	return scorers
+}
+
+// scorePayment scores the order about to be paid before the payment locks
+// it, so the order isn't locked while a scoring service is called. It's nil
+// for the orders that aren't scored.
+func (a *API) scorePayment(ctx context.Context, orderID string) (*fraudScore, error) {
+	if getConfig(ctx).Fraud.Threshold <= 0 {
+		return nil, nil
+	}
+	db := a.dbFor(ctx)
+	order := &models.Order{}
+	rsp := db.Preload("LineItems").Preload("BillingAddress").Preload("ShippingAddress").First(order, "id = ?", orderID)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if order.PaymentState != models.PendingState || order.Review == models.ApprovedReview {
+		return nil, nil
+	}
+	if claims := getClaims(ctx); order.UserID == "" && claims != nil {
+		order.UserID = claims.ID
+	}
+	return a.scoreOrder(ctx, db, order), nil
+}
+
+// scoreOrder adds up the scores of the order. A scorer that fails is left
+// out, so an outage of the scoring service doesn't stop checkout.
+func (a *API) scoreOrder(ctx context.Context, tx *gorm.DB, order *models.Order) *fraudScore {
+	total := &fraudScore{}
+	for _, scorer := range fraudScorers(getConfig(ctx)) {
+		score, err := scorer.score(ctx, tx, order)
+		if err != nil {
+			getLogger(ctx).WithError(err).Warn("Failed to score the order for fraud")
+			continue
+		}
+		total.add(score)
+	}
+	return total
+}
+
+// fraudRules are the rules of the configuration scored by gocommerce
+type fraudRules struct {
+	config *conf.Configuration
+}
+
+func (f *fraudRules) score(ctx context.Context, tx *gorm.DB, order *models.Order) (*fraudScore, error) {
+	rules := f.config.Fraud.Rules
+	score := &fraudScore{}
+
+	billing, shipping := order.BillingAddress.Country, order.ShippingAddress.Country
+	if rules.CountryMismatch > 0 && billing != "" && shipping != "" && !strings.EqualFold(billing, shipping) {
+		score.add(&fraudScore{Score: rules.CountryMismatch, Reasons: []string{"country_mismatch"}})
+	}
+
+	if rules.DisposableEmail > 0 && disposableEmail(order.Email, rules.DisposableDomains) {
+		score.add(&fraudScore{Score: rules.DisposableEmail, Reasons: []string{"disposable_email"}})
+	}
+
+	if rules.Velocity > 0 && order.Email != "" {
+		count, err := models.CountOrdersByEmail(tx, order.Email, time.Now().Add(-rules.VelocityWindow))
+		if err != nil {
+			return nil, err
+		}
+		if count > rules.VelocityOrders {
+			score.add(&fraudScore{Score: rules.Velocity, Reasons: []string{"velocity"}})
+		}
+	}
+	return score, nil
+}
+
+// disposableEmail tells if the address is on one of the domains, or on one
+// of their subdomains
+func disposableEmail(email string, domains []string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, disposable := range domains {
+		disposable = strings.ToLower(disposable)
+		if domain == disposable || strings.HasSuffix(domain, "."+disposable) {
+			return true
+		}
+	}
+	return false
+}
+
+// fraudRequest is posted to the fraud scoring endpoint
+type fraudRequest struct {
+	Order *models.Order `json:"order"`
+	IP    string        `json:"ip,omitempty"`
+}
+
+// fraudEndpoint is a scoring service, it's posted the order and answers with
+// a fraudScore
+type fraudEndpoint struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (f *fraudEndpoint) score(ctx context.Context, tx *gorm.DB, order *models.Order) (*fraudScore, error) {
+	params := &fraudRequest{Order: order}
+	if ip := getClientIP(ctx); ip != nil {
+		params.IP = ip.String()
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", f.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if f.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+f.secret)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fraud scoring URL returned %v", resp.StatusCode)
+	}
+
+	score := &fraudScore{}
+	if err := json.NewDecoder(resp.Body).Decode(score); err != nil {
+		return nil, err
+	}
+	return score, nil
+}
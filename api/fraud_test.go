@@ -0,0 +1,156 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func runOrderReview(t *testing.T, api *API, approve bool) *httptest.ResponseRecorder {
+	ctx := testContext(testToken("magical-unicorn", ""), api.config, true)
+	ctx = kami.SetParam(ctx, "order_id", secondOrder.ID)
+	body := `{"approve": false}`
+	if approve {
+		body = `{"approve": true}`
+	}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(body))
+	guarded(t, api, "POST /orders/:order_id/review", api.OrderReview)(ctx, w, r)
+	return w
+}
+
+func runOrderRiskView(t *testing.T, api *API) *httptest.ResponseRecorder {
+	ctx := testContext(testToken("magical-unicorn", ""), api.config, true)
+	ctx = kami.SetParam(ctx, "order_id", secondOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something", nil)
+	guarded(t, api, "GET /orders/:order_id/review", api.OrderRiskView)(ctx, w, r)
+	return w
+}
+
+func TestPaymentCreateHeldForReview(t *testing.T) {
+	db, config := db(t)
+	config.Fraud.Threshold = 50
+	config.Fraud.Rules.DisposableEmail = 60
+	config.Fraud.Rules.DisposableDomains = []string{"wayneindustries.com"}
+	provider := &chargeProvider{id: "ch_123"}
+
+	w := runPaymentCreate(t, db, config, provider)
+	held := map[string]interface{}{}
+	extractPayload(t, http.StatusAccepted, w, &held)
+	assert.Equal(t, models.ManualReviewState, held["payment_state"])
+	assert.NotContains(t, held, "risk_score", "customers don't see why")
+	assert.NotContains(t, held, "risk_reasons")
+	assert.Equal(t, 0, provider.calls, "held orders aren't charged")
+
+	validateError(t, http.StatusConflict, runPaymentCreate(t, db, config, provider))
+
+	api := NewAPI(config, db, nil, nil, nil)
+	risk := &OrderRisk{}
+	extractPayload(t, http.StatusOK, runOrderRiskView(t, api), risk)
+	assert.Equal(t, 60, risk.RiskScore)
+	assert.Equal(t, []string{"disposable_email"}, risk.RiskReasons)
+
+	reviewed := &OrderRisk{}
+	extractPayload(t, http.StatusOK, runOrderReview(t, api, true), reviewed)
+	assert.Equal(t, models.PendingState, reviewed.PaymentState)
+	assert.Equal(t, models.ApprovedReview, reviewed.Review)
+
+	w = runPaymentCreate(t, db, config, provider)
+	assert.Equal(t, http.StatusOK, w.Code, "approved orders aren't scored again")
+	assert.Equal(t, 1, provider.calls)
+}
+
+func TestPaymentCreateRejectedAfterReview(t *testing.T) {
+	db, config := db(t)
+	config.Fraud.Threshold = 50
+	config.Fraud.Rules.DisposableEmail = 60
+	config.Fraud.Rules.DisposableDomains = []string{"wayneindustries.com"}
+	provider := &chargeProvider{id: "ch_123"}
+
+	w := runPaymentCreate(t, db, config, provider)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	api := NewAPI(config, db, nil, nil, nil)
+	reviewed := &OrderRisk{}
+	extractPayload(t, http.StatusOK, runOrderReview(t, api, false), reviewed)
+	assert.Equal(t, models.FailedState, reviewed.PaymentState)
+	assert.Equal(t, models.RejectedReview, reviewed.Review)
+
+	validateError(t, http.StatusBadRequest, runPaymentCreate(t, db, config, provider))
+	validateError(t, http.StatusBadRequest, runOrderReview(t, api, true))
+	assert.Equal(t, 0, provider.calls)
+}
+
+func TestPaymentCreateScoredByEndpoint(t *testing.T) {
+	db, config := db(t)
+	var received fraudRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer fraud-secret", r.Header.Get("Authorization"))
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`{"score": 80, "reasons": ["proxy_ip"]}`))
+	}))
+	defer server.Close()
+	config.Fraud.Threshold = 100
+	config.Fraud.URL = server.URL
+	config.Fraud.Secret = "fraud-secret"
+	config.Fraud.Rules.CountryMismatch = 30
+	config.Fraud.Rules.Velocity = 20
+	config.Fraud.Rules.VelocityOrders = 1
+	config.Fraud.Rules.VelocityWindow = time.Hour
+
+	w := runPaymentCreate(t, db, config, &chargeProvider{id: "ch_123"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	risk := &OrderRisk{}
+	extractPayload(t, http.StatusOK, runOrderRiskView(t, NewAPI(config, db, nil, nil, nil)), risk)
+	assert.Equal(t, 100, risk.RiskScore)
+	assert.Equal(t, []string{"velocity", "proxy_ip"}, risk.RiskReasons, "both fixture orders were placed with the same email")
+	if assert.NotNil(t, received.Order) {
+		assert.Equal(t, secondOrder.ID, received.Order.ID)
+	}
+}
+
+func TestPaymentCreateWhenScoringFails(t *testing.T) {
+	db, config := db(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	config.Fraud.Threshold = 1
+	config.Fraud.URL = server.URL
+
+	w := runPaymentCreate(t, db, config, &chargeProvider{id: "ch_123"})
+	assert.Equal(t, http.StatusOK, w.Code, "an outage of the scoring service doesn't stop checkout")
+}
+
+func TestFraudRules(t *testing.T) {
+	db, config := db(t)
+	config.Fraud.Rules.CountryMismatch = 30
+	config.Fraud.Rules.DisposableEmail = 40
+	config.Fraud.Rules.DisposableDomains = []string{"mailinator.com"}
+
+	order := &models.Order{Email: "someone@eu.Mailinator.com"}
+	order.BillingAddress.Country = "Germany"
+	order.ShippingAddress.Country = "Nigeria"
+	score, err := (&fraudRules{config}).score(testContext(nil, config, false), db, order)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 70, score.Score)
+		assert.Equal(t, []string{"country_mismatch", "disposable_email"}, score.Reasons)
+	}
+
+	order = &models.Order{Email: "someone@notmailinator.com"}
+	order.BillingAddress.Country = "germany"
+	order.ShippingAddress.Country = "Germany"
+	score, err = (&fraudRules{config}).score(testContext(nil, config, false), db, order)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, score.Score)
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/guregu/kami"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// GoodwillParams holds the parameters for a goodwill refund or credit
+type GoodwillParams struct {
+	Type     string `json:"type"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+	Reason   string `json:"reason"`
+	Note     string `json:"note"`
+}
+
+// OrderGoodwill gives a customer money back on an order without a return.
+// A "refund" goes back through the payment provider, a "credit" is only
+// recorded and announced through the refund webhook so it can be honored
+// elsewhere. It requires admin access and a reason code, and the goodwill on
+// an order is capped by the goodwill config.
+func (a *API) OrderGoodwill(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	orderID := kami.Param(ctx, "order_id")
+	log := getLogger(ctx).WithField("order_id", orderID)
+	claims := getClaims(ctx)
+
+	params := new(GoodwillParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		log.WithError(err).Infof("Failed to deserialize goodwill params: %s", err.Error())
+		readError(w, "goodwill params", err)
+		return
+	}
+
+	if params.Type != models.RefundTransactionType && params.Type != models.CreditTransactionType {
+		badRequestError(w, "Goodwill must be either a refund or a credit")
+		return
+	}
+	config := getConfig(ctx)
+	reasons := goodwillReasons(config)
+	if !inList(reasons, params.Reason) {
+		badRequestError(w, "Goodwill requires a reason, must be one of: %v", strings.Join(reasons, ", "))
+		return
+	}
+	if params.Amount == 0 {
+		badRequestError(w, "Goodwill requires an amount")
+		return
+	}
+
+	order := &models.Order{}
+	if rsp := orderQuery(a.dbFor(ctx)).First(order, "id = ?", orderID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			notFoundError(w, "Failed to find order with id '%s'", orderID)
+		} else {
+			log.WithError(rsp.Error).Warnf("Failed to query for id '%s'", orderID)
+			internalServerError(w, "Error while querying for order")
+		}
+		return
+	}
+	if order.PaymentState != models.PaidState {
+		badRequestError(w, "Can't give goodwill on an order that hasn't been paid")
+		return
+	}
+	if params.Currency != "" && params.Currency != order.Currency {
+		badRequestError(w, "Currencies doesn't match - %v vs %v", order.Currency, params.Currency)
+		return
+	}
+
+	var charge *models.Transaction
+	var refunded, given uint64
+	for _, t := range order.Transactions {
+		switch {
+		case t.Type == models.ChargeTransactionType && t.Status != models.FailedState:
+			charge = t
+		case t.Status != models.PaidState:
+		case t.Type == models.RefundTransactionType:
+			refunded += t.Amount
+			if t.Goodwill {
+				given += t.Amount
+			}
+		case t.Type == models.CreditTransactionType:
+			given += t.Amount
+		}
+	}
+
+	if limit := goodwillLimit(config, order); given+params.Amount > limit {
+		badRequestError(w, "The goodwill on this order can be at most %v, %v has been given already", limit, given)
+		return
+	}
+
+	m := &models.Transaction{
+		ID:       uuid.NewRandom().String(),
+		Amount:   params.Amount,
+		Currency: order.Currency,
+		UserID:   order.UserID,
+		OrderID:  order.ID,
+		Type:     params.Type,
+		Status:   models.PendingState,
+		Reason:   params.Reason,
+		Goodwill: true,
+		Note:     params.Note,
+		IssuedBy: claims.ID,
+	}
+
+	tx := a.dbFor(ctx).Begin()
+	batch := a.events.Begin(tx)
+	if params.Type == models.RefundTransactionType {
+		if charge == nil || order.PaymentProcessor == string(PaypalChargerType) {
+			tx.Rollback()
+			badRequestError(w, "This order has no charge that can be refunded, give a credit instead")
+			return
+		}
+		if refunded+params.Amount > charge.Amount {
+			tx.Rollback()
+			badRequestError(w, "Can't refund more than was charged")
+			return
+		}
+		a.issueRefund(ctx, batch, charge, m)
+	} else {
+		m.Status = models.PaidState
+		tx.Create(m)
+		a.publish(ctx, batch, &events.Event{Type: webhooks.RefundEvent, UserID: m.UserID, Payload: m, Transaction: m})
+	}
+
+	models.LogEvent(tx, r.RemoteAddr, claims.ID, order.ID, models.EventUpdated, []string{"goodwill_" + params.Type})
+	a.audit(ctx, tx, r, "order.goodwill", "transaction", m.ID, nil, models.Snapshot(m))
+	if rsp := batch.Commit(); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Problem while committing goodwill")
+		internalServerError(w, "Error committing goodwill")
+		return
+	}
+
+	log.WithField("reason", params.Reason).Infof("Gave %v goodwill %v on order", params.Amount, params.Type)
+	sendJSON(w, 200, m)
+}
+
+func goodwillReasons(config *conf.Configuration) []string {
+	if config != nil && len(config.Goodwill.Reasons) > 0 {
+		return config.Goodwill.Reasons
+	}
+	return conf.DefaultGoodwillReasons
+}
+
+// goodwillLimit is the most goodwill an order can get in total. It is never
+// more than the order total.
+func goodwillLimit(config *conf.Configuration, order *models.Order) uint64 {
+	limit := order.Total
+	if config == nil {
+		return limit
+	}
+	if max := config.Goodwill.MaxAmount; max > 0 && max < limit {
+		limit = max
+	}
+	if pct := config.Goodwill.MaxPercentage; pct > 0 {
+		if max := order.Total * pct / 100; max < limit {
+			limit = max
+		}
+	}
+	return limit
+}
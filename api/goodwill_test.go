@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func runGoodwill(t *testing.T, db *gorm.DB, config *conf.Configuration, provider *memProvider, body string) *httptest.ResponseRecorder {
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	ctx = withPayer(ctx, StripeChargerType, provider)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(body))
+
+	NewAPI(config, db, nil, nil, nil).OrderGoodwill(ctx, w, r)
+	return w
+}
+
+func payFirstOrder(db *gorm.DB) {
+	db.Model(firstOrder).Updates(map[string]interface{}{"payment_state": models.PaidState, "payment_processor": "stripe"})
+}
+
+func TestOrderGoodwillRefund(t *testing.T) {
+	db, config := db(t)
+	payFirstOrder(db)
+	provider := &memProvider{}
+
+	w := runGoodwill(t, db, config, provider, `{"type": "refund", "amount": 10, "reason": "late_delivery", "note": "sorry!"}`)
+
+	rsp := new(models.Transaction)
+	extractPayload(t, 200, w, rsp)
+	assert.Equal(t, models.RefundTransactionType, rsp.Type)
+	assert.Equal(t, models.PaidState, rsp.Status)
+	assert.True(t, rsp.Goodwill)
+	assert.Equal(t, "magical-unicorn", rsp.IssuedBy)
+	if assert.Len(t, provider.refundCalls, 1) {
+		assert.Equal(t, uint64(10), provider.refundCalls[0].amount)
+		assert.Equal(t, firstTransaction.ProcessorID, provider.refundCalls[0].id)
+	}
+
+	event := &models.Event{}
+	db.Last(event, "order_id = ?", firstOrder.ID)
+	assert.Equal(t, "goodwill_refund", event.Changes)
+}
+
+func TestOrderGoodwillCredit(t *testing.T) {
+	db, config := db(t)
+	payFirstOrder(db)
+	provider := &memProvider{}
+
+	w := runGoodwill(t, db, config, provider, `{"type": "credit", "amount": 10, "reason": "damaged_item"}`)
+
+	rsp := new(models.Transaction)
+	extractPayload(t, 200, w, rsp)
+	assert.Equal(t, models.CreditTransactionType, rsp.Type)
+	assert.Equal(t, models.PaidState, rsp.Status)
+	assert.Empty(t, provider.refundCalls)
+}
+
+func TestOrderGoodwillCapped(t *testing.T) {
+	db, config := db(t)
+	payFirstOrder(db)
+	config.Goodwill.MaxPercentage = 50
+
+	// the order total is 24, so at most 12 can be given
+	w := runGoodwill(t, db, config, &memProvider{}, `{"type": "credit", "amount": 10, "reason": "other"}`)
+	extractPayload(t, 200, w, new(models.Transaction))
+
+	w = runGoodwill(t, db, config, &memProvider{}, `{"type": "credit", "amount": 3, "reason": "other"}`)
+	validateError(t, 400, w)
+}
+
+func TestOrderGoodwillRequiresReason(t *testing.T) {
+	db, config := db(t)
+	payFirstOrder(db)
+
+	w := runGoodwill(t, db, config, &memProvider{}, `{"type": "refund", "amount": 10}`)
+	validateError(t, 400, w)
+}
+
+func TestOrderGoodwillUnpaid(t *testing.T) {
+	db, config := db(t)
+
+	w := runGoodwill(t, db, config, &memProvider{}, `{"type": "credit", "amount": 10, "reason": "other"}`)
+	validateError(t, 400, w)
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// healthTimeout is how long the health check waits for the database
+const healthTimeout = 2 * time.Second
+
+// deploymentPaths are served for the deployment as a whole, also on hosts
+// without an instance in multi-instance mode
+var deploymentPaths = map[string]bool{
+	"/health":  true,
+	"/version": true,
+}
+
+// BuildInfo tells which build is running. It's set when the binary is
+// built, see the Makefile.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// HealthResponse is the state of the process and its database
+type HealthResponse struct {
+	Status   string    `json:"status"`
+	Database string    `json:"database"`
+	ReadOnly bool      `json:"read_only"`
+	Build    BuildInfo `json:"build"`
+}
+
+// Version shows the build that serves the request
+func (a *API) Version(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, http.StatusOK, a.build)
+}
+
+// Health tells load balancers and operators if the process can serve
+// requests. It's unavailable while the database can't be reached, and
+// reports the read-only state of the database, in which reads are still
+// served.
+func (a *API) Health(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	rsp := &HealthResponse{Status: "ok", Database: "ok", Build: a.build}
+	a.readOnly.mutex.Lock()
+	rsp.ReadOnly = !a.readOnly.since.IsZero()
+	a.readOnly.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	if err := a.db.DB().PingContext(ctx); err != nil {
+		getLogger(ctx).WithError(err).Warn("Health check failed to reach the database")
+		rsp.Status = "unavailable"
+		rsp.Database = "unreachable"
+		sendJSON(w, http.StatusServiceUnavailable, rsp)
+		return
+	}
+	sendJSON(w, http.StatusOK, rsp)
+}
+
+func buildInfo(build BuildInfo) BuildInfo {
+	if build.Version == "" {
+		build.Version = defaultVersion
+	}
+	build.GoVersion = runtime.Version()
+	return build
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersion(t *testing.T) {
+	db, config := db(t)
+	api := NewAPIWithBuild(config, db, nil, nil, nil, BuildInfo{Version: "v1.2.0", Commit: "0a1b2c3", BuildDate: "2026-10-01T12:00:00Z"})
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	build := &BuildInfo{}
+	extractPayload(t, http.StatusOK, w, build)
+	assert.Equal(t, BuildInfo{Version: "v1.2.0", Commit: "0a1b2c3", BuildDate: "2026-10-01T12:00:00Z", GoVersion: runtime.Version()}, *build)
+
+	api = NewAPI(config, db, nil, nil, nil)
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	extractPayload(t, http.StatusOK, w, build)
+	assert.Equal(t, defaultVersion, build.Version)
+}
+
+func TestHealth(t *testing.T) {
+	db, config := db(t)
+	config.MultiInstance.Enabled = true
+	config.MultiInstance.OperatorToken = "operator"
+	api := NewAPIWithBuild(config, db, nil, nil, nil, BuildInfo{Version: "v1.2.0"})
+
+	// served on hosts without an instance, for load balancers
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "http://10.0.0.1/health", nil))
+	rsp := &HealthResponse{}
+	extractPayload(t, http.StatusOK, w, rsp)
+	assert.Equal(t, "ok", rsp.Status)
+	assert.Equal(t, "ok", rsp.Database)
+	assert.False(t, rsp.ReadOnly)
+	assert.Equal(t, "v1.2.0", rsp.Build.Version)
+
+	api.readOnly.trip()
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "http://10.0.0.1/health", nil))
+	extractPayload(t, http.StatusOK, w, rsp)
+	assert.True(t, rsp.ReadOnly, "reads are still served")
+	api.readOnly.recover()
+
+	db.Close()
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "http://10.0.0.1/health", nil))
+	extractPayload(t, http.StatusServiceUnavailable, w, rsp)
+	assert.Equal(t, "unavailable", rsp.Status)
+	assert.Equal(t, "unreachable", rsp.Database)
+}
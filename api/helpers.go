@@ -1,8 +1,12 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	jwt "github.com/dgrijalva/jwt-go"
 )
@@ -14,6 +18,62 @@ func sendJSON(w http.ResponseWriter, status int, obj interface{}) {
 	encoder.Encode(obj)
 }
 
+// sendJSONWithETag sends the JSON with an ETag. Clients polling with the
+// ETag in If-None-Match get an empty 304 as long as nothing changed.
+func sendJSONWithETag(w http.ResponseWriter, r *http.Request, status int, obj interface{}) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		internalServerError(w, "Error encoding response: %v", err)
+		return
+	}
+	body = append(body, '\n')
+
+	// the total count of a list can change while the page stays the same
+	hash := sha256.New()
+	hash.Write([]byte(w.Header().Get("X-Total-Count") + "\n"))
+	hash.Write(body)
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// etagMatches does the weak comparison of If-None-Match
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// sendCSV writes a CSV attachment, the first row is the header
+func sendCSV(w http.ResponseWriter, filename string, records [][]string) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	w.WriteHeader(200)
+	writer := csv.NewWriter(w)
+	writer.WriteAll(records)
+	return writer.Error()
+}
+
+// wantsCSV checks if a report was requested as CSV, either with `?format=csv`
+// or an Accept header
+func wantsCSV(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
 func userIDFromToken(token *jwt.Token) string {
 	if token == nil {
 		return ""
@@ -22,3 +82,12 @@ func userIDFromToken(token *jwt.Token) string {
 	claims := token.Claims.(*JWTClaims)
 	return claims.ID
 }
+
+func inList(list []string, candidate string) bool {
+	for _, item := range list {
+		if item == candidate {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// webhookURL is the URL configured for an event type
+func webhookURL(config *conf.Configuration, eventType string) string {
+	switch eventType {
+	case webhooks.OrderEvent:
+		return config.Webhooks.Order
+	case webhooks.PaymentEvent:
+		return config.Webhooks.Payment
+	case webhooks.UpdateEvent:
+		return config.Webhooks.Update
+	case webhooks.RefundEvent:
+		return config.Webhooks.Refund
+	case webhooks.CancellationEvent:
+		return config.Webhooks.Cancellation
+	case webhooks.FulfillmentEvent:
+		return config.Webhooks.Fulfillment
+	case webhooks.DisputeEvent:
+		return config.Webhooks.Dispute
+	case webhooks.DownloadEvent:
+		return config.Webhooks.Download
+	case webhooks.CouponRedemptionEvent:
+		return config.Webhooks.CouponRedemption
+	case webhooks.StockEvent:
+		return config.Webhooks.Stock
+	case webhooks.ReferralCreditEvent:
+		return config.Webhooks.ReferralCredit
+	}
+	return ""
+}
+
+// queueHooks saves the webhooks for an event in the transaction that
+// publishes it, to the URL for its type, to the shared URL, to the event
+// sinks and to the webhook subscriptions, so they are only sent if it commits
+func (a *API) queueHooks(ctx context.Context, tx *gorm.DB, e *events.Event) {
+	log := getLogger(ctx)
+	config := getConfig(ctx)
+	if config == nil {
+		// published outside of a request
+		config = a.currentConfig()
+	}
+	subscriptions, err := models.ActiveWebhookSubscriptions(tx, e.Type)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to query the webhook subscriptions to %v", e.Type)
+	}
+
+	data, err := json.Marshal(e.Payload)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to encode %v webhook", e.Type)
+		return
+	}
+	save := func(url, format, subscriptionID string, shared bool) {
+		hook := models.NewHook(e.Type, url, e.UserID, hookPayload(config, e, data, format, shared))
+		hook.OrderID = e.OrderID
+		hook.RequestID = e.RequestID
+		hook.Format = format
+		hook.SubscriptionID = subscriptionID
+		tx.Save(hook)
+	}
+
+	if url := webhookURL(config, e.Type); url != "" {
+		save(url, config.Webhooks.Format, "", false)
+	}
+	if config.Webhooks.URL != "" {
+		save(config.Webhooks.URL, config.Webhooks.Format, "", true)
+	}
+	for _, sink := range config.EventSinks {
+		if len(sink.Events) == 0 || inList(sink.Events, e.Type) {
+			save(models.SinkURLPrefix+sink.Name, sink.Format, "", true)
+		}
+	}
+	for _, s := range subscriptions {
+		save(s.URL, s.Format, s.ID, true)
+	}
+}
+
+// hookPayload wraps the payload of an event in the format of an endpoint.
+// Shared endpoints get events of every type, so in the JSON format their
+// payload is wrapped in an envelope with the type.
+func hookPayload(config *conf.Configuration, e *events.Event, data json.RawMessage, format string, shared bool) interface{} {
+	switch {
+	case format == webhooks.CloudEventsFormat:
+		return webhooks.NewCloudEvent(uuid.NewRandom().String(), cloudEventsSource(config), e.Type, e.OrderID, data, e.CreatedAt)
+	case shared:
+		return &webhooks.Envelope{Event: e.Type, Data: data}
+	}
+	return data
+}
+
+// cloudEventsSource is the source of the CloudEvents sent, the site URL if
+// one is configured
+func cloudEventsSource(config *conf.Configuration) string {
+	if config.SiteURL != "" {
+		return config.SiteURL
+	}
+	return "gocommerce"
+}
+
+// CouponRedemption is the payload of the coupon redemption webhook, sent
+// when an order with a coupon is paid
+type CouponRedemption struct {
+	Code     string `json:"code"`
+	OrderID  string `json:"order_id"`
+	UserID   string `json:"user_id,omitempty"`
+	Email    string `json:"email"`
+	Discount uint64 `json:"discount"`
+	Currency string `json:"currency"`
+}
+
+func (c *CouponRedemption) eventOrderID() string {
+	return c.OrderID
+}
+
+// publishStock publishes the new stock of the tracked SKUs in an order
+func (a *API) publishStock(ctx context.Context, batch *events.Batch, order *models.Order) {
+	items, err := order.TrackedInventory(batch.Tx())
+	if err != nil {
+		getLogger(ctx).WithError(err).Warn("Failed to query the stock for its events")
+		return
+	}
+	for i := range items {
+		a.publish(ctx, batch, &events.Event{Type: webhooks.StockEvent, Payload: &items[i]})
+	}
+}
+
+// DownloadAccess is the payload of the download webhook, sent when a
+// download URL is handed out. It leaves out the signed URL itself.
+type DownloadAccess struct {
+	DownloadID string `json:"download_id"`
+	OrderID    string `json:"order_id"`
+	UserID     string `json:"user_id,omitempty"`
+	Sku        string `json:"sku"`
+	Title      string `json:"title"`
+	IP         string `json:"ip"`
+	Downloads  uint64 `json:"downloads"`
+}
+
+func (d *DownloadAccess) eventOrderID() string {
+	return d.OrderID
+}
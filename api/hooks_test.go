@@ -0,0 +1,177 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+func TestCancellationWebhooks(t *testing.T) {
+	db, config := db(t)
+	config.Webhooks.Cancellation = "https://hooks.example.com/cancellation"
+	config.Webhooks.URL = "https://hooks.example.com/all"
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"reason": "fraud"}`))
+	NewAPI(config, db, nil, nil, nil).OrderCancel(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+
+	hooks := []models.Hook{}
+	db.Order("url asc").Find(&hooks, "type = ?", webhooks.CancellationEvent)
+	if !assert.Len(t, hooks, 2) {
+		return
+	}
+
+	shared, own := hooks[0], hooks[1]
+	assert.Equal(t, config.Webhooks.URL, shared.URL)
+	assert.Equal(t, config.Webhooks.Cancellation, own.URL)
+	assert.Equal(t, firstOrder.ID, shared.OrderID)
+	assert.Equal(t, firstOrder.ID, own.OrderID)
+
+	order := &models.Order{}
+	assert.NoError(t, json.Unmarshal([]byte(own.Payload), order))
+	assert.Equal(t, models.CancelledState, order.State)
+
+	envelope := &webhooks.Envelope{}
+	assert.NoError(t, json.Unmarshal([]byte(shared.Payload), envelope))
+	assert.Equal(t, webhooks.CancellationEvent, envelope.Event)
+	assert.JSONEq(t, own.Payload, string(envelope.Data))
+}
+
+func TestEventSinkHooks(t *testing.T) {
+	db, config := db(t)
+	published := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		published <- string(body)
+		fmt.Fprint(w, `{"offsets": [{"partition": 0, "offset": 1}]}`)
+	}))
+	defer proxy.Close()
+	config.EventSinks = []conf.EventSink{
+		{Name: "kafka", URL: "kafka+" + proxy.URL + "/topics/orders", Events: []string{webhooks.CancellationEvent}},
+		{Name: "payments", URL: "nats://localhost:4222/payments", Events: []string{webhooks.PaymentEvent}},
+	}
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", strings.NewReader(`{"reason": "fraud"}`))
+	NewAPI(config, db, nil, nil, nil).OrderCancel(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+
+	hooks := []models.Hook{}
+	db.Find(&hooks, "url LIKE ?", models.SinkURLPrefix+"%")
+	if !assert.Len(t, hooks, 1) {
+		return
+	}
+	hook := &hooks[0]
+	assert.Equal(t, "sink:kafka", hook.URL)
+	assert.Equal(t, webhooks.CancellationEvent, hook.Type)
+
+	deliverHooks(t, db, config, hook)
+	assert.True(t, hook.Done)
+	assert.Equal(t, "published", hook.ResponseStatus)
+	select {
+	case body := <-published:
+		assert.Contains(t, body, `"key":"`+firstOrder.ID+`"`)
+		assert.Contains(t, body, `"event":"cancellation"`)
+	default:
+		t.Error("Nothing was published to Kafka")
+	}
+}
+
+func TestStockWebhooks(t *testing.T) {
+	db, config := db(t)
+	config.Webhooks.Stock = "https://hooks.example.com/stock"
+
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+	ctx = kami.SetParam(ctx, "sku", "stocked")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "http://something", strings.NewReader(`{"quantity": 3}`))
+	NewAPI(config, db, nil, nil, nil).InventoryUpdate(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+
+	hook := &models.Hook{}
+	if assert.NoError(t, db.First(hook, "type = ?", webhooks.StockEvent).Error) {
+		assert.JSONEq(t, `{"sku": "stocked", "quantity": 3}`, removeTimestamps(t, hook.Payload))
+	}
+}
+
+func TestStripeDisputeEvent(t *testing.T) {
+	db, config := db(t)
+	config.Payment.Stripe.WebhookSecret = "whsec_test"
+	config.Webhooks.Dispute = "https://hooks.example.com/dispute"
+
+	body := fmt.Sprintf(`{"id": "evt_1", "type": "charge.dispute.created", "data": {"object": {
+		"id": "dp_1", "charge": %q, "amount": 100, "currency": "usd", "reason": "fraudulent", "status": "needs_response"
+	}}}`, firstTransaction.ProcessorID)
+
+	w := runStripeEvent(t, db, config, body, signStripeEvent("whsec_test", body, time.Now()))
+	assert.Equal(t, 200, w.Code)
+
+	hook := &models.Hook{}
+	if assert.NoError(t, db.First(hook, "type = ?", webhooks.DisputeEvent).Error) {
+		dispute := &Dispute{}
+		assert.NoError(t, json.Unmarshal([]byte(hook.Payload), dispute))
+		assert.Equal(t, "dp_1", dispute.ID)
+		assert.Equal(t, "needs_response", dispute.Status)
+		assert.Equal(t, firstTransaction.ID, dispute.TransactionID)
+		assert.Equal(t, firstOrder.ID, hook.OrderID)
+	}
+}
+
+func TestStripeEventBadSignature(t *testing.T) {
+	db, config := db(t)
+	config.Payment.Stripe.WebhookSecret = "whsec_test"
+	body := `{"id": "evt_1", "type": "charge.dispute.created", "data": {"object": {}}}`
+
+	w := runStripeEvent(t, db, config, body, signStripeEvent("other", body, time.Now()))
+	validateError(t, 400, w)
+
+	w = runStripeEvent(t, db, config, body, signStripeEvent("whsec_test", body, time.Now().Add(-time.Hour)))
+	validateError(t, 400, w)
+}
+
+func runStripeEvent(t *testing.T, db *gorm.DB, config *conf.Configuration, body, signature string) *httptest.ResponseRecorder {
+	ctx := testContext(nil, config, false)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something/stripe/events", strings.NewReader(body))
+	r.Header.Set("Stripe-Signature", signature)
+	NewAPI(config, db, nil, nil, nil).StripeEvents(ctx, w, r)
+	return w
+}
+
+func signStripeEvent(secret, body string, now time.Time) string {
+	timestamp := fmt.Sprintf("%d", now.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// removeTimestamps drops created_at and updated_at from a JSON object
+func removeTimestamps(t *testing.T, payload string) string {
+	object := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(payload), &object))
+	delete(object, "created_at")
+	delete(object, "updated_at")
+	data, _ := json.Marshal(object)
+	return string(data)
+}
@@ -0,0 +1,391 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+// instanceHeader picks the instance of a request by its ID or hostname,
+// for callers that can't use the hostname of the instance
+const instanceHeader = "X-Gocommerce-Instance"
+
+var errInstanceGone = errors.New("The instance was deleted")
+
+// instanceState is what's set up for an instance from its settings. It's
+// kept until the instance changes.
+type instanceState struct {
+	instance *models.Instance
+	config   *conf.Configuration
+	mailer   *mailer.Mailer
+	paypal   *paypalsdk.Client
+}
+
+type instanceCache struct {
+	mutex  sync.Mutex
+	states map[string]*instanceState
+}
+
+func newInstanceCache() *instanceCache {
+	return &instanceCache{states: map[string]*instanceState{}}
+}
+
+// state returns the state of an instance, set up again if the instance
+// changed since
+func (a *API) instanceState(instance *models.Instance) (*instanceState, error) {
+	a.instances.mutex.Lock()
+	defer a.instances.mutex.Unlock()
+	if state, ok := a.instances.states[instance.ID]; ok && state.instance.UpdatedAt.Equal(instance.UpdatedAt) {
+		return state, nil
+	}
+
+	config, err := instance.Configuration(a.currentConfig())
+	if err != nil {
+		return nil, err
+	}
+	state := &instanceState{instance: instance, config: config, paypal: a.paypal}
+	if a.mailer != nil {
+		m := mailer.NewMailer(config)
+		m.InstanceID = instance.ID
+		if a.mailer.Queue != nil {
+			m.Queue = models.ForInstance(a.mailer.Queue, instance.ID)
+		}
+		if a.mailer.Suppressions != nil {
+			m.Suppressions = models.ForInstance(a.mailer.Suppressions, instance.ID)
+		}
+		state.mailer = m
+	}
+	if paypal := config.Payment.Paypal; paypal.ClientID != "" && paypal.ClientID != a.currentConfig().Payment.Paypal.ClientID {
+		base := paypalsdk.APIBaseSandBox
+		if paypal.Env == "production" {
+			base = paypalsdk.APIBaseLive
+		}
+		if state.paypal, err = paypalsdk.NewClient(paypal.ClientID, paypal.Secret, base); err != nil {
+			return nil, err
+		}
+		state.paypal.Client = config.HTTPClient(config.Timeouts.Payments)
+	}
+	a.instances.states[instance.ID] = state
+	return state, nil
+}
+
+// withInstance finds the instance of a request by the instance header or
+// the hostname, and sets up the request with its settings. Only the operator
+// gets by without an instance.
+func (a *API) withInstance(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	log := getLogger(ctx)
+	key := r.Header.Get(instanceHeader)
+	if key == "" && strings.TrimPrefix(r.URL.Path, "/v1") == "/emails/unsubscribe" {
+		// unsubscribe links are opened in browsers and name their instance
+		key = r.URL.Query().Get("instance")
+	}
+	if key == "" {
+		key = r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			key = host
+		}
+	}
+
+	instance, err := models.FindInstance(a.db, key)
+	if err != nil {
+		log.WithError(err).Warn("Error while querying for instance")
+		internalServerError(w, "Error during database query: %v", err)
+		return nil
+	}
+	if instance == nil {
+		if a.operatorToken(r) {
+			return ctx
+		}
+		notFoundError(w, "No store is served at %s", key)
+		return nil
+	}
+
+	state, err := a.instanceState(instance)
+	if err != nil {
+		log.WithError(err).WithField("instance_id", instance.ID).Error("Invalid instance config")
+		internalServerError(w, "The settings of this store are invalid")
+		return nil
+	}
+	ctx = withInstance(ctx, state)
+	ctx = withLogger(ctx, log.WithField("instance_id", instance.ID))
+	ctx = withConfig(ctx, state.config)
+	ctx = withCoupons(ctx, state.config)
+	ctx = withPayer(ctx, PaypalChargerType, &paypalProvider{state.paypal})
+	ctx = withPayer(ctx, StripeChargerType, &stripeProvider{key: state.config.Payment.Stripe.SecretKey})
+	return ctx
+}
+
+// operatorToken tells if a request is authorized with the operator token
+func (a *API) operatorToken(r *http.Request) bool {
+	token := a.currentConfig().MultiInstance.OperatorToken
+	matches := bearerRegexp.FindStringSubmatch(r.Header.Get("Authorization"))
+	return token != "" && len(matches) == 2 && subtle.ConstantTimeCompare([]byte(matches[1]), []byte(token)) == 1
+}
+
+// MailStores lists the stores the background mails are sent for, with db
+// scoped to them: the deployment, or every instance in multi-instance mode
+func (a *API) MailStores(db *gorm.DB) mailer.Stores {
+	return func() ([]mailer.Store, error) {
+		if a.mailer == nil {
+			return nil, nil
+		}
+		if !a.currentConfig().MultiInstance.Enabled {
+			return []mailer.Store{{Mailer: a.mailer, DB: db}}, nil
+		}
+		instances := []*models.Instance{}
+		if err := db.Find(&instances).Error; err != nil {
+			return nil, err
+		}
+		stores := []mailer.Store{}
+		for _, instance := range instances {
+			state, err := a.instanceState(instance)
+			if err != nil {
+				a.log.WithError(err).WithField("instance_id", instance.ID).Error("Invalid instance config")
+				continue
+			}
+			stores = append(stores, mailer.Store{Mailer: state.mailer, DB: models.ForInstance(db, instance.ID)})
+		}
+		return stores, nil
+	}
+}
+
+// mailerFor returns the mailer of the instance of a request
+func (a *API) mailerFor(ctx context.Context) *mailer.Mailer {
+	if state := getInstanceState(ctx); state != nil {
+		return state.mailer
+	}
+	return a.mailer
+}
+
+// paypalFor returns the PayPal client of the instance of a request
+func (a *API) paypalFor(ctx context.Context) *paypalsdk.Client {
+	if state := getInstanceState(ctx); state != nil {
+		return state.paypal
+	}
+	return a.paypal
+}
+
+// instanceConfig returns the configuration of an instance, or of the
+// deployment for records outside of any instance
+func (a *API) instanceConfig(instanceID string) (*conf.Configuration, error) {
+	if instanceID == "" {
+		return a.currentConfig(), nil
+	}
+	state, err := a.instanceStateByID(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return state.config, nil
+}
+
+func (a *API) instanceStateByID(instanceID string) (*instanceState, error) {
+	instance, err := models.FindInstance(a.db, instanceID)
+	if err == nil && instance == nil {
+		err = errInstanceGone
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a.instanceState(instance)
+}
+
+// instanceCharger returns the payment provider an order of an instance was
+// charged with, along with the configuration of the instance. A provider in
+// the context is used instead, like for requests.
+func (a *API) instanceCharger(ctx context.Context, instanceID, processor string) (paymentProvider, *conf.Configuration, error) {
+	config, paypal, key := a.currentConfig(), a.paypal, ""
+	if instanceID != "" {
+		state, err := a.instanceStateByID(instanceID)
+		if err != nil {
+			return nil, nil, err
+		}
+		config, paypal, key = state.config, state.paypal, state.config.Payment.Stripe.SecretKey
+	}
+
+	chType := StripeChargerType
+	if processor == "paypal" {
+		chType = PaypalChargerType
+	}
+	if charger := getCharger(ctx, chType); charger != nil {
+		return charger, config, nil
+	}
+	if chType == PaypalChargerType {
+		return &paypalProvider{paypal}, config, nil
+	}
+	return &stripeProvider{key: key}, config, nil
+}
+
+// eventMailer returns the mailer of the instance of an event
+func (a *API) eventMailer(e *events.Event) *mailer.Mailer {
+	if e.InstanceID == "" {
+		return a.mailer
+	}
+	instance, err := models.FindInstance(a.db, e.InstanceID)
+	if err == nil && instance == nil {
+		err = errInstanceGone
+	}
+	if err != nil {
+		a.log.WithError(err).WithField("instance_id", e.InstanceID).Error("Error loading instance for mails")
+		return nil
+	}
+	state, err := a.instanceState(instance)
+	if err != nil {
+		a.log.WithError(err).WithField("instance_id", e.InstanceID).Error("Invalid instance config")
+		return nil
+	}
+	return state.mailer
+}
+
+// InstanceParams are the hostname and settings of an instance
+type InstanceParams struct {
+	Hostname string                 `json:"hostname"`
+	Config   map[string]interface{} `json:"config"`
+}
+
+// InstanceList lists the instances served by the deployment
+func (a *API) InstanceList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.db.Model(&models.Instance{})
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	instances := []models.Instance{}
+	if rsp := query.Order("created_at asc").Offset(offset).Limit(limit).Find(&instances); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for instances")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+	sendJSON(w, http.StatusOK, instances)
+}
+
+// InstanceView shows an instance
+func (a *API) InstanceView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if instance := a.findInstance(ctx, w); instance != nil {
+		sendJSON(w, http.StatusOK, instance)
+	}
+}
+
+// InstanceCreate adds an instance, served at its hostname from now on
+func (a *API) InstanceCreate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	instance := &models.Instance{ID: uuid.NewRandom().String()}
+	if !a.applyInstanceParams(ctx, w, r, instance) {
+		return
+	}
+	if rsp := a.db.Create(instance); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to save instance")
+		internalServerError(w, "Failed to save instance")
+		return
+	}
+	log.WithField("instance_id", instance.ID).Infof("Created instance for %s", instance.Hostname)
+	sendJSON(w, http.StatusCreated, instance)
+}
+
+// InstanceUpdate changes the hostname or the settings of an instance. The
+// settings replace the ones it had.
+func (a *API) InstanceUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	instance := a.findInstance(ctx, w)
+	if instance == nil || !a.applyInstanceParams(ctx, w, r, instance) {
+		return
+	}
+	if rsp := a.db.Save(instance); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to save instance")
+		internalServerError(w, "Failed to save instance")
+		return
+	}
+	log.WithField("instance_id", instance.ID).Info("Updated instance")
+	sendJSON(w, http.StatusOK, instance)
+}
+
+// InstanceDelete stops serving an instance. Its orders and other records
+// are kept.
+func (a *API) InstanceDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	instance := a.findInstance(ctx, w)
+	if instance == nil {
+		return
+	}
+	if rsp := a.db.Delete(instance); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to delete instance")
+		internalServerError(w, "Failed to delete instance")
+		return
+	}
+	a.instances.mutex.Lock()
+	delete(a.instances.states, instance.ID)
+	a.instances.mutex.Unlock()
+	log.WithField("instance_id", instance.ID).Info("Deleted instance")
+}
+
+func (a *API) findInstance(ctx context.Context, w http.ResponseWriter) *models.Instance {
+	instance := &models.Instance{}
+	rsp := a.db.First(instance, "id = ?", kami.Param(ctx, "instance_id"))
+	if rsp.RecordNotFound() {
+		notFoundError(w, "Instance not found")
+		return nil
+	}
+	if rsp.Error != nil {
+		getLogger(ctx).WithError(rsp.Error).Warn("Error while querying for instance")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return nil
+	}
+	return instance
+}
+
+// applyInstanceParams sets the hostname and the settings of an instance from
+// the request, as long as the hostname isn't taken and the settings fit the
+// configuration
+func (a *API) applyInstanceParams(ctx context.Context, w http.ResponseWriter, r *http.Request, instance *models.Instance) bool {
+	params := &InstanceParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		getLogger(ctx).WithError(err).Infof("Failed to deserialize instance params: %s", err.Error())
+		readError(w, "instance params", err)
+		return false
+	}
+
+	if params.Hostname != "" {
+		instance.Hostname = strings.ToLower(params.Hostname)
+	}
+	if instance.Hostname == "" {
+		badRequestError(w, "An instance needs a hostname")
+		return false
+	}
+	other := &models.Instance{}
+	if rsp := a.db.Where("hostname = ? AND id != ?", instance.Hostname, instance.ID).First(other); rsp.Error == nil {
+		badRequestError(w, "The hostname %s is taken by another instance", instance.Hostname)
+		return false
+	}
+
+	if params.Config != nil {
+		instance.Config = params.Config
+		if err := instance.BeforeSave(); err != nil {
+			badRequestError(w, "Invalid instance config: %v", err)
+			return false
+		}
+		if _, err := instance.Configuration(a.currentConfig()); err != nil {
+			badRequestError(w, "Invalid instance config: %v", err)
+			return false
+		}
+	}
+	instance.UpdatedAt = time.Now()
+	return true
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestInstances(t *testing.T) {
+	db, config := db(t)
+	config.JWT.Secret = "secret"
+	config.JWT.AdminGroupName = "admin"
+	config.MultiInstance.Enabled = true
+	config.MultiInstance.OperatorToken = "operator-token"
+	api := NewAPI(config, db, nil, nil, nil)
+
+	do := func(method, host, path, auth, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Host = host
+		if auth != "" {
+			r.Header.Set("Authorization", "Bearer "+auth)
+		}
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, r)
+		return w
+	}
+	adminToken := func(secret string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &JWTClaims{
+			ID:             "magical-unicorn",
+			AppMetaData:    map[string]interface{}{"roles": []string{"admin"}},
+			StandardClaims: &jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		})
+		signed, _ := token.SignedString([]byte(secret))
+		return signed
+	}
+
+	t.Run("OperatorOnly", func(t *testing.T) {
+		rsp := do("POST", "ops.example.com", "/v1/instances", "", `{"hostname": "a.example.com"}`)
+		validateError(t, http.StatusNotFound, rsp)
+		rsp = do("POST", "ops.example.com", "/v1/instances", "wrong-token", `{"hostname": "a.example.com"}`)
+		validateError(t, http.StatusNotFound, rsp)
+	})
+
+	instance := &models.Instance{}
+	rsp := do("POST", "ops.example.com", "/v1/instances", "operator-token", `{"hostname": "A.example.com", "config": {"jwt": {"secret": "secret-a"}}}`)
+	extractPayload(t, http.StatusCreated, rsp, instance)
+	assert.Equal(t, "a.example.com", instance.Hostname)
+	assert.Equal(t, "secret-a", instance.Config["jwt"].(map[string]interface{})["secret"])
+
+	other := &models.Instance{}
+	rsp = do("POST", "ops.example.com", "/v1/instances", "operator-token", `{"hostname": "b.example.com", "config": {"jwt": {"secret": "secret-b"}}}`)
+	extractPayload(t, http.StatusCreated, rsp, other)
+
+	t.Run("HostnameTaken", func(t *testing.T) {
+		rsp := do("PUT", "ops.example.com", "/v1/instances/"+other.ID, "operator-token", `{"hostname": "a.example.com"}`)
+		validateError(t, http.StatusBadRequest, rsp)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		rsp := do("POST", "ops.example.com", "/v1/instances", "operator-token", `{"hostname": "c.example.com", "config": {"jwt": "secret"}}`)
+		validateError(t, http.StatusBadRequest, rsp)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		instances := []models.Instance{}
+		rsp := do("GET", "ops.example.com", "/v1/instances", "operator-token", "")
+		extractPayload(t, http.StatusOK, rsp, &instances)
+		if assert.Len(t, instances, 2) {
+			assert.Equal(t, instance.ID, instances[0].ID)
+			assert.Equal(t, other.ID, instances[1].ID)
+		}
+
+		// the admin of an instance isn't the operator
+		rsp = do("GET", "a.example.com", "/v1/instances", adminToken("secret-a"), "")
+		validateError(t, http.StatusUnauthorized, rsp)
+	})
+
+	t.Run("InstanceSecret", func(t *testing.T) {
+		rsp := do("GET", "a.example.com:8080", "/v1/orders", adminToken("secret"), "")
+		validateError(t, http.StatusUnauthorized, rsp)
+		rsp = do("GET", "a.example.com:8080", "/v1/orders", adminToken("secret-a"), "")
+		assert.Equal(t, http.StatusOK, rsp.Code)
+	})
+
+	t.Run("ScopedOrders", func(t *testing.T) {
+		order := models.NewOrder("session", "alfred@wayneindustries.com", "usd")
+		order.UserID = "magical-unicorn"
+		if !assert.NoError(t, models.ForInstance(db, instance.ID).Create(order).Error) {
+			t.FailNow()
+		}
+		stored := &models.Order{}
+		assert.NoError(t, db.First(stored, "id = ?", order.ID).Error)
+		assert.Equal(t, instance.ID, stored.InstanceID)
+
+		orders := []models.Order{}
+		rsp := do("GET", "a.example.com", "/v1/orders", adminToken("secret-a"), "")
+		extractPayload(t, http.StatusOK, rsp, &orders)
+		if assert.Len(t, orders, 1) {
+			assert.Equal(t, order.ID, orders[0].ID)
+		}
+
+		// by the instance header
+		orders = []models.Order{}
+		r := httptest.NewRequest("GET", "/v1/orders", nil)
+		r.Host = "gocommerce.internal"
+		r.Header.Set(instanceHeader, other.ID)
+		r.Header.Set("Authorization", "Bearer "+adminToken("secret-b"))
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, r)
+		extractPayload(t, http.StatusOK, w, &orders)
+		assert.Len(t, orders, 0)
+
+		rsp = do("GET", "b.example.com", "/v1/orders/"+order.ID, adminToken("secret-b"), "")
+		validateError(t, http.StatusNotFound, rsp)
+	})
+
+	t.Run("ScopedInventory", func(t *testing.T) {
+		rsp := do("PUT", "a.example.com", "/v1/inventory/book", adminToken("secret-a"), `{"quantity": 3}`)
+		assert.Equal(t, http.StatusOK, rsp.Code)
+		rsp = do("PUT", "b.example.com", "/v1/inventory/book", adminToken("secret-b"), `{"quantity": 7}`)
+		assert.Equal(t, http.StatusOK, rsp.Code)
+		rsp = do("PUT", "a.example.com", "/v1/inventory/book", adminToken("secret-a"), `{"quantity": 4}`)
+		assert.Equal(t, http.StatusOK, rsp.Code)
+
+		items := []models.InventoryItem{}
+		rsp = do("GET", "a.example.com", "/v1/inventory", adminToken("secret-a"), "")
+		extractPayload(t, http.StatusOK, rsp, &items)
+		if assert.Len(t, items, 1) {
+			assert.EqualValues(t, 4, items[0].Quantity)
+		}
+		items = []models.InventoryItem{}
+		rsp = do("GET", "b.example.com", "/v1/inventory", adminToken("secret-b"), "")
+		extractPayload(t, http.StatusOK, rsp, &items)
+		if assert.Len(t, items, 1) {
+			assert.EqualValues(t, 7, items[0].Quantity, "instances keep their own stock of a SKU")
+		}
+	})
+
+	t.Run("UnknownHost", func(t *testing.T) {
+		rsp := do("GET", "unknown.example.com", "/v1/orders", adminToken("secret"), "")
+		validateError(t, http.StatusNotFound, rsp)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		rsp := do("DELETE", "ops.example.com", "/v1/instances/"+other.ID, "operator-token", "")
+		assert.Equal(t, http.StatusOK, rsp.Code)
+		rsp = do("GET", "b.example.com", "/v1/orders", adminToken("secret-b"), "")
+		validateError(t, http.StatusNotFound, rsp)
+		rsp = do("GET", "ops.example.com", "/v1/instances/"+other.ID, "operator-token", "")
+		validateError(t, http.StatusNotFound, rsp)
+	})
+}
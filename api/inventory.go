@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/guregu/kami"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// InventoryParams holds the parameters for setting the stock of a SKU
+type InventoryParams struct {
+	Quantity *int64 `json:"quantity"`
+}
+
+// InventoryList lists the stock of all tracked SKUs
+func (a *API) InventoryList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).Model(&models.InventoryItem{})
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	items := []models.InventoryItem{}
+	if rsp := query.Order("sku asc").Offset(offset).Limit(limit).Find(&items); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for inventory")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, 200, items)
+}
+
+// InventoryUpdate sets the stock of a SKU, which starts tracking it if it
+// wasn't tracked before
+func (a *API) InventoryUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	sku := kami.Param(ctx, "sku")
+	log := getLogger(ctx).WithField("sku", sku)
+	params := new(InventoryParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		log.WithError(err).Infof("Failed to deserialize inventory params: %s", err.Error())
+		readError(w, "inventory params", err)
+		return
+	}
+	if params.Quantity == nil || *params.Quantity < 0 {
+		badRequestError(w, "The stock must be a quantity of 0 or more")
+		return
+	}
+
+	tx := a.dbFor(ctx).Begin()
+	item, previous, err := models.SetInventory(tx, sku, *params.Quantity)
+	if err != nil {
+		log.WithError(err).Warn("Error while saving inventory")
+		cleanup(tx, w, internalServerError(w, "Error saving inventory"))
+		return
+	}
+	var before map[string]interface{}
+	if previous != nil {
+		before = models.Snapshot(previous)
+	}
+	a.audit(ctx, tx, r, "inventory.update", "inventory", sku, before, models.Snapshot(item))
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.StockEvent, Payload: item})
+	if rsp := batch.Commit(); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while committing inventory")
+		internalServerError(w, "Error saving inventory")
+		return
+	}
+
+	log.WithField("quantity", item.Quantity).Info("Updated inventory")
+	sendJSON(w, 200, item)
+}
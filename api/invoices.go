@@ -0,0 +1,26 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// assignInvoiceNumber gives a paid order the next number of the invoice
+// series of the country it's taxed for. It's called in the transaction that
+// records the payment, so the series has no gaps.
+func assignInvoiceNumber(config *conf.Configuration, tx *gorm.DB, order *models.Order) error {
+	if order.InvoiceNumber != "" {
+		return nil
+	}
+	prefix := config.InvoicePrefix(order.TaxCountry)
+	number, err := models.NextInvoiceNumber(tx, order.InstanceID, prefix)
+	if err != nil {
+		return fmt.Errorf("Error creating invoice number: %v", err)
+	}
+	order.InvoiceNumber = fmt.Sprintf("%s%0*d", prefix, config.Invoices.Digits, number)
+	return nil
+}
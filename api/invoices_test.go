@@ -0,0 +1,65 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestPaymentCreateAssignsInvoiceNumber(t *testing.T) {
+	db, config := db(t)
+	config.Invoices.Prefix = "INV-"
+	config.Invoices.Digits = 4
+	assert.NoError(t, db.Create(&models.InvoiceSeries{Prefix: "INV-", LastNumber: 41}).Error)
+
+	w := runPaymentCreate(t, db, config, &chargeProvider{id: "ch_123"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	order := &models.Order{}
+	db.First(order, "id = ?", secondOrder.ID)
+	assert.Equal(t, models.PaidState, order.PaymentState)
+	assert.Equal(t, "INV-0042", order.InvoiceNumber)
+}
+
+func TestPaymentCreateUsesCountrySeries(t *testing.T) {
+	db, config := db(t)
+	config.Invoices.Prefix = "INV-"
+	config.Invoices.Digits = 4
+	config.Invoices.Series = []conf.InvoiceSeries{{Prefix: "DE-", Countries: []string{"germany"}}}
+	assert.NoError(t, db.Model(&models.Order{}).Where("id = ?", secondOrder.ID).UpdateColumn("tax_country", "Germany").Error)
+
+	w := runPaymentCreate(t, db, config, &chargeProvider{id: "ch_123"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	order := &models.Order{}
+	db.First(order, "id = ?", secondOrder.ID)
+	assert.Equal(t, "DE-0001", order.InvoiceNumber)
+}
+
+func TestFailedPaymentsTakeNoInvoiceNumber(t *testing.T) {
+	db, config := db(t)
+	config.Invoices.Prefix = "INV-"
+
+	validateError(t, http.StatusInternalServerError, runPaymentCreate(t, db, config, &chargeProvider{err: errors.New("card declined")}))
+	order := &models.Order{}
+	db.First(order, "id = ?", secondOrder.ID)
+	assert.Empty(t, order.InvoiceNumber)
+
+	tx := db.Begin()
+	number, err := models.NextInvoiceNumber(tx, "", "INV-")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), number)
+	tx.Rollback()
+
+	number, err = models.NextInvoiceNumber(db, "", "INV-")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), number, "a rolled back payment gives its number back")
+	number, err = models.NextInvoiceNumber(db, "", "INV-")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), number)
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/worker"
+)
+
+// EventJob is the type of the jobs that run the background subscribers of
+// an event in a worker
+const EventJob = "event"
+
+// eventJob is the payload of an EventJob. The order and the transaction are
+// loaded again when the job runs, so the subscribers see them as they are
+// then. Every subscriber gets a job of its own, so a failed mail is retried
+// without sending the other ones again.
+type eventJob struct {
+	Type          string    `json:"type"`
+	Subscriber    string    `json:"subscriber,omitempty"`
+	OrderID       string    `json:"order_id"`
+	UserID        string    `json:"user_id,omitempty"`
+	RequestID     string    `json:"request_id,omitempty"`
+	TransactionID string    `json:"transaction_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// backgroundSubscriber handles events after they were committed. Its job is
+// retried when it returns an error.
+type backgroundSubscriber struct {
+	name string
+	run  func(e *events.Event) error
+}
+
+// subscribeBackground runs h for the events of a type once they were
+// committed, in a worker when there are workers. Without workers an error
+// is only logged.
+func (a *API) subscribeBackground(eventType, name string, h func(e *events.Event) error) {
+	if a.currentConfig().Worker.Enabled {
+		a.background[eventType] = append(a.background[eventType], backgroundSubscriber{name: name, run: h})
+		return
+	}
+	a.events.Subscribe(eventType, func(e *events.Event) {
+		if err := h(e); err != nil {
+			a.log.WithError(err).WithField("order_id", e.OrderID).Errorf("Error running %s for the %v event", name, e.Type)
+		}
+	})
+}
+
+// queueEventJob queues a job for every background subscriber of the event
+// within its transaction
+func (a *API) queueEventJob(ctx context.Context, tx *gorm.DB, e *events.Event) {
+	if e.OrderID == "" {
+		return
+	}
+	for _, subscriber := range a.background[e.Type] {
+		payload := &eventJob{
+			Type:       e.Type,
+			Subscriber: subscriber.name,
+			OrderID:    e.OrderID,
+			UserID:     e.UserID,
+			RequestID:  e.RequestID,
+			CreatedAt:  e.CreatedAt,
+		}
+		if e.Transaction != nil {
+			payload.TransactionID = e.Transaction.ID
+		}
+		if err := worker.Enqueue(tx, EventJob, e.InstanceID, payload); err != nil {
+			getLogger(ctx).WithError(err).Errorf("Failed to queue the %v event for %s", e.Type, subscriber.name)
+		}
+	}
+}
+
+// RunEventJob runs the background subscriber of an event queued for the
+// workers
+func (a *API) RunEventJob(ctx context.Context, job *models.Job) error {
+	payload := &eventJob{}
+	if err := job.Decode(payload); err != nil {
+		return worker.Permanent(err)
+	}
+	subscribers := []backgroundSubscriber{}
+	for _, subscriber := range a.background[payload.Type] {
+		// the jobs queued before they were split up run every subscriber
+		if payload.Subscriber == "" || subscriber.name == payload.Subscriber {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	if len(subscribers) == 0 {
+		return worker.Permanent(fmt.Errorf("no subscriber %s for the %v event", payload.Subscriber, payload.Type))
+	}
+
+	order := &models.Order{}
+	rsp := orderQuery(models.ForInstance(a.db, job.InstanceID)).First(order, "id = ?", payload.OrderID)
+	if rsp.RecordNotFound() {
+		return worker.Permanent(fmt.Errorf("order %s of the event is gone", payload.OrderID))
+	}
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+
+	e := &events.Event{
+		Type:       payload.Type,
+		OrderID:    order.ID,
+		UserID:     payload.UserID,
+		RequestID:  payload.RequestID,
+		InstanceID: job.InstanceID,
+		Payload:    order,
+		CreatedAt:  payload.CreatedAt,
+	}
+	if payload.TransactionID != "" {
+		for _, t := range order.Transactions {
+			if t.ID == payload.TransactionID {
+				transaction := *t
+				transaction.Order = order
+				e.Transaction = &transaction
+			}
+		}
+		if e.Transaction == nil {
+			return worker.Permanent(fmt.Errorf("transaction %s of the event is gone", payload.TransactionID))
+		}
+	}
+
+	for _, subscriber := range subscribers {
+		if err := subscriber.run(e); err != nil {
+			return fmt.Errorf("%s failed: %v", subscriber.name, err)
+		}
+	}
+	return nil
+}
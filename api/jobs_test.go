@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+	"github.com/netlify/gocommerce/worker"
+)
+
+func TestEventJobsRunInWorker(t *testing.T) {
+	db, config := db(t)
+	config.Worker.Enabled = true
+	sender := &testSender{}
+	api := NewAPI(config, db, nil, testMailerWith(config, sender), nil)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "http://something", strings.NewReader(`{"fulfillment_state": "shipped", "tracking_number": "1Z999"}`))
+	api.OrderUpdate(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+	api.events.Wait()
+	assert.Empty(t, sender.messages, "the API leaves the mail to the workers")
+
+	jobs := []*models.Job{}
+	db.Find(&jobs)
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, EventJob, jobs[0].Type)
+		assert.Contains(t, jobs[0].Payload, webhooks.FulfillmentEvent)
+	}
+
+	jobWorker := worker.New(db, testLogger, config)
+	jobWorker.Handle(EventJob, api.RunEventJob)
+	assert.Equal(t, 1, jobWorker.Work(context.Background(), "test", time.Now()))
+	if assert.Len(t, sender.messages, 1) {
+		assert.Equal(t, firstOrder.Email, sender.messages[0].To)
+		assert.Equal(t, "Your order has shipped", sender.messages[0].Subject)
+		assert.Contains(t, sender.messages[0].HTML, "1Z999")
+	}
+
+	count := 0
+	db.Model(&models.Job{}).Count(&count)
+	assert.Equal(t, 0, count, "jobs that ran are removed")
+}
+
+func TestEventJobForDeletedOrder(t *testing.T) {
+	db, config := db(t)
+	config.Worker.Enabled = true
+	api := NewAPI(config, db, nil, testMailerWith(config, &testSender{}), nil)
+
+	assert.NoError(t, worker.Enqueue(db, EventJob, "", &eventJob{Type: webhooks.PaymentEvent, OrderID: "gone"}))
+	jobWorker := worker.New(db, testLogger, config)
+	jobWorker.Handle(EventJob, api.RunEventJob)
+	assert.Equal(t, 0, jobWorker.Work(context.Background(), "test", time.Now()))
+
+	job := &models.Job{}
+	if assert.NoError(t, db.First(job).Error) {
+		assert.True(t, job.Failed, "a missing order isn't retried")
+		assert.Contains(t, *job.ErrorMessage, "gone")
+	}
+}
+
+func TestEventJobsAreRetried(t *testing.T) {
+	db, config := db(t)
+	config.Worker.Enabled = true
+	config.Worker.MaxRetries = 3
+	config.Worker.RetryPeriod = time.Minute
+	config.Worker.MaxRetryPeriod = time.Hour
+	sender := &failingSender{errors: []error{errors.New("provider unavailable")}}
+	api := NewAPI(config, db, nil, testMailerWith(config, sender), nil)
+	db.Model(&models.Order{}).Where("id = ?", firstOrder.ID).UpdateColumn("fulfillment_state", models.ShippedState)
+	assert.NoError(t, worker.Enqueue(db, EventJob, "", &eventJob{Type: webhooks.FulfillmentEvent, Subscriber: "shipping_mail", OrderID: firstOrder.ID}))
+
+	jobWorker := worker.New(db, testLogger, config)
+	jobWorker.Handle(EventJob, api.RunEventJob)
+	now := time.Now()
+	assert.Equal(t, 0, jobWorker.Work(context.Background(), "test", now))
+	assert.Empty(t, sender.messages)
+	job := &models.Job{}
+	if assert.NoError(t, db.First(job).Error) {
+		assert.False(t, job.Failed, "a failed mail is retried")
+		assert.Contains(t, *job.ErrorMessage, "provider unavailable")
+	}
+
+	assert.Equal(t, 1, jobWorker.Work(context.Background(), "test", now.Add(2*time.Minute)))
+	assert.Len(t, sender.messages, 1)
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// Audience is the aud claim of a token. It's either a single string or a
+// list of strings, the JWT spec allows both.
+type Audience []string
+
+// UnmarshalJSON accepts an audience as a string or a list of strings
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("aud must be a string or a list of strings")
+	}
+	*a = Audience(list)
+	return nil
+}
+
+// MarshalJSON writes a single audience as a string, like most tokens have it
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// Contains tells if the audience includes aud
+func (a Audience) Contains(aud string) bool {
+	for _, value := range a {
+		if value == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyAudienceAndIssuer refuses tokens that weren't issued for this API,
+// when jwt.audience or jwt.issuer are set. An identity provider often signs
+// the tokens of several services with the same secret, and only these claims
+// tell them apart.
+func verifyAudienceAndIssuer(config *conf.Configuration, claims *JWTClaims) error {
+	if config.JWT.Audience != "" && !claims.Audience.Contains(config.JWT.Audience) {
+		return errors.New("token isn't meant for this audience")
+	}
+	if config.JWT.Issuer != "" && (claims.StandardClaims == nil || claims.StandardClaims.Issuer != config.JWT.Issuer) {
+		return errors.New("token wasn't issued by the expected issuer")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+func TestAudienceAndIssuer(t *testing.T) {
+	db, config := db(t)
+	config.JWT.Secret = "shared-with-other-services"
+	config.JWT.Audience = "commerce"
+	config.JWT.Issuer = "https://identity.example.com/"
+	config.JWT.AdminGroupName = "admin"
+	api := NewAPI(config, db, nil, nil, nil)
+
+	sign := func(claims *JWTClaims) string {
+		claims.ID = "magical-unicorn"
+		claims.AppMetaData = map[string]interface{}{"roles": []string{"admin"}}
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.JWT.Secret))
+		return signed
+	}
+	status := func(token string) int {
+		r := httptest.NewRequest("GET", "/v1/users", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	expires := time.Now().Add(time.Hour).Unix()
+
+	assert.Equal(t, http.StatusOK, status(sign(&JWTClaims{
+		Audience:       Audience{"commerce"},
+		StandardClaims: &jwt.StandardClaims{Issuer: "https://identity.example.com/", ExpiresAt: expires},
+	})))
+	assert.Equal(t, http.StatusOK, status(sign(&JWTClaims{
+		Audience:       Audience{"identity", "commerce"},
+		StandardClaims: &jwt.StandardClaims{Issuer: "https://identity.example.com/", ExpiresAt: expires},
+	})), "one of several audiences")
+
+	assert.Equal(t, http.StatusUnauthorized, status(sign(&JWTClaims{
+		Audience:       Audience{"billing"},
+		StandardClaims: &jwt.StandardClaims{Issuer: "https://identity.example.com/", ExpiresAt: expires},
+	})), "minted for another service")
+	assert.Equal(t, http.StatusUnauthorized, status(sign(&JWTClaims{
+		StandardClaims: &jwt.StandardClaims{Issuer: "https://identity.example.com/", ExpiresAt: expires},
+	})), "without an audience")
+	assert.Equal(t, http.StatusUnauthorized, status(sign(&JWTClaims{
+		Audience:       Audience{"commerce"},
+		StandardClaims: &jwt.StandardClaims{Issuer: "https://evil.example.com/", ExpiresAt: expires},
+	})), "another issuer")
+
+	admin, err := AdminToken(config, "cli:alfred", "alfred@wayneindustries.com", time.Minute)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, status(admin), "the tokens of the CLI have the claims")
+	}
+}
+
+func TestTokenKeyIDs(t *testing.T) {
+	db, config := db(t)
+	config.JWT.Secret = "before-rotation"
+	config.JWT.Keys = []conf.JWTKey{{ID: "2026-10", Secret: "after-rotation"}}
+	config.JWT.AdminGroupName = "admin"
+	api := NewAPI(config, db, nil, nil, nil)
+
+	sign := func(kid, secret string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &JWTClaims{
+			ID:             "magical-unicorn",
+			AppMetaData:    map[string]interface{}{"roles": []string{"admin"}},
+			StandardClaims: &jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, _ := token.SignedString([]byte(secret))
+		return signed
+	}
+	status := func(token string) int {
+		r := httptest.NewRequest("GET", "/v1/users", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status(sign("", "before-rotation")), "tokens without a kid use the secret")
+	assert.Equal(t, http.StatusOK, status(sign("2026-10", "after-rotation")))
+	assert.Equal(t, http.StatusUnauthorized, status(sign("2026-10", "before-rotation")), "signed with another key")
+	assert.Equal(t, http.StatusUnauthorized, status(sign("2026-09", "after-rotation")), "an unknown key")
+
+	config.JWT.SigningKeyID = "2026-10"
+	admin, err := AdminToken(config, "cli:alfred", "alfred@wayneindustries.com", time.Minute)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, status(admin))
+		parsed, _, err := new(jwt.Parser).ParseUnverified(admin, &JWTClaims{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "2026-10", parsed.Header["kid"])
+		}
+	}
+}
+
+func TestAudienceJSON(t *testing.T) {
+	claims := &JWTClaims{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"aud": "commerce"}`), claims))
+	assert.Equal(t, Audience{"commerce"}, claims.Audience)
+	assert.NoError(t, json.Unmarshal([]byte(`{"aud": ["identity", "commerce"]}`), claims))
+	assert.Equal(t, Audience{"identity", "commerce"}, claims.Audience)
+	assert.Error(t, json.Unmarshal([]byte(`{"aud": 42}`), claims))
+
+	data, err := json.Marshal(Audience{"commerce"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"commerce"`, string(data))
+	}
+}
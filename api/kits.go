@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// ComponentParams holds the parameters for fulfilling a kit component
+type ComponentParams struct {
+	FulfillmentState string `json:"fulfillment_state"`
+}
+
+// ComponentUpdate updates the fulfillment state of a single component of a
+// kit, so kits can be shipped a component at a time. The order is marked as
+// shipped once all of its components are.
+func (a *API) ComponentUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	orderID := kami.Param(ctx, "order_id")
+	componentID := kami.Param(ctx, "component_id")
+	log := getLogger(ctx).WithField("component_id", componentID)
+	claims := getClaims(ctx)
+
+	params := new(ComponentParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		log.WithError(err).Infof("Failed to deserialize component params: %s", err.Error())
+		readError(w, "component params", err)
+		return
+	}
+	if !inList([]string{models.PendingState, models.ShippingState, models.ShippedState}, params.FulfillmentState) {
+		badRequestError(w, "Bad fulfillment state: "+params.FulfillmentState)
+		return
+	}
+
+	order := &models.Order{}
+	if rsp := orderQuery(a.dbFor(ctx)).First(order, "id = ?", orderID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			notFoundError(w, "Failed to find order with id '%s'", orderID)
+		} else {
+			log.WithError(rsp.Error).Warnf("Failed to query for id '%s'", orderID)
+			internalServerError(w, "Error while querying for order")
+		}
+		return
+	}
+	if order.State == models.CancelledState {
+		badRequestError(w, "Can't fulfill a cancelled order")
+		return
+	}
+
+	var component *models.LineItemComponent
+	for _, item := range order.LineItems {
+		for _, c := range item.Components {
+			if strconv.FormatInt(c.ID, 10) == componentID {
+				component = c
+			}
+		}
+	}
+	if component == nil {
+		notFoundError(w, "Failed to find component with id '%s'", componentID)
+		return
+	}
+
+	before := models.Snapshot(component)
+	component.FulfillmentState = params.FulfillmentState
+	component.ShippedAt = nil
+	if component.FulfillmentState == models.ShippedState {
+		now := time.Now()
+		component.ShippedAt = &now
+	}
+	order.UpdateFulfillmentState()
+
+	tx := a.dbFor(ctx).Begin()
+	if rsp := tx.Save(component); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Problem while saving component")
+		internalServerError(w, "Error saving component")
+		tx.Rollback()
+		return
+	}
+	if rsp := tx.Model(order).UpdateColumn("fulfillment_state", order.FulfillmentState); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Problem while saving order fulfillment state")
+		internalServerError(w, "Error saving order")
+		tx.Rollback()
+		return
+	}
+
+	models.LogEvent(tx, r.RemoteAddr, claims.ID, order.ID, models.EventUpdated, []string{"components"})
+	a.audit(ctx, tx, r, "order.component_update", "component", componentID, before, models.Snapshot(component))
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.FulfillmentEvent, UserID: order.UserID, Payload: order})
+	if rsp := batch.Commit(); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Problem while committing component update")
+		internalServerError(w, "Error committing component update")
+		return
+	}
+
+	log.WithField("fulfillment_state", component.FulfillmentState).Info("Updated kit component")
+	sendJSON(w, 200, order)
+}
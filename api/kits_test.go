@@ -0,0 +1,113 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func createKitOrder(t *testing.T, db *gorm.DB, config *conf.Configuration, quantity int) *httptest.ResponseRecorder {
+	startTestSite(config)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://not-real", strings.NewReader(`{
+		"email": "info@example.com",
+		"shipping_address": {
+			"first_name": "Test", "last_name": "User",
+			"address1": "Branengebranen",
+			"city": "Berlin", "country": "Germany", "zip": "94107"
+		},
+		"line_items": [{"path": "/kit-product", "quantity": `+strconv.Itoa(quantity)+`}]
+	}`))
+	NewAPI(config, db, nil, nil, nil).OrderCreate(testContext(nil, config, false), w, r)
+	return w
+}
+
+func TestOrderCreationForKitWithTaxes(t *testing.T) {
+	db, config := db(t)
+
+	order := &models.Order{}
+	extractPayload(t, 201, createKitOrder(t, db, config, 1), order)
+
+	// the kit price is split 1200/800 between the book and e-book, taxed at 7% and 19%
+	assert.Equal(t, uint64(2000), order.SubTotal)
+	assert.Equal(t, uint64(236), order.Taxes)
+	assert.Equal(t, uint64(2236), order.Total)
+	if assert.Len(t, order.LineItems, 1) && assert.Len(t, order.LineItems[0].Components, 2) {
+		components := order.LineItems[0].Components
+		assert.Equal(t, "kit-book", components[0].Sku)
+		assert.Equal(t, uint64(1200), components[0].Price)
+		assert.Equal(t, "kit-ebook", components[1].Sku)
+		assert.Equal(t, uint64(800), components[1].Price)
+	}
+}
+
+func TestOrderCreationForKitDecrementsInventory(t *testing.T) {
+	db, config := db(t)
+	db.Save(&models.InventoryItem{Sku: "kit-book", Quantity: 3})
+	defer db.Delete(&models.InventoryItem{Sku: "kit-book"})
+
+	extractPayload(t, 201, createKitOrder(t, db, config, 2), &models.Order{})
+
+	stock := &models.InventoryItem{}
+	db.First(stock, "sku = ?", "kit-book")
+	assert.EqualValues(t, 1, stock.Quantity)
+
+	validateError(t, 400, createKitOrder(t, db, config, 2))
+	db.First(stock, "sku = ?", "kit-book")
+	assert.EqualValues(t, 1, stock.Quantity)
+}
+
+func TestComponentUpdate(t *testing.T) {
+	db, config := db(t)
+
+	order := &models.Order{}
+	extractPayload(t, 201, createKitOrder(t, db, config, 1), order)
+	components := order.LineItems[0].Components
+
+	update := func(component *models.LineItemComponent) *models.Order {
+		ctx := testContext(testToken("magical-unicorn", ""), config, true)
+		ctx = kami.SetParam(ctx, "order_id", order.ID)
+		ctx = kami.SetParam(ctx, "component_id", strconv.FormatInt(component.ID, 10))
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PUT", "http://something", strings.NewReader(`{"fulfillment_state": "shipped"}`))
+		NewAPI(config, db, nil, nil, nil).ComponentUpdate(ctx, w, r)
+
+		updated := &models.Order{}
+		extractPayload(t, 200, w, updated)
+		return updated
+	}
+
+	updated := update(components[0])
+	assert.Equal(t, models.ShippingState, updated.FulfillmentState)
+	assert.NotNil(t, updated.LineItems[0].Components[0].ShippedAt)
+
+	updated = update(components[1])
+	assert.Equal(t, models.ShippedState, updated.FulfillmentState)
+
+	stored := &models.Order{}
+	db.First(stored, "id = ?", order.ID)
+	assert.Equal(t, models.ShippedState, stored.FulfillmentState)
+}
+
+func TestComponentUpdateAsNonAdmin(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken(testUser.ID, ""), config, false)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	ctx = kami.SetParam(ctx, "component_id", "1")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "http://something", strings.NewReader(`{"fulfillment_state": "shipped"}`))
+
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "PUT /orders/:order_id/components/:component_id", api.ComponentUpdate)(ctx, w, r)
+	validateError(t, 401, w)
+}
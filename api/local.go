@@ -0,0 +1,46 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// Handler serves the API to callers in the same process, like the admin
+// commands of the CLI
+func (a *API) Handler() http.Handler {
+	return a.handler
+}
+
+// AdminToken signs a token with the admin role, with the JWT signing key of
+// the configuration. The admin commands of the CLI call the API with it, so
+// their changes are checked, audited and sent to the webhooks like the ones
+// made through the API.
+func AdminToken(config *conf.Configuration, id, email string, ttl time.Duration) (string, error) {
+	claims := &JWTClaims{
+		ID:          id,
+		Email:       email,
+		AppMetaData: map[string]interface{}{"roles": []string{config.JWT.AdminGroupName}},
+		StandardClaims: &jwt.StandardClaims{
+			Subject:   id,
+			Issuer:    config.JWT.Issuer,
+			ExpiresAt: time.Now().Add(ttl).Unix(),
+		},
+	}
+	if config.JWT.Audience != "" {
+		claims.Audience = Audience{config.JWT.Audience}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	secret, ok := config.JWTSecret(config.JWT.SigningKeyID)
+	if !ok {
+		return "", fmt.Errorf("unknown JWT signing key %s", config.JWT.SigningKeyID)
+	}
+	if config.JWT.SigningKeyID != "" {
+		token.Header["kid"] = config.JWT.SigningKeyID
+	}
+	return token.SignedString([]byte(secret))
+}
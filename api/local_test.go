@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestAdminToken(t *testing.T) {
+	db, config := db(t)
+	config.JWT.Secret = "secret"
+	config.JWT.AdminGroupName = "admin"
+	api := NewAPI(config, db, nil, nil, nil)
+
+	token, err := AdminToken(config, "cli:ops", "ops@example.com", time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	r := httptest.NewRequest("PUT", "/v1/orders/"+firstOrder.ID, strings.NewReader(`{"fulfillment_state": "shipped", "carrier": "UPS"}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	api.Handler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	entry := &models.AuditLog{}
+	if assert.NoError(t, db.First(entry, "action = ?", "order.update").Error) {
+		assert.Equal(t, "cli:ops", entry.ActorID)
+		assert.Equal(t, "ops@example.com", entry.ActorEmail)
+	}
+
+	expired, _ := AdminToken(config, "cli:ops", "ops@example.com", -time.Minute)
+	r = httptest.NewRequest("GET", "/v1/orders/"+firstOrder.ID, nil)
+	r.Header.Set("Authorization", "Bearer "+expired)
+	w = httptest.NewRecorder()
+	api.Handler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
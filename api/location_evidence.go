@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/charge"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// cardCountryProvider is a payment provider that can tell the country the
+// card of a charge was issued in
+type cardCountryProvider interface {
+	cardCountry(ctx context.Context, chargeID string) (string, error)
+}
+
+func (s stripeProvider) cardCountry(ctx context.Context, chargeID string) (string, error) {
+	var ch *stripe.Charge
+	var err error
+	if s.key != "" {
+		ch, err = charge.Client{B: stripe.GetBackend(stripe.APIBackend), Key: s.key}.Get(chargeID, nil)
+	} else {
+		ch, err = charge.Get(chargeID, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	if ch.Source == nil || ch.Source.Card == nil {
+		return "", nil
+	}
+	return ch.Source.Card.Country, nil
+}
+
+// ipCountry is the country of the client's IP address, from the header of
+// vat.ip_country_header. Only trusted proxies get to set it.
+func (a *API) ipCountry(config *conf.Configuration, r *http.Request) string {
+	if config.VAT.IPCountryHeader == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !a.trustedProxies.Contains(net.ParseIP(host)) {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimSpace(r.Header.Get(config.VAT.IPCountryHeader)))
+}
+
+// evidenceCountry is the code a country is compared as, the VAT code of EU
+// member states
+func evidenceCountry(country string) string {
+	if code, ok := memberStateCode(country); ok {
+		return code
+	}
+	return strings.ToUpper(strings.TrimSpace(country))
+}
+
+// evidenceMemberState is the member state a digital sale to an EU consumer was
+// taxed for, the orders that need location evidence
+func evidenceMemberState(config *conf.Configuration, order *models.Order) (string, bool) {
+	country := order.TaxCountry
+	if country == "" {
+		country = order.ShippingAddress.Country
+	}
+	taxed, ok := memberStateCode(country)
+	if !ok || order.VATNumber != "" {
+		return "", false
+	}
+	for _, item := range order.LineItems {
+		if digitalItem(config, item) {
+			return taxed, true
+		}
+	}
+	return "", false
+}
+
+// locationEvidence checks the billing country, the IP country and the card
+// country of a digital sale to an EU consumer support the country it was
+// taxed for, two of them have to. It's empty for the other orders.
+func locationEvidence(config *conf.Configuration, order *models.Order) string {
+	taxed, ok := evidenceMemberState(config, order)
+	if !ok {
+		return ""
+	}
+
+	agreeing, available := 0, 0
+	for _, evidence := range []string{order.BillingAddress.Country, order.IPCountry, order.CardCountry} {
+		if evidence == "" {
+			continue
+		}
+		available++
+		if evidenceCountry(evidence) == taxed {
+			agreeing++
+		}
+	}
+	switch {
+	case agreeing >= 2:
+		return models.LocationConsistent
+	case available > agreeing:
+		return models.LocationConflicting
+	}
+	return models.LocationInsufficient
+}
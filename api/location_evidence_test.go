@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// cardProvider charges cards issued in the country
+type cardProvider struct {
+	chargeProvider
+	country string
+}
+
+func (cp *cardProvider) cardCountry(ctx context.Context, chargeID string) (string, error) {
+	return cp.country, nil
+}
+
+func TestIPCountryFromTrustedProxies(t *testing.T) {
+	_, config := db(t)
+	config.API.TrustedProxies = []string{"10.0.0.1"}
+	config.VAT.IPCountryHeader = "CF-IPCountry"
+	api := NewAPI(config, nil, nil, nil, nil)
+
+	r, _ := http.NewRequest("POST", "https://example.org", nil)
+	r.Header.Set("CF-IPCountry", "de")
+	r.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "DE", api.ipCountry(config, r))
+
+	r.RemoteAddr = "203.0.113.7:1234"
+	assert.Empty(t, api.ipCountry(config, r), "only proxies get to tell the country")
+}
+
+func TestLocationEvidence(t *testing.T) {
+	db, config := db(t)
+	db.Model(&models.Address{}).Where("id = ?", testAddress.ID).UpdateColumn("country", "Germany")
+
+	pay := func(ipCountry, cardCountry string) *models.Order {
+		db.Model(&models.Order{}).Where("id = ?", secondOrder.ID).Updates(map[string]interface{}{"tax_country": "Germany", "ip_country": ipCountry, "payment_state": models.PendingState})
+		db.Where("order_id = ?", secondOrder.ID).Delete(&models.Transaction{})
+		w := runPaymentCreate(t, db, config, &cardProvider{chargeProvider: chargeProvider{id: "ch_123"}, country: cardCountry})
+		assert.Equal(t, http.StatusOK, w.Code)
+		order := &models.Order{}
+		db.First(order, "id = ?", secondOrder.ID)
+		return order
+	}
+
+	order := pay("", "DE")
+	assert.Equal(t, "DE", order.CardCountry)
+	assert.Equal(t, models.LocationConsistent, order.LocationEvidence)
+
+	assert.Equal(t, models.LocationConsistent, pay("DE", "US").LocationEvidence, "two pieces of evidence are enough")
+	assert.Equal(t, models.LocationConflicting, pay("FR", "US").LocationEvidence)
+	assert.Equal(t, models.LocationInsufficient, pay("", "").LocationEvidence)
+
+	config.Taxes.DigitalTypes = []string{"ebook"}
+	order = pay("FR", "US")
+	assert.Empty(t, order.LocationEvidence, "only digital sales need evidence")
+	assert.Empty(t, order.CardCountry, "the card is only looked up for evidence")
+}
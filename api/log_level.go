@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// LogLevelParams change the log level, for Duration if it's set
+type LogLevelParams struct {
+	Level    string `json:"level"`
+	Duration string `json:"duration"`
+}
+
+// LogLevelResponse is the log level, and when it goes back to the one before
+type LogLevelResponse struct {
+	Level     string     `json:"level"`
+	RevertsAt *time.Time `json:"reverts_at,omitempty"`
+}
+
+// logLevelState reverts a temporary log level
+type logLevelState struct {
+	mutex     sync.Mutex
+	timer     *time.Timer
+	revertsAt *time.Time
+}
+
+// set changes the log level. A temporary level goes back to the level before
+// after duration, unless the level is changed again before then.
+func (s *logLevelState) set(level logrus.Level, duration time.Duration) *time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := logrus.GetLevel()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+		s.revertsAt = nil
+	}
+	logrus.SetLevel(level)
+	if duration > 0 {
+		revertsAt := time.Now().Add(duration)
+		s.revertsAt = &revertsAt
+		var timer *time.Timer
+		timer = time.AfterFunc(duration, func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.timer == timer {
+				logrus.SetLevel(previous)
+				logrus.Infof("Log level went back to %s", previous)
+				s.timer = nil
+				s.revertsAt = nil
+			}
+		})
+		s.timer = timer
+	}
+	return s.revertsAt
+}
+
+func (s *logLevelState) response() *LogLevelResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &LogLevelResponse{Level: logrus.GetLevel().String(), RevertsAt: s.revertsAt}
+}
+
+// LogLevelView shows the log level
+func (a *API) LogLevelView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, http.StatusOK, a.logLevel.response())
+}
+
+// LogLevelUpdate changes the log level while serving, like to debug during
+// an incident. With a duration the level goes back to the one before.
+func (a *API) LogLevelUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := &LogLevelParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		readError(w, "log level params", err)
+		return
+	}
+	level, err := logrus.ParseLevel(strings.ToLower(params.Level))
+	if err != nil {
+		badRequestError(w, "Unknown log level '%s'", params.Level)
+		return
+	}
+	var duration time.Duration
+	if params.Duration != "" {
+		if duration, err = time.ParseDuration(params.Duration); err != nil || duration <= 0 {
+			badRequestError(w, "Invalid duration '%s'", params.Duration)
+			return
+		}
+	}
+
+	before := models.Snapshot(a.logLevel.response())
+	a.logLevel.set(level, duration)
+	a.audit(ctx, a.dbFor(ctx), r, "log_level.update", "log_level", "", before, models.Snapshot(a.logLevel.response()))
+	log.WithField("duration", params.Duration).Warnf("Changed the log level to %s", level)
+	sendJSON(w, http.StatusOK, a.logLevel.response())
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevelUpdate(t *testing.T) {
+	db, config := db(t)
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.InfoLevel)
+	api := NewAPI(config, db, nil, nil, nil)
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+
+	update := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PUT", "http://something/log_level", strings.NewReader(body))
+		api.LogLevelUpdate(ctx, w, r)
+		return w
+	}
+
+	rsp := &LogLevelResponse{}
+	extractPayload(t, http.StatusOK, update(`{"level": "DEBUG"}`), rsp)
+	assert.Equal(t, "debug", rsp.Level)
+	assert.Nil(t, rsp.RevertsAt)
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+
+	// a temporary level goes back to the one before
+	extractPayload(t, http.StatusOK, update(`{"level": "warn", "duration": "50ms"}`), rsp)
+	assert.Equal(t, "warning", rsp.Level)
+	assert.NotNil(t, rsp.RevertsAt)
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/log_level", nil)
+	api.LogLevelView(ctx, w, r)
+	rsp = &LogLevelResponse{}
+	extractPayload(t, http.StatusOK, w, rsp)
+	assert.Equal(t, "debug", rsp.Level)
+	assert.Nil(t, rsp.RevertsAt)
+
+	validateError(t, http.StatusBadRequest, update(`{"level": "verbose"}`))
+	validateError(t, http.StatusBadRequest, update(`{"level": "debug", "duration": "-1m"}`))
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "http://something/log_level", strings.NewReader(`{"level": "error"}`))
+	guarded(t, api, "PUT /log_level", api.LogLevelUpdate)(testContext(testToken(testUser.ID, ""), config, false), w, r)
+	validateError(t, http.StatusUnauthorized, w)
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+// webhookDeliveryRetention is how long a handled webhook delivery is kept
+// to refuse replays of it. Signed deliveries are too old to be accepted well
+// before then and SNS stops retrying within the hour.
+const webhookDeliveryRetention = 24 * time.Hour
+
+// MailBounceWebhook receives the bounce and complaint webhooks of the mail
+// provider. The provider's own signature, or token for SES, authenticates it.
+// Hard bounces, complaints and unsubscribes put the address on the
+// suppression list. A delivery that was handled before is acknowledged
+// without handling it again.
+func (a *API) MailBounceWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+
+	var receiver mailer.BounceReceiver
+	if m := a.mailerFor(ctx); m != nil {
+		receiver, _ = m.Sender.(mailer.BounceReceiver)
+	}
+	if receiver == nil {
+		notFoundError(w, "The mail provider doesn't send bounce webhooks")
+		return
+	}
+
+	webhook, err := receiver.Bounces(r)
+	if err == mailer.ErrUnverifiedWebhook {
+		log.Warn("Received a bounce webhook with an invalid signature")
+		unauthorizedError(w, err.Error())
+		return
+	}
+	if err != nil {
+		log.WithError(err).Info("Failed to read bounce webhook")
+		readError(w, "bounce webhook", err)
+		return
+	}
+
+	db := a.dbFor(ctx)
+	if err := models.PruneWebhookDeliveries(db, time.Now().Add(-webhookDeliveryRetention)); err != nil {
+		log.WithError(err).Warn("Failed to prune webhook deliveries")
+	}
+
+	tx := db.Begin()
+	first, err := models.RecordWebhookDelivery(tx, webhook.ID)
+	if err != nil {
+		tx.Rollback()
+		log.WithError(err).Warn("Failed to record webhook delivery")
+		internalServerError(w, "Failed to record webhook delivery")
+		return
+	}
+	if !first {
+		tx.Rollback()
+		log.WithField("delivery_id", webhook.ID).Info("Ignoring a bounce webhook that was delivered before")
+		sendJSON(w, http.StatusOK, map[string]int{"bounces": 0})
+		return
+	}
+	for _, bounce := range webhook.Bounces {
+		record := &models.MailBounce{
+			Email:     bounce.Email,
+			Type:      bounce.Type,
+			Reason:    bounce.Reason,
+			Provider:  getConfig(ctx).Mailer.Provider,
+			MessageID: bounce.MessageID,
+			BouncedAt: bounce.At,
+		}
+		if err := tx.Create(record).Error; err != nil {
+			tx.Rollback()
+			log.WithError(err).Warn("Failed to save mail bounce")
+			internalServerError(w, "Failed to save mail bounce")
+			return
+		}
+		if mailer.Suppresses(bounce.Type) {
+			if _, err := models.Suppress(tx, bounce.Email, bounce.Type); err != nil {
+				tx.Rollback()
+				log.WithError(err).Warn("Failed to suppress mail address")
+				internalServerError(w, "Failed to suppress mail address")
+				return
+			}
+		}
+		log.WithField("email", bounce.Email).Infof("Mail bounced: %s %s", bounce.Type, bounce.Reason)
+	}
+	tx.Commit()
+
+	sendJSON(w, http.StatusOK, map[string]int{"bounces": len(webhook.Bounces)})
+}
+
+// MailBounceList lists the bounces and complaints reported by the mail
+// provider, optionally for a single ?email
+func (a *API) MailBounceList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).Model(&models.MailBounce{})
+	if email := r.URL.Query().Get("email"); email != "" {
+		query = query.Where("email = ?", email)
+	}
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	bounces := []models.MailBounce{}
+	if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&bounces); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for mail bounces")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, bounces)
+}
+
+// MailSuppressionParams adds an address to the suppression list by hand
+type MailSuppressionParams struct {
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+}
+
+// MailSuppressionList lists the addresses no mails are sent to, optionally
+// just a single ?email
+func (a *API) MailSuppressionList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).Model(&models.MailSuppression{})
+	if email := r.URL.Query().Get("email"); email != "" {
+		query = query.Where("email = ?", strings.ToLower(email))
+	}
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	suppressions := []models.MailSuppression{}
+	if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&suppressions); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for mail suppressions")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, suppressions)
+}
+
+// MailSuppressionCreate stops the mails to an address
+func (a *API) MailSuppressionCreate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := &MailSuppressionParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		log.WithError(err).Infof("Failed to deserialize mail suppression params: %s", err.Error())
+		readError(w, "mail suppression params", err)
+		return
+	}
+	address, err := netmail.ParseAddress(params.Email)
+	if err != nil {
+		badRequestError(w, "Invalid email address: %v", err)
+		return
+	}
+	if params.Reason == "" {
+		params.Reason = "manual"
+	}
+
+	suppression, err := models.Suppress(a.dbFor(ctx), address.Address, params.Reason)
+	if err != nil {
+		log.WithError(err).Warn("Failed to suppress mail address")
+		internalServerError(w, "Failed to suppress mail address")
+		return
+	}
+	log.WithField("email", address.Address).Info("Suppressed mail address")
+
+	a.audit(ctx, a.dbFor(ctx), r, "mail_suppression.create", "mail_suppression", suppression.Email, nil, models.Snapshot(suppression))
+	sendJSON(w, http.StatusOK, suppression)
+}
+
+// MailSuppressionDelete sends mails to a suppressed address again
+func (a *API) MailSuppressionDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	email := kami.Param(ctx, "email")
+	found, err := models.Unsuppress(a.dbFor(ctx), email)
+	if err != nil {
+		log.WithError(err).Warn("Failed to remove mail suppression")
+		internalServerError(w, "Failed to remove mail suppression")
+		return
+	}
+	if !found {
+		notFoundError(w, "Mail address isn't suppressed")
+		return
+	}
+	a.audit(ctx, a.dbFor(ctx), r, "mail_suppression.delete", "mail_suppression", email, nil, nil)
+	log.WithField("email", email).Info("Removed mail suppression")
+}
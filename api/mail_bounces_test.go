@@ -0,0 +1,392 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestMailSendGridSend(t *testing.T) {
+	_, config := db(t)
+
+	sent := make(chan map[string]interface{}, 1)
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/mail/send", r.URL.Path)
+		assert.Equal(t, "Bearer SG.key", r.Header.Get("Authorization"))
+		body := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		sent <- body
+		w.Header().Set("X-Message-Id", "msg-1")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer provider.Close()
+
+	config.Mailer.Provider = conf.SendGridProvider
+	config.Mailer.AdminEmail = "Shop <shop@example.com>"
+	config.Mailer.SendGrid.APIKey = "SG.key"
+	config.Mailer.SendGrid.APIURL = provider.URL
+
+	m := mailer.NewMailer(config)
+	assert.NoError(t, m.Mail("buyer@example.com", mailer.Template{Subject: "Hello {{ .Name }}", Default: "<p>{{ .Name }}</p>"}, map[string]interface{}{"Name": "Joe"}))
+
+	body := <-sent
+	assert.Equal(t, "Hello Joe", body["subject"])
+	assert.Equal(t, map[string]interface{}{"email": "shop@example.com", "name": "Shop"}, body["from"])
+	assert.Contains(t, fmt.Sprint(body["personalizations"]), "buyer@example.com")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"type": "text/plain", "value": "Joe\n"},
+		map[string]interface{}{"type": "text/html", "value": "<p>Joe</p>"},
+	}, body["content"])
+}
+
+func TestMailSendGridError(t *testing.T) {
+	_, config := db(t)
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"errors": [{"message": "too many requests"}]}`))
+	}))
+	defer provider.Close()
+
+	config.Mailer.Provider = conf.SendGridProvider
+	config.Mailer.SendGrid.APIKey = "SG.key"
+	config.Mailer.SendGrid.APIURL = provider.URL
+
+	err := mailer.NewMailer(config).Mail("buyer@example.com", mailer.Template{Subject: "Hello", Default: "<p>Hi</p>"}, nil)
+	if providerErr, ok := err.(*mailer.ProviderError); assert.True(t, ok) {
+		assert.Equal(t, 429, providerErr.StatusCode)
+		assert.Equal(t, "too many requests", providerErr.Message)
+		assert.True(t, providerErr.Temporary)
+	}
+}
+
+func TestMailSendGridBounces(t *testing.T) {
+	db, config := db(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	config.Mailer.Provider = conf.SendGridProvider
+	config.Mailer.SendGrid.WebhookVerificationKey = base64.StdEncoding.EncodeToString(der)
+	api := NewAPI(config, db, nil, mailer.NewMailer(config), nil)
+
+	body := `[
+		{"email": "gone@example.com", "event": "bounce", "type": "bounce", "reason": "550 no such user", "timestamp": 1600000000, "sg_message_id": "msg-1.filter0001"},
+		{"email": "full@example.com", "event": "bounce", "type": "blocked", "timestamp": 1600000000},
+		{"email": "angry@example.com", "event": "spamreport", "timestamp": 1600000000},
+		{"email": "happy@example.com", "event": "delivered", "timestamp": 1600000000}
+	]`
+	deliver := func(body string, signed time.Time) *httptest.ResponseRecorder {
+		timestamp := strconv.FormatInt(signed.Unix(), 10)
+		hash := sha256.Sum256([]byte(timestamp + body))
+		sig, _ := ecdsa.SignASN1(rand.Reader, key, hash[:])
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "https://not-real/mail/bounces", strings.NewReader(body))
+		r.Header.Set("X-Twilio-Email-Event-Webhook-Signature", base64.StdEncoding.EncodeToString(sig))
+		r.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+		api.MailBounceWebhook(testContext(nil, config, false), w, r)
+		return w
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	hash := sha256.Sum256([]byte(timestamp + body))
+	sig, _ := ecdsa.SignASN1(rand.Reader, key, hash[:])
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://not-real/mail/bounces", strings.NewReader(body))
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Signature", base64.StdEncoding.EncodeToString(sig))
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	api.MailBounceWebhook(testContext(nil, config, false), w, r)
+	assert.Equal(t, 200, w.Code)
+
+	bounces := []models.MailBounce{}
+	db.Order("id asc").Find(&bounces)
+	if assert.Len(t, bounces, 3) {
+		assert.Equal(t, "gone@example.com", bounces[0].Email)
+		assert.Equal(t, mailer.HardBounce, bounces[0].Type)
+		assert.Equal(t, "msg-1", bounces[0].MessageID)
+		assert.Equal(t, conf.SendGridProvider, bounces[0].Provider)
+		assert.Equal(t, mailer.SoftBounce, bounces[1].Type)
+		assert.Equal(t, mailer.Complaint, bounces[2].Type)
+	}
+
+	// a tampered body doesn't verify
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/mail/bounces", strings.NewReader(strings.Replace(body, "gone", "other", 1)))
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Signature", base64.StdEncoding.EncodeToString(sig))
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	api.MailBounceWebhook(testContext(nil, config, false), w, r)
+	validateError(t, 401, w)
+
+	// a replayed delivery is acknowledged but not handled again
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/mail/bounces", strings.NewReader(body))
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Signature", base64.StdEncoding.EncodeToString(sig))
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	api.MailBounceWebhook(testContext(nil, config, false), w, r)
+	assert.Equal(t, 200, w.Code)
+	count := 0
+	db.Model(&models.MailBounce{}).Count(&count)
+	assert.Equal(t, 3, count)
+
+	// a delivery signed too long ago is refused
+	validateError(t, 401, deliver(body, time.Now().Add(-mailer.WebhookTolerance-time.Minute)))
+}
+
+func mailgunSignature(key, timestamp, token string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestMailMailgunBounces(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.Provider = conf.MailgunProvider
+	config.Mailer.Mailgun.Domain = "mg.example.com"
+	config.Mailer.Mailgun.WebhookSigningKey = "signing-key"
+	api := NewAPI(config, db, nil, mailer.NewMailer(config), nil)
+
+	hook := `{
+		"signature": {"timestamp": "%s", "token": "%s", "signature": "%s"},
+		"event-data": {
+			"event": "failed", "severity": "permanent", "recipient": "gone@example.com", "timestamp": 1600000000.5,
+			"delivery-status": {"description": "No such mailbox"},
+			"message": {"headers": {"message-id": "msg-1@mg.example.com"}}
+		}
+	}`
+	deliver := func(key, token string, signed time.Time) *httptest.ResponseRecorder {
+		timestamp := strconv.FormatInt(signed.Unix(), 10)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "https://not-real/mail/bounces", strings.NewReader(fmt.Sprintf(hook, timestamp, token, mailgunSignature(key, timestamp, token))))
+		api.MailBounceWebhook(testContext(nil, config, false), w, r)
+		return w
+	}
+
+	assert.Equal(t, 200, deliver("signing-key", "abc", time.Now()).Code)
+
+	bounce := &models.MailBounce{}
+	if assert.NoError(t, db.First(bounce).Error) {
+		assert.Equal(t, "gone@example.com", bounce.Email)
+		assert.Equal(t, mailer.HardBounce, bounce.Type)
+		assert.Equal(t, "No such mailbox", bounce.Reason)
+		assert.Equal(t, "msg-1@mg.example.com", bounce.MessageID)
+	}
+
+	validateError(t, 401, deliver("wrong-key", "def", time.Now()))
+	validateError(t, 401, deliver("signing-key", "def", time.Now().Add(-mailer.WebhookTolerance-time.Minute)))
+	validateError(t, 401, deliver("signing-key", "def", time.Now().Add(mailer.WebhookTolerance+time.Minute)))
+
+	// the token was delivered before
+	assert.Equal(t, 200, deliver("signing-key", "abc", time.Now()).Code)
+	count := 0
+	db.Model(&models.MailBounce{}).Count(&count)
+	assert.Equal(t, 1, count)
+}
+
+func TestMailSESBounces(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.Provider = conf.SESProvider
+	config.Mailer.SES.Region = "eu-west-1"
+	config.Mailer.SES.WebhookToken = "sns-token"
+	api := NewAPI(config, db, nil, mailer.NewMailer(config), nil)
+
+	notification, _ := json.Marshal(map[string]interface{}{
+		"notificationType": "Bounce",
+		"mail":             map[string]string{"messageId": "ses-1"},
+		"bounce": map[string]interface{}{
+			"bounceType":        "Transient",
+			"bounceSubType":     "MailboxFull",
+			"timestamp":         "2020-09-13T12:26:40.000Z",
+			"bouncedRecipients": []map[string]string{{"emailAddress": "full@example.com"}},
+		},
+	})
+	body, _ := json.Marshal(map[string]string{"Type": "Notification", "MessageId": "sns-1", "Message": string(notification)})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://not-real/mail/bounces?token=sns-token", strings.NewReader(string(body)))
+	api.MailBounceWebhook(testContext(nil, config, false), w, r)
+	assert.Equal(t, 200, w.Code)
+
+	// SNS retries with the same message ID
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/mail/bounces?token=sns-token", strings.NewReader(string(body)))
+	api.MailBounceWebhook(testContext(nil, config, false), w, r)
+	assert.Equal(t, 200, w.Code)
+	count := 0
+	db.Model(&models.MailBounce{}).Count(&count)
+	assert.Equal(t, 1, count)
+
+	bounce := &models.MailBounce{}
+	if assert.NoError(t, db.First(bounce).Error) {
+		assert.Equal(t, "full@example.com", bounce.Email)
+		assert.Equal(t, mailer.SoftBounce, bounce.Type)
+		assert.Equal(t, "MailboxFull", bounce.Reason)
+		assert.Equal(t, "ses-1", bounce.MessageID)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/mail/bounces?token=guess", strings.NewReader(string(body)))
+	api.MailBounceWebhook(testContext(nil, config, false), w, r)
+	validateError(t, 401, w)
+
+	// subscriptions are only confirmed with AWS
+	confirmation := `{"Type": "SubscriptionConfirmation", "SubscribeURL": "http://evil.example.com/confirm"}`
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/mail/bounces?token=sns-token", strings.NewReader(confirmation))
+	api.MailBounceWebhook(testContext(nil, config, false), w, r)
+	validateError(t, 400, w)
+}
+
+func TestMailBouncesWithSMTP(t *testing.T) {
+	db, config := db(t)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://not-real/mail/bounces", strings.NewReader(`{}`))
+	NewAPI(config, db, nil, mailer.NewMailer(config), nil).MailBounceWebhook(testContext(nil, config, false), w, r)
+	validateError(t, 404, w)
+}
+
+func TestMailBounceList(t *testing.T) {
+	db, config := db(t)
+	for _, email := range []string{"gone@example.com", "full@example.com"} {
+		assert.NoError(t, db.Create(&models.MailBounce{Email: email, Type: mailer.HardBounce}).Error)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/mail/bounces?email=gone@example.com", nil)
+	NewAPI(config, db, nil, nil, nil).MailBounceList(testContext(testToken("magical-unicorn", ""), config, true), w, r)
+	bounces := []models.MailBounce{}
+	extractPayload(t, 200, w, &bounces)
+	if assert.Len(t, bounces, 1) {
+		assert.Equal(t, "gone@example.com", bounces[0].Email)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/mail/bounces", nil)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /mail/bounces", api.MailBounceList)(testContext(testToken("stranger", "stranger@example.com"), config, false), w, r)
+	validateError(t, 401, w)
+}
+
+func TestMailSuppressedByWebhook(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.Provider = conf.MailgunProvider
+	config.Mailer.Mailgun.Domain = "mg.example.com"
+	config.Mailer.Mailgun.WebhookSigningKey = "signing-key"
+	api := NewAPI(config, db, nil, mailer.NewMailer(config), nil)
+
+	hook := `{
+		"signature": {"timestamp": "%s", "token": "%s", "signature": "%s"},
+		"event-data": {"event": "%s", "severity": "%s", "recipient": "%s", "timestamp": 1600000000}
+	}`
+	for i, event := range [][]string{
+		{"failed", "temporary", "full@example.com"},
+		{"failed", "permanent", "Gone@example.com"},
+		{"unsubscribed", "", "tired@example.com"},
+	} {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		token := fmt.Sprintf("token-%d", i)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "https://not-real/mail/bounces", strings.NewReader(fmt.Sprintf(hook, timestamp, token, mailgunSignature("signing-key", timestamp, token), event[0], event[1], event[2])))
+		api.MailBounceWebhook(testContext(nil, config, false), w, r)
+		assert.Equal(t, 200, w.Code)
+	}
+
+	suppressions := []models.MailSuppression{}
+	db.Order("email asc").Find(&suppressions)
+	if assert.Len(t, suppressions, 2) {
+		assert.Equal(t, "gone@example.com", suppressions[0].Email)
+		assert.Equal(t, mailer.HardBounce, suppressions[0].Reason)
+		assert.Equal(t, "tired@example.com", suppressions[1].Email)
+		assert.Equal(t, mailer.Unsubscribe, suppressions[1].Reason)
+	}
+}
+
+func TestMailSuppressedNotSent(t *testing.T) {
+	db, config := db(t)
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+	m.Queue = db
+	m.Suppressions = db
+
+	_, err := models.Suppress(db, strings.ToUpper(firstOrder.Email), mailer.HardBounce)
+	assert.NoError(t, err)
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	assert.Empty(t, sender.messages)
+	mail := &models.Mail{}
+	if assert.NoError(t, db.First(mail).Error) {
+		assert.Equal(t, firstOrder.ID, mail.OrderID)
+		assert.True(t, mail.Failed)
+		assert.Equal(t, 0, mail.Tries)
+	}
+
+	found, err := models.Unsuppress(db, firstOrder.Email)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	assert.Len(t, sender.messages, 1)
+}
+
+func TestMailSuppressionAdmin(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://not-real/mail/suppressions", strings.NewReader(`{"email": "Joker <Joker@example.com>"}`))
+	api.MailSuppressionCreate(ctx, w, r)
+	suppression := &models.MailSuppression{}
+	extractPayload(t, 200, w, suppression)
+	assert.Equal(t, "joker@example.com", suppression.Email)
+	assert.Equal(t, "manual", suppression.Reason)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/mail/suppressions", strings.NewReader(`{"email": "not an address"}`))
+	api.MailSuppressionCreate(ctx, w, r)
+	validateError(t, 400, w)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/mail/suppressions?email=joker@example.com", nil)
+	api.MailSuppressionList(ctx, w, r)
+	suppressions := []models.MailSuppression{}
+	extractPayload(t, 200, w, &suppressions)
+	assert.Len(t, suppressions, 1)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", "https://not-real/mail/suppressions/joker@example.com", nil)
+	api.MailSuppressionDelete(kami.SetParam(ctx, "email", "joker@example.com"), w, r)
+	assert.Equal(t, 200, w.Code)
+	suppressed, _ := models.Suppressed(db, "joker@example.com")
+	assert.False(t, suppressed)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", "https://not-real/mail/suppressions/joker@example.com", nil)
+	api.MailSuppressionDelete(kami.SetParam(ctx, "email", "joker@example.com"), w, r)
+	validateError(t, 404, w)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/mail/suppressions", nil)
+	guarded(t, api, "GET /mail/suppressions", api.MailSuppressionList)(testContext(testToken("stranger", "stranger@example.com"), config, false), w, r)
+	validateError(t, 401, w)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestMailDigest(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.AdminEmail = "admin@example.com"
+	config.Mailer.Digest.Enabled = true
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	tomorrow := time.Now().UTC().Add(24 * time.Hour)
+	assert.True(t, m.SendDigest(db, testLogger, tomorrow))
+	if assert.Len(t, sender.messages, 1) {
+		digest := sender.messages[0]
+		assert.Equal(t, mailer.OrderDigest, digest.Type)
+		assert.Equal(t, "admin@example.com", digest.To)
+		assert.Contains(t, digest.Subject, "2 orders on")
+		assert.Contains(t, digest.HTML, "$1.00")
+	}
+
+	// once a day
+	assert.False(t, m.SendDigest(db, testLogger, tomorrow.Add(time.Hour)))
+	assert.Len(t, sender.messages, 1)
+}
+
+func TestMailDigestSentAfterFailure(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.AdminEmail = "admin@example.com"
+	config.Mailer.Digest.Enabled = true
+	sender := &failingSender{errors: []error{errors.New("connection refused")}}
+	m := testMailerWith(config, sender)
+
+	tomorrow := time.Now().UTC().Add(24 * time.Hour)
+	assert.False(t, m.SendDigest(db, testLogger, tomorrow))
+	assert.Empty(t, sender.messages)
+
+	// the day wasn't taken by the failed attempt
+	assert.True(t, m.SendDigest(db, testLogger, tomorrow.Add(time.Hour)))
+	assert.Len(t, sender.messages, 1)
+}
+
+func TestMailDigestHour(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.AdminEmail = "admin@example.com"
+	config.Mailer.Digest.Enabled = true
+	config.Mailer.Digest.Hour = 7
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	assert.False(t, m.SendDigest(db, testLogger, today.Add(6*time.Hour)))
+	assert.Empty(t, sender.messages)
+	assert.True(t, m.SendDigest(db, testLogger, today.Add(7*time.Hour)))
+	assert.Len(t, sender.messages, 1)
+}
+
+func TestMailDigestSkipsOrderReceived(t *testing.T) {
+	_, config := db(t)
+	config.Mailer.AdminEmail = "admin@example.com"
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	config.Mailer.Digest.SkipOrderReceived = true
+	assert.NoError(t, m.OrderReceivedMail(firstTransaction))
+	assert.Len(t, sender.messages, 1, "the digest isn't enabled")
+
+	config.Mailer.Digest.Enabled = true
+	assert.NoError(t, m.OrderReceivedMail(firstTransaction))
+	assert.Len(t, sender.messages, 1)
+}
+
+func TestMailDigestPerInstance(t *testing.T) {
+	db, config := db(t)
+	config.MultiInstance.Enabled = true
+	assert.NoError(t, db.Create(&models.Instance{ID: "instance-a", Hostname: "a.example.com", Config: map[string]interface{}{
+		"mailer": map[string]interface{}{"admin_email": "a@example.com", "digest": map[string]interface{}{"enabled": true}},
+	}}).Error)
+	api := NewAPI(config, db, nil, testMailerWith(config, &testSender{}), nil)
+
+	stores, err := api.MailStores(db)()
+	if !assert.NoError(t, err) || !assert.Len(t, stores, 1) {
+		return
+	}
+	sender := &testSender{}
+	stores[0].Mailer.Sender = sender
+	assert.Equal(t, "instance-a", stores[0].Mailer.InstanceID)
+
+	tomorrow := time.Now().UTC().Add(24 * time.Hour)
+	assert.True(t, stores[0].Mailer.SendDigest(stores[0].DB, testLogger, tomorrow))
+	if assert.Len(t, sender.messages, 1) {
+		assert.Equal(t, "a@example.com", sender.messages[0].To)
+		assert.Contains(t, sender.messages[0].Subject, "0 orders on", "the orders of the deployment aren't the instance's")
+	}
+}
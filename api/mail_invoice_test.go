@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/mailer"
+)
+
+var testAttachment = &mailer.Attachment{Filename: "invoice-1.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4 test")}
+
+func TestMailInvoiceAttachment(t *testing.T) {
+	_, config := db(t)
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	if assert.Len(t, sender.messages, 1) {
+		assert.Empty(t, sender.messages[0].Attachments)
+	}
+
+	config.Mailer.Invoice.Attach = true
+	config.Mailer.Invoice.Issuer = "Wayne Enterprises\n1007 Mountain Drive"
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	if assert.Len(t, sender.messages, 2) && assert.Len(t, sender.messages[1].Attachments, 1) {
+		invoice := sender.messages[1].Attachments[0]
+		assert.Equal(t, "invoice-"+firstOrder.ID+".pdf", invoice.Filename)
+		assert.Equal(t, "application/pdf", invoice.ContentType)
+		assert.True(t, bytes.HasPrefix(invoice.Data, []byte("%PDF-1.4\n")))
+		assert.True(t, bytes.HasSuffix(invoice.Data, []byte("%%EOF\n")))
+		assert.Contains(t, string(invoice.Data), "(Wayne Enterprises)")
+		assert.Contains(t, string(invoice.Data), "(batwing)")
+		assert.Contains(t, string(invoice.Data), "(123 cave way)")
+	}
+}
+
+func TestMailInvoicePreview(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.Invoice.Attach = true
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "template", mailer.OrderConfirmation)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/emails/preview/order_confirmation", nil)
+	NewAPI(config, db, nil, nil, nil).EmailPreviewView(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+
+	preview := &EmailPreview{}
+	extractPayload(t, 200, w, preview)
+	assert.Equal(t, []string{"invoice-SAMPLE-1.pdf"}, preview.Attachments)
+}
+
+func TestMailSendGridAttachments(t *testing.T) {
+	_, config := db(t)
+
+	sent := make(chan map[string]interface{}, 1)
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		sent <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer provider.Close()
+
+	config.Mailer.Provider = conf.SendGridProvider
+	config.Mailer.SendGrid.APIKey = "SG.key"
+	config.Mailer.SendGrid.APIURL = provider.URL
+
+	_, err := mailer.NewSender(config, http.DefaultClient).Send(&mailer.Message{
+		To:          "buyer@example.com",
+		Bcc:         []string{"Finance <finance@example.com>"},
+		Attachments: []*mailer.Attachment{testAttachment},
+	})
+	assert.NoError(t, err)
+
+	body := <-sent
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"to":  []interface{}{map[string]interface{}{"email": "buyer@example.com"}},
+		"bcc": []interface{}{map[string]interface{}{"email": "finance@example.com", "name": "Finance"}},
+	}}, body["personalizations"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"content":     base64.StdEncoding.EncodeToString(testAttachment.Data),
+		"type":        "application/pdf",
+		"filename":    "invoice-1.pdf",
+		"disposition": "attachment",
+	}}, body["attachments"])
+}
+
+func TestMailMailgunAttachments(t *testing.T) {
+	_, config := db(t)
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseMultipartForm(1<<20))
+		assert.Equal(t, "buyer@example.com", r.FormValue("to"))
+		file, header, err := r.FormFile("attachment")
+		if assert.NoError(t, err) {
+			data, _ := ioutil.ReadAll(file)
+			assert.Equal(t, "invoice-1.pdf", header.Filename)
+			assert.Equal(t, testAttachment.Data, data)
+		}
+		w.Write([]byte(`{"id": "<msg-1@example.com>", "message": "Queued"}`))
+	}))
+	defer provider.Close()
+
+	config.Mailer.Provider = conf.MailgunProvider
+	config.Mailer.Mailgun.APIKey = "key"
+	config.Mailer.Mailgun.Domain = "example.com"
+	config.Mailer.Mailgun.APIURL = provider.URL
+
+	id, err := mailer.NewSender(config, http.DefaultClient).Send(&mailer.Message{To: "buyer@example.com", Attachments: []*mailer.Attachment{testAttachment}})
+	assert.NoError(t, err)
+	assert.Equal(t, "msg-1@example.com", id)
+}
+
+func TestMailSESAttachments(t *testing.T) {
+	_, config := db(t)
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "SendRawEmail", r.FormValue("Action"))
+		assert.Equal(t, "buyer@example.com", r.FormValue("Destinations.member.1"))
+		raw, err := base64.StdEncoding.DecodeString(r.FormValue("RawMessage.Data"))
+		assert.NoError(t, err)
+		assert.Contains(t, string(raw), "Content-Disposition: attachment; filename=invoice-1.pdf")
+		assert.Contains(t, string(raw), base64.StdEncoding.EncodeToString(testAttachment.Data))
+		fmt.Fprint(w, `<SendRawEmailResponse><SendRawEmailResult><MessageId>msg-1</MessageId></SendRawEmailResult></SendRawEmailResponse>`)
+	}))
+	defer provider.Close()
+
+	config.Mailer.Provider = conf.SESProvider
+	config.Mailer.SES.Region = "us-east-1"
+	config.Mailer.SES.Endpoint = provider.URL
+
+	id, err := mailer.NewSender(config, http.DefaultClient).Send(&mailer.Message{To: "buyer@example.com", Subject: "Invoice", Attachments: []*mailer.Attachment{testAttachment}})
+	assert.NoError(t, err)
+	assert.Equal(t, "msg-1", id)
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+// failingSender fails with its errors, one per mail, before it sends mails
+type failingSender struct {
+	testSender
+	errors []error
+}
+
+func (s *failingSender) Send(msg *mailer.Message) (string, error) {
+	if len(s.errors) > 0 {
+		err := s.errors[0]
+		s.errors = s.errors[1:]
+		return "", err
+	}
+	return s.testSender.Send(msg)
+}
+
+func TestMailQueueRetries(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.MaxRetries = 3
+	config.Mailer.RetryPeriod = time.Minute
+	config.Mailer.MaxRetryPeriod = time.Hour
+	sender := &failingSender{errors: []error{
+		&mailer.ProviderError{Provider: "sendgrid", StatusCode: 503, Temporary: true},
+		&textproto.Error{Code: 421, Msg: "Service not available"},
+	}}
+	m := testMailerWith(config, sender)
+	m.Queue = db
+
+	// a temporary failure isn't an error, the mail is retried
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	mail := &models.Mail{}
+	if !assert.NoError(t, db.First(mail).Error) {
+		return
+	}
+	assert.Equal(t, mailer.OrderConfirmation, mail.Type)
+	assert.Equal(t, firstOrder.ID, mail.OrderID)
+	assert.Equal(t, 1, mail.Tries)
+	assert.False(t, mail.Done)
+	assert.Nil(t, mail.LockedBy)
+	if assert.NotNil(t, mail.RunAfter) {
+		assert.True(t, mail.RunAfter.After(time.Now()))
+	}
+
+	// not due yet
+	assert.Equal(t, 0, m.SendQueuedMails(testLogger, "test", time.Now()))
+
+	assert.Equal(t, 0, m.SendQueuedMails(testLogger, "test", time.Now().Add(2*time.Minute)))
+	db.First(mail, mail.ID)
+	assert.Equal(t, 2, mail.Tries)
+	assert.Contains(t, *mail.ErrorMessage, "Service not available")
+
+	assert.Equal(t, 1, m.SendQueuedMails(testLogger, "test", time.Now().Add(10*time.Minute)))
+	db.First(mail, mail.ID)
+	assert.True(t, mail.Done)
+	assert.False(t, mail.Failed)
+	assert.Equal(t, "test-message", mail.MessageID)
+	assert.NotNil(t, mail.SentAt)
+	if assert.Len(t, sender.messages, 1) {
+		assert.Equal(t, firstOrder.Email, sender.messages[0].To)
+		assert.Contains(t, sender.messages[0].HTML, "batwing")
+	}
+
+	assert.Equal(t, 0, m.SendQueuedMails(testLogger, "test", time.Now().Add(time.Hour)))
+}
+
+func TestMailQueueGivesUp(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.MaxRetries = 2
+	temporary := &mailer.ProviderError{Provider: "mailgun", StatusCode: 429, Temporary: true}
+	sender := &failingSender{errors: []error{temporary, temporary, &mailer.ProviderError{Provider: "mailgun", StatusCode: 400}}}
+	m := testMailerWith(config, sender)
+	m.Queue = db
+
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	assert.Equal(t, 0, m.SendQueuedMails(testLogger, "test", time.Now().Add(time.Hour)))
+	mail := &models.Mail{}
+	db.First(mail)
+	assert.True(t, mail.Done)
+	assert.True(t, mail.Failed)
+	assert.Equal(t, 2, mail.Tries)
+
+	// permanent failures aren't retried
+	assert.Error(t, m.OrderReceivedMail(firstTransaction))
+	failed := &models.Mail{}
+	db.Where("type = ?", mailer.OrderReceived).First(failed)
+	assert.True(t, failed.Failed)
+	assert.Equal(t, 1, failed.Tries)
+	assert.Empty(t, sender.messages)
+}
+
+func TestMailTemporaryErrors(t *testing.T) {
+	assert.True(t, mailer.Temporary(&mailer.ProviderError{Temporary: true}))
+	assert.False(t, mailer.Temporary(&mailer.ProviderError{StatusCode: 400}))
+	assert.True(t, mailer.Temporary(&textproto.Error{Code: 450}))
+	assert.False(t, mailer.Temporary(&textproto.Error{Code: 550}))
+	assert.True(t, mailer.Temporary(errors.New("connection reset")))
+}
+
+func TestMailBcc(t *testing.T) {
+	db, config := db(t)
+	config.Mailer.Bcc.OrderReceived = []string{"Finance <finance@example.com>", "ops@example.com"}
+	sender := &failingSender{errors: []error{&mailer.ProviderError{Provider: "ses", StatusCode: 500, Temporary: true}}}
+	m := testMailerWith(config, sender)
+	m.Queue = db
+
+	assert.NoError(t, m.OrderReceivedMail(firstTransaction))
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	if assert.Len(t, sender.messages, 1) {
+		assert.Equal(t, mailer.OrderConfirmation, sender.messages[0].Type)
+		assert.Empty(t, sender.messages[0].Bcc)
+	}
+
+	// the copies survive a retry
+	assert.Equal(t, 1, m.SendQueuedMails(testLogger, "test", time.Now().Add(time.Hour)))
+	if assert.Len(t, sender.messages, 2) {
+		assert.Equal(t, mailer.OrderReceived, sender.messages[1].Type)
+		assert.Equal(t, []string{`"Finance" <finance@example.com>`, "<ops@example.com>"}, sender.messages[1].Bcc)
+	}
+}
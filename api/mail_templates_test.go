@@ -0,0 +1,236 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/mailer"
+)
+
+// testSender keeps the mails instead of sending them
+type testSender struct {
+	mutex    sync.Mutex
+	messages []*mailer.Message
+}
+
+func (s *testSender) Send(msg *mailer.Message) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messages = append(s.messages, msg)
+	return "test-message", nil
+}
+
+// testMailerWith is a mailer that hands its mails to sender
+func testMailerWith(config *conf.Configuration, sender mailer.Sender) *mailer.Mailer {
+	m := mailer.NewMailer(config)
+	m.Sender = sender
+	return m
+}
+
+func TestMailDefaultTemplate(t *testing.T) {
+	_, config := db(t)
+	config.SiteURL = "https://shop.example.com"
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	if assert.Len(t, sender.messages, 1) {
+		html := sender.messages[0].HTML
+		assert.Equal(t, "Order Confirmation", sender.messages[0].Subject)
+		assert.Contains(t, html, "batwing")
+		assert.Contains(t, html, "2 x $0.12")
+		assert.Contains(t, html, "$0.24")
+		assert.Contains(t, html, "123 cave way")
+		assert.Contains(t, html, "https://shop.example.com")
+	}
+}
+
+func TestMailTemplateDirectory(t *testing.T) {
+	_, config := db(t)
+	dir, err := ioutil.TempDir("", "gocommerce-mail")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "partials"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "order_confirmation.html"), []byte(
+		`<h1>Thanks {{ .Order.Email }}</h1>{{ template "line_items" .Order }}{{ template "totals" .Order }}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "partials", "line_items.html"), []byte(
+		`{{ range .LineItems }}<li>{{ upper .Title }}</li>{{ end }}`), 0644))
+
+	config.Mailer.Templates.Dir = dir
+	// the directory wins over the site
+	config.Mailer.Templates.OrderConfirmation = "http://localhost:1/confirmation.html"
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	if assert.Len(t, sender.messages, 1) {
+		html := sender.messages[0].HTML
+		assert.Contains(t, html, "<h1>Thanks "+firstOrder.Email+"</h1>")
+		assert.Contains(t, html, "<li>BATWING</li>")
+		// the default totals partial is still there
+		assert.Contains(t, html, "Subtotal")
+	}
+
+	// mails without their own file use the defaults
+	assert.NoError(t, m.OrderReceivedMail(firstTransaction))
+	if assert.Len(t, sender.messages, 2) {
+		assert.Contains(t, sender.messages[1].HTML, "Order Received From")
+		assert.Contains(t, sender.messages[1].HTML, "<li>BATWING</li>")
+	}
+}
+
+func TestMailBrokenTemplates(t *testing.T) {
+	_, config := db(t)
+	dir, err := ioutil.TempDir("", "gocommerce-mail")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "partials"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "order_confirmation.html"), []byte(
+		`<h1>Thanks {{ .Order.Email </h1>`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "order_confirmation.txt"), []byte(
+		`Thanks {{ range }}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "partials", "totals.html"), []byte(
+		`{{ if .Total }}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "partials", "line_items.html"), []byte(
+		`{{ range .LineItems }}<li>{{ upper .Title }}</li>{{ end }}`), 0644))
+
+	config.Mailer.Templates.Dir = dir
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	// the broken mail gets the built-in template
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	if assert.Len(t, sender.messages, 1) {
+		assert.Contains(t, sender.messages[0].HTML, "Thank you for your order!")
+		assert.Contains(t, sender.messages[0].Text, "Thank you for your order!")
+	}
+
+	// the other mails keep the partials that parse, and the broken one is the default
+	assert.NoError(t, m.OrderReceivedMail(firstTransaction))
+	if assert.Len(t, sender.messages, 2) {
+		assert.Contains(t, sender.messages[1].HTML, "<li>BATWING</li>")
+		assert.Contains(t, sender.messages[1].HTML, "Subtotal")
+	}
+}
+
+func TestMailTemplateFromSite(t *testing.T) {
+	_, config := db(t)
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/gocommerce/emails/confirmation.html", r.URL.Path)
+		w.Write([]byte(`{{ define "line_items" }}{{ range .LineItems }}[{{ .Title }}: {{ price (lineTotal .) $.Currency }}]{{ end }}{{ end }}` +
+			`<p>{{ template "line_items" .Order }}</p>`))
+	}))
+	defer site.Close()
+
+	config.SiteURL = site.URL
+	config.Mailer.Templates.OrderConfirmation = "/gocommerce/emails/confirmation.html"
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	if assert.Len(t, sender.messages, 1) {
+		assert.Equal(t, "<p>[batwing: $0.24]</p>", sender.messages[0].HTML)
+	}
+}
+
+func TestMailTemplateFromSiteCache(t *testing.T) {
+	_, config := db(t)
+	var mutex sync.Mutex
+	requests, template, etag := 0, "<p>first</p>", `"v1"`
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(template))
+	}))
+	defer site.Close()
+
+	config.SiteURL = site.URL
+	config.Mailer.Templates.OrderConfirmation = "/gocommerce/emails/confirmation.html"
+	config.Mailer.Templates.TTL = time.Hour
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	// cached for the ttl
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	assert.Equal(t, 1, requests)
+
+	config.Mailer.Templates.TTL = time.Millisecond
+	m = testMailerWith(config, sender)
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	time.Sleep(5 * time.Millisecond)
+	// unchanged, so it's not downloaded again
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	assert.Equal(t, 3, requests)
+
+	mutex.Lock()
+	template, etag = "<p>second</p>", `"v2"`
+	mutex.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	if assert.Len(t, sender.messages, 5) {
+		assert.Equal(t, "<p>first</p>", sender.messages[3].HTML)
+		assert.Equal(t, "<p>second</p>", sender.messages[4].HTML)
+	}
+}
+
+func TestMailPrices(t *testing.T) {
+	_, config := db(t)
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	tmpl := mailer.Template{Subject: "Prices", Default: `{{ price 123456 "usd" }}|{{ price 999 "EUR" }}|{{ price 1500 "JPY" }}|{{ price 250 "SEK" }}`}
+	assert.NoError(t, m.Mail("buyer@example.com", tmpl, nil))
+	if assert.Len(t, sender.messages, 1) {
+		assert.Equal(t, "$1234.56|9.99€|¥1500|2.50 SEK", sender.messages[0].HTML)
+	}
+}
+
+func TestMailTextAlternative(t *testing.T) {
+	_, config := db(t)
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+
+	tmpl := mailer.Template{Subject: "Hi", Default: `<style>p { color: red; }</style><h2>Thanks &amp; welcome</h2>` +
+		`<p>Your order:</p><ul><li>batwing</li><li>utility belt</li></ul><p>Track it <a href="https://example.com/track">here</a>.<br>Bye</p>`}
+	assert.NoError(t, m.Mail("buyer@example.com", tmpl, nil))
+	if assert.Len(t, sender.messages, 1) {
+		assert.Equal(t, "Thanks & welcome\n\nYour order:\n\n- batwing\n- utility belt\n\nTrack it here (https://example.com/track).\nBye\n", sender.messages[0].Text)
+	}
+
+	dir, err := ioutil.TempDir("", "gocommerce-mail")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "order_confirmation.txt"), []byte(
+		`Thanks {{ .Order.Email }}{{ range .Order.LineItems }}
+* {{ .Title }} {{ price (lineTotal .) $.Order.Currency }}{{ end }}`), 0644))
+	config.Mailer.Templates.Dir = dir
+	m = testMailerWith(config, sender)
+
+	assert.NoError(t, m.OrderConfirmationMail(firstTransaction))
+	if assert.Len(t, sender.messages, 2) {
+		assert.Equal(t, "Thanks "+firstOrder.Email+"\n* batwing $0.24", sender.messages[1].Text)
+		assert.Contains(t, sender.messages[1].HTML, "Thank you for your order!")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 
 	"github.com/PuerkitoBio/goquery"
@@ -12,12 +13,17 @@ import (
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/guregu/kami"
 	"github.com/jinzhu/gorm"
-	"github.com/mattes/vat"
-	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/events"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
 	"github.com/pborman/uuid"
 )
 
+// maxOrderRefTries is how many order numbers are tried for a reference that
+// isn't taken
+const maxOrderRefTries = 10
+
 type OrderLineItem struct {
 	Sku      string                 `json:"sku"`
 	Path     string                 `json:"path"`
@@ -53,7 +59,14 @@ type OrderParams struct {
 
 	FulfillmentState string `json:"fulfillment_state"`
 
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"tracking_number"`
+	TrackingURL    string `json:"tracking_url"`
+
 	CouponCode string `json:"coupon"`
+
+	Experiment string `json:"experiment"`
+	Variant    string `json:"variant"`
 }
 
 type ReceiptParams struct {
@@ -76,12 +89,6 @@ func (a *API) ClaimOrders(ctx context.Context, w http.ResponseWriter, r *http.Re
 	log := getLogger(ctx)
 
 	claims := getClaims(ctx)
-	if claims == nil {
-		unauthorizedError(w, "Claiming an order requires a token")
-		log.Info("request made with no claims")
-		return
-	}
-
 	if claims.Email == "" {
 		badRequestError(w, "Must provide an email in the token to claim orders")
 		log.Info("Claim request made with missing email")
@@ -99,21 +106,7 @@ func (a *API) ClaimOrders(ctx context.Context, w http.ResponseWriter, r *http.Re
 		"user_email": claims.Email,
 	})
 
-	// now find all the order associated with that email
-	query := orderQuery(a.db)
-	query = query.Where(&models.Order{
-		UserID: "",
-		Email:  claims.Email,
-	})
-
-	orders := []models.Order{}
-	if res := query.Find(&orders); res.Error != nil {
-		internalServerError(w, "Failed to query for orders with email: %s", claims.Email)
-		log.WithError(res.Error).Warn("Failed to make query for orders")
-		return
-	}
-
-	tx := a.db.Begin()
+	tx := a.dbFor(ctx).Begin()
 
 	// create the user
 	user := models.User{Email: claims.Email, ID: claims.ID}
@@ -124,14 +117,15 @@ func (a *API) ClaimOrders(ctx context.Context, w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	for _, o := range orders {
-		o.UserID = user.ID
-		if res := tx.Save(&o); res.Error != nil {
-			internalServerError(w, "Failed to update an order with user ID %s", user.ID)
-			log.WithError(res.Error).WithField("order_id", o.ID).Warn("Failed to save order")
-			tx.Rollback()
-			return
-		}
+	// all the orders associated with that email are claimed at once
+	res := tx.Model(&models.Order{}).
+		Where("email = ?", claims.Email).
+		Update("user_id", user.ID)
+	if res.Error != nil {
+		internalServerError(w, "Failed to update the orders with user ID %s", user.ID)
+		log.WithError(res.Error).Warn("Failed to claim orders")
+		tx.Rollback()
+		return
 	}
 
 	if rsp := tx.Commit(); rsp.Error != nil {
@@ -147,19 +141,18 @@ func (a *API) ClaimOrders(ctx context.Context, w http.ResponseWriter, r *http.Re
 func (a *API) ResendOrderReceipt(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	id := kami.Param(ctx, "order_id")
 	log := getLogger(ctx)
-	claims := getClaims(ctx)
 
 	params := &ReceiptParams{}
 	jsonDecoder := json.NewDecoder(r.Body)
 	err := jsonDecoder.Decode(params)
 	if err != nil {
 		log.WithError(err).Infof("Failed to deserialize receipt params: %s", err.Error())
-		badRequestError(w, "Could not read receipt params: %v", err)
+		readError(w, "receipt params", err)
 		return
 	}
 
 	order := &models.Order{}
-	if result := orderQuery(a.db).Preload("Transactions").First(order, "id = ?", id); result.Error != nil {
+	if result := orderQuery(a.dbFor(ctx)).Preload("Transactions").First(order, "id = ?", id); result.Error != nil {
 		if result.RecordNotFound() {
 			log.Debug("Requested record that doesn't exist")
 			notFoundError(w, "Order not found")
@@ -170,14 +163,6 @@ func (a *API) ResendOrderReceipt(ctx context.Context, w http.ResponseWriter, r *
 		return
 	}
 
-	if order.UserID != "" {
-		if claims == nil || (order.UserID != claims.ID && !isAdmin(ctx)) {
-			unauthorizedError(w, "Order History Requires Authentication")
-			log.Info("request made with no claims")
-			return
-		}
-	}
-
 	if params.Email != "" {
 		order.Email = params.Email
 	}
@@ -185,7 +170,7 @@ func (a *API) ResendOrderReceipt(ctx context.Context, w http.ResponseWriter, r *
 	for _, transaction := range order.Transactions {
 		if transaction.Type == models.ChargeTransactionType {
 			transaction.Order = order
-			a.mailer.OrderConfirmationMail(transaction)
+			a.mailerFor(ctx).OrderConfirmationMail(transaction)
 		}
 	}
 
@@ -197,23 +182,19 @@ func (a *API) ResendOrderReceipt(ctx context.Context, w http.ResponseWriter, r *
 //  - orders before       &to=iso8601        - default = now
 //  - sort asc or desc    &sort=[asc | desc] - default = desc
 // And you can filter on
-//  - fullfilment_state=pending   - only orders pending shipping
-//  - payment_state=pending       - only payd orders
-//  - type=book  - filter on product type
+//  - state=pending               - only pending orders
+//  - fulfillment_state=pending   - only orders pending shipping
+//  - payment_state=paid          - only paid orders
+//  - email=jane@example.com      - only orders placed with that email
 
 func (a *API) OrderList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	log := getLogger(ctx)
 
 	var err error
 	claims := getClaims(ctx)
-	if claims == nil {
-		unauthorizedError(w, "Order History Requires Authentication")
-		log.Info("request made with no claims")
-		return
-	}
 
 	params := r.URL.Query()
-	query := orderQuery(a.db)
+	query := orderQuery(a.dbFor(ctx))
 	query, err = parseOrderParams(query, params)
 	if err != nil {
 		log.WithError(err).Info("Bad query parameters in request")
@@ -221,18 +202,12 @@ func (a *API) OrderList(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// handle the admin info
+	// the route policy only lets the user, or staff, pick the user_id
 	id := claims.ID
 	userID := kami.Param(ctx, "user_id")
 	if userID != "" {
-		if isAdmin(ctx) {
-			id = userID
-			log.WithField("admin_id", claims.ID).Debugf("Making admin request for user %s by %s", id, claims.ID)
-		} else {
-			log.Warnf("Request for user id %s as user %s - but not an admin", userID, id)
-			badRequestError(w, "Can't request user id if you're not that user, or an admin")
-			return
-		}
+		id = userID
+		log.WithField("requester_id", claims.ID).Debugf("Making request for user %s by %s", id, claims.ID)
 	}
 	if id != "all" {
 		query = query.Where("user_id = ?", id)
@@ -254,23 +229,18 @@ func (a *API) OrderList(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	}
 
 	log.WithField("order_count", len(orders)).Debugf("Successfully retrieved %d orders", len(orders))
-	sendJSON(w, 200, orders)
+	sendJSONWithETag(w, r, 200, orders)
 }
 
-// OrderView will request a specific order using the 'id' parameter.
+// OrderView will request a specific order using the 'id' parameter, which can
+// also be the order's public reference.
 // Only the owner of the order, an admin, or an anon order are allowed to be seen
 func (a *API) OrderView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	id := kami.Param(ctx, "id")
 	log := getLogger(ctx).WithField("order_id", id)
-	claims := getClaims(ctx)
-	if claims == nil {
-		log.Info("Request with no claims made")
-		unauthorizedError(w, "Order History Requires Authentication")
-		return
-	}
 
 	order := &models.Order{}
-	if result := orderQuery(a.db).First(order, "id = ?", id); result.Error != nil {
+	if result := orderQuery(a.dbFor(ctx)).First(order, "id = ? OR ref = ?", id, id); result.Error != nil {
 		if result.RecordNotFound() {
 			log.Debug("Requested record that doesn't exist")
 			notFoundError(w, "Order not found")
@@ -281,16 +251,8 @@ func (a *API) OrderView(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if order.UserID == "" || (order.UserID == claims.ID) || isAdmin(ctx) {
-		log.Debugf("Successfully got order %s", order.ID)
-		sendJSON(w, 200, order)
-	} else {
-		log.WithFields(logrus.Fields{
-			"user_id":       claims.ID,
-			"order_user_id": order.UserID,
-		}).Warnf("Unauthorized access attempted for order %s by %s", order.ID, claims.ID)
-		unauthorizedError(w, "You don't have access to this order")
-	}
+	log.Debugf("Successfully got order %s", order.ID)
+	sendJSONWithETag(w, r, 200, order)
 }
 
 // OrderCreate endpoint
@@ -302,7 +264,16 @@ func (a *API) OrderCreate(ctx context.Context, w http.ResponseWriter, r *http.Re
 	err := jsonDecoder.Decode(params)
 	if err != nil {
 		log.WithError(err).Infof("Failed to deserialize order params: %s", err.Error())
-		badRequestError(w, "Could not read Order params: %v", err)
+		readError(w, "order params", err)
+		return
+	}
+	if problems := validateOrderParams(getConfig(ctx), params); len(problems) > 0 {
+		log.WithField("problems", len(problems)).Info("Refused an invalid order")
+		sendJSON(w, http.StatusUnprocessableEntity, &HTTPError{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "The order is invalid",
+			Errors:  problems,
+		})
 		return
 	}
 
@@ -333,12 +304,20 @@ func (a *API) OrderCreate(ctx context.Context, w http.ResponseWriter, r *http.Re
 		"email":    params.Email,
 		"currency": params.Currency,
 	}).Debug("Created order, starting to process request")
-	tx := a.db.Begin()
+	tx := a.dbFor(ctx).Begin()
 	//c.tx = tx
 
 	order.Email = params.Email
 	order.IP = r.RemoteAddr
+	order.IPCountry = a.ipCountry(getConfig(ctx), r)
 	order.MetaData = params.MetaData
+	if params.Variant != "" && params.Experiment == "" {
+		cleanup(tx, w, badRequestError(w, "A variant requires an experiment"))
+		return
+	}
+	order.Experiment = params.Experiment
+	order.Variant = params.Variant
+	order.TestMode = getConfig(ctx).TestMode()
 	httpError := setOrderEmail(tx, order, claims, log)
 	if httpError != nil {
 		log.WithError(httpError).Info("Failed to set the order email from the token")
@@ -348,6 +327,13 @@ func (a *API) OrderCreate(ctx context.Context, w http.ResponseWriter, r *http.Re
 
 	log.WithField("order_user_id", order.UserID).Debug("Successfully set the order's ID")
 
+	if order.Coupon != nil {
+		if httpError := checkCouponUses(tx, order.Coupon, order.UserID, order.Email); httpError != nil {
+			cleanup(tx, w, httpError)
+			return
+		}
+	}
+
 	shipping, httpError := a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID)
 	if httpError != nil {
 		cleanup(tx, w, httpError)
@@ -374,13 +360,9 @@ func (a *API) OrderCreate(ctx context.Context, w http.ResponseWriter, r *http.Re
 	}
 
 	if params.VATNumber != "" {
-		valid, err := vat.IsValidVAT(params.VATNumber)
-		if err != nil {
-			cleanup(tx, w, internalServerError(w, "Error verifying VAT number %v", err))
-			return
-		}
-		if !valid {
-			cleanup(tx, w, badRequestError(w, "Vat number %v is not valid", order.VATNumber))
+		order.VATState = a.vatState(ctx, params.VATNumber)
+		if order.VATState == models.VATInvalidState {
+			cleanup(tx, w, badRequestError(w, "Vat number %v is not valid", params.VATNumber))
 			return
 		}
 		order.VATNumber = params.VATNumber
@@ -394,18 +376,57 @@ func (a *API) OrderCreate(ctx context.Context, w http.ResponseWriter, r *http.Re
 
 	log.WithField("subtotal", order.SubTotal).Debug("Successfully processed all the line items")
 
-	tx.Create(order)
+	if httpError := a.assignOrderRef(tx, order); httpError != nil {
+		log.WithError(httpError).Error("Failed to assign the order reference")
+		cleanup(tx, w, httpError)
+		return
+	}
+
+	if rsp := tx.Create(order); rsp.Error != nil {
+		tx.Rollback()
+		log.WithError(rsp.Error).Error("Failed to save the order")
+		internalServerError(w, "Error saving order: %v", rsp.Error)
+		return
+	}
 	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventCreated, nil)
-	if a.config.Webhooks.Order != "" {
-		hook := models.NewHook("order", a.config.Webhooks.Order, order.UserID, order)
-		tx.Save(hook)
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.OrderEvent, UserID: order.UserID, Payload: order})
+	a.publishStock(ctx, batch, order)
+	if rsp := batch.Commit(); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to commit the order")
+		internalServerError(w, "Error saving order: %v", rsp.Error)
+		return
 	}
-	tx.Commit()
 
 	log.Infof("Successfully created order %s", order.ID)
 	sendJSON(w, 201, order)
 }
 
+// assignOrderRef gives the order its public reference, from the next order
+// number. Another salt or alphabet can make the reference of a number one an
+// older order has already, those numbers are skipped.
+func (a *API) assignOrderRef(tx *gorm.DB, order *models.Order) *HTTPError {
+	for i := 0; i < maxOrderRefTries; i++ {
+		number, err := models.NextOrderNumber(tx)
+		if err != nil {
+			return httpError(500, "Error creating order number: %v", err)
+		}
+		ref, err := a.refs.Encode(number)
+		if err != nil {
+			return httpError(500, "Error creating order reference: %v", err)
+		}
+		taken, err := models.OrderRefTaken(tx, ref)
+		if err != nil {
+			return httpError(500, "Error creating order reference: %v", err)
+		}
+		if !taken {
+			order.Ref = ref
+			return nil
+		}
+	}
+	return httpError(500, "Error creating order reference: the references of %d order numbers were taken", maxOrderRefTries)
+}
+
 // OrderUpdate will allow an ADMIN only to update the details of a record
 // it is also important to note that it will not let modification of an order if the
 // order is no longer pending.
@@ -418,24 +439,18 @@ func (a *API) OrderUpdate(ctx context.Context, w http.ResponseWriter, r *http.Re
 	claims := getClaims(ctx)
 	changes := []string{}
 
-	if !isAdmin(ctx) {
-		log.Warn("Illegal access attempted")
-		cleanup(nil, w, unauthorizedError(w, "Admin privileges are required"))
-		return
-	}
-
 	orderParams := new(OrderParams)
 	err := json.NewDecoder(r.Body).Decode(orderParams)
 	if err != nil {
 		log.WithError(err).Infof("Failed to deserialize order params: %s", err.Error())
-		cleanup(nil, w, badRequestError(w, "Could not read Order Parameters: %v", err))
+		readError(w, "order params", err)
 		return
 	}
 
 	// verify that the order exists
 	existingOrder := new(models.Order)
 
-	rsp := orderQuery(a.db).First(existingOrder, "id = ?", orderID)
+	rsp := orderQuery(a.dbFor(ctx)).First(existingOrder, "id = ?", orderID)
 	if rsp.RecordNotFound() {
 		log.Warn("Update attempted to order that doesn't exist")
 		cleanup(nil, w, notFoundError(w, "Failed to find order with id '%s'", orderID))
@@ -447,7 +462,9 @@ func (a *API) OrderUpdate(ctx context.Context, w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	before := models.Snapshot(existingOrder)
 	alreadyPaid := existingOrder.PaymentState == models.PaidState
+	fulfillmentState := existingOrder.FulfillmentState
 
 	//
 	// handle the simple fields
@@ -484,12 +501,19 @@ func (a *API) OrderUpdate(ctx context.Context, w http.ResponseWriter, r *http.Re
 			return
 		}
 
+		vatState := a.vatState(ctx, orderParams.VATNumber)
+		if vatState == models.VATInvalidState {
+			cleanup(nil, w, badRequestError(w, "Vat number %v is not valid", orderParams.VATNumber))
+			return
+		}
+
 		log.Debugf("Updating vat number from '%v' to '%v'", existingOrder.VATNumber, orderParams.VATNumber)
 		existingOrder.VATNumber = orderParams.VATNumber
+		existingOrder.VATState = vatState
 		changes = append(changes, "vatnumber")
 	}
 
-	tx := a.db.Begin()
+	tx := a.dbFor(ctx).Begin()
 
 	//
 	// handle the addresses
@@ -547,6 +571,28 @@ func (a *API) OrderUpdate(ctx context.Context, w http.ResponseWriter, r *http.Re
 		changes = append(changes, "fulfillment_state")
 	}
 
+	// sending the tracking the order already has isn't a change
+	trackingChanged := false
+	if orderParams.Carrier != "" && orderParams.Carrier != existingOrder.Carrier {
+		existingOrder.Carrier = orderParams.Carrier
+		trackingChanged = true
+	}
+	if orderParams.TrackingNumber != "" && orderParams.TrackingNumber != existingOrder.TrackingNumber {
+		existingOrder.TrackingNumber = orderParams.TrackingNumber
+		trackingChanged = true
+	}
+	if orderParams.TrackingURL != "" && orderParams.TrackingURL != existingOrder.TrackingURL {
+		if u, err := url.Parse(orderParams.TrackingURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			cleanup(tx, w, badRequestError(w, "Bad tracking URL: %v", orderParams.TrackingURL))
+			return
+		}
+		existingOrder.TrackingURL = orderParams.TrackingURL
+		trackingChanged = true
+	}
+	if trackingChanged {
+		changes = append(changes, "tracking")
+	}
+
 	//
 	// handle the line items
 	//
@@ -576,7 +622,13 @@ func (a *API) OrderUpdate(ctx context.Context, w http.ResponseWriter, r *http.Re
 	}
 
 	models.LogEvent(tx, r.RemoteAddr, claims.ID, existingOrder.ID, models.EventUpdated, changes)
-	if rsp := tx.Commit(); rsp.Error != nil {
+	a.audit(ctx, tx, r, "order.update", "order", existingOrder.ID, before, models.Snapshot(existingOrder))
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.UpdateEvent, UserID: existingOrder.UserID, Payload: existingOrder})
+	if existingOrder.FulfillmentState != fulfillmentState || trackingChanged {
+		a.publish(ctx, batch, &events.Event{Type: webhooks.FulfillmentEvent, UserID: existingOrder.UserID, Payload: existingOrder})
+	}
+	if rsp := batch.Commit(); rsp.Error != nil {
 		log.WithError(err).Warn("Problem while committing order updates")
 		cleanup(tx, w, internalServerError(w, "Error committing order updates"))
 		return
@@ -695,6 +747,13 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 		}
 	}
 
+	if err := order.ReserveInventory(tx); err != nil {
+		if _, ok := err.(*models.OutOfStockError); ok {
+			return &HTTPError{Code: 400, Message: err.Error()}
+		}
+		return &HTTPError{Code: 500, Message: fmt.Sprintf("Error updating inventory: %v", err)}
+	}
+
 	for _, download := range order.Downloads {
 		if err := tx.Create(&download).Error; err != nil {
 			return &HTTPError{Code: 500, Message: fmt.Sprintf("Error creating download item: %v", err)}
@@ -706,28 +765,30 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 		return &HTTPError{Code: 500, Message: err.Error()}
 	}
 
+	order.SetTaxBasis(taxBasis(getConfig(ctx), order))
 	order.CalculateTotal(settings)
+	for _, tax := range order.TaxesByRate(settings) {
+		if err := tx.Create(tax).Error; err != nil {
+			return &HTTPError{Code: 500, Message: fmt.Sprintf("Error creating order taxes: %v", err)}
+		}
+	}
+	if err := a.settleOrder(ctx, order); err != nil {
+		return &HTTPError{Code: 500, Message: fmt.Sprintf("Error converting the order to the settlement currency: %v", err)}
+	}
 
 	return nil
 }
 
-func (a *API) loadSettings(ctx context.Context) (*calculator.Settings, error) {
-	config := getConfig(ctx)
-
-	settings := &calculator.Settings{}
-	resp, err := a.httpClient.Get(config.SiteURL + "/gocommerce/settings.json")
-	if err != nil {
-		return nil, fmt.Errorf("Error loading site settings: %v", err)
+// taxBasis is the address an order is taxed for, depending on the country
+// it ships to
+func taxBasis(config *conf.Configuration, order *models.Order) string {
+	if basis, ok := config.Taxes.CountryBasis[order.ShippingAddress.Country]; ok {
+		return basis
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		decoder := json.NewDecoder(resp.Body)
-		if err := decoder.Decode(settings); err != nil {
-			return nil, fmt.Errorf("Error parsing site settings: %v", err)
-		}
+	if config.Taxes.Basis != "" {
+		return config.Taxes.Basis
 	}
-
-	return settings, nil
+	return conf.ShippingTaxBasis
 }
 
 func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, address *models.Address, id string) (*models.Address, *HTTPError) {
@@ -765,7 +826,7 @@ func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, addr
 
 func (a *API) processLineItem(ctx context.Context, order *models.Order, item *models.LineItem, orderItem *OrderLineItem) error {
 	config := getConfig(ctx)
-	resp, err := a.httpClient.Get(config.SiteURL + item.Path)
+	resp, err := a.get(ctx, config.SiteURL+item.Path)
 	if err != nil {
 		return err
 	}
@@ -808,6 +869,9 @@ func (a *API) processLineItem(ctx context.Context, order *models.Order, item *mo
 				})
 			}
 
+			if err := a.convertPrices(ctx, order.Currency, meta); err != nil {
+				return err
+			}
 			return item.Process(order, meta)
 		}
 	}
@@ -818,6 +882,7 @@ func (a *API) processLineItem(ctx context.Context, order *models.Order, item *mo
 func orderQuery(db *gorm.DB) *gorm.DB {
 	return db.
 		Preload("LineItems").
+		Preload("LineItems.Components").
 		Preload("Downloads").
 		Preload("ShippingAddress").
 		Preload("BillingAddress").
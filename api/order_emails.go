@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/guregu/kami"
+
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+// OrderEmailList lists the mails sent about an order, newest first
+func (a *API) OrderEmailList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	orderID := kami.Param(ctx, "order_id")
+	log := getLogger(ctx).WithField("order_id", orderID)
+	query := a.dbFor(ctx).Model(&models.Mail{}).Where("order_id = ?", orderID)
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	mails := []models.Mail{}
+	if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&mails); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for mails")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, mails)
+}
+
+// OrderEmailResend sends one of the mails about an order again, like a
+// receipt that got lost
+func (a *API) OrderEmailResend(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	orderID := kami.Param(ctx, "order_id")
+	name := kami.Param(ctx, "type")
+	log := getLogger(ctx).WithField("order_id", orderID)
+	m := a.mailerFor(ctx)
+	if m == nil {
+		notFoundError(w, "Mail isn't configured")
+		return
+	}
+
+	order := &models.Order{}
+	if result := orderQuery(a.dbFor(ctx)).First(order, "id = ?", orderID); result.Error != nil {
+		if result.RecordNotFound() {
+			notFoundError(w, "Order not found")
+		} else {
+			log.WithError(result.Error).Warnf("Error while querying database: %s", result.Error.Error())
+			internalServerError(w, "Error during database query: %v", result.Error)
+		}
+		return
+	}
+
+	transaction := models.NewTransaction(order)
+	for _, t := range order.Transactions {
+		t.Order = order
+		if t.Type == models.ChargeTransactionType && t.Status == models.PaidState {
+			transaction = t
+		}
+	}
+	if reason := unsendable(name, order); reason != "" {
+		badRequestError(w, "Can't send the %s mail: %s", name, reason)
+		return
+	}
+
+	msg, err := m.SendOrderMail(name, transaction)
+	if msg == nil && err == nil {
+		notFoundError(w, "Unknown mail '%s', must be one of: %s", name, strings.Join(mailer.OrderMails(), ", "))
+		return
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Error sending the %s mail again", name)
+		internalServerError(w, "Error sending the %s mail: %v", name, err)
+		return
+	}
+	log.Infof("Sent the %s mail to %s again", name, msg.To)
+
+	sent := &EmailPreview{To: msg.To, Subject: msg.Subject, HTML: msg.HTML, Text: msg.Text}
+	for _, attachment := range msg.Attachments {
+		sent.Attachments = append(sent.Attachments, attachment.Filename)
+	}
+	sendJSON(w, http.StatusOK, sent)
+}
+
+// unsendable tells why a mail about an order doesn't fit the state of the
+// order, if it doesn't
+func unsendable(name string, order *models.Order) string {
+	switch name {
+	case mailer.OrderConfirmation, mailer.OrderReceived:
+		if order.PaymentState != models.PaidState {
+			return "the order isn't paid"
+		}
+	case mailer.ShippingConfirmation:
+		if order.FulfillmentState != models.ShippedState {
+			return "the order hasn't shipped"
+		}
+	case mailer.RefundConfirmation:
+		for _, t := range order.Transactions {
+			if t.Type == models.RefundTransactionType && t.Status == models.PaidState {
+				return ""
+			}
+		}
+		return "the order wasn't refunded"
+	case mailer.CartReminder:
+		if order.PaymentState != models.PendingState {
+			return "the order isn't pending"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderEmailResend(t *testing.T) {
+	db, config := db(t)
+	payFirstOrder(db)
+	sender := &testSender{}
+	m := testMailerWith(config, sender)
+	m.Queue = db
+	api := NewAPI(config, db, nil, m, nil)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	ctx = kami.SetParam(ctx, "type", mailer.OrderConfirmation)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", nil)
+	api.OrderEmailResend(ctx, w, r)
+
+	sent := &EmailPreview{}
+	extractPayload(t, http.StatusOK, w, sent)
+	assert.Equal(t, firstOrder.Email, sent.To)
+	assert.Equal(t, "Order Confirmation", sent.Subject)
+	if assert.Len(t, sender.messages, 1) {
+		assert.Contains(t, sender.messages[0].HTML, "batwing")
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://something", nil)
+	api.OrderEmailList(ctx, w, r)
+	mails := []models.Mail{}
+	extractPayload(t, http.StatusOK, w, &mails)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, mailer.OrderConfirmation, mails[0].Type)
+		assert.Equal(t, firstOrder.Email, mails[0].To)
+		assert.Equal(t, "test-message", mails[0].MessageID)
+		assert.True(t, mails[0].Done)
+		assert.NotNil(t, mails[0].SentAt)
+	}
+	raw, _ := json.Marshal(mails[0])
+	assert.NotContains(t, string(raw), "batwing", "the log leaves out the body")
+}
+
+func TestOrderEmailResendErrors(t *testing.T) {
+	db, config := db(t)
+	sender := &testSender{}
+	api := NewAPI(config, db, nil, testMailerWith(config, sender), nil)
+
+	resend := func(token string, admin bool, name string) *httptest.ResponseRecorder {
+		ctx := testContext(testToken(token, ""), config, admin)
+		ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+		ctx = kami.SetParam(ctx, "type", name)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://something", nil)
+		guarded(t, api, "POST /orders/:order_id/emails/:type/resend", api.OrderEmailResend)(ctx, w, r)
+		return w
+	}
+
+	validateError(t, http.StatusUnauthorized, resend(testUser.ID, false, mailer.OrderConfirmation))
+	validateError(t, http.StatusNotFound, resend("magical-unicorn", true, "newsletter"))
+	// the first order isn't paid or shipped yet
+	validateError(t, http.StatusBadRequest, resend("magical-unicorn", true, mailer.OrderConfirmation))
+	validateError(t, http.StatusBadRequest, resend("magical-unicorn", true, mailer.ShippingConfirmation))
+	validateError(t, http.StatusBadRequest, resend("magical-unicorn", true, mailer.RefundConfirmation))
+	assert.Empty(t, sender.messages)
+}
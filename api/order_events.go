@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/guregu/kami"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// OrderEventsPollInterval is how often an order event stream checks the order
+// for changes made on other instances. Changes made on this instance are
+// streamed right away.
+var OrderEventsPollInterval = 5 * time.Second
+
+// OrderEvent is sent on the order event stream when the state of an order
+// changes
+type OrderEvent struct {
+	Type             string `json:"type"`
+	OrderID          string `json:"order_id"`
+	PaymentState     string `json:"payment_state"`
+	FulfillmentState string `json:"fulfillment_state"`
+	State            string `json:"state"`
+	Refunded         uint64 `json:"refunded"`
+}
+
+// orderNotifier wakes up the streams of an order when it is changed
+type orderNotifier struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan struct{}]bool
+}
+
+func newOrderNotifier() *orderNotifier {
+	return &orderNotifier{subscribers: map[string]map[chan struct{}]bool{}}
+}
+
+func (n *orderNotifier) subscribe(orderID string) (chan struct{}, func()) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	ch := make(chan struct{}, 1)
+	if n.subscribers[orderID] == nil {
+		n.subscribers[orderID] = map[chan struct{}]bool{}
+	}
+	n.subscribers[orderID][ch] = true
+
+	return ch, func() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		delete(n.subscribers[orderID], ch)
+		if len(n.subscribers[orderID]) == 0 {
+			delete(n.subscribers, orderID)
+		}
+	}
+}
+
+func (n *orderNotifier) notify(orderID string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for ch := range n.subscribers[orderID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// a wake up is already pending
+		}
+	}
+}
+
+// OrderEvents streams the changes to an order as Server-Sent Events: "paid",
+// "shipping", "shipped", "cancelled" and "refunded". The stream starts with a
+// "state" event holding the current state. The access rules are the ones of
+// viewing the order, which can be looked up by its ID or public reference.
+// Since EventSource can't set headers the token can
+// be passed as `?access_token=` instead, on this route only.
+func (a *API) OrderEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := kami.Param(ctx, "id")
+	log := getLogger(ctx).WithField("order_id", id)
+
+	flusher := findFlusher(w)
+	if flusher == nil {
+		internalServerError(w, "Streaming is not supported")
+		return
+	}
+
+	current, httpErr := a.orderEventState(ctx, id)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	// the stream may have been opened with the order's public reference
+	id = current.OrderID
+	changed, unsubscribe := a.orderEvents.subscribe(id)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", OrderEventsPollInterval/time.Millisecond)
+	writeOrderEvent(w, log, current.event("state"))
+	flusher.Flush()
+
+	// end the stream before the server's write timeout does, the client
+	// reconnects on its own
+	var deadline <-chan time.Time
+	if timeout := a.currentConfig().API.WriteTimeout; timeout > 0 {
+		deadline = time.After(timeout - timeout/10)
+	}
+
+	ticker := time.NewTicker(OrderEventsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+
+		next, httpErr := a.orderEventState(ctx, id)
+		if httpErr != nil {
+			log.Warnf("Stopped streaming order events: %v", httpErr.Message)
+			return
+		}
+		events := current.changes(next)
+		if len(events) == 0 {
+			// keeps proxies from closing an idle connection
+			fmt.Fprint(w, ":\n\n")
+		}
+		for _, event := range events {
+			writeOrderEvent(w, log, event)
+		}
+		flusher.Flush()
+		current = next
+	}
+}
+
+type orderEventState struct {
+	OrderEvent
+	userID string
+}
+
+func (a *API) orderEventState(ctx context.Context, id string) (*orderEventState, *HTTPError) {
+	order := &models.Order{}
+	if rsp := a.dbFor(ctx).Preload("Transactions").First(order, "id = ? OR ref = ?", id, id); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, httpError(404, "Order not found")
+		}
+		return nil, httpError(500, "Error during database query: %v", rsp.Error)
+	}
+
+	s := &orderEventState{
+		OrderEvent: OrderEvent{
+			OrderID:          order.ID,
+			PaymentState:     order.PaymentState,
+			FulfillmentState: order.FulfillmentState,
+			State:            order.State,
+		},
+		userID: order.UserID,
+	}
+	for _, t := range order.Transactions {
+		if t.Type == models.RefundTransactionType && t.Status == models.PaidState {
+			s.Refunded += t.Amount
+		}
+	}
+	return s, nil
+}
+
+func (s *orderEventState) event(eventType string) OrderEvent {
+	event := s.OrderEvent
+	event.Type = eventType
+	return event
+}
+
+// changes lists the events for going from s to next
+func (s *orderEventState) changes(next *orderEventState) []OrderEvent {
+	events := []OrderEvent{}
+	if next.PaymentState != s.PaymentState && next.PaymentState == models.PaidState {
+		events = append(events, next.event("paid"))
+	}
+	if next.FulfillmentState != s.FulfillmentState && next.FulfillmentState != models.PendingState {
+		events = append(events, next.event(next.FulfillmentState))
+	}
+	if next.State != s.State && next.State == models.CancelledState {
+		events = append(events, next.event("cancelled"))
+	}
+	if next.Refunded > s.Refunded {
+		events = append(events, next.event("refunded"))
+	}
+	return events
+}
+
+func writeOrderEvent(w http.ResponseWriter, log *logrus.Entry, event OrderEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Warn("Failed to encode order event")
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
+
+// findFlusher looks for a Flusher through the writer proxies wrapped around
+// the response, kami's proxy only exposes one if the writer can be hijacked
+func findFlusher(w http.ResponseWriter) http.Flusher {
+	for {
+		if f, ok := w.(http.Flusher); ok {
+			return f
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
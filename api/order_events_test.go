@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// readOrderEvent reads the next event off an order event stream
+func readOrderEvent(t *testing.T, scanner *bufio.Scanner) *OrderEvent {
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data: ") {
+			event := &OrderEvent{}
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event))
+			return event
+		}
+	}
+	assert.FailNow(t, "stream ended before an event")
+	return nil
+}
+
+func TestOrderEvents(t *testing.T) {
+	db, config := db(t)
+	config.JWT.Secret = "secret"
+
+	api := NewAPI(config, db, nil, nil, nil)
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &JWTClaims{
+		ID:             testUser.ID,
+		StandardClaims: &jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	signed, _ := token.SignedString([]byte(config.JWT.Secret))
+
+	r, _ := http.NewRequest("GET", server.URL+"/v1/orders/"+firstOrder.ID+"/events?access_token="+signed, nil)
+	r.Header.Set("Accept", "text/event-stream")
+	rsp, err := http.DefaultClient.Do(r)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer rsp.Body.Close()
+	assert.Equal(t, 200, rsp.StatusCode)
+	assert.Equal(t, "text/event-stream", rsp.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(rsp.Body)
+	event := readOrderEvent(t, scanner)
+	assert.Equal(t, "state", event.Type)
+	assert.Equal(t, models.PendingState, event.PaymentState)
+
+	db.Model(firstOrder).UpdateColumn("payment_state", models.PaidState)
+	api.orderEvents.notify(firstOrder.ID)
+
+	event = readOrderEvent(t, scanner)
+	assert.Equal(t, "paid", event.Type)
+	assert.Equal(t, firstOrder.ID, event.OrderID)
+
+	// other routes don't take the token from the query
+	r, _ = http.NewRequest("GET", server.URL+"/v1/orders/"+firstOrder.ID+"?access_token="+signed, nil)
+	r.Header.Set("Accept", "text/event-stream")
+	rsp, err = http.DefaultClient.Do(r)
+	if assert.NoError(t, err) {
+		rsp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+	}
+}
+
+func TestOrderEventsAsStranger(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken("stranger", ""), config, false)
+	ctx = kami.SetParam(ctx, "id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something", nil)
+
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /orders/:id/events", api.OrderEvents)(ctx, w, r)
+	validateError(t, 401, w)
+}
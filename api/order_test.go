@@ -212,9 +212,9 @@ func TestOrderQueryForAllOrdersNotWithAdminRights(t *testing.T) {
 	req, _ := http.NewRequest("GET", urlWithUserID, nil)
 
 	api := NewAPI(config, db, nil, nil, nil)
-	api.OrderList(ctx, recorder, req)
-	assert.Equal(t, 400, recorder.Code)
-	validateError(t, 400, recorder)
+	guarded(t, api, "GET /users/:user_id/orders", api.OrderList)(ctx, recorder, req)
+	assert.Equal(t, 401, recorder.Code)
+	validateError(t, 401, recorder)
 }
 
 func TestOrderQueryForAllOrdersWithNoToken(t *testing.T) {
@@ -225,7 +225,7 @@ func TestOrderQueryForAllOrdersWithNoToken(t *testing.T) {
 	req, _ := http.NewRequest("GET", urlWithUserID, nil)
 
 	api := NewAPI(config, nil, nil, nil, nil)
-	api.OrderList(ctx, recorder, req)
+	guarded(t, api, "GET /orders", api.OrderList)(ctx, recorder, req)
 	assert.Equal(t, 401, recorder.Code)
 	validateError(t, 401, recorder)
 }
@@ -252,6 +252,105 @@ func TestOrderQueryForAnOrderAsTheUser(t *testing.T) {
 	validateAddress(t, firstOrder.ShippingAddress, order.ShippingAddress)
 }
 
+func TestOrderQueryForAnOrderByRef(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(nil, config, false)
+
+	startTestSite(config)
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "https://not-real", strings.NewReader(`{
+		"email": "info@example.com",
+		"shipping_address": {
+			"first_name": "Test", "last_name": "User",
+			"address1": "610 22nd Street",
+			"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`))
+	NewAPI(config, db, nil, nil, nil).OrderCreate(ctx, recorder, req)
+	created := &models.Order{}
+	extractPayload(t, 201, recorder, created)
+	assert.Len(t, created.Ref, 7)
+	assert.NotEqual(t, created.ID, created.Ref)
+
+	ctx = testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "id", created.Ref)
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "https://not-real/"+created.Ref, nil)
+	NewAPI(config, db, nil, nil, nil).OrderView(ctx, recorder, req)
+	order := new(models.Order)
+	extractPayload(t, 200, recorder, order)
+	assert.Equal(t, created.ID, order.ID)
+	assert.Equal(t, created.Ref, order.Ref)
+}
+
+func TestOrderQueryWithETag(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken(testUser.ID, "marp@wayneindustries.com"), config, false)
+	ctx = kami.SetParam(ctx, "id", firstOrder.ID)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "https://not-real/"+firstOrder.ID, nil)
+	NewAPI(config, db, nil, nil, nil).OrderView(ctx, recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	etag := recorder.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	recorder = httptest.NewRecorder()
+	req.Header.Set("If-None-Match", etag)
+	NewAPI(config, db, nil, nil, nil).OrderView(ctx, recorder, req)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Empty(t, recorder.Body.String())
+
+	db.Model(firstOrder).Update("fulfillment_state", models.ShippedState)
+	defer db.Model(firstOrder).Update("fulfillment_state", firstOrder.FulfillmentState)
+	recorder = httptest.NewRecorder()
+	NewAPI(config, db, nil, nil, nil).OrderView(ctx, recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+}
+
+func TestOrderListWithETag(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken(testUser.ID, "marp@wayneindustries.com"), config, false)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "https://not-real/orders", nil)
+	NewAPI(config, db, nil, nil, nil).OrderList(ctx, recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+
+	recorder2 := httptest.NewRecorder()
+	req.Header.Set("If-None-Match", `"other", W/`+recorder.Header().Get("ETag"))
+	NewAPI(config, db, nil, nil, nil).OrderList(ctx, recorder2, req)
+	assert.Equal(t, http.StatusNotModified, recorder2.Code)
+	assert.Equal(t, recorder.Header().Get("ETag"), recorder2.Header().Get("ETag"))
+}
+
+func TestOrderListByState(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken(testUser.ID, "marp@wayneindustries.com"), config, false)
+	db.Model(firstOrder).Update("fulfillment_state", models.ShippedState)
+	defer db.Model(firstOrder).Update("fulfillment_state", firstOrder.FulfillmentState)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "https://not-real/orders?fulfillment_state=shipped", nil)
+	NewAPI(config, db, nil, nil, nil).OrderList(ctx, recorder, req)
+	orders := []models.Order{}
+	extractPayload(t, 200, recorder, &orders)
+	if assert.Len(t, orders, 1) {
+		assert.Equal(t, firstOrder.ID, orders[0].ID)
+		assert.Len(t, orders[0].LineItems, 1)
+	}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "https://not-real/orders?state=pending&fulfillment_state=pending", nil)
+	NewAPI(config, db, nil, nil, nil).OrderList(ctx, recorder, req)
+	extractPayload(t, 200, recorder, &orders)
+	if assert.Len(t, orders, 1) {
+		assert.Equal(t, secondOrder.ID, orders[0].ID)
+	}
+}
+
 func TestOrderQueryForAnOrderAsAnAdmin(t *testing.T) {
 	db, config := db(t)
 	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
@@ -280,7 +379,8 @@ func TestOrderQueryForAnOrderAsAStranger(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", urlForFirstOrder, nil)
 
-	NewAPI(config, db, nil, nil, nil).OrderView(ctx, recorder, req)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /orders/:id", api.OrderView)(ctx, recorder, req)
 	assert.Equal(t, 401, recorder.Code)
 	validateError(t, 401, recorder)
 }
@@ -310,7 +410,8 @@ func TestOrderQueryForAnOrderWithNoToken(t *testing.T) {
 	req, _ := http.NewRequest("GET", "https://not-real/does-not-exist", nil)
 
 	// use nil for DB b/c it should *NEVER* be called
-	NewAPI(config, nil, nil, nil, nil).OrderView(ctx, recorder, req)
+	api := NewAPI(config, nil, nil, nil, nil)
+	guarded(t, api, "GET /orders/:id", api.OrderView)(ctx, recorder, req)
 	validateError(t, 401, recorder)
 }
 
@@ -531,7 +632,7 @@ func TestOrderUpdateAsNonAdmin(t *testing.T) {
 	req, _ := http.NewRequest("POST", urlWithUserID, bytes.NewReader(updateBody))
 
 	api := NewAPI(config, db, nil, nil, nil)
-	api.OrderUpdate(ctx, recorder, req)
+	guarded(t, api, "PUT /orders/:id", api.OrderUpdate)(ctx, recorder, req)
 	validateError(t, 401, recorder)
 }
 
@@ -554,7 +655,7 @@ func TestOrderUpdateWithNoCreds(t *testing.T) {
 	req, _ := http.NewRequest("POST", urlForFirstOrder, bytes.NewReader(updateBody))
 
 	api := NewAPI(config, db, nil, nil, nil)
-	api.OrderUpdate(ctx, recorder, req)
+	guarded(t, api, "PUT /orders/:id", api.OrderUpdate)(ctx, recorder, req)
 	validateError(t, 401, recorder)
 }
 
@@ -798,6 +899,21 @@ func startTestSite(config *conf.Configuration) {
 					</script>
 				</body>
 				</html>`)
+		case "/kit-product":
+			fmt.Fprintln(w, `<!doctype html>
+				<html>
+				<head><title>Test Kit</title></head>
+				<body>
+					<script class="gocommerce-product">
+					{"sku": "kit-1", "title": "Kit 1", "type": "Kit", "prices": [
+						{"amount": "20.00", "currency": "USD"}
+					], "components": [
+						{"sku": "kit-book", "title": "Book", "type": "Book", "prices": [{"amount": "15.00", "currency": "USD"}]},
+						{"sku": "kit-ebook", "title": "E-Book", "type": "E-Book", "prices": [{"amount": "10.00", "currency": "USD"}]}
+					]}
+					</script>
+				</body>
+				</html>`)
 		case "/gocommerce/settings.json":
 			fmt.Fprintln(w, `{
 				"taxes": [
@@ -810,3 +926,40 @@ func startTestSite(config *conf.Configuration) {
 
 	config.SiteURL = ts.URL
 }
+
+func TestOrderCreationWithBillingTaxBasis(t *testing.T) {
+	db, config := db(t)
+	config.Taxes.Basis = conf.ShippingTaxBasis
+	config.Taxes.CountryBasis = map[string]string{"USA": conf.BillingTaxBasis}
+	ctx := testContext(nil, config, false)
+
+	startTestSite(config)
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "https://not-real", strings.NewReader(`{
+		"email": "info@example.com",
+		"shipping_address": {
+			"first_name": "Test", "last_name": "User",
+			"address1": "610 22nd Street",
+			"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+		},
+		"billing_address": {
+			"first_name": "Test", "last_name": "User",
+			"address1": "Branengebranen",
+			"city": "Berlin", "country": "Germany", "zip": "94107"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`))
+	api := NewAPI(config, db, nil, nil, nil)
+
+	api.OrderCreate(ctx, recorder, req)
+
+	order := &models.Order{}
+	extractPayload(t, 201, recorder, order)
+	assert.Equal(t, conf.BillingTaxBasis, order.TaxBasis)
+	assert.Equal(t, "Germany", order.TaxCountry)
+	assert.Equal(t, uint64(70), order.Taxes)
+
+	stored := &models.Order{}
+	db.First(stored, "id = ?", order.ID)
+	assert.Equal(t, "Germany", stored.TaxCountry)
+}
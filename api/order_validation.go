@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"unicode/utf8"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// orderProblems collects the invalid fields of an order
+type orderProblems struct {
+	config *conf.Configuration
+	errors []FieldError
+}
+
+func (p *orderProblems) add(field, format string, args ...interface{}) {
+	p.errors = append(p.errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *orderProblems) text(field, value string) {
+	if max := p.config.OrderLimits.MaxFieldLength; max > 0 && utf8.RuneCountInString(value) > max {
+		p.add(field, "can't be longer than %d characters", max)
+	}
+}
+
+func (p *orderProblems) meta(field string, meta map[string]interface{}) {
+	max := p.config.OrderLimits.MaxMetaSize
+	if max <= 0 || meta == nil {
+		return
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		p.add(field, "can't be encoded: %v", err)
+	} else if len(data) > max {
+		p.add(field, "can't be larger than %d bytes", max)
+	}
+}
+
+func (p *orderProblems) address(field string, address *models.Address) {
+	if address == nil {
+		return
+	}
+	p.text(field+".first_name", address.FirstName)
+	p.text(field+".last_name", address.LastName)
+	p.text(field+".company", address.Company)
+	p.text(field+".address1", address.Address1)
+	p.text(field+".address2", address.Address2)
+	p.text(field+".city", address.City)
+	p.text(field+".country", address.Country)
+	p.text(field+".state", address.State)
+	p.text(field+".zip", address.Zip)
+}
+
+// validateOrderParams checks a new order stays within the order limits, before
+// any of it is looked up or stored. Limits left at 0 in the configuration are
+// set to their defaults when it's loaded.
+func validateOrderParams(config *conf.Configuration, params *OrderParams) []FieldError {
+	p := &orderProblems{config: config}
+	limits := config.OrderLimits
+
+	if params.Email != "" {
+		p.text("email", params.Email)
+		if _, err := mail.ParseAddress(params.Email); err != nil {
+			p.add("email", "isn't a valid email address")
+		}
+	}
+	p.text("session_id", params.SessionID)
+	p.text("vatnumber", params.VATNumber)
+	p.text("currency", params.Currency)
+	p.text("coupon", params.CouponCode)
+	p.text("experiment", params.Experiment)
+	p.text("variant", params.Variant)
+	p.text("shipping_address_id", params.ShippingAddressID)
+	p.text("billing_address_id", params.BillingAddressID)
+	p.address("shipping_address", params.ShippingAddress)
+	p.address("billing_address", params.BillingAddress)
+	p.meta("meta", params.MetaData)
+
+	if limits.MaxLineItems > 0 && len(params.LineItems) > limits.MaxLineItems {
+		p.add("line_items", "can't have more than %d items", limits.MaxLineItems)
+		return p.errors
+	}
+	for i, item := range params.LineItems {
+		field := fmt.Sprintf("line_items[%d]", i)
+		if item == nil {
+			p.add(field, "can't be empty")
+			continue
+		}
+		p.text(field+".sku", item.Sku)
+		p.text(field+".path", item.Path)
+		if limits.MaxQuantity > 0 && item.Quantity > limits.MaxQuantity {
+			p.add(field+".quantity", "can't be more than %d", limits.MaxQuantity)
+		}
+		if limits.MaxLineItems > 0 && len(item.Addons) > limits.MaxLineItems {
+			p.add(field+".addons", "can't have more than %d addons", limits.MaxLineItems)
+		}
+		for j, addon := range item.Addons {
+			p.text(fmt.Sprintf("%s.addons[%d].sku", field, j), addon.Sku)
+		}
+		p.meta(field+".meta", item.MetaData)
+	}
+	return p.errors
+}
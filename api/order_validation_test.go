@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderCreateRefusesOversizedOrders(t *testing.T) {
+	db, config := db(t)
+	config.OrderLimits.MaxLineItems = 2
+	config.OrderLimits.MaxQuantity = 10
+	config.OrderLimits.MaxMetaSize = 32
+	config.OrderLimits.MaxFieldLength = 20
+	ctx := testContext(nil, config, false)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "https://not-real", strings.NewReader(`{
+		"email": "not an email",
+		"shipping_address": {"first_name": "Ångström-Ødegård Zoë", "address1": "610 22nd Street, Suite 500, Floor 3"},
+		"meta": {"notes": "this is more than thirty-two bytes of meta data"},
+		"line_items": [{"path": "/simple-product", "quantity": 500}]
+	}`))
+	NewAPI(config, db, nil, nil, nil).OrderCreate(ctx, recorder, req)
+
+	rsp := &HTTPError{}
+	extractPayload(t, http.StatusUnprocessableEntity, recorder, rsp)
+	fields := []string{}
+	for _, problem := range rsp.Errors {
+		fields = append(fields, problem.Field)
+	}
+	assert.Equal(t, []string{"email", "shipping_address.address1", "meta", "line_items[0].quantity"}, fields)
+
+	recorder = httptest.NewRecorder()
+	items, _ := json.Marshal(map[string]interface{}{
+		"email":      "info@example.com",
+		"line_items": []map[string]interface{}{{"path": "/a"}, {"path": "/b"}, {"path": "/c"}},
+	})
+	req, _ = http.NewRequest("POST", "https://not-real", strings.NewReader(string(items)))
+	NewAPI(config, db, nil, nil, nil).OrderCreate(ctx, recorder, req)
+
+	rsp = &HTTPError{}
+	extractPayload(t, http.StatusUnprocessableEntity, recorder, rsp)
+	if assert.Len(t, rsp.Errors, 1) {
+		assert.Equal(t, "line_items", rsp.Errors[0].Field)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	db, config := db(t)
+	config.API.MaxBodySize = 64
+	api := NewAPI(config, db, nil, nil, nil)
+
+	recorder := httptest.NewRecorder()
+	body := `{"email": "info@example.com", "meta": {"notes": "` + strings.Repeat("x", 100) + `"}}`
+	req, _ := http.NewRequest("POST", "https://not-real/orders", strings.NewReader(body))
+	ctx := api.populateContext(testContext(nil, config, false), recorder, req)
+	api.OrderCreate(ctx, recorder, req)
+
+	validateError(t, http.StatusRequestEntityTooLarge, recorder)
+
+	recorder = httptest.NewRecorder()
+	body = `{"code": "` + strings.Repeat("X", 100) + `"}`
+	req, _ = http.NewRequest("POST", "https://not-real/coupons", strings.NewReader(body))
+	ctx = api.populateContext(testContext(testToken("magical-unicorn", ""), config, true), recorder, req)
+	api.CouponCreate(ctx, recorder, req)
+
+	validateError(t, http.StatusRequestEntityTooLarge, recorder)
+}
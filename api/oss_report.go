@@ -0,0 +1,215 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// euMemberStates are the codes of the EU member states in OSS returns, by
+// their names and ISO codes. Greece is EL in VAT matters.
+var euMemberStates = map[string]string{
+	"austria": "AT", "belgium": "BE", "bulgaria": "BG", "croatia": "HR", "cyprus": "CY",
+	"czech republic": "CZ", "czechia": "CZ", "denmark": "DK", "estonia": "EE", "finland": "FI",
+	"france": "FR", "germany": "DE", "greece": "EL", "hungary": "HU", "ireland": "IE",
+	"italy": "IT", "latvia": "LV", "lithuania": "LT", "luxembourg": "LU", "malta": "MT",
+	"netherlands": "NL", "the netherlands": "NL", "poland": "PL", "portugal": "PT",
+	"romania": "RO", "slovakia": "SK", "slovenia": "SI", "spain": "ES", "sweden": "SE",
+	"at": "AT", "be": "BE", "bg": "BG", "hr": "HR", "cy": "CY", "cz": "CZ", "dk": "DK",
+	"ee": "EE", "fi": "FI", "fr": "FR", "de": "DE", "el": "EL", "gr": "EL", "hu": "HU",
+	"ie": "IE", "it": "IT", "lv": "LV", "lt": "LT", "lu": "LU", "mt": "MT", "nl": "NL",
+	"pl": "PL", "pt": "PT", "ro": "RO", "sk": "SK", "si": "SI", "es": "ES", "se": "SE",
+}
+
+// memberStateCode is the OSS code of the country, if it's an EU member state
+func memberStateCode(country string) (string, bool) {
+	code, ok := euMemberStates[strings.ToLower(strings.TrimSpace(country))]
+	return code, ok
+}
+
+// OSSRow is the sales of a quarter to consumers in an EU member state at one
+// VAT rate, less the refunds issued in the quarter
+type OSSRow struct {
+	Country       string `json:"country"`
+	Rate          uint64 `json:"rate"`
+	Currency      string `json:"currency"`
+	Orders        uint64 `json:"orders"`
+	TaxableAmount int64  `json:"taxable_amount"`
+	VATAmount     int64  `json:"vat_amount"`
+}
+
+type ossKey struct {
+	country  string
+	rate     uint64
+	currency string
+}
+
+// parseQuarter reads a quarter like 2026-Q3. Without one it's the last
+// quarter that ended.
+func parseQuarter(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return periodStart(now, "quarter").AddDate(0, -3, 0), nil
+	}
+	var year, quarter int
+	if _, err := fmt.Sscanf(strings.ToUpper(value), "%d-Q%d", &year, &quarter); err != nil || quarter < 1 || quarter > 4 {
+		return time.Time{}, fmt.Errorf("bad value for 'quarter' parameter '%v', must be like 2026-Q3", value)
+	}
+	return time.Date(year, time.Month(3*quarter-2), 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+// OSSReport sums up the sales of digital goods to consumers in the other EU
+// member states for the orders paid in a quarter, by member state and VAT
+// rate, for the One Stop Shop VAT return. Orders with a VAT number are
+// business sales, which aren't declared in the OSS. The taxes are the ones
+// the calculator split by rate when the orders were placed, like in the tax
+// summary, and refunds issued in the quarter are taken off by their share
+// of each rate. Use `?quarter=2026-Q3` for a quarter and `?format=csv` for
+// the CSV of the return.
+func (a *API) OSSReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	config := getConfig(ctx)
+	from, err := parseQuarter(r.URL.Query().Get("quarter"), time.Now())
+	if err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+	to := from.AddDate(0, 3, 0)
+
+	ordersTable := models.Order{}.TableName()
+	taxesTable := models.OrderTax{}.TableName()
+	transactionsTable := models.Transaction{}.TableName()
+	consumers := func(query *gorm.DB) *gorm.DB {
+		query = query.Where(ordersTable+".vat_number = ? OR "+ordersTable+".vat_number IS NULL", "")
+		if len(config.Taxes.DigitalTypes) > 0 {
+			query = query.Where(taxesTable+".type IN (?)", config.Taxes.DigitalTypes)
+		}
+		return query
+	}
+	sales := consumers(paidOrderTaxes(a.dbFor(ctx))).
+		Select(taxesTable+".country, "+taxesTable+".percentage, "+ordersTable+".currency, count(distinct "+taxesTable+".order_id), sum("+taxesTable+".net), sum("+taxesTable+".taxes)").
+		Where(paidAt+" >= ? AND "+paidAt+" < ?", from, to).
+		Group(taxesTable + ".country, " + taxesTable + ".percentage, " + ordersTable + ".currency")
+	refunds := consumers(refundedOrderTaxes(a.dbFor(ctx))).
+		Select(taxesTable+".country, "+taxesTable+".percentage, "+ordersTable+".currency, sum("+transactionsTable+".amount), "+taxesTable+".net, "+taxesTable+".taxes, "+ordersTable+".total").
+		Where(transactionsTable+".created_at >= ? AND "+transactionsTable+".created_at < ?", from, to).
+		Group(taxesTable + ".id, " + taxesTable + ".country, " + taxesTable + ".percentage, " + ordersTable + ".currency, " + taxesTable + ".net, " + taxesTable + ".taxes, " + ordersTable + ".total")
+
+	home, _ := memberStateCode(config.Taxes.HomeCountry)
+	aggregated := map[ossKey]*OSSRow{}
+	for _, refund := range []bool{false, true} {
+		query := sales
+		if refund {
+			query = refunds
+		}
+		rows, err := query.Rows()
+		if err != nil {
+			log.WithError(err).Warn("Error while querying for the OSS report")
+			internalServerError(w, "Database error: %v", err)
+			return
+		}
+		for rows.Next() {
+			var country, currency string
+			var rate, orders, refunded, net, taxes, total uint64
+			if refund {
+				err = rows.Scan(&country, &rate, &currency, &refunded, &net, &taxes, &total)
+			} else {
+				err = rows.Scan(&country, &rate, &currency, &orders, &net, &taxes)
+			}
+			if err != nil {
+				rows.Close()
+				internalServerError(w, "Database error: %v", err)
+				return
+			}
+			code, ok := memberStateCode(country)
+			if !ok || code == home {
+				continue
+			}
+
+			key := ossKey{code, rate, strings.ToUpper(currency)}
+			row, ok := aggregated[key]
+			if !ok {
+				row = &OSSRow{Country: key.country, Rate: key.rate, Currency: key.currency}
+				aggregated[key] = row
+			}
+			if refund {
+				row.TaxableAmount -= int64(taxShare(refunded, net, total))
+				row.VATAmount -= int64(taxShare(refunded, taxes, total))
+			} else {
+				row.Orders += orders
+				row.TaxableAmount += int64(net)
+				row.VATAmount += int64(taxes)
+			}
+		}
+		rows.Close()
+	}
+
+	result := []*OSSRow{}
+	for _, row := range aggregated {
+		result = append(result, row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Country != result[j].Country {
+			return result[i].Country < result[j].Country
+		}
+		if result[i].Rate != result[j].Rate {
+			return result[i].Rate < result[j].Rate
+		}
+		return result[i].Currency < result[j].Currency
+	})
+
+	if !wantsCSV(r) {
+		sendJSON(w, 200, result)
+		return
+	}
+
+	period := fmt.Sprintf("%d-Q%d", from.Year(), (int(from.Month())+2)/3)
+	records := [][]string{{"period", "member_state", "supply_type", "vat_rate", "currency", "taxable_amount", "vat_amount"}}
+	for _, row := range result {
+		records = append(records, []string{
+			period,
+			row.Country,
+			"services",
+			strconv.FormatUint(row.Rate, 10),
+			row.Currency,
+			decimalAmount(row.TaxableAmount),
+			decimalAmount(row.VATAmount),
+		})
+	}
+	if err := sendCSV(w, "oss_"+period+".csv", records); err != nil {
+		log.WithError(err).Warn("Failed to write CSV report")
+	}
+}
+
+// digitalItem tells if the item is one of the digital goods of the OSS
+// report and the location evidence. Without taxes.digital_types every item
+// is digital.
+func digitalItem(config *conf.Configuration, item *models.LineItem) bool {
+	if len(config.Taxes.DigitalTypes) == 0 {
+		return true
+	}
+	for _, t := range config.Taxes.DigitalTypes {
+		if t == item.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// decimalAmount is an amount in the lowest unit with the two decimals of
+// the currencies of the member states
+func decimalAmount(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func runOSSReport(t *testing.T, api *API, query string) *httptest.ResponseRecorder {
+	ctx := testContext(testToken("magical-unicorn", ""), api.config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/reports/oss"+query, nil)
+	guarded(t, api, "GET /reports/oss", api.OSSReport)(ctx, w, r)
+	return w
+}
+
+func TestOSSReport(t *testing.T) {
+	db, config := db(t)
+	config.Taxes.DigitalTypes = []string{"plane", "tank"}
+	db.Model(firstOrder).Updates(map[string]interface{}{"payment_state": models.PaidState, "tax_country": "Germany"})
+	db.Model(secondOrder).Updates(map[string]interface{}{"payment_state": models.PaidState, "tax_country": "fr"})
+	for _, tax := range []*models.OrderTax{
+		{OrderID: firstOrder.ID, Country: "Germany", Type: "plane", Percentage: 25, Net: 24, Taxes: 6},
+		{OrderID: secondOrder.ID, Country: "fr", Type: "tank", Percentage: 20, Net: 10, Taxes: 2},
+		{OrderID: secondOrder.ID, Country: "fr", Type: "clothes", Percentage: 20, Net: 45, Taxes: 9},
+	} {
+		assert.NoError(t, db.Create(tax).Error)
+	}
+	// the first order was placed last quarter and paid in this one
+	db.Model(firstOrder).UpdateColumn("created_at", time.Now().AddDate(0, -4, 0))
+	api := NewAPI(config, db, nil, nil, nil)
+
+	now := time.Now().UTC()
+	quarter := fmt.Sprintf("?quarter=%d-Q%d", now.Year(), (int(now.Month())+2)/3)
+	rows := []OSSRow{}
+	extractPayload(t, http.StatusOK, runOSSReport(t, api, quarter), &rows)
+	assert.Equal(t, []OSSRow{
+		{Country: "DE", Rate: 25, Currency: "USD", Orders: 1, TaxableAmount: 24, VATAmount: 6},
+		{Country: "FR", Rate: 20, Currency: "USD", Orders: 1, TaxableAmount: 10, VATAmount: 2},
+	}, rows, "the clothes aren't digital")
+
+	refund := &models.Transaction{ID: "refund", OrderID: secondOrder.ID, Type: models.RefundTransactionType, Status: models.PaidState, Amount: 22, Currency: "usd"}
+	assert.NoError(t, db.Create(refund).Error)
+	config.Taxes.HomeCountry = "Germany"
+	w := runOSSReport(t, api, quarter+"&format=csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if assert.NoError(t, err) && assert.Len(t, records, 2, "sales to the home country are left out") {
+		assert.Equal(t, []string{quarter[9:], "FR", "services", "20", "USD", "0.06", "0.01"}, records[1], "refunds are taken off")
+	}
+
+	rows = []OSSRow{}
+	extractPayload(t, http.StatusOK, runOSSReport(t, api, ""), &rows)
+	assert.Empty(t, rows, "the last quarter has no sales")
+
+	db.Model(secondOrder).UpdateColumn("vat_number", "FR40303265045")
+	rows = []OSSRow{}
+	extractPayload(t, http.StatusOK, runOSSReport(t, api, quarter), &rows)
+	assert.Empty(t, rows, "business sales aren't in the OSS")
+
+	validateError(t, http.StatusBadRequest, runOSSReport(t, api, "?quarter=2026-Q5"))
+}
@@ -1,10 +1,12 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/jinzhu/gorm"
 )
@@ -19,22 +21,32 @@ func calculateTotalPages(perPage, total uint64) uint64 {
 	return pages
 }
 
+// addPaginationHeaders adds the Link header, with the first, prev, next and
+// last pages, and the X-Total-Count header that every list endpoint returns
 func addPaginationHeaders(w http.ResponseWriter, r *http.Request, page, perPage, total uint64) {
 	totalPages := calculateTotalPages(perPage, total)
+	if totalPages == 0 {
+		totalPages = 1
+	}
 	url, _ := url.ParseRequestURI(r.URL.String())
 	query := url.Query()
-	header := ""
-	if totalPages > page {
-		query.Set("page", fmt.Sprintf("%v", page+1))
+	link := func(page uint64, rel string) string {
+		query.Set("page", fmt.Sprintf("%v", page))
 		url.RawQuery = query.Encode()
-		header += "<" + url.String() + ">; rel=\"next\", "
+		return "<" + url.String() + ">; rel=\"" + rel + "\""
+	}
+
+	links := []string{}
+	if page > 1 {
+		links = append(links, link(1, "first"), link(page-1, "prev"))
 	}
-	query.Set("page", fmt.Sprintf("%v", totalPages))
-	url.RawQuery = query.Encode()
-	header += "<" + url.String() + ">; rel=\"last\""
+	if totalPages > page {
+		links = append(links, link(page+1, "next"))
+	}
+	links = append(links, link(totalPages, "last"))
 
-	w.Header().Add("Link", header)
-	w.Header().Add("X-Total-Count", fmt.Sprintf("%v", total))
+	w.Header().Set("Link", strings.Join(links, ", "))
+	w.Header().Set("X-Total-Count", fmt.Sprintf("%v", total))
 }
 
 func paginate(w http.ResponseWriter, r *http.Request, query *gorm.DB) (offset int, limit int, err error) {
@@ -55,6 +67,10 @@ func paginate(w http.ResponseWriter, r *http.Request, query *gorm.DB) (offset in
 			return
 		}
 	}
+	if page < 1 || perPage < 1 {
+		err = errors.New("page and per_page start at 1")
+		return
+	}
 
 	var total uint64
 	if result := query.Count(&total); result.Error != nil {
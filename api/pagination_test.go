@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaginationHeaders(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/orders?per_page=10&page=2", nil)
+
+	recorder := httptest.NewRecorder()
+	addPaginationHeaders(recorder, req, 2, 10, 35)
+	assert.Equal(t, "35", recorder.Header().Get("X-Total-Count"))
+	assert.Equal(t, `</orders?page=1&per_page=10>; rel="first", `+
+		`</orders?page=1&per_page=10>; rel="prev", `+
+		`</orders?page=3&per_page=10>; rel="next", `+
+		`</orders?page=4&per_page=10>; rel="last"`, recorder.Header().Get("Link"))
+
+	recorder = httptest.NewRecorder()
+	addPaginationHeaders(recorder, req, 1, 10, 0)
+	assert.Equal(t, "0", recorder.Header().Get("X-Total-Count"))
+	assert.Equal(t, `</orders?page=1&per_page=10>; rel="last"`, recorder.Header().Get("Link"))
+}
+
+func TestPaymentListPagination(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "https://not-real/payments?per_page=1", nil)
+	NewAPI(config, db, nil, nil, nil).PaymentList(ctx, recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("X-Total-Count"))
+	assert.Contains(t, recorder.Header().Get("Link"), `rel="next"`)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "https://not-real/payments?per_page=0", nil)
+	NewAPI(config, db, nil, nil, nil).PaymentList(ctx, recorder, req)
+	assert.Equal(t, 400, recorder.Code)
+}
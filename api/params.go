@@ -65,6 +65,14 @@ func sortField(value string) string {
 }
 
 func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
+	query = addFilters(query, models.Order{}.TableName(), params, []string{
+		"state",
+		"payment_state",
+		"fulfillment_state",
+		"email",
+		"location_evidence",
+	})
+
 	if tax := params.Get("tax"); tax != "" {
 		if tax == "yes" || tax == "true" {
 			query = query.Where("taxes > 0")
@@ -110,7 +118,6 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 			query = query.Order(field + " " + dir)
 		}
 	} else {
-		fmt.Println("Sorting by created_at desc")
 		query = query.Order("created_at desc")
 	}
 
@@ -150,6 +157,22 @@ func getTimeQueryParams(params url.Values) (from *time.Time, to *time.Time, err
 	return
 }
 
+// reportIntervals are the periods reports can be grouped by
+var reportIntervals = []string{"day", "week", "month", "quarter", "year"}
+
+func getIntervalQueryParam(params url.Values) (string, error) {
+	value := params.Get("interval")
+	if value == "" {
+		return "month", nil
+	}
+	for _, interval := range reportIntervals {
+		if interval == value {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("bad value for 'interval' parameter '%v', must be one of: %v", value, strings.Join(reportIntervals, ", "))
+}
+
 func parseTimeQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	from, to, err := getTimeQueryParams(params)
 	if err != nil {
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/models"
+)
+
+// recordPaymentAttempt checks the payment limits for a charge of amount on
+// the order, and records the attempt when it's allowed. Every attempt counts,
+// the ones that fail as much as the others.
+func (a *API) recordPaymentAttempt(ctx context.Context, tx *gorm.DB, order *models.Order, amount uint64) (*models.PaymentAttempt, *HTTPError) {
+	limits := getConfig(ctx).Payment.Limits
+	since := time.Now().Add(-limits.Window)
+
+	ip := ""
+	if clientIP := getClientIP(ctx); clientIP != nil {
+		ip = clientIP.String()
+	}
+
+	// Small failures are counted per user and IP address, so card testing
+	// from one client doesn't block the small charges of everyone else. The
+	// order is locked already, users and IP addresses are locked before
+	// they're counted, so attempts on other orders wait for this one.
+	small := limits.MaxSmallFailures > 0 && amount <= limits.SmallAmount
+	checks := []struct {
+		column string
+		value  string
+		limit  int
+		lock   bool
+	}{
+		{"order_id", order.ID, limits.PerOrder, false},
+		{"user_id", order.UserID, limits.PerUser, true},
+		{"ip", ip, limits.PerIP, true},
+	}
+	for _, check := range checks {
+		countSmall := small && check.lock
+		if check.value == "" || (check.limit == 0 && !countSmall) {
+			continue
+		}
+		if check.lock {
+			if err := models.LockPaymentAttempts(tx, check.column, check.value); err != nil {
+				return nil, httpError(http.StatusInternalServerError, "Error checking the payment attempts: %v", err)
+			}
+		}
+		if check.limit > 0 {
+			count, err := models.CountPaymentAttempts(tx, check.column, check.value, since)
+			if err != nil {
+				return nil, httpError(http.StatusInternalServerError, "Error checking the payment attempts: %v", err)
+			}
+			if count >= check.limit {
+				getLogger(ctx).WithField(check.column, check.value).Warn("Too many payment attempts")
+				return nil, httpError(http.StatusTooManyRequests, "Too many payment attempts, try again later")
+			}
+		}
+		if countSmall {
+			count, err := models.CountSmallFailures(tx, check.column, check.value, limits.SmallAmount, since)
+			if err != nil {
+				return nil, httpError(http.StatusInternalServerError, "Error checking the payment attempts: %v", err)
+			}
+			if count >= limits.MaxSmallFailures {
+				getLogger(ctx).WithField(check.column, check.value).Errorf("Refused a small charge after %d small charges failed, this looks like card testing", count)
+				return nil, httpError(http.StatusTooManyRequests, "Too many payment attempts, try again later")
+			}
+		}
+	}
+
+	attempt := models.NewPaymentAttempt(order, ip, amount)
+	if rsp := tx.Create(attempt); rsp.Error != nil {
+		return nil, httpError(http.StatusInternalServerError, "Error recording the payment attempt: %v", rsp.Error)
+	}
+	return attempt, nil
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/netlify/gocommerce/models"
+)
+
+// MaxPaymentStatusWait is the longest a payment status request will be held open
+const MaxPaymentStatusWait = 60 * time.Second
+
+// PaymentStatusPollInterval controls how often a waiting request checks the order again
+const PaymentStatusPollInterval = 1 * time.Second
+
+// PaymentStatus is the payment state of an order as reported to the storefront
+type PaymentStatus struct {
+	OrderID      string              `json:"order_id"`
+	PaymentState string              `json:"payment_state"`
+	Final        bool                `json:"final"`
+	Transaction  *models.Transaction `json:"transaction,omitempty"`
+}
+
+// OrderPaymentStatus returns the payment state of an order. With `?wait=30s` the
+// request is held open until the payment reaches a final state (paid or failed)
+// or the wait time elapses, so thank-you pages behind redirect based payment
+// flows don't need to poll.
+// Anonymous orders can be checked without a token, anything else requires the
+// owner or an admin.
+func (a *API) OrderPaymentStatus(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := kami.Param(ctx, "order_id")
+	log := getLogger(ctx).WithField("order_id", id)
+
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			badRequestError(w, "Bad value for 'wait' parameter: %v", value)
+			return
+		}
+		if d > MaxPaymentStatusWait {
+			d = MaxPaymentStatusWait
+		}
+		wait = d
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		order := &models.Order{}
+		if result := a.dbFor(ctx).First(order, "id = ?", id); result.Error != nil {
+			if result.RecordNotFound() {
+				log.Debug("Requested record that doesn't exist")
+				notFoundError(w, "Order not found")
+			} else {
+				log.WithError(result.Error).Warnf("Error while querying database: %s", result.Error.Error())
+				internalServerError(w, "Error during database query: %v", result.Error)
+			}
+			return
+		}
+
+		status, err := a.paymentStatus(ctx, order)
+		if err != nil {
+			log.WithError(err).Warn("Error while querying for transactions")
+			internalServerError(w, "Error during database query: %v", err)
+			return
+		}
+
+		if status.Final || !time.Now().Before(deadline) {
+			sendJSON(w, 200, status)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			log.Debug("Client went away while waiting for payment status")
+			return
+		case <-time.After(PaymentStatusPollInterval):
+		}
+	}
+}
+
+func (a *API) paymentStatus(ctx context.Context, order *models.Order) (*PaymentStatus, error) {
+	status := &PaymentStatus{
+		OrderID:      order.ID,
+		PaymentState: order.PaymentState,
+		Final:        order.PaymentState == models.PaidState,
+	}
+
+	trans := &models.Transaction{}
+	rsp := a.dbFor(ctx).
+		Where("order_id = ? AND type = ?", order.ID, models.ChargeTransactionType).
+		Order("created_at desc").
+		First(trans)
+	if rsp.RecordNotFound() {
+		return status, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	status.Transaction = trans
+	if !status.Final && trans.Status == models.FailedState {
+		status.PaymentState = models.FailedState
+		status.Final = true
+	}
+
+	return status, nil
+}
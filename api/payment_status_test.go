@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestPaymentStatusPending(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken(testUser.ID, ""), config, false)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something", nil)
+
+	NewAPI(config, db, nil, nil, nil).OrderPaymentStatus(ctx, w, r)
+
+	status := &PaymentStatus{}
+	extractPayload(t, 200, w, status)
+	assert.Equal(t, firstOrder.ID, status.OrderID)
+	assert.Equal(t, models.PendingState, status.PaymentState)
+	assert.False(t, status.Final)
+}
+
+func TestPaymentStatusWaitsForPayment(t *testing.T) {
+	db, config := db(t)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		db.Model(firstOrder).Update("payment_state", models.PaidState)
+	}()
+
+	ctx := testContext(testToken(testUser.ID, ""), config, false)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something?wait=5s", nil)
+
+	NewAPI(config, db, nil, nil, nil).OrderPaymentStatus(ctx, w, r)
+
+	status := &PaymentStatus{}
+	extractPayload(t, 200, w, status)
+	assert.Equal(t, models.PaidState, status.PaymentState)
+	assert.True(t, status.Final)
+}
+
+func TestPaymentStatusAsStranger(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken("stranger-danger", ""), config, false)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something", nil)
+
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /orders/:order_id/payment_status", api.OrderPaymentStatus)(ctx, w, r)
+	validateError(t, 401, w)
+}
+
+func TestPaymentStatusBadWait(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(nil, config, false)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something?wait=forever", nil)
+
+	NewAPI(config, db, nil, nil, nil).OrderPaymentStatus(ctx, w, r)
+	validateError(t, 400, w)
+}
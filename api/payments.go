@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/guregu/kami"
@@ -14,8 +17,13 @@ import (
 	"github.com/stripe/stripe-go"
 	"github.com/stripe/stripe-go/charge"
 	"github.com/stripe/stripe-go/refund"
+	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/events"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/tracing"
+	"github.com/netlify/gocommerce/webhooks"
 )
 
 // MaxConcurrentLookups controls the number of simultaneous HTTP Order lookups
@@ -28,29 +36,36 @@ type PaymentParams struct {
 	StripeToken  string `json:"stripe_token"`
 	PaypalID     string `json:"paypal_payment_id"`
 	PaypalUserID string `json:"paypal_user_id"`
+	Reason       string `json:"reason"`
 }
 
+// paymentProvider charges the customer for a charge transaction, its ID
+// keeps the provider from charging twice for it
 type paymentProvider interface {
-	charge(amount uint64, currency, token, userToken string) (string, error)
-	refund(amount uint64, id string) (string, error)
+	charge(ctx context.Context, transactionID string, amount uint64, currency, token, userToken string) (string, error)
+	refund(ctx context.Context, amount uint64, id string) (string, error)
+}
+
+// chargeFinder is a payment provider that can find the charge it made for a
+// transaction, to settle the charges left processing. It returns an empty ID
+// when the customer wasn't charged.
+type chargeFinder interface {
+	findCharge(ctx context.Context, tr *models.Transaction) (string, error)
 }
 
 // PaymentListForUser is the endpoint for listing transactions for a user.
 // The ID in the claim and the ID in the path must match (or have admin override)
 func (a *API) PaymentListForUser(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	log, claims, userID, httpErr := initEndpoint(ctx, w, "user_id", true)
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
+	log, userID := initEndpoint(ctx, "user_id")
 
-	if userID != claims.ID && !isAdmin(ctx) {
-		log.Warn("Illegal access attempt")
-		unauthorizedError(w, "Can't access payments for this user")
+	query := a.dbFor(ctx).Where("user_id = ?", userID)
+	offset, limit, err := paginate(w, r, query.Model(&models.Transaction{}))
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
 		return
 	}
 
-	trans, httpErr := queryForTransactions(a.db, log, "user_id = ?", userID)
+	trans, httpErr := queryForTransactions(query.Offset(offset).Limit(limit), log, "", "")
 	if httpErr != nil {
 		sendJSON(w, httpErr.Code, httpErr)
 		return
@@ -61,36 +76,29 @@ func (a *API) PaymentListForUser(ctx context.Context, w http.ResponseWriter, r *
 // PaymentListForOrder is the endpoint for listing transactions for an order. You must be the owner
 // of the order (user_id) or an admin. Listing the payments for an anon order.
 func (a *API) PaymentListForOrder(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	log, claims, orderID, httpErr := initEndpoint(ctx, w, "order_id", true)
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
+	log, orderID := initEndpoint(ctx, "order_id")
 
-	order, httpErr := queryForOrder(a.db, orderID, log)
+	order, httpErr := queryForOrder(a.dbFor(ctx), orderID, log)
 	if httpErr != nil {
 		sendJSON(w, httpErr.Code, httpErr)
 		return
 	}
 
-	isAdmin := isAdmin(ctx)
-
-	// now we need to check if you're allowed to look at this order
-	if order.UserID == "" && !isAdmin {
-		// anon order ~ only accessible by an admin
-		log.Warn("Queried for an anonymous order but not as admin")
-		sendJSON(w, 401, unauthorizedError(w, "Anonymous orders must be accessed by admins"))
+	query := a.dbFor(ctx).Where("order_id = ?", order.ID)
+	offset, limit, err := paginate(w, r, query.Model(&models.Transaction{}))
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
 		return
 	}
 
-	if order.UserID != claims.ID && !isAdmin {
-		log.Warnf("Attempt to access order as %s, but order.UserID is %s", claims.ID, order.UserID)
-		sendJSON(w, 401, unauthorizedError(w, "Anonymous orders must be accessed by admins"))
+	trans, httpErr := queryForTransactions(query.Offset(offset).Limit(limit), log, "", "")
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
 		return
 	}
 
-	log.Debugf("Returning %d transactions", len(order.Transactions))
-	sendJSON(w, 200, order.Transactions)
+	log.Debugf("Returning %d transactions", len(trans))
+	sendJSON(w, 200, trans)
 }
 
 // PaymentCreate is the endpoint for creating a payment for an order
@@ -99,7 +107,7 @@ func (a *API) PaymentCreate(ctx context.Context, w http.ResponseWriter, r *http.
 	jsonDecoder := json.NewDecoder(r.Body)
 	err := jsonDecoder.Decode(params)
 	if err != nil {
-		badRequestError(w, fmt.Sprintf("Could not read params: %v", err))
+		readError(w, "params", err)
 		return
 	}
 
@@ -109,10 +117,23 @@ func (a *API) PaymentCreate(ctx context.Context, w http.ResponseWriter, r *http.
 	}
 
 	orderID := kami.Param(ctx, "order_id")
-	tx := a.db.Begin()
+	log := getLogger(ctx).WithField("order_id", orderID)
 	order := &models.Order{}
 
-	if result := tx.Preload("LineItems").Preload("BillingAddress").First(order, "id = ?", orderID); result.Error != nil {
+	score, err := a.scorePayment(ctx, orderID)
+	if err != nil {
+		internalServerError(w, "Error during database query: %v", err)
+		return
+	}
+
+	// the order is locked while the payment is checked, so concurrent
+	// payments for it can't both get to charge the customer
+	tx := a.dbFor(ctx).Begin()
+	result := models.LockOrder(tx, orderID)
+	if result.Error == nil {
+		result = tx.Preload("LineItems").Preload("BillingAddress").Preload("ShippingAddress").First(order, "id = ?", orderID)
+	}
+	if result.Error != nil {
 		tx.Rollback()
 		if result.RecordNotFound() {
 			notFoundError(w, "No order with this ID found")
@@ -127,6 +148,34 @@ func (a *API) PaymentCreate(ctx context.Context, w http.ResponseWriter, r *http.
 		badRequestError(w, "This order has already been paid")
 		return
 	}
+	if order.State == models.CancelledState {
+		tx.Rollback()
+		cleanup(nil, w, httpError(http.StatusConflict, "This order was cancelled"))
+		return
+	}
+	if order.PaymentState == models.ManualReviewState {
+		tx.Rollback()
+		cleanup(nil, w, httpError(http.StatusConflict, "This order is waiting for a review"))
+		return
+	}
+	if order.Review == models.RejectedReview {
+		tx.Rollback()
+		badRequestError(w, "This order was refused after a review")
+		return
+	}
+
+	processing := &models.Transaction{}
+	rsp := tx.First(processing, "order_id = ? AND type = ? AND status = ?", order.ID, models.ChargeTransactionType, models.ProcessingState)
+	if rsp.Error == nil {
+		tx.Rollback()
+		cleanup(nil, w, httpError(http.StatusConflict, "A payment for this order is already being processed"))
+		return
+	}
+	if !rsp.RecordNotFound() {
+		tx.Rollback()
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
 
 	if order.Currency != params.Currency {
 		tx.Rollback()
@@ -134,25 +183,10 @@ func (a *API) PaymentCreate(ctx context.Context, w http.ResponseWriter, r *http.
 		return
 	}
 
-	token := getToken(ctx)
-	if order.UserID == "" {
-		if token != nil {
-			claims := token.Claims.(*JWTClaims)
-			order.UserID = claims.ID
-			tx.Save(order)
-		}
-	} else {
-		if token == nil {
-			tx.Rollback()
-			unauthorizedError(w, "You must be logged in to pay for this order")
-			return
-		}
-		claims := token.Claims.(*JWTClaims)
-		if order.UserID != claims.ID {
-			tx.Rollback()
-			unauthorizedError(w, "You must be logged in to pay for this order")
-			return
-		}
+	// whoever pays for an anonymous order claims it, the route policy keeps
+	// the other orders to their owner
+	if claims := getClaims(ctx); order.UserID == "" && claims != nil {
+		order.UserID = claims.ID
 	}
 
 	err = a.verifyAmount(ctx, order, params.Amount)
@@ -161,6 +195,19 @@ func (a *API) PaymentCreate(ctx context.Context, w http.ResponseWriter, r *http.
 		internalServerError(w, fmt.Sprintf("We failed to authorize the amount for this order: %v", err))
 		return
 	}
+	attempt, httpErr := a.recordPaymentAttempt(ctx, tx, order, params.Amount)
+	if httpErr != nil {
+		cleanup(tx, w, httpErr)
+		return
+	}
+	if score != nil && order.Review != models.ApprovedReview && score.Score >= getConfig(ctx).Fraud.Threshold {
+		a.holdForReview(ctx, tx, w, order, score)
+		return
+	}
+	if httpErr := redeemCoupon(tx, order); httpErr != nil {
+		cleanup(tx, w, httpErr)
+		return
+	}
 	tr := models.NewTransaction(order)
 
 	chType := StripeChargerType
@@ -177,62 +224,207 @@ func (a *API) PaymentCreate(ctx context.Context, w http.ResponseWriter, r *http.
 		order.PaymentProcessor = "paypal"
 	}
 
-	processorID, err := getCharger(ctx, chType).charge(params.Amount, params.Currency, paymentToken, paymentUser)
+	// the charge is recorded before the customer is charged, so a crash
+	// while charging leaves a processing charge behind instead of nothing.
+	// A PayPal charge is found by its payment.
+	tr.Status = models.ProcessingState
+	if chType == PaypalChargerType {
+		tr.ProcessorID = paymentToken
+	}
+	if rsp := tx.Create(tr); rsp.Error != nil {
+		tx.Rollback()
+		internalServerError(w, "Error recording the payment: %v", rsp.Error)
+		return
+	}
+	if rsp := tx.Model(order).UpdateColumns(map[string]interface{}{
+		"user_id":           order.UserID,
+		"payment_processor": order.PaymentProcessor,
+	}); rsp.Error != nil {
+		tx.Rollback()
+		internalServerError(w, "Error recording the payment: %v", rsp.Error)
+		return
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		internalServerError(w, "Error recording the payment: %v", rsp.Error)
+		return
+	}
+
+	_, span := tracing.StartSpan(ctx, "payment.charge",
+		attribute.String("payment.processor", string(chType)),
+		attribute.String("order.id", order.ID),
+	)
+	charger := getCharger(ctx, chType)
+	processorID, err := charger.charge(ctx, tr.ID, params.Amount, params.Currency, paymentToken, paymentUser)
+	tracing.EndSpan(span, err)
 	tr.ProcessorID = processorID
+	// the card country is only evidence, looking it up is another call to the
+	// provider that other sales can do without
+	_, needsEvidence := evidenceMemberState(getConfig(ctx), order)
+	if lookup, ok := charger.(cardCountryProvider); ok && err == nil && needsEvidence {
+		country, lookupErr := lookup.cardCountry(ctx, processorID)
+		if lookupErr != nil {
+			log.WithError(lookupErr).Warn("Failed to look up the country of the card")
+		}
+		order.CardCountry = country
+	}
 
 	if err != nil {
 		tr.FailureCode = "500"
 		tr.FailureDescription = err.Error()
-		tr.Status = "failed"
+		tr.Status = models.FailedState
 	} else {
-		tr.Status = "pending"
+		tr.Status = models.PendingState
 	}
-	tx.Create(tr)
+
+	log = log.WithFields(logrus.Fields{
+		"transaction_id": tr.ID,
+		"processor_id":   processorID,
+	})
+	tx = a.dbFor(ctx).Begin()
+	if rsp := models.LockOrder(tx, order.ID); rsp.Error != nil {
+		tx.Rollback()
+		log.WithError(rsp.Error).Error("Failed to lock the order to record a charge")
+		internalServerError(w, "Error recording the payment: %v", rsp.Error)
+		return
+	}
+	// staff may have cancelled the order while the card was charged, the
+	// charge is given back then
+	cancelled := false
+	if err == nil {
+		current := &models.Order{}
+		if rsp := tx.Select("state").First(current, "id = ?", order.ID); rsp.Error != nil {
+			tx.Rollback()
+			log.WithError(rsp.Error).Error("Failed to load the order to record a charge")
+			internalServerError(w, "Error recording the payment: %v", rsp.Error)
+			return
+		}
+		if current.State == models.CancelledState {
+			cancelled = true
+			err = fmt.Errorf("the order was cancelled while it was being paid")
+			if _, refundErr := charger.refund(ctx, params.Amount, processorID); refundErr != nil {
+				log.WithError(refundErr).Error("Charged a cancelled order and failed to refund the charge")
+			} else {
+				tr.FailureCode = "409"
+				tr.FailureDescription = err.Error()
+				tr.Status = models.FailedState
+			}
+		}
+	}
+	rsp = tx.Model(tr).UpdateColumns(map[string]interface{}{
+		"processor_id":        tr.ProcessorID,
+		"status":              tr.Status,
+		"failure_code":        tr.FailureCode,
+		"failure_description": tr.FailureDescription,
+	})
 
 	if err != nil {
-		tx.Commit()
+		if rsp.Error == nil {
+			rsp = tx.Model(attempt).UpdateColumn("failed", true)
+		}
+		if rsp.Error == nil {
+			// the coupon can be used again, for this order or another one
+			rsp = tx.Where("order_id = ?", order.ID).Delete(&models.CouponRedemption{})
+		}
+		if rsp.Error == nil {
+			rsp = tx.Commit()
+		}
+		if rsp.Error != nil {
+			tx.Rollback()
+			log.WithError(rsp.Error).Error("Failed to record a failed charge")
+		}
+		if cancelled {
+			cleanup(nil, w, httpError(http.StatusConflict, "This order was cancelled while it was being paid"))
+			return
+		}
 		internalServerError(w, fmt.Sprintf("There was an error charging your card: %v", err))
 		return
 	}
 
-	order.PaymentState = models.PaidState
-	tx.Save(order)
-
-	if a.config.Webhooks.Payment != "" {
-		hook := models.NewHook("payment", a.config.Webhooks.Payment, order.UserID, order)
-		tx.Save(hook)
+	if rsp.Error != nil {
+		tx.Rollback()
+		log.WithError(rsp.Error).Error("Charged the customer but failed to record the payment")
+		internalServerError(w, "Error recording the payment: %v", rsp.Error)
+		return
+	}
+	if err := a.recordPayment(ctx, tx, order, tr); err != nil {
+		// the customer was charged but the charge stays processing, until
+		// the settle_charges task finds it with the payment provider
+		log.WithError(err).Error("Charged the customer but failed to record the payment")
+		internalServerError(w, "Error recording the payment: %v", err)
+		return
 	}
 
-	tx.Commit()
-
-	go func() {
-		err1 := a.mailer.OrderConfirmationMail(tr)
-		err2 := a.mailer.OrderReceivedMail(tr)
+	sendJSON(w, 200, tr)
+}
 
-		if err1 != nil || err2 != nil {
-			a.log.Errorf("Error sending order confirmation mails: %v %v", err1, err2)
-		}
-	}()
+// recordPayment marks the order paid with the charge, assigns its invoice
+// number, credits its referrer and publishes the payment, committing tx. The
+// charge has to be recorded in tx already.
+func (a *API) recordPayment(ctx context.Context, tx *gorm.DB, order *models.Order, tr *models.Transaction) error {
+	config := getConfig(ctx)
+	order.PaymentState = models.PaidState
+	order.LocationEvidence = locationEvidence(config, order)
+	if order.LocationEvidence == models.LocationConflicting {
+		getLogger(ctx).WithFields(logrus.Fields{
+			"billing_country": order.BillingAddress.Country,
+			"ip_country":      order.IPCountry,
+			"card_country":    order.CardCountry,
+		}).Warn("The location evidence of the order doesn't support its tax country")
+	}
+	err := assignInvoiceNumber(config, tx, order)
+	if err == nil {
+		err = tx.Model(order).Updates(map[string]interface{}{
+			"payment_state":     order.PaymentState,
+			"invoice_number":    order.InvoiceNumber,
+			"card_country":      order.CardCountry,
+			"location_evidence": order.LocationEvidence,
+		}).Error
+	}
+	var credit *models.ReferralCredit
+	if err == nil {
+		credit, err = creditReferrer(config, tx, order)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
-	sendJSON(w, 200, tr)
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.PaymentEvent, UserID: order.UserID, InstanceID: order.InstanceID, Payload: order, Transaction: tr})
+	if order.CouponCode != "" {
+		a.publish(ctx, batch, &events.Event{Type: webhooks.CouponRedemptionEvent, UserID: order.UserID, InstanceID: order.InstanceID, Payload: &CouponRedemption{
+			Code:     order.CouponCode,
+			OrderID:  order.ID,
+			UserID:   order.UserID,
+			Email:    order.Email,
+			Discount: order.Discount,
+			Currency: order.Currency,
+		}})
+	}
+	if credit != nil {
+		a.publish(ctx, batch, &events.Event{Type: webhooks.ReferralCreditEvent, UserID: credit.UserID, InstanceID: order.InstanceID, OrderID: order.ID, Payload: credit})
+	}
+	return batch.Commit().Error
 }
 
 // PaymentList will list all the payments that meet the criteria. It is only available to admins
 func (a *API) PaymentList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	log, _, httpErr := requireAdmin(ctx, "")
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
+	log := getLogger(ctx)
 
-	query, err := parsePaymentQueryParams(a.db, r.URL.Query())
+	query, err := parsePaymentQueryParams(a.dbFor(ctx), r.URL.Query())
 	if err != nil {
 		log.WithError(err).Info("Malformed request")
 		badRequestError(w, err.Error())
 		return
 	}
 
-	trans, httpErr := queryForTransactions(query, log, "", "")
+	offset, limit, err := paginate(w, r, query.Model(&models.Transaction{}))
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	trans, httpErr := queryForTransactions(query.Offset(offset).Limit(limit), log, "", "")
 	if httpErr != nil {
 		sendJSON(w, httpErr.Code, httpErr)
 		return
@@ -253,7 +445,7 @@ func (a *API) PaymentRefund(ctx context.Context, w http.ResponseWriter, r *http.
 	jsonDecoder := json.NewDecoder(r.Body)
 	err := jsonDecoder.Decode(params)
 	if err != nil {
-		badRequestError(w, "Could not read params: %v", err)
+		readError(w, "params", err)
 		return
 	}
 
@@ -263,43 +455,77 @@ func (a *API) PaymentRefund(ctx context.Context, w http.ResponseWriter, r *http.
 		return
 	}
 
-	if trans.Currency != params.Currency {
-		badRequestError(w, "Currencies doesn't match - %v vs %v", trans.Currency, params.Currency)
+	if httpErr := validateRefund(getConfig(ctx), trans, params); httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
 		return
 	}
 
-	if params.Amount <= 0 || params.Amount > trans.Amount {
-		badRequestError(w, "The balance of the refund must be between 0 and the total amount")
-		return
+	// ok make the refund
+	m := newRefund(trans, params)
+
+	batch := a.events.Begin(a.dbFor(ctx).Begin())
+	a.issueRefund(ctx, batch, trans, m)
+	a.audit(ctx, batch.Tx(), r, "payment.refund", "transaction", m.ID, nil, models.Snapshot(m))
+	batch.Commit()
+	sendJSON(w, http.StatusOK, m)
+}
+
+// ------------------------------------------------------------------------------------------------
+// Helpers
+// ------------------------------------------------------------------------------------------------
+// validateRefund checks that a refund can be made for the charge
+func validateRefund(config *conf.Configuration, charge *models.Transaction, params *PaymentParams) *HTTPError {
+	if charge.Currency != params.Currency {
+		return httpError(400, "Currencies doesn't match - %v vs %v", charge.Currency, params.Currency)
 	}
 
-	if trans.FailureCode != "" {
-		badRequestError(w, "Can't refund a failed transaction")
-		return
+	if params.Amount <= 0 || params.Amount > charge.Amount {
+		return httpError(400, "The balance of the refund must be between 0 and the total amount")
 	}
 
-	if trans.Status != models.PaidState {
-		badRequestError(w, "Can't refund a transaction that hasn't been paid")
-		return
+	if charge.FailureCode != "" {
+		return httpError(400, "Can't refund a failed transaction")
 	}
 
-	// ok make the refund
-	m := &models.Transaction{
+	if charge.Status != models.PaidState {
+		return httpError(400, "Can't refund a transaction that hasn't been paid")
+	}
+
+	reasons := cancellationReasons(config)
+	if !inList(reasons, params.Reason) {
+		return httpError(400, "A refund requires a reason, must be one of: %v", strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// newRefund creates the pending refund transaction for a charge
+func newRefund(charge *models.Transaction, params *PaymentParams) *models.Transaction {
+	return &models.Transaction{
 		ID:       uuid.NewRandom().String(),
 		Amount:   params.Amount,
 		Currency: params.Currency,
-		UserID:   trans.UserID,
-		OrderID:  trans.OrderID,
+		UserID:   charge.UserID,
+		OrderID:  charge.OrderID,
 		Type:     models.RefundTransactionType,
 		Status:   models.PendingState,
+		Reason:   params.Reason,
 	}
+}
 
-	tx := a.db.Begin()
+// issueRefund refunds m.Amount of a charge through stripe, recording the
+// outcome on the refund transaction m
+func (a *API) issueRefund(ctx context.Context, batch *events.Batch, charge, m *models.Transaction) {
+	tx := batch.Tx()
 	tx.Create(m)
 	log := getLogger(ctx)
 	log.Debug("Starting refund to stripe")
 	// TODO ~ refund via paypal
-	stripeID, err := getCharger(ctx, StripeChargerType).refund(params.Amount, trans.ProcessorID)
+	_, span := tracing.StartSpan(ctx, "payment.refund",
+		attribute.String("payment.processor", string(StripeChargerType)),
+		attribute.String("order.id", charge.OrderID),
+	)
+	stripeID, err := getCharger(ctx, StripeChargerType).refund(ctx, m.Amount, charge.ProcessorID)
+	tracing.EndSpan(span, err)
 	if err != nil {
 		log.WithError(err).Info("Failed to refund value")
 		m.FailureCode = "500"
@@ -312,25 +538,19 @@ func (a *API) PaymentRefund(ctx context.Context, w http.ResponseWriter, r *http.
 
 	log.Infof("Finished transaction with stripe: %s", m.ProcessorID)
 	tx.Save(m)
-	if a.config.Webhooks.Refund != "" {
-		hook := models.NewHook("refund", a.config.Webhooks.Refund, m.UserID, m)
-		tx.Save(hook)
+	if m.Status == models.PaidState {
+		if err := reverseReferralCredit(tx, charge.OrderID); err != nil {
+			log.WithError(err).Warn("Failed to reverse the referral credit of the refunded order")
+		}
 	}
-	tx.Commit()
-	sendJSON(w, http.StatusOK, m)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.RefundEvent, UserID: m.UserID, Payload: m, Transaction: m})
 }
 
-// ------------------------------------------------------------------------------------------------
-// Helpers
-// ------------------------------------------------------------------------------------------------
 func (a *API) getTransaction(ctx context.Context) (*models.Transaction, *HTTPError) {
-	log, payID, httpErr := requireAdmin(ctx, "pay_id")
-	if httpErr != nil {
-		return nil, httpErr
-	}
+	log, payID := initEndpoint(ctx, "pay_id")
 
 	trans := &models.Transaction{ID: payID}
-	if rsp := a.db.First(trans); rsp.Error != nil {
+	if rsp := a.dbFor(ctx).First(trans); rsp.Error != nil {
 		if rsp.RecordNotFound() {
 			log.Infof("Failed to find transaction %s", payID)
 			return nil, httpError(404, "Transaction not found")
@@ -343,22 +563,6 @@ func (a *API) getTransaction(ctx context.Context) (*models.Transaction, *HTTPErr
 	return trans, nil
 }
 
-func requireAdmin(ctx context.Context, paramKey string) (*logrus.Entry, string, *HTTPError) {
-	log := getLogger(ctx)
-	paramValue := ""
-	if paramKey != "" {
-		paramValue = kami.Param(ctx, paramKey)
-		log = log.WithField(paramKey, paramValue)
-	}
-
-	if !isAdmin(ctx) {
-		log.Warn("Illegal access attempt")
-		return nil, paramValue, httpError(401, "Can only access payments as admin")
-	}
-
-	return log, paramValue, nil
-}
-
 func (a *API) verifyAmount(ctx context.Context, order *models.Order, amount uint64) error {
 	if order.Total != amount {
 		return fmt.Errorf("Amount calculated for order didn't match amount to charge. %v vs %v", order.Total, amount)
@@ -367,21 +571,11 @@ func (a *API) verifyAmount(ctx context.Context, order *models.Order, amount uint
 	return nil
 }
 
-func initEndpoint(ctx context.Context, w http.ResponseWriter, paramKey string, authRequired bool) (*logrus.Entry, *JWTClaims, string, *HTTPError) {
-	log := getLogger(ctx)
-	paramValue := ""
-	if paramKey != "" {
-		paramValue = kami.Param(ctx, paramKey)
-		log = log.WithField(paramKey, paramValue)
-	}
-
-	claims := getClaims(ctx)
-	if claims == nil && authRequired {
-		log.Warn("Claims is missing and auth required")
-		return log, nil, paramValue, unauthorizedError(w, "Listing payments requires authentication")
-	}
-
-	return log, claims, paramValue, nil
+// initEndpoint gets the param, and a logger with it. Who may call the
+// endpoint is up to the policy of its route.
+func initEndpoint(ctx context.Context, paramKey string) (*logrus.Entry, string) {
+	paramValue := kami.Param(ctx, paramKey)
+	return getLogger(ctx).WithField(paramKey, paramValue), paramValue
 }
 
 func queryForOrder(db *gorm.DB, orderID string, log *logrus.Entry) (*models.Order, *HTTPError) {
@@ -413,15 +607,28 @@ func queryForTransactions(db *gorm.DB, log *logrus.Entry, clause, id string) ([]
 	return trans, nil
 }
 
+// stripeProvider charges with the key of the deployment, or with its own key
+// when a store has one
 type stripeProvider struct {
+	key string
 }
 
-func (stripeProvider) charge(amount uint64, currency, token, userToken string) (string, error) {
-	ch, err := charge.New(&stripe.ChargeParams{
+func (s stripeProvider) charge(ctx context.Context, transactionID string, amount uint64, currency, token, userToken string) (string, error) {
+	params := &stripe.ChargeParams{
+		Params:   stripeParams(ctx),
 		Amount:   amount,
 		Source:   &stripe.SourceParams{Token: token},
 		Currency: stripe.Currency(currency),
-	})
+	}
+	params.IdempotencyKey = transactionID
+	params.AddMeta("transaction_id", transactionID)
+	var ch *stripe.Charge
+	var err error
+	if s.key != "" {
+		ch, err = charge.Client{B: stripe.GetBackend(stripe.APIBackend), Key: s.key}.New(params)
+	} else {
+		ch, err = charge.New(params)
+	}
 
 	if err != nil {
 		return "", err
@@ -430,11 +637,19 @@ func (stripeProvider) charge(amount uint64, currency, token, userToken string) (
 	return ch.ID, nil
 }
 
-func (stripeProvider) refund(amount uint64, id string) (string, error) {
-	r, err := refund.New(&stripe.RefundParams{
+func (s stripeProvider) refund(ctx context.Context, amount uint64, id string) (string, error) {
+	params := &stripe.RefundParams{
+		Params: stripeParams(ctx),
 		Charge: id,
 		Amount: amount,
-	})
+	}
+	var r *stripe.Refund
+	var err error
+	if s.key != "" {
+		r, err = refund.Client{B: stripe.GetBackend(stripe.APIBackend), Key: s.key}.New(params)
+	} else {
+		r, err = refund.New(params)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -442,11 +657,49 @@ func (stripeProvider) refund(amount uint64, id string) (string, error) {
 	return r.ID, err
 }
 
+// stripeChargeWindow is how long after its transaction a charge is looked
+// for, the charge is made within the payment timeout
+const stripeChargeWindow = time.Hour
+
+// findCharge looks for the charge tagged with the transaction, among the
+// ones made around the time of the transaction
+func (s stripeProvider) findCharge(ctx context.Context, tr *models.Transaction) (string, error) {
+	params := &stripe.ChargeListParams{}
+	params.Filters.AddFilter("created", "gte", strconv.FormatInt(tr.CreatedAt.Add(-time.Minute).Unix(), 10))
+	params.Filters.AddFilter("created", "lte", strconv.FormatInt(tr.CreatedAt.Add(stripeChargeWindow).Unix(), 10))
+	var charges *charge.Iter
+	if s.key != "" {
+		charges = charge.Client{B: stripe.GetBackend(stripe.APIBackend), Key: s.key}.List(params)
+	} else {
+		charges = charge.List(params)
+	}
+	for charges.Next() {
+		ch := charges.Charge()
+		if ch.Meta["transaction_id"] != tr.ID {
+			continue
+		}
+		if !ch.Paid {
+			return "", nil
+		}
+		return ch.ID, nil
+	}
+	return "", charges.Err()
+}
+
+// stripeParams tags stripe objects with the request that created them
+func stripeParams(ctx context.Context) stripe.Params {
+	params := stripe.Params{}
+	if id := getRequestID(ctx); id != "" {
+		params.Meta = map[string]string{"request_id": id}
+	}
+	return params
+}
+
 type paypalProvider struct {
 	paypal *paypalsdk.Client
 }
 
-func (p *paypalProvider) charge(amount uint64, currency, paymentID, payerID string) (string, error) {
+func (p *paypalProvider) charge(ctx context.Context, transactionID string, amount uint64, currency, paymentID, payerID string) (string, error) {
 	payment, err := p.paypal.GetPayment(paymentID)
 	if err != nil {
 		return "", err
@@ -473,6 +726,22 @@ func (p *paypalProvider) charge(amount uint64, currency, paymentID, payerID stri
 	return executeResult.ID, nil
 }
 
-func (paypalProvider) refund(amount uint64, id string) (string, error) {
+func (paypalProvider) refund(ctx context.Context, amount uint64, id string) (string, error) {
 	return "", nil
 }
+
+// findCharge looks up the payment of the transaction, it was charged once
+// it's approved
+func (p *paypalProvider) findCharge(ctx context.Context, tr *models.Transaction) (string, error) {
+	if tr.ProcessorID == "" {
+		return "", nil
+	}
+	payment, err := p.paypal.GetPayment(tr.ProcessorID)
+	if err != nil {
+		return "", err
+	}
+	if payment.State != "approved" {
+		return "", nil
+	}
+	return payment.ID, nil
+}
@@ -3,9 +3,11 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/guregu/kami"
 	"github.com/stretchr/testify/assert"
@@ -17,6 +19,7 @@ import (
 	"context"
 
 	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
 )
 
@@ -78,7 +81,8 @@ func TestPaymentsOrderQueryForAllAsAnon(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("GET", "http://something", nil)
-	NewAPI(config, db, nil, nil, nil).PaymentListForOrder(ctx, w, r)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /orders/:order_id/payments", api.PaymentListForOrder)(ctx, w, r)
 
 	// should get a 401 ~ claims are required
 	validateError(t, 401, w)
@@ -126,7 +130,8 @@ func TestPaymentsUserForAllAsAnon(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("GET", "http://something", nil)
-	NewAPI(config, db, nil, nil, nil).PaymentListForUser(ctx, w, r)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /users/:user_id/payments", api.PaymentListForUser)(ctx, w, r)
 
 	// should get a 401 ~ claims are required
 	validateError(t, 401, w)
@@ -140,7 +145,8 @@ func TestPaymentsUserForAllAsStranger(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("GET", "http://something", nil)
-	NewAPI(config, db, nil, nil, nil).PaymentListForUser(ctx, w, r)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /users/:user_id/payments", api.PaymentListForUser)(ctx, w, r)
 
 	// should get a 401 ~ not the right user
 	validateError(t, 401, w)
@@ -155,7 +161,8 @@ func TestPaymentsListAllAsNonAdmin(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("GET", "http://something", nil)
-	NewAPI(config, nil, nil, nil, nil).PaymentList(ctx, w, r)
+	api := NewAPI(config, nil, nil, nil, nil)
+	guarded(t, api, "GET /payments", api.PaymentList)(ctx, w, r)
 
 	// should get a 401 ~ not the right user
 	validateError(t, 401, w)
@@ -198,7 +205,8 @@ func TestPaymentsViewAsNonAdmin(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("GET", "http://something", nil)
-	NewAPI(config, nil, nil, nil, nil).PaymentView(ctx, w, r)
+	api := NewAPI(config, nil, nil, nil, nil)
+	guarded(t, api, "GET /payments/:pay_id", api.PaymentView)(ctx, w, r)
 
 	// should get a 401 ~ not the right user
 	validateError(t, 401, w)
@@ -331,6 +339,7 @@ func TestPaymentsRefundSuccess(t *testing.T) {
 		Amount:      1,
 		Currency:    firstTransaction.Currency,
 		StripeToken: "123",
+		Reason:      "customer_request",
 	}
 	body, _ := json.Marshal(params)
 	w := httptest.NewRecorder()
@@ -352,6 +361,187 @@ func TestPaymentsRefundSuccess(t *testing.T) {
 		assert.Empty(t, payment.FailureDescription)
 		assert.Equal(t, models.RefundTransactionType, payment.Type)
 		assert.Equal(t, models.PaidState, payment.Status)
+		assert.Equal(t, "customer_request", payment.Reason)
+	}
+}
+
+func TestPaymentsRefundMissingReason(t *testing.T) {
+	w, _ := runPaymentRefund(t, &PaymentParams{
+		Amount:      1,
+		Currency:    firstTransaction.Currency,
+		StripeToken: "123",
+	})
+
+	validateError(t, 400, w)
+}
+
+func runPaymentCreate(t *testing.T, db *gorm.DB, config *conf.Configuration, provider paymentProvider) *httptest.ResponseRecorder {
+	return runPaymentCreateFrom(t, db, config, provider, nil)
+}
+
+func runPaymentCreateFrom(t *testing.T, db *gorm.DB, config *conf.Configuration, provider paymentProvider, ip net.IP) *httptest.ResponseRecorder {
+	ctx := testContext(testToken(testUser.ID, testUser.Email), config, false)
+	ctx = withClientIP(ctx, ip)
+	ctx = kami.SetParam(ctx, "order_id", secondOrder.ID)
+	ctx = withPayer(ctx, StripeChargerType, provider)
+
+	body, _ := json.Marshal(&PaymentParams{
+		Amount:      secondOrder.Total,
+		Currency:    secondOrder.Currency,
+		StripeToken: "tok_visa",
+	})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://something", bytes.NewBuffer(body))
+	NewAPI(config, db, nil, nil, nil).PaymentCreate(ctx, w, r)
+	return w
+}
+
+func TestPaymentCreate(t *testing.T) {
+	db, config := db(t)
+	provider := &chargeProvider{id: "ch_123", check: func() {
+		charge := &models.Transaction{}
+		err := db.First(charge, "order_id = ? AND status = ?", secondOrder.ID, models.ProcessingState).Error
+		assert.NoError(t, err, "the charge is recorded before the customer is charged")
+	}}
+
+	w := runPaymentCreate(t, db, config, provider)
+	rsp := new(models.Transaction)
+	extractPayload(t, 200, w, rsp)
+	assert.Equal(t, 1, provider.calls)
+
+	stored := &models.Transaction{}
+	if assert.NoError(t, db.First(stored, "id = ?", rsp.ID).Error) {
+		assert.Equal(t, models.PendingState, stored.Status)
+		assert.Equal(t, "ch_123", stored.ProcessorID)
+		assert.Equal(t, secondOrder.Total, stored.Amount)
+	}
+	order := &models.Order{}
+	if assert.NoError(t, db.First(order, "id = ?", secondOrder.ID).Error) {
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, "stripe", order.PaymentProcessor)
+	}
+}
+
+func TestPaymentCreateFailedCharge(t *testing.T) {
+	db, config := db(t)
+	w := runPaymentCreate(t, db, config, &chargeProvider{err: errors.New("card declined")})
+	validateError(t, 500, w)
+
+	charge := &models.Transaction{}
+	if assert.NoError(t, db.First(charge, "order_id = ? AND id != ?", secondOrder.ID, secondTransaction.ID).Error) {
+		assert.Equal(t, models.FailedState, charge.Status)
+		assert.Equal(t, "card declined", charge.FailureDescription)
+	}
+	order := &models.Order{}
+	if assert.NoError(t, db.First(order, "id = ?", secondOrder.ID).Error) {
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	}
+}
+
+func TestPaymentCreateLimitsAttemptsPerOrder(t *testing.T) {
+	db, config := db(t)
+	config.Payment.Limits.Window = time.Hour
+	config.Payment.Limits.PerOrder = 2
+	provider := &chargeProvider{err: errors.New("card declined")}
+
+	validateError(t, 500, runPaymentCreate(t, db, config, provider))
+	validateError(t, 500, runPaymentCreate(t, db, config, provider))
+	validateError(t, 429, runPaymentCreate(t, db, config, provider))
+	assert.Equal(t, 2, provider.calls)
+
+	count := 0
+	db.Model(&models.PaymentAttempt{}).Where("order_id = ? AND failed = ?", secondOrder.ID, true).Count(&count)
+	assert.Equal(t, 2, count)
+}
+
+func TestPaymentCreateLimitsAttemptsPerIP(t *testing.T) {
+	db, config := db(t)
+	config.Payment.Limits.Window = time.Hour
+	config.Payment.Limits.PerIP = 1
+	old := &models.PaymentAttempt{ID: "old-attempt", OrderID: firstOrder.ID, IP: "203.0.113.9", CreatedAt: time.Now().Add(-2 * time.Hour)}
+	recent := &models.PaymentAttempt{ID: "recent-attempt", OrderID: firstOrder.ID, IP: "203.0.113.7"}
+	db.Create(old)
+	db.Create(recent)
+	db.Model(old).UpdateColumn("created_at", time.Now().Add(-2*time.Hour))
+
+	provider := &chargeProvider{id: "ch_123"}
+	validateError(t, 429, runPaymentCreateFrom(t, db, config, provider, net.ParseIP("203.0.113.7")))
+	assert.Equal(t, 0, provider.calls)
+
+	w := runPaymentCreateFrom(t, db, config, provider, net.ParseIP("203.0.113.9"))
+	assert.Equal(t, 200, w.Code, "attempts older than the window don't count")
+	assert.Equal(t, 1, provider.calls)
+}
+
+func TestPaymentCreateBlocksCardTesting(t *testing.T) {
+	db, config := db(t)
+	config.Payment.Limits.Window = time.Hour
+	config.Payment.Limits.SmallAmount = secondOrder.Total
+	config.Payment.Limits.MaxSmallFailures = 3
+	for i := 0; i < 3; i++ {
+		db.Create(&models.PaymentAttempt{ID: fmt.Sprintf("small-%d", i), OrderID: fmt.Sprintf("order-%d", i), IP: "203.0.113.7", Amount: 1, Failed: true})
+	}
+
+	provider := &chargeProvider{id: "ch_123"}
+	validateError(t, 429, runPaymentCreateFrom(t, db, config, provider, net.ParseIP("203.0.113.7")))
+	assert.Equal(t, 0, provider.calls)
+
+	config.Payment.Limits.SmallAmount = secondOrder.Total - 1
+	w := runPaymentCreateFrom(t, db, config, provider, net.ParseIP("203.0.113.7"))
+	assert.Equal(t, 200, w.Code, "larger charges go through")
+}
+
+func TestPaymentCreateCountsSmallFailuresPerClient(t *testing.T) {
+	db, config := db(t)
+	config.Payment.Limits.Window = time.Hour
+	config.Payment.Limits.SmallAmount = secondOrder.Total
+	config.Payment.Limits.MaxSmallFailures = 3
+	for i := 0; i < 3; i++ {
+		db.Create(&models.PaymentAttempt{ID: fmt.Sprintf("small-%d", i), OrderID: fmt.Sprintf("order-%d", i), IP: "203.0.113.7", Amount: 1, Failed: true})
+	}
+
+	provider := &chargeProvider{id: "ch_123"}
+	w := runPaymentCreateFrom(t, db, config, provider, net.ParseIP("203.0.113.9"))
+	assert.Equal(t, 200, w.Code, "the small failures of another client don't count")
+	assert.Equal(t, 1, provider.calls)
+}
+
+func TestPaymentCreateWhileProcessing(t *testing.T) {
+	db, config := db(t)
+	processing := models.NewTransaction(secondOrder)
+	processing.Status = models.ProcessingState
+	db.Create(processing)
+
+	provider := &chargeProvider{id: "ch_123"}
+	w := runPaymentCreate(t, db, config, provider)
+	validateError(t, http.StatusConflict, w)
+	assert.Equal(t, 0, provider.calls, "a charge in progress blocks charging again")
+}
+
+func TestPaymentCreateCancelledOrder(t *testing.T) {
+	db, config := db(t)
+	db.Model(&models.Order{}).Where("id = ?", secondOrder.ID).UpdateColumn("state", models.CancelledState)
+
+	provider := &chargeProvider{id: "ch_123"}
+	validateError(t, http.StatusConflict, runPaymentCreate(t, db, config, provider))
+	assert.Equal(t, 0, provider.calls)
+}
+
+func TestPaymentCreateCancelledWhileCharging(t *testing.T) {
+	db, config := db(t)
+	provider := &chargeProvider{id: "ch_123", check: func() {
+		db.Model(&models.Order{}).Where("id = ?", secondOrder.ID).UpdateColumn("state", models.CancelledState)
+	}}
+
+	validateError(t, http.StatusConflict, runPaymentCreate(t, db, config, provider))
+	assert.Equal(t, []string{"ch_123"}, provider.refunded)
+	charge := &models.Transaction{}
+	if assert.NoError(t, db.First(charge, "order_id = ? AND processor_id = ?", secondOrder.ID, "ch_123").Error) {
+		assert.Equal(t, models.FailedState, charge.Status)
+	}
+	order := &models.Order{}
+	if assert.NoError(t, db.First(order, "id = ?", secondOrder.ID).Error) {
+		assert.Equal(t, models.PendingState, order.PaymentState)
 	}
 }
 
@@ -397,11 +587,11 @@ type refundCall struct {
 	id     string
 }
 
-func (mp *memProvider) charge(amount uint64, currency, token, payerID string) (string, error) {
+func (mp *memProvider) charge(ctx context.Context, transactionID string, amount uint64, currency, token, payerID string) (string, error) {
 	return "", errors.New("Shouldn't have called this")
 }
 
-func (mp *memProvider) refund(amount uint64, id string) (string, error) {
+func (mp *memProvider) refund(ctx context.Context, amount uint64, id string) (string, error) {
 	if mp.refundCalls == nil {
 		mp.refundCalls = []refundCall{}
 	}
@@ -412,3 +602,26 @@ func (mp *memProvider) refund(amount uint64, id string) (string, error) {
 
 	return fmt.Sprintf("trans-%d", len(mp.refundCalls)), nil
 }
+
+// chargeProvider charges successfully with id, or fails with err. It calls
+// check while charging.
+type chargeProvider struct {
+	id       string
+	err      error
+	check    func()
+	calls    int
+	refunded []string
+}
+
+func (cp *chargeProvider) charge(ctx context.Context, transactionID string, amount uint64, currency, token, payerID string) (string, error) {
+	cp.calls++
+	if cp.check != nil {
+		cp.check()
+	}
+	return cp.id, cp.err
+}
+
+func (cp *chargeProvider) refund(ctx context.Context, amount uint64, id string) (string, error) {
+	cp.refunded = append(cp.refunded, id)
+	return "re_" + id, nil
+}
@@ -8,18 +8,21 @@ import (
 
 	"github.com/guregu/kami"
 	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
+
+	"github.com/netlify/gocommerce/tracing"
 )
 
+// Experience caches the gocommerce web profile of each PayPal account
 type Experience struct {
-	profile *paypalsdk.WebProfile
-	mutex   sync.Mutex
+	profiles map[string]*paypalsdk.WebProfile
+	mutex    sync.Mutex
 }
 
-var paypalExperience Experience
+var paypalExperience = Experience{profiles: map[string]*paypalsdk.WebProfile{}}
 
 // PaypalCreatePayment creates a new payment that can be authorized in the browser
 func (a *API) PaypalCreatePayment(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	profile, err := a.getExperience()
+	profile, err := a.getExperience(a.paypalFor(ctx))
 	if err != nil {
 		internalServerError(w, fmt.Sprintf("Error creating paypal experience: %v", err))
 		return
@@ -30,9 +33,10 @@ func (a *API) PaypalCreatePayment(ctx context.Context, w http.ResponseWriter, r
 		Currency: r.FormValue("currency"),
 	}
 	a.log.Infof("Creating paypal payment with profile %v: %v", profile, amount)
-	redirectURI := a.config.SiteURL + "/gocommerce/paypal"
-	cancelURI := a.config.SiteURL + "/gocommerce/paypal/cancel"
-	paymentResult, err := a.paypal.CreatePayment(paypalsdk.Payment{
+	redirectURI := getConfig(ctx).SiteURL + "/gocommerce/paypal"
+	cancelURI := getConfig(ctx).SiteURL + "/gocommerce/paypal/cancel"
+	_, span := tracing.StartSpan(ctx, "paypal.create_payment")
+	paymentResult, err := a.paypalFor(ctx).CreatePayment(paypalsdk.Payment{
 		Intent: "sale",
 		Payer: &paypalsdk.Payer{
 			PaymentMethod: "paypal",
@@ -47,6 +51,7 @@ func (a *API) PaypalCreatePayment(ctx context.Context, w http.ResponseWriter, r
 			CancelURL: cancelURI,
 		},
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
 		internalServerError(w, fmt.Sprintf("Error creating paypal payment: %v", err))
@@ -59,7 +64,9 @@ func (a *API) PaypalCreatePayment(ctx context.Context, w http.ResponseWriter, r
 // PaypalGetPayment retrieves information on an authorized paypal payment, including
 // the shipping address
 func (a *API) PaypalGetPayment(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	payment, err := a.paypal.GetPayment(kami.Param(ctx, "payment_id"))
+	_, span := tracing.StartSpan(ctx, "paypal.get_payment")
+	payment, err := a.paypalFor(ctx).GetPayment(kami.Param(ctx, "payment_id"))
+	tracing.EndSpan(span, err)
 	if err != nil {
 		internalServerError(w, fmt.Sprintf("Error fetching paypal payment: %v", err))
 		return
@@ -68,12 +75,15 @@ func (a *API) PaypalGetPayment(ctx context.Context, w http.ResponseWriter, r *ht
 	sendJSON(w, 200, payment)
 }
 
-func (a *API) getExperience() (*paypalsdk.WebProfile, error) {
-	if paypalExperience.profile != nil {
-		return paypalExperience.profile, nil
+func (a *API) getExperience(client *paypalsdk.Client) (*paypalsdk.WebProfile, error) {
+	paypalExperience.mutex.Lock()
+	cached := paypalExperience.profiles[client.ClientID]
+	paypalExperience.mutex.Unlock()
+	if cached != nil {
+		return cached, nil
 	}
 
-	experiences, err := a.paypal.GetWebProfiles()
+	experiences, err := client.GetWebProfiles()
 	if err != nil {
 		a.log.Errorf("Error getting web profiles: %v", err)
 		return nil, err
@@ -82,13 +92,13 @@ func (a *API) getExperience() (*paypalsdk.WebProfile, error) {
 	for _, profile := range experiences {
 		if profile.Name == "gocommerce" {
 			paypalExperience.mutex.Lock()
-			paypalExperience.profile = &profile
+			paypalExperience.profiles[client.ClientID] = &profile
 			paypalExperience.mutex.Unlock()
-			return paypalExperience.profile, nil
+			return &profile, nil
 		}
 	}
 
-	profile, err := a.paypal.CreateWebProfile(paypalsdk.WebProfile{
+	profile, err := client.CreateWebProfile(paypalsdk.WebProfile{
 		Name: "gocommerce",
 		InputFields: paypalsdk.InputFields{
 			NoShipping: 1,
@@ -101,7 +111,7 @@ func (a *API) getExperience() (*paypalsdk.WebProfile, error) {
 	}
 
 	paypalExperience.mutex.Lock()
-	paypalExperience.profile = profile
+	paypalExperience.profiles[client.ClientID] = profile
 	paypalExperience.mutex.Unlock()
 
 	return profile, nil
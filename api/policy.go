@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/guregu/kami"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// policy decides if a request may be served by a route, before its handler
+// runs. Every route declares one when it's registered, see NewAPIWithBuild,
+// so the handlers only deal with requests they're allowed to serve.
+type policy func(ctx context.Context, a *API) *HTTPError
+
+// ownerRule tells if the caller owns the resource a request is about
+type ownerRule func(ctx context.Context, a *API) (bool, *HTTPError)
+
+// enforce runs the handler once the policy allows the request
+func (a *API) enforce(p policy, handler kami.HandlerFunc) kami.HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if httpErr := p(ctx, a); httpErr != nil {
+			getLogger(ctx).WithError(httpErr).Warn("Illegal access attempted")
+			sendJSON(w, httpErr.Code, httpErr)
+			return
+		}
+		handler(ctx, w, r)
+	}
+}
+
+// public routes are served to anyone, with or without a token
+func public() policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		return nil
+	}
+}
+
+// authenticated routes need a token, of any user
+func authenticated() policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		if getClaims(ctx) == nil {
+			return httpError(http.StatusUnauthorized, "This endpoint requires authentication")
+		}
+		return nil
+	}
+}
+
+// admin routes need the admin role, no scope covers them
+func admin() policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		if !isAdmin(ctx) {
+			return httpError(http.StatusUnauthorized, "Admin privileges are required")
+		}
+		return staffNetwork(ctx)
+	}
+}
+
+// adminUser routes need an admin authenticated with a JWT, so a leaked API
+// key can't be used to mint more keys or redirect the webhooks
+func adminUser() policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		if !isAdmin(ctx) || getAPIKey(ctx) != nil {
+			return httpError(http.StatusUnauthorized, "Admin privileges are required")
+		}
+		return staffNetwork(ctx)
+	}
+}
+
+// operator routes manage the deployment in multi-instance mode, with the
+// operator token
+func operator() policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		if !isOperator(ctx) {
+			return httpError(http.StatusUnauthorized, "The operator token is required")
+		}
+		return nil
+	}
+}
+
+// deploymentAdmin routes change what every instance shares, so in
+// multi-instance mode they need the operator token rather than an admin
+func deploymentAdmin() policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		if a.currentConfig().MultiInstance.Enabled {
+			return operator()(ctx, a)
+		}
+		return admin()(ctx, a)
+	}
+}
+
+// scope routes need the scope, which admins always have
+func scope(s string) policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		if !hasScope(ctx, s) {
+			return httpError(http.StatusUnauthorized, "The %s scope is required", s)
+		}
+		return staffNetwork(ctx)
+	}
+}
+
+// owner routes are only served to the owner of the resource
+func owner(rule ownerRule) policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		owns, httpErr := rule(ctx, a)
+		if httpErr != nil {
+			return httpErr
+		}
+		if !owns {
+			return httpError(http.StatusUnauthorized, "You don't have access to this resource")
+		}
+		return nil
+	}
+}
+
+// ownerOr routes are served to the owner of the resource, and to anyone
+// with the scope
+func ownerOr(rule ownerRule, s string) policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		if hasScope(ctx, s) && staffNetwork(ctx) == nil {
+			return nil
+		}
+		return owner(rule)(ctx, a)
+	}
+}
+
+// all routes need every one of the policies to allow the request
+func all(policies ...policy) policy {
+	return func(ctx context.Context, a *API) *HTTPError {
+		for _, p := range policies {
+			if httpErr := p(ctx, a); httpErr != nil {
+				return httpErr
+			}
+		}
+		return nil
+	}
+}
+
+// staffNetwork refuses the staff access of requests from outside of
+// api.admin_allowed_ips, when it's set. A token alone isn't enough then.
+func staffNetwork(ctx context.Context) *HTTPError {
+	networks, err := conf.ParseNetworks(getConfig(ctx).API.AdminAllowedIPs)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, "Invalid admin_allowed_ips: %v", err)
+	}
+	if len(networks) > 0 && !networks.Contains(getClientIP(ctx)) {
+		return httpError(http.StatusUnauthorized, "Admin privileges can't be used from this network")
+	}
+	return nil
+}
+
+// userInPath is owned by the user the user_id parameter names
+func userInPath() ownerRule {
+	return func(ctx context.Context, a *API) (bool, *HTTPError) {
+		claims := getClaims(ctx)
+		return claims != nil && claims.ID == kami.Param(ctx, "user_id"), nil
+	}
+}
+
+// orderOwner is owned by the user of the order in the param, which is its ID
+// or its reference. Anonymous orders are open to anyone who knows the ID, but
+// not the reference, which is short enough to guess.
+func orderOwner(param string) ownerRule {
+	return func(ctx context.Context, a *API) (bool, *HTTPError) {
+		return a.ownsOrder(ctx, kami.Param(ctx, param), true)
+	}
+}
+
+// orderUser is owned by the user of the order in the param. Nobody owns
+// anonymous orders.
+func orderUser(param string) ownerRule {
+	return func(ctx context.Context, a *API) (bool, *HTTPError) {
+		return a.ownsOrder(ctx, kami.Param(ctx, param), false)
+	}
+}
+
+// downloadOwner is owned by the owner of the order the download in the param
+// was bought with
+func downloadOwner(param string) ownerRule {
+	return func(ctx context.Context, a *API) (bool, *HTTPError) {
+		download := &models.Download{}
+		if rsp := a.dbFor(ctx).Select("order_id").First(download, "id = ?", kami.Param(ctx, param)); rsp.Error != nil {
+			if rsp.RecordNotFound() {
+				return false, httpError(http.StatusNotFound, "Download not found")
+			}
+			getLogger(ctx).WithError(rsp.Error).Warn("Error while querying for download")
+			return false, httpError(http.StatusInternalServerError, "Error during database query: %v", rsp.Error)
+		}
+		return a.ownsOrder(ctx, download.OrderID, true)
+	}
+}
+
+// ownsOrder tells if the caller is the user of the order with the ID or
+// reference, or if the order is anonymous, those are open and it's named by
+// its ID
+func (a *API) ownsOrder(ctx context.Context, id string, anonymous bool) (bool, *HTTPError) {
+	order := &models.Order{}
+	if rsp := a.dbFor(ctx).Select("id, user_id").First(order, "id = ? OR ref = ?", id, id); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return false, httpError(http.StatusNotFound, "Order not found")
+		}
+		getLogger(ctx).WithError(rsp.Error).Warn("Error while querying for order")
+		return false, httpError(http.StatusInternalServerError, "Error during database query: %v", rsp.Error)
+	}
+	if order.UserID == "" {
+		return anonymous && order.ID == id, nil
+	}
+	claims := getClaims(ctx)
+	return claims != nil && claims.ID == order.UserID, nil
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestRoutePolicies(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	anon := models.NewOrder("session3", "alfred@wayneindustries.com", "usd")
+	anon.Ref = "K7QX3MB"
+	assert.NoError(t, db.Create(anon).Error)
+	defer db.Unscoped().Delete(anon)
+
+	owner := testContext(testToken(testUser.ID, testUser.Email), config, false)
+	stranger := testContext(testToken("stranger", "stranger@example.com"), config, false)
+	support := withScopes(stranger, map[string]bool{conf.ScopeOrdersRead: true})
+	admin := testContext(testToken("magical-unicorn", ""), config, true)
+	nobody := testContext(nil, config, false)
+
+	check := func(ctx context.Context, route, param, value string) int {
+		if param != "" {
+			ctx = kami.SetParam(ctx, param, value)
+		}
+		if httpErr := api.policies[route](ctx, api); httpErr != nil {
+			return httpErr.Code
+		}
+		return http.StatusOK
+	}
+
+	// owner or admin for viewing an order
+	assert.Equal(t, http.StatusOK, check(owner, "GET /orders/:id", "id", firstOrder.ID))
+	assert.Equal(t, http.StatusOK, check(support, "GET /orders/:id", "id", firstOrder.ID))
+	assert.Equal(t, http.StatusOK, check(admin, "GET /orders/:id", "id", firstOrder.ID))
+	assert.Equal(t, http.StatusUnauthorized, check(stranger, "GET /orders/:id", "id", firstOrder.ID))
+	assert.Equal(t, http.StatusUnauthorized, check(nobody, "GET /orders/:id", "id", firstOrder.ID))
+	assert.Equal(t, http.StatusNotFound, check(stranger, "GET /orders/:id", "id", "does-not-exist"))
+
+	// anonymous orders are open to anyone who knows their ID, except for
+	// listing their payments
+	assert.Equal(t, http.StatusOK, check(stranger, "GET /orders/:id", "id", anon.ID))
+	assert.Equal(t, http.StatusOK, check(nobody, "POST /orders/:order_id/payments", "order_id", anon.ID))
+	assert.Equal(t, http.StatusUnauthorized, check(stranger, "GET /orders/:order_id/payments", "order_id", anon.ID))
+	assert.Equal(t, http.StatusOK, check(support, "GET /orders/:order_id/payments", "order_id", anon.ID))
+	assert.Equal(t, http.StatusUnauthorized, check(stranger, "POST /orders/:order_id/payments", "order_id", firstOrder.ID))
+
+	// but not to anyone who knows their ref, which can be guessed
+	assert.Equal(t, http.StatusUnauthorized, check(stranger, "GET /orders/:id", "id", anon.Ref))
+	assert.Equal(t, http.StatusUnauthorized, check(stranger, "GET /orders/:id/events", "id", anon.Ref))
+	assert.Equal(t, http.StatusUnauthorized, check(nobody, "GET /orders/:order_id/payment_status", "order_id", anon.Ref))
+	assert.Equal(t, http.StatusUnauthorized, check(nobody, "GET /orders/:order_id/downloads", "order_id", anon.Ref))
+	assert.Equal(t, http.StatusOK, check(support, "GET /orders/:id", "id", anon.Ref))
+
+	// reading orders isn't enough to refund them
+	assert.Equal(t, http.StatusOK, check(admin, "POST /payments/:pay_id/refund", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, check(support, "POST /payments/:pay_id/refund", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, check(owner, "POST /payments/:pay_id/refund", "", ""))
+
+	// users see themselves
+	assert.Equal(t, http.StatusOK, check(owner, "GET /users/:user_id", "user_id", testUser.ID))
+	assert.Equal(t, http.StatusUnauthorized, check(stranger, "GET /users/:user_id", "user_id", testUser.ID))
+	assert.Equal(t, http.StatusUnauthorized, check(owner, "DELETE /users/:user_id", "user_id", testUser.ID))
+
+	// API keys can't mint more keys
+	withKey := withAPIKey(admin, &models.APIKey{ID: "key", Scope: models.AdminScope})
+	assert.Equal(t, http.StatusOK, check(admin, "POST /api_keys", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, check(withKey, "POST /api_keys", "", ""))
+	assert.Equal(t, http.StatusOK, check(withKey, "GET /audit_logs", "", ""))
+
+	// the log level is for the operator in multi-instance mode
+	assert.Equal(t, http.StatusOK, check(admin, "PUT /log_level", "", ""))
+	config.MultiInstance.Enabled = true
+	assert.Equal(t, http.StatusUnauthorized, check(admin, "PUT /log_level", "", ""))
+	assert.Equal(t, http.StatusOK, check(withOperator(nobody), "PUT /log_level", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, check(admin, "GET /instances", "", ""))
+}
+
+func TestOrderListForOwnUser(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	ctx := testContext(testToken(testUser.ID, testUser.Email), config, false)
+	ctx = kami.SetParam(ctx, "user_id", testUser.ID)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", urlWithUserID, nil)
+	guarded(t, api, "GET /users/:user_id/orders", api.OrderList)(ctx, recorder, req)
+	orders := []models.Order{}
+	extractPayload(t, http.StatusOK, recorder, &orders)
+	assert.Len(t, orders, 2)
+}
+
+func TestAdminAllowedIPs(t *testing.T) {
+	db, config := db(t)
+	config.JWT.Secret = "secret"
+	config.JWT.AdminGroupName = "admin"
+	config.JWT.Roles = map[string][]string{"finance": {conf.ScopeReportsRead}}
+	config.API.AdminAllowedIPs = []string{"10.0.0.0/8"}
+	config.API.TrustedProxies = []string{"192.168.0.1"}
+	api := NewAPI(config, db, nil, nil, nil)
+
+	do := func(id, role, path, remoteAddr, forwardedFor string) int {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &JWTClaims{
+			ID:             id,
+			AppMetaData:    map[string]interface{}{"roles": []string{role}},
+			StandardClaims: &jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		})
+		signed, _ := token.SignedString([]byte(config.JWT.Secret))
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Authorization", "Bearer "+signed)
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do("staff", "admin", "/v1/config", "10.1.2.3:4000", ""))
+	assert.Equal(t, http.StatusUnauthorized, do("staff", "admin", "/v1/config", "203.0.113.9:4000", ""))
+	assert.Equal(t, http.StatusOK, do("staff", "finance", "/v1/reports/sales", "10.1.2.3:4000", ""))
+	assert.Equal(t, http.StatusUnauthorized, do("staff", "finance", "/v1/reports/sales", "203.0.113.9:4000", ""))
+
+	// the proxy tells where the request comes from, but only the last hop
+	// before it can be trusted
+	assert.Equal(t, http.StatusOK, do("staff", "admin", "/v1/config", "192.168.0.1:4000", "203.0.113.9, 10.1.2.3"))
+	assert.Equal(t, http.StatusUnauthorized, do("staff", "admin", "/v1/config", "192.168.0.1:4000", "10.1.2.3, 203.0.113.9"))
+	assert.Equal(t, http.StatusUnauthorized, do("staff", "admin", "/v1/config", "203.0.113.9:4000", "10.1.2.3"))
+
+	// customers aren't affected
+	assert.Equal(t, http.StatusOK, do(testUser.ID, "", "/v1/orders/"+firstOrder.ID, "203.0.113.9:4000", ""))
+}
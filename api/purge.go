@@ -0,0 +1,35 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// PurgeTestOrders permanently deletes the orders placed in test mode, to clean
+// up an instance before it goes live. It's refused once the instance uses
+// live payment credentials. With `?dry_run=true` it only reports what would be
+// deleted.
+func (a *API) PurgeTestOrders(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	if !getConfig(ctx).TestMode() {
+		log.Warn("Attempted to purge test orders in production mode")
+		badRequestError(w, "Test orders can't be purged with live payment credentials")
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	result, err := models.PurgeTestOrders(a.dbFor(ctx), dryRun)
+	if err != nil {
+		log.WithError(err).Warn("Error while purging test orders")
+		internalServerError(w, "Error purging test orders: %v", err)
+		return
+	}
+
+	if !dryRun {
+		a.audit(ctx, a.dbFor(ctx), r, "test_orders.purge", "order", "", nil, models.Snapshot(result))
+	}
+	log.WithField("dry_run", dryRun).Infof("Purged %d test orders", result.Orders)
+	sendJSON(w, 200, result)
+}
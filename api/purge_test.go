@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestPurgeTestOrders(t *testing.T) {
+	db, config := db(t)
+	db.Model(firstOrder).UpdateColumn("test_mode", true)
+	assert.NoError(t, db.Create(&models.Mail{OrderID: firstOrder.ID, Type: "order_confirmation"}).Error)
+	assert.NoError(t, db.Create(&models.OrderNote{OrderID: firstOrder.ID, Text: "a test"}).Error)
+	assert.NoError(t, db.Create(&models.CouponRedemption{CouponCode: "DEMO10", OrderID: firstOrder.ID, Email: testUser.Email}).Error)
+
+	purge := func(url string) *models.PurgeResult {
+		ctx := testContext(testToken("magical-unicorn", ""), config, true)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("DELETE", url, nil)
+		NewAPI(config, db, nil, nil, nil).PurgeTestOrders(ctx, w, r)
+
+		result := &models.PurgeResult{}
+		extractPayload(t, 200, w, result)
+		return result
+	}
+
+	result := purge("http://something/test_orders?dry_run=true")
+	assert.True(t, result.DryRun)
+	assert.Equal(t, 1, result.Orders)
+	assert.Equal(t, 1, result.LineItems)
+	assert.Equal(t, 1, result.Transactions)
+	assert.Equal(t, 1, result.Mails)
+	assert.Equal(t, 1, result.Notes)
+	assert.Equal(t, 1, result.CouponRedemptions)
+
+	count := 0
+	db.Model(&models.Order{}).Count(&count)
+	assert.Equal(t, 2, count, "a dry run doesn't delete anything")
+
+	result = purge("http://something/test_orders")
+	assert.False(t, result.DryRun)
+	assert.Equal(t, 1, result.Orders)
+
+	remaining := []models.Order{}
+	db.Find(&remaining)
+	if assert.Len(t, remaining, 1) {
+		assert.Equal(t, secondOrder.ID, remaining[0].ID)
+	}
+	for _, model := range []interface{}{&models.Transaction{}, &models.Mail{}, &models.OrderNote{}, &models.CouponRedemption{}} {
+		db.Model(model).Where("order_id = ?", firstOrder.ID).Count(&count)
+		assert.Equal(t, 0, count)
+	}
+}
+
+func TestPurgeTestOrdersInProduction(t *testing.T) {
+	db, config := db(t)
+	config.Payment.Stripe.SecretKey = "sk_live_123"
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("DELETE", "http://something/test_orders", nil)
+	NewAPI(config, db, nil, nil, nil).PurgeTestOrders(ctx, w, r)
+	validateError(t, 400, w)
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// ReadOnlyRetryAfter is how long writes are rejected after the database
+// reported it is read-only. The first write after that checks again.
+const ReadOnlyRetryAfter = 30 * time.Second
+
+var (
+	readOnlyMetric         = expvar.NewInt("db_read_only")
+	readOnlyRejectedMetric = expvar.NewInt("db_read_only_rejected_writes")
+)
+
+// readOnlyState tracks if the database is read-only, as seen by the last writes
+type readOnlyState struct {
+	mutex sync.Mutex
+	log   *logrus.Entry
+	since time.Time
+	until time.Time
+}
+
+func (s *readOnlyState) trip() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if s.since.IsZero() {
+		s.since = now
+		readOnlyMetric.Set(1)
+		s.log.Warn("Database is read-only, rejecting writes")
+	}
+	s.until = now.Add(ReadOnlyRetryAfter)
+}
+
+func (s *readOnlyState) recover() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.since.IsZero() {
+		s.log.WithField("duration", time.Since(s.since)).Info("Database accepts writes again")
+		s.since = time.Time{}
+		s.until = time.Time{}
+		readOnlyMetric.Set(0)
+	}
+}
+
+// retryAfter returns how long writes should back off, zero if they can go ahead
+func (s *readOnlyState) retryAfter() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.since.IsZero() {
+		return 0
+	}
+	if wait := time.Until(s.until); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (s *readOnlyState) trippedAfter(t time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.since.IsZero() && s.until.After(t.Add(ReadOnlyRetryAfter))
+}
+
+// register watches the writes on the db, so read-only errors trip the state
+// and successful writes recover it
+func (s *readOnlyState) register(db *gorm.DB) {
+	check := func(scope *gorm.Scope) {
+		if scope.HasError() {
+			if models.IsReadOnlyError(scope.DB().Error) {
+				s.trip()
+			}
+		} else {
+			s.recover()
+		}
+	}
+
+	callbacks := db.Callback()
+	callbacks.Create().After("gorm:commit_or_rollback_transaction").Register("gocommerce:read_only", check)
+	callbacks.Update().After("gorm:commit_or_rollback_transaction").Register("gocommerce:read_only", check)
+	callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register("gocommerce:read_only", check)
+}
+
+// withReadOnlyGuard serves reads as usual while the database is read-only, but
+// answers writes with a 503 and a Retry-After header. A write that fails
+// because the database just turned read-only gets the same response instead of
+// a 500.
+func (a *API) withReadOnlyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST", "PUT", "PATCH", "DELETE":
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if wait := a.readOnly.retryAfter(); wait > 0 {
+			readOnlyUnavailable(w, wait)
+			return
+		}
+
+		next.ServeHTTP(&readOnlyWriter{ResponseWriter: w, state: a.readOnly, started: time.Now()}, r)
+	})
+}
+
+func readOnlyUnavailable(w http.ResponseWriter, wait time.Duration) {
+	readOnlyRejectedMetric.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	sendJSON(w, http.StatusServiceUnavailable, httpError(http.StatusServiceUnavailable, "The database is read-only right now, please retry later"))
+}
+
+// readOnlyWriter replaces a 500 with the read-only response if the database
+// turned read-only while the request was being handled
+type readOnlyWriter struct {
+	http.ResponseWriter
+	state    *readOnlyState
+	started  time.Time
+	replaced bool
+}
+
+func (w *readOnlyWriter) WriteHeader(code int) {
+	if code == http.StatusInternalServerError && w.state.trippedAfter(w.started) {
+		w.replaced = true
+		readOnlyUnavailable(w.ResponseWriter, ReadOnlyRetryAfter)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *readOnlyWriter) Write(data []byte) (int, error) {
+	if w.replaced {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush passes flushes on, so responses can be streamed
+func (w *readOnlyWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// DebugVars serves the expvar metrics, like the read-only state of the database
+func (a *API) DebugVars(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	expvar.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyDatabase(t *testing.T) {
+	_, config := db(t)
+	config.JWT.Secret = "secret"
+	config.JWT.AdminGroupName = "admin"
+
+	readOnlyDB, err := gorm.Open("sqlite3", "file:"+config.DB.ConnURL+"?mode=ro")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer readOnlyDB.Close()
+
+	api := NewAPI(config, readOnlyDB, nil, nil, nil)
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &JWTClaims{
+		ID:             "magical-unicorn",
+		AppMetaData:    map[string]interface{}{"roles": []string{"admin"}},
+		StandardClaims: &jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	signed, _ := token.SignedString([]byte(config.JWT.Secret))
+
+	do := func(method, path string) *http.Response {
+		r, _ := http.NewRequest(method, server.URL+path, strings.NewReader(`{"reason": "fraud"}`))
+		r.Header.Set("Authorization", "Bearer "+signed)
+		rsp, err := http.DefaultClient.Do(r)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		rsp.Body.Close()
+		return rsp
+	}
+
+	// the write that discovers the database is read-only
+	rsp := do("POST", "/v1/orders/"+firstOrder.ID+"/cancel")
+	assert.Equal(t, 503, rsp.StatusCode)
+	assert.Equal(t, "30", rsp.Header.Get("Retry-After"))
+	assert.EqualValues(t, 1, readOnlyMetric.Value())
+
+	// writes are rejected up front after that
+	rsp = do("POST", "/v1/orders/"+firstOrder.ID+"/cancel")
+	assert.Equal(t, 503, rsp.StatusCode)
+	assert.NotEmpty(t, rsp.Header.Get("Retry-After"))
+
+	// while reads are served as usual
+	rsp = do("GET", "/v1/orders/"+firstOrder.ID)
+	assert.Equal(t, 200, rsp.StatusCode)
+
+	api.readOnly.recover()
+	assert.EqualValues(t, 0, readOnlyMetric.Value())
+}
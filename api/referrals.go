@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// ReferralStats is the referral code of a customer, with the orders placed
+// with it and the store credit they earned by currency
+type ReferralStats struct {
+	Code    string            `json:"code"`
+	Orders  uint64            `json:"orders"`
+	Credits map[string]uint64 `json:"credits"`
+}
+
+func referralsEnabled(config *conf.Configuration) bool {
+	return config.Referrals.Discount > 0 || config.Referrals.Credit > 0
+}
+
+// findReferralCoupon loads the referral code of the user, it's nil if they
+// have none
+func findReferralCoupon(db *gorm.DB, userID string) (*models.Coupon, error) {
+	coupon := &models.Coupon{}
+	rsp := db.First(coupon, "referrer_id = ?", userID)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	return coupon, rsp.Error
+}
+
+func referralStats(db *gorm.DB, coupon *models.Coupon) (*ReferralStats, error) {
+	counts, err := models.CouponRedemptionCounts(db, []string{coupon.Code})
+	if err != nil {
+		return nil, err
+	}
+	credits, err := models.ReferralCredits(db, coupon.ReferrerID)
+	if err != nil {
+		return nil, err
+	}
+	return &ReferralStats{Code: coupon.Code, Orders: counts[coupon.Code], Credits: credits}, nil
+}
+
+// ReferralView shows the referral code of a user, how many orders were paid
+// with it and the store credit it earned them
+func (a *API) ReferralView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	db := a.dbFor(ctx)
+	coupon, err := findReferralCoupon(db, kami.Param(ctx, "user_id"))
+	if err != nil {
+		log.WithError(err).Warn("Error while querying for referral code")
+		internalServerError(w, "Error during database query: %v", err)
+		return
+	}
+	if coupon == nil {
+		notFoundError(w, "This user has no referral code")
+		return
+	}
+
+	stats, err := referralStats(db, coupon)
+	if err != nil {
+		log.WithError(err).Warn("Error while counting referrals")
+		internalServerError(w, "Error during database query: %v", err)
+		return
+	}
+	sendJSON(w, 200, stats)
+}
+
+// ReferralCreate gives a customer their referral code. A customer has one
+// code, asking again returns the one they have.
+func (a *API) ReferralCreate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	config := getConfig(ctx)
+	if !referralsEnabled(config) {
+		notFoundError(w, "Referrals aren't enabled")
+		return
+	}
+
+	userID := kami.Param(ctx, "user_id")
+	tx := a.dbFor(ctx).Begin()
+	if rsp := tx.First(&models.User{}, "id = ?", userID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			cleanup(tx, w, httpError(http.StatusNotFound, "Couldn't find a user with id %s", userID))
+		} else {
+			cleanup(tx, w, httpError(http.StatusInternalServerError, "Error during database query: %v", rsp.Error))
+		}
+		return
+	}
+
+	coupon, err := findReferralCoupon(tx, userID)
+	if err != nil {
+		cleanup(tx, w, httpError(http.StatusInternalServerError, "Error during database query: %v", err))
+		return
+	}
+	status := http.StatusOK
+	if coupon == nil {
+		coupon, err = models.NewReferralCoupon(userID, config.Referrals.Discount)
+		if err == nil {
+			err = tx.Create(coupon).Error
+		}
+		if err != nil {
+			log.WithError(err).Warn("Failed to store referral code")
+			cleanup(tx, w, httpError(http.StatusInternalServerError, "Failed to store referral code"))
+			return
+		}
+		status = http.StatusCreated
+	}
+
+	stats, err := referralStats(tx, coupon)
+	if err == nil {
+		err = tx.Commit().Error
+	}
+	if err != nil {
+		tx.Rollback()
+		internalServerError(w, "Failed to store referral code: %v", err)
+		return
+	}
+	if status == http.StatusCreated {
+		log.WithField("coupon", coupon.Code).Info("Created referral code")
+	}
+	sendJSON(w, status, stats)
+}
+
+// checkReferral refuses referral codes used by their own customer, with
+// their account or their email, or by customers who paid for an order
+// before. Guests can use referral codes, they're told apart by email.
+func checkReferral(db *gorm.DB, coupon *models.Coupon, userID, email string) *HTTPError {
+	if coupon.ReferrerID == "" {
+		return nil
+	}
+	if userID == coupon.ReferrerID {
+		return httpError(http.StatusBadRequest, "You can't use your own referral code")
+	}
+	referrer := &models.User{}
+	if rsp := db.First(referrer, "id = ?", coupon.ReferrerID); rsp.Error != nil && !rsp.RecordNotFound() {
+		return httpError(http.StatusInternalServerError, "Error during database query: %v", rsp.Error)
+	}
+	if referrer.Email != "" && strings.EqualFold(referrer.Email, email) {
+		return httpError(http.StatusBadRequest, "You can't use your own referral code")
+	}
+	paid, err := models.CountPaidOrders(db, userID, email)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, "Error during database query: %v", err)
+	}
+	if paid > 0 {
+		return httpError(http.StatusBadRequest, "Referral codes are for new customers")
+	}
+	return nil
+}
+
+// creditReferrer gives the customer whose referral code the order was paid
+// with their store credit, a share of the order total
+func creditReferrer(config *conf.Configuration, tx *gorm.DB, order *models.Order) (*models.ReferralCredit, error) {
+	if order.Coupon == nil || order.Coupon.ReferrerID == "" {
+		return nil, nil
+	}
+	amount := order.Total * config.Referrals.Credit / 100
+	if amount == 0 {
+		return nil, nil
+	}
+	credit := &models.ReferralCredit{
+		UserID:   order.Coupon.ReferrerID,
+		OrderID:  order.ID,
+		Code:     order.CouponCode,
+		Amount:   amount,
+		Currency: order.Currency,
+	}
+	return credit, tx.Create(credit).Error
+}
+
+// reverseReferralCredit takes back the credit earned with the order in the
+// share of its total that was refunded so far
+func reverseReferralCredit(tx *gorm.DB, orderID string) error {
+	order := &models.Order{}
+	if err := tx.First(order, "id = ?", orderID).Error; err != nil {
+		return err
+	}
+	var refunded uint64
+	row := tx.Model(&models.Transaction{}).
+		Select("coalesce(sum(amount), 0)").
+		Where("order_id = ? AND type = ? AND status = ?", orderID, models.RefundTransactionType, models.PaidState).
+		Row()
+	if err := row.Scan(&refunded); err != nil {
+		return err
+	}
+	return models.ReverseReferralCredit(tx, order, refunded)
+}
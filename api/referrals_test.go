@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func runReferralRequest(t *testing.T, api *API, method, userID string) *httptest.ResponseRecorder {
+	ctx := kami.SetParam(testContext(testToken(userID, ""), api.config, false), "user_id", userID)
+	handler := api.ReferralView
+	if method == "POST" {
+		handler = api.ReferralCreate
+	}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(method, "https://example.org", nil)
+	guarded(t, api, method+" /users/:user_id/referral", handler)(ctx, w, r)
+	return w
+}
+
+func TestReferrals(t *testing.T) {
+	db, config := db(t)
+	config.Referrals.Discount = 10
+	config.Referrals.Credit = 5
+	assert.NoError(t, db.Create(&models.User{ID: "referrer", Email: "referrer@example.com"}).Error)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	validateError(t, http.StatusNotFound, runReferralRequest(t, api, "GET", "referrer"))
+	stats := &ReferralStats{}
+	extractPayload(t, http.StatusCreated, runReferralRequest(t, api, "POST", "referrer"), stats)
+	assert.True(t, strings.HasPrefix(stats.Code, models.ReferralCodePrefix))
+	again := &ReferralStats{}
+	extractPayload(t, http.StatusOK, runReferralRequest(t, api, "POST", "referrer"), again)
+	assert.Equal(t, stats.Code, again.Code, "a customer has one referral code")
+
+	order := &models.Order{}
+	userCtx := testContext(testToken(testUser.ID, testUser.Email), config, false)
+	extractPayload(t, http.StatusCreated, runOrderCreateWithCoupon(t, api, userCtx, stats.Code), order)
+	assert.Equal(t, uint64(100), order.Discount)
+	referrerCtx := testContext(testToken("referrer", "referrer@example.com"), config, false)
+	validateError(t, http.StatusBadRequest, runOrderCreateWithCoupon(t, api, referrerCtx, stats.Code))
+
+	assert.NoError(t, db.Model(secondOrder).Updates(map[string]interface{}{
+		"coupon_code": stats.Code,
+		"raw_coupon":  `{"code": "` + stats.Code + `", "percentage": 10, "max_uses_per_user": 1, "referrer_id": "referrer"}`,
+	}).Error)
+	assert.Equal(t, http.StatusOK, runPaymentCreate(t, db, config, &chargeProvider{id: "ch_123"}).Code)
+
+	credit := secondOrder.Total * 5 / 100
+	extractPayload(t, http.StatusOK, runReferralRequest(t, api, "GET", "referrer"), stats)
+	assert.Equal(t, uint64(1), stats.Orders)
+	assert.Equal(t, map[string]uint64{"usd": credit}, stats.Credits)
+
+	validateError(t, http.StatusBadRequest, runOrderCreateWithCoupon(t, api, userCtx, stats.Code))
+
+	adminCtx := kami.SetParam(testContext(testToken("magical-unicorn", ""), config, true), "order_id", secondOrder.ID)
+	r, _ := http.NewRequest("POST", "https://example.org", strings.NewReader(`{"reason": "fraud"}`))
+	w := httptest.NewRecorder()
+	api.OrderCancel(adminCtx, w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	extractPayload(t, http.StatusOK, runReferralRequest(t, api, "GET", "referrer"), stats)
+	assert.Equal(t, map[string]uint64{"usd": 0}, stats.Credits, "the credit of a cancelled order is reversed")
+}
+
+func TestReferralsRefuseTheEmailOfTheReferrer(t *testing.T) {
+	db, config := db(t)
+	config.Referrals.Discount = 10
+	assert.NoError(t, db.Create(&models.User{ID: "referrer", Email: "Info@Example.com"}).Error)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	stats := &ReferralStats{}
+	extractPayload(t, http.StatusCreated, runReferralRequest(t, api, "POST", "referrer"), stats)
+	w := runOrderCreateWithCoupon(t, api, testContext(nil, config, false), stats.Code)
+	validateError(t, http.StatusBadRequest, w)
+}
+
+func TestReferralsDisabled(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	validateError(t, http.StatusNotFound, runReferralRequest(t, api, "POST", testUser.ID))
+}
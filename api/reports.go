@@ -2,32 +2,150 @@ package api
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/models"
 )
 
 type SalesRow struct {
+	Variant  string `json:"variant,omitempty"`
+	Orders   uint64 `json:"orders"`
 	Total    uint64 `json:"total"`
 	SubTotal uint64 `json:"subtotal"`
 	Taxes    uint64 `json:"taxes"`
 	Currency string `json:"currency"`
 }
 
+// SalesPeriodRow is the sales of a period in a currency. Gross is the order
+// totals, and net is what's left of them after the taxes and refunds. The
+// refunds gave back taxes too, so only their share without taxes comes off
+// the net.
+type SalesPeriodRow struct {
+	Period    time.Time `json:"period"`
+	Currency  string    `json:"currency"`
+	Orders    uint64    `json:"orders"`
+	Gross     uint64    `json:"gross"`
+	Discounts uint64    `json:"discounts"`
+	Taxes     uint64    `json:"taxes"`
+	Refunds   uint64    `json:"refunds"`
+	Net       int64     `json:"net"`
+
+	refundedTaxes uint64
+}
+
+type salesPeriodKey struct {
+	period   time.Time
+	currency string
+}
+
+// ProductsRow is how a product, or a product type, sold in a currency: the
+// units sold and the revenue of their line items
 type ProductsRow struct {
 	Sku      string `json:"sku"`
 	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Units    uint64 `json:"units"`
 	Total    uint64 `json:"total"`
 	Currency string `json:"currency"`
 }
 
-// SalesReport lists the sales numbers for a period
+// CouponsRow is how a coupon did in a currency: the paid orders with it,
+// the discount it gave and the revenue of those orders
+type CouponsRow struct {
+	Code              string `json:"code"`
+	Currency          string `json:"currency"`
+	Redemptions       uint64 `json:"redemptions"`
+	Discount          uint64 `json:"discount"`
+	Revenue           uint64 `json:"revenue"`
+	AverageOrderValue uint64 `json:"average_order_value"`
+}
+
+type CancellationsRow struct {
+	Period   time.Time `json:"period"`
+	Type     string    `json:"type"`
+	Reason   string    `json:"reason"`
+	Count    uint64    `json:"count"`
+	Amount   uint64    `json:"amount"`
+	Currency string    `json:"currency"`
+}
+
+type TaxLiabilityRow struct {
+	Period        time.Time `json:"period"`
+	Country       string    `json:"country"`
+	Currency      string    `json:"currency"`
+	Orders        uint64    `json:"orders"`
+	Sales         uint64    `json:"sales"`
+	Taxes         uint64    `json:"taxes"`
+	RefundedSales uint64    `json:"refunded_sales"`
+	RefundedTaxes uint64    `json:"refunded_taxes"`
+	NetRevenue    int64     `json:"net_revenue"`
+	TaxLiability  int64     `json:"tax_liability"`
+}
+
+// TaxSummaryRow is the sales of a period taxed at one rate in a country, as
+// the calculator split the taxes of the orders, and the refunds issued in
+// the period
+type TaxSummaryRow struct {
+	Period        time.Time `json:"period"`
+	Country       string    `json:"country"`
+	Rate          uint64    `json:"rate"`
+	Currency      string    `json:"currency"`
+	Orders        uint64    `json:"orders"`
+	TaxableSales  uint64    `json:"taxable_sales"`
+	TaxCollected  uint64    `json:"tax_collected"`
+	RefundedSales uint64    `json:"refunded_sales"`
+	RefundedTaxes uint64    `json:"refunded_taxes"`
+	NetSales      int64     `json:"net_sales"`
+	NetTaxes      int64     `json:"net_taxes"`
+}
+
+type taxSummaryKey struct {
+	period   time.Time
+	country  string
+	rate     uint64
+	currency string
+}
+
+type taxLiabilityKey struct {
+	period   time.Time
+	country  string
+	currency string
+}
+
+const unspecifiedReason = "unspecified"
+
+type cancellationsKey struct {
+	period   time.Time
+	kind     string
+	reason   string
+	currency string
+}
+
+// SalesReport lists the sales numbers for a period. With `?experiment=name`
+// only the orders from that experiment are included, grouped by variant.
 func (a *API) SalesReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	query := a.db.
+	query := a.dbFor(ctx).
 		Model(&models.Order{}).
-		Select("sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency").
-		Where("payment_state = 'paid'").
-		Group("currency")
+		Where("payment_state = 'paid'")
+
+	if experiment := r.URL.Query().Get("experiment"); experiment != "" {
+		query = query.
+			Select("variant, count(*) as orders, sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency").
+			Where("experiment = ?", experiment).
+			Group("variant, currency").
+			Order("variant")
+	} else {
+		query = query.
+			Select("'' as variant, count(*) as orders, sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency").
+			Group("currency")
+	}
 
 	query, err := parseTimeQueryParams(query, r.URL.Query())
 	if err != nil {
@@ -44,7 +162,7 @@ func (a *API) SalesReport(ctx context.Context, w http.ResponseWriter, r *http.Re
 	result := []*SalesRow{}
 	for rows.Next() {
 		row := &SalesRow{}
-		err = rows.Scan(&row.Total, &row.SubTotal, &row.Taxes, &row.Currency)
+		err = rows.Scan(&row.Variant, &row.Orders, &row.Total, &row.SubTotal, &row.Taxes, &row.Currency)
 		if err != nil {
 			internalServerError(w, "Database error: %v", err)
 			return
@@ -55,18 +173,239 @@ func (a *API) SalesReport(ctx context.Context, w http.ResponseWriter, r *http.Re
 	sendJSON(w, 200, result)
 }
 
-// ProductsReport list the products sold within a period
+// SalesPeriodsReport lists the sales of every day, week or month (the
+// `interval` parameter, month by default) by currency, for dashboards. The
+// database adds up the orders and refunds of each day, and the days are
+// added up by period. Reports are cached for reports.cache_ttl.
+func (a *API) SalesPeriodsReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := r.URL.Query()
+	interval, err := getIntervalQueryParam(params)
+	if err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+
+	key := r.URL.Path + "?" + params.Encode()
+	if instance := getInstance(ctx); instance != nil {
+		key = instance.ID + ":" + key
+	}
+	now := time.Now()
+	result, ok := a.reportCache.get(key, now).([]*SalesPeriodRow)
+	if !ok {
+		sales, err := parseTimeQueryParams(a.dbFor(ctx).
+			Model(&models.Order{}).
+			Select("date(created_at) as day, currency, count(*), sum(total), sum(discount), sum(taxes)").
+			Where("payment_state = ?", models.PaidState).
+			Group("date(created_at), currency"), params)
+		if err != nil {
+			badRequestError(w, err.Error())
+			return
+		}
+		// refunds are split by the taxes of their order one by one
+		order := func(column string) string {
+			return "COALESCE((SELECT " + column + " FROM " + models.Order{}.TableName() + " o WHERE o.id = " + models.Transaction{}.TableName() + ".order_id), 0)"
+		}
+		refunds, _ := parseTimeQueryParams(a.dbFor(ctx).
+			Model(&models.Transaction{}).
+			Select("date(created_at) as day, currency, 1, amount, "+order("total")+", "+order("taxes")).
+			Where("type = ? AND status = ?", models.RefundTransactionType, models.PaidState), params)
+
+		if result, err = salesPeriods(sales, refunds, interval); err != nil {
+			log.WithError(err).Warn("Error while querying for the sales by period")
+			internalServerError(w, "Database error: %v", err)
+			return
+		}
+		if ttl := getConfig(ctx).Reports.CacheTTL; ttl > 0 {
+			a.reportCache.put(key, result, now.Add(ttl))
+		}
+	}
+
+	if !wantsCSV(r) {
+		sendJSON(w, 200, result)
+		return
+	}
+
+	records := [][]string{{"period", "currency", "orders", "gross", "discounts", "taxes", "refunds", "net"}}
+	for _, row := range result {
+		records = append(records, []string{
+			row.Period.Format("2006-01-02"),
+			row.Currency,
+			strconv.FormatUint(row.Orders, 10),
+			strconv.FormatUint(row.Gross, 10),
+			strconv.FormatUint(row.Discounts, 10),
+			strconv.FormatUint(row.Taxes, 10),
+			strconv.FormatUint(row.Refunds, 10),
+			strconv.FormatInt(row.Net, 10),
+		})
+	}
+	if err := sendCSV(w, "sales_"+interval+".csv", records); err != nil {
+		log.WithError(err).Warn("Failed to write CSV report")
+	}
+}
+
+// salesPeriods adds up the daily sums of the orders and the refunds by
+// period. The rows of refunds have the total of their order in place of the
+// discount, and its taxes.
+func salesPeriods(sales, refunds *gorm.DB, interval string) ([]*SalesPeriodRow, error) {
+	aggregated := map[salesPeriodKey]*SalesPeriodRow{}
+	for _, refund := range []bool{false, true} {
+		query := sales
+		if refund {
+			query = refunds
+		}
+		rows, err := query.Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var day interface{}
+			var currency string
+			var count, amount, discount, taxes uint64
+			if err := rows.Scan(&day, &currency, &count, &amount, &discount, &taxes); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			when, err := parseDay(day)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			key := salesPeriodKey{periodStart(when, interval), currency}
+			row, ok := aggregated[key]
+			if !ok {
+				row = &SalesPeriodRow{Period: key.period, Currency: key.currency}
+				aggregated[key] = row
+			}
+			if refund {
+				row.Refunds += amount
+				row.refundedTaxes += taxShare(amount, taxes, discount)
+			} else {
+				row.Orders += count
+				row.Gross += amount
+				row.Discounts += discount
+				row.Taxes += taxes
+			}
+		}
+		rows.Close()
+	}
+
+	result := []*SalesPeriodRow{}
+	for _, row := range aggregated {
+		row.Net = int64(row.Gross) - int64(row.Taxes) - (int64(row.Refunds) - int64(row.refundedTaxes))
+		result = append(result, row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Period.Equal(result[j].Period) {
+			return result[i].Period.Before(result[j].Period)
+		}
+		return result[i].Currency < result[j].Currency
+	})
+	return result, nil
+}
+
+// parseDay reads the date(...) of a row, which is a time or a string
+// depending on the database
+func parseDay(value interface{}) (time.Time, error) {
+	switch day := value.(type) {
+	case time.Time:
+		return day, nil
+	case []byte:
+		return parseDay(string(day))
+	case string:
+		if len(day) >= 10 {
+			return time.Parse("2006-01-02", day[:10])
+		}
+	}
+	return time.Time{}, fmt.Errorf("Unexpected day %v", value)
+}
+
+// maxCachedReports is how many reports are kept at most, every query string
+// is a report of its own
+const maxCachedReports = 1000
+
+// reportCache keeps the reports computed for dashboards until they expire.
+// Expired reports are swept when a report is added, and the ones closest to
+// expiring make room when it's full.
+type reportCache struct {
+	mutex   sync.Mutex
+	entries map[string]*cachedReport
+}
+
+type cachedReport struct {
+	report    interface{}
+	expiresAt time.Time
+}
+
+func newReportCache() *reportCache {
+	return &reportCache{entries: map[string]*cachedReport{}}
+}
+
+func (c *reportCache) get(key string, now time.Time) interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached := c.entries[key]
+	if cached == nil {
+		return nil
+	}
+	if now.After(cached.expiresAt) {
+		delete(c.entries, key)
+		return nil
+	}
+	return cached.report
+}
+
+func (c *reportCache) put(key string, report interface{}, expiresAt time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	for k, cached := range c.entries {
+		if now.After(cached.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	for len(c.entries) >= maxCachedReports {
+		first := ""
+		for k, cached := range c.entries {
+			if first == "" || cached.expiresAt.Before(c.entries[first].expiresAt) {
+				first = k
+			}
+		}
+		delete(c.entries, first)
+	}
+	c.entries[key] = &cachedReport{report: report, expiresAt: expiresAt}
+}
+
+// ProductsReport lists the products sold within a period, best sellers
+// first, with the units sold and their revenue by currency. With
+// `?group_by=type` the products are added up by product type. Use
+// `?format=csv` for a CSV export.
 func (a *API) ProductsReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := r.URL.Query()
 	ordersTable := models.Order{}.TableName()
 	itemsTable := models.LineItem{}.TableName()
-	query := a.db.
+	query := a.dbFor(ctx).
 		Model(&models.LineItem{}).
-		Select("sku, path, sum(quantity * price) as total, currency").
 		Joins("JOIN " + ordersTable + " as orders " + "ON orders.id = " + itemsTable + ".order_id " + "AND orders.payment_state = 'paid'").
-		Group("sku, path, currency").
 		Order("total desc")
 
-	from, to, err := getTimeQueryParams(r.URL.Query())
+	switch groupBy := params.Get("group_by"); groupBy {
+	case "", "sku":
+		query = query.
+			Select("sku, path, type, sum(quantity) as units, sum(quantity * price) as total, currency").
+			Group("sku, path, type, currency")
+	case "type":
+		query = query.
+			Select("'' as sku, '' as path, type, sum(quantity) as units, sum(quantity * price) as total, currency").
+			Group("type, currency")
+	default:
+		badRequestError(w, "bad value for 'group_by' parameter '%v', must be sku or type", groupBy)
+		return
+	}
+
+	from, to, err := getTimeQueryParams(params)
 	if err != nil {
 		badRequestError(w, err.Error())
 		return
@@ -75,11 +414,12 @@ func (a *API) ProductsReport(ctx context.Context, w http.ResponseWriter, r *http
 		query = query.Where("orders.created_at >= ?", from)
 	}
 	if to != nil {
-		query.Where("orders.created_at <= ?", to)
+		query = query.Where("orders.created_at <= ?", to)
 	}
 
 	rows, err := query.Rows()
 	if err != nil {
+		log.WithError(err).Warn("Error while querying for the products report")
 		internalServerError(w, "Database error: %v", err)
 		return
 	}
@@ -87,13 +427,516 @@ func (a *API) ProductsReport(ctx context.Context, w http.ResponseWriter, r *http
 	result := []*ProductsRow{}
 	for rows.Next() {
 		row := &ProductsRow{}
-		err = rows.Scan(&row.Sku, &row.Path, &row.Total, &row.Currency)
+		var productType sql.NullString
+		err = rows.Scan(&row.Sku, &row.Path, &productType, &row.Units, &row.Total, &row.Currency)
 		if err != nil {
 			internalServerError(w, "Database error: %v", err)
 			return
 		}
+		row.Type = productType.String
 		result = append(result, row)
 	}
 
+	if !wantsCSV(r) {
+		sendJSON(w, 200, result)
+		return
+	}
+
+	records := [][]string{{"sku", "path", "type", "currency", "units", "total"}}
+	for _, row := range result {
+		records = append(records, []string{
+			row.Sku,
+			row.Path,
+			row.Type,
+			row.Currency,
+			strconv.FormatUint(row.Units, 10),
+			strconv.FormatUint(row.Total, 10),
+		})
+	}
+	if err := sendCSV(w, "products.csv", records); err != nil {
+		log.WithError(err).Warn("Failed to write CSV report")
+	}
+}
+
+// CancellationsReport aggregates cancelled orders and refunds by reason code for
+// each period. Periods are grouped by the `interval` parameter (default month).
+func (a *API) CancellationsReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	interval, err := getIntervalQueryParam(params)
+	if err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+	from, to, err := getTimeQueryParams(params)
+	if err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+
+	cancellations := a.dbFor(ctx).
+		Model(&models.Order{}).
+		Select("cancellation_reason, cancelled_at, total, currency").
+		Where("state = ?", models.CancelledState)
+	refunds := a.dbFor(ctx).
+		Model(&models.Transaction{}).
+		Select("reason, created_at, amount, currency").
+		Where("type = ? AND status = ?", models.RefundTransactionType, models.PaidState)
+	if from != nil {
+		cancellations = cancellations.Where("cancelled_at >= ?", from)
+		refunds = refunds.Where("created_at >= ?", from)
+	}
+	if to != nil {
+		cancellations = cancellations.Where("cancelled_at <= ?", to)
+		refunds = refunds.Where("created_at <= ?", to)
+	}
+
+	aggregated := map[cancellationsKey]*CancellationsRow{}
+	for kind, query := range map[string]*gorm.DB{"cancellation": cancellations, "refund": refunds} {
+		rows, err := query.Rows()
+		if err != nil {
+			internalServerError(w, "Database error: %v", err)
+			return
+		}
+		for rows.Next() {
+			var reason sql.NullString
+			var when time.Time
+			var amount uint64
+			var currency string
+			if err := rows.Scan(&reason, &when, &amount, &currency); err != nil {
+				rows.Close()
+				internalServerError(w, "Database error: %v", err)
+				return
+			}
+			key := cancellationsKey{periodStart(when, interval), kind, reason.String, currency}
+			if key.reason == "" {
+				key.reason = unspecifiedReason
+			}
+			row, ok := aggregated[key]
+			if !ok {
+				row = &CancellationsRow{Period: key.period, Type: key.kind, Reason: key.reason, Currency: key.currency}
+				aggregated[key] = row
+			}
+			row.Count++
+			row.Amount += amount
+		}
+		rows.Close()
+	}
+
+	result := []*CancellationsRow{}
+	for _, row := range aggregated {
+		result = append(result, row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Period.Equal(result[j].Period) {
+			return result[i].Period.Before(result[j].Period)
+		}
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		if result[i].Reason != result[j].Reason {
+			return result[i].Reason < result[j].Reason
+		}
+		return result[i].Currency < result[j].Currency
+	})
+
 	sendJSON(w, 200, result)
 }
+
+// TaxLiabilityReport summarizes the tax collected per jurisdiction (the country
+// taxes were calculated for) and the period the orders were paid in, like the
+// tax summary. Taxes are taken from the orders as they were charged, so rate
+// changes don't affect past periods, and refunds reduce
+// the liability of the period they were issued in by their share of the tax.
+// Sales and revenue are net of taxes. Use `?format=csv` for a CSV export.
+func (a *API) TaxLiabilityReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := r.URL.Query()
+	interval, err := getIntervalQueryParam(params)
+	if err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+	from, to, err := getTimeQueryParams(params)
+	if err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+
+	ordersTable := models.Order{}.TableName()
+	addressTable := models.Address{}.TableName()
+	transactionsTable := models.Transaction{}.TableName()
+	shippingJoin := "LEFT JOIN " + addressTable + " as shipping_address ON shipping_address.id = " + ordersTable + ".shipping_address_id"
+	// orders from before the tax basis was recorded were taxed by their shipping address
+	taxCountry := "COALESCE(NULLIF(" + ordersTable + ".tax_country, ''), shipping_address.country)"
+
+	sales := joinCharge(a.dbFor(ctx).Model(&models.Order{})).
+		Select("charge.created_at, "+ordersTable+".created_at, "+taxCountry+", "+ordersTable+".currency, "+ordersTable+".total, "+ordersTable+".taxes, "+ordersTable+".total").
+		Joins(shippingJoin).
+		Where(ordersTable+".payment_state = ?", models.PaidState)
+	refunds := a.dbFor(ctx).
+		Model(&models.Transaction{}).
+		Select(transactionsTable+".created_at, "+transactionsTable+".created_at, "+taxCountry+", "+transactionsTable+".currency, "+transactionsTable+".amount, "+ordersTable+".taxes, "+ordersTable+".total").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+transactionsTable+".order_id").
+		Joins(shippingJoin).
+		Where(transactionsTable+".type = ? AND "+transactionsTable+".status = ?", models.RefundTransactionType, models.PaidState)
+	if from != nil {
+		sales = sales.Where(paidAt+" >= ?", from)
+		refunds = refunds.Where(transactionsTable+".created_at >= ?", from)
+	}
+	if to != nil {
+		sales = sales.Where(paidAt+" <= ?", to)
+		refunds = refunds.Where(transactionsTable+".created_at <= ?", to)
+	}
+
+	aggregated := map[taxLiabilityKey]*TaxLiabilityRow{}
+	for _, refund := range []bool{false, true} {
+		query := sales
+		if refund {
+			query = refunds
+		}
+		rows, err := query.Rows()
+		if err != nil {
+			log.WithError(err).Warn("Error while querying for tax liability")
+			internalServerError(w, "Database error: %v", err)
+			return
+		}
+		for rows.Next() {
+			var paid *time.Time
+			var created time.Time
+			var country sql.NullString
+			var currency string
+			var amount, taxes, total uint64
+			if err := rows.Scan(&paid, &created, &country, &currency, &amount, &taxes, &total); err != nil {
+				rows.Close()
+				internalServerError(w, "Database error: %v", err)
+				return
+			}
+			if paid == nil {
+				paid = &created
+			}
+
+			key := taxLiabilityKey{periodStart(*paid, interval), country.String, currency}
+			row, ok := aggregated[key]
+			if !ok {
+				row = &TaxLiabilityRow{Period: key.period, Country: key.country, Currency: key.currency}
+				aggregated[key] = row
+			}
+
+			tax := taxes
+			if refund {
+				tax = taxShare(amount, taxes, total)
+				row.RefundedSales += amount - tax
+				row.RefundedTaxes += tax
+			} else {
+				row.Orders++
+				row.Sales += amount - tax
+				row.Taxes += tax
+			}
+		}
+		rows.Close()
+	}
+
+	result := []*TaxLiabilityRow{}
+	for _, row := range aggregated {
+		row.NetRevenue = int64(row.Sales) - int64(row.RefundedSales)
+		row.TaxLiability = int64(row.Taxes) - int64(row.RefundedTaxes)
+		result = append(result, row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Period.Equal(result[j].Period) {
+			return result[i].Period.Before(result[j].Period)
+		}
+		if result[i].Country != result[j].Country {
+			return result[i].Country < result[j].Country
+		}
+		return result[i].Currency < result[j].Currency
+	})
+
+	if !wantsCSV(r) {
+		sendJSON(w, 200, result)
+		return
+	}
+
+	records := [][]string{{"period", "country", "currency", "orders", "sales", "taxes", "refunded_sales", "refunded_taxes", "net_revenue", "tax_liability"}}
+	for _, row := range result {
+		records = append(records, []string{
+			row.Period.Format("2006-01-02"),
+			row.Country,
+			row.Currency,
+			strconv.FormatUint(row.Orders, 10),
+			strconv.FormatUint(row.Sales, 10),
+			strconv.FormatUint(row.Taxes, 10),
+			strconv.FormatUint(row.RefundedSales, 10),
+			strconv.FormatUint(row.RefundedTaxes, 10),
+			strconv.FormatInt(row.NetRevenue, 10),
+			strconv.FormatInt(row.TaxLiability, 10),
+		})
+	}
+	if err := sendCSV(w, "tax_liability.csv", records); err != nil {
+		log.WithError(err).Warn("Failed to write CSV report")
+	}
+}
+
+// TaxSummaryReport sums up the taxable sales and the taxes collected of the
+// orders paid in each period (the `interval` parameter, month by default)
+// by the country they were taxed for and the rate, for filing returns.
+// Refunds reduce the period they were issued in by their share of each
+// rate. The taxes are the ones the calculator split by rate when the orders
+// were placed, orders placed before it did are left out. Use
+// `?format=csv` for a CSV export.
+func (a *API) TaxSummaryReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := r.URL.Query()
+	interval, err := getIntervalQueryParam(params)
+	if err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+	from, to, err := getTimeQueryParams(params)
+	if err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+
+	ordersTable := models.Order{}.TableName()
+	taxesTable := models.OrderTax{}.TableName()
+	transactionsTable := models.Transaction{}.TableName()
+	sales := paidOrderTaxes(a.dbFor(ctx)).
+		Select("charge.created_at, " + ordersTable + ".created_at, " + taxesTable + ".country, " + taxesTable + ".percentage, " + ordersTable + ".currency, sum(" + taxesTable + ".net), sum(" + taxesTable + ".taxes)").
+		Group(taxesTable + ".order_id, charge.created_at, " + ordersTable + ".created_at, " + taxesTable + ".country, " + taxesTable + ".percentage, " + ordersTable + ".currency")
+	refunds := refundedOrderTaxes(a.dbFor(ctx)).
+		Select(transactionsTable + ".created_at, " + taxesTable + ".country, " + taxesTable + ".percentage, " + ordersTable + ".currency, " + transactionsTable + ".amount, " + taxesTable + ".net, " + taxesTable + ".taxes, " + ordersTable + ".total")
+	if from != nil {
+		sales = sales.Where(paidAt+" >= ?", from)
+		refunds = refunds.Where(transactionsTable+".created_at >= ?", from)
+	}
+	if to != nil {
+		sales = sales.Where(paidAt+" <= ?", to)
+		refunds = refunds.Where(transactionsTable+".created_at <= ?", to)
+	}
+
+	aggregated := map[taxSummaryKey]*TaxSummaryRow{}
+	summaryRow := func(when time.Time, country string, rate uint64, currency string) *TaxSummaryRow {
+		key := taxSummaryKey{periodStart(when, interval), country, rate, currency}
+		row, ok := aggregated[key]
+		if !ok {
+			row = &TaxSummaryRow{Period: key.period, Country: key.country, Rate: key.rate, Currency: key.currency}
+			aggregated[key] = row
+		}
+		return row
+	}
+
+	rows, err := sales.Rows()
+	if err != nil {
+		log.WithError(err).Warn("Error while querying for the tax summary")
+		internalServerError(w, "Database error: %v", err)
+		return
+	}
+	for rows.Next() {
+		var paid *time.Time
+		var created time.Time
+		var country, currency string
+		var rate, net, taxes uint64
+		if err := rows.Scan(&paid, &created, &country, &rate, &currency, &net, &taxes); err != nil {
+			rows.Close()
+			internalServerError(w, "Database error: %v", err)
+			return
+		}
+		if paid == nil {
+			paid = &created
+		}
+		row := summaryRow(*paid, country, rate, currency)
+		row.Orders++
+		row.TaxableSales += net
+		row.TaxCollected += taxes
+	}
+	rows.Close()
+
+	rows, err = refunds.Rows()
+	if err != nil {
+		log.WithError(err).Warn("Error while querying for the refunds of the tax summary")
+		internalServerError(w, "Database error: %v", err)
+		return
+	}
+	for rows.Next() {
+		var when time.Time
+		var country, currency string
+		var rate, amount, net, taxes, total uint64
+		if err := rows.Scan(&when, &country, &rate, &currency, &amount, &net, &taxes, &total); err != nil {
+			rows.Close()
+			internalServerError(w, "Database error: %v", err)
+			return
+		}
+		row := summaryRow(when, country, rate, currency)
+		row.RefundedSales += taxShare(amount, net, total)
+		row.RefundedTaxes += taxShare(amount, taxes, total)
+	}
+	rows.Close()
+
+	result := []*TaxSummaryRow{}
+	for _, row := range aggregated {
+		row.NetSales = int64(row.TaxableSales) - int64(row.RefundedSales)
+		row.NetTaxes = int64(row.TaxCollected) - int64(row.RefundedTaxes)
+		result = append(result, row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Period.Equal(result[j].Period) {
+			return result[i].Period.Before(result[j].Period)
+		}
+		if result[i].Country != result[j].Country {
+			return result[i].Country < result[j].Country
+		}
+		if result[i].Rate != result[j].Rate {
+			return result[i].Rate < result[j].Rate
+		}
+		return result[i].Currency < result[j].Currency
+	})
+
+	if !wantsCSV(r) {
+		sendJSON(w, 200, result)
+		return
+	}
+
+	records := [][]string{{"period", "country", "rate", "currency", "orders", "taxable_sales", "tax_collected", "refunded_sales", "refunded_taxes", "net_sales", "net_taxes"}}
+	for _, row := range result {
+		records = append(records, []string{
+			row.Period.Format("2006-01-02"),
+			row.Country,
+			strconv.FormatUint(row.Rate, 10),
+			row.Currency,
+			strconv.FormatUint(row.Orders, 10),
+			strconv.FormatUint(row.TaxableSales, 10),
+			strconv.FormatUint(row.TaxCollected, 10),
+			strconv.FormatUint(row.RefundedSales, 10),
+			strconv.FormatUint(row.RefundedTaxes, 10),
+			strconv.FormatInt(row.NetSales, 10),
+			strconv.FormatInt(row.NetTaxes, 10),
+		})
+	}
+	if err := sendCSV(w, "taxes.csv", records); err != nil {
+		log.WithError(err).Warn("Failed to write CSV report")
+	}
+}
+
+// paidAt is when an order was paid: when it was charged, or when it was
+// placed if it was paid without a charge
+var paidAt = "COALESCE(charge.created_at, " + models.Order{}.TableName() + ".created_at)"
+
+// paidOrderTaxes queries the taxes by rate of the paid orders, joined with
+// the orders and their charges for paidAt
+func paidOrderTaxes(db *gorm.DB) *gorm.DB {
+	ordersTable := models.Order{}.TableName()
+	taxesTable := models.OrderTax{}.TableName()
+	query := db.Model(&models.OrderTax{}).
+		Joins("JOIN " + ordersTable + " ON " + ordersTable + ".id = " + taxesTable + ".order_id")
+	return joinCharge(query).Where(ordersTable+".payment_state = ?", models.PaidState)
+}
+
+// joinCharge joins a query of orders with their charge as `charge`, for
+// paidAt
+func joinCharge(query *gorm.DB) *gorm.DB {
+	return query.Joins("LEFT JOIN "+models.Transaction{}.TableName()+" charge ON charge.order_id = "+models.Order{}.TableName()+".id AND charge.type = ? AND charge.status IN (?, ?)",
+		models.ChargeTransactionType, models.PendingState, models.PaidState)
+}
+
+// refundedOrderTaxes queries the taxes by rate of the orders joined with
+// every refund paid on them, so each refund can be split by rate
+func refundedOrderTaxes(db *gorm.DB) *gorm.DB {
+	ordersTable := models.Order{}.TableName()
+	taxesTable := models.OrderTax{}.TableName()
+	transactionsTable := models.Transaction{}.TableName()
+	return db.Model(&models.Transaction{}).
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+transactionsTable+".order_id").
+		Joins("JOIN "+taxesTable+" ON "+taxesTable+".order_id = "+ordersTable+".id").
+		Where(transactionsTable+".type = ? AND "+transactionsTable+".status = ?", models.RefundTransactionType, models.PaidState)
+}
+
+// CouponsReport lists the coupons used on the orders paid within a period,
+// with the discount they gave, the revenue of the orders and their average
+// value, by currency. Revenue is the order totals, after the discount. Use
+// `?format=csv` for a CSV export.
+func (a *API) CouponsReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).
+		Model(&models.Order{}).
+		Select("coupon_code, currency, count(*) as redemptions, sum(discount) as discount, sum(total) as revenue").
+		Where("payment_state = ? AND coupon_code <> ?", models.PaidState, "").
+		Group("coupon_code, currency").
+		Order("revenue desc, coupon_code")
+
+	query, err := parseTimeQueryParams(query, r.URL.Query())
+	if err != nil {
+		badRequestError(w, err.Error())
+		return
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		log.WithError(err).Warn("Error while querying for the coupons report")
+		internalServerError(w, "Database error: %v", err)
+		return
+	}
+	defer rows.Close()
+	result := []*CouponsRow{}
+	for rows.Next() {
+		row := &CouponsRow{}
+		if err := rows.Scan(&row.Code, &row.Currency, &row.Redemptions, &row.Discount, &row.Revenue); err != nil {
+			internalServerError(w, "Database error: %v", err)
+			return
+		}
+		if row.Redemptions > 0 {
+			row.AverageOrderValue = (row.Revenue + row.Redemptions/2) / row.Redemptions
+		}
+		result = append(result, row)
+	}
+
+	if !wantsCSV(r) {
+		sendJSON(w, 200, result)
+		return
+	}
+
+	records := [][]string{{"code", "currency", "redemptions", "discount", "revenue", "average_order_value"}}
+	for _, row := range result {
+		records = append(records, []string{
+			row.Code,
+			row.Currency,
+			strconv.FormatUint(row.Redemptions, 10),
+			strconv.FormatUint(row.Discount, 10),
+			strconv.FormatUint(row.Revenue, 10),
+			strconv.FormatUint(row.AverageOrderValue, 10),
+		})
+	}
+	if err := sendCSV(w, "coupons.csv", records); err != nil {
+		log.WithError(err).Warn("Failed to write CSV report")
+	}
+}
+
+// taxShare is the part of a refund that was taxes on the original order
+func taxShare(amount, taxes, total uint64) uint64 {
+	if total == 0 {
+		return 0
+	}
+	if amount > total {
+		amount = total
+	}
+	return uint64(float64(amount)*float64(taxes)/float64(total) + 0.5)
+}
+
+// periodStart truncates a time to the start of the report interval it falls in.
+// Weeks start on monday and all periods are in UTC.
+func periodStart(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch interval {
+	case "day":
+		return day
+	case "week":
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "quarter":
+		return time.Date(t.Year(), t.Month()-(t.Month()-1)%3, 1, 0, 0, 0, 0, time.UTC)
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
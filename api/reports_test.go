@@ -0,0 +1,360 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestTaxLiabilityReport(t *testing.T) {
+	db, config := db(t)
+	loadTaxedSale(db)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/reports/tax_liability?interval=year", nil)
+	NewAPI(config, db, nil, nil, nil).TaxLiabilityReport(ctx, w, r)
+
+	rows := []TaxLiabilityRow{}
+	extractPayload(t, 200, w, &rows)
+	if assert.Len(t, rows, 1) {
+		row := rows[0]
+		assert.Equal(t, testAddress.Country, row.Country)
+		assert.Equal(t, "usd", row.Currency)
+		assert.EqualValues(t, 1, row.Orders)
+		assert.EqualValues(t, 100, row.Sales)
+		assert.EqualValues(t, 20, row.Taxes)
+		assert.EqualValues(t, 50, row.RefundedSales)
+		assert.EqualValues(t, 10, row.RefundedTaxes)
+		assert.EqualValues(t, 50, row.NetRevenue)
+		assert.EqualValues(t, 10, row.TaxLiability)
+	}
+}
+
+func TestTaxLiabilityReportByPaymentDate(t *testing.T) {
+	db, config := db(t)
+	loadTaxedSale(db)
+	placed := time.Date(2025, 12, 30, 12, 0, 0, 0, time.UTC)
+	paid := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	db.Model(firstOrder).UpdateColumn("created_at", placed)
+	db.Model(firstTransaction).UpdateColumn("created_at", paid)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/reports/tax_liability?interval=year&from=1767225600", nil)
+	NewAPI(config, db, nil, nil, nil).TaxLiabilityReport(ctx, w, r)
+
+	rows := []TaxLiabilityRow{}
+	extractPayload(t, 200, w, &rows)
+	sales := uint64(0)
+	for _, row := range rows {
+		if row.Orders > 0 {
+			assert.Equal(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), row.Period, "the sale is in the year it was paid in")
+		}
+		sales += row.Sales
+	}
+	assert.EqualValues(t, 100, sales)
+}
+
+func TestTaxLiabilityReportCSV(t *testing.T) {
+	db, config := db(t)
+	loadTaxedSale(db)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/reports/tax_liability?format=csv", nil)
+	NewAPI(config, db, nil, nil, nil).TaxLiabilityReport(ctx, w, r)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if assert.NoError(t, err) && assert.Len(t, records, 2) {
+		assert.Equal(t, "tax_liability", records[0][9])
+		assert.Equal(t, testAddress.Country, records[1][1])
+		assert.Equal(t, "10", records[1][9])
+	}
+}
+
+func TestTaxLiabilityReportAsNonAdmin(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken(testUser.ID, ""), config, false)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/reports/tax_liability", nil)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /reports/tax_liability", api.TaxLiabilityReport)(ctx, w, r)
+	validateError(t, 401, w)
+}
+
+// loadTaxedSale marks the first order as a paid sale of 100 + 20 in taxes,
+// half of which was refunded
+func loadTaxedSale(db *gorm.DB) {
+	db.Model(firstOrder).Updates(map[string]interface{}{
+		"payment_state": models.PaidState,
+		"total":         120,
+		"taxes":         20,
+	})
+
+	refund := models.NewTransaction(firstOrder)
+	refund.Type = models.RefundTransactionType
+	refund.Status = models.PaidState
+	refund.Amount = 60
+	db.Create(refund)
+}
+
+func TestSalesReportByVariant(t *testing.T) {
+	db, config := db(t)
+	db.Model(firstOrder).Updates(map[string]interface{}{"payment_state": models.PaidState, "experiment": "checkout", "variant": "a"})
+	db.Model(secondOrder).Updates(map[string]interface{}{"payment_state": models.PaidState, "experiment": "checkout", "variant": "b"})
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something/reports/sales?experiment=checkout", nil)
+	NewAPI(config, db, nil, nil, nil).SalesReport(ctx, w, r)
+
+	rows := []SalesRow{}
+	extractPayload(t, 200, w, &rows)
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, "a", rows[0].Variant)
+		assert.EqualValues(t, 1, rows[0].Orders)
+		assert.Equal(t, firstOrder.Total, rows[0].Total)
+		assert.Equal(t, "b", rows[1].Variant)
+		assert.Equal(t, secondOrder.Total, rows[1].Total)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://something/reports/sales", nil)
+	NewAPI(config, db, nil, nil, nil).SalesReport(ctx, w, r)
+
+	rows = []SalesRow{}
+	extractPayload(t, 200, w, &rows)
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, "", rows[0].Variant)
+		assert.EqualValues(t, 2, rows[0].Orders)
+		assert.Equal(t, firstOrder.Total+secondOrder.Total, rows[0].Total)
+	}
+}
+
+func TestProductsReport(t *testing.T) {
+	db, config := db(t)
+	db.Model(&models.Order{}).Where("id IN (?)", []string{firstOrder.ID, secondOrder.ID}).UpdateColumn("payment_state", models.PaidState)
+	db.Model(&models.LineItem{}).Where("id = ?", secondLineItem1.ID).UpdateColumn("type", "plane")
+	api := NewAPI(config, db, nil, nil, nil)
+
+	run := func(query string) *httptest.ResponseRecorder {
+		ctx := testContext(testToken("magical-unicorn", ""), config, true)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://something/reports/products"+query, nil)
+		guarded(t, api, "GET /reports/products", api.ProductsReport)(ctx, w, r)
+		return w
+	}
+
+	rows := []ProductsRow{}
+	extractPayload(t, http.StatusOK, run(""), &rows)
+	assert.Equal(t, []ProductsRow{
+		{Sku: secondLineItem2.Sku, Path: secondLineItem2.Path, Type: "clothes", Units: 1, Total: 45, Currency: "usd"},
+		{Sku: firstLineItem.Sku, Path: firstLineItem.Path, Type: "plane", Units: 2, Total: 24, Currency: "usd"},
+		{Sku: secondLineItem1.Sku, Path: secondLineItem1.Path, Type: "plane", Units: 2, Total: 10, Currency: "usd"},
+	}, rows, "best sellers come first")
+
+	rows = []ProductsRow{}
+	extractPayload(t, http.StatusOK, run("?group_by=type"), &rows)
+	assert.Equal(t, []ProductsRow{
+		{Type: "clothes", Units: 1, Total: 45, Currency: "usd"},
+		{Type: "plane", Units: 4, Total: 34, Currency: "usd"},
+	}, rows)
+
+	w := run("?group_by=type&format=csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if assert.NoError(t, err) && assert.Len(t, records, 3) {
+		assert.Equal(t, []string{"", "", "plane", "usd", "4", "34"}, records[2])
+	}
+
+	rows = []ProductsRow{}
+	extractPayload(t, http.StatusOK, run(fmt.Sprintf("?to=%d", time.Now().Add(-time.Hour).Unix())), &rows)
+	assert.Empty(t, rows, "the orders were placed after the period")
+
+	validateError(t, http.StatusBadRequest, run("?group_by=color"))
+}
+
+func TestCouponsReport(t *testing.T) {
+	db, config := db(t)
+	db.Model(firstOrder).Updates(map[string]interface{}{"payment_state": models.PaidState, "coupon_code": "SPRING", "discount": 100})
+	db.Model(secondOrder).Updates(map[string]interface{}{"payment_state": models.PaidState, "coupon_code": "SPRING", "discount": 300})
+	api := NewAPI(config, db, nil, nil, nil)
+
+	run := func(query string) *httptest.ResponseRecorder {
+		ctx := testContext(testToken("magical-unicorn", ""), config, true)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://something/reports/coupons"+query, nil)
+		guarded(t, api, "GET /reports/coupons", api.CouponsReport)(ctx, w, r)
+		return w
+	}
+
+	rows := []CouponsRow{}
+	extractPayload(t, http.StatusOK, run(""), &rows)
+	if assert.Len(t, rows, 1) {
+		revenue := firstOrder.Total + secondOrder.Total
+		assert.Equal(t, CouponsRow{
+			Code:              "SPRING",
+			Currency:          "usd",
+			Redemptions:       2,
+			Discount:          400,
+			Revenue:           revenue,
+			AverageOrderValue: (revenue + 1) / 2,
+		}, rows[0])
+	}
+
+	w := run("?format=csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if assert.NoError(t, err) && assert.Len(t, records, 2) {
+		assert.Equal(t, []string{"SPRING", "usd", "2", "400"}, records[1][:4])
+	}
+
+	rows = []CouponsRow{}
+	extractPayload(t, http.StatusOK, run(fmt.Sprintf("?from=%d", time.Now().Add(time.Hour).Unix())), &rows)
+	assert.Empty(t, rows)
+}
+
+func TestSalesPeriodsReport(t *testing.T) {
+	db, config := db(t)
+	loadTaxedSale(db)
+	db.Model(&models.Order{}).Where("id = ?", firstOrder.ID).UpdateColumns(map[string]interface{}{
+		"discount":   0,
+		"created_at": time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+	})
+	db.Model(&models.Order{}).Where("id = ?", secondOrder.ID).UpdateColumns(map[string]interface{}{
+		"payment_state": models.PaidState,
+		"total":         200,
+		"taxes":         0,
+		"discount":      50,
+		"created_at":    time.Date(2026, 3, 4, 18, 0, 0, 0, time.UTC),
+	})
+	db.Model(&models.Transaction{}).Where("type = ?", models.RefundTransactionType).UpdateColumn("created_at", time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC))
+	config.Reports.CacheTTL = time.Minute
+	api := NewAPI(config, db, nil, nil, nil)
+
+	run := func(query string) *httptest.ResponseRecorder {
+		ctx := testContext(testToken("magical-unicorn", ""), config, true)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://something/reports/sales/periods"+query, nil)
+		guarded(t, api, "GET /reports/sales/periods", api.SalesPeriodsReport)(ctx, w, r)
+		return w
+	}
+
+	rows := []SalesPeriodRow{}
+	extractPayload(t, http.StatusOK, run("?interval=week"), &rows)
+	assert.Equal(t, []SalesPeriodRow{
+		{Period: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), Currency: "usd", Orders: 2, Gross: 320, Discounts: 50, Taxes: 20, Net: 300},
+		{Period: time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC), Currency: "usd", Refunds: 60, Net: -60},
+	}, rows)
+
+	rows = []SalesPeriodRow{}
+	extractPayload(t, http.StatusOK, run(""), &rows)
+	assert.Equal(t, []SalesPeriodRow{
+		{Period: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), Currency: "usd", Orders: 2, Gross: 320, Discounts: 50, Taxes: 20, Refunds: 60, Net: 250},
+	}, rows, "the periods are months by default")
+
+	db.Model(&models.Order{}).Where("id = ?", secondOrder.ID).UpdateColumn("total", 300)
+	rows = []SalesPeriodRow{}
+	extractPayload(t, http.StatusOK, run(""), &rows)
+	if assert.Len(t, rows, 1) {
+		assert.EqualValues(t, 320, rows[0].Gross, "the report is cached")
+	}
+
+	w := run("?interval=day&format=csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if assert.NoError(t, err) && assert.Len(t, records, 4) {
+		assert.Equal(t, []string{"2026-03-04", "usd", "1", "300", "50", "0", "0", "300"}, records[2])
+	}
+
+	validateError(t, http.StatusBadRequest, run("?interval=fortnight"))
+}
+
+func TestTaxSummaryReport(t *testing.T) {
+	db, config := db(t)
+	startTestSite(config)
+	api := NewAPI(config, db, nil, nil, nil)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "https://not-real", strings.NewReader(`{
+		"email": "info@example.com",
+		"shipping_address": {
+			"first_name": "Test", "last_name": "User",
+			"address1": "Friedrichstraße 1",
+			"city": "Berlin", "country": "Germany", "zip": "10117"
+		},
+		"line_items": [{"path": "/bundle-product", "quantity": 2}]
+	}`))
+	api.OrderCreate(testContext(nil, config, false), recorder, req)
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+
+	taxes := []models.OrderTax{}
+	assert.NoError(t, db.Order("percentage").Find(&taxes, "order_id = ?", order.ID).Error)
+	if assert.Len(t, taxes, 2) {
+		assert.Equal(t, uint64(7), taxes[0].Percentage)
+		assert.Equal(t, uint64(1400), taxes[0].Net)
+		assert.Equal(t, uint64(98), taxes[0].Taxes)
+		assert.Equal(t, uint64(19), taxes[1].Percentage)
+		assert.Equal(t, uint64(114), taxes[1].Taxes)
+		assert.Equal(t, order.Taxes, taxes[0].Taxes+taxes[1].Taxes, "the rates add up to the taxes of the order")
+	}
+
+	run := func(query string) *httptest.ResponseRecorder {
+		ctx := testContext(testToken("magical-unicorn", ""), config, true)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://something/reports/taxes"+query, nil)
+		guarded(t, api, "GET /reports/taxes", api.TaxSummaryReport)(ctx, w, r)
+		return w
+	}
+
+	rows := []TaxSummaryRow{}
+	extractPayload(t, http.StatusOK, run(""), &rows)
+	assert.Empty(t, rows, "the order isn't paid")
+
+	db.Model(&models.Order{}).Where("id = ?", order.ID).UpdateColumn("payment_state", models.PaidState)
+	rows = []TaxSummaryRow{}
+	extractPayload(t, http.StatusOK, run("?interval=year"), &rows)
+	year := time.Date(time.Now().UTC().Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, []TaxSummaryRow{
+		{Period: year, Country: "Germany", Rate: 7, Currency: "USD", Orders: 1, TaxableSales: 1400, TaxCollected: 98, NetSales: 1400, NetTaxes: 98},
+		{Period: year, Country: "Germany", Rate: 19, Currency: "USD", Orders: 1, TaxableSales: 598, TaxCollected: 114, NetSales: 598, NetTaxes: 114},
+	}, rows)
+
+	refund := &models.Transaction{ID: "refund", OrderID: order.ID, Type: models.RefundTransactionType, Status: models.PaidState, Amount: order.Total, Currency: order.Currency}
+	assert.NoError(t, db.Create(refund).Error)
+	w := run("?format=csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if assert.NoError(t, err) && assert.Len(t, records, 3) {
+		assert.Equal(t, []string{"Germany", "19", "USD", "1", "598", "114", "598", "114", "0", "0"}, records[2][1:], "refunds are taken off")
+	}
+
+	validateError(t, http.StatusBadRequest, run("?interval=fortnight"))
+}
+
+func TestReportCacheIsBounded(t *testing.T) {
+	cache := newReportCache()
+	now := time.Now()
+	cache.put("expired", []*SalesPeriodRow{}, now.Add(-time.Minute))
+	for i := 0; i < maxCachedReports+10; i++ {
+		cache.put(fmt.Sprintf("report-%d", i), []*SalesPeriodRow{}, now.Add(time.Duration(i)*time.Second+time.Hour))
+	}
+	assert.Len(t, cache.entries, maxCachedReports)
+	assert.Nil(t, cache.entries["expired"], "expired reports are swept")
+	assert.Nil(t, cache.entries["report-0"], "the reports closest to expiring make room")
+	assert.NotNil(t, cache.get(fmt.Sprintf("report-%d", maxCachedReports+9), now))
+}
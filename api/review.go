@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// holdForReview holds an order the fraud scoring flagged instead of charging
+// it, and commits tx. The customer gets a 202 with the held order, without
+// its score.
+func (a *API) holdForReview(ctx context.Context, tx *gorm.DB, w http.ResponseWriter, order *models.Order, score *fraudScore) {
+	log := getLogger(ctx).WithField("order_id", order.ID)
+
+	order.PaymentState = models.ManualReviewState
+	order.RiskScore = score.Score
+	order.RiskReasons = strings.Join(score.Reasons, ",")
+	rsp := tx.Model(order).UpdateColumns(map[string]interface{}{
+		"user_id":       order.UserID,
+		"payment_state": order.PaymentState,
+		"risk_score":    order.RiskScore,
+		"risk_reasons":  order.RiskReasons,
+	})
+	if rsp.Error != nil {
+		tx.Rollback()
+		internalServerError(w, "Error holding the order for review: %v", rsp.Error)
+		return
+	}
+
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.UpdateEvent, UserID: order.UserID, Payload: order})
+	if rsp := batch.Commit(); rsp.Error != nil {
+		internalServerError(w, "Error holding the order for review: %v", rsp.Error)
+		return
+	}
+
+	log.WithField("risk_score", order.RiskScore).Warnf("Held the order for a review instead of charging it: %v", order.RiskReasons)
+	sendJSON(w, http.StatusAccepted, order)
+}
+
+// OrderRisk is the fraud score of an order and what its review decided. It's
+// only shown to staff, so customers don't learn which of their signals
+// tripped the scoring.
+type OrderRisk struct {
+	OrderID      string   `json:"order_id"`
+	PaymentState string   `json:"payment_state"`
+	RiskScore    int      `json:"risk_score"`
+	RiskReasons  []string `json:"risk_reasons"`
+	Review       string   `json:"review,omitempty"`
+}
+
+func orderRisk(order *models.Order) *OrderRisk {
+	risk := &OrderRisk{
+		OrderID:      order.ID,
+		PaymentState: order.PaymentState,
+		RiskScore:    order.RiskScore,
+		RiskReasons:  []string{},
+		Review:       order.Review,
+	}
+	if order.RiskReasons != "" {
+		risk.RiskReasons = strings.Split(order.RiskReasons, ",")
+	}
+	return risk
+}
+
+// OrderRiskView shows staff the fraud score of an order and its review
+func (a *API) OrderRiskView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	orderID := kami.Param(ctx, "order_id")
+	order := &models.Order{}
+	if rsp := a.dbFor(ctx).First(order, "id = ?", orderID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			notFoundError(w, "Failed to find order with id '%s'", orderID)
+		} else {
+			internalServerError(w, "Error while querying for order: %v", rsp.Error)
+		}
+		return
+	}
+	sendJSON(w, http.StatusOK, orderRisk(order))
+}
+
+// ReviewParams approve or reject an order held for review
+type ReviewParams struct {
+	Approve bool `json:"approve"`
+}
+
+// OrderReview decides on an order the fraud scoring held. An approved order
+// goes back to pending, and the customer can pay for it without it being
+// scored again. A rejected order fails, and can't be paid for.
+func (a *API) OrderReview(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	orderID := kami.Param(ctx, "order_id")
+	log := getLogger(ctx).WithField("order_id", orderID)
+	claims := getClaims(ctx)
+
+	params := new(ReviewParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		readError(w, "review params", err)
+		return
+	}
+
+	tx := a.dbFor(ctx).Begin()
+	order := &models.Order{}
+	rsp := models.LockOrder(tx, orderID)
+	if rsp.Error == nil {
+		rsp = orderQuery(tx).First(order, "id = ?", orderID)
+	}
+	if rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			notFoundError(w, "Failed to find order with id '%s'", orderID)
+		} else {
+			internalServerError(w, "Error while querying for order: %v", rsp.Error)
+		}
+		return
+	}
+
+	if order.PaymentState != models.ManualReviewState {
+		tx.Rollback()
+		badRequestError(w, "This order isn't waiting for a review")
+		return
+	}
+
+	// the audit records the risk view, the order doesn't show the review
+	before := models.Snapshot(orderRisk(order))
+	order.PaymentState, order.Review = models.PendingState, models.ApprovedReview
+	if !params.Approve {
+		order.PaymentState, order.Review = models.FailedState, models.RejectedReview
+	}
+	rsp = tx.Model(order).UpdateColumns(map[string]interface{}{
+		"payment_state": order.PaymentState,
+		"review":        order.Review,
+	})
+	if rsp.Error != nil {
+		tx.Rollback()
+		internalServerError(w, "Error reviewing the order: %v", rsp.Error)
+		return
+	}
+
+	models.LogEvent(tx, r.RemoteAddr, claims.ID, order.ID, models.EventUpdated, []string{"payment_state", "review"})
+	a.audit(ctx, tx, r, "order.review", "order", order.ID, before, models.Snapshot(orderRisk(order)))
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.UpdateEvent, UserID: order.UserID, Payload: order})
+	if rsp := batch.Commit(); rsp.Error != nil {
+		internalServerError(w, "Error reviewing the order: %v", rsp.Error)
+		return
+	}
+
+	log.WithField("review", order.Review).Info("Reviewed order")
+	sendJSON(w, http.StatusOK, orderRisk(order))
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/guregu/kami"
+)
+
+// CurrentVersion is the API version served on the legacy, unversioned paths
+const CurrentVersion = "v1"
+
+// router registers endpoints under a version prefix like `/v1`. The router for
+// the current version also aliases every endpoint to its unversioned path, so
+// clients that predate versioning keep working.
+type router struct {
+	api    *API
+	mux    *kami.Mux
+	prefix string
+	legacy bool
+}
+
+func newRouter(api *API, mux *kami.Mux, version string) *router {
+	return &router{
+		api:    api,
+		mux:    mux,
+		prefix: "/" + version,
+		legacy: version == CurrentVersion,
+	}
+}
+
+// Get registers a GET endpoint, served to the requests the policy allows
+func (r *router) Get(path string, p policy, handler kami.HandlerFunc) {
+	r.handle("GET", path, p, handler)
+}
+
+func (r *router) Post(path string, p policy, handler kami.HandlerFunc) {
+	r.handle("POST", path, p, handler)
+}
+
+func (r *router) Put(path string, p policy, handler kami.HandlerFunc) {
+	r.handle("PUT", path, p, handler)
+}
+
+func (r *router) Delete(path string, p policy, handler kami.HandlerFunc) {
+	r.handle("DELETE", path, p, handler)
+}
+
+func (r *router) handle(method, path string, p policy, fn kami.HandlerFunc) {
+	r.api.policies[method+" "+path] = p
+	handler := withRouteLogger(path, r.api.enforce(p, fn))
+	r.mux.Handle(method, r.prefix+path, handler)
+	if r.legacy {
+		r.mux.Handle(method, path, handler)
+	}
+}
+
+// withRouteLogger adds the route, and the order the route is about if any, to
+// the request logger
+func withRouteLogger(path string, fn kami.HandlerFunc) kami.HandlerFunc {
+	orderParam := ""
+	if strings.Contains(path, ":order_id") {
+		orderParam = "order_id"
+	} else if strings.HasPrefix(path, "/orders/:id") {
+		orderParam = "id"
+	}
+
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		log := getLogger(ctx).WithField("route", path)
+		if orderParam != "" {
+			log = log.WithField("order_id", kami.Param(ctx, orderParam))
+		}
+		fn(withLogger(ctx, log), w, r)
+	}
+}
@@ -0,0 +1,370 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/scheduler"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// ExpiredCancellation is the cancellation reason of the orders that expired
+// unpaid
+const ExpiredCancellation = "expired"
+
+// maxExpiredOrders is how many orders are expired per run
+const maxExpiredOrders = 100
+
+// maxPendingVATOrders is how many VAT numbers are checked again per run
+const maxPendingVATOrders = 100
+
+// settleChargesAfter is how long a charge has to be processing before it's
+// taken for one a crash left behind, unless twice the payment timeout is
+// longer
+const settleChargesAfter = 15 * time.Minute
+
+// maxSettledCharges is how many charges are settled per run
+const maxSettledCharges = 100
+
+// ScheduledTasks are the recurring tasks of the API. Refreshing the settings
+// is local, every process refreshes its own.
+func (a *API) ScheduledTasks() []*scheduler.Task {
+	schedule := a.currentConfig().Schedule
+	tasks := []*scheduler.Task{}
+	if a.currentConfig().Cancellations.ExpireAfter > 0 && !schedule.ExpireOrders.Disabled {
+		tasks = append(tasks, &scheduler.Task{
+			Name:     "expire_orders",
+			Interval: schedule.ExpireOrders.Interval,
+			Run:      a.expireOrders,
+		})
+	}
+	if !schedule.RefreshSettings.Disabled {
+		tasks = append(tasks, &scheduler.Task{
+			Name:     "refresh_settings",
+			Interval: schedule.RefreshSettings.Interval,
+			Local:    true,
+			Run:      a.refreshSettings,
+		})
+	}
+	if !schedule.RevalidateVAT.Disabled {
+		tasks = append(tasks, &scheduler.Task{
+			Name:     "revalidate_vat",
+			Interval: schedule.RevalidateVAT.Interval,
+			Run:      a.revalidateVAT,
+		})
+	}
+	if !schedule.SettleCharges.Disabled {
+		tasks = append(tasks, &scheduler.Task{
+			Name:     "settle_charges",
+			Interval: schedule.SettleCharges.Interval,
+			Run:      a.settleCharges,
+		})
+	}
+	return tasks
+}
+
+// expireOrders cancels the orders that have been unpaid for longer than
+// cancellations.expire_after and restocks what they took out of stock
+func (a *API) expireOrders(ctx context.Context, now time.Time) error {
+	log := a.log.WithField("task", "expire_orders")
+	db := models.WithContext(a.db, ctx)
+	orders := []*models.Order{}
+	rsp := orderQuery(db).
+		Where("payment_state = ? AND state = ?", models.PendingState, models.PendingState).
+		Where("updated_at < ?", now.Add(-a.currentConfig().Cancellations.ExpireAfter)).
+		Order("updated_at asc").
+		Limit(maxExpiredOrders).
+		Find(&orders)
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+
+	expired := 0
+	for _, order := range orders {
+		orderLog := log.WithField("order_id", order.ID)
+		tx := models.ForInstance(db, order.InstanceID).Begin()
+		// the lock waits for a payment that is checking the order, and a
+		// charge that is still processing keeps the order until it's done
+		if rsp := models.LockOrder(tx, order.ID); rsp.Error != nil {
+			tx.Rollback()
+			orderLog.WithError(rsp.Error).Warn("Problem while locking order to expire it")
+			continue
+		}
+		charging := 0
+		rsp := tx.Model(&models.Transaction{}).
+			Where("order_id = ? AND type = ? AND status = ?", order.ID, models.ChargeTransactionType, models.ProcessingState).
+			Count(&charging)
+		if rsp.Error != nil || charging > 0 {
+			tx.Rollback()
+			if rsp.Error != nil {
+				orderLog.WithError(rsp.Error).Warn("Problem while expiring order")
+			}
+			continue
+		}
+		// claim the order, it may have been paid or cancelled since
+		claim := tx.Model(&models.Order{}).
+			Where("id = ? AND payment_state = ? AND state = ?", order.ID, models.PendingState, models.PendingState).
+			Updates(map[string]interface{}{
+				"state":               models.CancelledState,
+				"cancellation_reason": ExpiredCancellation,
+				"cancelled_at":        &now,
+			})
+		if claim.Error != nil || claim.RowsAffected != 1 {
+			tx.Rollback()
+			if claim.Error != nil {
+				orderLog.WithError(claim.Error).Warn("Problem while expiring order")
+			}
+			continue
+		}
+		order.State = models.CancelledState
+		order.CancellationReason = ExpiredCancellation
+		order.CancelledAt = &now
+
+		if err := order.ReleaseInventory(tx); err != nil {
+			orderLog.WithError(err).Warn("Problem while restocking expired order")
+			tx.Rollback()
+			continue
+		}
+
+		models.LogEvent(tx, "", "", order.ID, models.EventUpdated, []string{"state", "cancellation_reason"})
+		batch := a.events.Begin(tx)
+		a.publish(ctx, batch, &events.Event{Type: webhooks.CancellationEvent, UserID: order.UserID, InstanceID: order.InstanceID, Payload: order})
+		a.publishStock(ctx, batch, order)
+		if rsp := batch.Commit(); rsp.Error != nil {
+			orderLog.WithError(rsp.Error).Warn("Problem while committing expired order")
+			continue
+		}
+		expired++
+	}
+	if expired > 0 {
+		log.Infof("Expired %d unpaid orders", expired)
+	}
+	return nil
+}
+
+// revalidateVAT checks the VAT numbers VIES couldn't check when their orders
+// were placed, with the settings of their instance. VIES answers for each
+// member state on its own, so once one can't be reached its numbers are left
+// for the next run while the others are still checked. An invalid number is
+// left to the staff, who get the order's update webhook.
+func (a *API) revalidateVAT(ctx context.Context, now time.Time) error {
+	log := a.log.WithField("task", "revalidate_vat")
+	db := models.WithContext(a.db, ctx)
+	orders := []*models.Order{}
+	rsp := orderQuery(db).
+		Where("vat_state = ?", models.VATPendingState).
+		Order("created_at asc").
+		Limit(maxPendingVATOrders).
+		Find(&orders)
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+
+	unavailable := map[string]bool{}
+	for _, order := range orders {
+		orderLog := log.WithField("order_id", order.ID)
+		memberState := vatMemberState(order.VATNumber)
+		if unavailable[memberState] {
+			continue
+		}
+		config, err := a.instanceConfig(order.InstanceID)
+		if err != nil {
+			orderLog.WithError(err).Warn("Failed to load the settings of the order's instance")
+			continue
+		}
+		response, err := a.checkVAT(config, order.VATNumber)
+		if vatUnavailable(err) {
+			orderLog.WithError(err).Infof("VIES still can't check VAT numbers of %s", memberState)
+			unavailable[memberState] = true
+			continue
+		}
+		order.VATState = models.VATValidState
+		if err != nil || !response.Valid {
+			order.VATState = models.VATInvalidState
+			orderLog.Warnf("The VAT number %s of a placed order is invalid", order.VATNumber)
+		}
+
+		tx := models.ForInstance(db, order.InstanceID).Begin()
+		rsp := tx.Model(order).UpdateColumn("vat_state", order.VATState)
+		if rsp.Error != nil {
+			tx.Rollback()
+			orderLog.WithError(rsp.Error).Warn("Problem while recording the VAT state")
+			continue
+		}
+		models.LogEvent(tx, "", "", order.ID, models.EventUpdated, []string{"vat_state"})
+		batch := a.events.Begin(tx)
+		a.publish(ctx, batch, &events.Event{Type: webhooks.UpdateEvent, UserID: order.UserID, InstanceID: order.InstanceID, Payload: order})
+		if rsp := batch.Commit(); rsp.Error != nil {
+			orderLog.WithError(rsp.Error).Warn("Problem while recording the VAT state")
+		}
+	}
+	return nil
+}
+
+// settleCharges looks up the charges left processing, by a crash or a
+// timeout between charging the customer and recording it, with their payment
+// provider. A charge that went through pays its order, unless the order was
+// cancelled or paid since and the charge is refunded, and one that didn't is
+// marked failed so the order can be paid again or expire.
+func (a *API) settleCharges(ctx context.Context, now time.Time) error {
+	log := a.log.WithField("task", "settle_charges")
+	db := models.WithContext(a.db, ctx)
+	after := settleChargesAfter
+	if timeout := 2 * a.currentConfig().Timeouts.Payments; timeout > after {
+		after = timeout
+	}
+	charges := []*models.Transaction{}
+	rsp := db.
+		Where("type = ? AND status = ?", models.ChargeTransactionType, models.ProcessingState).
+		Where("created_at < ?", now.Add(-after)).
+		Order("created_at asc").
+		Limit(maxSettledCharges).
+		Find(&charges)
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+
+	for _, tr := range charges {
+		trLog := log.WithFields(logrus.Fields{
+			"order_id":       tr.OrderID,
+			"transaction_id": tr.ID,
+		})
+		if err := a.settleCharge(withLogger(ctx, trLog), db, tr); err != nil {
+			trLog.WithError(err).Warn("Problem while settling a processing charge")
+		}
+	}
+	return nil
+}
+
+func (a *API) settleCharge(ctx context.Context, db *gorm.DB, tr *models.Transaction) error {
+	log := getLogger(ctx)
+	order := &models.Order{}
+	rsp := db.Select("payment_processor").First(order, "id = ?", tr.OrderID)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		return rsp.Error
+	}
+	charger, config, err := a.instanceCharger(ctx, tr.InstanceID, order.PaymentProcessor)
+	if err != nil {
+		return err
+	}
+	finder, ok := charger.(chargeFinder)
+	if !ok {
+		return fmt.Errorf("the payment provider can't look up charges")
+	}
+	processorID, err := finder.findCharge(ctx, tr)
+	if err != nil {
+		return err
+	}
+	ctx = withConfig(ctx, config)
+
+	tx := models.ForInstance(db, tr.InstanceID).Begin()
+	rsp = models.LockOrder(tx, tr.OrderID)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		tx.Rollback()
+		return rsp.Error
+	}
+	// the charge may have been recorded while it was looked up
+	current := &models.Transaction{}
+	if rsp := tx.First(current, "id = ?", tr.ID); rsp.Error != nil {
+		tx.Rollback()
+		return rsp.Error
+	}
+	if current.Status != models.ProcessingState {
+		tx.Rollback()
+		return nil
+	}
+
+	order = &models.Order{}
+	rsp = orderQuery(tx).First(order, "id = ?", tr.OrderID)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		tx.Rollback()
+		return rsp.Error
+	}
+	var reason string
+	switch {
+	case processorID == "":
+		tr.FailureCode = "500"
+		tr.FailureDescription = "the payment provider has no charge for the transaction"
+	case rsp.RecordNotFound():
+		reason = "the order was deleted while it was being paid"
+	case order.State == models.CancelledState:
+		reason = "the order was cancelled while it was being paid"
+	case order.PaymentState == models.PaidState:
+		reason = "the order was paid with another charge"
+	}
+	if reason != "" {
+		// the charge is given back like when a payment finds its order cancelled
+		if _, err := charger.refund(ctx, tr.Amount, processorID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to refund the charge of an order that can't take it: %v", err)
+		}
+		tr.FailureCode = "409"
+		tr.FailureDescription = reason
+	}
+
+	tr.ProcessorID = processorID
+	tr.Status = models.PendingState
+	if tr.FailureCode != "" {
+		tr.Status = models.FailedState
+	}
+	rsp = tx.Model(tr).UpdateColumns(map[string]interface{}{
+		"processor_id":        tr.ProcessorID,
+		"status":              tr.Status,
+		"failure_code":        tr.FailureCode,
+		"failure_description": tr.FailureDescription,
+	})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return rsp.Error
+	}
+
+	if tr.Status == models.FailedState {
+		// the coupon can be used again, for this order or another one
+		if order.ID != "" && order.PaymentState != models.PaidState {
+			if rsp := tx.Where("order_id = ?", order.ID).Delete(&models.CouponRedemption{}); rsp.Error != nil {
+				tx.Rollback()
+				return rsp.Error
+			}
+		}
+		log.Infof("Settled a processing charge as failed: %s", tr.FailureDescription)
+		return tx.Commit().Error
+	}
+	if err := a.recordPayment(ctx, tx, order, tr); err != nil {
+		return err
+	}
+	log.WithField("processor_id", processorID).Info("Settled a processing charge that paid its order")
+	return nil
+}
+
+// refreshSettings loads the settings of the sites in use again before they
+// expire, so requests don't wait for the sites
+func (a *API) refreshSettings(ctx context.Context, now time.Time) error {
+	a.settings.mutex.Lock()
+	urls := make([]string, 0, len(a.settings.entries))
+	for url := range a.settings.entries {
+		urls = append(urls, url)
+	}
+	a.settings.mutex.Unlock()
+
+	for _, url := range urls {
+		cached, ok := a.settings.get(url)
+		if !ok {
+			continue
+		}
+		loaded, err := a.fetchSettings(ctx, url, cached)
+		if err != nil {
+			a.log.WithError(err).WithField("url", url).Warn("Failed to refresh the site settings, using the ones loaded before")
+			continue
+		}
+		// the ttl of the site stays the same
+		loaded.expiresAt = loaded.loadedAt.Add(cached.expiresAt.Sub(cached.loadedAt))
+		a.settings.put(url, loaded)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+func TestExpireOrders(t *testing.T) {
+	db, config := db(t)
+	config.Cancellations.ExpireAfter = time.Hour
+	api := NewAPI(config, db, nil, nil, nil)
+	assert.NoError(t, db.Model(&models.Order{}).Where("id = ?", secondOrder.ID).UpdateColumn("payment_state", models.PaidState).Error)
+
+	cancelled := make(chan *events.Event, 10)
+	api.events.Subscribe(webhooks.CancellationEvent, func(e *events.Event) {
+		cancelled <- e
+	})
+
+	assert.NoError(t, api.expireOrders(context.Background(), time.Now()))
+	api.events.Wait()
+	assert.Len(t, cancelled, 0, "the orders are recent")
+
+	assert.NoError(t, api.expireOrders(context.Background(), time.Now().Add(2*time.Hour)))
+	api.events.Wait()
+	if assert.Len(t, cancelled, 1) {
+		assert.Equal(t, firstOrder.ID, (<-cancelled).OrderID)
+	}
+
+	order := &models.Order{}
+	db.First(order, "id = ?", firstOrder.ID)
+	assert.Equal(t, models.CancelledState, order.State)
+	assert.Equal(t, ExpiredCancellation, order.CancellationReason)
+	assert.NotNil(t, order.CancelledAt)
+	paid := &models.Order{}
+	db.First(paid, "id = ?", secondOrder.ID)
+	assert.Equal(t, models.PendingState, paid.State, "paid orders don't expire")
+
+	assert.NoError(t, api.expireOrders(context.Background(), time.Now().Add(3*time.Hour)))
+	api.events.Wait()
+	assert.Len(t, cancelled, 0)
+}
+
+func TestExpireOrdersWhileCharging(t *testing.T) {
+	db, config := db(t)
+	config.Cancellations.ExpireAfter = time.Hour
+	api := NewAPI(config, db, nil, nil, nil)
+	charge := models.NewTransaction(firstOrder)
+	charge.Status = models.ProcessingState
+	assert.NoError(t, db.Create(charge).Error)
+
+	assert.NoError(t, api.expireOrders(context.Background(), time.Now().Add(2*time.Hour)))
+	order := &models.Order{}
+	db.First(order, "id = ?", firstOrder.ID)
+	assert.Equal(t, models.PendingState, order.State, "orders that are being charged don't expire")
+}
+
+func TestScheduledTasks(t *testing.T) {
+	_, config := db(t)
+	api := NewAPI(config, nil, nil, nil, nil)
+	names := func() []string {
+		names := []string{}
+		for _, task := range api.ScheduledTasks() {
+			names = append(names, task.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"refresh_settings", "revalidate_vat", "settle_charges"}, names(), "orders don't expire unless configured")
+
+	config.Cancellations.ExpireAfter = 24 * time.Hour
+	assert.Equal(t, []string{"expire_orders", "refresh_settings", "revalidate_vat", "settle_charges"}, names())
+
+	config.Schedule.RefreshSettings.Disabled = true
+	config.Schedule.RevalidateVAT.Disabled = true
+	config.Schedule.SettleCharges.Disabled = true
+	assert.Equal(t, []string{"expire_orders"}, names())
+}
+
+type findProvider struct {
+	chargeProvider
+	found string
+}
+
+func (fp *findProvider) findCharge(ctx context.Context, tr *models.Transaction) (string, error) {
+	return fp.found, nil
+}
+
+func TestSettleCharges(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	charge := models.NewTransaction(firstOrder)
+	charge.Status = models.ProcessingState
+	assert.NoError(t, db.Create(charge).Error)
+	provider := &findProvider{found: "ch_settled"}
+	ctx := withPayer(context.Background(), StripeChargerType, provider)
+
+	assert.NoError(t, api.settleCharges(ctx, time.Now()))
+	tr := &models.Transaction{}
+	db.First(tr, "id = ?", charge.ID)
+	assert.Equal(t, models.ProcessingState, tr.Status, "the charge may still be in flight")
+
+	assert.NoError(t, api.settleCharges(ctx, time.Now().Add(time.Hour)))
+	api.events.Wait()
+	db.First(tr, "id = ?", charge.ID)
+	assert.Equal(t, models.PendingState, tr.Status)
+	assert.Equal(t, "ch_settled", tr.ProcessorID)
+	order := &models.Order{}
+	db.First(order, "id = ?", firstOrder.ID)
+	assert.Equal(t, models.PaidState, order.PaymentState)
+	assert.Empty(t, provider.refunded)
+}
+
+func TestSettleChargesNotFound(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	charge := models.NewTransaction(firstOrder)
+	charge.Status = models.ProcessingState
+	assert.NoError(t, db.Create(charge).Error)
+	ctx := withPayer(context.Background(), StripeChargerType, &findProvider{})
+
+	assert.NoError(t, api.settleCharges(ctx, time.Now().Add(time.Hour)))
+	tr := &models.Transaction{}
+	db.First(tr, "id = ?", charge.ID)
+	assert.Equal(t, models.FailedState, tr.Status)
+	order := &models.Order{}
+	db.First(order, "id = ?", firstOrder.ID)
+	assert.Equal(t, models.PendingState, order.PaymentState, "the order can be paid again")
+}
+
+func TestSettleChargesOfCancelledOrder(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	charge := models.NewTransaction(firstOrder)
+	charge.Status = models.ProcessingState
+	assert.NoError(t, db.Create(charge).Error)
+	assert.NoError(t, db.Model(&models.Order{}).Where("id = ?", firstOrder.ID).UpdateColumn("state", models.CancelledState).Error)
+	provider := &findProvider{found: "ch_settled"}
+	ctx := withPayer(context.Background(), StripeChargerType, provider)
+
+	assert.NoError(t, api.settleCharges(ctx, time.Now().Add(time.Hour)))
+	tr := &models.Transaction{}
+	db.First(tr, "id = ?", charge.ID)
+	assert.Equal(t, models.FailedState, tr.Status)
+	assert.Equal(t, "409", tr.FailureCode)
+	assert.Equal(t, []string{"ch_settled"}, provider.refunded)
+}
+
+func TestRefreshSettings(t *testing.T) {
+	var mutex sync.Mutex
+	percentage := 21
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fmt.Fprintf(w, `{"taxes": [{"percentage": %d, "product_types": ["book"]}]}`, percentage)
+	}))
+	defer site.Close()
+
+	db, config := db(t)
+	config.SiteURL = site.URL
+	config.Settings.TTL = time.Hour
+	api := NewAPI(config, db, nil, nil, nil)
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	settings, err := api.loadSettings(ctx)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 21, settings.Taxes[0].Percentage)
+	}
+
+	mutex.Lock()
+	percentage = 19
+	mutex.Unlock()
+	assert.NoError(t, api.refreshSettings(context.Background(), time.Now()))
+	cached, err := api.cachedSettings(ctx, false)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 19, cached.settings.Taxes[0].Percentage, "refreshed before the ttl")
+		assert.Equal(t, time.Hour, cached.expiresAt.Sub(cached.loadedAt))
+	}
+}
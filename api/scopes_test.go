@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+func TestRoleScopes(t *testing.T) {
+	db, config := db(t)
+	config.JWT.Secret = "secret"
+	config.JWT.AdminGroupName = "admin"
+	config.JWT.Roles = map[string][]string{
+		"support": {conf.ScopeOrdersRead, conf.ScopeUsersRead},
+		"finance": {conf.ScopeReportsRead, conf.ScopeRefundsCreate},
+	}
+	api := NewAPI(config, db, nil, nil, nil)
+
+	do := func(role, method, path, body string) int {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &JWTClaims{
+			ID:             "staff",
+			AppMetaData:    map[string]interface{}{"roles": []string{role}},
+			StandardClaims: &jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		})
+		signed, _ := token.SignedString([]byte(config.JWT.Secret))
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+signed)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// support staff can look at orders, but not change or refund them
+	assert.Equal(t, http.StatusOK, do("support", "GET", "/v1/orders/"+firstOrder.ID, ""))
+	assert.Equal(t, http.StatusOK, do("support", "GET", "/v1/users/all/orders", ""))
+	assert.Equal(t, http.StatusOK, do("support", "GET", "/v1/payments/"+firstTransaction.ID, ""))
+	assert.Equal(t, http.StatusOK, do("support", "GET", "/v1/users", ""))
+	assert.Equal(t, http.StatusUnauthorized, do("support", "POST", "/v1/payments/"+firstTransaction.ID+"/refund", `{"amount": 1, "reason": "other"}`))
+	assert.Equal(t, http.StatusUnauthorized, do("support", "PUT", "/v1/orders/"+firstOrder.ID, `{"fulfillment_state": "shipped"}`))
+	assert.Equal(t, http.StatusUnauthorized, do("support", "GET", "/v1/reports/sales", ""))
+	assert.Equal(t, http.StatusUnauthorized, do("support", "DELETE", "/v1/users/"+testUser.ID, ""))
+
+	// finance reads the reports
+	assert.Equal(t, http.StatusOK, do("finance", "GET", "/v1/reports/sales", ""))
+	assert.Equal(t, http.StatusOK, do("finance", "GET", "/v1/reports/tax_liability", ""))
+	assert.Equal(t, http.StatusUnauthorized, do("finance", "GET", "/v1/orders/"+firstOrder.ID, ""))
+	assert.Equal(t, http.StatusUnauthorized, do("finance", "GET", "/v1/users/all/orders", ""))
+
+	// endpoints no scope covers are still only for admins
+	assert.Equal(t, http.StatusUnauthorized, do("support", "GET", "/v1/config", ""))
+	assert.Equal(t, http.StatusOK, do("admin", "GET", "/v1/config", ""))
+	assert.Equal(t, http.StatusOK, do("admin", "GET", "/v1/reports/sales", ""))
+
+	// a role without a mapping grants nothing
+	assert.Equal(t, http.StatusUnauthorized, do("intern", "GET", "/v1/orders/"+firstOrder.ID, ""))
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netlify/gocommerce/calculator"
+)
+
+// settingsPath is where the site serves its commerce settings
+const settingsPath = "/gocommerce/settings.json"
+
+type cachedSettings struct {
+	settings  *calculator.Settings
+	loadedAt  time.Time
+	expiresAt time.Time
+	// etag and lastModified revalidate the settings once they expired, so
+	// they're only downloaded again when they changed
+	etag         string
+	lastModified string
+}
+
+// settingsCache holds the settings of the sites, by their URL
+type settingsCache struct {
+	mutex   sync.Mutex
+	entries map[string]*cachedSettings
+}
+
+func newSettingsCache() *settingsCache {
+	return &settingsCache{entries: map[string]*cachedSettings{}}
+}
+
+// SettingsResponse shows the settings in use and when they were loaded
+type SettingsResponse struct {
+	URL       string               `json:"url"`
+	Settings  *calculator.Settings `json:"settings"`
+	LoadedAt  time.Time            `json:"loaded_at"`
+	ExpiresAt time.Time            `json:"expires_at"`
+}
+
+// loadSettings returns the settings of the site, loaded again once they're
+// older than the settings ttl. The settings loaded before keep being used
+// while the site can't be reached.
+func (a *API) loadSettings(ctx context.Context) (*calculator.Settings, error) {
+	cached, err := a.cachedSettings(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return cached.settings, nil
+}
+
+func (a *API) cachedSettings(ctx context.Context, refresh bool) (*cachedSettings, error) {
+	config := getConfig(ctx)
+	url := config.SiteURL + settingsPath
+
+	cached, ok := a.settings.get(url)
+	if ok && !refresh && time.Now().Before(cached.expiresAt) {
+		return cached, nil
+	}
+
+	loaded, err := a.fetchSettings(ctx, url, cached)
+	if err != nil {
+		if ok && !refresh {
+			getLogger(ctx).WithError(err).Warn("Failed to refresh the site settings, using the ones loaded before")
+			return cached, nil
+		}
+		return nil, err
+	}
+	loaded.expiresAt = loaded.loadedAt.Add(config.Settings.TTL)
+	return a.settings.put(url, loaded), nil
+}
+
+func (c *settingsCache) get(url string) (*cachedSettings, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached, ok := c.entries[url]
+	return cached, ok
+}
+
+// put caches settings that were loaded without holding the lock, unless
+// settings loaded later got there first. It returns the settings it kept.
+func (c *settingsCache) put(url string, loaded *cachedSettings) *cachedSettings {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if cached, ok := c.entries[url]; ok && cached.loadedAt.After(loaded.loadedAt) {
+		return cached
+	}
+	c.entries[url] = loaded
+	return loaded
+}
+
+// fetchSettings loads the settings from url. Cached settings are only
+// downloaded again if they changed, and a site without settings has empty
+// ones. Any other answer is an error, so the settings loaded before stay.
+func (a *API) fetchSettings(ctx context.Context, url string, cached *cachedSettings) (*cachedSettings, error) {
+	header := http.Header{}
+	if cached != nil {
+		if cached.etag != "" {
+			header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := a.getWithHeader(ctx, url, header)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading site settings: %v", err)
+	}
+	defer resp.Body.Close()
+
+	loaded := &cachedSettings{settings: &calculator.Settings{}, loadedAt: time.Now()}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		loaded.settings = cached.settings
+		loaded.etag = cached.etag
+		loaded.lastModified = cached.lastModified
+	case resp.StatusCode == http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(loaded.settings); err != nil {
+			return nil, fmt.Errorf("Error parsing site settings: %v", err)
+		}
+		loaded.etag = resp.Header.Get("ETag")
+		loaded.lastModified = resp.Header.Get("Last-Modified")
+	case resp.StatusCode == http.StatusNotFound:
+	default:
+		return nil, fmt.Errorf("Error loading site settings: status %d", resp.StatusCode)
+	}
+	return loaded, nil
+}
+
+// SettingsView shows the settings of the site that are in use
+func (a *API) SettingsView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	a.sendSettings(ctx, w, false)
+}
+
+// SettingsRefresh loads the settings of the site again right away, for
+// changes that shouldn't wait for the settings ttl
+func (a *API) SettingsRefresh(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	a.sendSettings(ctx, w, true)
+}
+
+func (a *API) sendSettings(ctx context.Context, w http.ResponseWriter, refresh bool) {
+	log := getLogger(ctx)
+	cached, err := a.cachedSettings(ctx, refresh)
+	if err != nil {
+		log.WithError(err).Warn("Failed to load the site settings")
+		internalServerError(w, err.Error())
+		return
+	}
+	if refresh {
+		log.Info("Refreshed the site settings")
+	}
+	sendJSON(w, http.StatusOK, &SettingsResponse{
+		URL:       getConfig(ctx).SiteURL + settingsPath,
+		Settings:  cached.settings,
+		LoadedAt:  cached.loadedAt,
+		ExpiresAt: cached.expiresAt,
+	})
+}
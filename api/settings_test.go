@@ -0,0 +1,150 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettingsCache(t *testing.T) {
+	var mutex sync.Mutex
+	requests, conditional := 0, 0
+	percentage, failing := 21, 0
+	blocked := make(chan struct{})
+	close(blocked)
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		wait := blocked
+		mutex.Unlock()
+		<-wait
+		mutex.Lock()
+		defer mutex.Unlock()
+		assert.Equal(t, settingsPath, r.URL.Path)
+		requests++
+		if failing != 0 {
+			w.WriteHeader(failing)
+			return
+		}
+		etag := fmt.Sprintf(`"v%d"`, percentage)
+		if r.Header.Get("If-None-Match") == etag {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `{"taxes": [{"percentage": %d, "product_types": ["book"]}]}`, percentage)
+	}))
+	defer site.Close()
+
+	db, config := db(t)
+	config.SiteURL = site.URL
+	config.Settings.TTL = time.Hour
+	api := NewAPI(config, db, nil, nil, nil)
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+
+	settings, err := api.loadSettings(ctx)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 21, settings.Taxes[0].Percentage)
+	}
+	_, err = api.loadSettings(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests, "the settings are cached for the ttl")
+
+	t.Run("Refresh", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://something/settings/refresh", nil)
+		api.SettingsRefresh(ctx, w, r)
+		rsp := &SettingsResponse{}
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.EqualValues(t, 21, rsp.Settings.Taxes[0].Percentage)
+		assert.Equal(t, 1, conditional, "unchanged settings aren't downloaded again")
+
+		mutex.Lock()
+		percentage = 19
+		mutex.Unlock()
+		w = httptest.NewRecorder()
+		api.SettingsRefresh(ctx, w, r)
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.EqualValues(t, 19, rsp.Settings.Taxes[0].Percentage)
+		assert.Equal(t, site.URL+settingsPath, rsp.URL)
+		assert.True(t, rsp.ExpiresAt.After(rsp.LoadedAt))
+	})
+
+	t.Run("FetchWithoutLock", func(t *testing.T) {
+		mutex.Lock()
+		blocked = make(chan struct{})
+		mutex.Unlock()
+		done := make(chan struct{})
+		go func() {
+			api.cachedSettings(ctx, true)
+			close(done)
+		}()
+
+		// the cached settings are read while the site hasn't answered
+		cached, ok := api.settings.get(site.URL + settingsPath)
+		if assert.True(t, ok) {
+			assert.EqualValues(t, 19, cached.settings.Taxes[0].Percentage)
+		}
+		mutex.Lock()
+		close(blocked)
+		mutex.Unlock()
+		<-done
+	})
+
+	t.Run("SiteDown", func(t *testing.T) {
+		for _, status := range []int{http.StatusBadGateway, http.StatusForbidden} {
+			mutex.Lock()
+			failing = status
+			mutex.Unlock()
+			config.Settings.TTL = time.Nanosecond
+			api.settings.entries[site.URL+settingsPath].expiresAt = time.Now()
+
+			// the settings loaded before stand in for orders
+			settings, err := api.loadSettings(ctx)
+			if assert.NoError(t, err) {
+				assert.EqualValues(t, 19, settings.Taxes[0].Percentage, "status %d", status)
+			}
+			assert.NoError(t, api.refreshSettings(ctx, time.Now()))
+			settings, err = api.loadSettings(ctx)
+			if assert.NoError(t, err) {
+				assert.EqualValues(t, 19, settings.Taxes[0].Percentage, "status %d", status)
+			}
+
+			// while a refresh tells the site is down
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("POST", "http://something/settings/refresh", nil)
+			api.SettingsRefresh(ctx, w, r)
+			validateError(t, http.StatusInternalServerError, w)
+		}
+		config.Settings.TTL = time.Hour
+	})
+
+	t.Run("NoSettings", func(t *testing.T) {
+		mutex.Lock()
+		failing = http.StatusNotFound
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			failing = 0
+			mutex.Unlock()
+		}()
+
+		// a site without settings has empty ones
+		cached, err := api.cachedSettings(ctx, true)
+		if assert.NoError(t, err) {
+			assert.Empty(t, cached.settings.Taxes)
+		}
+	})
+
+	t.Run("NonAdmin", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://something/settings", nil)
+		guarded(t, api, "GET /settings", api.SettingsView)(testContext(testToken(testUser.ID, ""), config, false), w, r)
+		validateError(t, http.StatusUnauthorized, w)
+	})
+}
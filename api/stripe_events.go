@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+const (
+	stripeSignatureHeader = "Stripe-Signature"
+	// stripeEventTolerance is how old a Stripe event signature can be
+	stripeEventTolerance = 5 * time.Minute
+	maxStripeEventSize   = 1 << 20
+)
+
+var errStripeSignature = errors.New("Invalid Stripe signature")
+
+// stripeEvent is the part of a Stripe event GoCommerce looks at
+type stripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type stripeDispute struct {
+	ID       string `json:"id"`
+	Charge   string `json:"charge"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+	Reason   string `json:"reason"`
+	Status   string `json:"status"`
+}
+
+// Dispute is the payload of the dispute webhook, sent when a customer
+// disputes a charge with their bank and whenever the dispute changes
+type Dispute struct {
+	ID            string `json:"id"`
+	Event         string `json:"event"`
+	Status        string `json:"status"`
+	Reason        string `json:"reason"`
+	Amount        uint64 `json:"amount"`
+	Currency      string `json:"currency"`
+	TransactionID string `json:"transaction_id"`
+	OrderID       string `json:"order_id"`
+	UserID        string `json:"user_id,omitempty"`
+}
+
+func (d *Dispute) eventOrderID() string {
+	return d.OrderID
+}
+
+// StripeEvents receives the events Stripe sends to its webhook and turns the
+// disputes of charges into dispute webhooks
+func (a *API) StripeEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	secret := getConfig(ctx).Payment.Stripe.WebhookSecret
+	if secret == "" {
+		notFoundError(w, "Stripe events are not configured")
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxStripeEventSize))
+	if err != nil {
+		readError(w, "the event", err)
+		return
+	}
+	if err := verifyStripeSignature(secret, r.Header.Get(stripeSignatureHeader), body, time.Now()); err != nil {
+		log.WithError(err).Warn("Received Stripe event with a bad signature")
+		badRequestError(w, err.Error())
+		return
+	}
+
+	event := &stripeEvent{}
+	if err := json.Unmarshal(body, event); err != nil {
+		badRequestError(w, "Could not read the event: %v", err)
+		return
+	}
+	log = log.WithField("stripe_event", event.ID)
+	if !strings.HasPrefix(event.Type, "charge.dispute.") {
+		log.Debugf("Ignoring Stripe event of type %v", event.Type)
+		sendJSON(w, 200, map[string]string{})
+		return
+	}
+
+	dispute := &stripeDispute{}
+	if err := json.Unmarshal(event.Data.Object, dispute); err != nil {
+		badRequestError(w, "Could not read the dispute: %v", err)
+		return
+	}
+
+	charge := &models.Transaction{}
+	if rsp := a.dbFor(ctx).First(charge, "processor_id = ? AND type = ?", dispute.Charge, models.ChargeTransactionType); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			// not a charge made by this instance, nothing to do
+			log.Infof("Ignoring dispute of unknown charge %v", dispute.Charge)
+			sendJSON(w, 200, map[string]string{})
+		} else {
+			log.WithError(rsp.Error).Warn("Error while querying for disputed charge")
+			internalServerError(w, "Error during database query: %v", rsp.Error)
+		}
+		return
+	}
+
+	tx := a.dbFor(ctx).Begin()
+	models.LogEvent(tx, r.RemoteAddr, "", charge.OrderID, models.EventUpdated, []string{"dispute"})
+	batch := a.events.Begin(tx)
+	a.publish(ctx, batch, &events.Event{Type: webhooks.DisputeEvent, UserID: charge.UserID, Transaction: charge, Payload: &Dispute{
+		ID:            dispute.ID,
+		Event:         event.Type,
+		Status:        dispute.Status,
+		Reason:        dispute.Reason,
+		Amount:        dispute.Amount,
+		Currency:      dispute.Currency,
+		TransactionID: charge.ID,
+		OrderID:       charge.OrderID,
+		UserID:        charge.UserID,
+	}})
+	if rsp := batch.Commit(); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Problem while committing dispute")
+		internalServerError(w, "Error saving dispute")
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"order_id": charge.OrderID,
+		"status":   dispute.Status,
+	}).Warnf("Charge %v is disputed", charge.ID)
+	sendJSON(w, 200, map[string]string{})
+}
+
+// verifyStripeSignature checks the Stripe-Signature header, which has the
+// time the event was sent and HMACs of it and the body
+func verifyStripeSignature(secret, header string, body []byte, now time.Time) error {
+	var timestamp string
+	signatures := []string{}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errStripeSignature
+	}
+	if age := now.Sub(time.Unix(sent, 0)); age > stripeEventTolerance || age < -stripeEventTolerance {
+		return errStripeSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		actual, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(actual, expected) {
+			return nil
+		}
+	}
+	return errStripeSignature
+}
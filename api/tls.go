@@ -0,0 +1,46 @@
+package api
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// defaultAutocertCacheDir is where certificates from Let's Encrypt are kept
+// when no cache dir is configured
+const defaultAutocertCacheDir = "autocert"
+
+// tlsConfig returns the TLS config the API serves HTTPS with, or nil when TLS
+// isn't configured and the API serves plain HTTP
+func tlsConfig(config *conf.Configuration) (*tls.Config, error) {
+	settings := config.API.TLS
+	switch {
+	case len(settings.Autocert.Hosts) > 0:
+		cacheDir := settings.Autocert.CacheDir
+		if cacheDir == "" {
+			cacheDir = defaultAutocertCacheDir
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(settings.Autocert.Hosts...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      settings.Autocert.Email,
+		}
+		tlsConf := manager.TLSConfig()
+		tlsConf.MinVersion = tls.VersionTLS12
+		return tlsConf, nil
+	case settings.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading TLS certificate")
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	config := testConfig()
+	tlsConf, err := tlsConfig(config)
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConf, "plain HTTP without TLS settings")
+
+	dir, err := ioutil.TempDir("", "gocommerce-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config.API.TLS.CertFile, config.API.TLS.KeyFile = writeTestCertificate(t, dir)
+	tlsConf, err = tlsConfig(config)
+	if assert.NoError(t, err) && assert.NotNil(t, tlsConf) {
+		assert.Len(t, tlsConf.Certificates, 1)
+	}
+
+	config.API.TLS.CertFile = filepath.Join(dir, "missing.pem")
+	_, err = tlsConfig(config)
+	assert.Error(t, err)
+}
+
+func TestTLSConfigAutocert(t *testing.T) {
+	config := testConfig()
+	config.API.TLS.Autocert.Hosts = []string{"shop.example.com"}
+
+	tlsConf, err := tlsConfig(config)
+	if assert.NoError(t, err) && assert.NotNil(t, tlsConf) {
+		assert.NotNil(t, tlsConf.GetCertificate)
+		assert.Contains(t, tlsConf.NextProtos, "acme-tls/1")
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+const unsubscribedPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Unsubscribed</title></head>
+<body><p>You won't get any more reminders.</p></body></html>
+`
+
+// EmailUnsubscribe stops the reminders to the ?email of an unsubscribe link.
+// It takes POSTs too, for one-click unsubscribes from mail clients.
+func (a *API) EmailUnsubscribe(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	email := r.URL.Query().Get("email")
+	if !mailer.ValidUnsubscribeToken(getConfig(ctx).JWT.Secret, email, r.URL.Query().Get("token")) {
+		log.Info("Unsubscribe attempted with an invalid token")
+		badRequestError(w, "This unsubscribe link isn't valid")
+		return
+	}
+
+	if err := models.OptOut(a.dbFor(ctx), email); err != nil {
+		log.WithError(err).Warn("Failed to save opt out")
+		internalServerError(w, "Failed to unsubscribe")
+		return
+	}
+	log.Info("Unsubscribed from reminders")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(unsubscribedPage))
+}
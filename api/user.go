@@ -23,15 +23,9 @@ import (
 // user_id   id
 // limit     # of records to return (max)
 func (a *API) UserList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	_, _, httpErr := checkPermissions(ctx, true)
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
-
 	log := getLogger(ctx)
 
-	query, err := parseUserQueryParams(a.db, r.URL.Query())
+	query, err := parseUserQueryParams(a.dbFor(ctx), r.URL.Query())
 	if err != nil {
 		log.WithError(err).Info("Bad query parameters in request")
 		badRequestError(w, "Bad parameters in query: "+err.Error())
@@ -84,17 +78,13 @@ func (a *API) UserList(ctx context.Context, w http.ResponseWriter, r *http.Reque
 // UserView will return the user specified.
 // If you're an admin you can request a user that is not your self
 func (a *API) UserView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	userID, _, httpErr := checkPermissions(ctx, false)
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
+	userID, _ := userParams(ctx)
 	log := getLogger(ctx)
 
 	user := &models.User{
 		ID: userID,
 	}
-	rsp := a.db.First(user)
+	rsp := a.dbFor(ctx).First(user)
 	if rsp.RecordNotFound() {
 		notFoundError(w, "Couldn't find a record for "+userID)
 		return
@@ -110,28 +100,24 @@ func (a *API) UserView(ctx context.Context, w http.ResponseWriter, r *http.Reque
 	}
 
 	orders := []models.Order{}
-	a.db.Where("user_id = ?", user.ID).Find(&orders).Count(&user.OrderCount)
+	a.dbFor(ctx).Where("user_id = ?", user.ID).Find(&orders).Count(&user.OrderCount)
 
 	sendJSON(w, 200, user)
 }
 
 // AddressList will return the addresses for a given user
 func (a *API) AddressList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	userID, _, httpErr := checkPermissions(ctx, false)
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
+	userID, _ := userParams(ctx)
 
 	log := getLogger(ctx)
 
-	if getUser(a.db, userID) == nil {
+	if getUser(a.dbFor(ctx), userID) == nil {
 		log.WithError(notFoundError(w, "couldn't find a record for user: "+userID)).Warn("requested non-existent user")
 		return
 	}
 
 	addrs := []models.Address{}
-	results := a.db.Where("user_id = ?", userID).Find(&addrs)
+	results := a.dbFor(ctx).Where("user_id = ?", userID).Find(&addrs)
 	if results.Error != nil {
 		log.WithError(results.Error).Warn("failed to query for userID: " + userID)
 		internalServerError(w, "problem while querying for userID: "+userID)
@@ -143,15 +129,11 @@ func (a *API) AddressList(ctx context.Context, w http.ResponseWriter, r *http.Re
 
 // AddressView will return a particular address for a given user
 func (a *API) AddressView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	userID, addrID, httpErr := checkPermissions(ctx, false)
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
+	userID, addrID := userParams(ctx)
 
 	log := getLogger(ctx)
 
-	if getUser(a.db, userID) == nil {
+	if getUser(a.dbFor(ctx), userID) == nil {
 		log.WithError(notFoundError(w, "couldn't find a record for user: "+userID)).Warn("requested non-existent user")
 		return
 	}
@@ -160,7 +142,7 @@ func (a *API) AddressView(ctx context.Context, w http.ResponseWriter, r *http.Re
 		ID:     addrID,
 		UserID: userID,
 	}
-	results := a.db.First(addr)
+	results := a.dbFor(ctx).First(addr)
 	if results.Error != nil {
 		log.WithError(results.Error).Warn("failed to query for userID: " + userID)
 		internalServerError(w, "problem while querying for userID: "+userID)
@@ -173,22 +155,18 @@ func (a *API) AddressView(ctx context.Context, w http.ResponseWriter, r *http.Re
 // UserDelete will soft delete the user. It requires admin access
 // return errors or 200 and no body
 func (a *API) UserDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	userID, _, httpErr := checkPermissions(ctx, true)
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
+	userID, _ := userParams(ctx)
 	log := getLogger(ctx)
 	log.Debugf("Starting to delete user %s", userID)
 
-	user := getUser(a.db, userID)
+	user := getUser(a.dbFor(ctx), userID)
 	if user == nil {
 		log.Info("attempted to delete non-existent user")
 		return // not an error ~ just an action
 	}
 
 	// do a cascading delete
-	tx := a.db.Begin()
+	tx := a.dbFor(ctx).Begin()
 
 	results := tx.Delete(user)
 	if results.Error != nil {
@@ -239,6 +217,7 @@ func (a *API) UserDelete(ctx context.Context, w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	a.audit(ctx, tx, r, "user.delete", "user", userID, models.Snapshot(user), nil)
 	tx.Commit()
 	log.Infof("Deleted user")
 }
@@ -246,19 +225,15 @@ func (a *API) UserDelete(ctx context.Context, w http.ResponseWriter, r *http.Req
 // AddressDelete will soft delete the address associated with that user. It requires admin access
 // return errors or 200 and no body
 func (a *API) AddressDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	userID, addrID, httpErr := checkPermissions(ctx, true)
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
+	userID, addrID := userParams(ctx)
 	log := getLogger(ctx).WithField("addr_id", addrID)
 
-	if getUser(a.db, userID) == nil {
+	if getUser(a.dbFor(ctx), userID) == nil {
 		log.Warn("requested non-existent user - not an error b/c it is a delete")
 		return
 	}
 
-	rsp := a.db.Delete(&models.Address{ID: addrID})
+	rsp := a.dbFor(ctx).Delete(&models.Address{ID: addrID})
 	if rsp.RecordNotFound() {
 		log.Warn("Attempted to delete an address that doesn't exist")
 		return
@@ -268,19 +243,16 @@ func (a *API) AddressDelete(ctx context.Context, w http.ResponseWriter, r *http.
 		return
 	}
 
+	a.audit(ctx, a.dbFor(ctx), r, "address.delete", "address", addrID, nil, nil)
 	log.Info("deleted address")
 }
 
 // CreateNewAddress will create an address associated with that user
 func (a *API) CreateNewAddress(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	userID, _, httpErr := checkPermissions(ctx, true)
-	if httpErr != nil {
-		sendJSON(w, httpErr.Code, httpErr)
-		return
-	}
+	userID, _ := userParams(ctx)
 	log := getLogger(ctx)
 
-	if getUser(a.db, userID) == nil {
+	if getUser(a.dbFor(ctx), userID) == nil {
 		log.WithError(notFoundError(w, "Couldn't find user "+userID)).Warn("Requested to add an address to a missing user")
 		return
 	}
@@ -289,7 +261,7 @@ func (a *API) CreateNewAddress(ctx context.Context, w http.ResponseWriter, r *ht
 	err := json.NewDecoder(r.Body).Decode(addrReq)
 	if err != nil {
 		log.WithError(err).Info("Failed to parse json")
-		badRequestError(w, "Failed to parse json body")
+		readError(w, "address params", err)
 		return
 	}
 
@@ -304,7 +276,7 @@ func (a *API) CreateNewAddress(ctx context.Context, w http.ResponseWriter, r *ht
 		ID:             uuid.NewRandom().String(),
 		UserID:         userID,
 	}
-	rsp := a.db.Create(&addr)
+	rsp := a.dbFor(ctx).Create(&addr)
 	if rsp.Error != nil {
 		log.WithError(rsp.Error).Warnf("Failed to save address %v", addr)
 		internalServerError(w, "failed to save address")
@@ -317,36 +289,10 @@ func (a *API) CreateNewAddress(ctx context.Context, w http.ResponseWriter, r *ht
 // -------------------------------------------------------------------------------------------------------------------
 // Helper methods
 // -------------------------------------------------------------------------------------------------------------------
-func checkPermissions(ctx context.Context, adminOnly bool) (string, string, *HTTPError) {
-	log := getLogger(ctx)
-	userID := kami.Param(ctx, "user_id")
-	addrID := kami.Param(ctx, "addr_id")
-
-	claims := getClaims(ctx)
-	if claims == nil {
-		err := httpError(401, "No claims provided")
-		log.WithError(err).Warn("Illegal access attempt")
-		return "", "", err
-	}
-
-	isAdmin := isAdmin(ctx)
-	if isAdmin {
-		ctx = withLogger(ctx, log.WithField("admin_id", claims.ID))
-	}
-
-	if claims.ID != userID && !isAdmin {
-		err := httpError(401, "Can't access a different user unless you're an admin")
-		log.WithError(err).Warn("Illegal access attempt")
-		return "", "", err
-	}
-
-	if adminOnly && !isAdmin {
-		err := httpError(401, "Admin permissions required")
-		log.WithError(err).Warn("Illegal access attempt")
-		return "", "", err
-	}
-
-	return userID, addrID, nil
+// userParams are the user and address IDs in the path. Who may act on the
+// user is up to the policy of the route.
+func userParams(ctx context.Context) (string, string) {
+	return kami.Param(ctx, "user_id"), kami.Param(ctx, "addr_id")
 }
 
 func getUser(db *gorm.DB, userID string) *models.User {
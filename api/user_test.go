@@ -22,7 +22,8 @@ func TestUsersQueryForAllUsersAsStranger(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", urlWithUserID, nil)
 
-	NewAPI(config, db, nil, nil, nil).UserList(ctx, recorder, req)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /users", api.UserList)(ctx, recorder, req)
 	validateError(t, 401, recorder)
 }
 
@@ -125,7 +126,7 @@ func TestUsersQueryForUserAsStranger(t *testing.T) {
 	ctx = kami.SetParam(ctx, "user_id", testUser.ID)
 
 	api := NewAPI(config, db, nil, nil, nil)
-	api.UserView(ctx, recorder, req)
+	guarded(t, api, "GET /users/:user_id", api.UserView)(ctx, recorder, req)
 	validateError(t, 401, recorder)
 }
 
@@ -184,7 +185,8 @@ func TestUsersQueryForAllAddressesAsStranger(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", urlWithUserID, nil)
 
-	NewAPI(config, db, nil, nil, nil).AddressList(ctx, recorder, req)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /users/:user_id/addresses", api.AddressList)(ctx, recorder, req)
 	validateError(t, 401, recorder)
 }
 
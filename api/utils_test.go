@@ -13,6 +13,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/guregu/kami"
 	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
 
@@ -87,6 +88,16 @@ func testToken(id, email string) *jwt.Token {
 	return t
 }
 
+// guarded is the handler behind the policy of its route, like "GET /orders/:id",
+// for the tests that call the handlers directly
+func guarded(t *testing.T, api *API, route string, handler kami.HandlerFunc) kami.HandlerFunc {
+	p, ok := api.policies[route]
+	if !ok {
+		assert.FailNow(t, "no policy for route "+route)
+	}
+	return api.enforce(p, handler)
+}
+
 // ------------------------------------------------------------------------------------------------
 // TEST DATA
 // ------------------------------------------------------------------------------------------------
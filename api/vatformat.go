@@ -0,0 +1,235 @@
+package api
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// vatFormat is the syntax of the national part of a VAT number, and its
+// check digits for the countries that define them
+type vatFormat struct {
+	pattern *regexp.Regexp
+	check   func(national string) bool
+}
+
+// vatFormats are the formats of the countries VIES knows about, by the
+// prefix of their VAT numbers
+var vatFormats = map[string]vatFormat{
+	"AT": {regexp.MustCompile(`^U\d{8}$`), checkATVAT},
+	"BE": {regexp.MustCompile(`^[01]?\d{9}$`), checkBEVAT},
+	"BG": {regexp.MustCompile(`^\d{9,10}$`), nil},
+	"CY": {regexp.MustCompile(`^\d{8}[A-Z]$`), nil},
+	"CZ": {regexp.MustCompile(`^\d{8,10}$`), nil},
+	"DE": {regexp.MustCompile(`^\d{9}$`), checkMod1110},
+	"DK": {regexp.MustCompile(`^[1-9]\d{7}$`), checkDKVAT},
+	"EE": {regexp.MustCompile(`^10\d{7}$`), checkEEVAT},
+	"EL": {regexp.MustCompile(`^\d{9}$`), checkELVAT},
+	"ES": {regexp.MustCompile(`^([A-Z]\d{7}[A-Z0-9]|\d{8}[A-Z])$`), nil},
+	"FI": {regexp.MustCompile(`^\d{8}$`), checkFIVAT},
+	"FR": {regexp.MustCompile(`^[A-Z0-9]{2}\d{9}$`), checkFRVAT},
+	"HR": {regexp.MustCompile(`^\d{11}$`), checkMod1110},
+	"HU": {regexp.MustCompile(`^\d{8}$`), checkHUVAT},
+	"IE": {regexp.MustCompile(`^(\d{7}[A-W][A-I]?|\d[A-Z+*]\d{5}[A-W])$`), nil},
+	"IT": {regexp.MustCompile(`^\d{11}$`), checkLuhn},
+	"LT": {regexp.MustCompile(`^(\d{9}|\d{12})$`), nil},
+	"LU": {regexp.MustCompile(`^\d{8}$`), checkLUVAT},
+	"LV": {regexp.MustCompile(`^\d{11}$`), nil},
+	"MT": {regexp.MustCompile(`^[1-9]\d{7}$`), nil},
+	"NL": {regexp.MustCompile(`^\d{9}B\d{2}$`), checkNLVAT},
+	"PL": {regexp.MustCompile(`^\d{10}$`), checkPLVAT},
+	"PT": {regexp.MustCompile(`^\d{9}$`), checkPTVAT},
+	"RO": {regexp.MustCompile(`^[1-9]\d{1,9}$`), nil},
+	"SE": {regexp.MustCompile(`^\d{10}01$`), checkSEVAT},
+	"SI": {regexp.MustCompile(`^[1-9]\d{7}$`), checkSIVAT},
+	"SK": {regexp.MustCompile(`^[1-9]\d{9}$`), checkSKVAT},
+	"XI": {regexp.MustCompile(`^(\d{9}|\d{12}|GD\d{3}|HA\d{3})$`), nil},
+}
+
+// validVATFormat tells if a normalized VAT number can be valid at all, so
+// the obviously wrong ones are turned down without asking VIES
+func validVATFormat(number string) bool {
+	if len(number) < 3 {
+		return false
+	}
+	format, ok := vatFormats[number[:2]]
+	if !ok {
+		return false
+	}
+	national := number[2:]
+	if !format.pattern.MatchString(national) {
+		return false
+	}
+	return format.check == nil || format.check(national)
+}
+
+// digits are the values of the digits of s, which has been matched by a
+// vatFormat
+func digits(s string) []int {
+	values := make([]int, len(s))
+	for i, c := range s {
+		values[i] = int(c - '0')
+	}
+	return values
+}
+
+// weighted is the sum of the digits multiplied by their weights
+func weighted(values []int, weights ...int) int {
+	sum := 0
+	for i, weight := range weights {
+		sum += values[i] * weight
+	}
+	return sum
+}
+
+// checkMod1110 is ISO 7064 MOD 11,10, where the last digit checks the others
+func checkMod1110(national string) bool {
+	d := digits(national)
+	product := 10
+	for _, digit := range d[:len(d)-1] {
+		sum := (digit + product) % 10
+		if sum == 0 {
+			sum = 10
+		}
+		product = (2 * sum) % 11
+	}
+	return (11-product)%10 == d[len(d)-1]
+}
+
+// checkLuhn is the Luhn check card numbers use
+func checkLuhn(national string) bool {
+	d := digits(national)
+	sum := 0
+	for i := range d {
+		digit := d[len(d)-1-i]
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+func checkATVAT(national string) bool {
+	d := digits(national[1:])
+	sum := 0
+	for i, digit := range d[:7] {
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return (10-(sum+4)%10)%10 == d[7]
+}
+
+func checkBEVAT(national string) bool {
+	if len(national) == 9 {
+		national = "0" + national
+	}
+	base, _ := strconv.Atoi(national[:8])
+	check, _ := strconv.Atoi(national[8:])
+	return 97-base%97 == check
+}
+
+func checkDKVAT(national string) bool {
+	return weighted(digits(national), 2, 7, 6, 5, 4, 3, 2, 1)%11 == 0
+}
+
+func checkEEVAT(national string) bool {
+	d := digits(national)
+	return (10-weighted(d, 3, 7, 1, 3, 7, 1, 3, 7)%10)%10 == d[8]
+}
+
+func checkELVAT(national string) bool {
+	d := digits(national)
+	return weighted(d, 256, 128, 64, 32, 16, 8, 4, 2)%11%10 == d[8]
+}
+
+func checkFIVAT(national string) bool {
+	d := digits(national)
+	remainder := weighted(d, 7, 9, 10, 5, 8, 4, 2) % 11
+	if remainder == 0 {
+		return d[7] == 0
+	}
+	return remainder != 1 && 11-remainder == d[7]
+}
+
+// checkFRVAT checks the numeric keys, the keys with letters of newer
+// numbers have no published check
+func checkFRVAT(national string) bool {
+	key, err := strconv.Atoi(national[:2])
+	if err != nil {
+		return true
+	}
+	siren, _ := strconv.Atoi(national[2:])
+	return (12+3*(siren%97))%97 == key
+}
+
+func checkHUVAT(national string) bool {
+	d := digits(national)
+	return (10-weighted(d, 9, 7, 3, 1, 9, 7, 3)%10)%10 == d[7]
+}
+
+func checkLUVAT(national string) bool {
+	base, _ := strconv.Atoi(national[:6])
+	check, _ := strconv.Atoi(national[6:])
+	return base%89 == check
+}
+
+// checkNLVAT accepts the 11-check of company numbers and the 97-check of the
+// numbers of sole proprietors, which replaced their citizen numbers
+func checkNLVAT(national string) bool {
+	d := digits(national[:9])
+	if weighted(d, 9, 8, 7, 6, 5, 4, 3, 2)%11 == d[8] {
+		return true
+	}
+	// NL and B are 2321 and 11 when letters are counted from A=10
+	remainder := 2321 % 97
+	for _, c := range national {
+		value := int(c - '0')
+		if c == 'B' {
+			remainder = (remainder*100 + 11) % 97
+			continue
+		}
+		remainder = (remainder*10 + value) % 97
+	}
+	return remainder == 1
+}
+
+func checkPLVAT(national string) bool {
+	d := digits(national)
+	remainder := weighted(d, 6, 5, 7, 2, 3, 4, 5, 6, 7) % 11
+	return remainder != 10 && remainder == d[9]
+}
+
+func checkPTVAT(national string) bool {
+	d := digits(national)
+	check := 11 - weighted(d, 9, 8, 7, 6, 5, 4, 3, 2)%11
+	if check >= 10 {
+		check = 0
+	}
+	return check == d[8]
+}
+
+func checkSEVAT(national string) bool {
+	return checkLuhn(national[:10])
+}
+
+func checkSIVAT(national string) bool {
+	d := digits(national)
+	check := 11 - weighted(d, 8, 7, 6, 5, 4, 3, 2)%11
+	if check == 11 {
+		return false
+	}
+	return check%10 == d[7]
+}
+
+func checkSKVAT(national string) bool {
+	number, _ := strconv.ParseInt(national, 10, 64)
+	return number%11 == 0
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guregu/kami"
+	"github.com/mattes/vat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidVATFormat(t *testing.T) {
+	valid := []string{
+		"ATU13585627", "BE0403170701", "BE403170701", "DE136695976", "DK13585628",
+		"EE100931558", "EL094259216", "ESA28015865", "FI20774740", "FR40303265045",
+		"FRK7399859412", "HR33392005961", "HU12892312", "IE6388047V", "IT00743110157",
+		"LU15027442", "NL004495445B01", "NL000099998B57", "PL8567346215", "PT501964843",
+		"SE556188840401", "SI15012557", "SK2022749619", "XI123456789",
+	}
+	for _, number := range valid {
+		assert.True(t, validVATFormat(number), number)
+	}
+
+	invalid := []string{
+		"", "DE", "US123456789", "DE123456789", "DE13669597", "ATU13585628", "BE0403170702",
+		"DK13585629", "FR41303265045", "IT00743110158", "NL004495446B01", "PL8567346216",
+		"PT501964844", "SE556188840402", "SK2022749618", "ES123456789", "136695976",
+	}
+	for _, number := range invalid {
+		assert.False(t, validVATFormat(number), number)
+	}
+}
+
+func TestVATLookupRefusesInvalidFormats(t *testing.T) {
+	_, config := db(t)
+	lookups := 0
+	defer fakeVIES(func(number string) (*vat.VATresponse, error) {
+		lookups++
+		return &vat.VATresponse{Valid: true}, nil
+	})()
+	api := NewAPI(config, nil, nil, nil, nil)
+
+	ctx := kami.SetParam(testContext(nil, config, false), "number", "DE123456789")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://something", nil)
+	api.VatnumberLookup(ctx, w, r)
+	validateError(t, http.StatusBadRequest, w)
+	assert.Equal(t, 0, lookups, "VIES isn't asked about malformed numbers")
+
+	ctx = kami.SetParam(testContext(nil, config, false), "number", "DE136695976")
+	w = httptest.NewRecorder()
+	api.VatnumberLookup(ctx, w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, lookups)
+}
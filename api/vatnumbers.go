@@ -2,17 +2,90 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/guregu/kami"
 	"github.com/mattes/vat"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
 )
 
+var errVATTimeout = errors.New("Timed out waiting for the VAT number service")
+
+// lookupVAT asks VIES about a VAT number
+var lookupVAT = vat.CheckVAT
+
+// vatCache remembers the valid VAT numbers for vat.cache_ttl, so checkouts
+// don't depend on VIES for every order
+type vatCache struct {
+	mutex   sync.Mutex
+	entries map[string]*cachedVAT
+}
+
+type cachedVAT struct {
+	response  *vat.VATresponse
+	expiresAt time.Time
+}
+
+func newVATCache() *vatCache {
+	return &vatCache{entries: map[string]*cachedVAT{}}
+}
+
+func (c *vatCache) get(number string, now time.Time) *vat.VATresponse {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached := c.entries[number]
+	if cached == nil {
+		return nil
+	}
+	if now.After(cached.expiresAt) {
+		delete(c.entries, number)
+		return nil
+	}
+	return cached.response
+}
+
+func (c *vatCache) put(number string, response *vat.VATresponse, expiresAt time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[number] = &cachedVAT{response: response, expiresAt: expiresAt}
+}
+
+// normalizeVAT drops the spaces and dots people type in VAT numbers
+func normalizeVAT(number string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", ".", "", "-", "").Replace(number))
+}
+
+// vatMemberState is the country prefix of a VAT number, which tells the
+// member state that answers for it in VIES
+func vatMemberState(number string) string {
+	number = normalizeVAT(number)
+	if len(number) < 2 {
+		return number
+	}
+	return number[:2]
+}
+
+// vatUnavailable tells if a lookup failed because VIES couldn't answer,
+// rather than because the number is malformed
+func vatUnavailable(err error) bool {
+	return err != nil && err != vat.ErrInvalidVATNumber
+}
+
 func (a *API) VatnumberLookup(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	number := kami.Param(ctx, "number")
 
-	response, err := vat.CheckVAT(number)
+	response, err := a.checkVAT(getConfig(ctx), number)
+	if err == vat.ErrInvalidVATNumber {
+		badRequestError(w, "Vat number %v is not valid", number)
+		return
+	}
 	if err != nil {
 		internalServerError(w, fmt.Sprintf("Failed to lookup VAT Number: %v", err))
 		return
@@ -25,3 +98,63 @@ func (a *API) VatnumberLookup(ctx context.Context, w http.ResponseWriter, r *htt
 		"address": response.Address,
 	})
 }
+
+// checkVAT looks up a VAT number, in the cache or with VIES. Valid numbers
+// are cached, and numbers of the wrong format are invalid without a lookup.
+func (a *API) checkVAT(config *conf.Configuration, number string) (*vat.VATresponse, error) {
+	number = normalizeVAT(number)
+	if !validVATFormat(number) {
+		return nil, vat.ErrInvalidVATNumber
+	}
+	now := time.Now()
+	if response := a.vatCache.get(number, now); response != nil {
+		return response, nil
+	}
+	response, err := checkVIES(config, number)
+	if err == nil && response.Valid && config.VAT.CacheTTL > 0 {
+		a.vatCache.put(number, response, now.Add(config.VAT.CacheTTL))
+	}
+	return response, err
+}
+
+// checkVIES looks up a VAT number with VIES, giving up after the configured
+// timeout. The vat package has no timeout of its own, so the lookup is left
+// to finish in the background.
+func checkVIES(config *conf.Configuration, number string) (*vat.VATresponse, error) {
+	type result struct {
+		response *vat.VATresponse
+		err      error
+	}
+	lookup := lookupVAT
+	done := make(chan result, 1)
+	go func() {
+		response, err := lookup(number)
+		done <- result{response, err}
+	}()
+
+	var timeout <-chan time.Time
+	if config.Timeouts.VAT > 0 {
+		timeout = time.After(config.Timeouts.VAT)
+	}
+	select {
+	case r := <-done:
+		return r.response, r.err
+	case <-timeout:
+		return nil, errVATTimeout
+	}
+}
+
+// vatState checks the format and existence of a VAT number. It's
+// vat_pending when VIES can't tell, so the order can go on and the number
+// is checked again later.
+func (a *API) vatState(ctx context.Context, number string) string {
+	response, err := a.checkVAT(getConfig(ctx), number)
+	if vatUnavailable(err) {
+		getLogger(ctx).WithError(err).Warn("VIES couldn't check the VAT number, it will be checked again later")
+		return models.VATPendingState
+	}
+	if err != nil || !response.Valid {
+		return models.VATInvalidState
+	}
+	return models.VATValidState
+}
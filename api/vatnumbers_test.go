@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattes/vat"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// fakeVIES replaces the VIES lookup until the returned func is called
+func fakeVIES(lookup func(number string) (*vat.VATresponse, error)) func() {
+	original := lookupVAT
+	lookupVAT = lookup
+	return func() { lookupVAT = original }
+}
+
+func runOrderCreateWithVAT(t *testing.T, api *API) *httptest.ResponseRecorder {
+	startTestSite(api.config)
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "https://not-real", strings.NewReader(`{
+		"email": "info@example.com",
+		"vatnumber": "DE 136695976",
+		"shipping_address": {
+			"first_name": "Test", "last_name": "User",
+			"address1": "Alexanderplatz 1",
+			"city": "Berlin", "country": "Germany", "zip": "10178"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`))
+	api.OrderCreate(testContext(nil, api.config, false), recorder, req)
+	return recorder
+}
+
+func TestVATLookupsAreCached(t *testing.T) {
+	_, config := db(t)
+	config.VAT.CacheTTL = time.Hour
+	lookups := 0
+	defer fakeVIES(func(number string) (*vat.VATresponse, error) {
+		lookups++
+		return &vat.VATresponse{CountryCode: "DE", VATnumber: number[2:], Valid: lookups > 1}, nil
+	})()
+	api := NewAPI(config, nil, nil, nil, nil)
+
+	response, err := api.checkVAT(config, "DE136695976")
+	if assert.NoError(t, err) {
+		assert.False(t, response.Valid)
+	}
+	response, err = api.checkVAT(config, "de 136.695.976")
+	if assert.NoError(t, err) {
+		assert.True(t, response.Valid)
+	}
+	response, err = api.checkVAT(config, "DE136695976")
+	if assert.NoError(t, err) {
+		assert.True(t, response.Valid)
+	}
+	assert.Equal(t, 2, lookups, "only valid numbers are cached")
+
+	config.VAT.CacheTTL = 0
+	api = NewAPI(config, nil, nil, nil, nil)
+	api.checkVAT(config, "DE136695976")
+	api.checkVAT(config, "DE136695976")
+	assert.Equal(t, 4, lookups)
+}
+
+func TestOrderCreateWithInvalidVATNumber(t *testing.T) {
+	db, config := db(t)
+	defer fakeVIES(func(number string) (*vat.VATresponse, error) {
+		return &vat.VATresponse{CountryCode: "DE", Valid: false}, nil
+	})()
+
+	validateError(t, http.StatusBadRequest, runOrderCreateWithVAT(t, NewAPI(config, db, nil, nil, nil)))
+}
+
+func TestOrderCreateWhileVIESIsDown(t *testing.T) {
+	db, config := db(t)
+	viesDown := true
+	defer fakeVIES(func(number string) (*vat.VATresponse, error) {
+		if viesDown {
+			return nil, vat.ErrServiceUnavailable
+		}
+		return &vat.VATresponse{CountryCode: "DE", Valid: true}, nil
+	})()
+	api := NewAPI(config, db, nil, nil, nil)
+
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, runOrderCreateWithVAT(t, api), order)
+	assert.Equal(t, models.VATPendingState, order.VATState)
+	assert.Equal(t, "DE 136695976", order.VATNumber)
+
+	updated := make(chan *events.Event, 10)
+	api.events.Subscribe(webhooks.UpdateEvent, func(e *events.Event) {
+		updated <- e
+	})
+
+	assert.NoError(t, api.revalidateVAT(context.Background(), time.Now()))
+	api.events.Wait()
+	assert.Len(t, updated, 0, "VIES is still down")
+
+	viesDown = false
+	assert.NoError(t, api.revalidateVAT(context.Background(), time.Now()))
+	api.events.Wait()
+	assert.Len(t, updated, 1)
+
+	saved := &models.Order{}
+	db.First(saved, "id = ?", order.ID)
+	assert.Equal(t, models.VATValidState, saved.VATState)
+}
+
+func TestVATStateWhenLookupTimesOut(t *testing.T) {
+	_, config := db(t)
+	config.Timeouts.VAT = 10 * time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	defer fakeVIES(func(number string) (*vat.VATresponse, error) {
+		<-block
+		return nil, errors.New("never answered")
+	})()
+
+	api := NewAPI(config, nil, nil, nil, nil)
+	assert.Equal(t, models.VATPendingState, api.vatState(testContext(nil, config, false), "DE136695976"))
+}
+
+func TestOrderUpdateChecksVATNumber(t *testing.T) {
+	db, _ := db(t)
+	defer db.Save(firstOrder)
+	assert.NoError(t, db.Model(firstOrder).UpdateColumn("vat_state", models.VATValidState).Error)
+	defer fakeVIES(func(number string) (*vat.VATresponse, error) {
+		if strings.HasPrefix(number, "FR") {
+			return nil, vat.ErrServiceUnavailable
+		}
+		return &vat.VATresponse{CountryCode: "DE", Valid: number == "DE136695976"}, nil
+	})()
+
+	validateError(t, http.StatusBadRequest, runUpdate(t, db, firstOrder, &OrderParams{VATNumber: "DE999999999"}))
+
+	order := &models.Order{}
+	extractPayload(t, http.StatusOK, runUpdate(t, db, firstOrder, &OrderParams{VATNumber: "FR40303265045"}), order)
+	assert.Equal(t, models.VATPendingState, order.VATState)
+	saved := &models.Order{}
+	db.First(saved, "id = ?", firstOrder.ID)
+	assert.Equal(t, "FR40303265045", saved.VATNumber)
+	assert.Equal(t, models.VATPendingState, saved.VATState)
+}
+
+func TestRevalidateVATPerMemberState(t *testing.T) {
+	db, config := db(t)
+	lookups := []string{}
+	defer fakeVIES(func(number string) (*vat.VATresponse, error) {
+		lookups = append(lookups, number)
+		if strings.HasPrefix(number, "FR") {
+			return nil, vat.ErrServiceUnavailable
+		}
+		return &vat.VATresponse{CountryCode: "DE", Valid: true}, nil
+	})()
+
+	created := time.Now().Add(-time.Hour)
+	for i, number := range []string{"FR40303265045", "FR83404833048", "DE136695976"} {
+		order := models.NewOrder("session-vat", "info@example.com", "eur")
+		order.VATNumber = number
+		order.VATState = models.VATPendingState
+		order.CreatedAt = created.Add(time.Duration(i) * time.Minute)
+		assert.NoError(t, db.Create(order).Error)
+	}
+
+	assert.NoError(t, NewAPI(config, db, nil, nil, nil).revalidateVAT(context.Background(), time.Now()))
+	assert.Equal(t, []string{"FR40303265045", "DE136695976"}, lookups, "FR is down, DE is still checked")
+
+	orders := []models.Order{}
+	db.Order("created_at asc").Find(&orders, "session_id = ?", "session-vat")
+	if assert.Len(t, orders, 3) {
+		assert.Equal(t, models.VATPendingState, orders[0].VATState)
+		assert.Equal(t, models.VATPendingState, orders[1].VATState)
+		assert.Equal(t, models.VATValidState, orders[2].VATState)
+	}
+}
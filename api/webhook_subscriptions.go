@@ -0,0 +1,246 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/guregu/kami"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// WebhookSubscriptionParams holds the parameters for registering or updating
+// a webhook subscription. Fields left out of an update are kept.
+type WebhookSubscriptionParams struct {
+	URL         *string  `json:"url"`
+	Description *string  `json:"description"`
+	Events      []string `json:"events"`
+	Active      *bool    `json:"active"`
+	Format      *string  `json:"format"`
+
+	// Secret sets the secret the webhooks are signed with, RotateSecret
+	// generates a new one. A new subscription gets a generated secret unless
+	// one is given.
+	Secret       *string `json:"secret"`
+	RotateSecret bool    `json:"rotate_secret"`
+}
+
+// WebhookSubscriptionWithSecret is returned when the secret of a subscription
+// is set, it's the only time the secret is shown.
+type WebhookSubscriptionWithSecret struct {
+	*models.WebhookSubscription
+	Secret string `json:"secret"`
+}
+
+// WebhookSubscriptionList lists the webhook subscriptions
+func (a *API) WebhookSubscriptionList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).Model(&models.WebhookSubscription{})
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	subscriptions := []models.WebhookSubscription{}
+	if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&subscriptions); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for webhook subscriptions")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, 200, subscriptions)
+}
+
+// WebhookSubscriptionView shows a webhook subscription
+func (a *API) WebhookSubscriptionView(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	subscription := a.findWebhookSubscription(ctx, w)
+	if subscription == nil {
+		return
+	}
+	sendJSON(w, 200, subscription)
+}
+
+// WebhookSubscriptionCreate registers a webhook endpoint. It's active and
+// subscribed to every event unless the params say otherwise.
+func (a *API) WebhookSubscriptionCreate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := a.webhookSubscriptionParams(ctx, w, r)
+	if params == nil {
+		return
+	}
+	if params.URL == nil {
+		badRequestError(w, "A webhook subscription requires a URL")
+		return
+	}
+
+	subscription := &models.WebhookSubscription{
+		ID:     uuid.NewRandom().String(),
+		Events: []string{},
+		Active: true,
+		Format: webhooks.JSONFormat,
+	}
+	params.RotateSecret = params.RotateSecret || params.Secret == nil
+	secretChanged, err := params.apply(subscription)
+	if err != nil {
+		log.WithError(err).Warn("Failed to generate webhook secret")
+		internalServerError(w, "Failed to generate webhook secret")
+		return
+	}
+
+	if rsp := a.dbFor(ctx).Create(subscription); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to store webhook subscription")
+		internalServerError(w, "Failed to store webhook subscription")
+		return
+	}
+
+	a.audit(ctx, a.dbFor(ctx), r, "webhook_subscription.create", "webhook_subscription", subscription.ID, nil, models.Snapshot(subscription))
+	log.WithField("subscription_id", subscription.ID).Infof("Registered webhook subscription for %s", subscription.URL)
+	sendJSON(w, 201, withSecret(subscription, secretChanged))
+}
+
+// WebhookSubscriptionUpdate changes a webhook subscription
+func (a *API) WebhookSubscriptionUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := a.webhookSubscriptionParams(ctx, w, r)
+	if params == nil {
+		return
+	}
+	subscription := a.findWebhookSubscription(ctx, w)
+	if subscription == nil {
+		return
+	}
+
+	before := models.Snapshot(subscription)
+	secretChanged, err := params.apply(subscription)
+	if err != nil {
+		log.WithError(err).Warn("Failed to generate webhook secret")
+		internalServerError(w, "Failed to generate webhook secret")
+		return
+	}
+
+	if rsp := a.dbFor(ctx).Save(subscription); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to update webhook subscription")
+		internalServerError(w, "Failed to update webhook subscription")
+		return
+	}
+
+	a.audit(ctx, a.dbFor(ctx), r, "webhook_subscription.update", "webhook_subscription", subscription.ID, before, models.Snapshot(subscription))
+	log.WithField("subscription_id", subscription.ID).Info("Updated webhook subscription")
+	sendJSON(w, 200, withSecret(subscription, secretChanged))
+}
+
+// WebhookSubscriptionDelete removes a webhook subscription, its pending
+// webhooks fail instead of being sent
+func (a *API) WebhookSubscriptionDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	subscription := a.findWebhookSubscription(ctx, w)
+	if subscription == nil {
+		return
+	}
+
+	if rsp := a.dbFor(ctx).Delete(subscription); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to delete webhook subscription")
+		internalServerError(w, "Failed to delete webhook subscription")
+		return
+	}
+
+	a.audit(ctx, a.dbFor(ctx), r, "webhook_subscription.delete", "webhook_subscription", subscription.ID, models.Snapshot(subscription), nil)
+	log.WithField("subscription_id", subscription.ID).Info("Deleted webhook subscription")
+}
+
+func (a *API) findWebhookSubscription(ctx context.Context, w http.ResponseWriter) *models.WebhookSubscription {
+	id := kami.Param(ctx, "subscription_id")
+	subscription, err := models.FindWebhookSubscription(a.dbFor(ctx), id)
+	if err != nil {
+		getLogger(ctx).WithError(err).Warn("Error while querying for webhook subscription")
+		internalServerError(w, "Error during database query: %v", err)
+		return nil
+	}
+	if subscription == nil {
+		notFoundError(w, "Webhook subscription not found")
+		return nil
+	}
+	return subscription
+}
+
+func (a *API) webhookSubscriptionParams(ctx context.Context, w http.ResponseWriter, r *http.Request) *WebhookSubscriptionParams {
+	params := new(WebhookSubscriptionParams)
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		getLogger(ctx).WithError(err).Infof("Failed to deserialize webhook subscription params: %s", err.Error())
+		readError(w, "webhook subscription params", err)
+		return nil
+	}
+	if err := params.validate(); err != nil {
+		badRequestError(w, "%v", err)
+		return nil
+	}
+	return params
+}
+
+func (p *WebhookSubscriptionParams) validate() error {
+	if p.URL != nil {
+		u, err := url.Parse(*p.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("The webhook URL must be an http or https URL")
+		}
+	}
+	for _, e := range p.Events {
+		if !inList(webhooks.Events, e) {
+			return fmt.Errorf("Unknown event '%s', must be one of: %v", e, webhooks.Events)
+		}
+	}
+	if p.Format != nil && !webhooks.ValidFormat(*p.Format) {
+		return fmt.Errorf("Unknown webhook format '%s', must be one of: %s, %s", *p.Format, webhooks.JSONFormat, webhooks.CloudEventsFormat)
+	}
+	if p.Secret != nil && *p.Secret == "" {
+		return fmt.Errorf("The webhook secret can't be empty")
+	}
+	return nil
+}
+
+// apply changes the subscription as given by the params and reports if its
+// secret changed
+func (p *WebhookSubscriptionParams) apply(s *models.WebhookSubscription) (bool, error) {
+	if p.URL != nil {
+		s.URL = *p.URL
+	}
+	if p.Description != nil {
+		s.Description = *p.Description
+	}
+	if p.Events != nil {
+		s.Events = p.Events
+	}
+	if p.Active != nil {
+		s.Active = *p.Active
+	}
+	if p.Format != nil {
+		s.Format = *p.Format
+	}
+
+	switch {
+	case p.Secret != nil:
+		s.Secret = *p.Secret
+	case p.RotateSecret:
+		secret, err := models.NewWebhookSecret()
+		if err != nil {
+			return false, err
+		}
+		s.Secret = secret
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func withSecret(s *models.WebhookSubscription, secretChanged bool) interface{} {
+	if secretChanged {
+		return &WebhookSubscriptionWithSecret{WebhookSubscription: s, Secret: s.Secret}
+	}
+	return s
+}
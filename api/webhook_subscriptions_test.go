@@ -0,0 +1,250 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+func TestWebhookSubscriptionCreate(t *testing.T) {
+	db, config := db(t)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://not-real/webhooks/subscriptions", strings.NewReader(`{"url": "https://crm.example.com/hooks", "events": ["payment", "refund"]}`))
+	NewAPI(config, db, nil, nil, nil).WebhookSubscriptionCreate(ctx, w, r)
+
+	created := &WebhookSubscriptionWithSecret{}
+	extractPayload(t, 201, w, created)
+	assert.NotEmpty(t, created.Secret)
+	assert.True(t, created.Active)
+	assert.Equal(t, []string{"payment", "refund"}, created.Events)
+
+	stored, err := models.FindWebhookSubscription(db, created.ID)
+	if assert.NoError(t, err) && assert.NotNil(t, stored) {
+		assert.Equal(t, created.Secret, stored.Secret)
+		assert.Equal(t, []string{"payment", "refund"}, stored.Events)
+	}
+
+	// the secret isn't shown again
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/webhooks/subscriptions", nil)
+	NewAPI(config, db, nil, nil, nil).WebhookSubscriptionList(ctx, w, r)
+	assert.NotContains(t, w.Body.String(), created.Secret)
+	subscriptions := []models.WebhookSubscription{}
+	extractPayload(t, 200, w, &subscriptions)
+	assert.Len(t, subscriptions, 1)
+}
+
+func TestWebhookSubscriptionCreateValidation(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+
+	for _, body := range []string{
+		`{"events": ["payment"]}`,
+		`{"url": "ftp://crm.example.com/hooks"}`,
+		`{"url": "https://crm.example.com/hooks", "events": ["unknown"]}`,
+		`{"url": "https://crm.example.com/hooks", "secret": ""}`,
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "https://not-real/webhooks/subscriptions", strings.NewReader(body))
+		NewAPI(config, db, nil, nil, nil).WebhookSubscriptionCreate(ctx, w, r)
+		validateError(t, 400, w)
+	}
+}
+
+func TestWebhookSubscriptionCreateWithAPIKey(t *testing.T) {
+	db, config := db(t)
+	api := NewAPI(config, db, nil, nil, nil)
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+
+	_, secret := createTestAPIKey(t, db, models.AdminScope)
+	r, _ := http.NewRequest("POST", server.URL+"/v1/webhooks/subscriptions", strings.NewReader(`{"url": "https://evil.example.com"}`))
+	r.Header.Set("Authorization", "Bearer "+secret)
+	rsp, err := http.DefaultClient.Do(r)
+	if assert.NoError(t, err) {
+		rsp.Body.Close()
+		assert.Equal(t, 401, rsp.StatusCode)
+	}
+}
+
+func TestWebhookSubscriptionUpdate(t *testing.T) {
+	db, config := db(t)
+	subscription := &models.WebhookSubscription{ID: "sub-1", URL: "https://crm.example.com/hooks", Secret: "old", Active: true}
+	assert.NoError(t, db.Create(subscription).Error)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "subscription_id", subscription.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "https://not-real/webhooks/subscriptions/sub-1", strings.NewReader(`{"active": false, "events": ["order"]}`))
+	NewAPI(config, db, nil, nil, nil).WebhookSubscriptionUpdate(ctx, w, r)
+
+	updated := &WebhookSubscriptionWithSecret{}
+	extractPayload(t, 200, w, updated)
+	assert.False(t, updated.Active)
+	assert.Equal(t, "https://crm.example.com/hooks", updated.URL)
+	assert.Empty(t, updated.Secret)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "https://not-real/webhooks/subscriptions/sub-1", strings.NewReader(`{"rotate_secret": true}`))
+	NewAPI(config, db, nil, nil, nil).WebhookSubscriptionUpdate(ctx, w, r)
+	extractPayload(t, 200, w, updated)
+	assert.NotEmpty(t, updated.Secret)
+	assert.NotEqual(t, "old", updated.Secret)
+
+	stored, _ := models.FindWebhookSubscription(db, subscription.ID)
+	if assert.NotNil(t, stored) {
+		assert.False(t, stored.Active)
+		assert.Equal(t, []string{"order"}, stored.Events)
+		assert.Equal(t, updated.Secret, stored.Secret)
+	}
+}
+
+func TestWebhookSubscriptionDelete(t *testing.T) {
+	db, config := db(t)
+	subscription := &models.WebhookSubscription{ID: "sub-1", URL: "https://crm.example.com/hooks", Secret: "shhh", Active: true}
+	assert.NoError(t, db.Create(subscription).Error)
+
+	ctx := testContext(testToken("magical-unicorn", ""), config, true)
+	ctx = kami.SetParam(ctx, "subscription_id", subscription.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("DELETE", "https://not-real/webhooks/subscriptions/sub-1", nil)
+	NewAPI(config, db, nil, nil, nil).WebhookSubscriptionDelete(ctx, w, r)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "https://not-real/webhooks/subscriptions/sub-1", nil)
+	NewAPI(config, db, nil, nil, nil).WebhookSubscriptionView(ctx, w, r)
+	validateError(t, 404, w)
+}
+
+func TestWebhookSubscriptionListAsStranger(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("stranger", "stranger@example.com"), config, false)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/webhooks/subscriptions", nil)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /webhooks/subscriptions", api.WebhookSubscriptionList)(ctx, w, r)
+	validateError(t, 401, w)
+}
+
+func TestWebhookSubscriptionHooks(t *testing.T) {
+	db, config := db(t)
+
+	received := make(chan *webhooks.Event, 2)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event, err := webhooks.NewVerifier("crm-secret").Parse(r)
+		if assert.NoError(t, err) {
+			received <- event
+		}
+	}))
+	defer consumer.Close()
+
+	for _, s := range []*models.WebhookSubscription{
+		{ID: "crm", URL: consumer.URL + "/crm", Secret: "crm-secret", Events: []string{"payment"}, Active: true},
+		{ID: "refunds", URL: consumer.URL + "/refunds", Secret: "other", Events: []string{"refund"}, Active: true},
+		{ID: "inactive", URL: consumer.URL + "/inactive", Secret: "other", Active: false},
+	} {
+		assert.NoError(t, db.Create(s).Error)
+	}
+
+	api := NewAPI(config, db, nil, nil, nil)
+	batch := api.events.Begin(db.Begin())
+	api.publish(context.Background(), batch, &events.Event{Type: webhooks.PaymentEvent, Payload: firstOrder})
+	assert.NoError(t, batch.Commit().Error)
+
+	hooks := []*models.Hook{}
+	db.Where("subscription_id != ?", "").Find(&hooks)
+	if assert.Len(t, hooks, 1) {
+		assert.Equal(t, "crm", hooks[0].SubscriptionID)
+		deliverHooks(t, db, config, hooks[0])
+		assert.True(t, hooks[0].Done)
+		assert.False(t, hooks[0].Failed)
+	}
+	if assert.Len(t, received, 1) {
+		event := <-received
+		assert.Equal(t, webhooks.PaymentEvent, event.Type)
+	}
+}
+
+func TestWebhookSubscriptionDeactivatedHooks(t *testing.T) {
+	db, config := db(t)
+	subscription := &models.WebhookSubscription{ID: "crm", URL: "http://localhost:1/crm", Secret: "shhh", Active: false}
+	assert.NoError(t, db.Create(subscription).Error)
+
+	hook := models.NewHook(webhooks.OrderEvent, subscription.URL, "", firstOrder)
+	hook.SubscriptionID = subscription.ID
+	assert.NoError(t, db.Create(hook).Error)
+	deliverHooks(t, db, config, hook)
+
+	assert.True(t, hook.Done)
+	assert.True(t, hook.Failed)
+	assert.Equal(t, 1, hook.Tries)
+}
+
+func TestWebhookCloudEvents(t *testing.T) {
+	db, config := db(t)
+	config.SiteURL = "https://shop.example.com"
+	config.Webhooks.Format = webhooks.CloudEventsFormat
+	config.Webhooks.Payment = "https://erp.example.com/payments"
+
+	subscription := &models.WebhookSubscription{ID: "crm", URL: "https://crm.example.com/hooks", Secret: "shhh", Active: true}
+	assert.NoError(t, db.Create(subscription).Error)
+
+	api := NewAPI(config, db, nil, nil, nil)
+	batch := api.events.Begin(db.Begin())
+	api.publish(context.Background(), batch, &events.Event{Type: webhooks.PaymentEvent, Payload: firstOrder})
+	assert.NoError(t, batch.Commit().Error)
+
+	hooks := []*models.Hook{}
+	db.Order("id asc").Find(&hooks)
+	if !assert.Len(t, hooks, 2) {
+		return
+	}
+	assert.Equal(t, webhooks.CloudEventsFormat, hooks[0].Format)
+	event := &webhooks.CloudEvent{}
+	assert.NoError(t, json.Unmarshal([]byte(hooks[0].Payload), event))
+	assert.Equal(t, "1.0", event.SpecVersion)
+	assert.Equal(t, "com.netlify.gocommerce.payment", event.Type)
+	assert.Equal(t, "https://shop.example.com", event.Source)
+	assert.Equal(t, firstOrder.ID, event.Subject)
+	assert.NotEmpty(t, event.ID)
+	order := &models.Order{}
+	assert.NoError(t, json.Unmarshal(event.Data, order))
+	assert.Equal(t, firstOrder.ID, order.ID)
+
+	// the subscription keeps its own format
+	assert.Equal(t, "", hooks[1].Format)
+	envelope := &webhooks.Envelope{}
+	assert.NoError(t, json.Unmarshal([]byte(hooks[1].Payload), envelope))
+	assert.Equal(t, webhooks.PaymentEvent, envelope.Event)
+}
+
+func TestWebhookCloudEventsContentType(t *testing.T) {
+	db, config := db(t)
+
+	contentType := make(chan string, 1)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType <- r.Header.Get("Content-Type")
+	}))
+	defer consumer.Close()
+
+	hook := models.NewHook(webhooks.OrderEvent, consumer.URL, "", webhooks.NewCloudEvent("1", "gocommerce", webhooks.OrderEvent, "", nil, time.Now()))
+	hook.Format = webhooks.CloudEventsFormat
+	assert.NoError(t, db.Create(hook).Error)
+	deliverHooks(t, db, config, hook)
+
+	assert.Equal(t, webhooks.CloudEventsContentType, <-contentType)
+}
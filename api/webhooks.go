@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/events"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// maxTestResponseBody is how much of a test response body is reported
+const maxTestResponseBody = 4096
+
+// WebhookTestParams picks the event a webhook test sends
+type WebhookTestParams struct {
+	Event string `json:"event"`
+}
+
+// WebhookTestPayload is the sample payload of a test webhook
+type WebhookTestPayload struct {
+	Test    bool      `json:"test"`
+	Event   string    `json:"event"`
+	Message string    `json:"message"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// WebhookTestResult is how an endpoint responded to a test webhook
+type WebhookTestResult struct {
+	URL          string `json:"url"`
+	Event        string `json:"event"`
+	DeliveryID   string `json:"delivery_id"`
+	Signed       bool   `json:"signed"`
+	OK           bool   `json:"ok"`
+	StatusCode   int    `json:"status_code,omitempty"`
+	ResponseBody string `json:"response_body,omitempty"`
+	Error        string `json:"error,omitempty"`
+	LatencyMs    int64  `json:"latency_ms"`
+}
+
+// WebhookEndpointList lists the URLs webhooks are delivered to and whether
+// they are healthy
+func (a *API) WebhookEndpointList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := a.dbFor(ctx).Model(&models.WebhookEndpoint{})
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	endpoints := []models.WebhookEndpoint{}
+	if rsp := query.Order("url asc").Offset(offset).Limit(limit).Find(&endpoints); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for webhook endpoints")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, 200, endpoints)
+}
+
+// WebhookDeliveryList lists the webhooks sent for an order, with all their
+// delivery attempts
+func (a *API) WebhookDeliveryList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	orderID := kami.Param(ctx, "order_id")
+	log := getLogger(ctx).WithField("order_id", orderID)
+	query := a.dbFor(ctx).Model(&models.Hook{}).Where("order_id = ?", orderID)
+	offset, limit, err := paginate(w, r, query)
+	if err != nil {
+		badRequestError(w, "Bad Pagination Parameters: %v", err)
+		return
+	}
+
+	hooks := []models.Hook{}
+	rsp := query.Preload("Attempts", func(db *gorm.DB) *gorm.DB {
+		return db.Order("try asc")
+	}).Order("created_at desc").Offset(offset).Limit(limit).Find(&hooks)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while querying for webhook deliveries")
+		internalServerError(w, "Error during database query: %v", rsp.Error)
+		return
+	}
+
+	sendJSON(w, 200, hooks)
+}
+
+// WebhookDeliveryReplay sends a webhook again, as a new delivery
+func (a *API) WebhookDeliveryReplay(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	hookID := kami.Param(ctx, "hook_id")
+	log := getLogger(ctx).WithField("hook_id", hookID)
+	hook := &models.Hook{}
+	if rsp := a.dbFor(ctx).First(hook, "id = ?", hookID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			notFoundError(w, "Webhook delivery not found")
+		} else {
+			log.WithError(rsp.Error).Warn("Error while querying for webhook delivery")
+			internalServerError(w, "Error during database query: %v", rsp.Error)
+		}
+		return
+	}
+
+	replay := hook.Replay()
+	replay.RequestID = getRequestID(ctx)
+	if rsp := a.dbFor(ctx).Create(replay); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while saving webhook replay")
+		internalServerError(w, "Error saving webhook delivery: %v", rsp.Error)
+		return
+	}
+
+	log.WithField("replay_id", replay.ID).Info("Replaying webhook delivery")
+	sendJSON(w, 201, replay)
+}
+
+// WebhookTest sends a signed test webhook to the configured endpoints right
+// away and reports how they responded. Without an event it sends a ping to
+// every endpoint, with one it sends to the URL of the event and to the shared
+// URL. Test deliveries are logged but never retried.
+func (a *API) WebhookTest(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	params := new(WebhookTestParams)
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+			log.WithError(err).Infof("Failed to deserialize webhook test params: %s", err.Error())
+			readError(w, "webhook test params", err)
+			return
+		}
+	}
+	if params.Event != "" && !inList(webhooks.Events, params.Event) {
+		badRequestError(w, "Unknown event '%s', must be one of: %v", params.Event, webhooks.Events)
+		return
+	}
+
+	targets := webhookTestTargets(getConfig(ctx), params.Event)
+	if len(targets) == 0 {
+		badRequestError(w, "No webhook endpoints are configured")
+		return
+	}
+
+	client := a.currentConfig().HTTPClient(a.currentConfig().Timeouts.Webhooks)
+	results := []*WebhookTestResult{}
+	for _, target := range targets {
+		results = append(results, a.sendTestHook(ctx, client, target.url, target.event, target.shared))
+	}
+	sendJSON(w, 200, results)
+}
+
+type webhookTestTarget struct {
+	url    string
+	event  string
+	shared bool
+}
+
+func webhookTestTargets(config *conf.Configuration, event string) []webhookTestTarget {
+	targets := []webhookTestTarget{}
+	seen := map[string]bool{}
+	add := func(url, event string, shared bool) {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			targets = append(targets, webhookTestTarget{url, event, shared})
+		}
+	}
+
+	if event != "" {
+		add(webhookURL(config, event), event, false)
+		add(config.Webhooks.URL, event, true)
+		return targets
+	}
+	for _, e := range webhooks.Events {
+		add(webhookURL(config, e), webhooks.PingEvent, false)
+	}
+	add(config.Webhooks.URL, webhooks.PingEvent, true)
+	return targets
+}
+
+func (a *API) sendTestHook(ctx context.Context, client *http.Client, url, event string, shared bool) *WebhookTestResult {
+	log := getLogger(ctx).WithField("url", url)
+	config := getConfig(ctx)
+	result := &WebhookTestResult{URL: url, Event: event, Signed: config.Webhooks.Secret != ""}
+
+	data, _ := json.Marshal(&WebhookTestPayload{
+		Test:    true,
+		Event:   event,
+		Message: "This is a test webhook from GoCommerce",
+		SentAt:  time.Now(),
+	})
+	format := config.Webhooks.Format
+	payload := hookPayload(config, &events.Event{Type: event, CreatedAt: time.Now()}, data, format, shared)
+
+	// the hook is saved so the delivery has an ID, as done so it's never
+	// picked up for retries
+	now := time.Now()
+	hook := models.NewHook(event, url, "", payload)
+	hook.RequestID = getRequestID(ctx)
+	hook.Format = format
+	hook.Done = true
+	hook.CompletedAt = &now
+	if rsp := a.dbFor(ctx).Create(hook); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Error while saving test webhook")
+		result.Error = "Error saving the test delivery"
+		return result
+	}
+	result.DeliveryID = hook.DeliveryID()
+
+	started := time.Now()
+	rsp, err := hook.Trigger(client, log, config.Webhooks.Secret, config.Webhooks.SecondarySecret)
+	result.LatencyMs = int64(time.Since(started) / time.Millisecond)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		defer rsp.Body.Close()
+		body, _ := ioutil.ReadAll(rsp.Body)
+		if len(body) > maxTestResponseBody {
+			body = body[:maxTestResponseBody]
+		}
+		result.StatusCode = rsp.StatusCode
+		result.ResponseBody = string(body)
+		result.OK = rsp.StatusCode >= 200 && rsp.StatusCode < 300
+		hook.ResponseStatus = rsp.Status
+		hook.ResponseBody = result.ResponseBody
+	}
+	if !result.OK {
+		hook.Failed = true
+		if result.Error != "" {
+			hook.ErrorMessage = &result.Error
+		}
+	}
+	a.dbFor(ctx).Save(hook)
+
+	log.WithField("status_code", result.StatusCode).Info("Sent test webhook")
+	return result
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"text/template"
+
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// webhookVerifierJS is a node module for consumers that can't use the Go
+// webhooks package. It is generated from the same constants, so the header
+// names, payload version and tolerance always match what is being sent.
+var webhookVerifierJS = template.Must(template.New("verify.js").Parse(`// GoCommerce webhook verification, payload version {{.Version}}
+"use strict";
+const crypto = require("crypto");
+
+const SIGNATURE_HEADER = "{{.SignatureHeader}}";
+const DELIVERY_HEADER = "{{.DeliveryHeader}}";
+const EVENT_HEADER = "{{.EventHeader}}";
+const VERSION_HEADER = "{{.VersionHeader}}";
+const VERSION = "{{.Version}}";
+const SIGNATURE_SCHEME = "{{.SignatureScheme}}";
+const DEFAULT_TOLERANCE = {{.Tolerance}}; // seconds
+
+function safeEqual(a, b) {
+  const bufA = Buffer.from(String(a));
+  const bufB = Buffer.from(String(b));
+  return bufA.length === bufB.length && crypto.timingSafeEqual(bufA, bufB);
+}
+
+// verify checks the signature header of a delivery and returns when it was
+// signed, in seconds since the epoch. secret can be a list of secrets while
+// one is rotated, a signature matching any of them is enough.
+function verify(secret, header, deliveryID, body, options) {
+  const tolerance = (options && options.tolerance) || DEFAULT_TOLERANCE;
+  const secrets = [].concat(secret).filter(Boolean);
+  if (secrets.length === 0) throw new Error("no webhook secret configured");
+  if (!header) throw new Error("missing webhook signature");
+
+  let timestamp = "";
+  const signatures = [];
+  for (const part of header.split(",")) {
+    const i = part.indexOf("=");
+    if (i < 0) throw new Error("invalid webhook signature");
+    const key = part.slice(0, i).trim();
+    const value = part.slice(i + 1).trim();
+    if (key === "t") timestamp = value;
+    if (key === SIGNATURE_SCHEME) signatures.push(value);
+  }
+  if (!/^\d+$/.test(timestamp) || signatures.length === 0) throw new Error("invalid webhook signature");
+
+  const valid = secrets.some((key) => {
+    const expected = crypto.createHmac("sha256", key)
+      .update(timestamp + "." + (deliveryID || "") + ".")
+      .update(body)
+      .digest("hex");
+    return signatures.some((sig) => safeEqual(expected, sig));
+  });
+  if (!valid) {
+    throw new Error("invalid webhook signature");
+  }
+
+  const signed = parseInt(timestamp, 10);
+  const now = Math.floor(Date.now() / 1000);
+  if (signed > now + tolerance || signed < now - tolerance) {
+    throw new Error("webhook signature is outside the allowed time window");
+  }
+  return signed;
+}
+
+// parse verifies a webhook from its headers and raw body and decodes the payload
+function parse(secret, headers, body, options) {
+  const get = (name) => headers[name] || headers[name.toLowerCase()];
+  const deliveryID = get(DELIVERY_HEADER);
+  const signed = verify(secret, get(SIGNATURE_HEADER), deliveryID, body, options);
+  const version = get(VERSION_HEADER) || VERSION;
+  if (version !== VERSION) throw new Error("unsupported webhook version '" + version + "'");
+  return {
+    type: get(EVENT_HEADER),
+    version: version,
+    deliveryID: deliveryID,
+    signedAt: new Date(signed * 1000),
+    data: JSON.parse(body.toString("utf8")),
+  };
+}
+
+module.exports = { verify, parse, SIGNATURE_HEADER, DELIVERY_HEADER, EVENT_HEADER, VERSION_HEADER, VERSION };
+`))
+
+// WebhookVerifierJS serves a node module that verifies and decodes webhooks
+func (a *API) WebhookVerifierJS(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	err := webhookVerifierJS.Execute(w, map[string]interface{}{
+		"SignatureHeader": webhooks.SignatureHeader,
+		"DeliveryHeader":  webhooks.DeliveryHeader,
+		"EventHeader":     webhooks.EventHeader,
+		"VersionHeader":   webhooks.VersionHeader,
+		"Version":         webhooks.Version,
+		"SignatureScheme": webhooks.SignatureScheme,
+		"Tolerance":       int(webhooks.DefaultTolerance.Seconds()),
+	})
+	if err != nil {
+		getLogger(ctx).WithError(err).Warn("Failed to render webhook verifier")
+	}
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+func TestWebhookRetriesAndEndpointHealth(t *testing.T) {
+	db, config := db(t)
+	config.Webhooks.MaxRetries = 3
+	config.Webhooks.RetryPeriod = time.Minute
+	config.Webhooks.MaxRetryPeriod = time.Hour
+	config.Webhooks.UnhealthyAfter = 1
+
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer consumer.Close()
+
+	hook := models.NewHook("order", consumer.URL, testUser.ID, firstOrder)
+	assert.NoError(t, db.Create(hook).Error)
+
+	started := time.Now()
+	deliverHooks(t, db, config, hook)
+
+	assert.Equal(t, 1, hook.Tries)
+	assert.False(t, hook.Done)
+	if assert.NotNil(t, hook.RunAfter) {
+		// unhealthy endpoints are retried after the max retry period
+		assert.True(t, hook.RunAfter.After(started.Add(59*time.Minute)), "retrying at %v", hook.RunAfter)
+	}
+
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/webhooks/endpoints", nil)
+	NewAPI(config, db, nil, nil, nil).WebhookEndpointList(ctx, w, r)
+
+	endpoints := []models.WebhookEndpoint{}
+	extractPayload(t, 200, w, &endpoints)
+	if assert.Len(t, endpoints, 1) {
+		assert.Equal(t, consumer.URL, endpoints[0].URL)
+		assert.True(t, endpoints[0].Unhealthy)
+		assert.Equal(t, 1, endpoints[0].ConsecutiveFailures)
+		assert.Equal(t, "503 Service Unavailable", endpoints[0].LastError)
+	}
+}
+
+func TestWebhookEndpointListAsStranger(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("stranger", "stranger@example.com"), config, false)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/webhooks/endpoints", nil)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "GET /webhooks/endpoints", api.WebhookEndpointList)(ctx, w, r)
+	validateError(t, 401, w)
+}
+
+func TestWebhookDeliveryLogAndReplay(t *testing.T) {
+	db, config := db(t)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("boom"))
+	}))
+	defer consumer.Close()
+
+	hook := models.NewHook("payment", consumer.URL, testUser.ID, firstOrder)
+	assert.NoError(t, db.Create(hook).Error)
+	deliverHooks(t, db, config, hook)
+
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+	ctx = kami.SetParam(ctx, "order_id", firstOrder.ID)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://not-real/orders/"+firstOrder.ID+"/webhooks", nil)
+	NewAPI(config, db, nil, nil, nil).WebhookDeliveryList(ctx, w, r)
+
+	hooks := []models.Hook{}
+	extractPayload(t, 200, w, &hooks)
+	if assert.Len(t, hooks, 1) && assert.Len(t, hooks[0].Attempts, 1) {
+		attempt := hooks[0].Attempts[0]
+		assert.Equal(t, 1, attempt.Try)
+		assert.Equal(t, 500, attempt.StatusCode)
+		assert.Equal(t, "boom", attempt.ResponseBody)
+		assert.True(t, attempt.LatencyMs >= 0)
+		assert.Equal(t, hook.Payload, hooks[0].Payload)
+	}
+
+	ctx = kami.SetParam(ctx, "hook_id", fmt.Sprintf("%d", hook.ID))
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/webhooks/deliveries/1/replay", nil)
+	NewAPI(config, db, nil, nil, nil).WebhookDeliveryReplay(ctx, w, r)
+
+	replay := &models.Hook{}
+	extractPayload(t, 201, w, replay)
+	assert.NotEqual(t, hook.ID, replay.ID)
+	assert.Equal(t, hook.Payload, replay.Payload)
+	assert.Equal(t, firstOrder.ID, replay.OrderID)
+	assert.Equal(t, 0, replay.Tries)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	db, config := db(t)
+	config.Webhooks.Secret = "shhh"
+
+	events := make(chan *webhooks.Event, 1)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event, err := webhooks.NewVerifier("shhh").Parse(r)
+		assert.NoError(t, err)
+		events <- event
+	}))
+	defer consumer.Close()
+
+	hook := models.NewHook("order", consumer.URL, testUser.ID, firstOrder)
+	assert.NoError(t, db.Create(hook).Error)
+	deliverHooks(t, db, config, hook)
+
+	assert.True(t, hook.Done)
+	select {
+	case event := <-events:
+		assert.Equal(t, hook.DeliveryID(), event.DeliveryID)
+		assert.Equal(t, "order", event.Type)
+	default:
+		t.Error("The webhook wasn't delivered")
+	}
+}
+
+func TestWebhookSecondarySignature(t *testing.T) {
+	db, config := db(t)
+	config.Webhooks.Secret = "new-secret"
+	config.Webhooks.SecondarySecret = "old-secret"
+
+	verified := make(chan bool, 2)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		for _, secret := range []string{"old-secret", "new-secret"} {
+			_, err := webhooks.NewVerifier(secret).Verify(r.Header.Get(webhooks.SignatureHeader), r.Header.Get(webhooks.DeliveryHeader), body)
+			verified <- err == nil
+		}
+	}))
+	defer consumer.Close()
+
+	hook := models.NewHook("order", consumer.URL, testUser.ID, firstOrder)
+	assert.NoError(t, db.Create(hook).Error)
+	deliverHooks(t, db, config, hook)
+
+	if assert.Len(t, verified, 2) {
+		assert.True(t, <-verified, "consumers with the old secret still verify webhooks")
+		assert.True(t, <-verified, "consumers with the new secret verify webhooks")
+	}
+}
+
+func TestWebhookCircuitBreaker(t *testing.T) {
+	db, config := db(t)
+	config.Webhooks.BreakerCooldown = time.Minute
+
+	called := make(chan bool, 1)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- true
+	}))
+	defer consumer.Close()
+
+	failed := time.Now()
+	assert.NoError(t, db.Create(&models.WebhookEndpoint{URL: consumer.URL, ConsecutiveFailures: 10, Unhealthy: true, LastFailureAt: &failed}).Error)
+	hook := models.NewHook("order", consumer.URL, testUser.ID, firstOrder)
+	assert.NoError(t, db.Create(hook).Error)
+
+	stop := models.RunHooks(db, testLogger, config)
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		db.First(hook, hook.ID)
+		if hook.RunAfter != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	stop()
+
+	assert.Len(t, called, 0, "hooks to an open circuit aren't sent")
+	assert.Equal(t, 0, hook.Tries)
+	assert.Nil(t, hook.LockedAt)
+	if assert.NotNil(t, hook.RunAfter) {
+		assert.WithinDuration(t, failed.Add(time.Minute), *hook.RunAfter, time.Second)
+	}
+}
+
+func TestWebhookEndpointConcurrency(t *testing.T) {
+	db, config := db(t)
+	config.Webhooks.EndpointConcurrency = 1
+
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+	}))
+	defer consumer.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, db.Create(models.NewHook("order", consumer.URL, testUser.ID, firstOrder)).Error)
+	}
+
+	stop := models.RunHooks(db, testLogger, config)
+	deadline := time.Now().Add(3 * time.Second)
+	pending := 3
+	for pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		db.Model(&models.Hook{}).Where("done = ?", false).Count(&pending)
+	}
+	stop()
+
+	assert.Equal(t, 0, pending)
+	assert.Equal(t, 1, maxInFlight)
+}
+
+// deliverHooks runs the hooks until the hook was tried once
+func deliverHooks(t *testing.T, db *gorm.DB, config *conf.Configuration, hook *models.Hook) {
+	stop := models.RunHooks(db, testLogger, config)
+	defer stop()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		db.First(hook, hook.ID)
+		if hook.Tries > 0 && hook.LockedAt == nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Hook %v wasn't delivered", hook.ID)
+}
+
+func TestWebhookTest(t *testing.T) {
+	db, config := db(t)
+	config.Webhooks.Secret = "shhh"
+
+	received := make(chan *webhooks.Event, 3)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event, err := webhooks.NewVerifier("shhh").Parse(r)
+		if assert.NoError(t, err) {
+			received <- event
+		}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("thanks"))
+	}))
+	defer consumer.Close()
+	config.Webhooks.Order = consumer.URL + "/orders"
+	config.Webhooks.Payment = consumer.URL + "/orders"
+	config.Webhooks.URL = consumer.URL + "/broken"
+
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://not-real/webhooks/test", nil)
+	NewAPI(config, db, nil, nil, nil).WebhookTest(ctx, w, r)
+
+	results := []WebhookTestResult{}
+	extractPayload(t, 200, w, &results)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, consumer.URL+"/orders", results[0].URL)
+		assert.Equal(t, webhooks.PingEvent, results[0].Event)
+		assert.True(t, results[0].OK)
+		assert.True(t, results[0].Signed)
+		assert.Equal(t, "thanks", results[0].ResponseBody)
+		assert.NotEmpty(t, results[0].DeliveryID)
+
+		assert.Equal(t, consumer.URL+"/broken", results[1].URL)
+		assert.False(t, results[1].OK)
+		assert.Equal(t, 404, results[1].StatusCode)
+	}
+	assert.Len(t, received, 2)
+
+	pending := 0
+	db.Model(&models.Hook{}).Where("done = ?", false).Count(&pending)
+	assert.Equal(t, 0, pending)
+}
+
+func TestWebhookTestEvent(t *testing.T) {
+	db, config := db(t)
+	config.Webhooks.Refund = "http://localhost:1/refunds"
+
+	ctx := testContext(testToken("admin-yo", "admin@wayneindustries.com"), config, true)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://not-real/webhooks/test", strings.NewReader(`{"event": "refund"}`))
+	NewAPI(config, db, nil, nil, nil).WebhookTest(ctx, w, r)
+
+	results := []WebhookTestResult{}
+	extractPayload(t, 200, w, &results)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, webhooks.RefundEvent, results[0].Event)
+		assert.False(t, results[0].OK)
+		assert.False(t, results[0].Signed)
+		assert.NotEmpty(t, results[0].Error)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "https://not-real/webhooks/test", strings.NewReader(`{"event": "unknown"}`))
+	NewAPI(config, db, nil, nil, nil).WebhookTest(ctx, w, r)
+	validateError(t, 400, w)
+}
+
+func TestWebhookTestAsStranger(t *testing.T) {
+	db, config := db(t)
+	ctx := testContext(testToken("stranger", "stranger@example.com"), config, false)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://not-real/webhooks/test", nil)
+	api := NewAPI(config, db, nil, nil, nil)
+	guarded(t, api, "POST /webhooks/test", api.WebhookTest)(ctx, w, r)
+	validateError(t, 401, w)
+}
@@ -1,6 +1,9 @@
 package calculator
 
-import "math"
+import (
+	"math"
+	"sort"
+)
 
 type Price struct {
 	Items []ItemPrice
@@ -80,33 +83,14 @@ func (t *Tax) AppliesTo(country, productType string) bool {
 func CalculatePrice(settings *Settings, country, currency string, coupon Coupon, items []Item) Price {
 	price := Price{}
 	includeTaxes := settings != nil && settings.PricesIncludeTaxes
+	// discountable is what's left of the items of the coupon's types after
+	// the percentage discount, a fixed discount can't take off more
+	var discountable uint64
 	for _, item := range items {
 		itemPrice := ItemPrice{Quantity: item.GetQuantity()}
 		itemPrice.Subtotal = item.PriceInLowestUnit()
 
-		taxAmounts := []taxAmount{}
-		if item.FixedVAT() != 0 {
-			taxAmounts = append(taxAmounts, taxAmount{price: itemPrice.Subtotal, percentage: item.FixedVAT()})
-		} else if settings != nil && item.TaxableItems() != nil && len(item.TaxableItems()) > 0 {
-			for _, item := range item.TaxableItems() {
-				amount := taxAmount{price: item.PriceInLowestUnit()}
-				for _, t := range settings.Taxes {
-					if t.AppliesTo(country, item.ProductType()) {
-						amount.percentage = t.Percentage
-						break
-					}
-				}
-				taxAmounts = append(taxAmounts, amount)
-			}
-		} else if settings != nil {
-			for _, t := range settings.Taxes {
-				if t.AppliesTo(country, item.ProductType()) {
-					taxAmounts = append(taxAmounts, taxAmount{price: itemPrice.Subtotal, percentage: t.Percentage})
-					break
-				}
-			}
-		}
-
+		taxAmounts := itemTaxAmounts(settings, country, item)
 		if len(taxAmounts) != 0 {
 			if includeTaxes {
 				itemPrice.Subtotal = 0
@@ -128,6 +112,13 @@ func CalculatePrice(settings *Settings, country, currency string, coupon Coupon,
 		}
 
 		itemPrice.Total = itemPrice.Subtotal - itemPrice.Discount + itemPrice.Taxes
+		if coupon != nil && coupon.ValidForType(item.ProductType()) {
+			left := itemPrice.Subtotal - itemPrice.Discount
+			if includeTaxes {
+				left += itemPrice.Taxes
+			}
+			discountable += left * itemPrice.Quantity
+		}
 
 		price.Items = append(price.Items, itemPrice)
 
@@ -137,11 +128,128 @@ func CalculatePrice(settings *Settings, country, currency string, coupon Coupon,
 		price.Total += (itemPrice.Total * itemPrice.Quantity)
 	}
 
+	if coupon != nil && coupon.FixedDiscount() > 0 && coupon.ValidForPrice(currency, price.Subtotal) {
+		discount := coupon.FixedDiscount()
+		if discount > discountable {
+			discount = discountable
+		}
+		price.Discount += discount
+	}
+
 	price.Total = price.Subtotal - price.Discount + price.Taxes
 
 	return price
 }
 
+// itemTaxAmounts are the parts of the price of an item, and the percentage
+// each of them is taxed at
+func itemTaxAmounts(settings *Settings, country string, item Item) []taxAmount {
+	taxAmounts := []taxAmount{}
+	if item.FixedVAT() != 0 {
+		taxAmounts = append(taxAmounts, taxAmount{price: item.PriceInLowestUnit(), percentage: item.FixedVAT()})
+	} else if settings != nil && item.TaxableItems() != nil && len(item.TaxableItems()) > 0 {
+		for _, item := range item.TaxableItems() {
+			amount := taxAmount{price: item.PriceInLowestUnit()}
+			for _, t := range settings.Taxes {
+				if t.AppliesTo(country, item.ProductType()) {
+					amount.percentage = t.Percentage
+					break
+				}
+			}
+			taxAmounts = append(taxAmounts, amount)
+		}
+	} else if settings != nil {
+		for _, t := range settings.Taxes {
+			if t.AppliesTo(country, item.ProductType()) {
+				taxAmounts = append(taxAmounts, taxAmount{price: item.PriceInLowestUnit(), percentage: t.Percentage})
+				break
+			}
+		}
+	}
+	return taxAmounts
+}
+
+// RateTotal is the part of the items taxed at one percentage
+type RateTotal struct {
+	Percentage uint64
+	Net        uint64
+	Taxes      uint64
+}
+
+// TaxesByRate splits the net price and taxes of the items by the percentage
+// they're taxed at, the way CalculatePrice taxes them. Untaxed parts are left
+// out, and the totals are sorted by percentage.
+func TaxesByRate(settings *Settings, country string, items []Item) []RateTotal {
+	includeTaxes := settings != nil && settings.PricesIncludeTaxes
+	totals := []RateTotal{}
+	for _, item := range items {
+		for _, tax := range itemTaxAmounts(settings, country, item) {
+			if tax.percentage == 0 {
+				continue
+			}
+			if includeTaxes {
+				tax.price = rint(float64(tax.price) / (100 + float64(tax.percentage)) * 100)
+			}
+			taxes := rint(float64(tax.price) * float64(tax.percentage) / 100)
+
+			i := sort.Search(len(totals), func(i int) bool { return totals[i].Percentage >= tax.percentage })
+			if i == len(totals) || totals[i].Percentage != tax.percentage {
+				totals = append(totals, RateTotal{})
+				copy(totals[i+1:], totals[i:])
+				totals[i] = RateTotal{Percentage: tax.percentage}
+			}
+			totals[i].Net += tax.price * item.GetQuantity()
+			totals[i].Taxes += taxes * item.GetQuantity()
+		}
+	}
+	return totals
+}
+
+// Allocate splits amount into parts proportional to weights. The parts always
+// add up to amount, the remainder left after rounding down goes to the parts
+// with the largest fractions. Without any weight the amount is split evenly.
+func Allocate(amount uint64, weights []uint64) []uint64 {
+	parts := make([]uint64, len(weights))
+	if len(weights) == 0 {
+		return parts
+	}
+
+	var total uint64
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		weights = make([]uint64, len(parts))
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = uint64(len(weights))
+	}
+
+	remainders := make([]float64, len(parts))
+	var allocated uint64
+	for i, w := range weights {
+		exact := float64(amount) * float64(w) / float64(total)
+		whole, frac := math.Modf(exact)
+		parts[i] = uint64(whole)
+		remainders[i] = frac
+		allocated += parts[i]
+	}
+
+	for left := amount - allocated; left > 0; left-- {
+		largest := 0
+		for i := range remainders {
+			if remainders[i] > remainders[largest] {
+				largest = i
+			}
+		}
+		parts[largest]++
+		remainders[largest] = -1
+	}
+
+	return parts
+}
+
 // Nopes - no `round` method in go
 // See https://gist.github.com/siddontang/1806573b9a8574989ccb
 func rint(x float64) uint64 {
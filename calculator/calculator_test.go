@@ -151,6 +151,39 @@ func TestCouponWithVATWhenPRiceIncludeTaxesWithQuantity(t *testing.T) {
 	assert.Equal(t, uint64(180), price.Total)
 }
 
+func TestFixedCoupon(t *testing.T) {
+	coupon := &TestCoupon{itemType: "test", fixed: 15}
+	items := []Item{
+		&TestItem{price: 100, itemType: "test", quantity: 2},
+		&TestItem{price: 50, itemType: "other"},
+	}
+	price := CalculatePrice(nil, "USA", "USD", coupon, items)
+
+	assert.Equal(t, uint64(250), price.Subtotal)
+	assert.Equal(t, uint64(15), price.Discount)
+	assert.Equal(t, uint64(235), price.Total)
+
+	coupon = &TestCoupon{itemType: "test", fixed: 500}
+	price = CalculatePrice(nil, "USA", "USD", coupon, items)
+	assert.Equal(t, uint64(200), price.Discount, "a fixed discount only covers the items of its types")
+	assert.Equal(t, uint64(50), price.Total)
+
+	coupon = &TestCoupon{itemType: "test", fixed: 15, moreThan: 300}
+	price = CalculatePrice(nil, "USA", "USD", coupon, items)
+	assert.Equal(t, uint64(0), price.Discount)
+}
+
+func TestFixedCouponWhenPricesIncludeTaxes(t *testing.T) {
+	settings := &Settings{PricesIncludeTaxes: true, Taxes: []*Tax{&Tax{Percentage: 25}}}
+	coupon := &TestCoupon{itemType: "test", percentage: 50, fixed: 100}
+	price := CalculatePrice(settings, "USA", "USD", coupon, []Item{&TestItem{price: 125, itemType: "test"}})
+
+	assert.Equal(t, uint64(100), price.Subtotal)
+	assert.Equal(t, uint64(25), price.Taxes)
+	assert.Equal(t, uint64(125), price.Discount, "the fixed discount takes off what the percentage left")
+	assert.Equal(t, uint64(0), price.Total)
+}
+
 func TestPricingItems(t *testing.T) {
 	settings := &Settings{Taxes: []*Tax{&Tax{
 		Percentage:   7,
@@ -179,3 +212,42 @@ func TestPricingItems(t *testing.T) {
 	assert.Equal(t, uint64(0), price.Discount)
 	assert.Equal(t, uint64(110), price.Total)
 }
+
+func TestTaxesByRate(t *testing.T) {
+	settings := &Settings{Taxes: []*Tax{&Tax{
+		Percentage:   7,
+		ProductTypes: []string{"book"},
+		Countries:    []string{"DE"},
+	}, &Tax{
+		Percentage:   19,
+		ProductTypes: []string{"ebook"},
+		Countries:    []string{"DE"},
+	}}}
+	items := []Item{
+		&TestItem{price: 100, itemType: "ebook", quantity: 2},
+		&TestItem{price: 100, itemType: "book", items: []Item{
+			&TestItem{price: 80, itemType: "book"},
+			&TestItem{price: 20, itemType: "ebook"},
+		}},
+		&TestItem{price: 50, itemType: "ebook", vat: 7},
+		&TestItem{price: 30, itemType: "gift card"},
+	}
+
+	assert.Equal(t, []RateTotal{
+		{Percentage: 7, Net: 130, Taxes: 10},
+		{Percentage: 19, Net: 220, Taxes: 42},
+	}, TaxesByRate(settings, "DE", items))
+
+	settings.PricesIncludeTaxes = true
+	assert.Equal(t, []RateTotal{
+		{Percentage: 19, Net: 168, Taxes: 32},
+	}, TaxesByRate(settings, "DE", items[:1]))
+	assert.Empty(t, TaxesByRate(settings, "FR", items[:1]))
+}
+
+func TestAllocate(t *testing.T) {
+	assert.Equal(t, []uint64{667, 333}, Allocate(1000, []uint64{2000, 1000}))
+	assert.Equal(t, []uint64{34, 33, 33}, Allocate(100, []uint64{1, 1, 1}))
+	assert.Equal(t, []uint64{50, 50}, Allocate(100, []uint64{0, 0}))
+	assert.Equal(t, []uint64{}, Allocate(100, nil))
+}
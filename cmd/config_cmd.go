@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+var configCmd = cobra.Command{
+	Use:   "config",
+	Short: "Show the effective configuration",
+	Long:  "Show the effective configuration, after the environment config file and the environment variables, with its secrets redacted.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, showConfig)
+	},
+}
+
+var configCheckCmd = cobra.Command{
+	Use:   "check",
+	Short: "Check the configuration",
+	Long:  "Check the configuration and exit with an error if it's invalid. With --db it also connects to the database and checks that it's migrated.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, checkConfig)
+	},
+}
+
+var configCheckDB bool
+
+func init() {
+	configCheckCmd.Flags().BoolVar(&configCheckDB, "db", false, "Also check the database")
+	configCmd.AddCommand(&configCheckCmd)
+}
+
+func showConfig(config *conf.Configuration) {
+	inspection, err := conf.Inspect(config)
+	if err != nil {
+		logrus.Fatalf("Failed to inspect the configuration: %+v", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(inspection); err != nil {
+		logrus.Fatalf("Failed to print the configuration: %+v", err)
+	}
+}
+
+// checkConfig only has to report success, execWithConfig exits with the
+// problems of an invalid configuration
+func checkConfig(config *conf.Configuration) {
+	if configCheckDB {
+		db := openUnlimited(config)
+		defer db.Close()
+		if err := models.CheckSchemaVersion(db); err != nil {
+			logrus.Fatalf("Database isn't ready: %+v", err)
+		}
+	}
+	fmt.Println("Configuration is valid")
+}
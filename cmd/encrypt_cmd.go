@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+var encryptCmd = cobra.Command{
+	Use:   "encrypt [value]",
+	Short: "Encrypt a secret for the config file",
+	Long:  "Encrypt a config value with the master key in " + conf.MasterKeyVar + ", for an enc: value in the config file. The value is read from stdin when it isn't an argument. With --new-key a new master key is made instead.",
+	Run:   encrypt,
+}
+
+func init() {
+	encryptCmd.Flags().Bool("new-key", false, "Make a new master key")
+}
+
+func encrypt(cmd *cobra.Command, args []string) {
+	if newKey, _ := cmd.Flags().GetBool("new-key"); newKey {
+		key, err := conf.NewMasterKey()
+		if err != nil {
+			logrus.Fatalf("Failed to make a master key: %+v", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	key, err := conf.MasterKey()
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+	var value string
+	if len(args) > 0 {
+		value = args[0]
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			logrus.Fatalf("Failed to read the value: %+v", err)
+		}
+		value = strings.TrimRight(line, "\r\n")
+	}
+	encrypted, err := conf.Encrypt(value, key)
+	if err != nil {
+		logrus.Fatalf("Failed to encrypt the value: %+v", err)
+	}
+	fmt.Println(encrypted)
+}
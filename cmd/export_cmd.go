@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+var exportCmd = cobra.Command{
+	Use:   "export [file]",
+	Short: "Export all data as JSON lines",
+	Long:  "Write all the data in the database, deleted records included, to a file or stdout as JSON lines. Stop the API or switch it to read-only mode first, so the export is consistent.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, func(config *conf.Configuration) {
+			exportData(config, args)
+		})
+	},
+}
+
+var importCmd = cobra.Command{
+	Use:   "import [file]",
+	Short: "Import an export into an empty database",
+	Long:  "Load an export from a file or stdin into an empty database, which can be of another kind than the one it was exported from. The database is migrated first.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, func(config *conf.Configuration) {
+			importData(config, args)
+		})
+	},
+}
+
+func exportData(config *conf.Configuration, args []string) {
+	out := os.Stdout
+	if len(args) > 0 && args[0] != "-" {
+		file, err := os.Create(args[0])
+		if err != nil {
+			logrus.Fatalf("Error creating export file: %+v", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	db := openUnlimited(config)
+	w := bufio.NewWriter(out)
+	result, err := models.Export(db, w, time.Now())
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		logrus.Fatalf("Error exporting after %d records: %+v", result.Total(), err)
+	}
+	logrus.WithFields(exportFields(result)).Infof("Exported %d records", result.Total())
+}
+
+func importData(config *conf.Configuration, args []string) {
+	in := os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			logrus.Fatalf("Error opening export file: %+v", err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	db := openUnlimited(config)
+	if err := models.Migrate(db); err != nil {
+		logrus.Fatalf("Error migrating tables: %+v", err)
+	}
+	result, err := models.Import(db, bufio.NewReader(in))
+	if err != nil {
+		logrus.Fatalf("Error importing, nothing was imported: %+v", err)
+	}
+	logrus.WithFields(exportFields(result)).Infof("Imported %d records", result.Total())
+}
+
+func exportFields(result models.ExportResult) logrus.Fields {
+	fields := logrus.Fields{}
+	for table, count := range result {
+		fields[table] = count
+	}
+	return fields
+}
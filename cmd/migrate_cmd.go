@@ -1,27 +1,108 @@
 package cmd
 
 import (
+	"fmt"
+
 	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
 	"github.com/spf13/cobra"
 )
 
 var migrateCmd = cobra.Command{
-	Use:  "migrate",
-	Long: "Migrate database strucutures. This will create new tables and add missing collumns and indexes.",
+	Use:   "migrate",
+	Short: "Migrate the database",
+	Long:  "Migrate database structures. This applies the migrations after the current schema version, or up to --to.",
+	Run: func(cmd *cobra.Command, args []string) {
+		to, _ := cmd.Flags().GetInt("to")
+		execWithConfig(cmd, func(config *conf.Configuration) {
+			migrate(config, to)
+		})
+	},
+}
+
+var migrateDownCmd = cobra.Command{
+	Use:   "down",
+	Short: "Revert migrations",
+	Long:  "Revert the last migration, or the migrations after --to.",
 	Run: func(cmd *cobra.Command, args []string) {
-		execWithConfig(cmd, migrate)
+		to, _ := cmd.Flags().GetInt("to")
+		execWithConfig(cmd, func(config *conf.Configuration) {
+			migrateDown(config, to)
+		})
 	},
 }
 
-func migrate(config *conf.Configuration) {
+var migrateStatusCmd = cobra.Command{
+	Use:   "status",
+	Short: "List the migrations",
+	Long:  "List the migrations and whether they were applied.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, migrateStatus)
+	},
+}
+
+func init() {
+	migrateCmd.Flags().Int("to", 0, "The version to migrate to, the latest one by default")
+	migrateDownCmd.Flags().Int("to", -1, "The version to revert to, the one before the current version by default")
+	migrateCmd.AddCommand(&migrateDownCmd, &migrateStatusCmd)
+}
+
+// openUnlimited connects to the database without migrating it, and without
+// the query timeout for commands that run long statements like migrations.
+func openUnlimited(config *conf.Configuration) *gorm.DB {
+	config.DB.Automigrate = false
+	config.DB.QueryTimeout = 0
 	db, err := models.Connect(config)
 	if err != nil {
 		logrus.Fatalf("Error opening database: %+v", err)
 	}
+	return db
+}
 
-	if err := models.AutoMigrate(db); err != nil {
+func migrate(config *conf.Configuration, to int) {
+	db := openUnlimited(config)
+	if to == 0 {
+		to = models.SchemaVersion
+	}
+	if err := models.MigrateTo(db, to); err != nil {
 		logrus.Fatalf("Error migrating tables: %+v", err)
 	}
+	logrus.Infof("Migrated the database to version %d", to)
+}
+
+func migrateDown(config *conf.Configuration, to int) {
+	db := openUnlimited(config)
+	if to < 0 {
+		statuses, err := models.Migrations(db)
+		if err != nil {
+			logrus.Fatalf("Error reading schema version: %+v", err)
+		}
+		to = 0
+		for i, status := range statuses {
+			if status.Applied && i > 0 {
+				to = statuses[i-1].Version
+			}
+		}
+	}
+	if err := models.Rollback(db, to); err != nil {
+		logrus.Fatalf("Error reverting migrations: %+v", err)
+	}
+	logrus.Infof("Reverted the database to version %d", to)
+}
+
+func migrateStatus(config *conf.Configuration) {
+	db := openUnlimited(config)
+	statuses, err := models.Migrations(db)
+	if err != nil {
+		logrus.Fatalf("Error reading schema version: %+v", err)
+	}
+	for _, status := range statuses {
+		state := "pending"
+		if status.Applied {
+			state = "applied"
+		}
+		fmt.Printf("%4d  %-8s %s\n", status.Version, state, status.Name)
+	}
 }
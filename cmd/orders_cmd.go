@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/api"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// adminTokenTTL is how long the token of an admin command is valid
+const adminTokenTTL = 5 * time.Minute
+
+var ordersCmd = cobra.Command{
+	Use:   "orders",
+	Short: "Look up and change orders",
+	Long:  "Look up and change orders without the API, like over SSH. The commands go through the same checks as the API, and their changes are recorded in the audit log with the user running them and sent to the webhooks.",
+}
+
+var orderShowCmd = cobra.Command{
+	Use:   "show <id or ref>",
+	Short: "Show an order",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithOrder(cmd, args, func(client *adminClient, order *models.Order) {
+			printJSON(order)
+		})
+	},
+}
+
+var orderRefundCmd = cobra.Command{
+	Use:   "refund <id or ref>",
+	Short: "Refund the payment of an order",
+	Long:  "Refund the payment of an order through its payment provider, all of what's left to refund unless --amount is given.",
+	Run: func(cmd *cobra.Command, args []string) {
+		amount, _ := cmd.Flags().GetUint64("amount")
+		reason, _ := cmd.Flags().GetString("reason")
+		execWithOrder(cmd, args, func(client *adminClient, order *models.Order) {
+			refundOrder(client, order, amount, reason)
+		})
+	},
+}
+
+var orderReceiptCmd = cobra.Command{
+	Use:   "resend-receipt <id or ref>",
+	Short: "Send the order confirmation again",
+	Run: func(cmd *cobra.Command, args []string) {
+		email, _ := cmd.Flags().GetString("email")
+		execWithOrder(cmd, args, func(client *adminClient, order *models.Order) {
+			client.do("POST", "/v1/orders/"+order.ID+"/receipt", &api.ReceiptParams{Email: email}, nil)
+			logrus.Infof("Sent the receipt of order %s", order.ID)
+		})
+	},
+}
+
+var orderFulfillCmd = cobra.Command{
+	Use:   "fulfill <id or ref>",
+	Short: "Set the fulfillment state of an order",
+	Long:  "Set the fulfillment state of an order, shipped unless --state is given, along with how it was shipped.",
+	Run: func(cmd *cobra.Command, args []string) {
+		params := &api.OrderParams{}
+		params.FulfillmentState, _ = cmd.Flags().GetString("state")
+		params.Carrier, _ = cmd.Flags().GetString("carrier")
+		params.TrackingNumber, _ = cmd.Flags().GetString("tracking-number")
+		params.TrackingURL, _ = cmd.Flags().GetString("tracking-url")
+		execWithOrder(cmd, args, func(client *adminClient, order *models.Order) {
+			updated := &models.Order{}
+			client.do("PUT", "/v1/orders/"+order.ID, params, updated)
+			logrus.Infof("Order %s is %s", updated.ID, updated.FulfillmentState)
+		})
+	},
+}
+
+func init() {
+	orderRefundCmd.Flags().Uint64("amount", 0, "The amount to refund in the lowest currency unit, like cents")
+	orderRefundCmd.Flags().String("reason", "", "The reason for the refund, one of the configured refund reasons")
+	orderReceiptCmd.Flags().String("email", "", "The address to send the receipt to instead of the one of the order")
+	orderFulfillCmd.Flags().String("state", models.ShippedState, "The fulfillment state, pending, shipping or shipped")
+	orderFulfillCmd.Flags().String("carrier", "", "The carrier the order was shipped with")
+	orderFulfillCmd.Flags().String("tracking-number", "", "The tracking number of the shipment")
+	orderFulfillCmd.Flags().String("tracking-url", "", "Where the customer can track the shipment")
+	ordersCmd.AddCommand(&orderShowCmd, &orderRefundCmd, &orderReceiptCmd, &orderFulfillCmd)
+}
+
+// adminClient calls the API in the same process as an admin
+type adminClient struct {
+	handler http.Handler
+	token   string
+}
+
+// do sends a request with body as JSON and decodes the response into out. It
+// exits with the message of the API when the request fails.
+func (c *adminClient) do(method, path string, body, out interface{}) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			logrus.Fatalf("Error encoding request: %+v", err)
+		}
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(data))
+	r.RemoteAddr = "127.0.0.1:0"
+	r.Header.Set("Authorization", "Bearer "+c.token)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, r)
+
+	if w.Code >= http.StatusBadRequest {
+		httpErr := &api.HTTPError{}
+		if err := json.Unmarshal(w.Body.Bytes(), httpErr); err != nil || httpErr.Message == "" {
+			logrus.Fatalf("%s %s failed with status %d: %s", method, path, w.Code, w.Body.String())
+		}
+		logrus.Fatalf("%s %s failed: %s", method, path, httpErr.Message)
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			logrus.Fatalf("Error decoding response of %s %s: %+v", method, path, err)
+		}
+	}
+}
+
+// execWithOrder runs fn with the order named by the first argument, found by
+// its ID or its ref
+func execWithOrder(cmd *cobra.Command, args []string, fn func(client *adminClient, order *models.Order)) {
+	if len(args) != 1 {
+		logrus.Fatal("Give the ID or the ref of the order")
+	}
+	execWithConfig(cmd, func(config *conf.Configuration) {
+		if config.MultiInstance.Enabled {
+			logrus.Fatal("The order commands only work for a single store, use the API of the instance in multi-instance mode")
+		}
+
+		db, err := models.Connect(config)
+		if err != nil {
+			logrus.Fatalf("Error opening database: %+v", err)
+		}
+		if err := models.CheckSchemaVersion(db); err != nil {
+			logrus.Fatalf("Refusing to change orders: %+v", err)
+		}
+		server, _ := newAPI(config, db, db)
+
+		actor := "cli"
+		if u, err := user.Current(); err == nil {
+			actor = "cli:" + u.Username
+		}
+		token, err := api.AdminToken(config, actor, "", adminTokenTTL)
+		if err != nil {
+			logrus.Fatalf("Error signing admin token: %+v", err)
+		}
+
+		client := &adminClient{handler: server.Handler(), token: token}
+		order := &models.Order{}
+		client.do("GET", "/v1/orders/"+args[0], nil, order)
+		fn(client, order)
+	})
+}
+
+func refundOrder(client *adminClient, order *models.Order, amount uint64, reason string) {
+	var charge *models.Transaction
+	refunded := uint64(0)
+	for _, t := range order.Transactions {
+		switch {
+		case t.Status != models.PaidState:
+		case t.Type == models.ChargeTransactionType:
+			charge = t
+		case t.Type == models.RefundTransactionType:
+			refunded += t.Amount
+		}
+	}
+	if charge == nil {
+		logrus.Fatalf("Order %s has no payment to refund", order.ID)
+	}
+	if amount == 0 {
+		if refunded >= charge.Amount {
+			logrus.Fatalf("The payment of order %s was refunded already", order.ID)
+		}
+		amount = charge.Amount - refunded
+	}
+
+	refund := &models.Transaction{}
+	client.do("POST", "/v1/payments/"+charge.ID+"/refund", &api.PaymentParams{Amount: amount, Currency: charge.Currency, Reason: reason}, refund)
+	logrus.Infof("Refunded %d %s of order %s", refund.Amount, refund.Currency, order.ID)
+}
+
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		logrus.Fatalf("Failed to print the result: %+v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+var purgeDryRun bool
+
+var purgeCmd = cobra.Command{
+	Use:   "purge-test-orders",
+	Short: "Delete the orders placed in test mode",
+	Long:  "Permanently delete the orders placed in test mode, along with their transactions. Refuses to run with live payment credentials.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, purgeTestOrders)
+	},
+}
+
+func init() {
+	purgeCmd.Flags().BoolVar(&purgeDryRun, "dry-run", false, "Only count what would be deleted")
+}
+
+func purgeTestOrders(config *conf.Configuration) {
+	if !config.TestMode() {
+		logrus.Fatal("Refusing to purge test orders with live payment credentials")
+	}
+
+	db, err := models.Connect(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+
+	result, err := models.PurgeTestOrders(db, purgeDryRun)
+	if err != nil {
+		logrus.Fatalf("Error purging test orders: %+v", err)
+	}
+
+	action := "Purged"
+	if purgeDryRun {
+		action = "Would purge"
+	}
+	logrus.Infof("%s %d orders, %d line items, %d kit components, %d downloads, %d transactions, %d order taxes, %d events, "+
+		"%d notes, %d mails, %d hooks with %d attempts, %d payment attempts, %d coupon redemptions, %d referral credits and %d addresses",
+		action, result.Orders, result.LineItems, result.Components, result.Downloads, result.Transactions, result.Taxes, result.Events,
+		result.Notes, result.Mails, result.Hooks, result.HookAttempts, result.PaymentAttempts, result.CouponRedemptions, result.ReferralCredits,
+		result.Addresses)
+}
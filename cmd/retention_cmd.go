@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/retention"
+)
+
+var retentionDryRun bool
+
+var retentionCmd = cobra.Command{
+	Use:   "retention",
+	Short: "Apply the retention policy now",
+	Long:  "Archive or anonymize the orders older than the retention period now, instead of waiting for the next run while serving.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, applyRetention)
+	},
+}
+
+func init() {
+	retentionCmd.Flags().BoolVar(&retentionDryRun, "dry-run", false, "Only count the orders that would be handled")
+}
+
+func applyRetention(config *conf.Configuration) {
+	if config.Retention.OrderYears <= 0 {
+		logrus.Fatal("No retention policy is configured, set retention.order_years")
+	}
+
+	db, err := models.Connect(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+
+	var archive retention.Archive
+	if config.Retention.ArchiveURL != "" {
+		if archive, err = retention.NewArchive(config.Retention.ArchiveURL, config.HTTPClient(time.Minute)); err != nil {
+			logrus.Fatalf("Error opening archive: %+v", err)
+		}
+	}
+
+	result, err := retention.Apply(context.Background(), db, config, archive, time.Now(), retentionDryRun)
+	if err != nil {
+		logrus.Fatalf("Error applying the retention policy after %d orders: %+v", result.Orders, err)
+	}
+
+	action := "Applied"
+	if retentionDryRun {
+		action = "Would apply"
+	}
+	logrus.Infof("%s %s retention to %d orders older than %d years", action, result.Action, result.Orders, config.Retention.OrderYears)
+}
@@ -20,7 +20,10 @@ var rootCmd = cobra.Command{
 // NewRoot will add flags and subcommands to the different commands
 func RootCmd() *cobra.Command {
 	rootCmd.PersistentFlags().StringP("config", "c", "", "The configuration file")
-	rootCmd.AddCommand(&serveCmd, &migrateCmd, &versionCmd)
+	if err := conf.BindFlags(rootCmd.PersistentFlags()); err != nil {
+		logrus.Fatalf("Failed to define the configuration flags: %+v", err)
+	}
+	rootCmd.AddCommand(&serveCmd, &workerCmd, &migrateCmd, &purgeCmd, &retentionCmd, &exportCmd, &importCmd, &seedCmd, &ordersCmd, &configCmd, &encryptCmd, &versionCmd)
 	return &rootCmd
 }
 
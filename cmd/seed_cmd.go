@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/refs"
+	"github.com/netlify/gocommerce/seed"
+)
+
+var seedCmd = cobra.Command{
+	Use:   "seed",
+	Short: "Load a demo store",
+	Long:  "Load demo customers, stock and orders in every state into the database, for developing and testing storefronts. The orders are test orders, purge-test-orders removes them. Refuses to run with live payment credentials.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, seedDemo)
+	},
+}
+
+func seedDemo(config *conf.Configuration) {
+	if !config.TestMode() {
+		logrus.Fatal("Refusing to seed demo data with live payment credentials")
+	}
+
+	db, err := models.Connect(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+
+	result, err := seed.Seed(db, refs.NewObfuscator(config.OrderRefs.Salt, config.OrderRefs.Alphabet), time.Now())
+	if err == seed.ErrSeeded {
+		logrus.Info("The demo data is in the database already")
+		return
+	}
+	if err != nil {
+		logrus.Fatalf("Error seeding demo data: %+v", err)
+	}
+	logrus.Infof("Seeded %d users, %d orders, %d transactions and %d inventory items, add the coupon %s to the coupons of the site to use it",
+		result.Users, result.Orders, result.Transactions, result.InventoryItems, seed.Coupon.Code)
+}
@@ -1,39 +1,149 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/api"
 	"github.com/netlify/gocommerce/assetstores"
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/mailer"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/retention"
+	"github.com/netlify/gocommerce/scheduler"
+	"github.com/netlify/gocommerce/tracing"
 	"github.com/spf13/cobra"
 	stripe "github.com/stripe/stripe-go"
 
 	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
 )
 
+// shutdownTimeout is how long in-flight requests get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
 var serveCmd = cobra.Command{
-	Use:  "serve",
-	Long: "Start API server",
+	Use:   "serve",
+	Short: "Start the API server",
+	Long:  "Start API server",
 	Run: func(cmd *cobra.Command, args []string) {
 		execWithConfig(cmd, serve)
 	},
 }
 
 func serve(config *conf.Configuration) {
+	shutdownTracing, err := tracing.Configure(config, Version)
+	if err != nil {
+		logrus.Fatalf("Error configuring tracing: %+v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	db, err := models.Connect(config)
 	if err != nil {
 		logrus.Fatalf("Error opening database: %+v", err)
 	}
 
+	if err := models.CheckSchemaVersion(db); err != nil {
+		logrus.Fatalf("Refusing to serve: %+v", err)
+	}
+
 	bgDB, err := models.Connect(config)
 	if err != nil {
 		logrus.Fatalf("Error opening database: %+v", err)
 	}
 
+	api, mailer := newAPI(config, db.Debug(), bgDB)
+
+	l := fmt.Sprintf("%v:%v", config.API.Host, config.API.Port)
+	logrus.Infof("GoCommerce API started on: %s", l)
+
+	if config.Worker.Enabled {
+		logrus.Info("Leaving the background work to the workers")
+	}
+	stopBackground := runBackground(config, bgDB, api, mailer, !config.Worker.Enabled)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func(current *conf.Configuration) {
+		for range reload {
+			reloaded, err := conf.Reload(current)
+			if err != nil {
+				logrus.WithError(err).Error("Error reloading configuration, keeping the current one")
+				continue
+			}
+			current = reloaded
+			api.Reload(current)
+			mailer.Reload(current)
+			logrus.Info("Reloaded configuration")
+		}
+	}(config)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		logrus.Infof("Received %v, shutting down", sig)
+		signal.Stop(reload)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := api.Shutdown(ctx); err != nil {
+			logrus.WithError(err).Error("Error while draining connections")
+		}
+		stopBackground()
+	}()
+
+	if err := api.ListenAndServe(l); err != nil {
+		logrus.Fatalf("Error serving API: %+v", err)
+	}
+	<-done
+
+	logrus.Info("GoCommerce API stopped")
+	if err := conf.FlushLogs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error flushing logs: %v\n", err)
+	}
+}
+
+// runBackground starts the scheduled tasks of the process. With shared set,
+// it also delivers the webhooks, retries the mails and runs the scheduled
+// tasks that run in one process at a time. Calling stop waits for the work
+// in flight.
+func runBackground(config *conf.Configuration, db *gorm.DB, server *api.API, m *mailer.Mailer, shared bool) (stop func()) {
+	tasks := scheduler.New(db, logrus.WithField("component", "scheduler"))
+	for _, task := range append(server.ScheduledTasks(),
+		mailer.CartRemindersTask(config, server.MailStores(db), logrus.WithField("component", "cart_reminders")),
+		retention.Task(db, logrus.WithField("component", "retention"), config),
+	) {
+		if task != nil && (shared || task.Local) {
+			tasks.Add(task)
+		}
+	}
+	stopTasks := tasks.Run()
+	if !shared {
+		return stopTasks
+	}
+
+	stopHooks := models.RunHooks(db, logrus.WithField("component", "hooks"), config)
+	stopMails := m.RunQueue(logrus.WithField("component", "mail_queue"))
+	stopDigest := mailer.RunDigest(config, server.MailStores(db), logrus.WithField("component", "mail_digest"))
+	return func() {
+		stopTasks()
+		stopHooks()
+		stopDigest()
+		stopMails()
+	}
+}
+
+// newAPI sets up the API with its payment providers, mailer and asset store.
+// The mailer queues its mails in bgDB.
+func newAPI(config *conf.Configuration, db, bgDB *gorm.DB) (*api.API, *mailer.Mailer) {
 	var ppEnv string
 	if config.Payment.Paypal.Env == "production" {
 		ppEnv = paypalsdk.APIBaseLive
@@ -49,26 +159,24 @@ func serve(config *conf.Configuration) {
 	if err != nil {
 		logrus.Fatalf("Error configuring paypal: %+v", err)
 	}
+	paypal.Client = config.HTTPClient(config.Timeouts.Payments)
 	_, err = paypal.GetAccessToken()
 	if err != nil {
 		logrus.Fatalf("Error authorizing with paypal: %+v", err)
 	}
 
 	mailer := mailer.NewMailer(config)
+	mailer.Queue = bgDB
+	mailer.Suppressions = bgDB
 
 	store, err := assetstores.NewStore(config)
 	if err != nil {
 		logrus.Fatalf("Error initializing asset store: %+v", err)
 	}
 
-	api := api.NewAPIWithVersion(config, db.Debug(), paypal, mailer, store, Version)
+	api := api.NewAPIWithBuild(config, db, paypal, mailer, store, build())
 
 	stripe.Key = config.Payment.Stripe.SecretKey
-
-	l := fmt.Sprintf("%v:%v", config.API.Host, config.API.Port)
-	logrus.Infof("GoCommerce API started on: %s", l)
-
-	models.RunHooks(bgDB, logrus.WithField("component", "hooks"), config.Webhooks.Secret)
-
-	api.ListenAndServe(l)
+	stripe.SetHTTPClient(config.HTTPClient(config.Timeouts.Payments))
+	return api, mailer
 }
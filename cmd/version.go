@@ -2,17 +2,40 @@ package cmd
 
 import (
 	"fmt"
+	"runtime"
 
 	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/api"
 )
 
-var Version string
+// Version, Commit and BuildDate are set when the binary is built, like
+// with -ldflags "-X github.com/netlify/gocommerce/cmd.Version=v1.2.0"
+var (
+	Version   string
+	Commit    string
+	BuildDate string
+)
 
 var versionCmd = cobra.Command{
-	Run: showVersion,
-	Use: "version",
+	Run:   showVersion,
+	Use:   "version",
+	Short: "Print the version",
+	Long:  "Print the version of gocommerce, with the commit and the date it was built from.",
 }
 
 func showVersion(cmd *cobra.Command, args []string) {
 	fmt.Println(Version)
+	if Commit != "" {
+		fmt.Printf("commit:     %s\n", Commit)
+	}
+	if BuildDate != "" {
+		fmt.Printf("built:      %s\n", BuildDate)
+	}
+	fmt.Printf("go version: %s\n", runtime.Version())
+}
+
+// build is the build info the API serves
+func build() api.BuildInfo {
+	return api.BuildInfo{Version: Version, Commit: Commit, BuildDate: BuildDate}
 }
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/gocommerce/api"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/tracing"
+	"github.com/netlify/gocommerce/worker"
+)
+
+var workerCmd = cobra.Command{
+	Use:   "worker",
+	Short: "Run the background work of the API",
+	Long:  "Run the jobs the API queues, deliver the webhooks, retry the mails and run the periodic tasks, so the API processes only serve requests. Enable worker.enabled for the API to leave this work to the workers. Any number of workers can run at once.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, work)
+	},
+}
+
+func work(config *conf.Configuration) {
+	shutdownTracing, err := tracing.Configure(config, Version)
+	if err != nil {
+		logrus.Fatalf("Error configuring tracing: %+v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	db, err := models.Connect(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	if err := models.CheckSchemaVersion(db); err != nil {
+		logrus.Fatalf("Refusing to work: %+v", err)
+	}
+	if !config.Worker.Enabled {
+		logrus.Warn("worker.enabled is off, the API runs the background work as well and queues no jobs")
+	}
+
+	server, mailer := newAPI(config, db, db)
+	jobs := worker.New(db, logrus.WithField("component", "worker"), config)
+	jobs.Handle(api.EventJob, server.RunEventJob)
+
+	stopJobs := jobs.Run()
+	stopBackground := runBackground(config, db, server, mailer, true)
+	logrus.Infof("GoCommerce worker started, running %d jobs at once", config.Worker.Concurrency)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func(current *conf.Configuration) {
+		for range reload {
+			reloaded, err := conf.Reload(current)
+			if err != nil {
+				logrus.WithError(err).Error("Error reloading configuration, keeping the current one")
+				continue
+			}
+			current = reloaded
+			server.Reload(current)
+			mailer.Reload(current)
+			logrus.Info("Reloaded configuration")
+		}
+	}(config)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	logrus.Infof("Received %v, shutting down", sig)
+	signal.Stop(reload)
+	stopJobs()
+	stopBackground()
+
+	logrus.Info("GoCommerce worker stopped")
+	if err := conf.FlushLogs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error flushing logs: %v\n", err)
+	}
+}
@@ -1,25 +1,258 @@
 package conf
 
 import (
+	"fmt"
+	"net/mail"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"bufio"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
+
+	"github.com/netlify/gocommerce/refs"
+	"github.com/netlify/gocommerce/sinks"
+	"github.com/netlify/gocommerce/webhooks"
+)
+
+// DefaultCancellationReasons are used when no cancellation reasons are configured
+var DefaultCancellationReasons = []string{"customer_request", "fraud", "out_of_stock", "other"}
+
+// DefaultDisposableDomains are the email domains the fraud rules treat as
+// disposable when none are configured
+var DefaultDisposableDomains = []string{
+	"10minutemail.com",
+	"guerrillamail.com",
+	"mailinator.com",
+	"sharklasers.com",
+	"temp-mail.org",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// DefaultFraudVelocityWindow is how far back the fraud rules count the
+// orders of an email address
+const DefaultFraudVelocityWindow = 24 * time.Hour
+
+// Default timeouts of the API server and of its calls to other services
+const (
+	DefaultReadTimeout   = 30 * time.Second
+	DefaultWriteTimeout  = 60 * time.Second
+	DefaultIdleTimeout   = 120 * time.Second
+	DefaultClientTimeout = 10 * time.Second
+	// DefaultPaymentTimeout is longer, charges can take a while at the
+	// payment provider
+	DefaultPaymentTimeout = 30 * time.Second
+)
+
+// Defaults of the database connection pool, which leave room for several
+// instances under the connection limit of a database
+const (
+	DefaultMaxOpenConns    = 20
+	DefaultMaxIdleConns    = 10
+	DefaultConnMaxLifetime = 30 * time.Minute
+)
+
+// DefaultQueryTimeout is how long a statement can run on the database
+const DefaultQueryTimeout = 30 * time.Second
+
+// Retention actions
+const (
+	ArchiveRetention   = "archive"
+	AnonymizeRetention = "anonymize"
+)
+
+// DefaultRetentionInterval is how often expired orders are looked for
+const DefaultRetentionInterval = 24 * time.Hour
+
+// DefaultVATCacheTTL is how long a valid VAT number is trusted by default
+const DefaultVATCacheTTL = 24 * time.Hour
+
+// Exchange rate providers
+const (
+	ECBRates               = "ecb"
+	OpenExchangeRatesRates = "openexchangerates"
+)
+
+// DefaultRatesCacheTTL is how long exchange rates are used before they're
+// fetched again
+const DefaultRatesCacheTTL = time.Hour
+
+// DefaultRatesMaxStale is how long the last exchange rates are used while
+// the provider fails
+const DefaultRatesMaxStale = 24 * time.Hour
+
+// DefaultRevalidateVATInterval is how often the VAT numbers VIES couldn't
+// check are checked again
+const DefaultRevalidateVATInterval = 15 * time.Minute
+
+// DefaultExpireOrdersInterval is how often unpaid orders are looked for to
+// expire them
+const DefaultExpireOrdersInterval = 5 * time.Minute
+
+// DefaultSettleChargesInterval is how often the charges left processing are
+// looked up with the payment provider
+const DefaultSettleChargesInterval = 5 * time.Minute
+
+// Defaults for running and retrying the jobs of the workers
+const (
+	DefaultWorkerConcurrency    = 5
+	DefaultWorkerPollInterval   = time.Second
+	DefaultWorkerMaxRetries     = 8
+	DefaultWorkerRetryPeriod    = 30 * time.Second
+	DefaultWorkerMaxRetryPeriod = time.Hour
+)
+
+// DefaultPaymentWindow is how far back payment attempts are counted against
+// the payment limits
+const DefaultPaymentWindow = time.Hour
+
+// Defaults for the numbers of invoices
+const (
+	DefaultInvoicePrefix = "INV-"
+	DefaultInvoiceDigits = 6
+)
+
+// DefaultMaxBodySize is the largest request body the API reads by default
+const DefaultMaxBodySize = 1 << 20
+
+// Defaults for the size of orders
+const (
+	DefaultMaxLineItems   = 100
+	DefaultMaxQuantity    = 10000
+	DefaultMaxMetaSize    = 16 << 10
+	DefaultMaxFieldLength = 255
 )
 
+// Defaults for abandoned cart reminders
+const (
+	DefaultAbandonedCartMaxAge   = 7 * 24 * time.Hour
+	DefaultAbandonedCartInterval = 15 * time.Minute
+)
+
+// Defaults for retrying mails
+const (
+	DefaultMailMaxRetries     = 8
+	DefaultMailRetryPeriod    = time.Minute
+	DefaultMailMaxRetryPeriod = time.Hour
+)
+
+// DefaultMailTemplateTTL is how long a mail template loaded from the site is
+// used before it's loaded again
+const DefaultMailTemplateTTL = 10 * time.Second
+
+// DefaultSettingsTTL is how long the settings.json of the site is used before
+// it's loaded again
+const DefaultSettingsTTL = time.Minute
+
+// DefaultReportsCacheTTL is how long the sales by period are served from the
+// cache
+const DefaultReportsCacheTTL = time.Minute
+
+// Defaults for delivering and retrying webhooks
+const (
+	DefaultWebhookMaxRetries          = 8
+	DefaultWebhookRetryPeriod         = 30 * time.Second
+	DefaultWebhookMaxRetryPeriod      = time.Hour
+	DefaultWebhookUnhealthyAfter      = 10
+	DefaultWebhookConcurrency         = 5
+	DefaultWebhookEndpointConcurrency = 2
+	DefaultWebhookBreakerCooldown     = 5 * time.Minute
+)
+
+// The addresses taxes can be calculated for
+const (
+	ShippingTaxBasis = "shipping"
+	BillingTaxBasis  = "billing"
+)
+
+// Mail providers
+const (
+	SMTPProvider     = "smtp"
+	SendGridProvider = "sendgrid"
+	MailgunProvider  = "mailgun"
+	SESProvider      = "ses"
+)
+
+// DefaultGoodwillReasons are used when no goodwill reasons are configured
+var DefaultGoodwillReasons = []string{"late_delivery", "damaged_item", "service_issue", "other"}
+
+// EventSink is a message broker events are published to
+type EventSink struct {
+	Name string `mapstructure:"name" json:"name"`
+	URL  string `mapstructure:"url" json:"url"`
+	// Events are the event types published to the sink, all of them if empty
+	Events []string `mapstructure:"events" json:"events"`
+	// Format is json or cloudevents
+	Format string `mapstructure:"format" json:"format"`
+}
+
+// ScheduledTask configures a recurring task
+type ScheduledTask struct {
+	Disabled bool `mapstructure:"disabled" json:"disabled"`
+	// Interval is how often the task runs
+	Interval time.Duration `mapstructure:"interval" json:"interval"`
+}
+
+// JWTKey is a secret tokens with its ID in their kid header are signed with
+type JWTKey struct {
+	ID     string `mapstructure:"id" json:"id"`
+	Secret string `mapstructure:"secret" json:"secret"`
+}
+
+// InvoiceSeries is a series of invoice numbers of its own, for the orders
+// taxed for some countries
+type InvoiceSeries struct {
+	Prefix    string   `mapstructure:"prefix" json:"prefix"`
+	Countries []string `mapstructure:"countries" json:"countries"`
+}
+
 // Configuration holds all the confiruation for authlify
 type Configuration struct {
 	SiteURL string `mapstructure:"site_url" json:"site_url"`
 
+	// Settings are the commerce settings the site serves at
+	// /gocommerce/settings.json, like its taxes
+	Settings struct {
+		// TTL is how long the settings are used before they're loaded again
+		TTL time.Duration `mapstructure:"ttl" json:"ttl"`
+	} `mapstructure:"settings" json:"settings"`
+
+	Reports struct {
+		// CacheTTL is how long the sales by period are served from the
+		// cache, so dashboards polling them don't add up the orders every time
+		CacheTTL time.Duration `mapstructure:"cache_ttl" json:"cache_ttl"`
+	} `mapstructure:"reports" json:"reports"`
+
 	JWT struct {
 		Secret         string `mapstructure:"secret" json:"secret"`
 		AdminGroupName string `mapstructure:"admin_group_name" json:"admin_group_name"`
+
+		// Audience and Issuer are the aud and iss claims tokens must have
+		// when set, so tokens the identity provider issues for other
+		// services are refused
+		Audience string `mapstructure:"audience" json:"audience"`
+		Issuer   string `mapstructure:"issuer" json:"issuer"`
+
+		// Roles maps the roles of a token to the scopes they grant, so
+		// staff can get part of the admin access
+		Roles map[string][]string `mapstructure:"roles" json:"roles"`
+
+		// Keys are more secrets tokens can be signed with, picked by the
+		// kid header of the token, so the secret can be rotated. Tokens
+		// without a kid are signed with the secret.
+		Keys []JWTKey `mapstructure:"keys" json:"keys"`
+		// SigningKeyID is the key of the tokens gocommerce signs itself, like
+		// the ones of the CLI, the secret when it's empty
+		SigningKeyID string `mapstructure:"signing_key_id" json:"signing_key_id"`
 	} `mapstructure:"jwt" json:"jwt"`
 
 	DB struct {
@@ -27,41 +260,196 @@ type Configuration struct {
 		ConnURL     string `mapstructure:"url" json:"url"`
 		Namespace   string `mapstructure:"namespace" json:"namespace"`
 		Automigrate bool   `mapstructure:"automigrate" json:"automigrate"`
+
+		// RequireMigrations disables automigrate, so migrations have to be run
+		// with `gocommerce migrate` before new instances can start
+		RequireMigrations bool `mapstructure:"require_migrations" json:"require_migrations"`
+
+		// The connection pool of each instance. Connections are closed once
+		// they're older than ConnMaxLifetime, so they move to new database
+		// servers after a failover.
+		MaxOpenConns    int           `mapstructure:"max_open_conns" json:"max_open_conns"`
+		MaxIdleConns    int           `mapstructure:"max_idle_conns" json:"max_idle_conns"`
+		ConnMaxLifetime time.Duration `mapstructure:"conn_max_lifetime" json:"conn_max_lifetime"`
+
+		// QueryTimeout is how long a statement can run before it's cancelled.
+		// Migrations aren't limited.
+		QueryTimeout time.Duration `mapstructure:"query_timeout" json:"query_timeout"`
 	} `mapstructure:"db" json:"db"`
 
 	API struct {
 		Host string `mapstructure:"host" json:"host"`
 		Port int    `mapstructure:"port" json:"port"`
+
+		// PublicURL is where customers reach the API, for the links in mails
+		PublicURL string `mapstructure:"public_url" json:"public_url"`
+
+		ReadTimeout  time.Duration `mapstructure:"read_timeout" json:"read_timeout"`
+		WriteTimeout time.Duration `mapstructure:"write_timeout" json:"write_timeout"`
+		IdleTimeout  time.Duration `mapstructure:"idle_timeout" json:"idle_timeout"`
+
+		// MaxBodySize is the largest request body, in bytes, the API reads
+		MaxBodySize int64 `mapstructure:"max_body_size" json:"max_body_size"`
+
+		// TLS lets the API serve HTTPS itself, with either a certificate and key
+		// or certificates from Let's Encrypt for the autocert hosts
+		TLS struct {
+			CertFile string `mapstructure:"cert_file" json:"cert_file"`
+			KeyFile  string `mapstructure:"key_file" json:"key_file"`
+			Autocert struct {
+				Hosts    []string `mapstructure:"hosts" json:"hosts"`
+				CacheDir string   `mapstructure:"cache_dir" json:"cache_dir"`
+				Email    string   `mapstructure:"email" json:"email"`
+			} `mapstructure:"autocert" json:"autocert"`
+		} `mapstructure:"tls" json:"tls"`
+
+		// CORS locks the API down to known storefronts. All origins are
+		// allowed when AllowedOrigins is empty.
+		CORS struct {
+			AllowedOrigins []string `mapstructure:"allowed_origins" json:"allowed_origins"`
+			// MaxAge is how many seconds browsers may cache preflight responses
+			MaxAge         int      `mapstructure:"max_age" json:"max_age"`
+			ExposedHeaders []string `mapstructure:"exposed_headers" json:"exposed_headers"`
+		} `mapstructure:"cors" json:"cors"`
+
+		// AdminAllowedIPs are the networks, like 10.0.0.0/8, staff can use
+		// the admin endpoints from, on top of the checks of their tokens.
+		// They can be used from anywhere when it's empty.
+		AdminAllowedIPs []string `mapstructure:"admin_allowed_ips" json:"admin_allowed_ips"`
+		// TrustedProxies are the load balancers in front of the API, whose
+		// X-Forwarded-For header tells the address of the client
+		TrustedProxies []string `mapstructure:"trusted_proxies" json:"trusted_proxies"`
 	} `mapstructure:"api" json:"api"`
 	LogConf struct {
-		Level string `mapstructure:"level"`
-		File  string `mapstructure:"file"`
+		Level  string `mapstructure:"level"`
+		File   string `mapstructure:"file"`
+		Format string `mapstructure:"format"`
+		// Redact removes personal data, like emails, and secrets, like
+		// tokens and card numbers, from the logs
+		Redact bool `mapstructure:"redact"`
 	} `mapstructure:"log_conf"`
 	Mailer struct {
+		// Provider sends the mails, one of smtp, sendgrid, mailgun or ses
+		Provider string `mapstructure:"provider" json:"provider"`
+
 		Host       string `mapstructure:"host" json:"host"`
 		Port       int    `mapstructure:"port" json:"port"`
 		User       string `mapstructure:"user" json:"user"`
 		Pass       string `mapstructure:"pass" json:"pass"`
 		AdminEmail string `mapstructure:"admin_email" json:"admin_email"`
-		Subjects   struct {
-			OrderConfirmation string `mapstructure:"order_confirmation" json:"order_confirmation"`
-			OrderReceived     string `mapstructure:"order_received" json:"order_received"`
+
+		SendGrid struct {
+			APIKey string `mapstructure:"api_key" json:"api_key"`
+			APIURL string `mapstructure:"api_url" json:"api_url"`
+			// WebhookVerificationKey is the base64 encoded public key that
+			// signs the bounce webhooks
+			WebhookVerificationKey string `mapstructure:"webhook_verification_key" json:"webhook_verification_key"`
+		} `mapstructure:"sendgrid" json:"sendgrid"`
+		Mailgun struct {
+			Domain string `mapstructure:"domain" json:"domain"`
+			APIKey string `mapstructure:"api_key" json:"api_key"`
+			// APIURL is https://api.eu.mailgun.net/v3 for domains in the EU
+			APIURL            string `mapstructure:"api_url" json:"api_url"`
+			WebhookSigningKey string `mapstructure:"webhook_signing_key" json:"webhook_signing_key"`
+		} `mapstructure:"mailgun" json:"mailgun"`
+		SES struct {
+			Region   string `mapstructure:"region" json:"region"`
+			Endpoint string `mapstructure:"endpoint" json:"endpoint"`
+			// WebhookToken must be in the token parameter of the URL of the
+			// SNS subscription that sends the bounces
+			WebhookToken string `mapstructure:"webhook_token" json:"webhook_token"`
+		} `mapstructure:"ses" json:"ses"`
+
+		// Mails that fail because of a temporary problem of the provider are
+		// retried up to MaxRetries times, waiting twice as long after every
+		// try, starting at RetryPeriod and at most MaxRetryPeriod
+		MaxRetries     int           `mapstructure:"max_retries" json:"max_retries"`
+		RetryPeriod    time.Duration `mapstructure:"retry_period" json:"retry_period"`
+		MaxRetryPeriod time.Duration `mapstructure:"max_retry_period" json:"max_retry_period"`
+
+		// RefundSettlement tells customers when a refund reaches their
+		// account, like "5 to 10 business days"
+		RefundSettlement string `mapstructure:"refund_settlement" json:"refund_settlement"`
+
+		// Bcc gets copies of the mails, like
+		// {"order_received": ["finance@example.com"]}
+		Bcc struct {
+			OrderConfirmation    []string `mapstructure:"order_confirmation" json:"order_confirmation"`
+			OrderReceived        []string `mapstructure:"order_received" json:"order_received"`
+			ShippingConfirmation []string `mapstructure:"shipping_confirmation" json:"shipping_confirmation"`
+			RefundConfirmation   []string `mapstructure:"refund_confirmation" json:"refund_confirmation"`
+			CartReminder         []string `mapstructure:"cart_reminder" json:"cart_reminder"`
+		} `mapstructure:"bcc" json:"bcc"`
+
+		// Digest sends the admin a summary of the orders of the day before
+		// every day at Hour in the Timezone, like Europe/Berlin
+		Digest struct {
+			Enabled  bool   `mapstructure:"enabled" json:"enabled"`
+			Hour     int    `mapstructure:"hour" json:"hour"`
+			Timezone string `mapstructure:"timezone" json:"timezone"`
+			// SkipOrderReceived stops the mail to the admin about every
+			// order, the digest takes its place
+			SkipOrderReceived bool `mapstructure:"skip_order_received" json:"skip_order_received"`
+		} `mapstructure:"digest" json:"digest"`
+
+		Invoice struct {
+			// Attach a PDF invoice to the order confirmation
+			Attach bool `mapstructure:"attach" json:"attach"`
+			// Issuer is the name and address of the shop on the invoice,
+			// one line per line of the address
+			Issuer string `mapstructure:"issuer" json:"issuer"`
+		} `mapstructure:"invoice" json:"invoice"`
+
+		Subjects struct {
+			OrderConfirmation    string `mapstructure:"order_confirmation" json:"order_confirmation"`
+			OrderReceived        string `mapstructure:"order_received" json:"order_received"`
+			ShippingConfirmation string `mapstructure:"shipping_confirmation" json:"shipping_confirmation"`
+			RefundConfirmation   string `mapstructure:"refund_confirmation" json:"refund_confirmation"`
+			CartReminder         string `mapstructure:"cart_reminder" json:"cart_reminder"`
+			OrderDigest          string `mapstructure:"order_digest" json:"order_digest"`
 		} `mapstructure:"subjects" json:"subjects"`
 		Templates struct {
-			OrderConfirmation string `mapstructure:"order_confirmation" json:"order_confirmation"`
-			OrderReceived     string `mapstructure:"order_received" json:"order_received"`
+			// Dir holds templates that replace the ones on the site, named
+			// after the mail like order_confirmation.html, and partials in
+			// partials/
+			Dir string `mapstructure:"dir" json:"dir"`
+			// TTL is how long the templates loaded from their URL are used
+			// before they're loaded again
+			TTL time.Duration `mapstructure:"ttl" json:"ttl"`
+
+			OrderConfirmation    string `mapstructure:"order_confirmation" json:"order_confirmation"`
+			OrderReceived        string `mapstructure:"order_received" json:"order_received"`
+			ShippingConfirmation string `mapstructure:"shipping_confirmation" json:"shipping_confirmation"`
+			RefundConfirmation   string `mapstructure:"refund_confirmation" json:"refund_confirmation"`
+			CartReminder         string `mapstructure:"cart_reminder" json:"cart_reminder"`
+			OrderDigest          string `mapstructure:"order_digest" json:"order_digest"`
 		} `mapstructure:"templates" json:"templates"`
 	} `mapstructure:"mailer" json:"mailer"`
 
 	Payment struct {
 		Stripe struct {
 			SecretKey string `mapstructure:"secret_key" json:"secret_key"`
+			// WebhookSecret verifies the events Stripe sends about disputes
+			WebhookSecret string `mapstructure:"webhook_secret" json:"webhook_secret"`
 		} `mapstructure:"stripe" json:"stripe"`
 		Paypal struct {
 			ClientID string `mapstructure:"client_id" json:"client_id"`
 			Secret   string `mapstructure:"secret" json:"secret"`
 			Env      string `mapstructure:"env" json:"env"`
 		} `mapstructure:"paypal" json:"paypal"`
+		// Limits throttle the charges sent to the payment processors, to keep
+		// card testers from using the checkout. A limit of 0 is no limit.
+		Limits struct {
+			// Window is how far back attempts are counted
+			Window   time.Duration `mapstructure:"window" json:"window"`
+			PerOrder int           `mapstructure:"per_order" json:"per_order"`
+			PerUser  int           `mapstructure:"per_user" json:"per_user"`
+			PerIP    int           `mapstructure:"per_ip" json:"per_ip"`
+			// Charges of at most SmallAmount are refused for a user or IP
+			// address once MaxSmallFailures of theirs failed within the window
+			SmallAmount      uint64 `mapstructure:"small_amount" json:"small_amount"`
+			MaxSmallFailures int    `mapstructure:"max_small_failures" json:"max_small_failures"`
+		} `mapstructure:"limits" json:"limits"`
 	} `mapstructure:"payment" json:"payment"`
 
 	Downloads struct {
@@ -75,14 +463,296 @@ type Configuration struct {
 		Password string `mapstructure:"password" json:"password"`
 	} `mapstructure:"coupons" json:"coupons"`
 
+	// Referrals give new customers a discount with the referral code of a
+	// customer, and the customer a store credit once the order is paid. Both
+	// are percentages, of the products and of the order total.
+	Referrals struct {
+		Discount uint64 `mapstructure:"discount" json:"discount"`
+		Credit   uint64 `mapstructure:"credit" json:"credit"`
+	} `mapstructure:"referrals" json:"referrals"`
+
+	// Currencies configures selling in other currencies than the one the
+	// shop settles in
+	Currencies struct {
+		// Settlement is the currency the shop books its sales in, orders in
+		// other currencies store their amounts in it too
+		Settlement string `mapstructure:"settlement" json:"settlement"`
+		// Rates convert the prices of products without a price in the
+		// currency of an order, and the amounts of orders to the settlement
+		// currency
+		Rates struct {
+			// Provider is "ecb" or "openexchangerates"
+			Provider string `mapstructure:"provider" json:"provider"`
+			// URL is where the latest rates are fetched, it defaults to the
+			// one of the provider
+			URL string `mapstructure:"url" json:"url"`
+			// APIKey is the App ID of Open Exchange Rates
+			APIKey   string        `mapstructure:"api_key" json:"api_key"`
+			CacheTTL time.Duration `mapstructure:"cache_ttl" json:"cache_ttl"`
+			// MaxStale is how old the last rates can get while the provider
+			// can't be reached before orders needing them fail
+			MaxStale time.Duration `mapstructure:"max_stale" json:"max_stale"`
+		} `mapstructure:"rates" json:"rates"`
+	} `mapstructure:"currencies" json:"currencies"`
+
+	// VAT configures the lookups of VAT numbers with VIES
+	VAT struct {
+		// CacheTTL is how long a valid VAT number is trusted before VIES is
+		// asked again
+		CacheTTL time.Duration `mapstructure:"cache_ttl" json:"cache_ttl"`
+		// IPCountryHeader is the header a proxy in api.trusted_proxies puts
+		// the country of the client's IP address in, the location evidence
+		// of digital sales
+		IPCountryHeader string `mapstructure:"ip_country_header" json:"ip_country_header"`
+	} `mapstructure:"vat" json:"vat"`
+
+	// Invoices configures the numbers paid orders are invoiced with. Every
+	// series is numbered without gaps.
+	Invoices struct {
+		// Prefix starts the numbers of the default series
+		Prefix string `mapstructure:"prefix" json:"prefix"`
+		// Digits pads the numbers with zeros
+		Digits int `mapstructure:"digits" json:"digits"`
+		// Series are numbered apart from the default series
+		Series []InvoiceSeries `mapstructure:"series" json:"series"`
+	} `mapstructure:"invoices" json:"invoices"`
+
+	Taxes struct {
+		// Basis is the address whose country taxes are calculated for, "shipping" or "billing"
+		Basis string `mapstructure:"basis" json:"basis"`
+		// CountryBasis overrides the basis for orders shipped to a country
+		CountryBasis map[string]string `mapstructure:"country_basis" json:"country_basis"`
+		// HomeCountry is the country of the shop, its sales are declared in
+		// the national return and left out of the OSS report
+		HomeCountry string `mapstructure:"home_country" json:"home_country"`
+		// DigitalTypes are the product types of digital goods. When it's
+		// empty every product is digital, for the OSS report and the
+		// location evidence alike.
+		DigitalTypes []string `mapstructure:"digital_types" json:"digital_types"`
+	} `mapstructure:"taxes" json:"taxes"`
+
+	// Outbound configures the calls to other services, for networks where
+	// they have to go through a proxy
+	Outbound struct {
+		// Proxy is the URL of the proxy, like http://proxy.example.com:3128.
+		// Without it the HTTPS_PROXY and NO_PROXY variables are used.
+		Proxy string `mapstructure:"proxy" json:"proxy"`
+		// NoProxy are the hosts and domains that are called directly
+		NoProxy []string `mapstructure:"no_proxy" json:"no_proxy"`
+		// CABundle is a PEM file with the certificates to trust besides the
+		// ones of the system
+		CABundle      string `mapstructure:"ca_bundle" json:"ca_bundle"`
+		TLSMinVersion string `mapstructure:"tls_min_version" json:"tls_min_version"`
+	} `mapstructure:"outbound" json:"outbound"`
+
+	// Timeouts for calls to other services, so a hung service can't stall checkout
+	Timeouts struct {
+		// Site is for settings.json and product pages
+		Site     time.Duration `mapstructure:"site" json:"site"`
+		Coupons  time.Duration `mapstructure:"coupons" json:"coupons"`
+		VAT      time.Duration `mapstructure:"vat" json:"vat"`
+		Webhooks time.Duration `mapstructure:"webhooks" json:"webhooks"`
+		// Mail is for the APIs of the mail providers
+		Mail time.Duration `mapstructure:"mail" json:"mail"`
+		// Fraud is for the fraud scoring URL
+		Fraud time.Duration `mapstructure:"fraud" json:"fraud"`
+		// Rates is for the exchange rate provider
+		Rates time.Duration `mapstructure:"rates" json:"rates"`
+		// Payments is for the APIs of Stripe and PayPal
+		Payments time.Duration `mapstructure:"payments" json:"payments"`
+	} `mapstructure:"timeouts" json:"timeouts"`
+
+	// Fraud scores orders before they're charged. Orders scoring at least
+	// the threshold are held for a manual review instead of being charged.
+	Fraud struct {
+		Threshold int `mapstructure:"threshold" json:"threshold"`
+		// URL is sent the order and answers with its score and the reasons
+		// for it, which add up with the score of the rules
+		URL    string `mapstructure:"url" json:"url"`
+		Secret string `mapstructure:"secret" json:"secret"`
+		// Rules are scored by gocommerce, each adds its points to the score
+		// of the orders it matches. A rule with 0 points is off.
+		Rules struct {
+			// CountryMismatch matches orders billed and shipped to different countries
+			CountryMismatch int `mapstructure:"country_mismatch" json:"country_mismatch"`
+			// DisposableEmail matches orders placed with an email address
+			// of one of the DisposableDomains
+			DisposableEmail   int      `mapstructure:"disposable_email" json:"disposable_email"`
+			DisposableDomains []string `mapstructure:"disposable_domains" json:"disposable_domains"`
+			// Velocity matches emails with more than VelocityOrders orders
+			// within the VelocityWindow
+			Velocity       int           `mapstructure:"velocity" json:"velocity"`
+			VelocityOrders int           `mapstructure:"velocity_orders" json:"velocity_orders"`
+			VelocityWindow time.Duration `mapstructure:"velocity_window" json:"velocity_window"`
+		} `mapstructure:"rules" json:"rules"`
+	} `mapstructure:"fraud" json:"fraud"`
+
+	Cancellations struct {
+		Reasons []string `mapstructure:"reasons" json:"reasons"`
+		// ExpireAfter is how long an order sits unpaid before it's
+		// cancelled as expired. Orders don't expire when it's 0.
+		ExpireAfter time.Duration `mapstructure:"expire_after" json:"expire_after"`
+	} `mapstructure:"cancellations" json:"cancellations"`
+
+	// AbandonedCarts remind customers of orders they didn't pay for
+	AbandonedCarts struct {
+		// RemindAfter is how long an order sits unpaid before the customer is
+		// reminded. There are no reminders when it's 0.
+		RemindAfter time.Duration `mapstructure:"remind_after" json:"remind_after"`
+		// MaxAge keeps older orders from getting reminders
+		MaxAge time.Duration `mapstructure:"max_age" json:"max_age"`
+		// Interval is how often to look for abandoned carts
+		Interval time.Duration `mapstructure:"interval" json:"interval"`
+	} `mapstructure:"abandoned_carts" json:"abandoned_carts"`
+
+	// Retention archives or anonymizes old orders, to keep the order tables
+	// small and only hold on to personal data for as long as needed
+	Retention struct {
+		// OrderYears is how many years orders are kept, there's no retention
+		// policy when it's 0
+		OrderYears int `mapstructure:"order_years" json:"order_years"`
+		// Action is archive, to delete the orders once they're exported, or
+		// anonymize, to keep them without personal data
+		Action string `mapstructure:"action" json:"action"`
+		// ArchiveURL is where the orders are exported before they're pruned,
+		// like file:///var/lib/gocommerce/archive or s3://bucket/prefix
+		ArchiveURL string `mapstructure:"archive_url" json:"archive_url"`
+		// Interval is how often to look for expired orders
+		Interval time.Duration `mapstructure:"interval" json:"interval"`
+	} `mapstructure:"retention" json:"retention"`
+
+	// Schedule configures the recurring tasks. The tasks run once the
+	// feature they're for is configured, unless they're disabled.
+	Schedule struct {
+		ExpireOrders    ScheduledTask `mapstructure:"expire_orders" json:"expire_orders"`
+		RefreshSettings ScheduledTask `mapstructure:"refresh_settings" json:"refresh_settings"`
+		AbandonedCarts  ScheduledTask `mapstructure:"abandoned_carts" json:"abandoned_carts"`
+		Retention       ScheduledTask `mapstructure:"retention" json:"retention"`
+		RevalidateVAT   ScheduledTask `mapstructure:"revalidate_vat" json:"revalidate_vat"`
+		SettleCharges   ScheduledTask `mapstructure:"settle_charges" json:"settle_charges"`
+	} `mapstructure:"schedule" json:"schedule"`
+
+	// Worker moves the background work out of the API processes. With it
+	// enabled, the side effects of events are queued as jobs and the
+	// webhooks, mail retries and periodic tasks are left to the processes
+	// started with the worker command.
+	Worker struct {
+		Enabled bool `mapstructure:"enabled" json:"enabled"`
+		// Concurrency is how many jobs a worker runs at once
+		Concurrency int `mapstructure:"concurrency" json:"concurrency"`
+		// PollInterval is how often a worker looks for jobs that are due
+		PollInterval time.Duration `mapstructure:"poll_interval" json:"poll_interval"`
+		// Failed jobs are retried up to MaxRetries times, waiting twice as
+		// long after every try, starting at RetryPeriod and at most
+		// MaxRetryPeriod
+		MaxRetries     int           `mapstructure:"max_retries" json:"max_retries"`
+		RetryPeriod    time.Duration `mapstructure:"retry_period" json:"retry_period"`
+		MaxRetryPeriod time.Duration `mapstructure:"max_retry_period" json:"max_retry_period"`
+	} `mapstructure:"worker" json:"worker"`
+
+	// MultiInstance serves many stores from one deployment. Every instance
+	// has its own hostname and settings, and is managed by the operator with
+	// the OperatorToken.
+	MultiInstance struct {
+		Enabled       bool   `mapstructure:"enabled" json:"enabled"`
+		OperatorToken string `mapstructure:"operator_token" json:"operator_token"`
+	} `mapstructure:"multi_instance" json:"multi_instance"`
+
+	// OrderLimits keep the orders customers create to a sensible size
+	OrderLimits struct {
+		MaxLineItems int    `mapstructure:"max_line_items" json:"max_line_items"`
+		MaxQuantity  uint64 `mapstructure:"max_quantity" json:"max_quantity"`
+		// MaxMetaSize is the largest meta data, in bytes of JSON, of the
+		// order and of each of its line items
+		MaxMetaSize int `mapstructure:"max_meta_size" json:"max_meta_size"`
+		// MaxFieldLength is the longest text, like an email or address line
+		MaxFieldLength int `mapstructure:"max_field_length" json:"max_field_length"`
+	} `mapstructure:"order_limits" json:"order_limits"`
+
+	// OrderRefs configures the short public references orders get instead of
+	// their IDs in status URLs and emails
+	OrderRefs struct {
+		Salt     string `mapstructure:"salt" json:"salt"`
+		Alphabet string `mapstructure:"alphabet" json:"alphabet"`
+	} `mapstructure:"order_refs" json:"order_refs"`
+
+	Goodwill struct {
+		// MaxAmount caps the goodwill given on a single order, in the lowest currency unit
+		MaxAmount uint64 `mapstructure:"max_amount" json:"max_amount"`
+		// MaxPercentage caps the goodwill given on a single order, as a percentage of its total
+		MaxPercentage uint64   `mapstructure:"max_percentage" json:"max_percentage"`
+		Reasons       []string `mapstructure:"reasons" json:"reasons"`
+	} `mapstructure:"goodwill" json:"goodwill"`
+
 	Webhooks struct {
-		Order   string `mapstructure:"order" json:"order"`
-		Payment string `mapstructure:"payment" json:"payment"`
-		Update  string `mapstructure:"update" json:"update"`
-		Refund  string `mapstructure:"refund" json:"refund"`
+		Order            string `mapstructure:"order" json:"order"`
+		Payment          string `mapstructure:"payment" json:"payment"`
+		Update           string `mapstructure:"update" json:"update"`
+		Refund           string `mapstructure:"refund" json:"refund"`
+		Cancellation     string `mapstructure:"cancellation" json:"cancellation"`
+		Fulfillment      string `mapstructure:"fulfillment" json:"fulfillment"`
+		Dispute          string `mapstructure:"dispute" json:"dispute"`
+		Download         string `mapstructure:"download" json:"download"`
+		CouponRedemption string `mapstructure:"coupon_redemption" json:"coupon_redemption"`
+		Stock            string `mapstructure:"stock" json:"stock"`
+		ReferralCredit   string `mapstructure:"referral_credit" json:"referral_credit"`
+
+		// URL gets every event, wrapped in an envelope with the event type
+		URL string `mapstructure:"url" json:"url"`
 
 		Secret string `mapstructure:"secret" json:"secret"`
+		// SecondarySecret also signs every webhook while the secret is
+		// rotated, so consumers can move to the new one at their own pace
+		SecondarySecret string `mapstructure:"secondary_secret" json:"secondary_secret"`
+
+		// Format is the format of the webhooks sent to the URLs above, json
+		// or cloudevents
+		Format string `mapstructure:"format" json:"format"`
+
+		// Failed deliveries are retried up to MaxRetries times, waiting twice
+		// as long after every try, starting at RetryPeriod and at most
+		// MaxRetryPeriod
+		MaxRetries     int           `mapstructure:"max_retries" json:"max_retries"`
+		RetryPeriod    time.Duration `mapstructure:"retry_period" json:"retry_period"`
+		MaxRetryPeriod time.Duration `mapstructure:"max_retry_period" json:"max_retry_period"`
+		// UnhealthyAfter is the number of failures in a row after which an
+		// endpoint is marked unhealthy
+		UnhealthyAfter int `mapstructure:"unhealthy_after" json:"unhealthy_after"`
+		// BreakerCooldown is how long the hooks to an unhealthy endpoint are
+		// held back after it failed
+		BreakerCooldown time.Duration `mapstructure:"breaker_cooldown" json:"breaker_cooldown"`
+
+		// Concurrency is how many webhooks are delivered at once, at most
+		// EndpointConcurrency of them to the same endpoint
+		Concurrency         int `mapstructure:"concurrency" json:"concurrency"`
+		EndpointConcurrency int `mapstructure:"endpoint_concurrency" json:"endpoint_concurrency"`
 	} `mapstructure:"webhooks" json:"webhooks"`
+
+	// EventSinks get the webhook events through a message broker, next to
+	// or instead of the webhook URLs
+	EventSinks []EventSink `mapstructure:"event_sinks" json:"event_sinks"`
+
+	Tracing struct {
+		Enabled     bool   `mapstructure:"enabled" json:"enabled"`
+		ServiceName string `mapstructure:"service_name" json:"service_name"`
+		Endpoint    string `mapstructure:"endpoint" json:"endpoint"`
+		Insecure    bool   `mapstructure:"insecure" json:"insecure"`
+	} `mapstructure:"tracing" json:"tracing"`
+
+	// Secrets are where values like vault:secret/data/gocommerce#stripe_key
+	// or aws-secretsmanager:gocommerce#stripe_key are read from on start
+	Secrets struct {
+		Vault struct {
+			// Address and Token default to VAULT_ADDR and VAULT_TOKEN
+			Address string `mapstructure:"address" json:"address"`
+			Token   string `mapstructure:"token" json:"token"`
+		} `mapstructure:"vault" json:"vault"`
+		AWS struct {
+			// Region defaults to AWS_REGION
+			Region   string `mapstructure:"region" json:"region"`
+			Endpoint string `mapstructure:"endpoint" json:"endpoint"`
+		} `mapstructure:"aws" json:"aws"`
+	} `mapstructure:"secrets" json:"secrets"`
 }
 
 // Load will construct the config from the file `config.json`
@@ -101,9 +771,27 @@ func Load(configFile string) (*Configuration, error) {
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
+	config, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := configureLogging(config); err != nil {
+		return nil, errors.Wrap(err, "configure logging")
+	}
+
+	return validateConfig(config)
+}
+
+// read reads the configuration from the files and the environment viper was
+// set up with
+func read() (*Configuration, error) {
 	if err := viper.ReadInConfig(); err != nil && !os.IsNotExist(err) {
 		return nil, errors.Wrap(err, "reading configuration from files")
 	}
+	if err := mergeEnvironment(os.Getenv(EnvironmentVar)); err != nil {
+		return nil, err
+	}
 
 	config := new(Configuration)
 	if err := viper.Unmarshal(config); err != nil {
@@ -115,23 +803,134 @@ func Load(configFile string) (*Configuration, error) {
 		return nil, errors.Wrap(err, "populate config")
 	}
 
-	if err := configureLogging(config); err != nil {
-		return nil, errors.Wrap(err, "configure logging")
+	if err := resolveSecrets(config, config.HTTPClient(DefaultClientTimeout)); err != nil {
+		return nil, errors.Wrap(err, "resolving secrets")
 	}
 
 	if config.JWT.AdminGroupName == "" {
 		config.JWT.AdminGroupName = "admin"
 	}
+	return config, nil
+}
+
+// EnvironmentVar names the environment whose config file is merged over the
+// config file, like production for config.production.json
+const EnvironmentVar = "GOCOMMERCE_ENV"
+
+// mergeEnvironment merges the config file of an environment, next to the
+// config file and named after it, over the settings read so far
+func mergeEnvironment(env string) error {
+	if env == "" {
+		return nil
+	}
+	base := viper.ConfigFileUsed()
+	if base == "" {
+		return errors.Errorf("the %s environment needs a config file to go with", env)
+	}
+	ext := filepath.Ext(base)
+	overlay := strings.TrimSuffix(base, ext) + "." + env + ext
+	f, err := os.Open(overlay)
+	if err != nil {
+		return errors.Wrapf(err, "reading configuration for the %s environment", env)
+	}
+	defer f.Close()
+	if err := viper.MergeConfig(f); err != nil {
+		return errors.Wrapf(err, "merging configuration for the %s environment", env)
+	}
+	return nil
+}
 
-	return validateConfig(config)
+// Reload reads the configuration that was loaded with Load again, and returns
+// a copy of current with the settings that are safe to change while serving:
+// the log level, the webhook URLs, the mail templates, subjects and copies
+// and the tax settings. Everything else, like the database or the payment
+// credentials, only changes with a restart. current itself isn't changed,
+// it may be read while serving, the copy takes its place. It's an error if the
+// new configuration isn't valid.
+func Reload(current *Configuration) (*Configuration, error) {
+	fresh, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if fresh, err = validateConfig(fresh); err != nil {
+		return nil, err
+	}
+	if fresh.LogConf.Level != "" {
+		level, err := logrus.ParseLevel(strings.ToUpper(fresh.LogConf.Level))
+		if err != nil {
+			return nil, err
+		}
+		logrus.SetLevel(level)
+	}
+
+	config := *current
+	config.LogConf.Level = fresh.LogConf.Level
+	webhooks := config.Webhooks
+	config.Webhooks = fresh.Webhooks
+	// the delivery of the webhooks was set up on start
+	config.Webhooks.MaxRetries = webhooks.MaxRetries
+	config.Webhooks.RetryPeriod = webhooks.RetryPeriod
+	config.Webhooks.MaxRetryPeriod = webhooks.MaxRetryPeriod
+	config.Webhooks.UnhealthyAfter = webhooks.UnhealthyAfter
+	config.Webhooks.BreakerCooldown = webhooks.BreakerCooldown
+	config.Webhooks.Concurrency = webhooks.Concurrency
+	config.Webhooks.EndpointConcurrency = webhooks.EndpointConcurrency
+	config.Mailer.Templates = fresh.Mailer.Templates
+	config.Mailer.Subjects = fresh.Mailer.Subjects
+	config.Mailer.Bcc = fresh.Mailer.Bcc
+	config.Taxes = fresh.Taxes
+	return &config, nil
+}
+
+// bufferedWriter buffers writes to the log file. Flushing can happen while
+// logging goes on, so writes and flushes hold the same lock.
+type bufferedWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.w.Write(p)
+}
+
+func (b *bufferedWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.w.Flush()
+}
+
+var (
+	logOutput   *bufferedWriter
+	flushOnExit sync.Once
+)
+
+// FlushLogs writes out any buffered log lines. logrus.Fatal flushes them on its
+// own, any other exit should call it so they aren't lost.
+func FlushLogs() error {
+	if logOutput == nil {
+		return nil
+	}
+	return logOutput.Flush()
 }
 
 func configureLogging(config *Configuration) error {
-	// always use the full timestamp
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp:    true,
-		DisableTimestamp: false,
-	})
+	switch config.LogConf.Format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "", "text":
+		// always use the full timestamp
+		logrus.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:    true,
+			DisableTimestamp: false,
+		})
+	default:
+		return errors.Errorf("unknown log format '%s', must be 'text' or 'json'", config.LogConf.Format)
+	}
+	if config.LogConf.Redact {
+		logrus.SetFormatter(&redactingFormatter{logrus.StandardLogger().Formatter})
+	}
 
 	// use a file if you want
 	if config.LogConf.File != "" {
@@ -139,7 +938,11 @@ func configureLogging(config *Configuration) error {
 		if errOpen != nil {
 			return errOpen
 		}
-		logrus.SetOutput(bufio.NewWriter(f))
+		logOutput = &bufferedWriter{w: bufio.NewWriter(f)}
+		logrus.SetOutput(logOutput)
+		flushOnExit.Do(func() {
+			logrus.RegisterExitHandler(func() { FlushLogs() })
+		})
 		logrus.Infof("Set output file to %s", config.LogConf.File)
 	}
 
@@ -155,7 +958,40 @@ func configureLogging(config *Configuration) error {
 	return nil
 }
 
+// TestMode is true unless the instance is set up with live payment
+// credentials, orders placed in test mode can be purged
+func (c *Configuration) TestMode() bool {
+	key := c.Payment.Stripe.SecretKey
+	if strings.HasPrefix(key, "sk_live_") || strings.HasPrefix(key, "rk_live_") {
+		return false
+	}
+	return c.Payment.Paypal.Env != "production"
+}
+
+func setDefaultDuration(d *time.Duration, value time.Duration) {
+	if *d == 0 {
+		*d = value
+	}
+}
+
+// driverSchemes are the URL schemes that name a driver differently
+var driverSchemes = map[string]string{
+	"postgresql": "postgres",
+	"cockroach":  "cockroachdb",
+	"sqlserver":  "mssql",
+}
+
+// driverForScheme tells the database driver from the scheme of its URL
+func driverForScheme(scheme string) string {
+	if driver, ok := driverSchemes[scheme]; ok {
+		return driver
+	}
+	return scheme
+}
+
 func validateConfig(config *Configuration) (*Configuration, error) {
+	problems := &problems{}
+
 	if config.DB.ConnURL == "" && os.Getenv("DATABASE_URL") != "" {
 		config.DB.ConnURL = os.Getenv("DATABASE_URL")
 	}
@@ -163,17 +999,19 @@ func validateConfig(config *Configuration) (*Configuration, error) {
 	if config.DB.Driver == "" && config.DB.ConnURL != "" {
 		u, err := url.Parse(config.DB.ConnURL)
 		if err != nil {
-			return nil, errors.Wrap(err, "parsing db connection url")
+			problems.add("db.url", "can't be parsed: %v", err)
+		} else {
+			config.DB.Driver = driverForScheme(u.Scheme)
 		}
-		config.DB.Driver = u.Scheme
 	}
 
+	validatePool(config, problems)
+
 	if config.API.Port == 0 && os.Getenv("PORT") != "" {
 		port, err := strconv.Atoi(os.Getenv("PORT"))
 		if err != nil {
-			return nil, errors.Wrap(err, "formatting PORT into int")
+			problems.add("PORT", "must be a number, got '%s'", os.Getenv("PORT"))
 		}
-
 		config.API.Port = port
 	}
 
@@ -181,5 +1019,232 @@ func validateConfig(config *Configuration) (*Configuration, error) {
 		config.API.Port = 8080
 	}
 
+	setDefaultDuration(&config.API.ReadTimeout, DefaultReadTimeout)
+	setDefaultDuration(&config.API.WriteTimeout, DefaultWriteTimeout)
+	setDefaultDuration(&config.API.IdleTimeout, DefaultIdleTimeout)
+	if config.API.MaxBodySize < 0 {
+		problems.add("api.max_body_size", "can't be negative")
+	}
+	if config.API.MaxBodySize == 0 {
+		config.API.MaxBodySize = DefaultMaxBodySize
+	}
+	validateOrderLimits(config, problems)
+	setDefaultDuration(&config.Timeouts.Site, DefaultClientTimeout)
+	setDefaultDuration(&config.Timeouts.Coupons, DefaultClientTimeout)
+	setDefaultDuration(&config.Timeouts.VAT, DefaultClientTimeout)
+	setDefaultDuration(&config.Timeouts.Webhooks, DefaultClientTimeout)
+	setDefaultDuration(&config.Timeouts.Mail, DefaultClientTimeout)
+	setDefaultDuration(&config.Timeouts.Fraud, DefaultClientTimeout)
+	setDefaultDuration(&config.Timeouts.Rates, DefaultClientTimeout)
+	setDefaultDuration(&config.Timeouts.Payments, DefaultPaymentTimeout)
+	if config.Settings.TTL < 0 {
+		problems.add("settings.ttl", "can't be negative")
+	}
+	setDefaultDuration(&config.Settings.TTL, DefaultSettingsTTL)
+	if config.VAT.CacheTTL < 0 {
+		problems.add("vat.cache_ttl", "can't be negative")
+	}
+	setDefaultDuration(&config.VAT.CacheTTL, DefaultVATCacheTTL)
+	if config.Reports.CacheTTL < 0 {
+		problems.add("reports.cache_ttl", "can't be negative")
+	}
+	setDefaultDuration(&config.Reports.CacheTTL, DefaultReportsCacheTTL)
+
+	if config.Webhooks.MaxRetries == 0 {
+		config.Webhooks.MaxRetries = DefaultWebhookMaxRetries
+	}
+	setDefaultDuration(&config.Webhooks.RetryPeriod, DefaultWebhookRetryPeriod)
+	setDefaultDuration(&config.Webhooks.MaxRetryPeriod, DefaultWebhookMaxRetryPeriod)
+	if config.Webhooks.UnhealthyAfter == 0 {
+		config.Webhooks.UnhealthyAfter = DefaultWebhookUnhealthyAfter
+	}
+	if config.Webhooks.MaxRetries < 0 {
+		problems.add("webhooks.max_retries", "can't be negative")
+	}
+	if config.Webhooks.UnhealthyAfter < 0 {
+		problems.add("webhooks.unhealthy_after", "can't be negative")
+	}
+	setDefaultDuration(&config.Webhooks.BreakerCooldown, DefaultWebhookBreakerCooldown)
+	if config.Webhooks.Concurrency == 0 {
+		config.Webhooks.Concurrency = DefaultWebhookConcurrency
+	}
+	if config.Webhooks.EndpointConcurrency == 0 {
+		config.Webhooks.EndpointConcurrency = DefaultWebhookEndpointConcurrency
+	}
+	if config.Webhooks.Concurrency < 0 {
+		problems.add("webhooks.concurrency", "can't be negative")
+	}
+	if config.Webhooks.EndpointConcurrency < 0 {
+		problems.add("webhooks.endpoint_concurrency", "can't be negative")
+	}
+	if config.Webhooks.SecondarySecret != "" && config.Webhooks.Secret == "" {
+		problems.add("webhooks.secret", "is needed with a secondary_secret")
+	}
+	if !webhooks.ValidFormat(config.Webhooks.Format) {
+		problems.add("webhooks.format", "unknown format '%s', must be 'json' or 'cloudevents'", config.Webhooks.Format)
+	}
+
+	if config.MultiInstance.Enabled && config.MultiInstance.OperatorToken == "" {
+		problems.add("multi_instance.operator_token", "is needed in multi-instance mode")
+	}
+
+	validateMailer(config, problems)
+	validatePayment(config, problems)
+	validateFraud(config, problems)
+	validateDownloads(config, problems)
+	validateCoupons(config, problems)
+	validateReferrals(config, problems)
+	validateCurrencies(config, problems)
+	validateOutbound(config, problems)
+	validateNetworks(config, problems)
+	validateRetention(config, problems)
+	validateWorker(config, problems)
+	validateRoles(config, problems)
+	validateJWTKeys(config, problems)
+	validateInvoices(config, problems)
+
+	if config.AbandonedCarts.RemindAfter < 0 {
+		problems.add("abandoned_carts.remind_after", "can't be negative")
+	}
+	if config.AbandonedCarts.RemindAfter > 0 {
+		setDefaultDuration(&config.AbandonedCarts.MaxAge, DefaultAbandonedCartMaxAge)
+		setDefaultDuration(&config.AbandonedCarts.Interval, DefaultAbandonedCartInterval)
+		if config.API.PublicURL == "" {
+			problems.add("api.public_url", "is needed for the unsubscribe links of abandoned cart reminders")
+		}
+		if config.JWT.Secret == "" {
+			problems.add("jwt.secret", "is needed to sign the unsubscribe links of abandoned cart reminders")
+		}
+	}
+	validateSchedule(config, problems)
+
+	names := map[string]bool{}
+	for i, sink := range config.EventSinks {
+		field := fmt.Sprintf("event_sinks[%d]", i)
+		if sink.Name == "" || names[sink.Name] {
+			problems.add(field+".name", "every event sink needs a unique name")
+		}
+		names[sink.Name] = true
+		if err := sinks.Validate(sink.URL); err != nil {
+			problems.add(field+".url", "%v", err)
+		}
+		if !webhooks.ValidFormat(sink.Format) {
+			problems.add(field+".format", "unknown format '%s', must be 'json' or 'cloudevents'", sink.Format)
+		}
+	}
+
+	tls := config.API.TLS
+	if tls.CertFile != "" && tls.KeyFile == "" {
+		problems.add("api.tls.key_file", "is needed with a cert_file")
+	}
+	if tls.KeyFile != "" && tls.CertFile == "" {
+		problems.add("api.tls.cert_file", "is needed with a key_file")
+	}
+	if tls.CertFile != "" && len(tls.Autocert.Hosts) > 0 {
+		problems.add("api.tls.autocert.hosts", "can't be combined with a cert_file")
+	}
+
+	if config.API.CORS.MaxAge < 0 {
+		problems.add("api.cors.max_age", "can't be negative")
+	}
+
+	if config.OrderRefs.Alphabet == "" {
+		config.OrderRefs.Alphabet = refs.DefaultAlphabet
+	}
+	if err := refs.ValidAlphabet(config.OrderRefs.Alphabet); err != nil {
+		problems.add("order_refs.alphabet", "%v", err)
+	}
+
+	if config.Taxes.Basis == "" {
+		config.Taxes.Basis = ShippingTaxBasis
+	}
+	for country, basis := range config.Taxes.CountryBasis {
+		if basis != ShippingTaxBasis && basis != BillingTaxBasis {
+			problems.add("taxes.country_basis."+country, "unknown tax basis '%s', must be 'shipping' or 'billing'", basis)
+		}
+	}
+	if config.Taxes.Basis != ShippingTaxBasis && config.Taxes.Basis != BillingTaxBasis {
+		problems.add("taxes.basis", "unknown tax basis '%s', must be 'shipping' or 'billing'", config.Taxes.Basis)
+	}
+
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
+
+func validateMailer(config *Configuration, problems *problems) {
+	mailer := &config.Mailer
+	switch mailer.Provider {
+	case "":
+		mailer.Provider = SMTPProvider
+		validateSMTP(config, problems)
+	case SMTPProvider:
+		validateSMTP(config, problems)
+	case SendGridProvider:
+		if mailer.SendGrid.APIKey == "" {
+			problems.add("mailer.sendgrid.api_key", "is needed by the sendgrid mailer")
+		}
+	case MailgunProvider:
+		if mailer.Mailgun.APIKey == "" {
+			problems.add("mailer.mailgun.api_key", "is needed by the mailgun mailer")
+		}
+		if mailer.Mailgun.Domain == "" {
+			problems.add("mailer.mailgun.domain", "is needed by the mailgun mailer")
+		}
+	case SESProvider:
+		if mailer.SES.Region == "" {
+			problems.add("mailer.ses.region", "is needed by the ses mailer")
+		}
+	default:
+		problems.add("mailer.provider", "unknown mailer provider '%s', must be one of: smtp, sendgrid, mailgun, ses", mailer.Provider)
+	}
+
+	if mailer.AdminEmail != "" {
+		if _, err := mail.ParseAddress(mailer.AdminEmail); err != nil {
+			problems.add("mailer.admin_email", "invalid address '%s': %v", mailer.AdminEmail, err)
+		}
+	}
+	bcc := []struct {
+		name      string
+		addresses []string
+	}{
+		{"order_confirmation", mailer.Bcc.OrderConfirmation},
+		{"order_received", mailer.Bcc.OrderReceived},
+		{"shipping_confirmation", mailer.Bcc.ShippingConfirmation},
+		{"refund_confirmation", mailer.Bcc.RefundConfirmation},
+		{"cart_reminder", mailer.Bcc.CartReminder},
+	}
+	for _, list := range bcc {
+		for _, address := range list.addresses {
+			if _, err := mail.ParseAddress(address); err != nil {
+				problems.add("mailer.bcc."+list.name, "invalid address '%s': %v", address, err)
+			}
+		}
+	}
+
+	if mailer.Digest.Enabled {
+		if mailer.AdminEmail == "" {
+			problems.add("mailer.admin_email", "is needed by the mail digest, which is sent to it")
+		}
+		if mailer.Digest.Hour < 0 || mailer.Digest.Hour > 23 {
+			problems.add("mailer.digest.hour", "must be between 0 and 23")
+		}
+		if _, err := time.LoadLocation(mailer.Digest.Timezone); err != nil {
+			problems.add("mailer.digest.timezone", "%v", err)
+		}
+	}
+
+	if mailer.MaxRetries == 0 {
+		mailer.MaxRetries = DefaultMailMaxRetries
+	}
+	if mailer.MaxRetries < 0 {
+		problems.add("mailer.max_retries", "can't be negative")
+	}
+	setDefaultDuration(&mailer.RetryPeriod, DefaultMailRetryPeriod)
+	setDefaultDuration(&mailer.MaxRetryPeriod, DefaultMailMaxRetryPeriod)
+	if mailer.Templates.TTL < 0 {
+		problems.add("mailer.templates.ttl", "can't be negative")
+	}
+	setDefaultDuration(&mailer.Templates.TTL, DefaultMailTemplateTTL)
+}
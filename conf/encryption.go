@@ -0,0 +1,85 @@
+package conf
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// MasterKeyVar names the environment variable with the master key that
+// decrypts the enc: values of the configuration. The key is 32 random bytes,
+// base64 encoded.
+const MasterKeyVar = "GOCOMMERCE_MASTER_KEY"
+
+// encryptedPrefix marks the config values that are encrypted with the
+// master key
+const encryptedPrefix = "enc:"
+
+// NewMasterKey makes a random master key
+func NewMasterKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// MasterKey reads the master key from the environment
+func MasterKey() ([]byte, error) {
+	encoded := os.Getenv(MasterKeyVar)
+	if encoded == "" {
+		return nil, fmt.Errorf("%s isn't set", MasterKeyVar)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes, base64 encoded", MasterKeyVar)
+	}
+	return key, nil
+}
+
+// Encrypt encrypts a config value with the master key, with AES-GCM. The
+// result goes in the configuration as it is, enc: prefix included.
+func Encrypt(value string, key []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt decrypts a value made by Encrypt
+func decrypt(value string, key []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("the encrypted value is malformed")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("the encrypted value can't be decrypted with the master key")
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,82 @@
+package conf
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// boundFlags are the flags BindFlags defined, to tell which ones were set
+var boundFlags *pflag.FlagSet
+
+// BindFlags defines a flag for every setting with a single value or a list
+// of strings, named after its key like --db.url or --api.read_timeout. The
+// flags that are set take precedence over the environment variables and the
+// config files.
+func BindFlags(flags *pflag.FlagSet) error {
+	settings := pflag.NewFlagSet("settings", pflag.ContinueOnError)
+	if err := defineFlags(settings, reflect.TypeOf(Configuration{}), ""); err != nil {
+		return err
+	}
+	flags.AddFlagSet(settings)
+	boundFlags = settings
+	return nil
+}
+
+func defineFlags(flags *pflag.FlagSet, vType reflect.Type, prefix string) error {
+	for i := 0; i < vType.NumField(); i++ {
+		field := vType.Field(i)
+		key := prefix + getTag(field)
+		usage := fmt.Sprintf("Sets %s", key)
+
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			if err := defineFlags(flags, field.Type, key+"."); err != nil {
+				return err
+			}
+			continue
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			if field.Type == durationType {
+				flags.Duration(key, 0, usage)
+			} else {
+				flags.Int(key, 0, usage)
+			}
+		case reflect.Uint, reflect.Uint32, reflect.Uint64:
+			flags.Uint64(key, 0, usage)
+		case reflect.Bool:
+			flags.Bool(key, false, usage)
+		case reflect.String:
+			flags.String(key, "", usage)
+		case reflect.Slice:
+			if field.Type.Elem().Kind() != reflect.String {
+				// lists of objects can only come from the config file
+				continue
+			}
+			flags.StringSlice(key, nil, usage)
+		default:
+			// maps can only come from the config file
+			continue
+		}
+
+		if err := viper.BindPFlag(key, flags.Lookup(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagOverrides are the settings that were set by flags
+func flagOverrides() []string {
+	overrides := []string{}
+	if boundFlags == nil {
+		return overrides
+	}
+	boundFlags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed {
+			overrides = append(overrides, flag.Name)
+		}
+	})
+	return overrides
+}
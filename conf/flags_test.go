@@ -0,0 +1,64 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlagOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocommerce-flags")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "config.json")
+	assert.NoError(t, ioutil.WriteFile(fname, []byte(`{"db": {"url": "file-db", "driver": "sqlite3"},
+		"api": {"port": 9000, "cors": {"allowed_origins": ["https://file.example.com"]}}}`), 0644))
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	if !assert.NoError(t, BindFlags(flags)) {
+		return
+	}
+	defer func() {
+		viper.Reset()
+		boundFlags = nil
+	}()
+	assert.NoError(t, flags.Parse([]string{
+		"--db.driver=postgres",
+		"--api.read_timeout=5s",
+		"--api.cors.allowed_origins=https://a.example.com,https://b.example.com",
+		"--goodwill.max_amount=500",
+		"--tracing.enabled",
+	}))
+
+	os.Setenv("GOCOMMERCE_DB_DRIVER", "mysql")
+	defer os.Unsetenv("GOCOMMERCE_DB_DRIVER")
+
+	config, err := Load(fname)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "postgres", config.DB.Driver, "flags win over the environment")
+	assert.Equal(t, 5*time.Second, config.API.ReadTimeout)
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, config.API.CORS.AllowedOrigins)
+	assert.Equal(t, uint64(500), config.Goodwill.MaxAmount)
+	assert.True(t, config.Tracing.Enabled)
+
+	// the flags that aren't set leave the config file alone
+	assert.Equal(t, "file-db", config.DB.ConnURL)
+	assert.Equal(t, 9000, config.API.Port)
+	assert.Equal(t, DefaultWriteTimeout, config.API.WriteTimeout)
+
+	inspection, err := Inspect(config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"api.cors.allowed_origins", "api.read_timeout", "db.driver", "goodwill.max_amount", "tracing.enabled"}, inspection.FlagOverrides)
+	}
+}
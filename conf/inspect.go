@@ -0,0 +1,125 @@
+package conf
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// redactedValue takes the place of secrets in an inspected configuration
+const redactedValue = "[redacted]"
+
+// secretSuffixes tell the settings that hold secrets by the name of their
+// field
+var secretSuffixes = []string{"Secret", "Pass", "Password", "Token", "Key", "Salt"}
+
+// Inspection is the effective configuration, with the secrets redacted, and
+// where its settings came from
+type Inspection struct {
+	// Environment is the environment whose config file was merged, if any
+	Environment string `json:"environment,omitempty"`
+	// EnvOverrides are the settings that were set by environment variables
+	EnvOverrides []string `json:"env_overrides"`
+	// FlagOverrides are the settings that were set by command line flags
+	FlagOverrides []string       `json:"flag_overrides"`
+	Config        *Configuration `json:"config"`
+}
+
+// Inspect shows the configuration without its secrets. Secrets that are set
+// are replaced with [redacted], and so are the passwords of URLs.
+func Inspect(config *Configuration) (*Inspection, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	redacted := new(Configuration)
+	if err := json.Unmarshal(data, redacted); err != nil {
+		return nil, err
+	}
+	redact(reflect.ValueOf(redacted).Elem())
+
+	inspection := &Inspection{
+		Environment:   os.Getenv(EnvironmentVar),
+		EnvOverrides:  []string{},
+		FlagOverrides: flagOverrides(),
+		Config:        redacted,
+	}
+	envOverrides(reflect.TypeOf(*config), "", &inspection.EnvOverrides)
+	return inspection, nil
+}
+
+func redact(val reflect.Value) {
+	vType := val.Type()
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			redact(field)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() == reflect.Struct {
+				for j := 0; j < field.Len(); j++ {
+					redact(field.Index(j))
+				}
+			}
+		case reflect.Map:
+			if field.Type().Elem().Kind() == reflect.String {
+				for _, key := range field.MapKeys() {
+					field.SetMapIndex(key, reflect.ValueOf(redactURL(field.MapIndex(key).String())))
+				}
+			}
+		case reflect.String:
+			if field.String() == "" {
+				continue
+			}
+			if isSecret(vType.Field(i).Name) {
+				field.SetString(redactedValue)
+			} else {
+				field.SetString(redactURL(field.String()))
+			}
+		}
+	}
+}
+
+func isSecret(name string) bool {
+	for _, suffix := range secretSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL hides the password of a URL, like the one of a database
+func redactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedValue)
+		return strings.Replace(u.String(), url.QueryEscape(redactedValue), redactedValue, 1)
+	}
+	return value
+}
+
+// envOverrides finds the settings that are set by environment variables, the
+// way populateConfig reads them
+func envOverrides(vType reflect.Type, prefix string, overrides *[]string) {
+	for i := 0; i < vType.NumField(); i++ {
+		field := vType.Field(i)
+		tag := prefix + getTag(field)
+		if field.Type.Kind() == reflect.Struct {
+			envOverrides(field.Type, tag+".", overrides)
+			continue
+		}
+		name := "GOCOMMERCE_" + strings.ToUpper(strings.Replace(tag, ".", "_", -1))
+		if _, ok := os.LookupEnv(name); ok {
+			*overrides = append(*overrides, tag)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InvoicePrefix is the prefix of the invoice series of the orders taxed for
+// the country
+func (config *Configuration) InvoicePrefix(country string) string {
+	for _, series := range config.Invoices.Series {
+		for _, c := range series.Countries {
+			if strings.EqualFold(c, country) {
+				return series.Prefix
+			}
+		}
+	}
+	return config.Invoices.Prefix
+}
+
+// validateInvoices checks every series has a prefix of its own, and that a
+// country is in one series at most
+func validateInvoices(config *Configuration, problems *problems) {
+	invoices := &config.Invoices
+	if invoices.Prefix == "" {
+		invoices.Prefix = DefaultInvoicePrefix
+	}
+	if invoices.Digits < 0 || invoices.Digits > 20 {
+		problems.add("invoices.digits", "has to be between 0 and 20")
+	} else if invoices.Digits == 0 {
+		invoices.Digits = DefaultInvoiceDigits
+	}
+
+	prefixes := map[string]bool{invoices.Prefix: true}
+	countries := map[string]bool{}
+	for i, series := range invoices.Series {
+		field := fmt.Sprintf("invoices.series[%d]", i)
+		if series.Prefix == "" {
+			problems.add(field+".prefix", "every series needs a prefix")
+		} else if prefixes[series.Prefix] {
+			problems.add(field+".prefix", "'%s' is used by another series", series.Prefix)
+		}
+		prefixes[series.Prefix] = true
+		if len(series.Countries) == 0 {
+			problems.add(field+".countries", "every series needs a country")
+		}
+		for _, country := range series.Countries {
+			key := strings.ToLower(country)
+			if countries[key] {
+				problems.add(field+".countries", "'%s' is in another series", country)
+			}
+			countries[key] = true
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package conf
+
+import "fmt"
+
+// JWTSecret is the secret of the key tokens with the kid were signed with.
+// Tokens without a kid are signed with the jwt.secret, there's none for them
+// when it isn't set.
+func (config *Configuration) JWTSecret(kid string) (string, bool) {
+	if kid == "" {
+		return config.JWT.Secret, config.JWT.Secret != ""
+	}
+	for _, key := range config.JWT.Keys {
+		if key.ID == kid {
+			return key.Secret, true
+		}
+	}
+	return "", false
+}
+
+// validateJWTKeys checks every key has a unique ID and a secret, and that
+// the signing key is one of them
+func validateJWTKeys(config *Configuration, problems *problems) {
+	seen := map[string]bool{}
+	for i, key := range config.JWT.Keys {
+		field := fmt.Sprintf("jwt.keys[%d]", i)
+		if key.ID == "" {
+			problems.add(field+".id", "every key needs an ID")
+		} else if seen[key.ID] {
+			problems.add(field+".id", "'%s' is used by another key", key.ID)
+		}
+		seen[key.ID] = true
+		if key.Secret == "" {
+			problems.add(field+".secret", "every key needs a secret")
+		}
+	}
+	if id := config.JWT.SigningKeyID; id != "" && !seen[id] {
+		problems.add("jwt.signing_key_id", "'%s' isn't one of the keys", id)
+	}
+}
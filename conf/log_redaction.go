@@ -0,0 +1,103 @@
+package conf
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// redactedFields are the log fields that hold personal data or secrets
+// whatever their value, by a part of their name
+var redactedFields = []string{"email", "address", "phone", "token", "secret", "password", "authorization", "card"}
+
+// redactedIPFields hold the IP address of a customer
+var redactedIPFields = []string{"ip", "client_ip", "remote_addr"}
+
+var (
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`)
+	bearerPattern = regexp.MustCompile(`(Bearer|Basic) [A-Za-z0-9._~+/\-]+=*`)
+	keyPattern    = regexp.MustCompile(`\b((sk|rk|pk)_(live|test)|whsec)_[A-Za-z0-9]+`)
+	// payment identifiers keep their prefix and last 4 characters, so they
+	// can still be looked up with the payment provider
+	paymentPattern = regexp.MustCompile(`\b((?:tok|pm|src|card|ch|pi|py|re|cus)_|PAY-|PAYID-)([A-Za-z0-9]{8,})`)
+	cardPattern    = regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`)
+)
+
+// redactLogText replaces the personal data and secrets found in a log message
+func redactLogText(text string) string {
+	text = jwtPattern.ReplaceAllString(text, "[redacted token]")
+	text = bearerPattern.ReplaceAllString(text, "$1 [redacted token]")
+	text = keyPattern.ReplaceAllString(text, "[redacted secret]")
+	text = emailPattern.ReplaceAllString(text, "[redacted email]")
+	text = paymentPattern.ReplaceAllStringFunc(text, func(id string) string {
+		match := paymentPattern.FindStringSubmatch(id)
+		return match[1] + "****" + match[2][len(match[2])-4:]
+	})
+	return cardPattern.ReplaceAllStringFunc(text, func(digits string) string {
+		if luhn(digits) {
+			return "[redacted card]"
+		}
+		return digits
+	})
+}
+
+// luhn tells if the digits, ignoring spaces and dashes, pass the check card
+// numbers are made to pass
+func luhn(number string) bool {
+	sum, double := 0, false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func redactLogField(key string, value interface{}) interface{} {
+	name := strings.ToLower(key)
+	for _, field := range redactedIPFields {
+		if name == field {
+			return redactedValue
+		}
+	}
+	for _, field := range redactedFields {
+		if strings.Contains(name, field) {
+			return redactedValue
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return redactLogText(v)
+	case error:
+		return redactLogText(v.Error())
+	}
+	return value
+}
+
+// redactingFormatter redacts the personal data and secrets of log entries
+// before the formatter it wraps writes them
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = redactLogText(entry.Message)
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		redacted.Data[key] = redactLogField(key, value)
+	}
+	return f.Formatter.Format(&redacted)
+}
@@ -0,0 +1,60 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Networks are IP ranges, like the ones allowed to use the admin endpoints
+type Networks []*net.IPNet
+
+// ParseNetworks parses CIDR ranges like 10.0.0.0/8. A plain address is a
+// range of its own.
+func ParseNetworks(values []string) (Networks, error) {
+	networks := Networks{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("'%s' isn't an IP address or CIDR range", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' isn't an IP address or CIDR range", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Contains tells if the address is in one of the networks
+func (n Networks) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateNetworks(config *Configuration, problems *problems) {
+	if _, err := ParseNetworks(config.API.AdminAllowedIPs); err != nil {
+		problems.add("api.admin_allowed_ips", "%v", err)
+	}
+	if _, err := ParseNetworks(config.API.TrustedProxies); err != nil {
+		problems.add("api.trusted_proxies", "%v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package conf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", " 192.168.1.7 ", "2001:db8::/32"})
+	if assert.NoError(t, err) {
+		assert.True(t, networks.Contains(net.ParseIP("10.20.30.40")))
+		assert.True(t, networks.Contains(net.ParseIP("192.168.1.7")))
+		assert.True(t, networks.Contains(net.ParseIP("2001:db8::1")))
+		assert.False(t, networks.Contains(net.ParseIP("192.168.1.8")))
+		assert.False(t, networks.Contains(net.ParseIP("8.8.8.8")))
+		assert.False(t, networks.Contains(nil))
+	}
+
+	_, err = ParseNetworks([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = ParseNetworks([]string{"office"})
+	assert.Error(t, err)
+
+	config := new(Configuration)
+	config.API.AdminAllowedIPs = []string{"10.0.0.0/8", "office"}
+	_, err = validateConfig(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "api.admin_allowed_ips")
+	}
+}
@@ -0,0 +1,160 @@
+package conf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// tlsVersions are the TLS versions outbound.tls_min_version can be
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// transports are shared by the clients with the same outbound settings, so
+// they share their connections
+var transports = struct {
+	sync.Mutex
+	byKey map[string]*http.Transport
+}{byKey: map[string]*http.Transport{}}
+
+// refusingTransport fails every call, for outbound settings that can't be
+// used. Calling without them would go around the proxy or trust the wrong
+// certificates.
+type refusingTransport struct {
+	err error
+}
+
+func (t *refusingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// HTTPClient makes a client for the calls to other services, through the
+// outbound proxy and with the outbound TLS settings. The settings are checked
+// when the configuration is validated, a client with invalid settings that
+// got past it refuses to call anything.
+func (c *Configuration) HTTPClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	outbound := c.Outbound
+	if outbound.Proxy == "" && outbound.CABundle == "" && outbound.TLSMinVersion == "" {
+		return client
+	}
+
+	key := fmt.Sprintf("%s|%s|%s|%s", outbound.Proxy, strings.Join(outbound.NoProxy, ","), outbound.CABundle, outbound.TLSMinVersion)
+	transports.Lock()
+	defer transports.Unlock()
+	transport, ok := transports.byKey[key]
+	if !ok {
+		var err error
+		if transport, err = c.outboundTransport(); err != nil {
+			logrus.WithError(err).Error("Invalid outbound settings, refusing to call other services")
+			client.Transport = &refusingTransport{err: fmt.Errorf("invalid outbound settings: %v", err)}
+			return client
+		}
+		transports.byKey[key] = transport
+	}
+	client.Transport = transport
+	return client
+}
+
+func (c *Configuration) outboundTransport() (*http.Transport, error) {
+	outbound := c.Outbound
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       &tls.Config{},
+	}
+
+	if outbound.Proxy != "" {
+		proxy, err := url.Parse(outbound.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		if proxy.Host == "" {
+			return nil, fmt.Errorf("proxy %s has no host", outbound.Proxy)
+		}
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if skipProxy(req.URL.Hostname(), outbound.NoProxy) {
+				return nil, nil
+			}
+			return proxy, nil
+		}
+	}
+
+	if outbound.CABundle != "" {
+		pem, err := ioutil.ReadFile(outbound.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", outbound.CABundle)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	if outbound.TLSMinVersion != "" {
+		version, ok := tlsVersions[outbound.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %s", outbound.TLSMinVersion)
+		}
+		transport.TLSClientConfig.MinVersion = version
+	}
+	return transport, nil
+}
+
+// skipProxy tells if a host is reached directly, because it's one of the
+// hosts or domains in noProxy
+func skipProxy(host string, noProxy []string) bool {
+	for _, skipped := range noProxy {
+		skipped = strings.TrimPrefix(skipped, ".")
+		if host == skipped || strings.HasSuffix(host, "."+skipped) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateOutbound(config *Configuration, problems *problems) {
+	outbound := config.Outbound
+	if outbound.Proxy != "" {
+		if u, err := url.Parse(outbound.Proxy); err != nil || u.Host == "" {
+			problems.add("outbound.proxy", "must be a URL like http://proxy.example.com:3128, got '%s'", outbound.Proxy)
+		}
+	}
+	if outbound.TLSMinVersion != "" {
+		if _, ok := tlsVersions[outbound.TLSMinVersion]; !ok {
+			problems.add("outbound.tls_min_version", "unknown version '%s', must be one of 1.0, 1.1, 1.2, 1.3", outbound.TLSMinVersion)
+		}
+	}
+	if outbound.CABundle != "" {
+		pem, err := ioutil.ReadFile(outbound.CABundle)
+		if err != nil {
+			problems.add("outbound.ca_bundle", "%v", err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			problems.add("outbound.ca_bundle", "no certificates found in %s", outbound.CABundle)
+		}
+	}
+}
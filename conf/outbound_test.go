@@ -0,0 +1,102 @@
+package conf
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboundProxy(t *testing.T) {
+	proxied := []string{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		fmt.Fprint(w, "proxied")
+	}))
+	defer proxy.Close()
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "direct")
+	}))
+	defer direct.Close()
+
+	config := new(Configuration)
+	config.Outbound.Proxy = proxy.URL
+	config.Outbound.NoProxy = []string{"127.0.0.1"}
+	client := config.HTTPClient(time.Second)
+
+	rsp, err := client.Get("http://shop.example.com/gocommerce/settings.json")
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		assert.Equal(t, "proxied", string(body))
+		assert.Equal(t, []string{"http://shop.example.com/gocommerce/settings.json"}, proxied)
+	}
+
+	rsp, err = client.Get(direct.URL)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		assert.Equal(t, "direct", string(body))
+	}
+
+	// clients with the same settings share their transport
+	assert.True(t, client.Transport == config.HTTPClient(time.Minute).Transport)
+	assert.Nil(t, new(Configuration).HTTPClient(time.Second).Transport)
+}
+
+func TestOutboundCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	bundle, err := ioutil.TempFile("", "gocommerce-ca")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(bundle.Name())
+	pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	bundle.Close()
+
+	config := new(Configuration)
+	_, err = config.HTTPClient(time.Second).Get(server.URL)
+	assert.Error(t, err, "the certificate of the server isn't trusted")
+
+	config.Outbound.CABundle = bundle.Name()
+	config.Outbound.TLSMinVersion = "1.2"
+	rsp, err := config.HTTPClient(time.Second).Get(server.URL)
+	if assert.NoError(t, err) {
+		rsp.Body.Close()
+	}
+
+	// a bundle that can't be read doesn't fall back to the system certificates
+	config = new(Configuration)
+	config.Outbound.CABundle = "/does/not/exist.pem"
+	_, err = config.HTTPClient(time.Second).Get(server.URL)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid outbound settings")
+	}
+}
+
+func TestOutboundValidation(t *testing.T) {
+	config := new(Configuration)
+	config.API.Port = 8080
+	config.Outbound.Proxy = "http://proxy.example.com:3128"
+	config.Outbound.TLSMinVersion = "1.3"
+	_, err := validateConfig(config)
+	assert.NoError(t, err)
+
+	config.Outbound.Proxy = "proxy"
+	config.Outbound.TLSMinVersion = "1.4"
+	config.Outbound.CABundle = "/does/not/exist.pem"
+	_, err = validateConfig(config)
+	if assert.Error(t, err) {
+		assert.Len(t, err.(*ValidationError).Problems, 3)
+	}
+}
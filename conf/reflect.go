@@ -4,12 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 const tagPrefix = "viper"
 
+var durationType = reflect.TypeOf(time.Duration(0))
+
 func populateConfig(config *Configuration) (*Configuration, error) {
 	err := recursivelySet(reflect.ValueOf(config), "")
 	if err != nil {
@@ -50,15 +53,49 @@ func recursivelySet(val reflect.Value, prefix string) error {
 		case reflect.Int32:
 			fallthrough
 		case reflect.Int64:
+			if thisField.Type() == durationType {
+				thisField.SetInt(int64(viper.GetDuration(tag)))
+				continue
+			}
 			// you can only set with an int64 -> int
 			configVal := int64(viper.GetInt(tag))
 			thisField.SetInt(configVal)
+		case reflect.Uint:
+			fallthrough
+		case reflect.Uint32:
+			fallthrough
+		case reflect.Uint64:
+			configVal := uint64(viper.GetInt64(tag))
+			thisField.SetUint(configVal)
 		case reflect.Bool:
 			configVal := viper.GetBool(tag)
 			thisField.SetBool(configVal)
 		case reflect.String:
 			configVal := viper.GetString(tag)
 			thisField.SetString(configVal)
+		case reflect.Slice:
+			if thisField.Type().Elem().Kind() == reflect.Struct {
+				// lists of objects can only come from the config file,
+				// where viper.Unmarshal already read them
+				continue
+			}
+			if thisField.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("unexpected slice type detected ~ aborting: %s", thisField.Type())
+			}
+			configVal := viper.GetStringSlice(tag)
+			thisField.Set(reflect.ValueOf(configVal))
+		case reflect.Map:
+			if thisField.Type().Key().Kind() != reflect.String {
+				return fmt.Errorf("unexpected map type detected ~ aborting: %s", thisField.Type())
+			}
+			switch elem := thisField.Type().Elem(); {
+			case elem.Kind() == reflect.String:
+				thisField.Set(reflect.ValueOf(viper.GetStringMapString(tag)))
+			case elem.Kind() == reflect.Slice && elem.Elem().Kind() == reflect.String:
+				thisField.Set(reflect.ValueOf(viper.GetStringMapStringSlice(tag)))
+			default:
+				return fmt.Errorf("unexpected map type detected ~ aborting: %s", thisField.Type())
+			}
 		default:
 			return fmt.Errorf("unexpected type detected ~ aborting: %s", thisField.Kind())
 		}
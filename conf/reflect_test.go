@@ -40,3 +40,25 @@ func TestNestedValues(t *testing.T) {
 	assert.Equal(t, "i am a simple string", c.Nested.StringVal)
 	assert.Equal(t, true, c.Nested.BoolVal)
 }
+
+func TestSliceValues(t *testing.T) {
+	c := struct {
+		List []string `json:"list"`
+	}{}
+
+	viper.SetDefault("list", []string{"one", "two"})
+
+	assert.Nil(t, recursivelySet(reflect.ValueOf(&c), ""))
+	assert.Equal(t, []string{"one", "two"}, c.List)
+}
+
+func TestMapOfSliceValues(t *testing.T) {
+	c := struct {
+		Roles map[string][]string `json:"roles"`
+	}{}
+
+	viper.SetDefault("roles", map[string]interface{}{"support": []interface{}{"orders:read", "users:read"}})
+
+	assert.Nil(t, recursivelySet(reflect.ValueOf(&c), ""))
+	assert.Equal(t, map[string][]string{"support": {"orders:read", "users:read"}}, c.Roles)
+}
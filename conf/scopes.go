@@ -0,0 +1,76 @@
+package conf
+
+import "sort"
+
+// Scopes grant access to a part of the admin API. Roles are mapped to scopes
+// with jwt.roles, and the jwt.admin_group_name role has all of them, along
+// with the admin endpoints no scope covers, like the configuration.
+const (
+	ScopeOrdersRead     = "orders:read"
+	ScopeOrdersWrite    = "orders:write"
+	ScopeRefundsCreate  = "refunds:create"
+	ScopeReportsRead    = "reports:read"
+	ScopeUsersRead      = "users:read"
+	ScopeUsersWrite     = "users:write"
+	ScopeInventoryRead  = "inventory:read"
+	ScopeInventoryWrite = "inventory:write"
+	ScopeCouponsRead    = "coupons:read"
+	ScopeCouponsWrite   = "coupons:write"
+)
+
+// Scopes are all the scopes roles can be granted
+var Scopes = []string{
+	ScopeOrdersRead,
+	ScopeOrdersWrite,
+	ScopeRefundsCreate,
+	ScopeReportsRead,
+	ScopeUsersRead,
+	ScopeUsersWrite,
+	ScopeInventoryRead,
+	ScopeInventoryWrite,
+	ScopeCouponsRead,
+	ScopeCouponsWrite,
+}
+
+// ValidScope checks if scope is one of the known scopes
+func ValidScope(scope string) bool {
+	for _, known := range Scopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopesForRoles are the scopes jwt.roles grants to a token with the roles
+func (config *Configuration) ScopesForRoles(roles []string) map[string]bool {
+	scopes := map[string]bool{}
+	for _, role := range roles {
+		for _, scope := range config.JWT.Roles[role] {
+			scopes[scope] = true
+		}
+	}
+	return scopes
+}
+
+// validateRoles checks the roles only grant known scopes, and don't redefine
+// the admin role
+func validateRoles(config *Configuration, problems *problems) {
+	roles := make([]string, 0, len(config.JWT.Roles))
+	for role := range config.JWT.Roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	for _, role := range roles {
+		field := "jwt.roles." + role
+		if role == config.JWT.AdminGroupName {
+			problems.add(field, "is the admin_group_name role, which has all scopes")
+		}
+		for _, scope := range config.JWT.Roles[role] {
+			if !ValidScope(scope) {
+				problems.add(field, "unknown scope %q, must be one of %v", scope, Scopes)
+			}
+		}
+	}
+}
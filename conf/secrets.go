@@ -0,0 +1,236 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/sigv4"
+)
+
+// The prefixes of config values that are references to secrets
+const (
+	vaultPrefix = "vault:"
+	awsPrefix   = "aws-secretsmanager:"
+)
+
+// secretResolver reads the secrets config values refer to. Every secret is
+// only read once, even if several values use keys of it.
+type secretResolver struct {
+	config *Configuration
+	client *http.Client
+	now    func() time.Time
+
+	// secrets holds the Vault secrets, values the AWS ones
+	secrets map[string]map[string]string
+	values  map[string]string
+
+	// masterKey decrypts the enc: values, it's read when the first one is
+	// found
+	masterKey []byte
+}
+
+// resolveSecrets replaces the string values of the configuration that look
+// like vault:<path>#<key> or aws-secretsmanager:<secret id>[#<key>] with the
+// secrets they refer to, and decrypts the enc:<encrypted value> ones with the
+// master key
+func resolveSecrets(config *Configuration, client *http.Client) error {
+	r := &secretResolver{
+		config:  config,
+		client:  client,
+		now:     time.Now,
+		secrets: map[string]map[string]string{},
+		values:  map[string]string{},
+	}
+	return r.resolve(reflect.ValueOf(config).Elem(), "")
+}
+
+func (r *secretResolver) resolve(val reflect.Value, path string) error {
+	switch val.Kind() {
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			if err := r.resolve(val.Field(i), path+"."+getTag(val.Type().Field(i))); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			if err := r.resolve(val.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		if !val.CanSet() {
+			return nil
+		}
+		value := val.String()
+		var secret string
+		var err error
+		switch {
+		case strings.HasPrefix(value, vaultPrefix):
+			secret, err = r.vault(strings.TrimPrefix(value, vaultPrefix))
+		case strings.HasPrefix(value, awsPrefix):
+			secret, err = r.aws(strings.TrimPrefix(value, awsPrefix))
+		case strings.HasPrefix(value, encryptedPrefix):
+			secret, err = r.decrypt(value)
+		default:
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", strings.TrimPrefix(path, "."), err)
+		}
+		val.SetString(secret)
+	}
+	return nil
+}
+
+// decrypt decrypts an enc: value with the master key
+func (r *secretResolver) decrypt(value string) (string, error) {
+	if r.masterKey == nil {
+		key, err := MasterKey()
+		if err != nil {
+			return "", err
+		}
+		r.masterKey = key
+	}
+	return decrypt(value, r.masterKey)
+}
+
+// vault reads a key of a secret from Vault. Secrets of version 2 of the
+// key/value engine are nested in the data of the response.
+func (r *secretResolver) vault(reference string) (string, error) {
+	path, key := splitSecretReference(reference)
+	if key == "" {
+		return "", fmt.Errorf("the Vault secret %s needs a #key", path)
+	}
+	if secret, ok := r.secrets[vaultPrefix+path]; ok {
+		return secretKey(secret, path, key)
+	}
+
+	config := r.config.Secrets.Vault
+	address := withDefault(config.Address, os.Getenv("VAULT_ADDR"))
+	token := withDefault(config.Token, os.Getenv("VAULT_TOKEN"))
+	if address == "" || token == "" {
+		return "", fmt.Errorf("reading %s from Vault needs an address and a token", path)
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	body, err := r.do(req, "Vault")
+	if err != nil {
+		return "", err
+	}
+
+	rsp := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := json.Unmarshal(body, &rsp); err != nil {
+		return "", err
+	}
+	data := rsp.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	secret := map[string]string{}
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			secret[k] = s
+		}
+	}
+	r.secrets[vaultPrefix+path] = secret
+	return secretKey(secret, path, key)
+}
+
+// aws reads a secret from AWS Secrets Manager. Without a key the whole
+// secret is the value, with a key the secret is a JSON object.
+func (r *secretResolver) aws(reference string) (string, error) {
+	id, key := splitSecretReference(reference)
+	value, ok := r.values[awsPrefix+id]
+	if !ok {
+		config := r.config.Secrets.AWS
+		region := withDefault(config.Region, os.Getenv("AWS_REGION"))
+		if region == "" {
+			return "", fmt.Errorf("reading %s from AWS Secrets Manager needs a region", id)
+		}
+		endpoint := withDefault(config.Endpoint, "https://secretsmanager."+region+".amazonaws.com")
+		body, _ := json.Marshal(map[string]string{"SecretId": id})
+		req, err := http.NewRequest("POST", endpoint, strings.NewReader(string(body)))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+		if err := sigv4.Sign(req, string(body), "secretsmanager", region, r.now()); err != nil {
+			return "", err
+		}
+		raw, err := r.do(req, "AWS Secrets Manager")
+		if err != nil {
+			return "", err
+		}
+		rsp := struct {
+			SecretString string `json:"SecretString"`
+		}{}
+		if err := json.Unmarshal(raw, &rsp); err != nil {
+			return "", err
+		}
+		value = rsp.SecretString
+		r.values[awsPrefix+id] = value
+	}
+	if key == "" {
+		return value, nil
+	}
+
+	secret := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &secret); err != nil {
+		return "", fmt.Errorf("the secret %s isn't a JSON object of strings: %v", id, err)
+	}
+	return secretKey(secret, id, key)
+}
+
+func (r *secretResolver) do(req *http.Request, service string) ([]byte, error) {
+	rsp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %v: %s", service, rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func splitSecretReference(reference string) (path, key string) {
+	parts := strings.SplitN(reference, "#", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+func secretKey(secret map[string]string, path, key string) (string, error) {
+	value, ok := secret[key]
+	if !ok {
+		return "", fmt.Errorf("the secret %s has no %s", path, key)
+	}
+	return value, nil
+}
+
+func withDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,130 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaultSecrets(t *testing.T) {
+	requests := 0
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "vault-token", r.Header.Get("X-Vault-Token"))
+		switch r.URL.Path {
+		case "/v1/secret/data/gocommerce":
+			fmt.Fprint(w, `{"data": {"data": {"stripe_key": "sk_test_vault", "jwt_secret": "jwt-vault"}, "metadata": {"version": 3}}}`)
+		case "/v1/kv/smtp":
+			fmt.Fprint(w, `{"data": {"password": "smtp-vault"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": []}`)
+		}
+	}))
+	defer vault.Close()
+
+	config := new(Configuration)
+	config.Secrets.Vault.Address = vault.URL
+	config.Secrets.Vault.Token = "vault-token"
+	config.Payment.Stripe.SecretKey = "vault:secret/data/gocommerce#stripe_key"
+	config.JWT.Secret = "vault:secret/data/gocommerce#jwt_secret"
+	config.Mailer.Pass = "vault:kv/smtp#password"
+	config.Mailer.User = "plain"
+	assert.NoError(t, resolveSecrets(config, http.DefaultClient))
+	assert.Equal(t, "sk_test_vault", config.Payment.Stripe.SecretKey)
+	assert.Equal(t, "jwt-vault", config.JWT.Secret)
+	assert.Equal(t, "smtp-vault", config.Mailer.Pass)
+	assert.Equal(t, "plain", config.Mailer.User)
+	assert.Equal(t, 2, requests)
+
+	config.JWT.Secret = "vault:secret/data/gocommerce#missing"
+	err := resolveSecrets(config, http.DefaultClient)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "jwt.secret")
+	}
+
+	config.JWT.Secret = "vault:secret/data/other#key"
+	assert.Error(t, resolveSecrets(config, http.DefaultClient))
+}
+
+func TestAWSSecrets(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request")
+		body := map[string]string{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		switch body["SecretId"] {
+		case "gocommerce/prod":
+			fmt.Fprint(w, `{"Name": "gocommerce/prod", "SecretString": "{\"stripe_key\": \"sk_test_aws\"}"}`)
+		case "smtp-password":
+			fmt.Fprint(w, `{"Name": "smtp-password", "SecretString": "smtp-aws"}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type": "ResourceNotFoundException"}`)
+		}
+	}))
+	defer aws.Close()
+
+	config := new(Configuration)
+	config.Secrets.AWS.Region = "eu-west-1"
+	config.Secrets.AWS.Endpoint = aws.URL
+	config.Payment.Stripe.SecretKey = "aws-secretsmanager:gocommerce/prod#stripe_key"
+	config.Mailer.Pass = "aws-secretsmanager:smtp-password"
+	assert.NoError(t, resolveSecrets(config, http.DefaultClient))
+	assert.Equal(t, "sk_test_aws", config.Payment.Stripe.SecretKey)
+	assert.Equal(t, "smtp-aws", config.Mailer.Pass)
+
+	config.JWT.Secret = "aws-secretsmanager:missing"
+	assert.Error(t, resolveSecrets(config, http.DefaultClient))
+}
+
+func TestEncryptedValues(t *testing.T) {
+	masterKey, err := NewMasterKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+	os.Setenv(MasterKeyVar, masterKey)
+	defer os.Unsetenv(MasterKeyVar)
+	key, err := MasterKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	encrypted, err := Encrypt("sk_live_encrypted", key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, encrypted, "sk_live")
+	config := new(Configuration)
+	config.Payment.Stripe.SecretKey = encrypted
+	config.Mailer.User = "plain"
+	assert.NoError(t, resolveSecrets(config, http.DefaultClient))
+	assert.Equal(t, "sk_live_encrypted", config.Payment.Stripe.SecretKey)
+	assert.Equal(t, "plain", config.Mailer.User)
+
+	// another key can't decrypt the value
+	otherKey, _ := NewMasterKey()
+	os.Setenv(MasterKeyVar, otherKey)
+	config.Payment.Stripe.SecretKey = encrypted
+	err = resolveSecrets(config, http.DefaultClient)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "payment.stripe.secret_key")
+	}
+
+	os.Unsetenv(MasterKeyVar)
+	assert.Error(t, resolveSecrets(config, http.DefaultClient), "the master key is needed")
+
+	os.Setenv(MasterKeyVar, masterKey)
+	config.Payment.Stripe.SecretKey = "enc:not-base64!"
+	assert.Error(t, resolveSecrets(config, http.DefaultClient))
+}
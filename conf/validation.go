@@ -0,0 +1,391 @@
+package conf
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Problem is something wrong with a setting of the configuration
+type Problem struct {
+	// Field is the path of the setting, like mailer.sendgrid.api_key
+	Field   string
+	Message string
+}
+
+// ValidationError lists all the problems found in a configuration, so they
+// can be fixed at once
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		lines[i] = problem.Field + ": " + problem.Message
+	}
+	return "invalid configuration:\n  " + strings.Join(lines, "\n  ")
+}
+
+// problems collects the problems found while validating a configuration
+type problems []Problem
+
+func (p *problems) add(field, format string, args ...interface{}) {
+	*p = append(*p, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *problems) err() error {
+	if len(*p) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: *p}
+}
+
+// validateSMTP checks the SMTP mailer is complete once any of it is set up
+func validateSMTP(config *Configuration, problems *problems) {
+	mailer := config.Mailer
+	if mailer.Host == "" && mailer.Port == 0 && mailer.User == "" && mailer.Pass == "" {
+		return
+	}
+	if mailer.Host == "" {
+		problems.add("mailer.host", "is needed by the smtp mailer")
+	}
+	if mailer.Port <= 0 || mailer.Port > 65535 {
+		problems.add("mailer.port", "must be between 1 and 65535, got %d", mailer.Port)
+	}
+	if mailer.User != "" && mailer.Pass == "" {
+		problems.add("mailer.pass", "is needed with a user")
+	}
+	if mailer.Pass != "" && mailer.User == "" {
+		problems.add("mailer.user", "is needed with a pass")
+	}
+}
+
+// validatePayment checks the payment providers that are set up have all of
+// their credentials
+func validatePayment(config *Configuration, problems *problems) {
+	stripe := config.Payment.Stripe
+	if stripe.SecretKey != "" && !strings.HasPrefix(stripe.SecretKey, "sk_") && !strings.HasPrefix(stripe.SecretKey, "rk_") {
+		problems.add("payment.stripe.secret_key", "must be a secret or restricted key, starting with sk_ or rk_")
+	}
+	if stripe.WebhookSecret != "" && stripe.SecretKey == "" {
+		problems.add("payment.stripe.secret_key", "is needed with a webhook_secret")
+	}
+
+	paypal := config.Payment.Paypal
+	if paypal.ClientID != "" && paypal.Secret == "" {
+		problems.add("payment.paypal.secret", "is needed with a client_id")
+	}
+	if paypal.Secret != "" && paypal.ClientID == "" {
+		problems.add("payment.paypal.client_id", "is needed with a secret")
+	}
+	if paypal.Env != "" && paypal.Env != "sandbox" && paypal.Env != "production" {
+		problems.add("payment.paypal.env", "unknown env '%s', must be 'sandbox' or 'production'", paypal.Env)
+	}
+
+	limits := &config.Payment.Limits
+	if limits.Window < 0 {
+		problems.add("payment.limits.window", "can't be negative")
+	}
+	setDefaultDuration(&limits.Window, DefaultPaymentWindow)
+	if limits.PerOrder < 0 {
+		problems.add("payment.limits.per_order", "can't be negative")
+	}
+	if limits.PerUser < 0 {
+		problems.add("payment.limits.per_user", "can't be negative")
+	}
+	if limits.PerIP < 0 {
+		problems.add("payment.limits.per_ip", "can't be negative")
+	}
+	if limits.MaxSmallFailures < 0 {
+		problems.add("payment.limits.max_small_failures", "can't be negative")
+	}
+	if limits.MaxSmallFailures > 0 && limits.SmallAmount == 0 {
+		problems.add("payment.limits.small_amount", "is needed with max_small_failures")
+	}
+}
+
+// validateFraud checks the fraud scoring has a threshold once anything scores
+// orders
+func validateFraud(config *Configuration, problems *problems) {
+	fraud := &config.Fraud
+	rules := &fraud.Rules
+	if fraud.Threshold < 0 {
+		problems.add("fraud.threshold", "can't be negative")
+	}
+	if rules.CountryMismatch < 0 {
+		problems.add("fraud.rules.country_mismatch", "can't be negative")
+	}
+	if rules.DisposableEmail < 0 {
+		problems.add("fraud.rules.disposable_email", "can't be negative")
+	}
+	if rules.Velocity < 0 {
+		problems.add("fraud.rules.velocity", "can't be negative")
+	}
+	if rules.VelocityWindow < 0 {
+		problems.add("fraud.rules.velocity_window", "can't be negative")
+	}
+	if rules.Velocity > 0 && rules.VelocityOrders <= 0 {
+		problems.add("fraud.rules.velocity_orders", "is needed by the velocity rule")
+	}
+	if fraud.Secret != "" && fraud.URL == "" {
+		problems.add("fraud.url", "is needed with a secret")
+	}
+	if fraud.URL != "" {
+		if u, err := url.Parse(fraud.URL); err != nil || !u.IsAbs() {
+			problems.add("fraud.url", "must be an absolute URL, got '%s'", fraud.URL)
+		}
+	}
+	scored := fraud.URL != "" || rules.CountryMismatch > 0 || rules.DisposableEmail > 0 || rules.Velocity > 0
+	if scored && fraud.Threshold == 0 {
+		problems.add("fraud.threshold", "is needed to score orders")
+	}
+	if len(rules.DisposableDomains) == 0 {
+		rules.DisposableDomains = DefaultDisposableDomains
+	}
+	setDefaultDuration(&rules.VelocityWindow, DefaultFraudVelocityWindow)
+}
+
+// validateOrderLimits defaults the limits on the size of orders
+func validateOrderLimits(config *Configuration, problems *problems) {
+	limits := &config.OrderLimits
+	if limits.MaxLineItems < 0 {
+		problems.add("order_limits.max_line_items", "can't be negative")
+	}
+	if limits.MaxMetaSize < 0 {
+		problems.add("order_limits.max_meta_size", "can't be negative")
+	}
+	if limits.MaxFieldLength < 0 {
+		problems.add("order_limits.max_field_length", "can't be negative")
+	}
+	if limits.MaxLineItems == 0 {
+		limits.MaxLineItems = DefaultMaxLineItems
+	}
+	if limits.MaxQuantity == 0 {
+		limits.MaxQuantity = DefaultMaxQuantity
+	}
+	if limits.MaxMetaSize == 0 {
+		limits.MaxMetaSize = DefaultMaxMetaSize
+	}
+	if limits.MaxFieldLength == 0 {
+		limits.MaxFieldLength = DefaultMaxFieldLength
+	}
+}
+
+func validateDownloads(config *Configuration, problems *problems) {
+	switch config.Downloads.Provider {
+	case "":
+	case "netlify":
+		if config.Downloads.NetlifyToken == "" {
+			problems.add("downloads.netlify_token", "is needed by the netlify provider")
+		}
+	default:
+		problems.add("downloads.provider", "unknown provider '%s', must be 'netlify'", config.Downloads.Provider)
+	}
+}
+
+func validateCoupons(config *Configuration, problems *problems) {
+	coupons := config.Coupons
+	if coupons.URL == "" {
+		if coupons.User != "" || coupons.Password != "" {
+			problems.add("coupons.url", "is needed with a user and password")
+		}
+		return
+	}
+	if u, err := url.Parse(coupons.URL); err != nil || !u.IsAbs() {
+		problems.add("coupons.url", "must be an absolute URL, got '%s'", coupons.URL)
+	}
+	if (coupons.User == "") != (coupons.Password == "") {
+		problems.add("coupons.password", "the user and password go together")
+	}
+}
+
+// validateReferrals checks the discount and credit of referrals are
+// percentages
+func validateReferrals(config *Configuration, problems *problems) {
+	if config.Referrals.Discount > 100 {
+		problems.add("referrals.discount", "can't be more than 100 percent")
+	}
+	if config.Referrals.Credit > 100 {
+		problems.add("referrals.credit", "can't be more than 100 percent")
+	}
+}
+
+// validateCurrencies checks the settlement currency and the exchange rate
+// provider, and fills in the URL and cache TTL of the provider
+func validateCurrencies(config *Configuration, problems *problems) {
+	currencies := &config.Currencies
+	if currencies.Settlement != "" {
+		currencies.Settlement = strings.ToUpper(currencies.Settlement)
+		if len(currencies.Settlement) != 3 {
+			problems.add("currencies.settlement", "must be a currency code like EUR, got '%s'", currencies.Settlement)
+		}
+	}
+
+	rates := &currencies.Rates
+	switch rates.Provider {
+	case "":
+		if currencies.Settlement != "" {
+			problems.add("currencies.rates.provider", "is needed to convert orders to the settlement currency")
+		}
+		return
+	case ECBRates:
+		if rates.URL == "" {
+			rates.URL = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
+		}
+	case OpenExchangeRatesRates:
+		if rates.URL == "" {
+			rates.URL = "https://openexchangerates.org/api/latest.json"
+		}
+		if rates.APIKey == "" {
+			problems.add("currencies.rates.api_key", "is needed by the openexchangerates provider")
+		}
+	default:
+		problems.add("currencies.rates.provider", "unknown provider '%s', must be 'ecb' or 'openexchangerates'", rates.Provider)
+		return
+	}
+	if u, err := url.Parse(rates.URL); err != nil || !u.IsAbs() {
+		problems.add("currencies.rates.url", "must be an absolute URL, got '%s'", rates.URL)
+	}
+	if rates.CacheTTL < 0 {
+		problems.add("currencies.rates.cache_ttl", "can't be negative")
+	}
+	if rates.MaxStale < 0 {
+		problems.add("currencies.rates.max_stale", "can't be negative")
+	}
+	setDefaultDuration(&rates.CacheTTL, DefaultRatesCacheTTL)
+	setDefaultDuration(&rates.MaxStale, DefaultRatesMaxStale)
+}
+
+// validatePool checks the connection pool settings and fills in the defaults
+func validatePool(config *Configuration, problems *problems) {
+	db := &config.DB
+	if db.MaxOpenConns < 0 {
+		problems.add("db.max_open_conns", "can't be negative")
+	}
+	if db.MaxIdleConns < 0 {
+		problems.add("db.max_idle_conns", "can't be negative")
+	}
+	if db.ConnMaxLifetime < 0 {
+		problems.add("db.conn_max_lifetime", "can't be negative")
+	}
+	if db.QueryTimeout < 0 {
+		problems.add("db.query_timeout", "can't be negative")
+	}
+	if db.MaxOpenConns == 0 {
+		db.MaxOpenConns = DefaultMaxOpenConns
+	}
+	if db.MaxIdleConns == 0 {
+		db.MaxIdleConns = DefaultMaxIdleConns
+		if db.MaxIdleConns > db.MaxOpenConns {
+			db.MaxIdleConns = db.MaxOpenConns
+		}
+	}
+	if db.MaxIdleConns > db.MaxOpenConns {
+		problems.add("db.max_idle_conns", "can't be more than db.max_open_conns (%d), got %d", db.MaxOpenConns, db.MaxIdleConns)
+	}
+	setDefaultDuration(&db.ConnMaxLifetime, DefaultConnMaxLifetime)
+	setDefaultDuration(&db.QueryTimeout, DefaultQueryTimeout)
+}
+
+// validateRetention checks the retention policy can export the orders before
+// they're pruned
+func validateRetention(config *Configuration, problems *problems) {
+	retention := &config.Retention
+	if retention.OrderYears < 0 {
+		problems.add("retention.order_years", "can't be negative")
+	}
+	if retention.OrderYears <= 0 {
+		return
+	}
+	if retention.Action == "" {
+		retention.Action = ArchiveRetention
+	}
+	if retention.Action != ArchiveRetention && retention.Action != AnonymizeRetention {
+		problems.add("retention.action", "unknown action '%s', must be '%s' or '%s'", retention.Action, ArchiveRetention, AnonymizeRetention)
+	}
+	setDefaultDuration(&retention.Interval, DefaultRetentionInterval)
+
+	if retention.ArchiveURL == "" {
+		if retention.Action == ArchiveRetention {
+			problems.add("retention.archive_url", "is needed to export the orders before they're deleted")
+		}
+		return
+	}
+	u, err := url.Parse(retention.ArchiveURL)
+	switch {
+	case err != nil:
+		problems.add("retention.archive_url", "can't be parsed: %v", err)
+	case u.Scheme == "file" && u.Path == "":
+		problems.add("retention.archive_url", "needs a directory, like file:///var/lib/gocommerce/archive")
+	case u.Scheme == "s3" && u.Host == "":
+		problems.add("retention.archive_url", "needs a bucket, like s3://bucket/prefix")
+	case u.Scheme != "file" && u.Scheme != "s3":
+		problems.add("retention.archive_url", "unknown scheme '%s', must be file or s3", u.Scheme)
+	}
+}
+
+func validateWorker(config *Configuration, problems *problems) {
+	worker := &config.Worker
+	if worker.Concurrency < 0 {
+		problems.add("worker.concurrency", "can't be negative")
+	}
+	if worker.MaxRetries < 0 {
+		problems.add("worker.max_retries", "can't be negative")
+	}
+	if worker.PollInterval < 0 {
+		problems.add("worker.poll_interval", "can't be negative")
+	}
+	if worker.Concurrency == 0 {
+		worker.Concurrency = DefaultWorkerConcurrency
+	}
+	if worker.MaxRetries == 0 {
+		worker.MaxRetries = DefaultWorkerMaxRetries
+	}
+	setDefaultDuration(&worker.PollInterval, DefaultWorkerPollInterval)
+	setDefaultDuration(&worker.RetryPeriod, DefaultWorkerRetryPeriod)
+	setDefaultDuration(&worker.MaxRetryPeriod, DefaultWorkerMaxRetryPeriod)
+}
+
+// validateSchedule defaults the intervals of the recurring tasks. The ones
+// of the cart reminders and the retention policy default to the intervals
+// configured before there was a schedule.
+func validateSchedule(config *Configuration, problems *problems) {
+	if config.Cancellations.ExpireAfter < 0 {
+		problems.add("cancellations.expire_after", "can't be negative")
+	}
+	if remind := config.AbandonedCarts.RemindAfter; remind > 0 && config.Cancellations.ExpireAfter > 0 && config.Cancellations.ExpireAfter <= remind {
+		problems.add("cancellations.expire_after", "must be longer than abandoned_carts.remind_after, or the orders expire before they're reminded")
+	}
+
+	schedule := &config.Schedule
+	for _, task := range []struct {
+		name string
+		task *ScheduledTask
+	}{
+		{"expire_orders", &schedule.ExpireOrders},
+		{"refresh_settings", &schedule.RefreshSettings},
+		{"abandoned_carts", &schedule.AbandonedCarts},
+		{"retention", &schedule.Retention},
+		{"revalidate_vat", &schedule.RevalidateVAT},
+		{"settle_charges", &schedule.SettleCharges},
+	} {
+		if task.task.Interval < 0 {
+			problems.add("schedule."+task.name+".interval", "can't be negative")
+		}
+	}
+	setDefaultDuration(&schedule.ExpireOrders.Interval, DefaultExpireOrdersInterval)
+	setDefaultDuration(&schedule.RefreshSettings.Interval, config.Settings.TTL)
+	setDefaultDuration(&schedule.AbandonedCarts.Interval, withDefaultDuration(config.AbandonedCarts.Interval, DefaultAbandonedCartInterval))
+	setDefaultDuration(&schedule.Retention.Interval, withDefaultDuration(config.Retention.Interval, DefaultRetentionInterval))
+	setDefaultDuration(&schedule.RevalidateVAT.Interval, DefaultRevalidateVATInterval)
+	setDefaultDuration(&schedule.SettleCharges.Interval, DefaultSettleChargesInterval)
+}
+
+func withDefaultDuration(d, value time.Duration) time.Duration {
+	if d == 0 {
+		return value
+	}
+	return d
+}
@@ -0,0 +1,166 @@
+// Package events is the internal event bus of GoCommerce. The API handlers
+// publish what happened to orders and payments, and the side effects of it,
+// like webhooks, emails and stats, are subscribers of the bus.
+//
+// Events are published within the database transaction that makes the change.
+// Transactional subscribers run right away, within that transaction, so what
+// they write is only kept if it commits. The other subscribers run in the
+// background once the transaction committed, off the request path:
+//
+//	batch := bus.Begin(tx)
+//	batch.Publish(ctx, &events.Event{Type: webhooks.PaymentEvent, Payload: order})
+//	if rsp := batch.Commit(); rsp.Error != nil {
+//		// the background subscribers never see the event
+//	}
+package events
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// All subscribes to every type of event
+const All = "*"
+
+// Event is something that happened to an order. The types are the ones of
+// the webhooks.
+type Event struct {
+	Type    string
+	OrderID string
+	UserID  string
+	// RequestID is the ID of the request that caused the event
+	RequestID string
+	// InstanceID is the store of the event in multi-instance mode
+	InstanceID string
+	// Payload is what the webhooks for the event send
+	Payload interface{}
+	// Transaction is the payment or refund the event is about, if any
+	Transaction *models.Transaction
+
+	CreatedAt time.Time
+}
+
+// TxHandler handles events within the transaction that publishes them
+type TxHandler func(ctx context.Context, tx *gorm.DB, e *Event)
+
+// Handler handles events in the background after they were committed
+type Handler func(e *Event)
+
+// Bus passes events on to their subscribers
+type Bus struct {
+	log *logrus.Entry
+
+	mutex      sync.RWMutex
+	txHandlers map[string][]TxHandler
+	handlers   map[string][]Handler
+
+	running sync.WaitGroup
+}
+
+// NewBus creates a bus without subscribers
+func NewBus(log *logrus.Entry) *Bus {
+	return &Bus{
+		log:        log,
+		txHandlers: map[string][]TxHandler{},
+		handlers:   map[string][]Handler{},
+	}
+}
+
+// SubscribeTx runs h within the publishing transaction for events of a type,
+// or of every type for All
+func (b *Bus) SubscribeTx(eventType string, h TxHandler) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.txHandlers[eventType] = append(b.txHandlers[eventType], h)
+}
+
+// Subscribe runs h in the background for events of a type, or of every type
+// for All, once they were committed
+func (b *Bus) Subscribe(eventType string, h Handler) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers[eventType] = append(b.handlers[eventType], h)
+}
+
+// Begin starts collecting the events published within a transaction
+func (b *Bus) Begin(tx *gorm.DB) *Batch {
+	return &Batch{bus: b, tx: tx}
+}
+
+// Wait waits for the background subscribers that are still running
+func (b *Bus) Wait() {
+	b.running.Wait()
+}
+
+func (b *Bus) dispatch(e *Event) {
+	b.mutex.RLock()
+	handlers := append(append([]Handler{}, b.handlers[e.Type]...), b.handlers[All]...)
+	b.mutex.RUnlock()
+
+	for _, h := range handlers {
+		b.running.Add(1)
+		go func(h Handler) {
+			defer b.running.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					b.log.WithField("event", e.Type).Errorf("Event subscriber panicked: %v\n%s", r, debug.Stack())
+				}
+			}()
+			h(e)
+		}(h)
+	}
+}
+
+// Batch holds the events published within a transaction until it commits
+type Batch struct {
+	bus    *Bus
+	tx     *gorm.DB
+	events []*Event
+}
+
+// Tx is the transaction of the batch
+func (t *Batch) Tx() *gorm.DB {
+	return t.tx
+}
+
+// Publish runs the transactional subscribers of the event and keeps it for
+// the others
+func (t *Batch) Publish(ctx context.Context, e *Event) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+
+	t.bus.mutex.RLock()
+	handlers := append(append([]TxHandler{}, t.bus.txHandlers[e.Type]...), t.bus.txHandlers[All]...)
+	t.bus.mutex.RUnlock()
+	for _, h := range handlers {
+		h(ctx, t.tx, e)
+	}
+	t.events = append(t.events, e)
+}
+
+// Commit commits the transaction and, if that worked, passes the events on
+// to the background subscribers
+func (t *Batch) Commit() *gorm.DB {
+	rsp := t.tx.Commit()
+	if rsp.Error == nil {
+		for _, e := range t.events {
+			t.bus.dispatch(e)
+		}
+	}
+	t.events = nil
+	return rsp
+}
+
+// Rollback rolls the transaction back and drops its events
+func (t *Batch) Rollback() *gorm.DB {
+	t.events = nil
+	return t.tx.Rollback()
+}
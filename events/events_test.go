@@ -0,0 +1,116 @@
+package events
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+type note struct {
+	ID   uint64
+	Text string
+}
+
+func testDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		assert.FailNow(t, "failed to open db: "+err.Error())
+	}
+	db.AutoMigrate(&note{})
+	return db
+}
+
+// recorder collects the events its subscriber was called with
+type recorder struct {
+	mutex  sync.Mutex
+	events []*Event
+}
+
+func (r *recorder) handle(e *Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) types() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	types := []string{}
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestPublishAndCommit(t *testing.T) {
+	db := testDB(t)
+	bus := NewBus(logrus.NewEntry(logrus.StandardLogger()))
+
+	bus.SubscribeTx("order", func(ctx context.Context, tx *gorm.DB, e *Event) {
+		tx.Create(&note{Text: e.OrderID})
+	})
+	orders, all := &recorder{}, &recorder{}
+	bus.Subscribe("order", orders.handle)
+	bus.Subscribe(All, all.handle)
+
+	batch := bus.Begin(db.Begin())
+	batch.Publish(context.Background(), &Event{Type: "order", OrderID: "first-order"})
+	batch.Publish(context.Background(), &Event{Type: "payment", OrderID: "first-order"})
+
+	count := 0
+	batch.Tx().Model(&note{}).Count(&count)
+	assert.Equal(t, 1, count, "transactional subscribers run when publishing")
+	bus.Wait()
+	assert.Empty(t, all.types(), "the other subscribers wait for the commit")
+
+	assert.NoError(t, batch.Commit().Error)
+	bus.Wait()
+	assert.Equal(t, []string{"order"}, orders.types())
+	types := all.types()
+	sort.Strings(types)
+	assert.Equal(t, []string{"order", "payment"}, types)
+
+	db.Model(&note{}).Count(&count)
+	assert.Equal(t, 1, count)
+}
+
+func TestRollbackDropsEvents(t *testing.T) {
+	db := testDB(t)
+	bus := NewBus(logrus.NewEntry(logrus.StandardLogger()))
+	bus.SubscribeTx(All, func(ctx context.Context, tx *gorm.DB, e *Event) {
+		tx.Create(&note{Text: e.Type})
+	})
+	all := &recorder{}
+	bus.Subscribe(All, all.handle)
+
+	batch := bus.Begin(db.Begin())
+	batch.Publish(context.Background(), &Event{Type: "refund"})
+	batch.Rollback()
+	bus.Wait()
+
+	assert.Empty(t, all.types())
+	count := 0
+	db.Model(&note{}).Count(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestPanickingSubscriber(t *testing.T) {
+	db := testDB(t)
+	bus := NewBus(logrus.NewEntry(logrus.StandardLogger()))
+	bus.Subscribe(All, func(e *Event) { panic("boom") })
+	all := &recorder{}
+	bus.Subscribe(All, all.handle)
+
+	batch := bus.Begin(db.Begin())
+	batch.Publish(context.Background(), &Event{Type: "order"})
+	batch.Commit()
+	bus.Wait()
+
+	assert.Equal(t, []string{"order"}, all.types())
+}
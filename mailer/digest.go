@@ -0,0 +1,197 @@
+package mailer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// digestPollInterval is how often it's checked if the digest is due
+const digestPollInterval = 10 * time.Minute
+
+const defaultDigestTemplate = `{{ template "header" . }}
+<h2>Orders on {{ dateFormat "Monday, January 2, 2006" .Digest.From }}</h2>
+
+<table style="width: 100%; border-collapse: collapse;">
+<tr><td>Orders placed</td><td style="text-align: right;">{{ .Digest.Orders }}</td></tr>
+<tr><td>Payments</td><td style="text-align: right;">{{ .Digest.Payments }}</td></tr>
+<tr><td>Revenue</td><td style="text-align: right;">{{ range .Digest.Revenue }}{{ price .Amount .Currency }}<br>{{ else }}-{{ end }}</td></tr>
+<tr><td>Refunds</td><td style="text-align: right;">{{ range .Digest.Refunds }}{{ price .Amount .Currency }}<br>{{ else }}-{{ end }}</td></tr>
+<tr><td>Failed payments</td><td style="text-align: right;">{{ .Digest.FailedPayments }}</td></tr>
+</table>
+{{ template "footer" . }}
+`
+
+// CurrencyAmount is an amount in the lowest unit of its currency
+type CurrencyAmount struct {
+	Currency string
+	Amount   uint64
+}
+
+// Digest sums up the orders and payments between From and To. Test orders
+// are left out.
+type Digest struct {
+	From time.Time
+	To   time.Time
+
+	Orders         int
+	Payments       int
+	FailedPayments int
+	// Revenue and Refunds are the paid charges and refunds per currency
+	Revenue []CurrencyAmount
+	Refunds []CurrencyAmount
+}
+
+// NewDigest sums up the orders and payments between from and to. In
+// multi-instance mode db is scoped to the instance of the digest.
+func NewDigest(db *gorm.DB, from, to time.Time) (*Digest, error) {
+	digest := &Digest{From: from, To: to}
+	orders := models.Order{}.TableName()
+	rsp := db.Model(&models.Order{}).
+		Where("created_at >= ? AND created_at < ? AND test_mode = ?", from, to, false).
+		Count(&digest.Orders)
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	transactions := models.Transaction{}.TableName()
+	found := []*models.Transaction{}
+	rsp = db.Select(transactions+".*").
+		Joins("JOIN "+orders+" ON "+orders+".id = "+transactions+".order_id").
+		Where(transactions+".created_at >= ? AND "+transactions+".created_at < ? AND "+orders+".test_mode = ?", from, to, false).
+		Find(&found)
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	revenue, refunds := map[string]uint64{}, map[string]uint64{}
+	for _, t := range found {
+		switch {
+		case t.Type == models.ChargeTransactionType && t.Status == models.PaidState:
+			digest.Payments++
+			revenue[t.Currency] += t.Amount
+		case t.Type == models.ChargeTransactionType && t.Status == models.FailedState:
+			digest.FailedPayments++
+		case t.Type == models.RefundTransactionType && t.Status == models.PaidState:
+			refunds[t.Currency] += t.Amount
+		}
+	}
+	digest.Revenue = currencyAmounts(revenue)
+	digest.Refunds = currencyAmounts(refunds)
+	return digest, nil
+}
+
+func currencyAmounts(amounts map[string]uint64) []CurrencyAmount {
+	list := []CurrencyAmount{}
+	for currency, amount := range amounts {
+		list = append(list, CurrencyAmount{Currency: currency, Amount: amount})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Currency < list[j].Currency })
+	return list
+}
+
+// DigestMail sends a digest to the shop admin
+func (m *Mailer) DigestMail(digest *Digest) error {
+	return m.Mail(m.config().Mailer.AdminEmail,
+		Template{
+			Name:    OrderDigest,
+			Subject: withDefault(m.config().Mailer.Subjects.OrderDigest, `{{ .Digest.Orders }} orders on {{ dateFormat "January 2" .Digest.From }}`),
+			URL:     m.config().Mailer.Templates.OrderDigest,
+			Default: defaultDigestTemplate,
+		},
+		map[string]interface{}{
+			"Digest": digest,
+		})
+}
+
+// SendDigest sends the digest of the day before now once it's past the
+// configured hour, unless it was sent already. db is scoped to the store of
+// the mailer. The day is claimed before sending, so two processes don't both
+// send it, and given up again when sending fails. It tells if it sent the
+// digest.
+func (m *Mailer) SendDigest(db *gorm.DB, log *logrus.Entry, now time.Time) bool {
+	config := m.config().Mailer.Digest
+	if !config.Enabled {
+		return false
+	}
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		log.WithError(err).Error("Invalid timezone for the order digest")
+		return false
+	}
+	now = now.In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	if now.Before(today.Add(time.Duration(config.Hour) * time.Hour)) {
+		return false
+	}
+	yesterday := today.AddDate(0, 0, -1)
+	log = log.WithField("day", yesterday.Format("2006-01-02"))
+
+	day := yesterday.Format("2006-01-02")
+	claimed, err := models.ClaimMailDigest(db, m.InstanceID, day)
+	if err != nil {
+		log.WithError(err).Error("Error claiming the order digest")
+		return false
+	}
+	if !claimed {
+		return false
+	}
+
+	digest, err := NewDigest(db, yesterday, today)
+	if err == nil {
+		err = m.DigestMail(digest)
+	}
+	if err != nil {
+		log.WithError(err).Error("Error sending the order digest, it's tried again later")
+		if err := models.ReleaseMailDigest(db, m.InstanceID, day); err != nil {
+			log.WithError(err).Error("Error giving up the claim on the order digest, it won't be sent")
+		}
+		return false
+	}
+	return true
+}
+
+// RunDigest sends the daily digest of every store that enabled it in the
+// background until it's stopped. Without multi-instance mode it does nothing
+// unless the digest is enabled.
+func RunDigest(config *conf.Configuration, stores Stores, log *logrus.Entry) (stop func()) {
+	if !config.Mailer.Digest.Enabled && !config.MultiInstance.Enabled {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(digestPollInterval)
+		defer ticker.Stop()
+		for {
+			list, err := stores()
+			if err != nil {
+				log.WithError(err).Error("Error listing the stores for the order digest")
+			}
+			for _, store := range list {
+				log := store.log(log)
+				if store.Mailer.SendDigest(store.DB, log, time.Now()) {
+					log.Info("Sent the order digest")
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,90 @@
+package mailer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// templateFuncs are the helpers available in mail templates
+var templateFuncs = map[string]interface{}{
+	"dateFormat":     dateFormat,
+	"price":          price,
+	"currencySymbol": currencySymbol,
+	"lineTotal":      lineTotal,
+	"hasProductType": hasProductType,
+	"upper":          strings.ToUpper,
+}
+
+// currencySymbols are written before the amount, except for the ones in
+// symbolAfterAmount
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"CAD": "CA$",
+	"AUD": "A$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"INR": "₹",
+	"KRW": "₩",
+}
+
+var symbolAfterAmount = map[string]bool{
+	"EUR": true,
+}
+
+func dateFormat(layout string, date time.Time) string {
+	return date.Format(layout)
+}
+
+// price formats an amount in the lowest unit of the currency
+func price(amount uint64, currency string) string {
+	currency = strings.ToUpper(currency)
+	value := amountValue(amount, currency)
+
+	symbol, ok := currencySymbols[currency]
+	switch {
+	case !ok:
+		return value + " " + currency
+	case symbolAfterAmount[currency]:
+		return value + symbol
+	default:
+		return symbol + value
+	}
+}
+
+// amountValue formats an amount in the lowest unit of the currency without
+// the currency
+func amountValue(amount uint64, currency string) string {
+	switch models.CurrencyDecimals(currency) {
+	case 0:
+		return fmt.Sprintf("%d", amount)
+	case 3:
+		return fmt.Sprintf("%d.%03d", amount/1000, amount%1000)
+	}
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
+
+func currencySymbol(currency string) string {
+	currency = strings.ToUpper(currency)
+	if symbol, ok := currencySymbols[currency]; ok {
+		return symbol
+	}
+	return currency
+}
+
+// lineTotal is the price of all the items of a line, with addons
+func lineTotal(item *models.LineItem) uint64 {
+	return item.PriceInLowestUnit() * item.Quantity
+}
+
+func hasProductType(order *models.Order, productType string) bool {
+	for _, item := range order.LineItems {
+		if item.Type == productType {
+			return true
+		}
+	}
+	return false
+}
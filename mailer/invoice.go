@@ -0,0 +1,250 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// A4 in PDF points
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfMargin     = 50
+)
+
+// InvoicePDF renders the invoice of an order as a PDF
+func (m *Mailer) InvoicePDF(order *models.Order) []byte {
+	doc := newPDFDocument()
+
+	doc.row(20, pdfText{x: pdfMargin, bold: true, text: "Invoice"})
+	if issuer := strings.TrimSpace(m.config().Mailer.Invoice.Issuer); issuer != "" {
+		for _, line := range strings.Split(issuer, "\n") {
+			doc.row(10, pdfText{x: pdfMargin, text: strings.TrimSpace(line)})
+		}
+	}
+	doc.space(10)
+
+	ref := order.Ref
+	if ref == "" {
+		ref = order.ID
+	}
+	if order.InvoiceNumber != "" {
+		doc.row(10, pdfText{x: pdfMargin, text: "Invoice number"}, pdfText{x: 150, text: order.InvoiceNumber})
+	}
+	doc.row(10, pdfText{x: pdfMargin, text: "Order"}, pdfText{x: 150, text: ref})
+	doc.row(10, pdfText{x: pdfMargin, text: "Date"}, pdfText{x: 150, text: order.CreatedAt.Format("January 2, 2006")})
+	if order.VATNumber != "" {
+		doc.row(10, pdfText{x: pdfMargin, text: "VAT number"}, pdfText{x: 150, text: order.VATNumber})
+	}
+	doc.space(10)
+
+	doc.row(10, pdfText{x: pdfMargin, bold: true, text: "Billed to"})
+	for _, line := range addressLines(order.BillingAddress) {
+		doc.row(10, pdfText{x: pdfMargin, text: line})
+	}
+	doc.row(10, pdfText{x: pdfMargin, text: order.Email})
+	doc.space(10)
+
+	doc.row(10,
+		pdfText{x: pdfMargin, bold: true, text: "Item"},
+		pdfText{x: 320, bold: true, text: "Quantity"},
+		pdfText{x: 390, bold: true, text: "Price"},
+		pdfText{x: 470, bold: true, text: "Total"},
+	)
+	for _, item := range order.LineItems {
+		doc.row(10,
+			pdfText{x: pdfMargin, text: truncate(item.Title, 48)},
+			pdfText{x: 320, text: fmt.Sprintf("%d", item.Quantity)},
+			pdfText{x: 390, text: invoicePrice(item.PriceInLowestUnit(), order.Currency)},
+			pdfText{x: 470, text: invoicePrice(lineTotal(item), order.Currency)},
+		)
+	}
+	doc.space(10)
+
+	total := func(label string, amount string, bold bool) {
+		doc.row(10, pdfText{x: 390, bold: bold, text: label}, pdfText{x: 470, bold: bold, text: amount})
+	}
+	total("Subtotal", invoicePrice(order.SubTotal, order.Currency), false)
+	if order.Discount > 0 {
+		total("Discount", "-"+invoicePrice(order.Discount, order.Currency), false)
+	}
+	if order.Shipping > 0 {
+		total("Shipping", invoicePrice(order.Shipping, order.Currency), false)
+	}
+	total("Taxes", invoicePrice(order.Taxes, order.Currency), false)
+	total("Total", invoicePrice(order.Total, order.Currency), true)
+
+	return doc.bytes()
+}
+
+// invoiceAttachment is the invoice of an order as an attachment
+func (m *Mailer) invoiceAttachment(order *models.Order) *Attachment {
+	ref := order.Ref
+	if ref == "" {
+		ref = order.ID
+	}
+	return &Attachment{
+		Filename:    "invoice-" + ref + ".pdf",
+		ContentType: "application/pdf",
+		Data:        m.InvoicePDF(order),
+	}
+}
+
+// invoicePrice is the price, with the currency code instead of symbols the
+// fonts of the PDF don't have
+func invoicePrice(amount uint64, currency string) string {
+	formatted := price(amount, currency)
+	if pdfEncodable(formatted) {
+		return formatted
+	}
+	return amountValue(amount, currency) + " " + strings.ToUpper(currency)
+}
+
+func addressLines(address models.Address) []string {
+	lines := []string{}
+	add := func(parts ...string) {
+		line := strings.TrimSpace(strings.Join(parts, " "))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	add(address.FirstName, address.LastName)
+	add(address.Company)
+	add(address.Address1)
+	add(address.Address2)
+	add(address.Zip, address.City, address.State)
+	add(address.Country)
+	return lines
+}
+
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	return string(runes[:length-3]) + "..."
+}
+
+// pdfText is a piece of text on a row of a PDF
+type pdfText struct {
+	x    float64
+	bold bool
+	text string
+}
+
+// pdfDocument writes rows of text in Helvetica on A4 pages, which is all an
+// invoice needs
+type pdfDocument struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+func newPDFDocument() *pdfDocument {
+	doc := &pdfDocument{}
+	doc.newPage()
+	return doc
+}
+
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pdfPageHeight - pdfMargin
+}
+
+// row writes texts of the font size on the next row, on a new page if the
+// current one is full
+func (d *pdfDocument) row(size float64, texts ...pdfText) {
+	if d.y-size < pdfMargin {
+		d.newPage()
+	}
+	d.y -= size
+	page := d.pages[len(d.pages)-1]
+	for _, t := range texts {
+		font := "F1"
+		if t.bold {
+			font = "F2"
+		}
+		fmt.Fprintf(page, "BT /%s %g Tf %g %g Td (%s) Tj ET\n", font, size, t.x, d.y, pdfEscape(t.text))
+	}
+	d.y -= size / 2
+}
+
+func (d *pdfDocument) space(height float64) {
+	d.y -= height
+}
+
+func (d *pdfDocument) bytes() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+	kids := []string{}
+	for _, page := range d.pages {
+		pageID := len(objects) + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+				pdfPageWidth, pdfPageHeight, pageID+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()),
+		)
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages))
+
+	out := &bytes.Buffer{}
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEncodable tells if the standard fonts can show all of s
+func pdfEncodable(s string) bool {
+	for _, r := range s {
+		if _, ok := winAnsi(r); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// winAnsi is the byte of a rune in the encoding of the standard fonts,
+// which matches Latin-1 except for the euro sign
+func winAnsi(r rune) (byte, bool) {
+	switch {
+	case r == '€':
+		return 0x80, true
+	case r >= 0x20 && r < 0x7f, r >= 0xa0 && r <= 0xff:
+		return byte(r), true
+	}
+	return 0, false
+}
+
+// pdfEscape encodes s as the contents of a PDF string, with a ? for the
+// characters the fonts don't have
+func pdfEscape(s string) string {
+	out := []byte{}
+	for _, r := range s {
+		b, ok := winAnsi(r)
+		if !ok {
+			b = '?'
+		}
+		if b == '(' || b == ')' || b == '\\' {
+			out = append(out, '\\')
+		}
+		out = append(out, b)
+	}
+	return string(out)
+}
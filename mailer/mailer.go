@@ -1,19 +1,56 @@
 package mailer
 
 import (
-	"fmt"
 	"log"
-	"time"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
 
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
-	"github.com/netlify/mailme"
 )
 
 // Mailer will send mail and use templates from the site for easy mail styling
 type Mailer struct {
-	Config         *conf.Configuration
-	TemplateMailer *mailme.Mailer
+	// current is the configuration, it's replaced by Reload
+	current    *conf.Configuration
+	configLock sync.RWMutex
+
+	// Sender delivers the mails through the configured provider
+	Sender Sender
+	// Queue records the mails before they're sent, so the ones that fail
+	// because of a temporary problem can be retried by RunQueue. Without a
+	// queue mails are only tried once.
+	Queue *gorm.DB
+	// Suppressions holds the addresses mails aren't sent to anymore. Without
+	// it mails go to every address.
+	Suppressions *gorm.DB
+	// InstanceID is the instance the mails are sent for in multi-instance
+	// mode
+	InstanceID string
+
+	templates *templateEngine
+}
+
+// Store is a shop the background mails, like the digest and the cart
+// reminders, are sent for, with its database scoped to it
+type Store struct {
+	Mailer *Mailer
+	DB     *gorm.DB
+}
+
+// Stores lists the stores to send the background mails for: the deployment,
+// or every instance in multi-instance mode
+type Stores func() ([]Store, error)
+
+// log adds the instance of the store to log
+func (s Store) log(log *logrus.Entry) *logrus.Entry {
+	if s.Mailer.InstanceID == "" {
+		return log
+	}
+	return log.WithField("instance_id", s.Mailer.InstanceID)
 }
 
 // MailSubjects holds the subject lines for the emails
@@ -23,98 +60,387 @@ type MailSubjects struct {
 
 // NewMailer returns a new authlify mailer
 func NewMailer(conf *conf.Configuration) *Mailer {
-	mailConf := conf.Mailer
 	return &Mailer{
-		Config: conf,
-		TemplateMailer: &mailme.Mailer{
-			BaseURL: conf.SiteURL,
-			From:    conf.Mailer.AdminEmail,
-			Host:    mailConf.Host,
-			Port:    mailConf.Port,
-			User:    mailConf.User,
-			Pass:    mailConf.Pass,
-			FuncMap: map[string]interface{}{
-				"dateFormat":     dateFormat,
-				"price":          price,
-				"hasProductType": hasProductType,
-			},
-		},
+		current:   conf,
+		Sender:    NewSender(conf, conf.HTTPClient(conf.Timeouts.Mail)),
+		templates: newTemplateEngine(conf.SiteURL, conf.Mailer.Templates.Dir, conf.Mailer.Templates.TTL, conf.HTTPClient(conf.Timeouts.Site), templateFuncs),
 	}
 }
 
-func dateFormat(layout string, date time.Time) string {
-	return date.Format(layout)
+// Reload replaces the configuration with a reloaded one. The templates from
+// the site are loaded again with the next mail.
+func (m *Mailer) Reload(config *conf.Configuration) {
+	m.configLock.Lock()
+	m.current = config
+	m.configLock.Unlock()
+	m.templates.reset(config.Mailer.Templates.Dir, config.Mailer.Templates.TTL)
 }
 
-func price(amount uint64, currency string) string {
-	switch currency {
-	case "USD":
-		return fmt.Sprintf("$%.2f", float64(amount)/100)
-	case "EUR":
-		return fmt.Sprintf("%.2f€", float64(amount)/100)
-	default:
-		return fmt.Sprintf("%.2f %v", float64(amount)/100, currency)
+func (m *Mailer) config() *conf.Configuration {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+	return m.current
+}
+
+// Template describes where the templates of a mail come from
+type Template struct {
+	// Name of the mail, a file called <name>.html in the template directory
+	// replaces the template
+	Name    string
+	Subject string
+	// URL of the template on the site
+	URL     string
+	Default string
+}
+
+// Mail renders a mail from its templates and sends it. Besides the data, the
+// templates can use the .SiteURL.
+func (m *Mailer) Mail(to string, tmpl Template, data map[string]interface{}) error {
+	msg, err := m.Render(to, tmpl, data)
+	if err != nil {
+		return err
 	}
+	return m.send(msg)
 }
 
-func hasProductType(order *models.Order, productType string) bool {
-	for _, item := range order.LineItems {
-		if item.Type == productType {
-			return true
-		}
+// Render renders a mail without sending it
+func (m *Mailer) Render(to string, tmpl Template, data map[string]interface{}) (*Message, error) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	if _, ok := data["SiteURL"]; !ok {
+		data["SiteURL"] = m.config().SiteURL
+	}
+
+	subject, err := m.templates.subject(tmpl.Subject, data)
+	if err != nil {
+		return nil, err
+	}
+	body, err := m.templates.body(tmpl.Name, tmpl.URL, tmpl.Default, data)
+	if err != nil {
+		return nil, err
+	}
+	text, err := m.templates.text(tmpl.Name, body, data)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		Type:    tmpl.Name,
+		From:    m.config().Mailer.AdminEmail,
+		To:      to,
+		Bcc:     m.bcc(tmpl.Name),
+		Subject: subject,
+		HTML:    body,
+		Text:    text,
+	}
+	if order, ok := data["Order"].(*models.Order); ok {
+		msg.OrderID = order.ID
+	}
+	return msg, nil
+}
+
+// bcc are the addresses that get copies of the mail called name
+func (m *Mailer) bcc(name string) []string {
+	bcc := m.config().Mailer.Bcc
+	switch name {
+	case OrderConfirmation:
+		return bcc.OrderConfirmation
+	case OrderReceived:
+		return bcc.OrderReceived
+	case ShippingConfirmation:
+		return bcc.ShippingConfirmation
+	case RefundConfirmation:
+		return bcc.RefundConfirmation
+	case CartReminder:
+		return bcc.CartReminder
 	}
-	return false
+	return nil
 }
 
-const defaultConfirmationTemplate = `<h2>Thank you for your order!</h2>
+// The names of the mails about an order
+const (
+	OrderConfirmation    = "order_confirmation"
+	OrderReceived        = "order_received"
+	ShippingConfirmation = "shipping_confirmation"
+	RefundConfirmation   = "refund_confirmation"
+	CartReminder         = "cart_reminder"
+	// OrderDigest sums up the orders of a day, it's not about a single order
+	OrderDigest = "order_digest"
+)
+
+// orderMails build the recipient, template and data of the mails about an
+// order, by name
+var orderMails = map[string]func(m *Mailer, transaction *models.Transaction) (string, Template, map[string]interface{}){
+	OrderConfirmation: (*Mailer).orderConfirmation,
+	OrderReceived:     (*Mailer).orderReceived,
+	ShippingConfirmation: func(m *Mailer, transaction *models.Transaction) (string, Template, map[string]interface{}) {
+		return m.shippingConfirmation(transaction.Order)
+	},
+	RefundConfirmation: func(m *Mailer, transaction *models.Transaction) (string, Template, map[string]interface{}) {
+		return m.refundConfirmation(previewRefund(transaction))
+	},
+	CartReminder: func(m *Mailer, transaction *models.Transaction) (string, Template, map[string]interface{}) {
+		return m.cartReminder(transaction.Order)
+	},
+}
 
-<ul>
-{{ range .Order.LineItems }}
-<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong></li>
+// OrderMails lists the names of the mails about an order
+func OrderMails() []string {
+	names := []string{}
+	for name := range orderMails {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PreviewOrderMail renders one of the OrderMails for a transaction, without
+// sending it. It returns nil for unknown mails.
+func (m *Mailer) PreviewOrderMail(name string, transaction *models.Transaction) (*Message, error) {
+	mail, ok := orderMails[name]
+	if !ok {
+		return nil, nil
+	}
+	msg, err := m.Render(mail(m, transaction))
+	if err != nil {
+		return nil, err
+	}
+	if name == OrderConfirmation {
+		m.attachInvoice(msg, transaction.Order)
+	}
+	return msg, nil
+}
+
+// SendOrderMail sends one of the OrderMails for a transaction, like
+// PreviewOrderMail renders it. It returns nil for unknown mails.
+func (m *Mailer) SendOrderMail(name string, transaction *models.Transaction) (*Message, error) {
+	msg, err := m.PreviewOrderMail(name, transaction)
+	if err != nil || msg == nil {
+		return msg, err
+	}
+	return msg, m.send(msg)
+}
+
+const defaultConfirmationTemplate = `{{ template "header" . }}
+<h2>Thank you for your order!</h2>
+{{ with .Order.Ref }}
+<p>Your order reference is <strong>{{ . }}</strong></p>
 {{ end }}
-</ul>
 
-<p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+{{ template "line_items" .Order }}
+{{ template "totals" .Order }}
+
+{{ template "address" .Order.ShippingAddress }}
+{{ template "footer" . }}
 `
 
 // OrderConfirmationMail sends an order confirmation to the user
 func (m *Mailer) OrderConfirmationMail(transaction *models.Transaction) error {
-	log.Printf("Sending order confirmation to %v with template %v", transaction.Order.Email, m.Config.Mailer.Templates.OrderConfirmation)
-	return m.TemplateMailer.Mail(
-		transaction.Order.Email,
-		withDefault(m.Config.Mailer.Subjects.OrderConfirmation, "Order Confirmation"),
-		m.Config.Mailer.Templates.OrderConfirmation,
-		defaultConfirmationTemplate,
+	log.Printf("Sending order confirmation to %v with template %v", transaction.Order.Email, m.config().Mailer.Templates.OrderConfirmation)
+	msg, err := m.Render(m.orderConfirmation(transaction))
+	if err != nil {
+		return err
+	}
+	m.attachInvoice(msg, transaction.Order)
+	return m.send(msg)
+}
+
+// attachInvoice attaches the invoice to the order confirmation, when
+// configured
+func (m *Mailer) attachInvoice(msg *Message, order *models.Order) {
+	if m.config().Mailer.Invoice.Attach {
+		msg.Attachments = append(msg.Attachments, m.invoiceAttachment(order))
+	}
+}
+
+func (m *Mailer) orderConfirmation(transaction *models.Transaction) (string, Template, map[string]interface{}) {
+	return transaction.Order.Email,
+		Template{
+			Name:    OrderConfirmation,
+			Subject: withDefault(m.config().Mailer.Subjects.OrderConfirmation, "Order Confirmation"),
+			URL:     m.config().Mailer.Templates.OrderConfirmation,
+			Default: defaultConfirmationTemplate,
+		},
 		map[string]interface{}{
 			"Order":       transaction.Order,
 			"Transaction": transaction,
-		},
-	)
+		}
 }
 
-const defaultReceivedTemplate = `<h2>Order Received From {{ .Order.Email }}</h2>
-
-<ul>
-{{ range .Order.LineItems }}
-<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong></li>
+const defaultReceivedTemplate = `{{ template "header" . }}
+<h2>Order Received From {{ .Order.Email }}</h2>
+{{ with .Order.Ref }}
+<p>Order reference: <strong>{{ . }}</strong></p>
 {{ end }}
-</ul>
 
-<p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+{{ template "line_items" .Order }}
+{{ template "totals" .Order }}
+
+<h3>Shipping address</h3>
+{{ template "address" .Order.ShippingAddress }}
+{{ template "footer" . }}
 `
 
-// OrderReceivedMail sends a notification to the shop admin
+// OrderReceivedMail sends a notification to the shop admin, unless the
+// order digest takes its place
 func (m *Mailer) OrderReceivedMail(transaction *models.Transaction) error {
-	return m.TemplateMailer.Mail(
-		m.Config.Mailer.AdminEmail,
-		withDefault(m.Config.Mailer.Subjects.OrderReceived, "Order Received From {{ .Order.Email }}"),
-		m.Config.Mailer.Templates.OrderReceived,
-		defaultReceivedTemplate,
+	if digest := m.config().Mailer.Digest; digest.Enabled && digest.SkipOrderReceived {
+		return nil
+	}
+	return m.Mail(m.orderReceived(transaction))
+}
+
+func (m *Mailer) orderReceived(transaction *models.Transaction) (string, Template, map[string]interface{}) {
+	return m.config().Mailer.AdminEmail,
+		Template{
+			Name:    OrderReceived,
+			Subject: withDefault(m.config().Mailer.Subjects.OrderReceived, "Order Received From {{ .Order.Email }}"),
+			URL:     m.config().Mailer.Templates.OrderReceived,
+			Default: defaultReceivedTemplate,
+		},
 		map[string]interface{}{
 			"Order":       transaction.Order,
 			"Transaction": transaction,
+		}
+}
+
+const defaultShippingTemplate = `{{ template "header" . }}
+<h2>Your order is on its way!</h2>
+{{ with .Order.Ref }}
+<p>Order reference: <strong>{{ . }}</strong></p>
+{{ end }}
+
+{{ if .Order.TrackingNumber }}
+<p>Shipped{{ with .Order.Carrier }} with {{ . }}{{ end }}, tracking number
+{{ if .Order.TrackingURL }}<a href="{{ .Order.TrackingURL }}">{{ .Order.TrackingNumber }}</a>{{ else }}<strong>{{ .Order.TrackingNumber }}</strong>{{ end }}</p>
+{{ else if .Order.TrackingURL }}
+<p><a href="{{ .Order.TrackingURL }}">Track your package</a></p>
+{{ end }}
+
+{{ template "line_items" .Order }}
+
+<h3>Shipping to</h3>
+{{ template "address" .Order.ShippingAddress }}
+{{ template "footer" . }}
+`
+
+// ShippingConfirmationMail tells the customer their order shipped, with the
+// tracking link if there is one
+func (m *Mailer) ShippingConfirmationMail(order *models.Order) error {
+	log.Printf("Sending shipping confirmation to %v with template %v", order.Email, m.config().Mailer.Templates.ShippingConfirmation)
+	return m.Mail(m.shippingConfirmation(order))
+}
+
+func (m *Mailer) shippingConfirmation(order *models.Order) (string, Template, map[string]interface{}) {
+	return order.Email,
+		Template{
+			Name:    ShippingConfirmation,
+			Subject: withDefault(m.config().Mailer.Subjects.ShippingConfirmation, "Your order has shipped"),
+			URL:     m.config().Mailer.Templates.ShippingConfirmation,
+			Default: defaultShippingTemplate,
 		},
-	)
+		map[string]interface{}{
+			"Order": order,
+		}
+}
+
+// defaultRefundSettlement is how long refunds take to reach the customer's
+// account, unless the config says otherwise
+const defaultRefundSettlement = "5 to 10 business days"
+
+const defaultRefundTemplate = `{{ template "header" . }}
+<h2>We refunded {{ price .Refund.Amount .Refund.Currency }}</h2>
+{{ with .Order.Ref }}
+<p>Order reference: <strong>{{ . }}</strong></p>
+{{ end }}
+
+<p>The refund of <strong>{{ price .Refund.Amount .Refund.Currency }}</strong> should reach your account
+within {{ .Settlement }}.</p>
+{{ if .Remaining }}
+<p>The remaining balance of the order is <strong>{{ price .Remaining .Refund.Currency }}</strong>.</p>
+{{ else }}
+<p>Your order has been refunded in full.</p>
+{{ end }}
+
+{{ template "line_items" .Order }}
+{{ template "footer" . }}
+`
+
+// RefundConfirmationMail tells the customer about a refund, the balance that
+// remains of the order and when the money should arrive. The refund must
+// have its order with the transactions.
+func (m *Mailer) RefundConfirmationMail(refund *models.Transaction) error {
+	log.Printf("Sending refund confirmation to %v with template %v", refund.Order.Email, m.config().Mailer.Templates.RefundConfirmation)
+	return m.Mail(m.refundConfirmation(refund))
+}
+
+func (m *Mailer) refundConfirmation(refund *models.Transaction) (string, Template, map[string]interface{}) {
+	return refund.Order.Email,
+		Template{
+			Name:    RefundConfirmation,
+			Subject: withDefault(m.config().Mailer.Subjects.RefundConfirmation, "Your refund of {{ price .Refund.Amount .Refund.Currency }}"),
+			URL:     m.config().Mailer.Templates.RefundConfirmation,
+			Default: defaultRefundTemplate,
+		},
+		map[string]interface{}{
+			"Order":      refund.Order,
+			"Refund":     refund,
+			"Refunded":   refunded(refund.Order),
+			"Remaining":  remainingBalance(refund.Order),
+			"Settlement": withDefault(m.config().Mailer.RefundSettlement, defaultRefundSettlement),
+		}
+}
+
+// refunded sums up the refunds that went through
+func refunded(order *models.Order) uint64 {
+	var total uint64
+	for _, t := range order.Transactions {
+		if t.Type == models.RefundTransactionType && t.Status == models.PaidState {
+			total += t.Amount
+		}
+	}
+	return total
+}
+
+// remainingBalance is what was charged for the order and wasn't refunded
+func remainingBalance(order *models.Order) uint64 {
+	var charged uint64
+	for _, t := range order.Transactions {
+		if t.Type == models.ChargeTransactionType && t.Status == models.PaidState {
+			charged += t.Amount
+		}
+	}
+	if refunded := refunded(order); refunded < charged {
+		return charged - refunded
+	}
+	return 0
+}
+
+// previewRefund picks the last refund of the order of a transaction to
+// preview the refund mail with, or makes up a refund of half the charge
+func previewRefund(transaction *models.Transaction) *models.Transaction {
+	if transaction.Type == models.RefundTransactionType {
+		return transaction
+	}
+	order := transaction.Order
+	for i := len(order.Transactions) - 1; i >= 0; i-- {
+		if t := order.Transactions[i]; t.Type == models.RefundTransactionType && t.Status == models.PaidState {
+			t.Order = order
+			return t
+		}
+	}
+
+	preview := *order
+	refund := &models.Transaction{
+		Order:    &preview,
+		OrderID:  order.ID,
+		Amount:   transaction.Amount / 2,
+		Currency: transaction.Currency,
+		Type:     models.RefundTransactionType,
+		Status:   models.PaidState,
+	}
+	preview.Transactions = append(append([]*models.Transaction{}, order.Transactions...), refund)
+	return refund
 }
 
 func withDefault(value string, defaultValue string) string {
@@ -0,0 +1,196 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultMailgunURL = "https://api.mailgun.net/v3"
+
+// mailgunSender sends mails with the Mailgun messages API
+type mailgunSender struct {
+	client     *http.Client
+	domain     string
+	apiKey     string
+	apiURL     string
+	signingKey string
+}
+
+func (s *mailgunSender) Send(msg *Message) (string, error) {
+	form := url.Values{}
+	form.Set("from", msg.From)
+	form.Set("to", msg.To)
+	for _, bcc := range msg.Bcc {
+		form.Add("bcc", bcc)
+	}
+	form.Set("subject", msg.Subject)
+	form.Set("html", msg.HTML)
+	if msg.Text != "" {
+		form.Set("text", msg.Text)
+	}
+
+	body, contentType, err := mailgunBody(form, msg.Attachments)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", s.apiURL+"/"+s.domain+"/messages", body)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth("api", s.apiKey)
+	req.Header.Set("Content-Type", contentType)
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+
+	// both successes and errors look like {"id": "<...>", "message": "..."}
+	result := struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}{}
+	raw, _ := ioutil.ReadAll(rsp.Body)
+	if err := json.Unmarshal(raw, &result); err != nil {
+		result.Message = string(raw)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", &ProviderError{
+			Provider:   "mailgun",
+			StatusCode: rsp.StatusCode,
+			Message:    result.Message,
+			Temporary:  temporaryStatus(rsp.StatusCode),
+		}
+	}
+	// the events leave out the angle brackets around the message ID
+	return strings.Trim(result.ID, "<>"), nil
+}
+
+// mailgunBody encodes the form of a message, as multipart/form-data when
+// there are files to attach
+func mailgunBody(form url.Values, attachments []*Attachment) (io.Reader, string, error) {
+	if len(attachments) == 0 {
+		return strings.NewReader(form.Encode()), "application/x-www-form-urlencoded", nil
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, values := range form {
+		for _, value := range values {
+			if err := writer.WriteField(key, value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	for _, attachment := range attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="attachment"; filename=%q`, attachment.Filename))
+		header.Set("Content-Type", attachment.ContentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(attachment.Data); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, writer.FormDataContentType(), nil
+}
+
+type mailgunWebhook struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event     string  `json:"event"`
+		Severity  string  `json:"severity"`
+		Recipient string  `json:"recipient"`
+		Timestamp float64 `json:"timestamp"`
+		Reason    string  `json:"reason"`
+		Status    struct {
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+		Message struct {
+			Headers struct {
+				MessageID string `json:"message-id"`
+			} `json:"headers"`
+		} `json:"message"`
+	} `json:"event-data"`
+}
+
+// Bounces verifies the signature of the webhook with the webhook signing key
+// and turns failed deliveries, complaints and unsubscribes into bounces. The
+// token of the signature is the ID of the delivery.
+func (s *mailgunSender) Bounces(r *http.Request) (*BounceWebhook, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	hook := &mailgunWebhook{}
+	if err := json.Unmarshal(body, hook); err != nil {
+		return nil, err
+	}
+	if !s.verify(hook.Signature.Timestamp, hook.Signature.Token, hook.Signature.Signature) {
+		return nil, ErrUnverifiedWebhook
+	}
+	if !recentlySigned(hook.Signature.Timestamp, time.Now()) {
+		return nil, ErrUnverifiedWebhook
+	}
+	webhook := &BounceWebhook{ID: "mailgun:" + hook.Signature.Token, Bounces: []*Bounce{}}
+
+	e := hook.EventData
+	seconds, fraction := math.Modf(e.Timestamp)
+	bounce := &Bounce{
+		Email:     e.Recipient,
+		Reason:    withDefault(e.Status.Description, withDefault(e.Status.Message, e.Reason)),
+		MessageID: e.Message.Headers.MessageID,
+		At:        time.Unix(int64(seconds), int64(fraction*1e9)),
+	}
+	switch {
+	case e.Event == "failed" && e.Severity == "permanent":
+		bounce.Type = HardBounce
+	case e.Event == "failed":
+		bounce.Type = SoftBounce
+	case e.Event == "complained":
+		bounce.Type = Complaint
+	case e.Event == "unsubscribed":
+		bounce.Type = Unsubscribe
+	default:
+		return webhook, nil
+	}
+	webhook.Bounces = append(webhook.Bounces, bounce)
+	return webhook, nil
+}
+
+func (s *mailgunSender) verify(timestamp, token, signature string) bool {
+	if s.signingKey == "" || signature == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.signingKey))
+	mac.Write([]byte(timestamp + token))
+	return hmac.Equal(mac.Sum(nil), expected)
+}
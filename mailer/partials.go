@@ -0,0 +1,35 @@
+package mailer
+
+// defaultPartials can be used by every mail template, like
+// {{ template "line_items" .Order }}. A site replaces one by defining a
+// template with the same name.
+const defaultPartials = `
+{{ define "header" }}<div style="font-family: sans-serif; max-width: 600px; margin: 0 auto;">{{ end }}
+
+{{ define "footer" }}{{ with .SiteURL }}<p style="color: #888; font-size: 12px;"><a href="{{ . }}">{{ . }}</a></p>{{ end }}</div>{{ end }}
+
+{{ define "line_items" }}<table style="width: 100%; border-collapse: collapse;">
+{{ range .LineItems }}<tr>
+<td>{{ .Title }}{{ range .AddonItems }}<br><small>+ {{ .Title }}</small>{{ end }}</td>
+<td style="text-align: right;">{{ .Quantity }} x {{ price .PriceInLowestUnit $.Currency }}</td>
+<td style="text-align: right;"><strong>{{ price (lineTotal .) $.Currency }}</strong></td>
+</tr>
+{{ end }}</table>{{ end }}
+
+{{ define "totals" }}<table style="width: 100%; border-collapse: collapse;">
+<tr><td>Subtotal</td><td style="text-align: right;">{{ price .SubTotal .Currency }}</td></tr>
+{{ if .Discount }}<tr><td>Discount{{ with .CouponCode }} ({{ . }}){{ end }}</td><td style="text-align: right;">-{{ price .Discount .Currency }}</td></tr>
+{{ end }}{{ if .Shipping }}<tr><td>Shipping</td><td style="text-align: right;">{{ price .Shipping .Currency }}</td></tr>
+{{ end }}{{ if .Taxes }}<tr><td>Taxes</td><td style="text-align: right;">{{ price .Taxes .Currency }}</td></tr>
+{{ end }}<tr><td><strong>Total</strong></td><td style="text-align: right;"><strong>{{ price .Total .Currency }}</strong></td></tr>
+</table>{{ end }}
+
+{{ define "address" }}{{ if .LastName }}<p>
+{{ .FirstName }} {{ .LastName }}<br>
+{{ with .Company }}{{ . }}<br>{{ end }}
+{{ .Address1 }}<br>
+{{ with .Address2 }}{{ . }}<br>{{ end }}
+{{ .Zip }} {{ .City }}{{ with .State }}, {{ . }}{{ end }}<br>
+{{ .Country }}
+</p>{{ end }}{{ end }}
+`
@@ -0,0 +1,245 @@
+package mailer
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// queuePollInterval is how often the queue is checked for mails to retry
+const queuePollInterval = 10 * time.Second
+
+// send delivers a message. With a queue the mail is recorded first, and if
+// the provider fails temporarily it's left in the queue to be retried by
+// RunQueue instead of failing.
+func (m *Mailer) send(msg *Message) error {
+	if m.suppressed(msg) {
+		return nil
+	}
+	if m.Queue == nil {
+		_, err := m.Sender.Send(msg)
+		return err
+	}
+
+	attachments, err := json.Marshal(msg.Attachments)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	lockedBy := "send-" + uuid.NewRandom().String()
+	mail := &models.Mail{
+		OrderID:     msg.OrderID,
+		Type:        msg.Type,
+		From:        msg.From,
+		To:          msg.To,
+		Bcc:         strings.Join(msg.Bcc, ", "),
+		Subject:     msg.Subject,
+		HTML:        msg.HTML,
+		Text:        msg.Text,
+		Attachments: string(attachments),
+		// locked, so the queue leaves it alone while it's sent
+		LockedAt: &now,
+		LockedBy: &lockedBy,
+	}
+	if err := m.Queue.Create(mail).Error; err != nil {
+		// a mail that can't be queued is still sent, just not retried
+		log.Printf("Error queueing mail to %v, sending it without retries: %v", msg.To, err)
+		_, err := m.Sender.Send(msg)
+		return err
+	}
+
+	err = m.deliver(mail, msg)
+	if err != nil && !mail.Failed {
+		log.Printf("Error sending mail %v to %v, retrying at %v: %v", mail.ID, msg.To, mail.RunAfter, err)
+		return nil
+	}
+	return err
+}
+
+// suppressed tells if the recipient of a message is on the suppression list.
+// The skipped mail is recorded as failed in the queue, so it shows up with
+// the other mails of its order.
+func (m *Mailer) suppressed(msg *Message) bool {
+	if m.Suppressions == nil {
+		return false
+	}
+	email := msg.To
+	if address, err := netmail.ParseAddress(msg.To); err == nil {
+		email = address.Address
+	}
+	suppressed, err := models.Suppressed(m.Suppressions, email)
+	if err != nil {
+		// better a mail to a bad address than no mail at all
+		log.Printf("Error checking if %v is suppressed, sending the mail: %v", email, err)
+		return false
+	}
+	if !suppressed {
+		return false
+	}
+
+	log.Printf("Not sending %v mail to %v, the address is suppressed", msg.Type, email)
+	if m.Queue != nil {
+		reason := "The address is suppressed"
+		mail := &models.Mail{
+			OrderID:      msg.OrderID,
+			Type:         msg.Type,
+			From:         msg.From,
+			To:           msg.To,
+			Subject:      msg.Subject,
+			Done:         true,
+			Failed:       true,
+			ErrorMessage: &reason,
+		}
+		if err := m.Queue.Create(mail).Error; err != nil {
+			log.Printf("Error recording the suppressed mail to %v: %v", email, err)
+		}
+	}
+	return true
+}
+
+// deliver sends a queued mail and records how it went
+func (m *Mailer) deliver(mail *models.Mail, msg *Message) error {
+	config := m.config().Mailer
+	id, err := m.Sender.Send(msg)
+	now := time.Now()
+	if err == nil {
+		if err := mail.Sent(m.Queue, id, now); err != nil {
+			log.Printf("Error recording that mail %v was sent: %v", mail.ID, err)
+		}
+		return nil
+	}
+
+	maxRetries := config.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = conf.DefaultMailMaxRetries
+	}
+	period, maxPeriod := config.RetryPeriod, config.MaxRetryPeriod
+	if period <= 0 {
+		period = conf.DefaultMailRetryPeriod
+	}
+	if maxPeriod <= 0 {
+		maxPeriod = conf.DefaultMailMaxRetryPeriod
+	}
+	if recordErr := mail.Fail(m.Queue, err, Temporary(err), now, maxRetries, period, maxPeriod); recordErr != nil {
+		log.Printf("Error recording the failure of mail %v: %v", mail.ID, recordErr)
+	}
+	return err
+}
+
+// message turns a queued mail back into the message to send
+func message(mail *models.Mail) (*Message, error) {
+	msg := &Message{
+		Type:    mail.Type,
+		OrderID: mail.OrderID,
+		From:    mail.From,
+		To:      mail.To,
+		Subject: mail.Subject,
+		HTML:    mail.HTML,
+		Text:    mail.Text,
+	}
+	if mail.Bcc != "" {
+		bcc, err := netmail.ParseAddressList(mail.Bcc)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range bcc {
+			msg.Bcc = append(msg.Bcc, address.String())
+		}
+	}
+	if mail.Attachments != "" {
+		if err := json.Unmarshal([]byte(mail.Attachments), &msg.Attachments); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// Temporary tells if sending a mail failed for a reason that can go away,
+// like an outage or a rate limit of the provider or a network error.
+// Unknown errors are taken to be temporary, so no mail is given up early.
+func Temporary(err error) bool {
+	switch e := err.(type) {
+	case *ProviderError:
+		return e.Temporary
+	case *textproto.Error:
+		// SMTP replies with 4xx for temporary and 5xx for permanent errors
+		return e.Code < 500
+	case net.Error:
+		return true
+	}
+	return true
+}
+
+// SendQueuedMails tries the queued mails that are due again, and returns
+// how many of them were sent
+func (m *Mailer) SendQueuedMails(log *logrus.Entry, lockedBy string, now time.Time) int {
+	mails, err := models.LockMails(m.Queue, lockedBy, now)
+	if err != nil {
+		log.WithError(err).Error("Error looking for queued mails")
+		return 0
+	}
+
+	sent := 0
+	for _, mail := range mails {
+		mailLog := log.WithField("mail_id", mail.ID)
+		msg, err := message(mail)
+		if err != nil {
+			mailLog.WithError(err).Error("Error reading queued mail")
+			mail.Fail(m.Queue, err, false, now, 0, 0, 0)
+			continue
+		}
+		if err := m.deliver(mail, msg); err != nil {
+			if mail.Failed {
+				mailLog.WithError(err).Errorf("Mail to %v failed %v times, giving up", mail.To, mail.Tries)
+			} else {
+				mailLog.WithError(err).Warnf("Mail to %v failed, retrying at %v", mail.To, mail.RunAfter)
+			}
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// RunQueue retries the queued mails in the background until it's stopped.
+// It does nothing without a queue.
+func (m *Mailer) RunQueue(log *logrus.Entry) (stop func()) {
+	if m.Queue == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		id := uuid.NewRandom().String()
+		ticker := time.NewTicker(queuePollInterval)
+		defer ticker.Stop()
+		for {
+			if sent := m.SendQueuedMails(log, id, time.Now()); sent > 0 {
+				log.Infof("Sent %d queued mails", sent)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,151 @@
+package mailer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/scheduler"
+)
+
+// maxCartReminders is how many reminders are sent per look for abandoned carts
+const maxCartReminders = 100
+
+const defaultCartReminderTemplate = `{{ template "header" . }}
+<h2>You left something in your cart</h2>
+
+{{ template "line_items" .Order }}
+{{ template "totals" .Order }}
+
+{{ with .SiteURL }}<p><a href="{{ . }}">Complete your order</a></p>{{ end }}
+
+<p style="color: #888; font-size: 12px;">Don't want these reminders? <a href="{{ .UnsubscribeURL }}">Unsubscribe</a></p>
+{{ template "footer" . }}
+`
+
+// CartReminderMail reminds a customer of an order they didn't pay for
+func (m *Mailer) CartReminderMail(order *models.Order) error {
+	return m.Mail(m.cartReminder(order))
+}
+
+func (m *Mailer) cartReminder(order *models.Order) (string, Template, map[string]interface{}) {
+	return order.Email,
+		Template{
+			Name:    CartReminder,
+			Subject: withDefault(m.config().Mailer.Subjects.CartReminder, "You left something in your cart"),
+			URL:     m.config().Mailer.Templates.CartReminder,
+			Default: defaultCartReminderTemplate,
+		},
+		map[string]interface{}{
+			"Order":          order,
+			"UnsubscribeURL": m.UnsubscribeURL(order.Email),
+		}
+}
+
+// UnsubscribeToken signs an address for its unsubscribe link
+func UnsubscribeToken(secret, email string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("unsubscribe:" + strings.ToLower(email)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidUnsubscribeToken checks the token of an unsubscribe link
+func ValidUnsubscribeToken(secret, email, token string) bool {
+	if secret == "" || email == "" {
+		return false
+	}
+	return hmac.Equal([]byte(UnsubscribeToken(secret, email)), []byte(token))
+}
+
+// UnsubscribeURL is the link that stops the reminders to an address. It's
+// signed with the secret of the instance and names it, since the link goes
+// to the API of the deployment.
+func (m *Mailer) UnsubscribeURL(email string) string {
+	query := url.Values{"email": {email}, "token": {UnsubscribeToken(m.config().JWT.Secret, email)}}
+	if m.InstanceID != "" {
+		query.Set("instance", m.InstanceID)
+	}
+	return strings.TrimSuffix(m.config().API.PublicURL, "/") + "/v1/emails/unsubscribe?" + query.Encode()
+}
+
+// CartRemindersTask sends the abandoned cart reminders of every store as a
+// task of the scheduler. It's nil unless abandoned cart reminders are
+// configured, or in multi-instance mode, where instances can configure them.
+func CartRemindersTask(config *conf.Configuration, stores Stores, log *logrus.Entry) *scheduler.Task {
+	if (config.AbandonedCarts.RemindAfter <= 0 && !config.MultiInstance.Enabled) || config.Schedule.AbandonedCarts.Disabled {
+		return nil
+	}
+	return &scheduler.Task{
+		Name:     "abandoned_carts",
+		Interval: config.Schedule.AbandonedCarts.Interval,
+		Run: func(ctx context.Context, now time.Time) error {
+			list, err := stores()
+			if err != nil {
+				return err
+			}
+			for _, store := range list {
+				log := store.log(log)
+				if sent := store.Mailer.SendCartReminders(store.DB, log, now); sent > 0 {
+					log.Infof("Sent %d abandoned cart reminders", sent)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// SendCartReminders reminds the customers of the orders that have been unpaid
+// for longer than RemindAfter, unless they're older than MaxAge or the
+// customer opted out. Every order gets one reminder at most, also with
+// several instances running. It returns the number of reminders sent.
+func (m *Mailer) SendCartReminders(db *gorm.DB, log *logrus.Entry, now time.Time) int {
+	config := m.config().AbandonedCarts
+	if config.RemindAfter <= 0 {
+		return 0
+	}
+	// the opt outs are those of the order's instance
+	optOuts := models.MailOptOut{}.TableName()
+	orders := []*models.Order{}
+	rsp := db.Preload("LineItems").Preload("ShippingAddress").
+		Where("payment_state = ? AND state = ? AND test_mode = ?", models.PendingState, models.PendingState, false).
+		Where("reminder_sent_at IS NULL AND email != ?", "").
+		Where("updated_at < ? AND created_at > ?", now.Add(-config.RemindAfter), now.Add(-config.MaxAge)).
+		Where("LOWER(email) NOT IN (SELECT email FROM " + optOuts + " WHERE " + optOuts + ".instance_id = " + models.Order{}.TableName() + ".instance_id)").
+		Order("updated_at asc").
+		Limit(maxCartReminders).
+		Find(&orders)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error looking for abandoned carts")
+		return 0
+	}
+
+	sent := 0
+	for _, order := range orders {
+		// claim the order, so no other instance reminds it too
+		claim := db.Model(&models.Order{}).
+			Where("id = ? AND reminder_sent_at IS NULL", order.ID).
+			UpdateColumn("reminder_sent_at", now)
+		if claim.Error != nil {
+			log.WithError(claim.Error).WithField("order_id", order.ID).Error("Error claiming abandoned cart")
+			continue
+		}
+		if claim.RowsAffected != 1 {
+			continue
+		}
+		if err := m.CartReminderMail(order); err != nil {
+			log.WithError(err).WithField("order_id", order.ID).Error("Error sending abandoned cart reminder")
+			continue
+		}
+		sent++
+	}
+	return sent
+}
@@ -0,0 +1,164 @@
+package mailer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// Message is a rendered mail
+type Message struct {
+	// Type is the name of the mail, like order_confirmation
+	Type string
+	// OrderID is the order the mail is about, if any
+	OrderID string
+
+	From string
+	To   string
+	// Bcc get copies of the mail without the recipient knowing
+	Bcc     []string
+	Subject string
+	HTML    string
+	// Text is the plain text alternative of the HTML
+	Text string
+
+	Attachments []*Attachment
+}
+
+// Attachment is a file sent along with a mail
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Sender delivers mails through a mail provider. It returns the ID the
+// provider gave the message.
+type Sender interface {
+	Send(msg *Message) (string, error)
+}
+
+// NewSender creates the sender for the provider in the config
+func NewSender(config *conf.Configuration, client *http.Client) Sender {
+	mailer := config.Mailer
+	switch mailer.Provider {
+	case conf.SendGridProvider:
+		return &sendGridSender{
+			client:          client,
+			apiKey:          mailer.SendGrid.APIKey,
+			apiURL:          withDefault(mailer.SendGrid.APIURL, defaultSendGridURL),
+			verificationKey: mailer.SendGrid.WebhookVerificationKey,
+		}
+	case conf.MailgunProvider:
+		return &mailgunSender{
+			client:     client,
+			domain:     mailer.Mailgun.Domain,
+			apiKey:     mailer.Mailgun.APIKey,
+			apiURL:     withDefault(mailer.Mailgun.APIURL, defaultMailgunURL),
+			signingKey: mailer.Mailgun.WebhookSigningKey,
+		}
+	case conf.SESProvider:
+		return &sesSender{
+			client:       client,
+			region:       mailer.SES.Region,
+			endpoint:     withDefault(mailer.SES.Endpoint, "https://email."+mailer.SES.Region+".amazonaws.com"),
+			webhookToken: mailer.SES.WebhookToken,
+			now:          time.Now,
+		}
+	}
+	return &smtpSender{
+		host: mailer.Host,
+		port: mailer.Port,
+		user: mailer.User,
+		pass: mailer.Pass,
+	}
+}
+
+// ProviderError is an error returned by the API of a mail provider
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	// Code is the error code of the provider, if it has them
+	Code    string
+	Message string
+	// Temporary errors, like rate limits and outages, can go away when the
+	// mail is sent again later
+	Temporary bool
+}
+
+func (e *ProviderError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s error %d %s: %s", e.Provider, e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s error %d: %s", e.Provider, e.StatusCode, e.Message)
+}
+
+// temporaryStatus tells if an HTTP status is worth trying again
+func temporaryStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// The types of bounces
+const (
+	// HardBounce is a mail that can't ever be delivered to the address
+	HardBounce = "hard"
+	// SoftBounce is a mail that couldn't be delivered this time
+	SoftBounce = "soft"
+	// Complaint is a mail the recipient marked as spam
+	Complaint = "complaint"
+	// Unsubscribe is a recipient who unsubscribed with the provider's link
+	Unsubscribe = "unsubscribe"
+)
+
+// Suppresses tells if a bounce of a type stops all mails to the address
+func Suppresses(bounceType string) bool {
+	return bounceType == HardBounce || bounceType == Complaint || bounceType == Unsubscribe
+}
+
+// Bounce is a mail a provider reported as undeliverable or as spam, or a
+// recipient who unsubscribed
+type Bounce struct {
+	Email     string
+	Type      string
+	Reason    string
+	MessageID string
+	At        time.Time
+}
+
+// BounceWebhook is a verified delivery of a bounce webhook
+type BounceWebhook struct {
+	// ID tells the deliveries apart, a delivery with the ID of one that was
+	// handled is a replay
+	ID      string
+	Bounces []*Bounce
+}
+
+// BounceReceiver is implemented by the senders whose provider sends webhooks
+// about bounces
+type BounceReceiver interface {
+	// Bounces verifies a webhook from the provider and returns the bounces
+	// in it. Events that aren't bounces are left out.
+	Bounces(r *http.Request) (*BounceWebhook, error)
+}
+
+// ErrUnverifiedWebhook is returned for bounce webhooks that don't come from
+// the provider, or were signed too long ago
+var ErrUnverifiedWebhook = fmt.Errorf("The bounce webhook couldn't be verified")
+
+// WebhookTolerance is how far the time a bounce webhook was signed at can
+// be from now
+const WebhookTolerance = 5 * time.Minute
+
+// recentlySigned checks the signed time of a webhook, in seconds since the
+// epoch, is within WebhookTolerance of now
+func recentlySigned(timestamp string, now time.Time) bool {
+	signed, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(signed, 0))
+	return age <= WebhookTolerance && age >= -WebhookTolerance
+}
@@ -0,0 +1,218 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const defaultSendGridURL = "https://api.sendgrid.com"
+
+// Headers of the SendGrid event webhook
+const (
+	sendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	sendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+// sendGridSender sends mails with the SendGrid v3 API
+type sendGridSender struct {
+	client          *http.Client
+	apiKey          string
+	apiURL          string
+	verificationKey string
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridMail struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+}
+
+func newSendGridAddress(address string) sendGridAddress {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return sendGridAddress{Email: address}
+	}
+	return sendGridAddress{Email: parsed.Address, Name: parsed.Name}
+}
+
+func (s *sendGridSender) Send(msg *Message) (string, error) {
+	body := &sendGridMail{
+		From:    newSendGridAddress(msg.From),
+		Subject: msg.Subject,
+	}
+	// the plain text has to come first
+	if msg.Text != "" {
+		body.Content = append(body.Content, sendGridContent{Type: "text/plain", Value: msg.Text})
+	}
+	body.Content = append(body.Content, sendGridContent{Type: "text/html", Value: msg.HTML})
+	personalization := sendGridPersonalization{To: []sendGridAddress{newSendGridAddress(msg.To)}}
+	for _, bcc := range msg.Bcc {
+		personalization.Bcc = append(personalization.Bcc, newSendGridAddress(bcc))
+	}
+	body.Personalizations = []sendGridPersonalization{personalization}
+	for _, attachment := range msg.Attachments {
+		body.Attachments = append(body.Attachments, sendGridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(attachment.Data),
+			Type:        attachment.ContentType,
+			Filename:    attachment.Filename,
+			Disposition: "attachment",
+		})
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", s.apiURL+"/v3/mail/send", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return rsp.Header.Get("X-Message-Id"), nil
+	}
+
+	// errors look like {"errors": [{"message": "...", "field": "..."}]}
+	failure := struct {
+		Errors []struct {
+			Message string `json:"message"`
+			Field   string `json:"field"`
+		} `json:"errors"`
+	}{}
+	raw, _ := ioutil.ReadAll(rsp.Body)
+	messages := []string{}
+	if json.Unmarshal(raw, &failure) == nil {
+		for _, e := range failure.Errors {
+			if e.Field != "" {
+				messages = append(messages, e.Field+": "+e.Message)
+			} else {
+				messages = append(messages, e.Message)
+			}
+		}
+	}
+	if len(messages) == 0 {
+		messages = append(messages, string(raw))
+	}
+	return "", &ProviderError{
+		Provider:   "sendgrid",
+		StatusCode: rsp.StatusCode,
+		Message:    strings.Join(messages, "; "),
+		Temporary:  temporaryStatus(rsp.StatusCode),
+	}
+}
+
+type sendGridEvent struct {
+	Email       string `json:"email"`
+	Timestamp   int64  `json:"timestamp"`
+	Event       string `json:"event"`
+	Type        string `json:"type"`
+	Reason      string `json:"reason"`
+	SGMessageID string `json:"sg_message_id"`
+}
+
+// Bounces verifies the signature of the event webhook with the public key
+// from the SendGrid settings and picks out the bounces, spam reports and
+// unsubscribes. The signature is the ID of the delivery.
+func (s *sendGridSender) Bounces(r *http.Request) (*BounceWebhook, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	signature, timestamp := r.Header.Get(sendGridSignatureHeader), r.Header.Get(sendGridTimestampHeader)
+	if !s.verify(signature, timestamp, body) || !recentlySigned(timestamp, time.Now()) {
+		return nil, ErrUnverifiedWebhook
+	}
+
+	events := []sendGridEvent{}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, err
+	}
+	bounces := []*Bounce{}
+	for _, e := range events {
+		bounce := &Bounce{
+			Email:  e.Email,
+			Reason: e.Reason,
+			At:     time.Unix(e.Timestamp, 0),
+			// the ID returned when sending is the part before the first dot
+			MessageID: strings.SplitN(e.SGMessageID, ".", 2)[0],
+		}
+		switch {
+		case e.Event == "bounce" && e.Type == "blocked":
+			bounce.Type = SoftBounce
+		case e.Event == "bounce":
+			bounce.Type = HardBounce
+		case e.Event == "spamreport":
+			bounce.Type = Complaint
+		case e.Event == "unsubscribe" || e.Event == "group_unsubscribe":
+			bounce.Type = Unsubscribe
+		default:
+			continue
+		}
+		bounces = append(bounces, bounce)
+	}
+	return &BounceWebhook{ID: "sendgrid:" + signature, Bounces: bounces}, nil
+}
+
+func (s *sendGridSender) verify(signature, timestamp string, body []byte) bool {
+	if s.verificationKey == "" || signature == "" || timestamp == "" {
+		return false
+	}
+	der, err := base64.StdEncoding.DecodeString(s.verificationKey)
+	if err != nil {
+		return false
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return false
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(append([]byte(timestamp), body...))
+	return ecdsa.VerifyASN1(publicKey, hash[:], sig)
+}
@@ -0,0 +1,298 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/sigv4"
+)
+
+const sesService = "ses"
+
+// sesSender sends mails with the SendEmail action of the SES API, or with
+// SendRawEmail when they have attachments
+type sesSender struct {
+	client       *http.Client
+	region       string
+	endpoint     string
+	webhookToken string
+	now          func() time.Time
+}
+
+func (s *sesSender) Send(msg *Message) (string, error) {
+	form := url.Values{}
+	form.Set("Version", "2010-12-01")
+	form.Set("Source", msg.From)
+	if len(msg.Attachments) > 0 {
+		raw, err := rawMessage(msg)
+		if err != nil {
+			return "", err
+		}
+		form.Set("Action", "SendRawEmail")
+		// the Bcc addresses are only in the destinations, not the headers
+		for i, to := range append([]string{msg.To}, msg.Bcc...) {
+			form.Set(fmt.Sprintf("Destinations.member.%d", i+1), to)
+		}
+		form.Set("RawMessage.Data", base64.StdEncoding.EncodeToString(raw))
+	} else {
+		form.Set("Action", "SendEmail")
+		form.Set("Destination.ToAddresses.member.1", msg.To)
+		for i, bcc := range msg.Bcc {
+			form.Set(fmt.Sprintf("Destination.BccAddresses.member.%d", i+1), bcc)
+		}
+		form.Set("Message.Subject.Data", msg.Subject)
+		form.Set("Message.Subject.Charset", "UTF-8")
+		form.Set("Message.Body.Html.Data", msg.HTML)
+		form.Set("Message.Body.Html.Charset", "UTF-8")
+		if msg.Text != "" {
+			form.Set("Message.Body.Text.Data", msg.Text)
+			form.Set("Message.Body.Text.Charset", "UTF-8")
+		}
+	}
+	body := form.Encode()
+
+	req, err := http.NewRequest("POST", s.endpoint, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := sigv4.Sign(req, body, sesService, s.region, s.now()); err != nil {
+		return "", err
+	}
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	raw, _ := ioutil.ReadAll(rsp.Body)
+
+	if rsp.StatusCode != http.StatusOK {
+		failure := struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}{}
+		if err := xml.Unmarshal(raw, &failure); err != nil {
+			failure.Message = string(raw)
+		}
+		return "", &ProviderError{
+			Provider:   "ses",
+			StatusCode: rsp.StatusCode,
+			Code:       failure.Code,
+			Message:    failure.Message,
+			Temporary:  temporaryStatus(rsp.StatusCode) || failure.Code == "Throttling",
+		}
+	}
+
+	result := struct {
+		MessageID    string `xml:"SendEmailResult>MessageId"`
+		RawMessageID string `xml:"SendRawEmailResult>MessageId"`
+	}{}
+	if err := xml.Unmarshal(raw, &result); err != nil {
+		return "", err
+	}
+	if result.RawMessageID != "" {
+		return result.RawMessageID, nil
+	}
+	return result.MessageID, nil
+}
+
+// rawMessage encodes a message with its attachments as a MIME mail
+func rawMessage(msg *Message) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "From: %s\r\n", msg.From)
+	fmt.Fprintf(buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", msg.Subject))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	if msg.Text == "" {
+		if err := writeQuotedPrintable(writer, "text/html; charset=UTF-8", msg.HTML); err != nil {
+			return nil, err
+		}
+	} else {
+		boundary := multipart.NewWriter(nil).Boundary()
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"multipart/alternative; boundary=" + boundary},
+		})
+		if err != nil {
+			return nil, err
+		}
+		alternatives := multipart.NewWriter(part)
+		if err := alternatives.SetBoundary(boundary); err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(alternatives, "text/plain; charset=UTF-8", msg.Text); err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(alternatives, "text/html; charset=UTF-8", msg.HTML); err != nil {
+			return nil, err
+		}
+		if err := alternatives.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, attachment := range msg.Attachments {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(attachment.ContentType, map[string]string{"name": attachment.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			if _, err := part.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+				return nil, err
+			}
+			encoded = encoded[76:]
+		}
+		if _, err := part.Write([]byte(encoded + "\r\n")); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(writer *multipart.Writer, contentType, body string) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	encoder := quotedprintable.NewWriter(part)
+	if _, err := encoder.Write([]byte(body)); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// snsMessage is a message SNS posts to its HTTP subscriptions
+type snsMessage struct {
+	Type         string `json:"Type"`
+	MessageID    string `json:"MessageId"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+type sesRecipient struct {
+	EmailAddress   string `json:"emailAddress"`
+	DiagnosticCode string `json:"diagnosticCode"`
+}
+
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Mail             struct {
+		MessageID string `json:"messageId"`
+	} `json:"mail"`
+	Bounce struct {
+		BounceType        string         `json:"bounceType"`
+		BounceSubType     string         `json:"bounceSubType"`
+		BouncedRecipients []sesRecipient `json:"bouncedRecipients"`
+		Timestamp         time.Time      `json:"timestamp"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients  []sesRecipient `json:"complainedRecipients"`
+		ComplaintFeedbackType string         `json:"complaintFeedbackType"`
+		Timestamp             time.Time      `json:"timestamp"`
+	} `json:"complaint"`
+}
+
+// Bounces reads the SES notifications SNS posts to the bounce webhook. SNS
+// can't sign with a shared secret, so the webhook URL has to carry the
+// configured token as ?token=. Subscription confirmations are confirmed. The
+// SNS message ID is the ID of the delivery, SNS keeps it when it retries.
+func (s *sesSender) Bounces(r *http.Request) (*BounceWebhook, error) {
+	token := r.URL.Query().Get("token")
+	if s.webhookToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.webhookToken)) != 1 {
+		return nil, ErrUnverifiedWebhook
+	}
+
+	message := &snsMessage{}
+	if err := json.NewDecoder(r.Body).Decode(message); err != nil {
+		return nil, err
+	}
+
+	webhook := &BounceWebhook{ID: "ses:" + message.MessageID, Bounces: []*Bounce{}}
+	switch message.Type {
+	case "SubscriptionConfirmation":
+		return webhook, s.confirm(message.SubscribeURL)
+	case "Notification":
+	default:
+		return webhook, nil
+	}
+
+	notification := &sesNotification{}
+	if err := json.Unmarshal([]byte(message.Message), notification); err != nil {
+		return nil, err
+	}
+	bounces := webhook.Bounces
+	switch withDefault(notification.NotificationType, notification.EventType) {
+	case "Bounce":
+		bounceType := SoftBounce
+		if notification.Bounce.BounceType == "Permanent" {
+			bounceType = HardBounce
+		}
+		for _, recipient := range notification.Bounce.BouncedRecipients {
+			bounces = append(bounces, &Bounce{
+				Email:     recipient.EmailAddress,
+				Type:      bounceType,
+				Reason:    withDefault(recipient.DiagnosticCode, notification.Bounce.BounceSubType),
+				MessageID: notification.Mail.MessageID,
+				At:        notification.Bounce.Timestamp,
+			})
+		}
+	case "Complaint":
+		for _, recipient := range notification.Complaint.ComplainedRecipients {
+			bounces = append(bounces, &Bounce{
+				Email:     recipient.EmailAddress,
+				Type:      Complaint,
+				Reason:    notification.Complaint.ComplaintFeedbackType,
+				MessageID: notification.Mail.MessageID,
+				At:        notification.Complaint.Timestamp,
+			})
+		}
+	}
+	webhook.Bounces = bounces
+	return webhook, nil
+}
+
+// confirm visits the URL that confirms the subscription of the webhook to
+// the SNS topic, as long as it points to AWS
+func (s *sesSender) confirm(subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("Refusing to confirm an SNS subscription at %v", subscribeURL)
+	}
+	rsp, err := s.client.Get(subscribeURL)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Confirming the SNS subscription failed with %v", rsp.Status)
+	}
+	return nil
+}
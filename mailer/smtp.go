@@ -0,0 +1,62 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pborman/uuid"
+	"gopkg.in/gomail.v2"
+)
+
+// smtpSender sends mails through an SMTP server
+type smtpSender struct {
+	host string
+	port int
+	user string
+	pass string
+}
+
+func (s *smtpSender) Send(msg *Message) (string, error) {
+	id := fmt.Sprintf("<%s@%s>", uuid.NewRandom().String(), messageIDHost(msg.From))
+
+	mail := gomail.NewMessage()
+	mail.SetHeader("Message-ID", id)
+	mail.SetHeader("From", msg.From)
+	mail.SetHeader("To", msg.To)
+	if len(msg.Bcc) > 0 {
+		// gomail sends to the Bcc addresses and leaves out the header
+		mail.SetHeader("Bcc", msg.Bcc...)
+	}
+	mail.SetHeader("Subject", msg.Subject)
+	if msg.Text != "" {
+		mail.SetBody("text/plain", msg.Text)
+		mail.AddAlternative("text/html", msg.HTML)
+	} else {
+		mail.SetBody("text/html", msg.HTML)
+	}
+	for _, attachment := range msg.Attachments {
+		data := attachment.Data
+		mail.Attach(attachment.Filename,
+			gomail.SetHeader(map[string][]string{"Content-Type": {attachment.ContentType}}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		)
+	}
+
+	dialer := gomail.NewPlainDialer(s.host, s.port, s.user, s.pass)
+	return id, dialer.DialAndSend(mail)
+}
+
+// messageIDHost is the domain of the sender, for Message-IDs that don't
+// collide with those of other senders
+func messageIDHost(from string) string {
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+	host, _ := os.Hostname()
+	return host
+}
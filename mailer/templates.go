@@ -0,0 +1,253 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	textTemplate "text/template"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+type cachedTemplate struct {
+	text      string
+	expiresAt time.Time
+	// etag and lastModified revalidate the template once it expired, so
+	// it's only downloaded again when it changed
+	etag         string
+	lastModified string
+}
+
+// templateEngine renders the mails with html/template. Every mail template
+// can use the partials, which are the default ones unless the site overrides
+// them. A mail template is taken from the template directory if it has one
+// for the mail, else from its URL on the site, else the default is used.
+type templateEngine struct {
+	baseURL string
+	dir     string
+	ttl     time.Duration
+	client  *http.Client
+	funcMap map[string]interface{}
+
+	// partials holds the default partials, it's cloned for every mail
+	partials *template.Template
+
+	mutex     sync.Mutex
+	templates map[string]*cachedTemplate
+}
+
+func newTemplateEngine(baseURL, dir string, ttl time.Duration, client *http.Client, funcMap map[string]interface{}) *templateEngine {
+	if ttl <= 0 {
+		ttl = conf.DefaultMailTemplateTTL
+	}
+	return &templateEngine{
+		baseURL:   baseURL,
+		dir:       dir,
+		ttl:       ttl,
+		client:    client,
+		funcMap:   funcMap,
+		partials:  template.Must(template.New("partials").Funcs(template.FuncMap(funcMap)).Parse(defaultPartials)),
+		templates: map[string]*cachedTemplate{},
+	}
+}
+
+// reset forgets the templates loaded from the site and takes them from dir
+// from now on
+func (e *templateEngine) reset(dir string, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = conf.DefaultMailTemplateTTL
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.dir = dir
+	e.ttl = ttl
+	e.templates = map[string]*cachedTemplate{}
+}
+
+func (e *templateEngine) directory() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.dir
+}
+
+// subject renders a subject line, which isn't HTML escaped
+func (e *templateEngine) subject(subjectTemplate string, data interface{}) (string, error) {
+	tmpl, err := textTemplate.New("Subject").Funcs(textTemplate.FuncMap(e.funcMap)).Parse(subjectTemplate)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// body renders the mail template called name. A template of the site that
+// can't be rendered is replaced with the built-in one for this mail, so a
+// broken template only costs the mail its looks.
+func (e *templateEngine) body(name, url, defaultTemplate string, data interface{}) (string, error) {
+	html, err := e.render(name, e.source(name, url, defaultTemplate), data, true)
+	if err == nil {
+		return html, nil
+	}
+	log.Printf("Error rendering template %v, using the built-in one: %v", name, err)
+	return e.render(name, defaultTemplate, data, false)
+}
+
+func (e *templateEngine) render(name, text string, data interface{}, sitePartials bool) (string, error) {
+	tmpl, err := e.parse(name, text, sitePartials)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.ExecuteTemplate(buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// text renders the plain text alternative of a mail. A <name>.txt template
+// in the template directory is used if there is one, else the text is
+// derived from the HTML.
+func (e *templateEngine) text(name, html string, data interface{}) (string, error) {
+	dir := e.directory()
+	if dir == "" || name == "" {
+		return htmlToText(html), nil
+	}
+	source, err := ioutil.ReadFile(filepath.Join(dir, name+".txt"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading text template %v from %v: %v", name, dir, err)
+		}
+		return htmlToText(html), nil
+	}
+	tmpl, err := textTemplate.New(name).Funcs(textTemplate.FuncMap(e.funcMap)).Parse(string(source))
+	if err != nil {
+		log.Printf("Error parsing text template %v, deriving the text from the HTML: %v", name, err)
+		return htmlToText(html), nil
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		log.Printf("Error rendering text template %v, deriving the text from the HTML: %v", name, err)
+		return htmlToText(html), nil
+	}
+	return buf.String(), nil
+}
+
+// parse adds a mail template to a copy of the partials. With sitePartials
+// the partials in the template directory replace the default ones, and the
+// template itself can {{ define }} its own. A partial that can't be read or
+// parsed is left out, so the default one stays.
+func (e *templateEngine) parse(name, text string, sitePartials bool) (*template.Template, error) {
+	tmpl, err := e.partials.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if dir := e.directory(); dir != "" && sitePartials {
+		files, _ := filepath.Glob(filepath.Join(dir, "partials", "*.html"))
+		for _, file := range files {
+			partial, err := ioutil.ReadFile(file)
+			if err != nil {
+				log.Printf("Error reading partial %v, using the default one: %v", file, err)
+				continue
+			}
+			with, err := tmpl.Clone()
+			if err != nil {
+				return nil, err
+			}
+			partialName := strings.TrimSuffix(filepath.Base(file), ".html")
+			if _, err := with.New(partialName).Parse(string(partial)); err != nil {
+				log.Printf("Error parsing partial %v, using the default one: %v", file, err)
+				continue
+			}
+			tmpl = with
+		}
+	}
+	return tmpl.New(name).Parse(text)
+}
+
+// source finds the text of a mail template
+func (e *templateEngine) source(name, url, defaultTemplate string) string {
+	if dir := e.directory(); dir != "" {
+		text, err := ioutil.ReadFile(filepath.Join(dir, name+".html"))
+		if err == nil {
+			return string(text)
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading template %v from %v: %v", name, dir, err)
+		}
+	}
+	if url == "" {
+		return defaultTemplate
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	cached, ok := e.templates[url]
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.text
+	}
+
+	loaded, err := e.load(url, cached)
+	if err == nil {
+		loaded.expiresAt = time.Now().Add(e.ttl)
+		e.templates[url] = loaded
+		return loaded.text
+	}
+	log.Printf("Error loading template from %v: %v", url, err)
+	if ok {
+		return cached.text
+	}
+	return defaultTemplate
+}
+
+// load fetches a template from url, relative to the site unless it's
+// absolute. A cached template is only downloaded again if it changed.
+func (e *templateEngine) load(url string, cached *cachedTemplate) (*cachedTemplate, error) {
+	absoluteURL := url
+	if !strings.HasPrefix(url, "http") {
+		absoluteURL = e.baseURL + url
+	}
+	req, err := http.NewRequest("GET", absoluteURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	rsp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotModified && cached != nil {
+		return &cachedTemplate{text: cached.text, etag: cached.etag, lastModified: cached.lastModified}, nil
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", rsp.Status)
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedTemplate{
+		text:         string(body),
+		etag:         rsp.Header.Get("ETag"),
+		lastModified: rsp.Header.Get("Last-Modified"),
+	}, nil
+}
@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// blockTags start on a new line in the text of a mail
+var blockTags = map[string]bool{
+	"p": true, "div": true, "table": true, "tr": true, "ul": true, "ol": true, "li": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "hr": true,
+}
+
+// headingTags are followed by an empty line
+var headingTags = map[string]bool{
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+var (
+	spaces     = regexp.MustCompile(`[ \t\r\n]+`)
+	emptyLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText derives the plain text alternative of an HTML mail. Blocks and
+// line breaks become new lines, list items get a dash, and links are
+// followed by their URL.
+func htmlToText(source string) string {
+	out := &bytes.Buffer{}
+	links := []string{}
+	skip := 0
+	tokenizer := html.NewTokenizer(strings.NewReader(source))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			// io.EOF or broken HTML, either way the text so far is all
+			// there is
+			break
+		}
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch {
+			case token.Data == "style" || token.Data == "script" || token.Data == "head":
+				if tokenType == html.StartTagToken {
+					skip++
+				}
+			case token.Data == "br":
+				out.WriteString("\n")
+			case token.Data == "td" || token.Data == "th":
+				out.WriteString("  ")
+			case token.Data == "a":
+				links = append(links, attribute(token, "href"))
+			case blockTags[token.Data]:
+				out.WriteString("\n")
+				if token.Data == "li" {
+					out.WriteString("- ")
+				}
+			}
+		case html.EndTagToken:
+			switch {
+			case token.Data == "style" || token.Data == "script" || token.Data == "head":
+				if skip > 0 {
+					skip--
+				}
+			case token.Data == "a" && len(links) > 0:
+				href := links[len(links)-1]
+				links = links[:len(links)-1]
+				if href != "" && !strings.HasPrefix(href, "mailto:") && !strings.HasSuffix(out.String(), href) {
+					out.WriteString(" (" + href + ")")
+				}
+			case headingTags[token.Data]:
+				out.WriteString("\n\n")
+			case token.Data == "li" || token.Data == "tr":
+				// the next one starts on a new line already
+			case blockTags[token.Data]:
+				out.WriteString("\n")
+			}
+		case html.TextToken:
+			if skip == 0 {
+				out.WriteString(spaces.ReplaceAllString(token.Data, " "))
+			}
+		}
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	text := strings.Join(lines, "\n")
+	return strings.TrimSpace(emptyLines.ReplaceAllString(text, "\n\n")) + "\n"
+}
+
+func attribute(token html.Token, name string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
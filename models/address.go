@@ -22,13 +22,14 @@ type AddressRequest struct {
 type Address struct {
 	AddressRequest
 
-	ID string `json:"id"`
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
 
 	User   *User  `json:"-"`
 	UserID string `json:"-"`
 
 	CreatedAt time.Time  `json:"created_at"`
-	DeletedAt *time.Time `json:"deleted_at"`
+	DeletedAt *time.Time `json:"deleted_at" sql:"index"`
 }
 
 func (Address) TableName() string {
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// APIKeyPrefix marks a bearer token as an API key rather than a JWT
+const APIKeyPrefix = "gck_"
+
+// API key scopes
+const (
+	AdminScope    = "admin"
+	ReadOnlyScope = "read_only"
+)
+
+// APIKey is a static credential for server-to-server callers. Only a hash of
+// the key is stored, the key itself is shown once when it is created.
+type APIKey struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+	Name       string `json:"name"`
+	Scope      string `json:"scope"`
+
+	// Hint is the beginning of the key, so it can be recognized in listings
+	Hint    string `json:"hint"`
+	KeyHash string `json:"-" sql:"unique_index"`
+
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	DeletedAt  *time.Time `json:"-"`
+}
+
+func (APIKey) TableName() string {
+	return tableName("api_keys")
+}
+
+// ValidAPIKeyScope checks if the scope is one of the known API key scopes
+func ValidAPIKeyScope(scope string) bool {
+	return scope == AdminScope || scope == ReadOnlyScope
+}
+
+// NewAPIKey generates a new key. It returns the model to store and the key to
+// hand to the caller.
+func NewAPIKey(name, scope string) (*APIKey, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	key := APIKeyPrefix + hex.EncodeToString(secret)
+	return &APIKey{
+		ID:      uuid.NewRandom().String(),
+		Name:    name,
+		Scope:   scope,
+		Hint:    key[:len(APIKeyPrefix)+6],
+		KeyHash: HashAPIKey(key),
+	}, key, nil
+}
+
+// HashAPIKey returns the hash an API key is stored under
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAPIKey checks if a bearer token looks like an API key
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// FindAPIKey looks up an API key. It returns nil if the key doesn't
+// exist or has been revoked.
+func FindAPIKey(db *gorm.DB, key string) (*APIKey, error) {
+	apiKey := &APIKey{}
+	if rsp := db.First(apiKey, "key_hash = ?", HashAPIKey(key)); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return apiKey, nil
+}
+
+// AllowsMethod checks if the key's scope permits an HTTP method
+func (k *APIKey) AllowsMethod(method string) bool {
+	if k.Scope == AdminScope {
+		return true
+	}
+	return method == "GET" || method == "HEAD"
+}
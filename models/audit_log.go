@@ -0,0 +1,99 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// Kinds of actors of audit logs
+const (
+	UserActor   = "user"
+	APIKeyActor = "api_key"
+)
+
+// AuditLog records a change made by an admin, who made it and what it
+// changed
+type AuditLog struct {
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+
+	ActorType  string `json:"actor_type"`
+	ActorID    string `json:"actor_id" sql:"index"`
+	ActorEmail string `json:"actor_email,omitempty"`
+	IP         string `json:"ip"`
+
+	// Action is what was done, like order.update or payment.refund
+	Action     string `json:"action" sql:"index"`
+	TargetType string `json:"target_type"`
+	TargetID   string `json:"target_id" sql:"index"`
+
+	Changes    map[string]AuditChange `json:"changes" sql:"-"`
+	RawChanges string                 `json:"-" sql:"type:text"`
+
+	CreatedAt time.Time `json:"created_at" sql:"index"`
+}
+
+// AuditChange is the value of a field before and after a change. Before is
+// nil for created records and After for deleted ones.
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+func (AuditLog) TableName() string {
+	return tableName("audit_logs")
+}
+
+func (l *AuditLog) AfterFind() error {
+	if l.RawChanges != "" {
+		return json.Unmarshal([]byte(l.RawChanges), &l.Changes)
+	}
+	return nil
+}
+
+func (l *AuditLog) BeforeSave() error {
+	if l.Changes != nil {
+		data, err := json.Marshal(l.Changes)
+		if err != nil {
+			return err
+		}
+		l.RawChanges = string(data)
+	}
+	return nil
+}
+
+// Snapshot captures a record as it is serialized, so it can be compared
+// after it's changed
+func Snapshot(record interface{}) map[string]interface{} {
+	if record == nil || reflect.ValueOf(record).Kind() == reflect.Ptr && reflect.ValueOf(record).IsNil() {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil
+	}
+	snapshot := map[string]interface{}{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil
+	}
+	return snapshot
+}
+
+// AuditDiff lists the fields that differ between two snapshots. The
+// updated_at timestamps always change, so they're left out.
+func AuditDiff(before, after map[string]interface{}) map[string]AuditChange {
+	changes := map[string]AuditChange{}
+	for field, value := range before {
+		if !reflect.DeepEqual(value, after[field]) {
+			changes[field] = AuditChange{Before: value, After: after[field]}
+		}
+	}
+	for field, value := range after {
+		if _, ok := before[field]; !ok && value != nil {
+			changes[field] = AuditChange{After: value}
+		}
+	}
+	delete(changes, "updated_at")
+	return changes
+}
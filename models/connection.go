@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	// this is where we do the connections
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
@@ -26,22 +28,58 @@ type Configuration struct {
 
 // Connect will connect to that storage engine
 func Connect(config *conf.Configuration) (*gorm.DB, error) {
-	db, err := gorm.Open(config.DB.Driver, config.DB.ConnURL)
-	if err != nil {
-		return nil, errors.Wrap(err, "opening database connection")
+	if config.DB.Automigrate && !config.DB.RequireMigrations {
+		// migrations aren't limited by the query timeout, building an index on
+		// a big table takes a while
+		db, err := open(config, 0)
+		if err != nil {
+			return nil, err
+		}
+		err = Migrate(db)
+		db.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "migrating tables")
+		}
 	}
+	return open(config, config.DB.QueryTimeout)
+}
 
-	err = db.DB().Ping()
+// open connects to the database, with a time limit for every statement
+// unless timeout is 0
+func open(config *conf.Configuration, timeout time.Duration) (*gorm.DB, error) {
+	dialect, connURL := openArgs(config.DB.Driver, config.DB.ConnURL)
+	driverName := dialect
+	if timeout > 0 {
+		var err error
+		if driverName, err = timeoutDriverName(dialect, timeout); err != nil {
+			return nil, errors.Wrap(err, "opening database connection")
+		}
+	}
+	db, err := gorm.Open(dialect, driverName, connURL)
 	if err != nil {
-		return nil, errors.Wrap(err, "checking database connection")
+		return nil, errors.Wrap(err, "opening database connection")
+	}
+	if config.DB.Driver == CockroachDB {
+		db = db.Set(dialectKey, config.DB.Driver)
 	}
 
-	if config.DB.Automigrate {
-		if err := AutoMigrate(db); err != nil {
-			return nil, errors.Wrap(err, "migrating tables")
-		}
+	pool := db.DB()
+	if config.DB.MaxOpenConns > 0 {
+		pool.SetMaxOpenConns(config.DB.MaxOpenConns)
+	}
+	if config.DB.MaxIdleConns > 0 {
+		pool.SetMaxIdleConns(config.DB.MaxIdleConns)
+	}
+	if config.DB.ConnMaxLifetime > 0 {
+		pool.SetConnMaxLifetime(config.DB.ConnMaxLifetime)
 	}
 
+	err = pool.Ping()
+	if err != nil {
+		return nil, errors.Wrap(err, "checking database connection")
+	}
+	registerInstanceCallbacks(db)
+	registerContextCallbacks(db)
 	return db, nil
 }
 
@@ -51,19 +89,3 @@ func tableName(defaultName string) string {
 	}
 	return defaultName
 }
-
-func AutoMigrate(db *gorm.DB) error {
-	db = db.AutoMigrate(Address{},
-		LineItem{},
-		AddonItem{},
-		PriceItem{},
-		Hook{},
-		Download{},
-		Order{},
-		OrderNote{},
-		Transaction{},
-		User{},
-		Event{},
-	)
-	return db.Error
-}
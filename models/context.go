@@ -0,0 +1,63 @@
+package models
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+)
+
+const contextKey = "gocommerce:context"
+
+// WithContext returns a db handle whose queries aren't started once ctx is
+// done, like after the client of a request went away. gorm doesn't hand the
+// context to the driver, so a statement that is running already isn't
+// cancelled, only the query timeout stops it.
+func WithContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	return db.Set(contextKey, ctx)
+}
+
+func registerContextCallbacks(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:begin_transaction").Register("gocommerce:context", checkContext)
+	callbacks.Update().Before("gorm:begin_transaction").Register("gocommerce:context", checkContext)
+	callbacks.Delete().Before("gorm:begin_transaction").Register("gocommerce:context", checkContext)
+	callbacks.Query().Before("gorm:query").Register("gocommerce:context", checkContext)
+	callbacks.RowQuery().Before("gorm:row_query").Register("gocommerce:context", checkRowQueryContext)
+}
+
+// checkContext fails the query of a handle whose context is done, which keeps
+// gorm from sending it
+func checkContext(scope *gorm.Scope) {
+	if err := contextErr(scope); err != nil {
+		scope.Err(err)
+	}
+}
+
+// checkRowQueryContext fails the Rows of a handle whose context is done. gorm
+// doesn't look at the errors of the scope for them, the query is kept from
+// being sent by taking away the result gorm:row_query fills in. A Row can't
+// carry an error, its query is sent as usual.
+func checkRowQueryContext(scope *gorm.Scope) {
+	err := contextErr(scope)
+	if err == nil {
+		return
+	}
+	scope.Err(err)
+	if result, ok := scope.InstanceGet("row_query_result"); ok {
+		if rows, ok := result.(*gorm.RowsQueryResult); ok {
+			rows.Error = err
+			scope.InstanceSet("row_query_result", nil)
+		}
+	}
+}
+
+func contextErr(scope *gorm.Scope) error {
+	value, ok := scope.Get(contextKey)
+	if !ok {
+		return nil
+	}
+	if ctx, ok := value.(context.Context); ok {
+		return ctx.Err()
+	}
+	return nil
+}
@@ -1,17 +1,84 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
 
+// Coupon takes a percentage or a fixed amount off the products of its
+// product types. Coupons are kept in the store, or loaded from the
+// coupons.url, which only the codes not in the store are looked up in.
 type Coupon struct {
-	Code string `json:"code"`
+	ID         string `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_coupons_code"`
+	Code       string `json:"code" sql:"unique_index:idx_coupons_code"`
 
 	StartDate *time.Time `json:"start_date,omitempty"`
 	EndDate   *time.Time `json:"end_date,omitempty"`
 
 	Percentage uint64 `json:"percentage,omitempty"`
+	// FixedAmount is taken off orders in the Currency
+	FixedAmount uint64 `json:"fixed_amount,omitempty"`
+	Currency    string `json:"currency,omitempty"`
 
-	ProductTypes []string               `json:"product_types,omitempty"`
-	Claims       map[string]interface{} `json:"claims,omitempty"`
+	// MaxUses limits the orders paid with the coupon, MaxUsesPerUser the
+	// ones of each customer. Zero is no limit.
+	MaxUses        uint64 `json:"max_uses,omitempty"`
+	MaxUsesPerUser uint64 `json:"max_uses_per_user,omitempty"`
+
+	// UserID and Email bind the coupon to a single customer
+	UserID string `json:"user_id,omitempty"`
+	Email  string `json:"email,omitempty"`
+
+	// ReferrerID is the customer whose referral code the coupon is
+	ReferrerID string `json:"referrer_id,omitempty" sql:"index"`
+
+	ProductTypes    []string               `json:"product_types,omitempty" sql:"-"`
+	RawProductTypes string                 `json:"-"`
+	Claims          map[string]interface{} `json:"claims,omitempty" sql:"-"`
+	RawClaims       string                 `json:"-"`
+
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the Coupon model.
+func (Coupon) TableName() string {
+	return tableName("coupons")
+}
+
+// BeforeSave stores the product types and claims as JSON
+func (c *Coupon) BeforeSave() error {
+	c.RawProductTypes, c.RawClaims = "", ""
+	if len(c.ProductTypes) > 0 {
+		data, err := json.Marshal(c.ProductTypes)
+		if err != nil {
+			return err
+		}
+		c.RawProductTypes = string(data)
+	}
+	if len(c.Claims) > 0 {
+		data, err := json.Marshal(c.Claims)
+		if err != nil {
+			return err
+		}
+		c.RawClaims = string(data)
+	}
+	return nil
+}
+
+// AfterFind loads the product types and claims stored as JSON
+func (c *Coupon) AfterFind() error {
+	if c.RawProductTypes != "" {
+		if err := json.Unmarshal([]byte(c.RawProductTypes), &c.ProductTypes); err != nil {
+			return err
+		}
+	}
+	if c.RawClaims != "" {
+		return json.Unmarshal([]byte(c.RawClaims), &c.Claims)
+	}
+	return nil
 }
 
 func (c *Coupon) Valid() bool {
@@ -42,15 +109,25 @@ func (c *Coupon) ValidForType(productType string) bool {
 	return false
 }
 
+// ValidForUser checks a coupon bound to a customer is used by them
+func (c *Coupon) ValidForUser(userID, email string) bool {
+	if c.UserID != "" && c.UserID != userID {
+		return false
+	}
+	return c.Email == "" || strings.EqualFold(c.Email, email)
+}
+
+// ValidForPrice checks a fixed discount is in the currency of the order
 func (c *Coupon) ValidForPrice(currency string, price uint64) bool {
-	// TODO: Support for coupons based on amount
-	return true
+	return c.FixedAmount == 0 || strings.EqualFold(c.Currency, currency)
 }
 
 func (c *Coupon) PercentageDiscount() uint64 {
 	return c.Percentage
 }
 func (c *Coupon) FixedDiscount() uint64 {
-	// TODO: Support for fixed amount discoutns
-	return 0
+	if c == nil {
+		return 0
+	}
+	return c.FixedAmount
 }
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// CouponRedemption records an order paid with a coupon. It's taken when the
+// payment starts, and given back if the customer couldn't be charged.
+type CouponRedemption struct {
+	ID         uint64    `json:"-" gorm:"primary_key"`
+	InstanceID string    `json:"-"`
+	CouponCode string    `json:"coupon_code" sql:"index"`
+	OrderID    string    `json:"order_id" sql:"unique_index"`
+	UserID     string    `json:"user_id,omitempty"`
+	Email      string    `json:"email"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the CouponRedemption model.
+func (CouponRedemption) TableName() string {
+	return tableName("coupon_redemptions")
+}
+
+// CountCouponRedemptions counts the redemptions of the coupon, and the ones
+// by the user. A redemption is the user's when it has the user's account or
+// email, so checking out as a guest doesn't get around the limit.
+func CountCouponRedemptions(db *gorm.DB, code, userID, email string) (total, byUser uint64, err error) {
+	query := db.Model(&CouponRedemption{}).Where("coupon_code = ?", code)
+	if err = query.Count(&total).Error; err != nil || total == 0 {
+		return
+	}
+	email = strings.ToLower(email)
+	if userID != "" {
+		err = query.Where("user_id = ? OR lower(email) = ?", userID, email).Count(&byUser).Error
+	} else {
+		err = query.Where("lower(email) = ?", email).Count(&byUser).Error
+	}
+	return
+}
+
+// CouponRedemptionCounts counts the redemptions of each of the coupons
+func CouponRedemptionCounts(db *gorm.DB, codes []string) (map[string]uint64, error) {
+	counts := map[string]uint64{}
+	if len(codes) == 0 {
+		return counts, nil
+	}
+	rows, err := db.Model(&CouponRedemption{}).
+		Select("coupon_code, count(*)").
+		Where("coupon_code IN (?)", codes).
+		Group("coupon_code").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		var count uint64
+		if err := rows.Scan(&code, &count); err != nil {
+			return nil, err
+		}
+		counts[code] = count
+	}
+	return counts, rows.Err()
+}
+
+// LockCoupon locks the redemptions of the coupon until the transaction ends,
+// so they are counted and taken one payment at a time. The lock is a key of
+// its own rather than the coupon's row, which coupons loaded from the
+// coupons.url don't have.
+func LockCoupon(tx *gorm.DB, code string) error {
+	return lockPaymentAttemptKey(tx, "coupon:"+code)
+}
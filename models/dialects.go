@@ -0,0 +1,57 @@
+package models
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	// SQL Server goes through the mssql dialect of gorm and its driver
+	_ "github.com/jinzhu/gorm/dialects/mssql"
+)
+
+// The databases that are reached through the dialect of another one
+const (
+	// CockroachDB speaks the postgres protocol, but doesn't support all of
+	// postgres. The differences are handled where they matter.
+	CockroachDB = "cockroachdb"
+	// MSSQL is SQL Server
+	MSSQL = "mssql"
+)
+
+const dialectKey = "gocommerce:dialect"
+
+// openArgs tells the gorm dialect and the connection string to open the
+// database of a driver with
+func openArgs(driver, connURL string) (string, string) {
+	switch driver {
+	case CockroachDB:
+		return "postgres", withScheme(connURL, "postgresql")
+	case MSSQL, "sqlserver":
+		// the driver of SQL Server only takes sqlserver:// URLs
+		if strings.HasPrefix(connURL, "mssql://") {
+			connURL = withScheme(connURL, "sqlserver")
+		}
+		return MSSQL, connURL
+	}
+	return driver, connURL
+}
+
+func withScheme(connURL, scheme string) string {
+	u, err := url.Parse(connURL)
+	if err != nil || u.Scheme == "" {
+		return connURL
+	}
+	u.Scheme = scheme
+	return u.String()
+}
+
+// Dialect tells the database db is connected to. It's the name of the gorm
+// dialect, except for the databases that borrow the dialect of another one.
+func Dialect(db *gorm.DB) string {
+	if value, ok := db.Get(dialectKey); ok {
+		if name, ok := value.(string); ok {
+			return name
+		}
+	}
+	return db.Dialect().GetName()
+}
@@ -7,9 +7,10 @@ import (
 )
 
 type Download struct {
-	ID string `json:"id"`
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
 
-	OrderID    string `json:"order_id"`
+	OrderID    string `json:"order_id" sql:"index"`
 	LineItemID int64  `json:"line_item_id"`
 
 	Title  string `json:"title"`
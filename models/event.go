@@ -8,7 +8,8 @@ import (
 )
 
 type Event struct {
-	ID uint64 `json:"id"`
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
 
 	IP string `json:"ip"`
 
@@ -16,7 +17,7 @@ type Event struct {
 	UserID string `json:"user_id,omitempty"`
 
 	Order   *Order `json:"order,omitempty"`
-	OrderID string `json:"order_id,omitempty"`
+	OrderID string `json:"order_id,omitempty" sql:"index"`
 
 	Type    string `json:"type"`
 	Changes string `json:"data"`
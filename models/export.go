@@ -0,0 +1,306 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// ExportFormatVersion is the version of the export format. It only changes
+// when the shape of the lines does, new columns come with the schema version.
+const ExportFormatVersion = 1
+
+// exportTables are the tables an export holds, parents before the records
+// that point at them. The migration bookkeeping is left out, the database an
+// export is imported into is migrated already, and so are the webhook
+// deliveries, which only guard against replays for a day.
+var exportTables = []struct {
+	name  string
+	model func() interface{}
+}{
+	{"instances", func() interface{} { return &Instance{} }},
+	{"users", func() interface{} { return &User{} }},
+	{"addresses", func() interface{} { return &Address{} }},
+	{"order_numbers", func() interface{} { return &OrderNumber{} }},
+	{"coupons", func() interface{} { return &Coupon{} }},
+	{"invoice_series", func() interface{} { return &InvoiceSeries{} }},
+	{"orders", func() interface{} { return &Order{} }},
+	{"coupon_redemptions", func() interface{} { return &CouponRedemption{} }},
+	{"referral_credits", func() interface{} { return &ReferralCredit{} }},
+	{"order_taxes", func() interface{} { return &OrderTax{} }},
+	{"orders_notes", func() interface{} { return &OrderNote{} }},
+	{"line_items", func() interface{} { return &LineItem{} }},
+	{"line_item_components", func() interface{} { return &LineItemComponent{} }},
+	{"price_items", func() interface{} { return &PriceItem{} }},
+	{"addon_items", func() interface{} { return &AddonItem{} }},
+	{"downloads", func() interface{} { return &Download{} }},
+	{"transactions", func() interface{} { return &Transaction{} }},
+	{"payment_attempts", func() interface{} { return &PaymentAttempt{} }},
+	{"events", func() interface{} { return &Event{} }},
+	{"inventory_items", func() interface{} { return &InventoryItem{} }},
+	{"api_keys", func() interface{} { return &APIKey{} }},
+	{"audit_logs", func() interface{} { return &AuditLog{} }},
+	{"webhook_endpoints", func() interface{} { return &WebhookEndpoint{} }},
+	{"webhook_subscriptions", func() interface{} { return &WebhookSubscription{} }},
+	{"hooks", func() interface{} { return &Hook{} }},
+	{"hook_attempts", func() interface{} { return &HookAttempt{} }},
+	{"mails", func() interface{} { return &Mail{} }},
+	{"mail_digests", func() interface{} { return &MailDigest{} }},
+	{"mail_bounces", func() interface{} { return &MailBounce{} }},
+	{"mail_opt_outs", func() interface{} { return &MailOptOut{} }},
+	{"mail_suppressions", func() interface{} { return &MailSuppression{} }},
+	{"jobs", func() interface{} { return &Job{} }},
+	{"scheduled_tasks", func() interface{} { return &ScheduledTask{} }},
+}
+
+// ExportHeader is the first line of an export
+type ExportHeader struct {
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schema_version"`
+	ExportedAt    time.Time `json:"exported_at"`
+}
+
+// ExportRecord is a line of an export after the header, a row of a table.
+// The row is keyed by column, so it doesn't depend on the database it came
+// from, and the table is named without the namespace.
+type ExportRecord struct {
+	Table string                     `json:"table"`
+	Row   map[string]json.RawMessage `json:"row"`
+}
+
+// ExportResult counts the rows exported or imported per table
+type ExportResult map[string]int
+
+// Total is the number of rows in all tables
+func (r ExportResult) Total() int {
+	total := 0
+	for _, count := range r {
+		total += count
+	}
+	return total
+}
+
+// Export writes all the data in the database to w, one JSON document per
+// line: an ExportHeader followed by an ExportRecord for every row, ordered by
+// table and primary key. Deleted records are included.
+func Export(db *gorm.DB, w io.Writer, now time.Time) (ExportResult, error) {
+	if err := requireCurrentSchema(db); err != nil {
+		return nil, err
+	}
+
+	result := ExportResult{}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&ExportHeader{Format: "gocommerce", Version: ExportFormatVersion, SchemaVersion: SchemaVersion, ExportedAt: now}); err != nil {
+		return result, err
+	}
+
+	for _, table := range exportTables {
+		scope := db.NewScope(table.model())
+		rows, err := db.Unscoped().Model(table.model()).Order(primaryKeyOrder(scope)).Rows()
+		if err != nil {
+			return result, errors.Wrapf(err, "reading %s", table.name)
+		}
+		for rows.Next() {
+			record := table.model()
+			if err := db.ScanRows(rows, record); err != nil {
+				rows.Close()
+				return result, errors.Wrapf(err, "reading %s", table.name)
+			}
+			row, err := exportRow(db.NewScope(record))
+			if err != nil {
+				rows.Close()
+				return result, errors.Wrapf(err, "encoding %s", table.name)
+			}
+			if err := enc.Encode(&ExportRecord{Table: table.name, Row: row}); err != nil {
+				rows.Close()
+				return result, err
+			}
+			result[table.name]++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return result, errors.Wrapf(err, "reading %s", table.name)
+		}
+	}
+	return result, nil
+}
+
+// Import loads an export written by Export into an empty database, which
+// can be another kind of database than the one it was exported from. The
+// rows are inserted as they are, without running the hooks of the models, in
+// one transaction, so nothing is left behind when it fails.
+func Import(db *gorm.DB, r io.Reader) (ExportResult, error) {
+	if err := requireCurrentSchema(db); err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(r)
+	header := &ExportHeader{}
+	if err := dec.Decode(header); err != nil {
+		return nil, errors.Wrap(err, "reading export header")
+	}
+	if header.Format != "gocommerce" || header.Version != ExportFormatVersion {
+		return nil, fmt.Errorf("unsupported export format %q version %d", header.Format, header.Version)
+	}
+	if header.SchemaVersion != SchemaVersion {
+		return nil, fmt.Errorf("the export is of schema version %d but this build is at version %d, import it with the version of gocommerce that exported it", header.SchemaVersion, SchemaVersion)
+	}
+
+	tables := map[string]func() interface{}{}
+	for _, table := range exportTables {
+		tables[table.name] = table.model
+		count := 0
+		if err := db.Unscoped().Model(table.model()).Count(&count).Error; err != nil {
+			return nil, errors.Wrapf(err, "counting %s", table.name)
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("the database isn't empty, %s has %d rows", table.name, count)
+		}
+	}
+
+	result := ExportResult{}
+	tx := db.Begin()
+	identityInsert := ""
+	for {
+		record := &ExportRecord{}
+		if err := dec.Decode(record); err == io.EOF {
+			break
+		} else if err != nil {
+			tx.Rollback()
+			return result, errors.Wrapf(err, "reading record %d", result.Total()+1)
+		}
+		model, ok := tables[record.Table]
+		if !ok {
+			tx.Rollback()
+			return result, fmt.Errorf("record %d is of unknown table %q", result.Total()+1, record.Table)
+		}
+
+		scope := tx.NewScope(model())
+		if Dialect(db) == MSSQL && record.Table != identityInsert && hasSerialKey(scope) {
+			// SQL Server only takes the IDs of identity columns from one
+			// table of a session at a time
+			if identityInsert != "" {
+				tx.Exec("SET IDENTITY_INSERT " + tx.NewScope(tables[identityInsert]()).QuotedTableName() + " OFF")
+			}
+			if err := tx.Exec("SET IDENTITY_INSERT " + scope.QuotedTableName() + " ON").Error; err != nil {
+				tx.Rollback()
+				return result, err
+			}
+			identityInsert = record.Table
+		}
+		if err := importRow(tx, scope, record.Row); err != nil {
+			tx.Rollback()
+			return result, errors.Wrapf(err, "importing record %d of %s", result[record.Table]+1, record.Table)
+		}
+		result[record.Table]++
+	}
+
+	if err := resetSequences(tx); err != nil {
+		tx.Rollback()
+		return result, errors.Wrap(err, "resetting sequences")
+	}
+	return result, tx.Commit().Error
+}
+
+func requireCurrentSchema(db *gorm.DB) error {
+	current, err := CurrentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current != SchemaVersion {
+		return fmt.Errorf("database schema is at version %d but this build is at version %d, run `gocommerce migrate` first", current, SchemaVersion)
+	}
+	return nil
+}
+
+func primaryKeyOrder(scope *gorm.Scope) string {
+	columns := []string{}
+	for _, field := range scope.PrimaryFields() {
+		columns = append(columns, scope.Quote(field.DBName)+" asc")
+	}
+	return strings.Join(columns, ", ")
+}
+
+// exportRow encodes the columns of a record, with the JSON encoding of the
+// type of their field
+func exportRow(scope *gorm.Scope) (map[string]json.RawMessage, error) {
+	row := map[string]json.RawMessage{}
+	for _, field := range scope.Fields() {
+		if !field.IsNormal || field.IsIgnored {
+			continue
+		}
+		data, err := json.Marshal(field.Field.Interface())
+		if err != nil {
+			return nil, errors.Wrap(err, field.DBName)
+		}
+		row[field.DBName] = data
+	}
+	return row, nil
+}
+
+// importRow inserts an exported row. The columns are decoded into the fields
+// of the model they belong to, which gives them the type the database
+// expects.
+func importRow(tx *gorm.DB, scope *gorm.Scope, row map[string]json.RawMessage) error {
+	columns := []string{}
+	placeholders := []string{}
+	values := []interface{}{}
+	for column, data := range row {
+		field, ok := scope.FieldByName(column)
+		if !ok || !field.IsNormal || field.IsIgnored || field.DBName != column {
+			return fmt.Errorf("unknown column %q", column)
+		}
+		value := reflect.New(field.Field.Type())
+		if err := json.Unmarshal(data, value.Interface()); err != nil {
+			return errors.Wrap(err, column)
+		}
+		columns = append(columns, scope.Quote(column))
+		placeholders = append(placeholders, "?")
+		values = append(values, value.Elem().Interface())
+	}
+	return tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		scope.QuotedTableName(), strings.Join(columns, ", "), strings.Join(placeholders, ", ")), values...).Error
+}
+
+// hasSerialKey tells if the table has a primary key the database counts up
+func hasSerialKey(scope *gorm.Scope) bool {
+	fields := scope.PrimaryFields()
+	if len(fields) != 1 {
+		return false
+	}
+	switch fields[0].Field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// resetSequences moves the sequences of postgres past the imported IDs, the
+// other databases do it on their own when an ID is given
+func resetSequences(tx *gorm.DB) error {
+	if Dialect(tx) != "postgres" {
+		return nil
+	}
+	for _, table := range exportTables {
+		scope := tx.NewScope(table.model())
+		if !hasSerialKey(scope) {
+			continue
+		}
+		key := scope.PrimaryField().DBName
+		err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE(MAX(%s), 0) + 1, false) FROM %s",
+			scope.TableName(), key, scope.Quote(key), scope.QuotedTableName())).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
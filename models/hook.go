@@ -2,47 +2,77 @@ package models
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/sinks"
+	"github.com/netlify/gocommerce/tracing"
+	"github.com/netlify/gocommerce/webhooks"
 )
 
-const MaxConcurrentHooks = 5
-const MaxRetries = 5
-const RetryPeriod = 30 * time.Second
-const SignatureExpiration = 5 * time.Minute
+// SinkURLPrefix marks the hooks published to an event sink, the URL of such a
+// hook is the prefix followed by the name of the sink
+const SinkURLPrefix = "sink:"
+
+var errInactiveSubscription = errors.New("The webhook subscription was deleted or deactivated")
 
 type Hook struct {
-	ID uint64
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+
+	UserID string `json:"user_id,omitempty"`
+	// OrderID is the order the hook is about, if any
+	OrderID string `json:"order_id,omitempty" sql:"index"`
 
-	UserID string
+	Type string `json:"type"`
 
-	Type string
+	Done   bool `json:"done"`
+	Failed bool `json:"failed"`
 
-	Done   bool
-	Failed bool
+	URL     string `json:"url"`
+	Payload string `json:"payload"`
 
-	URL     string
-	Payload string
+	// SubscriptionID is the webhook subscription the hook is sent to, if any,
+	// it's signed with the secret of the subscription
+	SubscriptionID string `json:"subscription_id,omitempty" sql:"index"`
+	// Format is the format of the payload, see the webhooks package
+	Format string `json:"format,omitempty"`
 
-	ResponseStatus  string
-	ResponseHeaders string
-	ResponseBody    string
-	ErrorMessage    *string
+	// RequestID is the ID of the request that triggered the hook, passed on
+	// in the X-Request-ID header
+	RequestID string `json:"request_id,omitempty"`
 
-	Tries int
+	ResponseStatus  string  `json:"response_status,omitempty"`
+	ResponseHeaders string  `json:"-"`
+	ResponseBody    string  `json:"-"`
+	ErrorMessage    *string `json:"error_message,omitempty"`
 
-	CreatedAt   time.Time
-	RunAfter    *time.Time
-	LockedAt    *time.Time
-	LockedBy    *string
-	CompletedAt *time.Time
+	Tries int `json:"tries"`
+
+	// Attempts are the deliveries of the hook so far
+	Attempts []HookAttempt `json:"attempts,omitempty"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	RunAfter    *time.Time `json:"run_after,omitempty"`
+	LockedAt    *time.Time `json:"-"`
+	LockedBy    *string    `json:"-"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
 }
 
 func (Hook) TableName() string {
@@ -51,37 +81,145 @@ func (Hook) TableName() string {
 
 func NewHook(hookType, url, userID string, payload interface{}) *Hook {
 	json, _ := json.Marshal(payload)
-	return &Hook{
+	hook := &Hook{
 		Type:    hookType,
 		UserID:  userID,
 		URL:     url,
 		Payload: string(json),
 	}
+	switch p := payload.(type) {
+	case *Order:
+		hook.OrderID = p.ID
+	case *Transaction:
+		hook.OrderID = p.OrderID
+	}
+	return hook
+}
+
+// Replay creates a new hook delivering the same payload again
+func (h *Hook) Replay() *Hook {
+	return &Hook{
+		Type:           h.Type,
+		UserID:         h.UserID,
+		OrderID:        h.OrderID,
+		URL:            h.URL,
+		Payload:        h.Payload,
+		RequestID:      h.RequestID,
+		SubscriptionID: h.SubscriptionID,
+		Format:         h.Format,
+	}
 }
 
-func (h *Hook) Trigger(client *http.Client, log *logrus.Entry, secret string) (*http.Response, error) {
+// DeliveryID identifies the delivery to consumers, it's the same for every
+// try of a hook
+func (h *Hook) DeliveryID() string {
+	return strconv.FormatUint(h.ID, 10)
+}
+
+// Trigger sends the hook, signed with every secret that is set
+func (h *Hook) Trigger(client *http.Client, log *logrus.Entry, secrets ...string) (rsp *http.Response, err error) {
 	log.Infof("Triggering hook %v: %v", h.ID, h.URL)
 	h.Tries++
+
+	ctx, span := tracing.StartSpan(context.Background(), "webhook.deliver",
+		attribute.String("webhook.type", h.Type),
+		attribute.Int("webhook.try", h.Tries),
+	)
+	defer func() {
+		if rsp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", rsp.StatusCode))
+		}
+		tracing.EndSpan(span, err)
+	}()
+
 	body := bytes.NewBufferString(h.Payload)
 	req, err := http.NewRequest("POST", h.URL, body)
 	if err != nil {
 		return nil, err
 	}
-	if secret != "" {
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"sub": h.UserID,
-			"exp": time.Now().Add(SignatureExpiration),
-		})
-		tokenString, err := token.SignedString([]byte(secret))
-		if err != nil {
-			return nil, err
+	tracing.Inject(ctx, req.Header)
+	if h.RequestID != "" {
+		req.Header.Set("X-Request-ID", h.RequestID)
+	}
+	if h.Format == webhooks.CloudEventsFormat {
+		req.Header.Set("Content-Type", webhooks.CloudEventsContentType)
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(webhooks.EventHeader, h.Type)
+	req.Header.Set(webhooks.VersionHeader, webhooks.Version)
+	req.Header.Set(webhooks.DeliveryHeader, h.DeliveryID())
+	keys := []string{}
+	for _, secret := range secrets {
+		if secret != "" {
+			keys = append(keys, secret)
 		}
-		req.Header.Set("X-Commerce-Signature", tokenString)
+	}
+	if len(keys) > 0 {
+		req.Header.Set(webhooks.SignatureHeader, webhooks.SignAll(keys, h.DeliveryID(), []byte(h.Payload), time.Now()))
 	}
 	return client.Do(req)
 }
 
-func (h *Hook) handleError(db *gorm.DB, log *logrus.Entry, resp *http.Response, err error) {
+// Publish sends the hook to an event sink
+func (h *Hook) Publish(sink sinks.Sink, log *logrus.Entry, timeout time.Duration) (err error) {
+	log.Infof("Publishing hook %v to %v", h.ID, h.URL)
+	h.Tries++
+
+	ctx, span := tracing.StartSpan(context.Background(), "webhook.publish",
+		attribute.String("webhook.type", h.Type),
+		attribute.String("webhook.sink", strings.TrimPrefix(h.URL, SinkURLPrefix)),
+		attribute.Int("webhook.try", h.Tries),
+	)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	if sink == nil {
+		return fmt.Errorf("No event sink named %s is configured", strings.TrimPrefix(h.URL, SinkURLPrefix))
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return sink.Publish(ctx, &sinks.Message{
+		ID:    h.DeliveryID(),
+		Event: h.Type,
+		Key:   h.OrderID,
+		Body:  []byte(h.Payload),
+	})
+}
+
+// TriggerSubscription sends the hook to its webhook subscription, signed with
+// the secret of the subscription. Hooks of a subscription that was deleted or
+// deactivated since fail without being sent.
+func (h *Hook) TriggerSubscription(db *gorm.DB, client *http.Client, log *logrus.Entry) (*http.Response, error) {
+	subscription, err := FindWebhookSubscription(db, h.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if subscription == nil || !subscription.Active {
+		h.Tries++
+		return nil, errInactiveSubscription
+	}
+	return h.Trigger(client, log, subscription.Secret)
+}
+
+// eventSinks sets up the sinks in the config by their hook URL, the hooks of
+// a sink that can't be set up fail like those of a sink that isn't configured
+func eventSinks(config *conf.Configuration, client *http.Client, log *logrus.Entry) map[string]sinks.Sink {
+	all := map[string]sinks.Sink{}
+	for _, s := range config.EventSinks {
+		sink, err := sinks.New(s.URL, client)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to set up event sink %s", s.Name)
+			continue
+		}
+		all[SinkURLPrefix+s.Name] = sink
+	}
+	return all
+}
+
+func (h *Hook) handleError(db *gorm.DB, log *logrus.Entry, config *conf.Configuration, resp *http.Response, err error) {
 	if err != nil {
 		errString := err.Error()
 		h.ErrorMessage = &errString
@@ -89,6 +227,17 @@ func (h *Hook) handleError(db *gorm.DB, log *logrus.Entry, resp *http.Response,
 		h.ErrorMessage = nil
 	}
 
+	if err == errInactiveSubscription {
+		// the endpoint isn't at fault and retrying won't help
+		log.Infof("Hook %v is for an inactive webhook subscription. Giving up.", h.ID)
+		now := time.Now()
+		h.Failed = true
+		h.Done = true
+		h.CompletedAt = &now
+		db.Save(h)
+		return
+	}
+
 	if resp != nil && resp.Body != nil {
 		body, _ := ioutil.ReadAll(resp.Body)
 		h.ResponseBody = string(body)
@@ -97,40 +246,129 @@ func (h *Hook) handleError(db *gorm.DB, log *logrus.Entry, resp *http.Response,
 		h.ResponseHeaders = string(headers)
 	}
 
+	failure := h.ResponseStatus
+	if h.ErrorMessage != nil {
+		failure = *h.ErrorMessage
+	}
+	endpoint, recordErr := recordHookFailure(db, h.InstanceID, h.URL, failure, config.Webhooks.UnhealthyAfter)
+	if recordErr != nil {
+		log.WithError(recordErr).Warnf("Failed to record the failure of hook %v", h.ID)
+	} else if endpoint.Unhealthy && endpoint.ConsecutiveFailures == config.Webhooks.UnhealthyAfter {
+		log.Errorf("Webhook endpoint %v failed %v deliveries in a row, marking it unhealthy", h.URL, endpoint.ConsecutiveFailures)
+	}
+
 	now := time.Now()
-	if h.Tries >= MaxRetries {
-		log.Errorf("Hook %v failed more than %v times. %v. Giving up.", h.ID, MaxRetries, err)
+	if h.Tries >= config.Webhooks.MaxRetries {
+		log.Errorf("Hook %v failed more than %v times. %v. Giving up.", h.ID, config.Webhooks.MaxRetries, err)
 		h.Failed = true
 		h.Done = true
 		h.CompletedAt = &now
 	} else {
-		runAfter := now.Add(time.Duration(h.Tries) * RetryPeriod)
+		delay := retryDelay(h.Tries, config.Webhooks.RetryPeriod, config.Webhooks.MaxRetryPeriod)
+		if endpoint != nil && endpoint.Unhealthy {
+			// don't hammer an endpoint that is down
+			delay = config.Webhooks.MaxRetryPeriod
+		}
+		runAfter := now.Add(delay)
 		h.RunAfter = &runAfter
 		log.Errorf("Hook %v failed %v - retrying at %v", h.ID, err, runAfter)
 	}
 	db.Save(h)
 }
 
+// retryDelay doubles the wait after every try, up to max. The wait is
+// randomized between half and all of it, so hooks that failed together
+// don't all retry at once.
+func retryDelay(tries int, period, max time.Duration) time.Duration {
+	delay := period
+	for i := 1; i < tries && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
 func (h *Hook) handleSuccess(db *gorm.DB, log *logrus.Entry, resp *http.Response) {
-	log.Infof("Hook %v triggered. %v", h.ID, resp.Status)
 	now := time.Now()
 	h.Done = true
 	h.ErrorMessage = nil
-	h.ResponseStatus = resp.Status
-	headers, _ := json.Marshal(resp.Header)
-	h.ResponseHeaders = string(headers)
-	body, _ := ioutil.ReadAll(resp.Body)
-	h.ResponseBody = string(body)
 	h.CompletedAt = &now
+	if resp == nil {
+		log.Infof("Hook %v published", h.ID)
+		h.ResponseStatus = "published"
+	} else {
+		log.Infof("Hook %v triggered. %v", h.ID, resp.Status)
+		h.ResponseStatus = resp.Status
+		headers, _ := json.Marshal(resp.Header)
+		h.ResponseHeaders = string(headers)
+		body, _ := ioutil.ReadAll(resp.Body)
+		h.ResponseBody = string(body)
+	}
 	db.Save(h)
+	if err := recordHookSuccess(db, h.InstanceID, h.URL); err != nil {
+		log.WithError(err).Warnf("Failed to record the success of hook %v", h.ID)
+	}
 }
 
-func RunHooks(db *gorm.DB, log *logrus.Entry, secret string) {
+// postpone puts a hook back without trying it, to be picked up after until
+func (h *Hook) postpone(db *gorm.DB, until *time.Time) {
+	h.RunAfter = until
+	h.LockedAt = nil
+	h.LockedBy = nil
+	db.Save(h)
+}
+
+// instanceSecrets are the secrets a hook is signed with, the ones of its
+// instance when it has one
+func instanceSecrets(db *gorm.DB, hook *Hook, config *conf.Configuration, secrets []string) []string {
+	if hook.InstanceID == "" {
+		return secrets
+	}
+	instance, err := FindInstance(db, hook.InstanceID)
+	if err != nil || instance == nil {
+		return secrets
+	}
+	instanceConfig, err := instance.Configuration(config)
+	if err != nil {
+		return secrets
+	}
+	return []string{instanceConfig.Webhooks.Secret, instanceConfig.Webhooks.SecondarySecret}
+}
+
+// RunHooks delivers pending hooks in the background, retrying failed ones as
+// configured in config.Webhooks. Hooks for event sinks are published to the
+// sinks in config.EventSinks, hooks for webhook subscriptions are signed with
+// their secret. Calling stop stops picking up new hooks and
+// waits for the deliveries in flight.
+//
+// Up to config.Webhooks.Concurrency hooks are delivered at once, and up to
+// config.Webhooks.EndpointConcurrency to the same endpoint, so a slow endpoint
+// can't hold up the others. The circuit of an unhealthy endpoint opens after
+// every failure: its hooks are postponed without being sent until
+// config.Webhooks.BreakerCooldown passed.
+func RunHooks(db *gorm.DB, log *logrus.Entry, config *conf.Configuration) (stop func()) {
+	secrets := []string{config.Webhooks.Secret, config.Webhooks.SecondarySecret}
+	client := config.HTTPClient(config.Timeouts.Webhooks)
+	eventSinks := eventSinks(config, client, log)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		id := uuid.NewRandom().String()
-		sem := make(chan bool, MaxConcurrentHooks)
+		concurrency, endpointConcurrency := config.Webhooks.Concurrency, config.Webhooks.EndpointConcurrency
+		if concurrency <= 0 {
+			concurrency = conf.DefaultWebhookConcurrency
+		}
+		if endpointConcurrency <= 0 {
+			endpointConcurrency = conf.DefaultWebhookEndpointConcurrency
+		}
+		sem := make(chan bool, concurrency)
+		limiter := newEndpointLimiter(endpointConcurrency)
 		table := Hook{}.TableName()
-		client := &http.Client{}
 		for {
 			hooks := []*Hook{}
 			tx := db.Begin()
@@ -143,24 +381,77 @@ func RunHooks(db *gorm.DB, log *logrus.Entry, secret string) {
 			tx.Where("locked_by = ?", id).Find(&hooks)
 			tx.Commit()
 
+			open, err := openCircuits(db, config.Webhooks.BreakerCooldown)
+			if err != nil {
+				log.WithError(err).Warn("Failed to query the circuits of the webhook endpoints")
+			}
+			busy := false
 			for _, hook := range hooks {
+				if until, ok := open[endpointKey{hook.InstanceID, hook.URL}]; ok {
+					log.Infof("Circuit of %v is open, postponing hook %v until %v", hook.URL, hook.ID, until)
+					hook.postpone(db, &until)
+					continue
+				}
+				if !limiter.acquire(hook.URL) {
+					// picked up again once a delivery to the endpoint is done
+					hook.postpone(db, hook.RunAfter)
+					busy = true
+					continue
+				}
 				sem <- true
+				wg.Add(1)
 				go func(hook *Hook) {
-					resp, err := hook.Trigger(client, log, secret)
+					defer wg.Done()
+					defer limiter.release(hook.URL)
+					started := time.Now()
+					var resp *http.Response
+					var err error
+					switch {
+					case strings.HasPrefix(hook.URL, SinkURLPrefix):
+						err = hook.Publish(eventSinks[hook.URL], log, config.Timeouts.Webhooks)
+					case hook.SubscriptionID != "":
+						resp, err = hook.TriggerSubscription(db, client, log)
+					default:
+						resp, err = hook.Trigger(client, log, instanceSecrets(db, hook, config, secrets)...)
+					}
+					latency := time.Since(started)
 					hook.LockedAt = nil
 					hook.LockedBy = nil
 					tx := db.Begin()
-					if err != nil || !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-						hook.handleError(tx, log, resp, err)
+					if err != nil || (resp != nil && !(resp.StatusCode >= 200 && resp.StatusCode < 300)) {
+						hook.handleError(tx, log, config, resp, err)
 					} else {
 						hook.handleSuccess(tx, log, resp)
 					}
+					hook.recordAttempt(tx, log, resp, latency)
 					tx.Commit()
+					if resp != nil && resp.Body != nil {
+						resp.Body.Close()
+					}
 					<-sem
 				}(hook)
 			}
 
-			time.Sleep(5 * time.Second)
+			var freed <-chan struct{}
+			if busy {
+				freed = limiter.freed
+			}
+			select {
+			case <-done:
+				return
+			case <-freed:
+			case <-time.After(5 * time.Second):
+			}
 		}
 	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		for _, sink := range eventSinks {
+			if closer, ok := sink.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}
 }
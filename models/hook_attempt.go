@@ -0,0 +1,52 @@
+package models
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+)
+
+// maxAttemptBody is how much of a response body is kept with an attempt
+const maxAttemptBody = 4096
+
+// HookAttempt records one delivery of a hook
+type HookAttempt struct {
+	ID     uint64 `json:"id"`
+	HookID uint64 `json:"hook_id" sql:"index"`
+	Try    int    `json:"try"`
+
+	StatusCode   int    `json:"status_code,omitempty"`
+	Error        string `json:"error,omitempty"`
+	ResponseBody string `json:"response_body,omitempty" sql:"type:text"`
+	// LatencyMs is how long the consumer took to respond, in milliseconds
+	LatencyMs int64 `json:"latency_ms"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (HookAttempt) TableName() string {
+	return tableName("hook_attempts")
+}
+
+func (h *Hook) recordAttempt(db *gorm.DB, log *logrus.Entry, resp *http.Response, latency time.Duration) {
+	attempt := &HookAttempt{
+		HookID:    h.ID,
+		Try:       h.Tries,
+		LatencyMs: int64(latency / time.Millisecond),
+	}
+	if resp != nil {
+		attempt.StatusCode = resp.StatusCode
+		attempt.ResponseBody = h.ResponseBody
+		if len(attempt.ResponseBody) > maxAttemptBody {
+			attempt.ResponseBody = attempt.ResponseBody[:maxAttemptBody]
+		}
+	}
+	if h.ErrorMessage != nil {
+		attempt.Error = *h.ErrorMessage
+	}
+	if err := db.Create(attempt).Error; err != nil {
+		log.WithError(err).Warnf("Failed to record the delivery of hook %v", h.ID)
+	}
+}
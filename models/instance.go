@@ -0,0 +1,138 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// instanceIDKey is the gorm setting that scopes the queries of a handle to
+// an instance
+const instanceIDKey = "gocommerce:instance_id"
+
+// Instance is a store served by a deployment in multi-instance mode. Its
+// requests are told apart by their hostname, and its config overrides the
+// configuration of the deployment for them.
+type Instance struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname" sql:"unique_index"`
+
+	// Config holds the settings of the instance, in the same shape as the
+	// configuration file, like its JWT secret and payment keys
+	Config    map[string]interface{} `json:"config" sql:"-"`
+	RawConfig string                 `json:"-" sql:"type:text"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-" sql:"index"`
+}
+
+func (Instance) TableName() string {
+	return tableName("instances")
+}
+
+func (i *Instance) BeforeSave() error {
+	data, err := json.Marshal(i.Config)
+	if err != nil {
+		return err
+	}
+	i.RawConfig = string(data)
+	return nil
+}
+
+func (i *Instance) AfterFind() error {
+	if i.RawConfig != "" {
+		return json.Unmarshal([]byte(i.RawConfig), &i.Config)
+	}
+	return nil
+}
+
+// Configuration is the configuration of the deployment with the settings of
+// the instance on top
+func (i *Instance) Configuration(base *conf.Configuration) (*conf.Configuration, error) {
+	// the base is copied through JSON, so its maps and slices aren't shared
+	data, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+	config := new(conf.Configuration)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if i.RawConfig != "" {
+		if err := json.Unmarshal([]byte(i.RawConfig), config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// FindInstance finds an instance by its ID or its hostname, it returns nil
+// if there's none
+func FindInstance(db *gorm.DB, idOrHostname string) (*Instance, error) {
+	instance := &Instance{}
+	rsp := db.Where("id = ? OR hostname = ?", idOrHostname, strings.ToLower(idOrHostname)).First(instance)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return instance, nil
+}
+
+// ForInstance scopes the queries of a database handle to an instance. The
+// records of the models with an InstanceID are only found for their own
+// instance, and created for it.
+func ForInstance(db *gorm.DB, instanceID string) *gorm.DB {
+	return db.Set(instanceIDKey, instanceID)
+}
+
+// registerInstanceCallbacks adds the scope of ForInstance to the queries,
+// updates, deletes and creates of gorm
+func registerInstanceCallbacks(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:create").Register("gocommerce:instance", setInstanceID)
+	callbacks.Query().Before("gorm:query").Register("gocommerce:instance", whereInstance)
+	callbacks.RowQuery().Before("gorm:row_query").Register("gocommerce:instance", whereInstance)
+	callbacks.Update().Before("gorm:update").Register("gocommerce:instance", whereInstance)
+	callbacks.Delete().Before("gorm:delete").Register("gocommerce:instance", whereInstance)
+}
+
+// instanceOf returns the instance the queries of a handle are scoped to, ""
+// for the deployment itself. The models keyed by their instance look their
+// records up with it, also without an instance, so the deployment's own
+// records aren't mixed up with those of the instances.
+func instanceOf(db *gorm.DB) string {
+	if id, ok := db.Get(instanceIDKey); ok {
+		return id.(string)
+	}
+	return ""
+}
+
+func scopeInstanceID(scope *gorm.Scope) (string, bool) {
+	id, ok := scope.Get(instanceIDKey)
+	if !ok || id.(string) == "" {
+		return "", false
+	}
+	if _, ok := scope.FieldByName("InstanceID"); !ok {
+		return "", false
+	}
+	return id.(string), true
+}
+
+func setInstanceID(scope *gorm.Scope) {
+	if id, ok := scopeInstanceID(scope); ok {
+		scope.SetColumn("InstanceID", id)
+	}
+}
+
+func whereInstance(scope *gorm.Scope) {
+	if id, ok := scopeInstanceID(scope); ok {
+		scope.Search.Where(scope.QuotedTableName()+".instance_id = ?", id)
+	}
+}
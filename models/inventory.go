@@ -0,0 +1,151 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// InventoryItem holds the stock of a SKU. Only SKUs with an inventory item
+// are tracked, everything else can be ordered in any quantity. Every instance
+// tracks its own stock.
+type InventoryItem struct {
+	// the SKU goes first, gorm only matches the primary keys of a record
+	// when the first one is set, and the deployment has no instance
+	Sku        string `json:"sku" gorm:"primary_key"`
+	InstanceID string `json:"-" gorm:"primary_key"`
+	Quantity   int64  `json:"quantity"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (InventoryItem) TableName() string {
+	return tableName("inventory_items")
+}
+
+// OutOfStockError is returned when there isn't enough stock of a SKU
+type OutOfStockError struct {
+	Sku string
+}
+
+func (e *OutOfStockError) Error() string {
+	return fmt.Sprintf("Not enough stock of %v", e.Sku)
+}
+
+// DecrementInventory takes quantity units of a SKU out of stock. It returns an
+// OutOfStockError when the SKU is tracked and there isn't enough left.
+func DecrementInventory(tx *gorm.DB, sku string, quantity uint64) error {
+	instanceID := instanceOf(tx)
+	rsp := tx.Model(InventoryItem{}).
+		Where("instance_id = ? AND sku = ? AND quantity >= ?", instanceID, sku, quantity).
+		UpdateColumn("quantity", gorm.Expr("quantity - ?", quantity))
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	if rsp.RowsAffected > 0 {
+		return nil
+	}
+
+	var count int
+	if err := tx.Model(InventoryItem{}).Where("instance_id = ? AND sku = ?", instanceID, sku).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return &OutOfStockError{Sku: sku}
+	}
+	return nil
+}
+
+// RestockInventory puts quantity units of a SKU back in stock, if it is tracked
+func RestockInventory(tx *gorm.DB, sku string, quantity uint64) error {
+	return tx.Model(InventoryItem{}).
+		Where("instance_id = ? AND sku = ?", instanceOf(tx), sku).
+		UpdateColumn("quantity", gorm.Expr("quantity + ?", quantity)).Error
+}
+
+// SetInventory sets the stock of a SKU, which starts tracking it if it wasn't
+// tracked before. It returns the item as it was before too, nil if the SKU
+// wasn't tracked.
+func SetInventory(tx *gorm.DB, sku string, quantity int64) (*InventoryItem, *InventoryItem, error) {
+	instanceID := instanceOf(tx)
+	item := &InventoryItem{}
+	rsp := tx.First(item, "instance_id = ? AND sku = ?", instanceID, sku)
+	if rsp.RecordNotFound() {
+		item = &InventoryItem{InstanceID: instanceID, Sku: sku, Quantity: quantity}
+		return item, nil, tx.Create(item).Error
+	}
+	if rsp.Error != nil {
+		return nil, nil, rsp.Error
+	}
+
+	before := *item
+	item.Quantity = quantity
+	item.UpdatedAt = time.Now()
+	err := tx.Model(InventoryItem{}).
+		Where("instance_id = ? AND sku = ?", instanceID, sku).
+		UpdateColumns(map[string]interface{}{"quantity": item.Quantity, "updated_at": item.UpdatedAt}).Error
+	return item, &before, err
+}
+
+// stockOf scopes tx to the stock of the order's instance. An order that
+// isn't saved yet takes the instance of tx.
+func (o *Order) stockOf(tx *gorm.DB) *gorm.DB {
+	if o.InstanceID != "" {
+		return ForInstance(tx, o.InstanceID)
+	}
+	return tx
+}
+
+// stockedItems calls fn with every SKU an order takes out of stock. Kits are
+// stocked by their components.
+func (o *Order) stockedItems(fn func(sku string, quantity uint64) error) error {
+	for _, item := range o.LineItems {
+		if !item.IsKit() {
+			if err := fn(item.Sku, item.Quantity); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, component := range item.Components {
+			if err := fn(component.Sku, component.Quantity*item.Quantity); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReserveInventory takes everything in the order out of the stock of its
+// instance
+func (o *Order) ReserveInventory(tx *gorm.DB) error {
+	tx = o.stockOf(tx)
+	return o.stockedItems(func(sku string, quantity uint64) error {
+		return DecrementInventory(tx, sku, quantity)
+	})
+}
+
+// TrackedInventory returns the stock of the tracked SKUs in the order
+func (o *Order) TrackedInventory(tx *gorm.DB) ([]InventoryItem, error) {
+	skus := []string{}
+	o.stockedItems(func(sku string, quantity uint64) error {
+		skus = append(skus, sku)
+		return nil
+	})
+	items := []InventoryItem{}
+	if len(skus) == 0 {
+		return items, nil
+	}
+	tx = o.stockOf(tx)
+	err := tx.Where("instance_id = ? AND sku IN (?)", instanceOf(tx), skus).Order("sku asc").Find(&items).Error
+	return items, err
+}
+
+// ReleaseInventory puts everything in the order back in stock
+func (o *Order) ReleaseInventory(tx *gorm.DB) error {
+	tx = o.stockOf(tx)
+	return o.stockedItems(func(sku string, quantity uint64) error {
+		return RestockInventory(tx, sku, quantity)
+	})
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// InvoiceSeries hands out the invoice numbers of a series without gaps. The
+// last number is counted up in the transaction of the payment, so a payment
+// that's rolled back gives its number back, and the row stays locked until
+// the payment is recorded.
+type InvoiceSeries struct {
+	ID         uint64 `gorm:"primary_key"`
+	InstanceID string `sql:"unique_index:idx_invoice_series"`
+	Prefix     string `sql:"unique_index:idx_invoice_series"`
+	LastNumber uint64
+	UpdatedAt  time.Time
+}
+
+// TableName returns the database table name for the InvoiceSeries model.
+func (InvoiceSeries) TableName() string {
+	return tableName("invoice_series")
+}
+
+// NextInvoiceNumber takes the next number of the series of the instance
+func NextInvoiceNumber(tx *gorm.DB, instanceID, prefix string) (uint64, error) {
+	rsp := countUpInvoiceSeries(tx, instanceID, prefix)
+	if rsp.Error == nil && rsp.RowsAffected == 0 {
+		if err := createInvoiceSeries(tx, instanceID, prefix); err != nil {
+			return 0, err
+		}
+		rsp = countUpInvoiceSeries(tx, instanceID, prefix)
+	}
+	if rsp.Error != nil {
+		return 0, rsp.Error
+	}
+	series := &InvoiceSeries{}
+	if err := tx.First(series, "instance_id = ? AND prefix = ?", instanceID, prefix).Error; err != nil {
+		return 0, err
+	}
+	return series.LastNumber, nil
+}
+
+func countUpInvoiceSeries(tx *gorm.DB, instanceID, prefix string) *gorm.DB {
+	return tx.Model(&InvoiceSeries{}).
+		Where("instance_id = ? AND prefix = ?", instanceID, prefix).
+		UpdateColumn("last_number", gorm.Expr("last_number + 1"))
+}
+
+// createInvoiceSeries starts the series at 0 unless it's there. The first
+// payments of a series can get here at the same time, the one that doesn't
+// insert the row waits for the other one and counts up after it.
+func createInvoiceSeries(tx *gorm.DB, instanceID, prefix string) error {
+	table := InvoiceSeries{}.TableName()
+	columns := " (instance_id, prefix, last_number, updated_at) "
+	now := time.Now()
+	switch Dialect(tx) {
+	case "mysql":
+		return tx.Exec("INSERT IGNORE INTO "+table+columns+"VALUES (?, ?, 0, ?)", instanceID, prefix, now).Error
+	case MSSQL:
+		return tx.Exec("INSERT INTO "+table+columns+"SELECT ?, ?, 0, ? WHERE NOT EXISTS "+
+			"(SELECT 1 FROM "+table+" WITH (UPDLOCK, HOLDLOCK) WHERE instance_id = ? AND prefix = ?)",
+			instanceID, prefix, now, instanceID, prefix).Error
+	}
+	return tx.Exec("INSERT INTO "+table+columns+"VALUES (?, ?, 0, ?) ON CONFLICT (instance_id, prefix) DO NOTHING",
+		instanceID, prefix, now).Error
+}
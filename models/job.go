@@ -0,0 +1,126 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// jobLockTimeout is how long a job stays locked by a worker that stopped
+// before it's picked up by another one
+const jobLockTimeout = 5 * time.Minute
+
+// Job is background work queued for the workers, like the side effects of
+// an event. Jobs that ran are deleted, the ones that failed for good are
+// kept to be looked into.
+type Job struct {
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+
+	// Type tells the workers how to run the job
+	Type string `json:"type"`
+	// Payload is the JSON encoded input of the job
+	Payload string `json:"payload" sql:"type:text"`
+
+	Failed       bool    `json:"failed"`
+	Tries        int     `json:"tries"`
+	ErrorMessage *string `json:"error_message,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	RunAfter  *time.Time `json:"run_after,omitempty"`
+	LockedAt  *time.Time `json:"-"`
+	LockedBy  *string    `json:"-"`
+}
+
+func (Job) TableName() string {
+	return tableName("jobs")
+}
+
+// NewJob creates a job of a type with its payload encoded as JSON
+func NewJob(jobType, instanceID string, payload interface{}) (*Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Job{Type: jobType, InstanceID: instanceID, Payload: string(data)}, nil
+}
+
+// Decode decodes the payload of the job into v
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), v)
+}
+
+// LockJobs locks up to limit of the queued jobs that are due for the worker
+// called lockedBy, and returns them. Jobs another worker is locking at the
+// same time are skipped rather than waited for.
+func LockJobs(db *gorm.DB, lockedBy string, now time.Time, limit int) ([]*Job, error) {
+	isDue := func(db *gorm.DB) *gorm.DB {
+		return db.Where("failed = ? AND (locked_at IS NULL OR locked_at < ?) AND (run_after IS NULL OR run_after < ?)",
+			false, now.Add(-jobLockTimeout), now)
+	}
+	due := []*Job{}
+	tx := db.Begin()
+	if rsp := isDue(dueJobs(tx)).Select("id").Order("id").Limit(limit).Find(&due); rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	if len(due) == 0 {
+		return due, tx.Commit().Error
+	}
+
+	ids := make([]uint64, len(due))
+	for i, job := range due {
+		ids[i] = job.ID
+	}
+	// the jobs are checked again, for the databases that can't lock them
+	// when they're selected
+	rsp := isDue(tx.Table(Job{}.TableName()).Where("id IN (?)", ids)).
+		Updates(map[string]interface{}{"locked_at": now, "locked_by": lockedBy})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	jobs := []*Job{}
+	if rsp := tx.Where("id IN (?) AND locked_by = ?", ids, lockedBy).Order("id").Find(&jobs); rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	return jobs, tx.Commit().Error
+}
+
+// dueJobs selects jobs for update, skipping the rows other transactions
+// have locked
+func dueJobs(tx *gorm.DB) *gorm.DB {
+	switch Dialect(tx) {
+	case "postgres", "mysql", CockroachDB:
+		return tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED")
+	case MSSQL:
+		return tx.Table(Job{}.TableName() + " WITH (UPDLOCK, READPAST, ROWLOCK)")
+	}
+	// sqlite locks the whole database for the transaction
+	return tx
+}
+
+// Done removes a job that ran from the queue
+func (j *Job) Done(db *gorm.DB) error {
+	return db.Delete(j).Error
+}
+
+// Fail records a failed run. Jobs that can be retried are run again,
+// waiting twice as long after every try starting at period and at most
+// maxPeriod, until they failed maxTries times.
+func (j *Job) Fail(db *gorm.DB, err error, retry bool, now time.Time, maxTries int, period, maxPeriod time.Duration) error {
+	j.Tries++
+	message := err.Error()
+	j.ErrorMessage = &message
+	j.LockedAt = nil
+	j.LockedBy = nil
+	if retry && j.Tries < maxTries {
+		runAfter := now.Add(retryDelay(j.Tries, period, maxPeriod))
+		j.RunAfter = &runAfter
+	} else {
+		j.Failed = true
+	}
+	return db.Save(j).Error
+}
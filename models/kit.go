@@ -0,0 +1,118 @@
+package models
+
+import (
+	"time"
+
+	"github.com/netlify/gocommerce/calculator"
+)
+
+// ComponentMetaItem describes one of the products making up a kit
+type ComponentMetaItem struct {
+	Sku      string          `json:"sku"`
+	Title    string          `json:"title"`
+	Type     string          `json:"type"`
+	Quantity uint64          `json:"quantity"`
+	Prices   []PriceMetadata `json:"prices"`
+}
+
+// LineItemComponent is a component of a kit line item. Kits are priced as a
+// whole, but each component is stocked and fulfilled on its own.
+type LineItemComponent struct {
+	ID         int64  `json:"id"`
+	OrderID    string `json:"order_id"`
+	LineItemID int64  `json:"line_item_id" sql:"index"`
+
+	Sku   string `json:"sku"`
+	Title string `json:"title"`
+	Type  string `json:"type"`
+
+	// Quantity is the number of units in a single kit
+	Quantity uint64 `json:"quantity"`
+	// Price is the share of the kit price allocated to this component
+	Price uint64 `json:"price"`
+
+	FulfillmentState string     `json:"fulfillment_state"`
+	ShippedAt        *time.Time `json:"shipped_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (LineItemComponent) TableName() string {
+	return tableName("line_item_components")
+}
+
+// IsKit is true when the line item is made up of components
+func (i *LineItem) IsKit() bool {
+	return len(i.Components) > 0
+}
+
+// processComponents sets up the components of a kit and allocates the kit
+// price across them, in proportion to what the components cost on their own.
+// Unless the kit prices list their own items, the allocation is what taxes are
+// calculated on.
+func (i *LineItem) processComponents(order *Order, components []ComponentMetaItem) error {
+	weights := make([]uint64, len(components))
+	for index, component := range components {
+		if component.Quantity == 0 {
+			components[index].Quantity = 1
+		}
+		if len(component.Prices) == 0 {
+			continue
+		}
+		lowestPrice, err := determineLowestPrice(component.Prices, order.Currency)
+		if err != nil {
+			return err
+		}
+		weights[index] = lowestPrice.cents * components[index].Quantity
+	}
+
+	shares := calculator.Allocate(i.Price, weights)
+	explicitItems := len(i.PriceItems) > 0
+	i.Components = make([]*LineItemComponent, len(components))
+	for index, component := range components {
+		i.Components[index] = &LineItemComponent{
+			OrderID:          order.ID,
+			Sku:              component.Sku,
+			Title:            component.Title,
+			Type:             component.Type,
+			Quantity:         component.Quantity,
+			Price:            shares[index],
+			FulfillmentState: PendingState,
+		}
+		if !explicitItems {
+			i.PriceItems = append(i.PriceItems, &PriceItem{Amount: shares[index], Type: component.Type})
+		}
+	}
+
+	return nil
+}
+
+// UpdateFulfillmentState derives the fulfillment state of an order from the
+// state of its kit components. Orders that also have regular line items are
+// only marked as shipping, shipping the rest is up to whoever fulfills them.
+func (o *Order) UpdateFulfillmentState() {
+	components, shipped := 0, 0
+	onlyKits := true
+	for _, item := range o.LineItems {
+		if !item.IsKit() {
+			onlyKits = false
+			continue
+		}
+		for _, component := range item.Components {
+			components++
+			if component.FulfillmentState == ShippedState {
+				shipped++
+			}
+		}
+	}
+
+	switch {
+	case shipped == 0:
+		return
+	case shipped == components && onlyKits:
+		o.FulfillmentState = ShippedState
+	case o.FulfillmentState == PendingState:
+		o.FulfillmentState = ShippingState
+	}
+}
@@ -11,8 +11,9 @@ import (
 )
 
 type LineItem struct {
-	ID      int64  `json:"id"`
-	OrderID string `json:"-"`
+	ID         int64  `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+	OrderID    string `json:"-" sql:"index"`
 
 	Title       string `json:"title"`
 	Sku         string `json:"sku"`
@@ -30,6 +31,8 @@ type LineItem struct {
 
 	Quantity uint64 `json:"quantity"`
 
+	Components []*LineItemComponent `json:"components,omitempty"`
+
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-"`
 
@@ -132,6 +135,8 @@ type LineItemMetadata struct {
 	Downloads []Download      `json:"downloads"`
 	Addons    []AddonMetaItem `json:"addons"`
 
+	Components []ComponentMetaItem `json:"components"`
+
 	Webhook string `json:"webhook"`
 }
 
@@ -210,6 +215,10 @@ func (i *LineItem) Process(order *Order, meta *LineItemMetadata) error {
 		return err
 	}
 
+	if len(meta.Components) > 0 {
+		return i.processComponents(order, meta.Components)
+	}
+
 	return nil
 }
 
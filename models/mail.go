@@ -0,0 +1,100 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// mailLockTimeout is how long a mail stays locked by a sender that stopped
+// before it's picked up by another one
+const mailLockTimeout = 5 * time.Minute
+
+// Mail is a mail in the queue of outgoing mails. Mails that fail because of
+// a temporary problem of the mail provider are tried again later.
+type Mail struct {
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+
+	// OrderID is the order the mail is about, if any
+	OrderID string `json:"order_id,omitempty" sql:"index"`
+	// Type is the name of the mail, like order_confirmation
+	Type string `json:"type"`
+
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Bcc     string `json:"bcc,omitempty"`
+	Subject string `json:"subject"`
+	HTML    string `json:"-" sql:"type:text"`
+	Text    string `json:"-" sql:"type:text"`
+	// Attachments are the JSON encoded attachments of the mail
+	Attachments string `json:"-" sql:"type:text"`
+
+	Done   bool `json:"done"`
+	Failed bool `json:"failed"`
+	Tries  int  `json:"tries"`
+
+	// MessageID is the ID the mail provider gave the mail
+	MessageID    string  `json:"message_id,omitempty"`
+	ErrorMessage *string `json:"error_message,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	RunAfter  *time.Time `json:"run_after,omitempty"`
+	LockedAt  *time.Time `json:"-"`
+	LockedBy  *string    `json:"-"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+}
+
+func (Mail) TableName() string {
+	return tableName("mails")
+}
+
+// LockMails locks the queued mails that are due for the sender called
+// lockedBy, and returns them
+func LockMails(db *gorm.DB, lockedBy string, now time.Time) ([]*Mail, error) {
+	mails := []*Mail{}
+	tx := db.Begin()
+	rsp := tx.Table(Mail{}.TableName()).
+		Where("done = ? AND (locked_at IS NULL OR locked_at < ?) AND (run_after IS NULL OR run_after < ?)", false, now.Add(-mailLockTimeout), now).
+		Updates(map[string]interface{}{"locked_at": now, "locked_by": lockedBy})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	if rsp := tx.Where("locked_by = ? AND done = ?", lockedBy, false).Find(&mails); rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	return mails, tx.Commit().Error
+}
+
+// Sent records that the provider accepted the mail
+func (m *Mail) Sent(db *gorm.DB, messageID string, now time.Time) error {
+	m.Tries++
+	m.Done = true
+	m.MessageID = messageID
+	m.ErrorMessage = nil
+	m.SentAt = &now
+	m.LockedAt = nil
+	m.LockedBy = nil
+	return db.Save(m).Error
+}
+
+// Fail records a failed try. Mails with a temporary failure are tried again,
+// waiting twice as long after every try starting at period and at most
+// maxPeriod, until they failed maxTries times.
+func (m *Mail) Fail(db *gorm.DB, err error, temporary bool, now time.Time, maxTries int, period, maxPeriod time.Duration) error {
+	m.Tries++
+	message := err.Error()
+	m.ErrorMessage = &message
+	m.LockedAt = nil
+	m.LockedBy = nil
+	if temporary && m.Tries < maxTries {
+		runAfter := now.Add(retryDelay(m.Tries, period, maxPeriod))
+		m.RunAfter = &runAfter
+	} else {
+		m.Done = true
+		m.Failed = true
+	}
+	return db.Save(m).Error
+}
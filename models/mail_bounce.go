@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// MailBounce is a mail the mail provider reported as bounced or as spam
+type MailBounce struct {
+	ID         int64  `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+
+	Email     string `json:"email" sql:"index"`
+	Type      string `json:"type"`
+	Reason    string `json:"reason,omitempty"`
+	Provider  string `json:"provider"`
+	MessageID string `json:"message_id,omitempty"`
+
+	BouncedAt time.Time `json:"bounced_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (MailBounce) TableName() string {
+	return tableName("mail_bounces")
+}
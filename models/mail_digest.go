@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MailDigest is a day the order digest was sent for
+type MailDigest struct {
+	// Day is like 2006-01-02, after the instance ID and a slash for the
+	// digests of instances
+	Day       string    `json:"day" gorm:"primary_key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (MailDigest) TableName() string {
+	return tableName("mail_digests")
+}
+
+// mailDigestDay is the key of the digest of a day for the instance, if any
+func mailDigestDay(instanceID, day string) string {
+	if instanceID != "" {
+		return instanceID + "/" + day
+	}
+	return day
+}
+
+// ClaimMailDigest records that the digest of a day is sent for the instance,
+// if any. It returns false if it was sent already, also by another process.
+func ClaimMailDigest(db *gorm.DB, instanceID, day string) (bool, error) {
+	day = mailDigestDay(instanceID, day)
+	if err := db.Create(&MailDigest{Day: day}).Error; err != nil {
+		count := 0
+		if countErr := db.Model(&MailDigest{}).Where("day = ?", day).Count(&count).Error; countErr == nil && count > 0 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// ReleaseMailDigest gives up the claim on the digest of a day that couldn't
+// be sent, so it's tried again
+func ReleaseMailDigest(db *gorm.DB, instanceID, day string) error {
+	return db.Where("day = ?", mailDigestDay(instanceID, day)).Delete(&MailDigest{}).Error
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MailOptOut is an address that doesn't want to get reminders anymore from
+// an instance
+type MailOptOut struct {
+	Email      string    `json:"email" gorm:"primary_key"`
+	InstanceID string    `json:"-" gorm:"primary_key"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (MailOptOut) TableName() string {
+	return tableName("mail_opt_outs")
+}
+
+// OptOut stops the reminders to an address
+func OptOut(db *gorm.DB, email string) error {
+	instanceID, email := instanceOf(db), strings.ToLower(email)
+	return db.Where("instance_id = ? AND email = ?", instanceID, email).
+		Attrs(MailOptOut{InstanceID: instanceID, Email: email}).
+		FirstOrCreate(&MailOptOut{}).Error
+}
+
+// OptedOut checks if an address opted out of reminders
+func OptedOut(db *gorm.DB, email string) (bool, error) {
+	count := 0
+	err := db.Model(&MailOptOut{}).Where("instance_id = ? AND email = ?", instanceOf(db), strings.ToLower(email)).Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MailSuppression is an address no mails are sent to anymore, because mails
+// to it bounced for good, were marked as spam or the recipient unsubscribed
+// with the mail provider. Every instance has its own list.
+type MailSuppression struct {
+	Email      string `json:"email" gorm:"primary_key"`
+	InstanceID string `json:"-" gorm:"primary_key"`
+	// Reason is the type of the bounce that suppressed the address
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (MailSuppression) TableName() string {
+	return tableName("mail_suppressions")
+}
+
+// Suppress stops the mails to an address and returns its suppression. An
+// address that is suppressed already keeps its first reason.
+func Suppress(db *gorm.DB, email, reason string) (*MailSuppression, error) {
+	instanceID, email := instanceOf(db), strings.ToLower(email)
+	suppression := &MailSuppression{}
+	err := db.Where("instance_id = ? AND email = ?", instanceID, email).
+		Attrs(MailSuppression{InstanceID: instanceID, Email: email, Reason: reason}).
+		FirstOrCreate(suppression).Error
+	return suppression, err
+}
+
+// Unsuppress sends mails to an address again. It tells if the address was
+// suppressed.
+func Unsuppress(db *gorm.DB, email string) (bool, error) {
+	rsp := db.Where("instance_id = ? AND email = ?", instanceOf(db), strings.ToLower(email)).Delete(&MailSuppression{})
+	return rsp.RowsAffected > 0, rsp.Error
+}
+
+// Suppressed checks if mails to an address are suppressed
+func Suppressed(db *gorm.DB, email string) (bool, error) {
+	count := 0
+	err := db.Model(&MailSuppression{}).Where("instance_id = ? AND email = ?", instanceOf(db), strings.ToLower(email)).Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,266 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// SchemaVersion is the version of the schema the models expect, the version
+// of the last migration
+var SchemaVersion = migrations[len(migrations)-1].Version
+
+// MigrationLockTimeout is how long to wait for another instance to finish
+// migrating before giving up
+const MigrationLockTimeout = 5 * time.Minute
+
+const migrationLockPoll = time.Second
+
+// Migration changes the schema from the version before it to its Version.
+// Down reverts it, migrations without one can't be reverted.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records a migration to a schema version
+type SchemaMigration struct {
+	ID        uint64
+	Version   int
+	Name      string
+	CreatedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return tableName("schema_migrations")
+}
+
+// MigrationStatus tells if a migration was applied to the database
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// Migrate brings the schema up to date by applying the migrations after the
+// current version in order, each in a transaction. It holds a database lock
+// while migrating, so instances booting at the same time don't race each
+// other.
+func Migrate(db *gorm.DB) error {
+	return MigrateTo(db, SchemaVersion)
+}
+
+// MigrateTo applies the migrations up to version
+func MigrateTo(db *gorm.DB, version int) error {
+	return withMigrationLock(db, func() error {
+		if err := db.AutoMigrate(SchemaMigration{}).Error; err != nil {
+			return err
+		}
+		current, err := CurrentSchemaVersion(db)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			if migration.Version <= current || migration.Version > version {
+				continue
+			}
+			if err := runMigration(db, migration.Up, func(tx *gorm.DB) error {
+				return tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name}).Error
+			}); err != nil {
+				return errors.Wrapf(err, "migrating to version %d (%s)", migration.Version, migration.Name)
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback reverts the migrations after version, the latest first
+func Rollback(db *gorm.DB, version int) error {
+	return withMigrationLock(db, func() error {
+		current, err := CurrentSchemaVersion(db)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0; i-- {
+			migration := migrations[i]
+			if migration.Version > current || migration.Version <= version {
+				continue
+			}
+			if migration.Down == nil {
+				return fmt.Errorf("the migration to version %d (%s) can't be reverted", migration.Version, migration.Name)
+			}
+			if err := runMigration(db, migration.Down, func(tx *gorm.DB) error {
+				return tx.Where("version >= ?", migration.Version).Delete(SchemaMigration{}).Error
+			}); err != nil {
+				return errors.Wrapf(err, "reverting version %d (%s)", migration.Version, migration.Name)
+			}
+		}
+		return nil
+	})
+}
+
+// Migrations lists the migrations and whether they were applied
+func Migrations(db *gorm.DB) ([]MigrationStatus, error) {
+	current, err := CurrentSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		statuses[i] = MigrationStatus{Migration: migration, Applied: migration.Version <= current}
+	}
+	return statuses, nil
+}
+
+// runMigration makes a change to the schema and records it in one
+// transaction. CockroachDB runs schema changes in the background once their
+// transaction commits, and rejects writes in the same transaction after
+// them, so there the change is committed before it's recorded.
+func runMigration(db *gorm.DB, change func(tx *gorm.DB) error, record func(tx *gorm.DB) error) error {
+	if Dialect(db) == CockroachDB {
+		if err := change(db); err != nil {
+			return err
+		}
+		return record(db)
+	}
+
+	tx := db.Begin()
+	if err := change(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// CurrentSchemaVersion returns the version the database was last migrated to,
+// 0 if it has never been migrated
+func CurrentSchemaVersion(db *gorm.DB) (int, error) {
+	if !db.HasTable(SchemaMigration{}) {
+		return 0, nil
+	}
+
+	var version sql.NullInt64
+	if err := db.Model(SchemaMigration{}).Select("max(version)").Row().Scan(&version); err != nil {
+		return 0, errors.Wrap(err, "querying schema version")
+	}
+	return int(version.Int64), nil
+}
+
+// CheckSchemaVersion returns an error if the database hasn't been migrated
+// to the schema the models expect
+func CheckSchemaVersion(db *gorm.DB) error {
+	current, err := CurrentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current < SchemaVersion {
+		return fmt.Errorf("database schema is at version %d but version %d is required, run `gocommerce migrate`", current, SchemaVersion)
+	}
+	return nil
+}
+
+// withMigrationLock runs fn while holding an advisory lock. SQLite locks the
+// whole database on writes, so it doesn't need one, and CockroachDB has no
+// advisory locks, so it locks a row instead.
+func withMigrationLock(db *gorm.DB, fn func() error) error {
+	name := tableName("schema_migrations")
+	var lock, unlock string
+	var key interface{}
+	switch Dialect(db) {
+	case CockroachDB:
+		return withMigrationLockRow(db, name, fn)
+	case "postgres":
+		hash := fnv.New64a()
+		hash.Write([]byte(name))
+		key = int64(hash.Sum64())
+		lock = "SELECT pg_try_advisory_lock($1)"
+		unlock = "SELECT pg_advisory_unlock($1)"
+	case "mysql":
+		key = name
+		lock = "SELECT GET_LOCK(?, 0)"
+		unlock = "SELECT RELEASE_LOCK(?)"
+	case MSSQL:
+		key = name
+		lock = `DECLARE @result int;
+EXEC @result = sp_getapplock @Resource = ?, @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = 0;
+SELECT CASE WHEN @result >= 0 THEN 1 ELSE 0 END`
+		unlock = "EXEC sp_releaseapplock @Resource = ?, @LockOwner = 'Session'"
+	default:
+		return fn()
+	}
+
+	// advisory locks belong to a session, so lock and unlock on the same connection
+	ctx := context.Background()
+	conn, err := db.DB().Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting connection for migration lock")
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(MigrationLockTimeout)
+	for {
+		var acquired sql.NullBool
+		if err := conn.QueryRowContext(ctx, lock, key).Scan(&acquired); err != nil {
+			return errors.Wrap(err, "acquiring migration lock")
+		}
+		if acquired.Valid && acquired.Bool {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for migration lock after %v", MigrationLockTimeout)
+		}
+		time.Sleep(migrationLockPoll)
+	}
+	defer conn.ExecContext(ctx, unlock, key)
+
+	return fn()
+}
+
+// migrationLock is held by the instance that is migrating, on databases
+// without advisory locks
+type migrationLock struct {
+	Name     string `gorm:"primary_key"`
+	LockedAt time.Time
+}
+
+func (migrationLock) TableName() string {
+	return tableName("schema_migrations_lock")
+}
+
+// withMigrationLockRow runs fn while holding the lock row called name. The
+// row of an instance that died while migrating is taken over once it's
+// older than the lock timeout.
+func withMigrationLockRow(db *gorm.DB, name string, fn func() error) error {
+	if err := db.AutoMigrate(migrationLock{}).Error; err != nil {
+		return errors.Wrap(err, "creating migration lock table")
+	}
+
+	deadline := time.Now().Add(MigrationLockTimeout)
+	for {
+		stale := time.Now().Add(-MigrationLockTimeout)
+		if err := db.Where("name = ? AND locked_at < ?", name, stale).Delete(migrationLock{}).Error; err != nil {
+			return errors.Wrap(err, "clearing stale migration lock")
+		}
+		err := db.Create(&migrationLock{Name: name, LockedAt: time.Now()}).Error
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(err, "timed out waiting for migration lock after %v", MigrationLockTimeout)
+		}
+		time.Sleep(migrationLockPoll)
+	}
+	defer db.Where("name = ?", name).Delete(migrationLock{})
+
+	return fn()
+}
@@ -2,16 +2,54 @@ package models
 
 import (
 	"encoding/json"
+	"math"
 	"time"
 
+	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
 	"github.com/pborman/uuid"
 )
 
 const PendingState = "pending"
 const PaidState = "paid"
+const ShippingState = "shipping"
 const ShippedState = "shipped"
 const FailedState = "failed"
+const CancelledState = "cancelled"
+
+// ProcessingState is the status of a charge while the payment provider is
+// charging it
+const ProcessingState = "processing"
+
+// ManualReviewState is the payment state of an order the fraud scoring held
+// for a review instead of charging it
+const ManualReviewState = "manual_review"
+
+// States of the VAT number of an order
+const (
+	VATPendingState = "vat_pending"
+	VATValidState   = "vat_valid"
+	VATInvalidState = "vat_invalid"
+)
+
+// Location evidence of the digital sales to EU consumers
+const (
+	// LocationConsistent orders have two pieces of evidence of the country
+	// they were taxed for
+	LocationConsistent = "consistent"
+	// LocationConflicting orders have evidence of another country, and not
+	// two of the country they were taxed for
+	LocationConflicting = "conflicting"
+	// LocationInsufficient orders have less than two pieces of evidence
+	LocationInsufficient = "insufficient"
+)
+
+// Reviews of the orders held by the fraud scoring
+const (
+	ApprovedReview = "approved"
+	RejectedReview = "rejected"
+)
 
 // NumberType | StringType | BoolType are the different types supported in custom data for orders
 const (
@@ -22,11 +60,21 @@ const (
 
 type Order struct {
 	ID string `json:"id"`
+	// InstanceID is the store of the order in multi-instance mode
+	InstanceID string `json:"-" sql:"index"`
+
+	// Ref is the short public reference of the order, used instead of the ID
+	// in status URLs and emails. Orders without one get their ID as ref.
+	Ref string `json:"ref,omitempty" sql:"unique_index"`
+
+	// InvoiceNumber is given to the order when it's paid, from the invoice
+	// series of the country it's taxed for
+	InvoiceNumber string `json:"invoice_number,omitempty" sql:"index"`
 
 	IP string `json:"ip"`
 
 	User      *User  `json:"user,omitempty"`
-	UserID    string `json:"user_id,omitempty"`
+	UserID    string `json:"user_id,omitempty" sql:"index:idx_orders_user_id_created_at"`
 	SessionID string `json:"-"`
 
 	Email string `json:"email"`
@@ -43,12 +91,41 @@ type Order struct {
 
 	Total uint64 `json:"total"`
 
+	// SettlementCurrency is the currency the shop books its sales in, when
+	// it's set the amounts of the order are stored converted to it at the
+	// ExchangeRate of when the order was placed
+	SettlementCurrency string  `json:"settlement_currency,omitempty"`
+	ExchangeRate       float64 `json:"exchange_rate,omitempty"`
+	SettlementSubTotal uint64  `json:"settlement_subtotal,omitempty"`
+	SettlementTaxes    uint64  `json:"settlement_taxes,omitempty"`
+	SettlementDiscount uint64  `json:"settlement_discount,omitempty"`
+	SettlementTotal    uint64  `json:"settlement_total,omitempty"`
+
 	PaymentState     string `json:"payment_state"`
 	FulfillmentState string `json:"fulfillment_state"`
-	State            string `json:"state"`
+	State            string `json:"state" sql:"index:idx_orders_state_created_at"`
+
+	// Carrier, TrackingNumber and TrackingURL are recorded when the order
+	// ships, and are sent to the customer with the shipping confirmation
+	Carrier        string `json:"carrier,omitempty"`
+	TrackingNumber string `json:"tracking_number,omitempty"`
+	TrackingURL    string `json:"tracking_url,omitempty"`
+
+	// ReminderSentAt is when the customer was reminded of the unpaid order
+	ReminderSentAt *time.Time `json:"reminder_sent_at,omitempty"`
 
 	PaymentProcessor string `json:"payment_processor"`
 
+	// RiskScore and RiskReasons are the fraud score of the order when it was
+	// held for a review, and Review is what the review decided. Customers
+	// don't get to see them, staff do with the review of the order.
+	RiskScore   int    `json:"-"`
+	RiskReasons string `json:"-"`
+	Review      string `json:"-"`
+
+	CancellationReason string     `json:"cancellation_reason,omitempty"`
+	CancelledAt        *time.Time `json:"cancelled_at,omitempty"`
+
 	Transactions []*Transaction `json:"transactions"`
 	Notes        []*OrderNote   `json:"notes"`
 
@@ -59,18 +136,45 @@ type Order struct {
 	BillingAddressID string  `json:"billing_address_id"`
 
 	VATNumber string `json:"vatnumber"`
+	// VATState tells if VIES confirmed the VAT number, it's vat_pending
+	// while VIES couldn't be reached
+	VATState string `json:"vat_state,omitempty" sql:"index"`
+
+	// TaxBasis is the address, shipping or billing, whose country the order
+	// was taxed for
+	TaxBasis   string `json:"tax_basis,omitempty"`
+	TaxCountry string `json:"tax_country,omitempty"`
+
+	// IPCountry and CardCountry are evidence of where the customer is, with
+	// the billing address. LocationEvidence tells if they support the tax
+	// country of a digital sale to an EU consumer.
+	IPCountry        string `json:"ip_country,omitempty"`
+	CardCountry      string `json:"card_country,omitempty"`
+	LocationEvidence string `json:"location_evidence,omitempty" sql:"index"`
 
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-"`
 
 	CouponCode string `json:"coupon_code,omitempty"`
 
+	// Experiment and Variant label orders placed during an A/B test on the storefront
+	Experiment string `json:"experiment,omitempty" sql:"index"`
+	Variant    string `json:"variant,omitempty"`
+
+	// TestMode orders were placed with test payment credentials, they can be
+	// purged before going live
+	TestMode bool `json:"test_mode,omitempty" sql:"index"`
+
+	// AnonymizedAt is when the personal data was removed from the order by
+	// the retention policy
+	AnonymizedAt *time.Time `json:"anonymized_at,omitempty"`
+
 	Coupon    *Coupon `json:"coupon,omitempty" sql:"-"`
 	RawCoupon string  `json:"-"`
 
-	CreatedAt time.Time  `json:"created_at"`
+	CreatedAt time.Time  `json:"created_at" sql:"index:idx_orders_user_id_created_at,idx_orders_state_created_at,idx_orders_created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
-	DeletedAt *time.Time `json:"-",sql:"index"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" sql:"index"`
 }
 
 func (Order) TableName() string {
@@ -95,6 +199,15 @@ func (o *Order) AfterFind() error {
 	return nil
 }
 
+// BeforeCreate gives an order without a reference its ID as one, refs are
+// unique
+func (o *Order) BeforeCreate() error {
+	if o.Ref == "" {
+		o.Ref = o.ID
+	}
+	return nil
+}
+
 func (o *Order) BeforeUpdate() error {
 	if o.MetaData != nil {
 		data, err := json.Marshal(o.MetaData)
@@ -127,13 +240,28 @@ func NewOrder(sessionID, email, currency string) *Order {
 	return order
 }
 
+// SetTaxBasis picks the address, billing or shipping, taxes are calculated for
+func (o *Order) SetTaxBasis(basis string) {
+	o.TaxBasis = basis
+	if basis == conf.BillingTaxBasis {
+		o.TaxCountry = o.BillingAddress.Country
+	} else {
+		o.TaxCountry = o.ShippingAddress.Country
+	}
+}
+
 func (o *Order) CalculateTotal(settings *calculator.Settings) {
+	country := o.TaxCountry
+	if country == "" {
+		country = o.ShippingAddress.Country
+	}
+
 	items := make([]calculator.Item, len(o.LineItems))
 	for i, item := range o.LineItems {
 		items[i] = item
 	}
 
-	price := calculator.CalculatePrice(settings, o.ShippingAddress.Country, o.Currency, o.Coupon, items)
+	price := calculator.CalculatePrice(settings, country, o.Currency, o.Coupon, items)
 
 	o.SubTotal = price.Subtotal
 	o.Taxes = price.Taxes
@@ -141,6 +269,20 @@ func (o *Order) CalculateTotal(settings *calculator.Settings) {
 	o.Total = price.Total
 }
 
+// SetSettlement converts the amounts of the order to the settlement currency,
+// rate is the units of it for one unit of the order's currency
+func (o *Order) SetSettlement(currency string, rate float64) {
+	convert := func(amount uint64) uint64 {
+		return uint64(math.Round(float64(amount) * rate))
+	}
+	o.SettlementCurrency = currency
+	o.ExchangeRate = rate
+	o.SettlementSubTotal = convert(o.SubTotal)
+	o.SettlementTaxes = convert(o.Taxes)
+	o.SettlementDiscount = convert(o.Discount)
+	o.SettlementTotal = convert(o.Total)
+}
+
 func inList(list []string, candidate string) bool {
 	for _, item := range list {
 		if item == candidate {
@@ -149,3 +291,32 @@ func inList(list []string, candidate string) bool {
 	}
 	return false
 }
+
+// LockOrder locks the row of an order until tx ends, so concurrent changes
+// to the order wait for each other. Databases without SELECT ... FOR UPDATE
+// take the same lock with an update that changes nothing.
+func LockOrder(tx *gorm.DB, id string) *gorm.DB {
+	switch Dialect(tx) {
+	case "postgres", "mysql", CockroachDB:
+		return tx.Set("gorm:query_option", "FOR UPDATE").Select("id").First(&Order{}, "id = ?", id)
+	}
+	if rsp := tx.Model(&Order{}).Where("id = ?", id).UpdateColumn("id", gorm.Expr("id")); rsp.Error != nil {
+		return rsp
+	}
+	return tx.Select("id").First(&Order{}, "id = ?", id)
+}
+
+// OrderRefTaken tells if an order has the reference already, in any instance
+// and deleted or not
+func OrderRefTaken(db *gorm.DB, ref string) (bool, error) {
+	count := 0
+	err := ForInstance(db, "").Unscoped().Model(&Order{}).Where("ref = ?", ref).Count(&count).Error
+	return count > 0, err
+}
+
+// CountOrdersByEmail counts the orders placed with the email address since then
+func CountOrdersByEmail(db *gorm.DB, email string, since time.Time) (int, error) {
+	count := 0
+	err := db.Model(&Order{}).Where("email = ? AND created_at > ?", email, since).Count(&count).Error
+	return count, err
+}
@@ -3,9 +3,11 @@ package models
 import "time"
 
 type OrderNote struct {
-	ID int64 `json:"-"`
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"index"`
 
-	UserID string `json:"user_id"`
+	UserID  string `json:"user_id"`
+	OrderID string `json:"-" sql:"index"`
 
 	Text string `json:"text"`
 
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// OrderNumber hands out sequential order numbers. Only their obfuscated form,
+// the order's Ref, is ever shown. The instances share the sequence, so
+// instances with the same ref salt don't hand out the same refs, and every
+// number records the instance it was taken for.
+type OrderNumber struct {
+	ID         uint64 `gorm:"primary_key"`
+	InstanceID string `sql:"index"`
+	CreatedAt  time.Time
+}
+
+func (OrderNumber) TableName() string {
+	return tableName("order_numbers")
+}
+
+// NextOrderNumber takes the next number from the sequence
+func NextOrderNumber(tx *gorm.DB) (uint64, error) {
+	number := &OrderNumber{}
+	if err := tx.Create(number).Error; err != nil {
+		return 0, err
+	}
+	return number.ID, nil
+}
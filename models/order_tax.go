@@ -0,0 +1,56 @@
+package models
+
+import (
+	"github.com/netlify/gocommerce/calculator"
+)
+
+// OrderTax is the part of an order's products of one type taxed at one rate
+// in the country it was taxed for, the way the calculator split the taxes
+// when it was placed
+type OrderTax struct {
+	ID         uint64 `json:"-" gorm:"primary_key"`
+	InstanceID string `json:"-"`
+	OrderID    string `json:"order_id" sql:"index"`
+	Country    string `json:"country"`
+	Type       string `json:"type"`
+	Percentage uint64 `json:"percentage"`
+	Net        uint64 `json:"net"`
+	Taxes      uint64 `json:"taxes"`
+}
+
+// TableName returns the database table name for the OrderTax model.
+func (OrderTax) TableName() string {
+	return tableName("order_taxes")
+}
+
+// TaxesByRate splits the taxes of the order by product type and rate, the
+// way CalculateTotal taxes its items
+func (o *Order) TaxesByRate(settings *calculator.Settings) []*OrderTax {
+	country := o.TaxCountry
+	if country == "" {
+		country = o.ShippingAddress.Country
+	}
+	types := []string{}
+	items := map[string][]calculator.Item{}
+	for _, item := range o.LineItems {
+		if _, ok := items[item.Type]; !ok {
+			types = append(types, item.Type)
+		}
+		items[item.Type] = append(items[item.Type], item)
+	}
+
+	taxes := []*OrderTax{}
+	for _, t := range types {
+		for _, total := range calculator.TaxesByRate(settings, country, items[t]) {
+			taxes = append(taxes, &OrderTax{
+				OrderID:    o.ID,
+				Country:    country,
+				Type:       t,
+				Percentage: total.Percentage,
+				Net:        total.Net,
+				Taxes:      total.Taxes,
+			})
+		}
+	}
+	return taxes
+}
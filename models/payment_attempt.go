@@ -0,0 +1,101 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// PaymentAttempt records a charge sent to a payment processor, so attempts
+// can be throttled by order, user and IP address
+type PaymentAttempt struct {
+	ID       string `json:"id"`
+	OrderID  string `json:"order_id" sql:"index"`
+	UserID   string `json:"user_id,omitempty" sql:"index"`
+	IP       string `json:"ip,omitempty" sql:"index"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+	Failed   bool   `json:"failed"`
+
+	CreatedAt time.Time `json:"created_at" sql:"index"`
+}
+
+// TableName returns the database table name for the PaymentAttempt model.
+func (PaymentAttempt) TableName() string {
+	return tableName("payment_attempts")
+}
+
+// NewPaymentAttempt records an attempt to charge amount for the order
+func NewPaymentAttempt(order *Order, ip string, amount uint64) *PaymentAttempt {
+	return &PaymentAttempt{
+		ID:       uuid.NewRandom().String(),
+		OrderID:  order.ID,
+		UserID:   order.UserID,
+		IP:       ip,
+		Amount:   amount,
+		Currency: order.Currency,
+	}
+}
+
+// CountPaymentAttempts counts the attempts made since then with the column,
+// like order_id or ip, set to value
+func CountPaymentAttempts(db *gorm.DB, column, value string, since time.Time) (int, error) {
+	count := 0
+	rsp := db.Model(&PaymentAttempt{}).Where(column+" = ? AND created_at > ?", value, since).Count(&count)
+	return count, rsp.Error
+}
+
+// CountSmallFailures counts the failed attempts of at most maxAmount made
+// since then with the column, like user_id or ip, set to value. A burst of
+// them is what card testing looks like.
+func CountSmallFailures(db *gorm.DB, column, value string, maxAmount uint64, since time.Time) (int, error) {
+	count := 0
+	rsp := db.Model(&PaymentAttempt{}).
+		Where(column+" = ? AND failed = ? AND amount <= ? AND created_at > ?", value, true, maxAmount, since).
+		Count(&count)
+	return count, rsp.Error
+}
+
+// PaymentAttemptKey is a row for every user and IP address that made payment
+// attempts, and for every coupon redeemed. The limits of a user, IP address
+// or coupon are checked with its row locked, so payments of different orders
+// are counted one after the other.
+type PaymentAttemptKey struct {
+	ID        string `gorm:"primary_key"`
+	UpdatedAt time.Time
+}
+
+// TableName returns the database table name for the PaymentAttemptKey model.
+func (PaymentAttemptKey) TableName() string {
+	return tableName("payment_attempt_keys")
+}
+
+// LockPaymentAttempts locks the attempts with the column, like user_id or ip,
+// set to value until the transaction ends
+func LockPaymentAttempts(tx *gorm.DB, column, value string) error {
+	return lockPaymentAttemptKey(tx, column+":"+value)
+}
+
+// lockPaymentAttemptKey locks the row of the key until the transaction ends
+func lockPaymentAttemptKey(tx *gorm.DB, id string) error {
+	if err := createPaymentAttemptKey(tx, id); err != nil {
+		return err
+	}
+	return tx.Model(&PaymentAttemptKey{}).Where("id = ?", id).UpdateColumn("updated_at", time.Now()).Error
+}
+
+// createPaymentAttemptKey inserts the row of the key unless it's there, the
+// first attempts of a key can get here at the same time.
+func createPaymentAttemptKey(tx *gorm.DB, id string) error {
+	table := PaymentAttemptKey{}.TableName()
+	now := time.Now()
+	switch Dialect(tx) {
+	case "mysql":
+		return tx.Exec("INSERT IGNORE INTO "+table+" (id, updated_at) VALUES (?, ?)", id, now).Error
+	case MSSQL:
+		return tx.Exec("INSERT INTO "+table+" (id, updated_at) SELECT ?, ? WHERE NOT EXISTS "+
+			"(SELECT 1 FROM "+table+" WITH (UPDLOCK, HOLDLOCK) WHERE id = ?)", id, now, id).Error
+	}
+	return tx.Exec("INSERT INTO "+table+" (id, updated_at) VALUES (?, ?) ON CONFLICT (id) DO NOTHING", id, now).Error
+}
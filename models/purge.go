@@ -0,0 +1,100 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PurgeResult counts the records removed by a purge, or the records that
+// would be removed on a dry run
+type PurgeResult struct {
+	Orders            int  `json:"orders"`
+	LineItems         int  `json:"line_items"`
+	Components        int  `json:"components"`
+	Downloads         int  `json:"downloads"`
+	Transactions      int  `json:"transactions"`
+	Taxes             int  `json:"taxes"`
+	Events            int  `json:"events"`
+	Notes             int  `json:"notes"`
+	Mails             int  `json:"mails"`
+	Hooks             int  `json:"hooks"`
+	HookAttempts      int  `json:"hook_attempts"`
+	PaymentAttempts   int  `json:"payment_attempts"`
+	CouponRedemptions int  `json:"coupon_redemptions"`
+	ReferralCredits   int  `json:"referral_credits"`
+	Addresses         int  `json:"addresses"`
+	DryRun            bool `json:"dry_run"`
+}
+
+// PurgeTestOrders permanently deletes the orders placed in test mode, along
+// with every record about them, like their line items, transactions, mails,
+// hooks, events and coupon redemptions. Their addresses go too, unless an order that isn't a test
+// order or a user's address book still has them. With dryRun set nothing is
+// deleted, it only counts what would be.
+func PurgeTestOrders(db *gorm.DB, dryRun bool) (*PurgeResult, error) {
+	result := &PurgeResult{DryRun: dryRun}
+	orders := Order{}.TableName()
+	testOrders := "order_id IN (SELECT id FROM " + orders + " WHERE test_mode = ?)"
+	testHooks := "hook_id IN (SELECT id FROM " + Hook{}.TableName() + " WHERE " + testOrders + ")"
+	// like unsharedAddressIDs, for the addresses of every test order
+	orderAddress := func(column, mode string) string {
+		return "SELECT " + column + " FROM " + orders + " WHERE " + column + " IS NOT NULL AND test_mode " + mode + " ?"
+	}
+	testAddresses := "(id IN (" + orderAddress("shipping_address_id", "=") + ") OR id IN (" + orderAddress("billing_address_id", "=") + "))" +
+		" AND (user_id = '' OR user_id IS NULL)" +
+		" AND id NOT IN (" + orderAddress("shipping_address_id", "<>") + ") AND id NOT IN (" + orderAddress("billing_address_id", "<>") + ")"
+
+	tx := db.Begin()
+	for _, table := range []struct {
+		model interface{}
+		where string
+		count *int
+	}{
+		{LineItemComponent{}, testOrders, &result.Components},
+		{LineItem{}, testOrders, &result.LineItems},
+		{Download{}, testOrders, &result.Downloads},
+		{Transaction{}, testOrders, &result.Transactions},
+		{OrderTax{}, testOrders, &result.Taxes},
+		{Event{}, testOrders, &result.Events},
+		{OrderNote{}, testOrders, &result.Notes},
+		{Mail{}, testOrders, &result.Mails},
+		{HookAttempt{}, testHooks, &result.HookAttempts},
+		{Hook{}, testOrders, &result.Hooks},
+		{PaymentAttempt{}, testOrders, &result.PaymentAttempts},
+		// test checkouts don't use up coupons or earn credit once live
+		{CouponRedemption{}, testOrders, &result.CouponRedemptions},
+		{ReferralCredit{}, testOrders, &result.ReferralCredits},
+		{Address{}, testAddresses, &result.Addresses},
+		{Order{}, "test_mode = ?", &result.Orders},
+	} {
+		query := tx.Unscoped().Model(table.model).Where(table.where, testModeArgs(table.where)...)
+		if err := query.Count(table.count).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if dryRun {
+			continue
+		}
+		if err := query.Delete(table.model).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		tx.Rollback()
+		return result, nil
+	}
+	return result, tx.Commit().Error
+}
+
+// testModeArgs binds every placeholder of a condition to true, they all
+// compare test_mode
+func testModeArgs(where string) []interface{} {
+	args := []interface{}{}
+	for i := strings.Count(where, "?"); i > 0; i-- {
+		args = append(args, true)
+	}
+	return args
+}
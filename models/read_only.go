@@ -0,0 +1,27 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// IsReadOnlyError checks if a database error was caused by writing to a
+// read-only database, like a replica during a failover.
+func IsReadOnlyError(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *pq.Error:
+		// read_only_sql_transaction
+		return e.Code == "25006"
+	case *mysql.MySQLError:
+		// ER_OPTION_PREVENTS_STATEMENT (--read-only) and ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION
+		return e.Number == 1290 || e.Number == 1792
+	case sqlite3.Error:
+		return e.Code == sqlite3.ErrReadonly
+	}
+	return strings.Contains(err.Error(), "read-only") || strings.Contains(err.Error(), "readonly")
+}
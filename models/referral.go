@@ -0,0 +1,112 @@
+package models
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// ReferralCodePrefix starts the codes of referral coupons
+const ReferralCodePrefix = "REF-"
+
+// referralCodeAlphabet leaves out the letters and digits that look alike
+const referralCodeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// NewReferralCoupon makes the referral code of a customer, a coupon taking
+// the discount off the orders of the customers they refer. Each customer
+// can use it once.
+func NewReferralCoupon(userID string, discount uint64) (*Coupon, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	code := []byte(ReferralCodePrefix)
+	for _, b := range random {
+		code = append(code, referralCodeAlphabet[int(b)%len(referralCodeAlphabet)])
+	}
+	return &Coupon{
+		ID:             uuid.NewRandom().String(),
+		Code:           string(code),
+		Percentage:     discount,
+		MaxUsesPerUser: 1,
+		ReferrerID:     userID,
+	}, nil
+}
+
+// ReferralCredit is the store credit a customer earned with an order paid
+// with their referral code. Reversed is the part of it taken back because
+// the order was refunded or cancelled.
+type ReferralCredit struct {
+	ID         uint64    `json:"-" gorm:"primary_key"`
+	InstanceID string    `json:"-"`
+	UserID     string    `json:"user_id" sql:"index"`
+	OrderID    string    `json:"order_id" sql:"unique_index"`
+	Code       string    `json:"code"`
+	Amount     uint64    `json:"amount"`
+	Reversed   uint64    `json:"reversed,omitempty"`
+	Currency   string    `json:"currency"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the ReferralCredit model.
+func (ReferralCredit) TableName() string {
+	return tableName("referral_credits")
+}
+
+// ReferralCredits sums up the credit of the user by currency, less what was
+// reversed
+func ReferralCredits(db *gorm.DB, userID string) (map[string]uint64, error) {
+	rows, err := db.Model(&ReferralCredit{}).
+		Select("currency, sum(amount - reversed)").
+		Where("user_id = ?", userID).
+		Group("currency").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	credits := map[string]uint64{}
+	for rows.Next() {
+		var currency string
+		var amount uint64
+		if err := rows.Scan(&currency, &amount); err != nil {
+			return nil, err
+		}
+		credits[currency] = amount
+	}
+	return credits, rows.Err()
+}
+
+// ReverseReferralCredit takes back the credit earned with the order in the
+// share of its total that was refunded, all of it once refunded is the total
+func ReverseReferralCredit(tx *gorm.DB, order *Order, refunded uint64) error {
+	credit := &ReferralCredit{}
+	rsp := tx.First(credit, "order_id = ?", order.ID)
+	if rsp.RecordNotFound() {
+		return nil
+	}
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	reversed := credit.Amount
+	if refunded < order.Total {
+		reversed = credit.Amount * refunded / order.Total
+	}
+	return tx.Model(credit).UpdateColumn("reversed", reversed).Error
+}
+
+// CountPaidOrders counts the paid orders of the user or of the email, so
+// customers who paid as guests before count too
+func CountPaidOrders(db *gorm.DB, userID, email string) (int, error) {
+	query := db.Model(&Order{}).Where("payment_state = ?", PaidState)
+	if userID != "" {
+		query = query.Where("user_id = ? OR lower(email) = lower(?)", userID, email)
+	} else {
+		query = query.Where("lower(email) = lower(?)", email)
+	}
+	count := 0
+	err := query.Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ExpiredOrders finds up to limit orders placed before cutoff, deleted ones
+// included. With anonymized set, the orders that were anonymized already
+// are left out.
+func ExpiredOrders(db *gorm.DB, cutoff time.Time, anonymized bool, limit int) ([]*Order, error) {
+	query := expiredOrders(db, cutoff, anonymized).
+		Preload("LineItems", unscoped).
+		Preload("LineItems.Components", unscoped).
+		Preload("Downloads", unscoped).
+		Preload("ShippingAddress", unscoped).
+		Preload("BillingAddress", unscoped).
+		Preload("Transactions", unscoped)
+
+	orders := []*Order{}
+	if err := query.Order("created_at asc").Limit(limit).Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// CountExpiredOrders counts the orders ExpiredOrders would find without a
+// limit
+func CountExpiredOrders(db *gorm.DB, cutoff time.Time, anonymized bool) (int, error) {
+	count := 0
+	err := expiredOrders(db, cutoff, anonymized).Model(&Order{}).Count(&count).Error
+	return count, err
+}
+
+func expiredOrders(db *gorm.DB, cutoff time.Time, anonymized bool) *gorm.DB {
+	query := db.Unscoped().Where("created_at < ?", cutoff)
+	if anonymized {
+		query = query.Where("anonymized_at IS NULL")
+	}
+	return query
+}
+
+func unscoped(db *gorm.DB) *gorm.DB {
+	return db.Unscoped()
+}
+
+// DeleteOrdersPermanently removes orders from the database, along with every
+// record about them, like their line items, transactions, mails, hooks and
+// events. Their addresses go too, unless another order or a user's address
+// book still has them.
+func DeleteOrdersPermanently(tx *gorm.DB, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	addressIDs, err := orderAddressIDs(tx, ids)
+	if err != nil {
+		return err
+	}
+
+	hooks := "hook_id IN (SELECT id FROM " + Hook{}.TableName() + " WHERE order_id IN (?))"
+	if err := tx.Unscoped().Where(hooks, ids).Delete(HookAttempt{}).Error; err != nil {
+		return err
+	}
+	for _, model := range []interface{}{
+		LineItemComponent{}, LineItem{}, Download{}, Transaction{}, OrderTax{}, Event{}, OrderNote{},
+		Mail{}, Hook{}, PaymentAttempt{}, CouponRedemption{}, ReferralCredit{},
+	} {
+		if err := tx.Unscoped().Where("order_id IN (?)", ids).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Unscoped().Where("id IN (?)", ids).Delete(Order{}).Error; err != nil {
+		return err
+	}
+
+	addressIDs, err = unsharedAddressIDs(tx, addressIDs, ids)
+	if err != nil || len(addressIDs) == 0 {
+		return err
+	}
+	return tx.Unscoped().Where("id IN (?)", addressIDs).Delete(Address{}).Error
+}
+
+// orderAddressIDs lists the shipping and billing addresses of the orders
+func orderAddressIDs(tx *gorm.DB, ids []string) ([]string, error) {
+	orders := []*Order{}
+	err := tx.Unscoped().Select("shipping_address_id, billing_address_id").Where("id IN (?)", ids).Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	addressIDs := []string{}
+	for _, order := range orders {
+		addressIDs = appendAddressIDs(addressIDs, order)
+	}
+	return addressIDs, nil
+}
+
+func appendAddressIDs(addressIDs []string, order *Order) []string {
+	for _, id := range []string{order.ShippingAddressID, order.BillingAddressID} {
+		if id != "" {
+			addressIDs = append(addressIDs, id)
+		}
+	}
+	return addressIDs
+}
+
+// unsharedAddressIDs filters addresses down to the ones no order but the
+// given ones has, and no user saved
+func unsharedAddressIDs(tx *gorm.DB, addressIDs, orderIDs []string) ([]string, error) {
+	if len(addressIDs) == 0 {
+		return nil, nil
+	}
+	orders := Order{}.TableName()
+	used := func(column string) string {
+		return "id NOT IN (SELECT " + column + " FROM " + orders + " WHERE " + column + " IS NOT NULL AND id NOT IN (?))"
+	}
+	unshared := []string{}
+	err := tx.Unscoped().Model(&Address{}).
+		Where("id IN (?) AND (user_id = ? OR user_id IS NULL)", addressIDs, "").
+		Where(used("shipping_address_id"), orderIDs).
+		Where(used("billing_address_id"), orderIDs).
+		Pluck("id", &unshared).Error
+	return unshared, err
+}
+
+// AnonymizeOrders strips the personal data from orders and keeps what the
+// books need, like the amounts, the taxes and the countries they were
+// taxed for. Their addresses lose everything but the country and state,
+// unless another order or a user's address book still has them, and their
+// events lose the IP.
+func AnonymizeOrders(tx *gorm.DB, orders []*Order, now time.Time) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	ids := []string{}
+	addressIDs := []string{}
+	for _, order := range orders {
+		ids = append(ids, order.ID)
+		addressIDs = appendAddressIDs(addressIDs, order)
+	}
+	addressIDs, err := unsharedAddressIDs(tx, addressIDs, ids)
+	if err != nil {
+		return err
+	}
+
+	rsp := tx.Unscoped().Model(&Order{}).Where("id IN (?)", ids).UpdateColumns(map[string]interface{}{
+		"email":         "",
+		"ip":            "",
+		"session_id":    "",
+		"raw_meta_data": "",
+		"anonymized_at": now,
+	})
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	if len(addressIDs) > 0 {
+		rsp = tx.Unscoped().Model(&Address{}).Where("id IN (?)", addressIDs).UpdateColumns(map[string]interface{}{
+			"first_name": "",
+			"last_name":  "",
+			"company":    "",
+			"address1":   "",
+			"address2":   "",
+			"city":       "",
+			"zip":        "",
+		})
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return tx.Unscoped().Model(&Event{}).Where("order_id IN (?)", ids).UpdateColumn("ip", "").Error
+}
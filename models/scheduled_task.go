@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ScheduledTask records the runs of a recurring task, so it runs once per
+// interval with any number of processes
+type ScheduledTask struct {
+	Name string `json:"name" gorm:"primary_key"`
+
+	NextRunAt    time.Time  `json:"next_run_at"`
+	LastRunAt    *time.Time `json:"last_run_at,omitempty"`
+	ErrorMessage *string    `json:"error_message,omitempty"`
+
+	LockedAt *time.Time `json:"-"`
+	LockedBy *string    `json:"-"`
+}
+
+func (ScheduledTask) TableName() string {
+	return tableName("scheduled_tasks")
+}
+
+// ClaimScheduledTask locks the task called name for lockedBy if it's due,
+// and tells if it did. A lock older than lockTimeout is taken over, its
+// process is assumed to be gone.
+func ClaimScheduledTask(db *gorm.DB, name, lockedBy string, now time.Time, lockTimeout time.Duration) (bool, error) {
+	task := &ScheduledTask{}
+	rsp := db.Where("name = ?", name).First(task)
+	if rsp.RecordNotFound() {
+		// another process may create it at the same time, only one of
+		// them claims it below
+		db.Create(&ScheduledTask{Name: name, NextRunAt: now})
+	} else if rsp.Error != nil {
+		return false, rsp.Error
+	}
+
+	rsp = db.Model(&ScheduledTask{}).
+		Where("name = ? AND next_run_at <= ? AND (locked_at IS NULL OR locked_at < ?)", name, now, now.Add(-lockTimeout)).
+		Updates(map[string]interface{}{"locked_at": now, "locked_by": lockedBy})
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	return rsp.RowsAffected == 1, nil
+}
+
+// FinishScheduledTask records a run of the task claimed by lockedBy, with
+// its error if it failed, and unlocks it until next
+func FinishScheduledTask(db *gorm.DB, name, lockedBy string, now, next time.Time, err error) error {
+	var message *string
+	if err != nil {
+		m := err.Error()
+		message = &m
+	}
+	return db.Model(&ScheduledTask{}).
+		Where("name = ? AND locked_by = ?", name, lockedBy).
+		Updates(map[string]interface{}{
+			"next_run_at":   next,
+			"last_run_at":   now,
+			"error_message": message,
+			"locked_at":     nil,
+			"locked_by":     nil,
+		}).Error
+}
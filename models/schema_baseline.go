@@ -0,0 +1,406 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migrateBaseline creates the tables as they were when versioned migrations
+// were introduced. The types are frozen copies of the models of the time,
+// with their columns and indexes but not their relations, so the baseline
+// stays the same while the models change.
+func migrateBaseline(tx *gorm.DB) error {
+	type address struct {
+		ID         string
+		InstanceID string `sql:"index"`
+		UserID     string
+
+		FirstName string
+		LastName  string
+		Company   string
+		Address1  string
+		Address2  string
+		City      string
+		Country   string
+		State     string
+		Zip       string
+
+		CreatedAt time.Time
+		DeletedAt *time.Time
+	}
+
+	type lineItem struct {
+		ID         int64
+		InstanceID string `sql:"index"`
+		OrderID    string
+
+		Title       string
+		Sku         string
+		Type        string
+		Description string
+		Path        string
+
+		Price       uint64
+		VAT         uint64
+		AddonPrice  uint64
+		Quantity    uint64
+		RawMetaData string
+
+		CreatedAt time.Time
+		DeletedAt *time.Time
+	}
+
+	type lineItemComponent struct {
+		ID         int64
+		OrderID    string
+		LineItemID int64
+
+		Sku      string
+		Title    string
+		Type     string
+		Quantity uint64
+		Price    uint64
+
+		FulfillmentState string
+		ShippedAt        *time.Time
+
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}
+
+	type inventoryItem struct {
+		Sku      string `gorm:"primary_key"`
+		Quantity int64
+
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}
+
+	type addonItem struct {
+		ID          int64
+		Sku         string
+		Title       string
+		Description string
+		Price       uint64
+	}
+
+	type priceItem struct {
+		ID     int64
+		Amount uint64
+		Type   string
+		VAT    uint64
+	}
+
+	type hook struct {
+		ID             uint64
+		InstanceID     string `sql:"index"`
+		UserID         string
+		OrderID        string `sql:"index"`
+		Type           string
+		Done           bool
+		Failed         bool
+		URL            string
+		Payload        string
+		SubscriptionID string `sql:"index"`
+		Format         string
+		RequestID      string
+
+		ResponseStatus  string
+		ResponseHeaders string
+		ResponseBody    string
+		ErrorMessage    *string
+		Tries           int
+
+		CreatedAt   time.Time
+		RunAfter    *time.Time
+		LockedAt    *time.Time
+		LockedBy    *string
+		CompletedAt *time.Time
+	}
+
+	type hookAttempt struct {
+		ID           uint64
+		HookID       uint64 `sql:"index"`
+		Try          int
+		StatusCode   int
+		Error        string
+		ResponseBody string `sql:"type:text"`
+		LatencyMs    int64
+
+		CreatedAt time.Time
+	}
+
+	type webhookEndpoint struct {
+		URL string `gorm:"primary_key"`
+
+		ConsecutiveFailures int
+		Unhealthy           bool
+		UnhealthySince      *time.Time
+		LastError           string
+		LastFailureAt       *time.Time
+		LastSuccessAt       *time.Time
+
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}
+
+	type download struct {
+		ID         string
+		InstanceID string `sql:"index"`
+		OrderID    string
+		LineItemID int64
+
+		Title         string
+		Sku           string
+		Format        string
+		URL           string
+		DownloadCount uint64
+
+		CreatedAt time.Time
+		UpdatedAt time.Time
+		DeletedAt *time.Time
+	}
+
+	type order struct {
+		ID         string
+		InstanceID string `sql:"index"`
+		Ref        string `sql:"index"`
+
+		IP        string
+		UserID    string
+		SessionID string
+		Email     string
+
+		Currency string
+		Taxes    uint64
+		Shipping uint64
+		SubTotal uint64
+		Discount uint64
+		Total    uint64
+
+		PaymentState     string
+		FulfillmentState string
+		State            string
+
+		Carrier        string
+		TrackingNumber string
+		TrackingURL    string
+		ReminderSentAt *time.Time
+
+		PaymentProcessor   string
+		CancellationReason string
+		CancelledAt        *time.Time
+
+		ShippingAddressID string
+		BillingAddressID  string
+
+		VATNumber  string
+		TaxBasis   string
+		TaxCountry string
+
+		RawMetaData string
+		CouponCode  string
+		Experiment  string `sql:"index"`
+		Variant     string
+		TestMode    bool `sql:"index"`
+		RawCoupon   string
+
+		CreatedAt time.Time
+		UpdatedAt time.Time
+		DeletedAt *time.Time
+	}
+
+	type orderNumber struct {
+		ID        uint64 `gorm:"primary_key"`
+		CreatedAt time.Time
+	}
+
+	type orderNote struct {
+		ID         int64
+		InstanceID string `sql:"index"`
+		UserID     string
+		Text       string
+
+		CreatedAt time.Time
+		UpdatedAt time.Time
+		DeletedAt *time.Time
+	}
+
+	type transaction struct {
+		ID          string
+		InstanceID  string `sql:"index"`
+		OrderID     string
+		ProcessorID string
+		UserID      string
+
+		Amount   uint64
+		Currency string
+
+		FailureCode        string
+		FailureDescription string
+		Status             string
+		Type               string
+
+		Reason   string
+		Goodwill bool
+		Note     string
+		IssuedBy string
+
+		CreatedAt time.Time
+		DeletedAt *time.Time
+	}
+
+	type user struct {
+		ID         string
+		InstanceID string `sql:"index"`
+		Email      string
+
+		CreatedAt time.Time
+		UpdatedAt time.Time
+		DeletedAt *time.Time
+	}
+
+	type event struct {
+		ID         uint64
+		InstanceID string `sql:"index"`
+		IP         string
+		UserID     string
+		OrderID    string
+		Type       string
+		Changes    string
+
+		CreatedAt time.Time
+	}
+
+	type apiKey struct {
+		ID         string
+		InstanceID string `sql:"index"`
+		Name       string
+		Scope      string
+		Hint       string
+		KeyHash    string `sql:"unique_index"`
+
+		LastUsedAt *time.Time
+		CreatedAt  time.Time
+		UpdatedAt  time.Time
+		DeletedAt  *time.Time
+	}
+
+	type webhookSubscription struct {
+		ID          string
+		InstanceID  string `sql:"index"`
+		URL         string
+		Description string
+		Secret      string
+		RawEvents   string
+		Active      bool
+		Format      string
+
+		CreatedAt time.Time
+		UpdatedAt time.Time
+		DeletedAt *time.Time
+	}
+
+	type mailBounce struct {
+		ID         int64
+		InstanceID string `sql:"index"`
+		Email      string `sql:"index"`
+		Type       string
+		Reason     string
+		Provider   string
+		MessageID  string
+
+		BouncedAt time.Time
+		CreatedAt time.Time
+	}
+
+	type mailOptOut struct {
+		Email     string `gorm:"primary_key"`
+		CreatedAt time.Time
+	}
+
+	type mail struct {
+		ID         uint64
+		InstanceID string `sql:"index"`
+		OrderID    string `sql:"index"`
+		Type       string
+
+		From        string
+		To          string
+		Bcc         string
+		Subject     string
+		HTML        string `sql:"type:text"`
+		Text        string `sql:"type:text"`
+		Attachments string `sql:"type:text"`
+
+		Done         bool
+		Failed       bool
+		Tries        int
+		MessageID    string
+		ErrorMessage *string
+
+		CreatedAt time.Time
+		RunAfter  *time.Time
+		LockedAt  *time.Time
+		LockedBy  *string
+		SentAt    *time.Time
+	}
+
+	type mailDigest struct {
+		Day       string `gorm:"primary_key"`
+		CreatedAt time.Time
+	}
+
+	type mailSuppression struct {
+		Email     string `gorm:"primary_key"`
+		Reason    string
+		CreatedAt time.Time
+	}
+
+	type instance struct {
+		ID        string
+		Hostname  string `sql:"unique_index"`
+		RawConfig string `sql:"type:text"`
+
+		CreatedAt time.Time
+		UpdatedAt time.Time
+		DeletedAt *time.Time `sql:"index"`
+	}
+
+	tables := []struct {
+		name  string
+		model interface{}
+	}{
+		{Address{}.TableName(), &address{}},
+		{LineItem{}.TableName(), &lineItem{}},
+		{LineItemComponent{}.TableName(), &lineItemComponent{}},
+		{InventoryItem{}.TableName(), &inventoryItem{}},
+		{AddonItem{}.TableName(), &addonItem{}},
+		{PriceItem{}.TableName(), &priceItem{}},
+		{Hook{}.TableName(), &hook{}},
+		{HookAttempt{}.TableName(), &hookAttempt{}},
+		{WebhookEndpoint{}.TableName(), &webhookEndpoint{}},
+		{Download{}.TableName(), &download{}},
+		{Order{}.TableName(), &order{}},
+		{OrderNumber{}.TableName(), &orderNumber{}},
+		{OrderNote{}.TableName(), &orderNote{}},
+		{Transaction{}.TableName(), &transaction{}},
+		{User{}.TableName(), &user{}},
+		{Event{}.TableName(), &event{}},
+		{APIKey{}.TableName(), &apiKey{}},
+		{WebhookSubscription{}.TableName(), &webhookSubscription{}},
+		{MailBounce{}.TableName(), &mailBounce{}},
+		{MailOptOut{}.TableName(), &mailOptOut{}},
+		{Mail{}.TableName(), &mail{}},
+		{MailDigest{}.TableName(), &mailDigest{}},
+		{MailSuppression{}.TableName(), &mailSuppression{}},
+		{Instance{}.TableName(), &instance{}},
+	}
+	for _, table := range tables {
+		if err := migrateTable(tx, table.name, table.model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,602 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migrations are the changes to the schema, in the order of their versions.
+// A change to a model goes with a new migration at the end, which makes the
+// change with explicit steps, like migrateTable of the columns it adds or
+// DropColumn to revert it. Migrations declare the columns they add with types
+// of their own instead of using the models, which keep changing, so every
+// version creates the same schema. Migrations that were released never
+// change.
+var migrations = []Migration{
+	{
+		// The schema as it was when versioned migrations were introduced.
+		// Databases migrated before are at this version already.
+		Version: 20,
+		Name:    "baseline",
+		Up:      migrateBaseline,
+	},
+	{
+		Version: 21,
+		Name:    "index deleted_at of orders, users and addresses",
+		Up: func(tx *gorm.DB) error {
+			type deletedAt struct {
+				DeletedAt *time.Time `sql:"index"`
+			}
+			for _, table := range []string{Order{}.TableName(), User{}.TableName(), Address{}.TableName()} {
+				if err := migrateTable(tx, table, &deletedAt{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []string{Order{}.TableName(), User{}.TableName(), Address{}.TableName()} {
+				if err := tx.Table(table).RemoveIndex("idx_" + table + "_deleted_at").Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 22,
+		Name:    "audit logs",
+		Up: func(tx *gorm.DB) error {
+			type auditLog struct {
+				ID         uint64
+				InstanceID string `sql:"index"`
+				ActorType  string
+				ActorID    string `sql:"index"`
+				ActorEmail string
+				IP         string
+				Action     string `sql:"index"`
+				TargetType string
+				TargetID   string    `sql:"index"`
+				RawChanges string    `sql:"type:text"`
+				CreatedAt  time.Time `sql:"index"`
+			}
+			return migrateTable(tx, AuditLog{}.TableName(), &auditLog{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTable(AuditLog{}).Error
+		},
+	},
+	{
+		Version: 23,
+		Name:    "anonymized_at of orders",
+		Up: func(tx *gorm.DB) error {
+			type order struct {
+				AnonymizedAt *time.Time
+			}
+			return migrateTable(tx, Order{}.TableName(), &order{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Model(Order{}).DropColumn("anonymized_at").Error
+		},
+	},
+	{
+		Version: 24,
+		Name:    "indexes for listing orders and preloading their records",
+		Up: func(tx *gorm.DB) error {
+			type order struct {
+				UserID    string    `sql:"index:idx_orders_user_id_created_at"`
+				State     string    `sql:"index:idx_orders_state_created_at"`
+				CreatedAt time.Time `sql:"index:idx_orders_user_id_created_at,idx_orders_state_created_at,idx_orders_created_at"`
+			}
+			type orderID struct {
+				OrderID string `sql:"index"`
+			}
+			type lineItemComponent struct {
+				LineItemID int64 `sql:"index"`
+			}
+			if err := migrateTable(tx, Order{}.TableName(), &order{}); err != nil {
+				return err
+			}
+			for _, table := range []string{Transaction{}.TableName(), LineItem{}.TableName(), Download{}.TableName(), Event{}.TableName()} {
+				if err := migrateTable(tx, table, &orderID{}); err != nil {
+					return err
+				}
+			}
+			return migrateTable(tx, LineItemComponent{}.TableName(), &lineItemComponent{})
+		},
+		Down: func(tx *gorm.DB) error {
+			indexes := map[string][]string{
+				Order{}.TableName():             {"idx_orders_user_id_created_at", "idx_orders_state_created_at", "idx_orders_created_at"},
+				Transaction{}.TableName():       {"idx_" + Transaction{}.TableName() + "_order_id"},
+				LineItem{}.TableName():          {"idx_" + LineItem{}.TableName() + "_order_id"},
+				LineItemComponent{}.TableName(): {"idx_" + LineItemComponent{}.TableName() + "_line_item_id"},
+				Download{}.TableName():          {"idx_" + Download{}.TableName() + "_order_id"},
+				Event{}.TableName():             {"idx_" + Event{}.TableName() + "_order_id"},
+			}
+			for table, names := range indexes {
+				for _, name := range names {
+					if err := tx.Table(table).RemoveIndex(name).Error; err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 25,
+		Name:    "job queue",
+		Up: func(tx *gorm.DB) error {
+			type job struct {
+				ID           uint64
+				InstanceID   string `sql:"index"`
+				Type         string
+				Payload      string `sql:"type:text"`
+				Failed       bool
+				Tries        int
+				ErrorMessage *string
+				CreatedAt    time.Time
+				RunAfter     *time.Time
+				LockedAt     *time.Time
+				LockedBy     *string
+			}
+			return migrateTable(tx, Job{}.TableName(), &job{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTable(Job{}).Error
+		},
+	},
+	{
+		Version: 26,
+		Name:    "scheduled tasks",
+		Up: func(tx *gorm.DB) error {
+			type scheduledTask struct {
+				Name         string `gorm:"primary_key"`
+				NextRunAt    time.Time
+				LastRunAt    *time.Time
+				ErrorMessage *string
+				LockedAt     *time.Time
+				LockedBy     *string
+			}
+			return migrateTable(tx, ScheduledTask{}.TableName(), &scheduledTask{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTable(ScheduledTask{}).Error
+		},
+	},
+	{
+		Version: 27,
+		Name:    "payment attempts",
+		Up: func(tx *gorm.DB) error {
+			type paymentAttempt struct {
+				ID        string
+				OrderID   string `sql:"index"`
+				UserID    string `sql:"index"`
+				IP        string `sql:"index"`
+				Amount    uint64
+				Currency  string
+				Failed    bool
+				CreatedAt time.Time `sql:"index"`
+			}
+			return migrateTable(tx, PaymentAttempt{}.TableName(), &paymentAttempt{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTable(PaymentAttempt{}).Error
+		},
+	},
+	{
+		Version: 28,
+		Name:    "fraud review of orders",
+		Up: func(tx *gorm.DB) error {
+			type order struct {
+				RiskScore   int
+				RiskReasons string
+				Review      string
+			}
+			return migrateTable(tx, Order{}.TableName(), &order{})
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"risk_score", "risk_reasons", "review"} {
+				if err := tx.Model(Order{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 29,
+		Name:    "vat_state of orders",
+		Up: func(tx *gorm.DB) error {
+			type order struct {
+				VATState string `sql:"index"`
+			}
+			return migrateTable(tx, Order{}.TableName(), &order{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Model(Order{}).DropColumn("vat_state").Error
+		},
+	},
+	{
+		Version: 30,
+		Name:    "invoice numbers",
+		Up: func(tx *gorm.DB) error {
+			type order struct {
+				InvoiceNumber string `sql:"index"`
+			}
+			type invoiceSeries struct {
+				ID         uint64 `gorm:"primary_key"`
+				InstanceID string `sql:"unique_index:idx_invoice_series"`
+				Prefix     string `sql:"unique_index:idx_invoice_series"`
+				LastNumber uint64
+				UpdatedAt  time.Time
+			}
+			if err := migrateTable(tx, Order{}.TableName(), &order{}); err != nil {
+				return err
+			}
+			return migrateTable(tx, InvoiceSeries{}.TableName(), &invoiceSeries{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.DropTable(InvoiceSeries{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(Order{}).DropColumn("invoice_number").Error
+		},
+	},
+	{
+		Version: 31,
+		Name:    "coupons",
+		Up: func(tx *gorm.DB) error {
+			type coupon struct {
+				ID              string
+				InstanceID      string `sql:"unique_index:idx_coupons_code"`
+				Code            string `sql:"unique_index:idx_coupons_code"`
+				StartDate       *time.Time
+				EndDate         *time.Time
+				Percentage      uint64
+				FixedAmount     uint64
+				Currency        string
+				RawProductTypes string
+				RawClaims       string
+				CreatedAt       time.Time
+				UpdatedAt       time.Time
+			}
+			return migrateTable(tx, Coupon{}.TableName(), &coupon{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTable(Coupon{}).Error
+		},
+	},
+	{
+		Version: 32,
+		Name:    "coupon_redemptions",
+		Up: func(tx *gorm.DB) error {
+			type coupon struct {
+				MaxUses        uint64
+				MaxUsesPerUser uint64
+			}
+			type couponRedemption struct {
+				ID         uint64 `gorm:"primary_key"`
+				InstanceID string
+				CouponCode string `sql:"index"`
+				OrderID    string `sql:"unique_index"`
+				UserID     string
+				Email      string
+				CreatedAt  time.Time
+			}
+			if err := migrateTable(tx, Coupon{}.TableName(), &coupon{}); err != nil {
+				return err
+			}
+			return migrateTable(tx, CouponRedemption{}.TableName(), &couponRedemption{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.DropTable(CouponRedemption{}).Error; err != nil {
+				return err
+			}
+			for _, column := range []string{"max_uses", "max_uses_per_user"} {
+				if err := tx.Model(Coupon{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 33,
+		Name:    "customers of coupons",
+		Up: func(tx *gorm.DB) error {
+			type coupon struct {
+				UserID string
+				Email  string
+			}
+			return migrateTable(tx, Coupon{}.TableName(), &coupon{})
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"user_id", "email"} {
+				if err := tx.Model(Coupon{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 34,
+		Name:    "referrals",
+		Up: func(tx *gorm.DB) error {
+			type coupon struct {
+				ReferrerID string `sql:"index"`
+			}
+			type referralCredit struct {
+				ID         uint64 `gorm:"primary_key"`
+				InstanceID string
+				UserID     string `sql:"index"`
+				OrderID    string `sql:"unique_index"`
+				Code       string
+				Amount     uint64
+				Currency   string
+				CreatedAt  time.Time
+			}
+			if err := migrateTable(tx, Coupon{}.TableName(), &coupon{}); err != nil {
+				return err
+			}
+			return migrateTable(tx, ReferralCredit{}.TableName(), &referralCredit{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.DropTable(ReferralCredit{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(Coupon{}).DropColumn("referrer_id").Error
+		},
+	},
+	{
+		Version: 35,
+		Name:    "location evidence of orders",
+		Up: func(tx *gorm.DB) error {
+			type order struct {
+				IPCountry        string
+				CardCountry      string
+				LocationEvidence string `sql:"index"`
+			}
+			return migrateTable(tx, Order{}.TableName(), &order{})
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"ip_country", "card_country", "location_evidence"} {
+				if err := tx.Model(Order{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 36,
+		Name:    "settlement amounts of orders",
+		Up: func(tx *gorm.DB) error {
+			type order struct {
+				SettlementCurrency string
+				ExchangeRate       float64
+				SettlementSubTotal uint64
+				SettlementTaxes    uint64
+				SettlementDiscount uint64
+				SettlementTotal    uint64
+			}
+			return migrateTable(tx, Order{}.TableName(), &order{})
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"settlement_currency", "exchange_rate", "settlement_sub_total", "settlement_taxes", "settlement_discount", "settlement_total"} {
+				if err := tx.Model(Order{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 37,
+		Name:    "taxes of orders by rate",
+		Up: func(tx *gorm.DB) error {
+			type orderTax struct {
+				ID         uint64 `gorm:"primary_key"`
+				InstanceID string
+				OrderID    string `sql:"index"`
+				Country    string
+				Percentage uint64
+				Net        uint64
+				Taxes      uint64
+			}
+			return migrateTable(tx, OrderTax{}.TableName(), &orderTax{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTable(OrderTax{}).Error
+		},
+	},
+	{
+		Version: 38,
+		Name:    "locks of payment limits",
+		Up: func(tx *gorm.DB) error {
+			type paymentAttemptKey struct {
+				ID        string `gorm:"primary_key"`
+				UpdatedAt time.Time
+			}
+			return migrateTable(tx, PaymentAttemptKey{}.TableName(), &paymentAttemptKey{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTable(PaymentAttemptKey{}).Error
+		},
+	},
+	{
+		Version: 39,
+		Name:    "reversed referral credits",
+		Up: func(tx *gorm.DB) error {
+			type referralCredit struct {
+				Reversed uint64
+			}
+			return migrateTable(tx, ReferralCredit{}.TableName(), &referralCredit{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Model(ReferralCredit{}).DropColumn("reversed").Error
+		},
+	},
+	{
+		Version: 40,
+		Name:    "order_id of order notes",
+		Up: func(tx *gorm.DB) error {
+			type orderNote struct {
+				OrderID string `sql:"index"`
+			}
+			return migrateTable(tx, OrderNote{}.TableName(), &orderNote{})
+		},
+		Down: func(tx *gorm.DB) error {
+			table := OrderNote{}.TableName()
+			if err := tx.Table(table).RemoveIndex("idx_" + table + "_order_id").Error; err != nil {
+				return err
+			}
+			return tx.Model(OrderNote{}).DropColumn("order_id").Error
+		},
+	},
+	{
+		Version: 41,
+		Name:    "product types of order taxes",
+		Up: func(tx *gorm.DB) error {
+			type orderTax struct {
+				Type string
+			}
+			return migrateTable(tx, OrderTax{}.TableName(), &orderTax{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Model(OrderTax{}).DropColumn("type").Error
+		},
+	},
+	{
+		Version: 42,
+		Name:    "deliveries of mail webhooks",
+		Up: func(tx *gorm.DB) error {
+			type webhookDelivery struct {
+				ID        string    `gorm:"primary_key"`
+				CreatedAt time.Time `sql:"index"`
+			}
+			return migrateTable(tx, WebhookDelivery{}.TableName(), &webhookDelivery{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTable(WebhookDelivery{}).Error
+		},
+	},
+	{
+		// The records of the deployment are kept for it, with an empty
+		// instance_id. The keys of several instances can't be folded back
+		// into one, so there's no way down.
+		Version: 43,
+		Name:    "instances of inventory, mail suppressions, mail opt outs, webhook endpoints and order numbers",
+		Up: func(tx *gorm.DB) error {
+			type inventoryItem struct {
+				InstanceID string `gorm:"primary_key"`
+				Sku        string `gorm:"primary_key"`
+				Quantity   int64
+				CreatedAt  time.Time
+				UpdatedAt  time.Time
+			}
+			type mailSuppression struct {
+				InstanceID string `gorm:"primary_key"`
+				Email      string `gorm:"primary_key"`
+				Reason     string
+				CreatedAt  time.Time
+			}
+			type mailOptOut struct {
+				InstanceID string `gorm:"primary_key"`
+				Email      string `gorm:"primary_key"`
+				CreatedAt  time.Time
+			}
+			type webhookEndpoint struct {
+				InstanceID          string `gorm:"primary_key"`
+				URL                 string `gorm:"primary_key"`
+				ConsecutiveFailures int
+				Unhealthy           bool
+				UnhealthySince      *time.Time
+				LastError           string
+				LastFailureAt       *time.Time
+				LastSuccessAt       *time.Time
+				CreatedAt           time.Time
+				UpdatedAt           time.Time
+			}
+			type orderNumber struct {
+				InstanceID string `sql:"index"`
+			}
+			rekeyed := []struct {
+				table   string
+				model   interface{}
+				columns string
+			}{
+				{InventoryItem{}.TableName(), &inventoryItem{}, "sku, quantity, created_at, updated_at"},
+				{MailSuppression{}.TableName(), &mailSuppression{}, "email, reason, created_at"},
+				{MailOptOut{}.TableName(), &mailOptOut{}, "email, created_at"},
+				{WebhookEndpoint{}.TableName(), &webhookEndpoint{}, "url, consecutive_failures, unhealthy, unhealthy_since, " +
+					"last_error, last_failure_at, last_success_at, created_at, updated_at"},
+			}
+			for _, r := range rekeyed {
+				if err := rekeyTable(tx, r.table, r.model, r.columns); err != nil {
+					return err
+				}
+			}
+			return migrateTable(tx, OrderNumber{}.TableName(), &orderNumber{})
+		},
+	},
+	{
+		// Orders from before refs get their ID as ref, refs can't be empty
+		// once they're unique.
+		Version: 44,
+		Name:    "unique refs of orders",
+		Up: func(tx *gorm.DB) error {
+			table := Order{}.TableName()
+			rsp := tx.Table(table).Where("ref IS NULL OR ref = ?", "").UpdateColumn("ref", gorm.Expr("id"))
+			if rsp.Error != nil {
+				return rsp.Error
+			}
+			if err := tx.Table(table).RemoveIndex("idx_" + table + "_ref").Error; err != nil {
+				return err
+			}
+			return tx.Table(table).AddUniqueIndex("uix_"+table+"_ref", "ref").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			table := Order{}.TableName()
+			if err := tx.Table(table).RemoveIndex("uix_" + table + "_ref").Error; err != nil {
+				return err
+			}
+			return tx.Table(table).AddIndex("idx_"+table+"_ref", "ref").Error
+		},
+	},
+}
+
+// migrateTable creates the table from model, or adds the columns and indexes
+// of model it's missing. model is the part of the schema a migration declares,
+// not a model of the package.
+func migrateTable(tx *gorm.DB, table string, model interface{}) error {
+	return tx.Table(table).AutoMigrate(model).Error
+}
+
+// rekeyTable adds instance_id to the primary key of a table, which the
+// databases don't change in place the same way. The rows are copied aside,
+// and back once the table is created again from model, with the instance_id
+// of the deployment. columns are the columns of the table before.
+func rekeyTable(tx *gorm.DB, table string, model interface{}, columns string) error {
+	aside := table + "_rekey"
+	if err := migrateTable(tx, aside, model); err != nil {
+		return err
+	}
+	copied := tx.Exec("INSERT INTO "+aside+" (instance_id, "+columns+") SELECT ?, "+columns+" FROM "+table, "")
+	if copied.Error != nil {
+		return copied.Error
+	}
+	if err := tx.DropTable(table).Error; err != nil {
+		return err
+	}
+	if err := migrateTable(tx, table, model); err != nil {
+		return err
+	}
+	copied = tx.Exec("INSERT INTO " + table + " (instance_id, " + columns + ") SELECT instance_id, " + columns + " FROM " + aside)
+	if copied.Error != nil {
+		return copied.Error
+	}
+	return tx.DropTable(aside).Error
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DeleteOrder soft deletes an order along with its line items and downloads.
+// It can be undone with RestoreOrder.
+func DeleteOrder(tx *gorm.DB, order *Order) error {
+	if err := tx.Delete(order).Error; err != nil {
+		return err
+	}
+	for _, model := range []interface{}{&LineItem{}, &Download{}} {
+		if err := tx.Where("order_id = ?", order.ID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreOrder undeletes an order along with the line items and downloads
+// that were deleted with it. The ones that were deleted before the order
+// stay deleted.
+func RestoreOrder(tx *gorm.DB, order *Order) error {
+	if order.DeletedAt == nil {
+		return nil
+	}
+	deletedAt := *order.DeletedAt
+	for _, model := range []interface{}{&LineItem{}, &Download{}} {
+		if err := undelete(tx, model, deletedAt, "order_id = ?", order.ID); err != nil {
+			return err
+		}
+	}
+	if err := undelete(tx, &Order{}, deletedAt, "id = ?", order.ID); err != nil {
+		return err
+	}
+	order.DeletedAt = nil
+	return nil
+}
+
+// RestoreUser undeletes a user along with the orders, line items,
+// transactions, notes and addresses that were deleted with it
+func RestoreUser(tx *gorm.DB, user *User) error {
+	if user.DeletedAt == nil {
+		return nil
+	}
+	deletedAt := *user.DeletedAt
+	userOrders := "order_id IN (SELECT id FROM " + Order{}.TableName() + " WHERE user_id = ?)"
+	for _, table := range []struct {
+		model interface{}
+		where string
+	}{
+		{&LineItem{}, userOrders},
+		{&Order{}, "user_id = ?"},
+		{&Transaction{}, "user_id = ?"},
+		{&OrderNote{}, "user_id = ?"},
+		{&Address{}, "user_id = ?"},
+		{&User{}, "id = ?"},
+	} {
+		if err := undelete(tx, table.model, deletedAt, table.where, user.ID); err != nil {
+			return err
+		}
+	}
+	user.DeletedAt = nil
+	return nil
+}
+
+// RestoreAddress undeletes an address
+func RestoreAddress(tx *gorm.DB, address *Address) error {
+	if address.DeletedAt == nil {
+		return nil
+	}
+	if err := undelete(tx, &Address{}, *address.DeletedAt, "id = ?", address.ID); err != nil {
+		return err
+	}
+	address.DeletedAt = nil
+	return nil
+}
+
+// undelete clears deleted_at of the records matching where that were deleted
+// at deletedAt or after
+func undelete(tx *gorm.DB, model interface{}, deletedAt time.Time, where string, args ...interface{}) error {
+	return tx.Unscoped().Model(model).
+		Where(where, args...).
+		Where("deleted_at >= ?", deletedAt).
+		UpdateColumn("deleted_at", gorm.Expr("NULL")).Error
+}
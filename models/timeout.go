@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// timeoutDrivers are the drivers registered by timeoutDriverName
+var timeoutDrivers = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+// timeoutDriverName registers a driver that wraps the connections of another
+// one, so every statement sent over them is cancelled after timeout. The
+// drivers interrupt the statement on the database when it's cancelled.
+func timeoutDriverName(driverName string, timeout time.Duration) (string, error) {
+	name := fmt.Sprintf("%s+timeout=%s", driverName, timeout)
+
+	timeoutDrivers.Lock()
+	defer timeoutDrivers.Unlock()
+	if timeoutDrivers.names[name] {
+		return name, nil
+	}
+
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return "", err
+	}
+	wrapped := db.Driver()
+	db.Close()
+
+	sql.Register(name, &timeoutDriver{Driver: wrapped, timeout: timeout})
+	timeoutDrivers.names[name] = true
+	return name, nil
+}
+
+type timeoutDriver struct {
+	driver.Driver
+	timeout time.Duration
+}
+
+func (d *timeoutDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutConn{Conn: conn, timeout: d.timeout}, nil
+}
+
+// timeoutConn limits the statements of a connection. Whatever else the
+// connection supports is passed through.
+type timeoutConn struct {
+	driver.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the rows are read after the query returned, the time limit covers
+	// reading them too
+	return &timeoutRows{Rows: rows, cancel: cancel}, nil
+}
+
+func (c *timeoutConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *timeoutConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *timeoutConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *timeoutConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+func (c *timeoutConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+type timeoutRows struct {
+	driver.Rows
+	cancel context.CancelFunc
+}
+
+func (r *timeoutRows) Close() error {
+	err := r.Rows.Close()
+	r.cancel()
+	return err
+}
@@ -9,11 +9,15 @@ import (
 const ChargeTransactionType = "charge"
 const RefundTransactionType = "refund"
 
+// CreditTransactionType is a store credit, no money moves through the payment provider
+const CreditTransactionType = "credit"
+
 // Transaction is an transaction with a payment provider
 type Transaction struct {
-	ID      string `json:"id"`
-	Order   *Order `json:"-"`
-	OrderID string `json:"order_id"`
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+	Order      *Order `json:"-"`
+	OrderID    string `json:"order_id" sql:"index"`
 
 	ProcessorID string `json:"processor_id"`
 
@@ -29,6 +33,14 @@ type Transaction struct {
 	Status string `json:"status"`
 	Type   string `json:"type"`
 
+	// Reason is the reason code given for a refund
+	Reason string `json:"reason,omitempty"`
+
+	// Goodwill refunds and credits are given without a return
+	Goodwill bool   `json:"goodwill,omitempty"`
+	Note     string `json:"note,omitempty"`
+	IssuedBy string `json:"issued_by,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"-"`
 }
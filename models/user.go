@@ -3,12 +3,13 @@ package models
 import "time"
 
 type User struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+	Email      string `json:"email"`
 
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
-	DeletedAt *time.Time `json:"-"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" sql:"index"`
 
 	OrderCount int64 `json:"order_count,ommitempty" gorm:"-"`
 }
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// WebhookDelivery is a webhook of a mail provider that was handled. A
+// delivery with the ID of one that was handled is a replay.
+type WebhookDelivery struct {
+	ID        string    `gorm:"primary_key"`
+	CreatedAt time.Time `sql:"index"`
+}
+
+// TableName returns the database table name for the WebhookDelivery model.
+func (WebhookDelivery) TableName() string {
+	return tableName("webhook_deliveries")
+}
+
+// RecordWebhookDelivery records a delivery as handled. It tells if it's the
+// first time, deliveries can get here at the same time.
+func RecordWebhookDelivery(tx *gorm.DB, id string) (bool, error) {
+	table := WebhookDelivery{}.TableName()
+	now := time.Now()
+	var rsp *gorm.DB
+	switch Dialect(tx) {
+	case "mysql":
+		rsp = tx.Exec("INSERT IGNORE INTO "+table+" (id, created_at) VALUES (?, ?)", id, now)
+	case MSSQL:
+		rsp = tx.Exec("INSERT INTO "+table+" (id, created_at) SELECT ?, ? WHERE NOT EXISTS "+
+			"(SELECT 1 FROM "+table+" WITH (UPDLOCK, HOLDLOCK) WHERE id = ?)", id, now, id)
+	default:
+		rsp = tx.Exec("INSERT INTO "+table+" (id, created_at) VALUES (?, ?) ON CONFLICT (id) DO NOTHING", id, now)
+	}
+	return rsp.RowsAffected > 0, rsp.Error
+}
+
+// PruneWebhookDeliveries forgets the deliveries handled before a time
+func PruneWebhookDeliveries(db *gorm.DB, before time.Time) error {
+	return db.Where("created_at < ?", before).Delete(&WebhookDelivery{}).Error
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// WebhookEndpoint tracks the health of a URL webhooks are delivered to. An
+// endpoint becomes unhealthy after failing too many deliveries in a row, and
+// healthy again with the next successful one. Every instance tracks the
+// endpoints of its own webhooks.
+type WebhookEndpoint struct {
+	URL        string `json:"url" gorm:"primary_key"`
+	InstanceID string `json:"-" gorm:"primary_key"`
+
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Unhealthy           bool       `json:"unhealthy"`
+	UnhealthySince      *time.Time `json:"unhealthy_since,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (WebhookEndpoint) TableName() string {
+	return tableName("webhook_endpoints")
+}
+
+// endpointKey tells the endpoints of the instances apart
+type endpointKey struct {
+	instanceID string
+	url        string
+}
+
+func findWebhookEndpoint(db *gorm.DB, instanceID, url string) (*WebhookEndpoint, error) {
+	endpoint := &WebhookEndpoint{}
+	if rsp := db.First(endpoint, "instance_id = ? AND url = ?", instanceID, url); rsp.Error != nil {
+		if !rsp.RecordNotFound() {
+			return nil, rsp.Error
+		}
+		endpoint.InstanceID = instanceID
+		endpoint.URL = url
+	}
+	return endpoint, nil
+}
+
+// recordHookFailure counts a failed delivery to an endpoint and marks it
+// unhealthy once unhealthyAfter deliveries in a row failed. Deliveries to an
+// endpoint fail at the same time, so the count is incremented in place.
+func recordHookFailure(db *gorm.DB, instanceID, url, failure string, unhealthyAfter int) (*WebhookEndpoint, error) {
+	if err := createWebhookEndpoint(db, instanceID, url); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	rsp := db.Model(&WebhookEndpoint{}).Where("instance_id = ? AND url = ?", instanceID, url).UpdateColumns(map[string]interface{}{
+		"consecutive_failures": gorm.Expr("consecutive_failures + 1"),
+		"last_error":           failure,
+		"last_failure_at":      now,
+		"updated_at":           now,
+	})
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	endpoint, err := findWebhookEndpoint(db, instanceID, url)
+	if err != nil {
+		return nil, err
+	}
+	if !endpoint.Unhealthy && unhealthyAfter > 0 && endpoint.ConsecutiveFailures >= unhealthyAfter {
+		rsp := db.Model(&WebhookEndpoint{}).Where("instance_id = ? AND url = ? AND unhealthy = ?", instanceID, url, false).
+			UpdateColumns(map[string]interface{}{"unhealthy": true, "unhealthy_since": now})
+		if rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		endpoint.Unhealthy = true
+		endpoint.UnhealthySince = &now
+	}
+	return endpoint, nil
+}
+
+// createWebhookEndpoint inserts the row of the endpoint unless it's there,
+// the first failures of an endpoint can get here at the same time.
+func createWebhookEndpoint(db *gorm.DB, instanceID, url string) error {
+	table := WebhookEndpoint{}.TableName()
+	now := time.Now()
+	switch Dialect(db) {
+	case "mysql":
+		return db.Exec("INSERT IGNORE INTO "+table+" (instance_id, url, consecutive_failures, unhealthy, created_at, updated_at) "+
+			"VALUES (?, ?, 0, ?, ?, ?)", instanceID, url, false, now, now).Error
+	case MSSQL:
+		return db.Exec("INSERT INTO "+table+" (instance_id, url, consecutive_failures, unhealthy, created_at, updated_at) "+
+			"SELECT ?, ?, 0, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM "+table+" WITH (UPDLOCK, HOLDLOCK) WHERE instance_id = ? AND url = ?)",
+			instanceID, url, false, now, now, instanceID, url).Error
+	}
+	return db.Exec("INSERT INTO "+table+" (instance_id, url, consecutive_failures, unhealthy, created_at, updated_at) "+
+		"VALUES (?, ?, 0, ?, ?, ?) ON CONFLICT (instance_id, url) DO NOTHING", instanceID, url, false, now, now).Error
+}
+
+// recordHookSuccess marks an endpoint healthy after a successful delivery
+func recordHookSuccess(db *gorm.DB, instanceID, url string) error {
+	if err := createWebhookEndpoint(db, instanceID, url); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return db.Model(&WebhookEndpoint{}).Where("instance_id = ? AND url = ?", instanceID, url).UpdateColumns(map[string]interface{}{
+		"consecutive_failures": 0,
+		"unhealthy":            false,
+		"unhealthy_since":      nil,
+		"last_success_at":      now,
+		"updated_at":           now,
+	}).Error
+}
+
+// openCircuits finds the unhealthy endpoints that failed within the cooldown,
+// and when their circuit closes again
+func openCircuits(db *gorm.DB, cooldown time.Duration) (map[endpointKey]time.Time, error) {
+	endpoints := []WebhookEndpoint{}
+	if rsp := db.Where("unhealthy = ? AND last_failure_at > ?", true, time.Now().Add(-cooldown)).Find(&endpoints); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	open := map[endpointKey]time.Time{}
+	for _, e := range endpoints {
+		open[endpointKey{e.InstanceID, e.URL}] = e.LastFailureAt.Add(cooldown)
+	}
+	return open, nil
+}
+
+// endpointLimiter caps the deliveries in flight to each endpoint
+type endpointLimiter struct {
+	mutex    sync.Mutex
+	max      int
+	inFlight map[string]int
+	// freed is signaled when a delivery is done
+	freed chan struct{}
+}
+
+func newEndpointLimiter(max int) *endpointLimiter {
+	return &endpointLimiter{
+		max:      max,
+		inFlight: map[string]int{},
+		freed:    make(chan struct{}, 1),
+	}
+}
+
+func (l *endpointLimiter) acquire(url string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.inFlight[url] >= l.max {
+		return false
+	}
+	l.inFlight[url]++
+	return true
+}
+
+func (l *endpointLimiter) release(url string) {
+	l.mutex.Lock()
+	l.inFlight[url]--
+	if l.inFlight[url] == 0 {
+		delete(l.inFlight, url)
+	}
+	l.mutex.Unlock()
+
+	select {
+	case l.freed <- struct{}{}:
+	default:
+	}
+}
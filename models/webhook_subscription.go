@@ -0,0 +1,103 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// WebhookSubscription is a webhook endpoint registered through the API, next
+// to the ones in the config. It gets the shared envelope of the events it's
+// subscribed to, signed with its own secret.
+type WebhookSubscription struct {
+	ID          string `json:"id"`
+	InstanceID  string `json:"-" sql:"index"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+
+	// Secret signs the webhooks sent to the endpoint. It's only shown when it
+	// is set.
+	Secret string `json:"-"`
+
+	// Events are the event types sent to the endpoint, every type if empty
+	Events    []string `json:"events" sql:"-"`
+	RawEvents string   `json:"-"`
+
+	Active bool `json:"active"`
+	// Format is the format of the webhooks, json or cloudevents
+	Format string `json:"format"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-"`
+}
+
+func (WebhookSubscription) TableName() string {
+	return tableName("webhook_subscriptions")
+}
+
+func (s *WebhookSubscription) AfterFind() error {
+	s.Events = []string{}
+	if s.RawEvents != "" {
+		s.Events = strings.Split(s.RawEvents, ",")
+	}
+	return nil
+}
+
+func (s *WebhookSubscription) BeforeSave() error {
+	s.RawEvents = strings.Join(s.Events, ",")
+	return nil
+}
+
+// Subscribed checks if the endpoint gets the events of a type
+func (s *WebhookSubscription) Subscribed(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWebhookSecret generates a secret for signing webhooks
+func NewWebhookSecret() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(secret), nil
+}
+
+// FindWebhookSubscription looks up a subscription. It returns nil if it
+// doesn't exist or has been deleted.
+func FindWebhookSubscription(db *gorm.DB, id string) (*WebhookSubscription, error) {
+	subscription := &WebhookSubscription{}
+	if rsp := db.First(subscription, "id = ?", id); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return subscription, nil
+}
+
+// ActiveWebhookSubscriptions finds the active subscriptions to an event type
+func ActiveWebhookSubscriptions(db *gorm.DB, eventType string) ([]*WebhookSubscription, error) {
+	all := []*WebhookSubscription{}
+	if rsp := db.Where("active = ?", true).Order("created_at asc").Find(&all); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	subscriptions := []*WebhookSubscription{}
+	for _, s := range all {
+		if s.Subscribed(eventType) {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	return subscriptions, nil
+}
@@ -0,0 +1,107 @@
+// Package refs turns sequential order numbers into short public references,
+// so order URLs and emails don't reveal how many orders a shop has taken or
+// let anyone guess the reference of another order.
+package refs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// DefaultAlphabet leaves out characters that are easy to mix up, like 0 and O
+const DefaultAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+const (
+	minAlphabetLength = 16
+	rounds            = 4
+)
+
+// ErrOutOfRange is returned for numbers the encoder can't represent
+var ErrOutOfRange = errors.New("Order number is too large to encode")
+
+// Encoder turns an order number into a public reference
+type Encoder interface {
+	Encode(number uint64) (string, error)
+}
+
+// ValidAlphabet checks that an alphabet can be used for references
+func ValidAlphabet(alphabet string) error {
+	if len(alphabet) < minAlphabetLength {
+		return fmt.Errorf("the alphabet needs at least %d characters", minAlphabetLength)
+	}
+	seen := map[rune]bool{}
+	for _, c := range alphabet {
+		if c > 127 {
+			return fmt.Errorf("the alphabet can only have ASCII characters, not '%c'", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("the alphabet has '%c' more than once", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// Obfuscator is the default Encoder. It shuffles the numbers with a keyed
+// permutation, derived from the salt, before writing them out in the
+// alphabet, so consecutive orders get unrelated references. References are
+// all the same length, 7 characters with the default alphabet.
+type Obfuscator struct {
+	alphabet string
+	width    int
+	keys     [rounds]uint32
+}
+
+// NewObfuscator creates an Obfuscator. Invalid alphabets, see ValidAlphabet,
+// are replaced with the DefaultAlphabet.
+func NewObfuscator(salt, alphabet string) *Obfuscator {
+	if ValidAlphabet(alphabet) != nil {
+		alphabet = DefaultAlphabet
+	}
+
+	o := &Obfuscator{alphabet: alphabet}
+	for max := uint64(math.MaxUint32); max > 0; max /= uint64(len(alphabet)) {
+		o.width++
+	}
+	sum := sha256.Sum256([]byte(salt))
+	for i := range o.keys {
+		o.keys[i] = binary.BigEndian.Uint32(sum[i*4:])
+	}
+	return o
+}
+
+// Encode returns the reference for an order number
+func (o *Obfuscator) Encode(number uint64) (string, error) {
+	if number > math.MaxUint32 {
+		return "", ErrOutOfRange
+	}
+
+	n := uint64(o.permute(uint32(number)))
+	base := uint64(len(o.alphabet))
+	ref := make([]byte, o.width)
+	for i := o.width - 1; i >= 0; i-- {
+		ref[i] = o.alphabet[n%base]
+		n /= base
+	}
+	return string(ref), nil
+}
+
+// permute runs a Feistel network over the two halves of the number, which
+// maps every 32 bit number to a different one
+func (o *Obfuscator) permute(n uint32) uint32 {
+	left, right := uint16(n>>16), uint16(n)
+	for _, key := range o.keys {
+		left, right = right, left^round(right, key)
+	}
+	return uint32(left)<<16 | uint32(right)
+}
+
+func round(half uint16, key uint32) uint16 {
+	h := (uint32(half) ^ key) * 0x9e3779b1
+	h ^= h >> 15
+	h *= 0x85ebca6b
+	return uint16(h >> 16)
+}
@@ -0,0 +1,42 @@
+package refs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObfuscatorEncode(t *testing.T) {
+	o := NewObfuscator("salt", "")
+
+	seen := map[string]bool{}
+	for n := uint64(1); n <= 10000; n++ {
+		ref, err := o.Encode(n)
+		assert.NoError(t, err)
+		assert.Len(t, ref, 7)
+		assert.False(t, seen[ref], "reference %s was handed out twice", ref)
+		seen[ref] = true
+	}
+
+	first, _ := o.Encode(1)
+	again, _ := NewObfuscator("salt", "").Encode(1)
+	assert.Equal(t, first, again, "references have to be stable")
+
+	other, _ := NewObfuscator("other salt", "").Encode(1)
+	assert.NotEqual(t, first, other)
+
+	_, err := o.Encode(1 << 32)
+	assert.Equal(t, ErrOutOfRange, err)
+}
+
+func TestObfuscatorAlphabet(t *testing.T) {
+	o := NewObfuscator("salt", "0123456789abcdef")
+	ref, err := o.Encode(42)
+	assert.NoError(t, err)
+	assert.Len(t, ref, 8)
+	assert.Regexp(t, "^[0-9a-f]+$", ref)
+
+	assert.Error(t, ValidAlphabet("abc"))
+	assert.Error(t, ValidAlphabet("0123456789abcdee"))
+	assert.NoError(t, ValidAlphabet(DefaultAlphabet))
+}
@@ -0,0 +1,137 @@
+package retention
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/sigv4"
+)
+
+const (
+	s3Service       = "s3"
+	s3DefaultRegion = "us-east-1"
+)
+
+// Archive keeps the orders that are exported before they're pruned
+type Archive interface {
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// NewArchive returns the archive for a URL, a directory like
+// file:///var/lib/gocommerce/archive or an S3 bucket like
+// s3://bucket/prefix?region=eu-west-1. S3 compatible stores are reached
+// with ?endpoint=https://storage.example.com. S3 requests use client, or
+// the default client if it is nil.
+func NewArchive(rawURL string, client *http.Client) (Archive, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive URL: %v", err)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("the file archive needs a directory, like file:///var/lib/gocommerce/archive")
+		}
+		return &fileArchive{dir: filepath.FromSlash(u.Path)}, nil
+	case "s3":
+		return newS3Archive(u, client)
+	}
+	return nil, fmt.Errorf("unknown archive '%s', must be file or s3", u.Scheme)
+}
+
+// fileArchive writes the orders to files in a directory
+type fileArchive struct {
+	dir string
+}
+
+func (a *fileArchive) Put(ctx context.Context, key string, data []byte) error {
+	name := filepath.Join(a.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0600)
+}
+
+// s3Archive uploads the orders to an S3 bucket
+type s3Archive struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+	now      func() time.Time
+}
+
+func newS3Archive(u *url.URL, client *http.Client) (*s3Archive, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("the S3 archive needs a bucket, like s3://bucket/prefix")
+	}
+	query := u.Query()
+	archive := &s3Archive{
+		client: client,
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		region: query.Get("region"),
+		now:    time.Now,
+	}
+	if archive.region == "" {
+		archive.region = s3DefaultRegion
+	}
+
+	// buckets on AWS are addressed by their hostname, and on other stores by
+	// their path
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", archive.bucket, archive.region)
+	} else {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/" + archive.bucket
+	}
+	var err error
+	if archive.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %v", err)
+	}
+	return archive, nil
+}
+
+func (a *s3Archive) Put(ctx context.Context, key string, data []byte) error {
+	target := *a.endpoint
+	target.Path = path.Join("/", target.Path, a.prefix, key)
+
+	req, err := http.NewRequest("PUT", target.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	sum := sha256.Sum256(data)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	if err := sigv4.Sign(req, string(data), s3Service, a.region, a.now()); err != nil {
+		return err
+	}
+
+	rsp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("uploading to S3: %v", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("uploading to S3: %s %s", rsp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Package retention applies the retention policy to old orders. Orders older
+// than the retention period are exported to an archive, then deleted or
+// stripped of their personal data.
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/scheduler"
+)
+
+// batchSize is how many orders are handled in one transaction
+const batchSize = 100
+
+// archiveTimeout is how long an upload to the archive can take
+const archiveTimeout = time.Minute
+
+// Result counts the orders handled by a run, or the orders that would be on
+// a dry run
+type Result struct {
+	Action string `json:"action"`
+	Orders int    `json:"orders"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// Record is what's exported for an order
+type Record struct {
+	Order      *models.Order  `json:"order"`
+	Events     []models.Event `json:"events"`
+	ArchivedAt time.Time      `json:"archived_at"`
+}
+
+// Key is where an order is exported to in the archive
+func Key(order *models.Order) string {
+	return fmt.Sprintf("orders/%s/%s.json", order.CreatedAt.UTC().Format("2006/01"), order.ID)
+}
+
+// Apply handles the orders placed before the retention period, counted back
+// from now. Each order is exported to the archive before it's deleted or
+// anonymized, and nothing is pruned if the export fails. With dryRun set
+// nothing changes, it only counts the orders that would be handled.
+func Apply(ctx context.Context, db *gorm.DB, config *conf.Configuration, archive Archive, now time.Time, dryRun bool) (*Result, error) {
+	db = models.WithContext(db, ctx)
+	retention := config.Retention
+	result := &Result{Action: retention.Action, DryRun: dryRun}
+	if retention.OrderYears <= 0 {
+		return result, nil
+	}
+	cutoff := now.AddDate(-retention.OrderYears, 0, 0)
+	anonymize := retention.Action == conf.AnonymizeRetention
+
+	if dryRun {
+		count, err := models.CountExpiredOrders(db, cutoff, anonymize)
+		result.Orders = count
+		return result, err
+	}
+
+	for {
+		orders, err := models.ExpiredOrders(db, cutoff, anonymize, batchSize)
+		if err != nil {
+			return result, err
+		}
+		if len(orders) == 0 {
+			return result, nil
+		}
+
+		if archive != nil {
+			for _, order := range orders {
+				if err := export(ctx, db, archive, order, now); err != nil {
+					return result, fmt.Errorf("exporting order %s: %v", order.ID, err)
+				}
+			}
+		}
+
+		tx := db.Begin()
+		if anonymize {
+			err = models.AnonymizeOrders(tx, orders, now)
+		} else {
+			ids := []string{}
+			for _, order := range orders {
+				ids = append(ids, order.ID)
+			}
+			err = models.DeleteOrdersPermanently(tx, ids)
+		}
+		if err != nil {
+			tx.Rollback()
+			return result, err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return result, err
+		}
+		result.Orders += len(orders)
+	}
+}
+
+func export(ctx context.Context, db *gorm.DB, archive Archive, order *models.Order, now time.Time) error {
+	record := &Record{Order: order, Events: []models.Event{}, ArchivedAt: now}
+	if err := db.Where("order_id = ?", order.ID).Order("created_at asc").Find(&record.Events).Error; err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return archive.Put(ctx, Key(order), data)
+}
+
+// Task applies the retention policy as a task of the scheduler. It's nil
+// unless a retention period is configured.
+func Task(db *gorm.DB, log *logrus.Entry, config *conf.Configuration) *scheduler.Task {
+	retention := config.Retention
+	if retention.OrderYears <= 0 || config.Schedule.Retention.Disabled {
+		return nil
+	}
+
+	var archive Archive
+	if retention.ArchiveURL != "" {
+		var err error
+		if archive, err = NewArchive(retention.ArchiveURL, config.HTTPClient(archiveTimeout)); err != nil {
+			log.WithError(err).Error("Invalid retention archive, not applying the retention policy")
+			return nil
+		}
+	}
+
+	return &scheduler.Task{
+		Name:     "retention",
+		Interval: config.Schedule.Retention.Interval,
+		Run: func(ctx context.Context, now time.Time) error {
+			result, err := Apply(ctx, db, config, archive, now, false)
+			if err != nil {
+				return err
+			}
+			if result.Orders > 0 {
+				log.Infof("Applied %s retention to %d orders", result.Action, result.Orders)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,219 @@
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+var now = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func testDB(t *testing.T) (*gorm.DB, *conf.Configuration) {
+	f, err := ioutil.TempFile("", "retention-db")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	f.Close()
+
+	config := new(conf.Configuration)
+	config.DB.Driver = "sqlite3"
+	config.DB.ConnURL = f.Name()
+	config.DB.Automigrate = true
+	config.Retention.OrderYears = 7
+	db, err := models.Connect(config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return db, config
+}
+
+// createOrder stores an order placed at createdAt with an address, a line
+// item and an event
+func createOrder(t *testing.T, db *gorm.DB, id string, createdAt time.Time) *models.Order {
+	address := &models.Address{
+		ID:             id + "-address",
+		AddressRequest: models.AddressRequest{FirstName: "Peter", LastName: "Parker", Address1: "20 Ingram St", City: "New York", Country: "USA", State: "NY", Zip: "11375"},
+	}
+	order := models.NewOrder("session", "peter@example.com", "usd")
+	order.ID = id
+	order.IP = "10.0.0.1"
+	order.Total = 1000
+	order.ShippingAddressID = address.ID
+	order.BillingAddressID = address.ID
+	for _, record := range []interface{}{address, order, &models.LineItem{OrderID: id, Sku: "sku", Price: 1000, Quantity: 1}} {
+		if !assert.NoError(t, db.Create(record).Error) {
+			t.FailNow()
+		}
+	}
+	// gorm stamps the creation time, so orders are backdated afterwards
+	db.Model(order).UpdateColumn("created_at", createdAt)
+	models.LogEvent(db, "10.0.0.1", "", id, models.EventCreated, nil)
+	return order
+}
+
+func TestArchive(t *testing.T) {
+	db, config := testDB(t)
+	dir, err := ioutil.TempDir("", "retention-archive")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	old := createOrder(t, db, "old", now.AddDate(-8, 0, 0))
+	createOrder(t, db, "recent", now.AddDate(-1, 0, 0))
+	for _, record := range []interface{}{
+		&models.Mail{OrderID: "old", To: "peter@example.com"},
+		&models.Hook{OrderID: "old", URL: "https://example.com/hook"},
+		&models.PaymentAttempt{OrderID: "old", Amount: 1000},
+	} {
+		assert.NoError(t, db.Create(record).Error)
+	}
+
+	archive, err := NewArchive("file://"+dir, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	result, err := Apply(context.Background(), db, config, archive, now, true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, result.Orders)
+	}
+	assert.NoError(t, db.First(&models.Order{}, "id = ?", "old").Error, "a dry run changes nothing")
+
+	config.Retention.Action = conf.ArchiveRetention
+	result, err = Apply(context.Background(), db, config, archive, now, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, result.Orders)
+	}
+
+	assert.True(t, db.Unscoped().First(&models.Order{}, "id = ?", "old").RecordNotFound())
+	assert.True(t, db.Unscoped().First(&models.LineItem{}, "order_id = ?", "old").RecordNotFound())
+	assert.True(t, db.First(&models.Event{}, "order_id = ?", "old").RecordNotFound())
+	assert.True(t, db.First(&models.Mail{}, "order_id = ?", "old").RecordNotFound())
+	assert.True(t, db.First(&models.Hook{}, "order_id = ?", "old").RecordNotFound())
+	assert.True(t, db.First(&models.PaymentAttempt{}, "order_id = ?", "old").RecordNotFound())
+	assert.True(t, db.Unscoped().First(&models.Address{}, "id = ?", "old-address").RecordNotFound())
+	assert.NoError(t, db.First(&models.Order{}, "id = ?", "recent").Error)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(Key(old))))
+	if assert.NoError(t, err) {
+		record := &Record{}
+		assert.NoError(t, json.Unmarshal(data, record))
+		assert.Equal(t, "old", record.Order.ID)
+		assert.Equal(t, "peter@example.com", record.Order.Email)
+		assert.Len(t, record.Order.LineItems, 1)
+		assert.Equal(t, "Parker", record.Order.ShippingAddress.LastName)
+		assert.Len(t, record.Events, 1)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	db, config := testDB(t)
+	config.Retention.Action = conf.AnonymizeRetention
+	createOrder(t, db, "old", now.AddDate(-8, 0, 0))
+	shared := createOrder(t, db, "shared", now.AddDate(-8, 0, 0))
+	recent := createOrder(t, db, "recent", now.AddDate(-1, 0, 0))
+	db.Model(recent).UpdateColumn("billing_address_id", shared.BillingAddressID)
+
+	result, err := Apply(context.Background(), db, config, nil, now, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, result.Orders)
+	}
+
+	address := &models.Address{}
+	if assert.NoError(t, db.First(address, "id = ?", shared.BillingAddressID).Error) {
+		assert.Equal(t, "Parker", address.LastName, "addresses of newer orders stay")
+	}
+
+	order := &models.Order{}
+	if assert.NoError(t, db.Preload("ShippingAddress").First(order, "id = ?", "old").Error) {
+		assert.Empty(t, order.Email)
+		assert.Empty(t, order.IP)
+		assert.NotNil(t, order.AnonymizedAt)
+		assert.Equal(t, uint64(1000), order.Total, "the amounts stay for the books")
+		assert.Empty(t, order.ShippingAddress.LastName)
+		assert.Empty(t, order.ShippingAddress.Address1)
+		assert.Equal(t, "USA", order.ShippingAddress.Country)
+	}
+	event := &models.Event{}
+	if assert.NoError(t, db.First(event, "order_id = ?", "old").Error) {
+		assert.Empty(t, event.IP)
+	}
+
+	result, err = Apply(context.Background(), db, config, nil, now, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, result.Orders, "anonymized orders are only handled once")
+	}
+}
+
+func TestArchiveFailureKeepsOrders(t *testing.T) {
+	db, config := testDB(t)
+	config.Retention.Action = conf.ArchiveRetention
+	createOrder(t, db, "old", now.AddDate(-8, 0, 0))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	archive, err := NewArchive("s3://orders?endpoint="+server.URL, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = Apply(context.Background(), db, config, archive, now, false)
+	assert.Error(t, err)
+	assert.NoError(t, db.First(&models.Order{}, "id = ?", "old").Error)
+}
+
+func TestS3Archive(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	var method, path, auth, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, path, auth, body = r.Method, r.URL.Path, r.Header.Get("Authorization"), string(data)
+	}))
+	defer server.Close()
+
+	archive, err := NewArchive("s3://bucket/gocommerce/?region=eu-west-1&endpoint="+server.URL, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, archive.Put(context.Background(), "orders/2018/05/1.json", []byte(`{"order": {}}`)))
+	assert.Equal(t, "PUT", method)
+	assert.Equal(t, "/bucket/gocommerce/orders/2018/05/1.json", path)
+	assert.True(t, strings.Contains(auth, "/eu-west-1/s3/aws4_request"), auth)
+	assert.Equal(t, `{"order": {}}`, body)
+
+	u, _ := url.Parse("s3://bucket/prefix")
+	aws, err := newS3Archive(u, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://bucket.s3.us-east-1.amazonaws.com", aws.endpoint.String())
+	}
+
+	for _, invalid := range []string{"s3:///prefix", "file://", "ftp://host/path"} {
+		_, err := NewArchive(invalid, nil)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,162 @@
+// Package scheduler runs the recurring tasks of GoCommerce, like expiring
+// unpaid orders or applying the retention policy. A task runs in one
+// process at a time, the one that claims it in the database, once per
+// interval however many processes are running. Local tasks, like refreshing
+// the caches of a process, run in every process instead.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// pollInterval is how often the scheduler looks for tasks that are due, at
+// most
+const pollInterval = 10 * time.Second
+
+// lockTimeout is how long a task can run. The claim of a process that
+// stopped while running it is taken over after it.
+const lockTimeout = time.Hour
+
+// Task is a recurring task
+type Task struct {
+	Name     string
+	Interval time.Duration
+	// Local tasks run in every process, without claiming them
+	Local bool
+	Run   func(ctx context.Context, now time.Time) error
+}
+
+// Scheduler runs its tasks every interval
+type Scheduler struct {
+	db  *gorm.DB
+	log *logrus.Entry
+	id  string
+
+	mutex sync.Mutex
+	tasks []*Task
+	// localRuns is when the local tasks are due next
+	localRuns map[string]time.Time
+}
+
+// New creates a scheduler without tasks
+func New(db *gorm.DB, log *logrus.Entry) *Scheduler {
+	return &Scheduler{
+		db:        db,
+		log:       log,
+		id:        uuid.NewRandom().String(),
+		localRuns: map[string]time.Time{},
+	}
+}
+
+// Add schedules a task
+func (s *Scheduler) Add(task *Task) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tasks = append(s.tasks, task)
+}
+
+// Tasks are the scheduled tasks
+func (s *Scheduler) Tasks() []*Task {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*Task{}, s.tasks...)
+}
+
+// Tick runs the tasks that are due at now, one after the other, and returns
+// the names of the ones it ran
+func (s *Scheduler) Tick(ctx context.Context, now time.Time) []string {
+	ran := []string{}
+	for _, task := range s.Tasks() {
+		if ctx.Err() != nil {
+			break
+		}
+		log := s.log.WithField("task", task.Name)
+		if task.Local {
+			s.mutex.Lock()
+			due := !now.Before(s.localRuns[task.Name])
+			if due {
+				s.localRuns[task.Name] = now.Add(task.Interval)
+			}
+			s.mutex.Unlock()
+			if !due {
+				continue
+			}
+			if err := s.run(ctx, task, now); err != nil {
+				log.WithError(err).Error("Scheduled task failed")
+			}
+			ran = append(ran, task.Name)
+			continue
+		}
+
+		claimed, err := models.ClaimScheduledTask(s.db, task.Name, s.id, now, lockTimeout)
+		if err != nil {
+			log.WithError(err).Error("Error claiming scheduled task")
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		err = s.run(ctx, task, now)
+		if err != nil {
+			log.WithError(err).Error("Scheduled task failed")
+		}
+		if err := models.FinishScheduledTask(s.db, task.Name, s.id, now, now.Add(task.Interval), err); err != nil {
+			log.WithError(err).Error("Error recording the run of scheduled task")
+		}
+		ran = append(ran, task.Name)
+	}
+	return ran
+}
+
+func (s *Scheduler) run(ctx context.Context, task *Task, now time.Time) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return task.Run(ctx, now)
+}
+
+// Run runs the tasks in the background until it's stopped. Stopping
+// cancels the context of the task that is running and waits for it.
+func (s *Scheduler) Run() (stop func()) {
+	interval := pollInterval
+	for _, task := range s.Tasks() {
+		if task.Interval > 0 && task.Interval < interval {
+			interval = task.Interval
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.Tick(ctx, time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
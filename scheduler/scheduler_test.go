@@ -0,0 +1,153 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+var now = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func testDB(t *testing.T) *gorm.DB {
+	f, err := ioutil.TempFile("", "scheduler-db")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	f.Close()
+
+	config := new(conf.Configuration)
+	config.DB.Driver = "sqlite3"
+	config.DB.ConnURL = f.Name()
+	config.DB.Automigrate = true
+	db, err := models.Connect(config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return db
+}
+
+func countingTask(name string, interval time.Duration, runs *int) *Task {
+	return &Task{Name: name, Interval: interval, Run: func(ctx context.Context, now time.Time) error {
+		*runs++
+		return nil
+	}}
+}
+
+func TestTasksRunOnceAcrossProcesses(t *testing.T) {
+	db := testDB(t)
+	runs := 0
+	first := New(db, logrus.WithField("test", t.Name()))
+	first.Add(countingTask("expire_orders", 5*time.Minute, &runs))
+	second := New(db, logrus.WithField("test", t.Name()))
+	second.Add(countingTask("expire_orders", 5*time.Minute, &runs))
+
+	assert.Equal(t, []string{"expire_orders"}, first.Tick(context.Background(), now))
+	assert.Empty(t, second.Tick(context.Background(), now.Add(time.Minute)))
+	assert.Equal(t, 1, runs)
+
+	assert.Equal(t, []string{"expire_orders"}, second.Tick(context.Background(), now.Add(5*time.Minute)))
+	assert.Empty(t, first.Tick(context.Background(), now.Add(6*time.Minute)))
+	assert.Equal(t, 2, runs)
+
+	task := &models.ScheduledTask{}
+	if assert.NoError(t, db.First(task, "name = ?", "expire_orders").Error) {
+		assert.Equal(t, now.Add(10*time.Minute), task.NextRunAt.UTC())
+		assert.Equal(t, now.Add(5*time.Minute), task.LastRunAt.UTC())
+		assert.Nil(t, task.LockedBy)
+		assert.Nil(t, task.ErrorMessage)
+	}
+}
+
+func TestFailedTasksAreRecorded(t *testing.T) {
+	db := testDB(t)
+	s := New(db, logrus.WithField("test", t.Name()))
+	s.Add(&Task{Name: "retention", Interval: time.Hour, Run: func(ctx context.Context, now time.Time) error {
+		return errors.New("archive unavailable")
+	}})
+	s.Add(&Task{Name: "panics", Interval: time.Hour, Run: func(ctx context.Context, now time.Time) error {
+		panic("boom")
+	}})
+
+	assert.Equal(t, []string{"retention", "panics"}, s.Tick(context.Background(), now))
+	tasks := []*models.ScheduledTask{}
+	db.Order("name").Find(&tasks)
+	if assert.Len(t, tasks, 2) {
+		assert.Contains(t, *tasks[0].ErrorMessage, "boom")
+		assert.Equal(t, "archive unavailable", *tasks[1].ErrorMessage)
+		assert.Equal(t, now.Add(time.Hour), tasks[1].NextRunAt.UTC(), "failed tasks run at the next interval")
+	}
+}
+
+func TestStaleClaimsAreTakenOver(t *testing.T) {
+	db := testDB(t)
+	claimed, err := models.ClaimScheduledTask(db, "retention", "gone", now, lockTimeout)
+	if assert.NoError(t, err) {
+		assert.True(t, claimed)
+	}
+
+	runs := 0
+	s := New(db, logrus.WithField("test", t.Name()))
+	s.Add(countingTask("retention", time.Minute, &runs))
+	s.Tick(context.Background(), now.Add(10*time.Minute))
+	assert.Equal(t, 0, runs, "still running in the other process")
+
+	s.Tick(context.Background(), now.Add(lockTimeout+time.Minute))
+	assert.Equal(t, 1, runs)
+}
+
+func TestLocalTasksRunInEveryProcess(t *testing.T) {
+	db := testDB(t)
+	runs := 0
+	first := New(db, logrus.WithField("test", t.Name()))
+	second := New(db, logrus.WithField("test", t.Name()))
+	for _, s := range []*Scheduler{first, second} {
+		task := countingTask("refresh_settings", time.Minute, &runs)
+		task.Local = true
+		s.Add(task)
+	}
+
+	first.Tick(context.Background(), now)
+	second.Tick(context.Background(), now)
+	assert.Equal(t, 2, runs)
+	first.Tick(context.Background(), now.Add(30*time.Second))
+	assert.Equal(t, 2, runs)
+	first.Tick(context.Background(), now.Add(time.Minute))
+	assert.Equal(t, 3, runs)
+
+	count := 0
+	db.Model(&models.ScheduledTask{}).Count(&count)
+	assert.Equal(t, 0, count, "local tasks aren't claimed")
+}
+
+func TestStopCancelsRunningTask(t *testing.T) {
+	db := testDB(t)
+	started := make(chan struct{})
+	s := New(db, logrus.WithField("test", t.Name()))
+	s.Add(&Task{Name: "retention", Interval: time.Hour, Local: true, Run: func(ctx context.Context, now time.Time) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+
+	stop := s.Run()
+	<-started
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "stopping waited for the task to finish on its own")
+	}
+}
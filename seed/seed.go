@@ -0,0 +1,271 @@
+// Package seed fills a database with a demo store: customers, stock and
+// orders in every state, so storefronts and back offices can be developed
+// and tested against realistic data.
+package seed
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/refs"
+)
+
+// ErrSeeded is returned when the demo data is in the database already
+var ErrSeeded = errors.New("the demo data was seeded already")
+
+// Product is a product of the demo store. The products themselves are pages
+// of the site, the database only knows them from the orders and the stock.
+type Product struct {
+	Sku   string
+	Title string
+	Type  string
+	Path  string
+	Price uint64
+	// Stock is the quantity in stock, products without stock aren't
+	// tracked, like downloads
+	Stock *int64
+}
+
+// Coupon is the coupon some of the demo orders were placed with. Coupons
+// are served by the site, add it to its coupons.json to use it.
+var Coupon = models.Coupon{Code: "DEMO10", Percentage: 10}
+
+func stock(quantity int64) *int64 {
+	return &quantity
+}
+
+// Products are the products of the demo store
+var Products = []Product{
+	{Sku: "demo-t-shirt", Title: "Gocommerce T-Shirt", Type: "apparel", Path: "/products/t-shirt/", Price: 2500, Stock: stock(120)},
+	{Sku: "demo-hoodie", Title: "Gocommerce Hoodie", Type: "apparel", Path: "/products/hoodie/", Price: 5900, Stock: stock(24)},
+	{Sku: "demo-mug", Title: "Coffee Mug", Type: "homeware", Path: "/products/mug/", Price: 1400, Stock: stock(3)},
+	{Sku: "demo-stickers", Title: "Sticker Pack", Type: "accessories", Path: "/products/stickers/", Price: 500, Stock: stock(0)},
+	{Sku: "demo-e-book", Title: "The Static Store (E-Book)", Type: "book", Path: "/products/e-book/", Price: 999},
+}
+
+type customer struct {
+	id      string
+	email   string
+	address models.AddressRequest
+}
+
+var customers = []customer{
+	{"demo-user-alice", "alice@example.com", models.AddressRequest{
+		FirstName: "Alice", LastName: "Smith", Address1: "1 Market Street", City: "San Francisco", State: "CA", Zip: "94105", Country: "USA",
+	}},
+	{"demo-user-bob", "bob@example.com", models.AddressRequest{
+		FirstName: "Bob", LastName: "Müller", Address1: "Torstraße 12", City: "Berlin", Zip: "10119", Country: "Germany",
+	}},
+	{"demo-user-chloe", "chloe@example.com", models.AddressRequest{
+		FirstName: "Chloé", LastName: "Martin", Company: "Atelier Martin", Address1: "8 rue de Rivoli", City: "Paris", Zip: "75004", Country: "France",
+	}},
+}
+
+// guest places an order without an account
+var guest = customer{"", "guest@example.com", models.AddressRequest{
+	FirstName: "Grace", LastName: "Hopper", Address1: "2 Harbour Road", City: "Dublin", Country: "Ireland",
+}}
+
+type item struct {
+	sku      string
+	quantity uint64
+}
+
+// demoOrder is an order of the demo store and what happened to it
+type demoOrder struct {
+	customer  customer
+	age       time.Duration
+	items     []item
+	coupon    bool
+	paid      bool
+	shipped   bool
+	cancelled bool
+	refunded  bool
+}
+
+var orders = []demoOrder{
+	{customer: customers[0], age: 40 * 24 * time.Hour, items: []item{{"demo-t-shirt", 2}, {"demo-mug", 1}}, paid: true, shipped: true},
+	{customer: customers[0], age: 2 * 24 * time.Hour, items: []item{{"demo-hoodie", 1}}, coupon: true, paid: true},
+	{customer: customers[1], age: 25 * 24 * time.Hour, items: []item{{"demo-e-book", 1}, {"demo-stickers", 3}}, paid: true, shipped: true},
+	{customer: customers[1], age: 10 * 24 * time.Hour, items: []item{{"demo-hoodie", 2}}, cancelled: true},
+	{customer: customers[2], age: 15 * 24 * time.Hour, items: []item{{"demo-t-shirt", 1}}, coupon: true, paid: true, shipped: true, refunded: true},
+	{customer: customers[2], age: 3 * time.Hour, items: []item{{"demo-mug", 2}, {"demo-e-book", 1}}},
+	{customer: guest, age: 5 * 24 * time.Hour, items: []item{{"demo-stickers", 1}, {"demo-e-book", 1}}, paid: true},
+}
+
+// transaction is a transaction of an order that's saved with it
+func transaction(order *models.Order) *models.Transaction {
+	t := models.NewTransaction(order)
+	t.Order = nil
+	t.User = nil
+	return t
+}
+
+// Result counts the records a seed created
+type Result struct {
+	Users          int `json:"users"`
+	Orders         int `json:"orders"`
+	Transactions   int `json:"transactions"`
+	InventoryItems int `json:"inventory_items"`
+}
+
+// Seed adds the demo store to the database, with orders placed up to 40 days
+// before now. The orders are test orders, so purge-test-orders removes them
+// again, and seeding once more after that adds new orders for the customers
+// that are left.
+func Seed(db *gorm.DB, encoder refs.Encoder, now time.Time) (*Result, error) {
+	emails := []string{}
+	for _, c := range append(customers, guest) {
+		emails = append(emails, c.email)
+	}
+	count := 0
+	if err := db.Model(&models.Order{}).Where("test_mode = ? AND email IN (?)", true, emails).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrSeeded
+	}
+
+	result := &Result{}
+	tx := db.Begin()
+	if err := seed(tx, encoder, now, result); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return result, tx.Commit().Error
+}
+
+// createMissing creates the record unless one with its ID is there from an
+// earlier seed, deleted or not
+func createMissing(tx *gorm.DB, record interface{}, id string) (bool, error) {
+	count := 0
+	if err := tx.Unscoped().Model(record).Where("id = ?", id).Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	return true, tx.Create(record).Error
+}
+
+func seed(tx *gorm.DB, encoder refs.Encoder, now time.Time, result *Result) error {
+	products := map[string]Product{}
+	for _, product := range Products {
+		products[product.Sku] = product
+		if product.Stock == nil {
+			continue
+		}
+		if _, _, err := models.SetInventory(tx, product.Sku, *product.Stock); err != nil {
+			return err
+		}
+		result.InventoryItems++
+	}
+
+	addresses := map[string]string{}
+	for _, c := range append(customers, guest) {
+		if c.id != "" {
+			created, err := createMissing(tx, &models.User{ID: c.id, Email: c.email}, c.id)
+			if err != nil {
+				return err
+			}
+			if created {
+				result.Users++
+			}
+		}
+		address := &models.Address{ID: fmt.Sprintf("demo-address-%d", len(addresses)+1), AddressRequest: c.address, UserID: c.id}
+		if _, err := createMissing(tx, address, address.ID); err != nil {
+			return err
+		}
+		addresses[c.email] = address.ID
+	}
+
+	for _, demo := range orders {
+		order := models.NewOrder("", demo.customer.email, "USD")
+		order.UserID = demo.customer.id
+		order.TestMode = true
+		order.ShippingAddressID = addresses[demo.customer.email]
+		order.BillingAddressID = order.ShippingAddressID
+		order.TaxBasis = conf.ShippingTaxBasis
+		order.TaxCountry = demo.customer.address.Country
+		for _, item := range demo.items {
+			product := products[item.sku]
+			order.LineItems = append(order.LineItems, &models.LineItem{
+				Sku:      product.Sku,
+				Title:    product.Title,
+				Type:     product.Type,
+				Path:     product.Path,
+				Price:    product.Price,
+				Quantity: item.quantity,
+			})
+		}
+		if demo.coupon {
+			coupon := Coupon
+			order.Coupon = &coupon
+			order.CouponCode = coupon.Code
+		}
+		order.CalculateTotal(&calculator.Settings{})
+		if err := order.BeforeUpdate(); err != nil {
+			return err
+		}
+
+		number, err := models.NextOrderNumber(tx)
+		if err != nil {
+			return err
+		}
+		if order.Ref, err = encoder.Encode(number); err != nil {
+			return err
+		}
+
+		placedAt := now.Add(-demo.age)
+		if demo.paid {
+			order.PaymentState = models.PaidState
+			order.PaymentProcessor = "stripe"
+			charge := transaction(order)
+			charge.ProcessorID = "ch_demo_" + order.Ref
+			charge.Status = models.PaidState
+			order.Transactions = append(order.Transactions, charge)
+		}
+		if demo.shipped {
+			order.FulfillmentState = models.ShippedState
+			order.Carrier = "UPS"
+			order.TrackingNumber = fmt.Sprintf("1ZDEMO%010d", number)
+			order.TrackingURL = "https://www.ups.com/track?tracknum=" + order.TrackingNumber
+		}
+		if demo.cancelled {
+			cancelledAt := placedAt.Add(time.Hour)
+			order.State = models.CancelledState
+			order.CancellationReason = "customer_request"
+			order.CancelledAt = &cancelledAt
+		}
+		if demo.refunded {
+			refund := transaction(order)
+			refund.Type = models.RefundTransactionType
+			refund.ProcessorID = "re_demo_" + order.Ref
+			refund.Status = models.PaidState
+			refund.Reason = "damaged_item"
+			order.Transactions = append(order.Transactions, refund)
+		}
+
+		if err := tx.Create(order).Error; err != nil {
+			return err
+		}
+		result.Orders++
+		result.Transactions += len(order.Transactions)
+
+		// the records are stamped with the current time on create
+		rsp := tx.Model(&models.Order{}).Where("id = ?", order.ID).UpdateColumns(map[string]interface{}{"created_at": placedAt, "updated_at": placedAt})
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if err := tx.Model(&models.Transaction{}).Where("order_id = ?", order.ID).UpdateColumn("created_at", placedAt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package seed
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/refs"
+)
+
+var now = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func testDB(t *testing.T) *gorm.DB {
+	f, err := ioutil.TempFile("", "seed-db")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	f.Close()
+
+	config := new(conf.Configuration)
+	config.DB.Driver = "sqlite3"
+	config.DB.ConnURL = f.Name()
+	config.DB.Automigrate = true
+	db, err := models.Connect(config)
+	if !assert.NoError(t, err) {
+		os.Remove(f.Name())
+		t.FailNow()
+	}
+	return db
+}
+
+func TestSeed(t *testing.T) {
+	db := testDB(t)
+	result, err := Seed(db, refs.NewObfuscator("salt", ""), now)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &Result{Users: 3, Orders: 7, Transactions: 6, InventoryItems: 4}, result)
+
+	orders := []*models.Order{}
+	assert.NoError(t, db.Preload("LineItems").Preload("Transactions").Order("created_at asc").Find(&orders).Error)
+	if !assert.Len(t, orders, 7) {
+		return
+	}
+	oldest := orders[0]
+	assert.Equal(t, now.Add(-40*24*time.Hour).Unix(), oldest.CreatedAt.Unix())
+	assert.Equal(t, "demo-user-alice", oldest.UserID)
+	assert.Equal(t, models.PaidState, oldest.PaymentState)
+	assert.Equal(t, models.ShippedState, oldest.FulfillmentState)
+	assert.Equal(t, uint64(2*2500+1400), oldest.Total)
+	assert.NotEmpty(t, oldest.Ref)
+	assert.Len(t, oldest.LineItems, 2)
+	assert.Len(t, oldest.Transactions, 1)
+
+	states := map[string]int{}
+	discounted := 0
+	for _, order := range orders {
+		assert.True(t, order.TestMode)
+		states[order.State+"/"+order.PaymentState]++
+		if order.Coupon != nil {
+			assert.Equal(t, Coupon.Code, order.Coupon.Code)
+			assert.True(t, order.Discount > 0)
+			discounted++
+		}
+	}
+	assert.Equal(t, map[string]int{"pending/paid": 5, "pending/pending": 1, "cancelled/pending": 1}, states)
+	assert.Equal(t, 2, discounted)
+
+	item := &models.InventoryItem{}
+	assert.NoError(t, db.First(item, "sku = ?", "demo-mug").Error)
+	assert.Equal(t, int64(3), item.Quantity)
+
+	_, err = Seed(db, refs.NewObfuscator("salt", ""), now)
+	assert.Equal(t, ErrSeeded, err)
+
+	purged, err := models.PurgeTestOrders(db, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 7, purged.Orders)
+		assert.Equal(t, 6, purged.Transactions)
+	}
+
+	result, err = Seed(db, refs.NewObfuscator("salt", ""), now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Result{Orders: 7, Transactions: 6, InventoryItems: 4}, result)
+	}
+}
@@ -0,0 +1,32 @@
+package sigv4
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSign checks the example from the AWS Signature Version 4 documentation
+func TestSign(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	assert.NoError(t, Sign(req, "", "iam", "us-east-1", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)))
+
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, "+
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", req.Header.Get("Authorization"))
+}
+
+func TestSignWithoutCredentials(t *testing.T) {
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	req, _ := http.NewRequest("POST", "https://email.eu-west-1.amazonaws.com/", nil)
+	assert.Error(t, Sign(req, "", "ses", "eu-west-1", time.Now()))
+}
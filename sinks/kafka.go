@@ -0,0 +1,97 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	kafkaContentType = "application/vnd.kafka.json.v2+json"
+	kafkaAccept      = "application/vnd.kafka.v2+json"
+)
+
+// kafkaSink produces to a Kafka topic through the Confluent REST proxy, the
+// URL is the one of the topic on the proxy
+type kafkaSink struct {
+	client *http.Client
+	url    string
+	user   *url.Userinfo
+	topic  string
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+func newKafkaSink(u *url.URL, client *http.Client) (*kafkaSink, error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if u.Host == "" || len(parts) < 2 || parts[len(parts)-2] != "topics" {
+		return nil, fmt.Errorf("the Kafka sink needs the URL of a topic on the REST proxy, like kafka+https://proxy/topics/orders")
+	}
+	return &kafkaSink{
+		client: client,
+		url:    baseURL(u).String(),
+		user:   u.User,
+		topic:  parts[len(parts)-1],
+	}, nil
+}
+
+// Publish produces one record, keyed so the events of an order land on the
+// same partition
+func (s *kafkaSink) Publish(ctx context.Context, msg *Message) error {
+	body, err := json.Marshal(map[string][]kafkaRecord{
+		"records": {{Key: msg.Key, Value: json.RawMessage(msg.Body)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", kafkaAccept)
+	if s.user != nil {
+		pass, _ := s.user.Password()
+		req.SetBasicAuth(s.user.Username(), pass)
+	}
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("producing to Kafka topic %s: %v", s.topic, err)
+	}
+	defer rsp.Body.Close()
+	data, _ := ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("producing to Kafka topic %s: %s %s", s.topic, rsp.Status, data)
+	}
+
+	result := &kafkaResponse{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("reading the Kafka proxy response: %v", err)
+	}
+	for _, offset := range result.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("producing to Kafka topic %s: %s", s.topic, offset.Error)
+		}
+	}
+	return nil
+}
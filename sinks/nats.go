@@ -0,0 +1,291 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	natsDefaultPort = "4222"
+	natsTimeout     = 10 * time.Second
+)
+
+// natsSink publishes to a NATS subject, the path of the URL followed by the
+// event type. It keeps a connection to the server open between messages.
+type natsSink struct {
+	addr      string
+	subject   string
+	connect   []byte
+	tlsConfig *tls.Config
+
+	// mutex lets one message through at a time, so each PING gets its PONG
+	mutex sync.Mutex
+	conn  *natsConn
+}
+
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// natsInfo is the part of the INFO of the server the sink needs
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+func newNATSSink(u *url.URL) (*natsSink, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("the NATS sink needs a host")
+	}
+	subject := strings.Replace(strings.Trim(u.Path, "/"), "/", ".", -1)
+	if subject == "" {
+		return nil, fmt.Errorf("the NATS sink needs a subject, like nats://localhost:4222/gocommerce")
+	}
+	port := u.Port()
+	if port == "" {
+		port = natsDefaultPort
+	}
+
+	connect := natsConnect{Name: "gocommerce", Lang: "go", Version: "1.0.0"}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect.User = u.User.Username()
+			connect.Pass = pass
+		} else {
+			connect.AuthToken = u.User.Username()
+		}
+	}
+	data, err := json.Marshal(connect)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsSink{
+		addr:      net.JoinHostPort(u.Hostname(), port),
+		subject:   subject,
+		connect:   data,
+		tlsConfig: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+	}, nil
+}
+
+// Publish sends the message and waits for the server to answer a PING, which
+// it only does after it processed the publish. The connection is dropped
+// after an error and opened again for the next message.
+func (s *natsSink) Publish(ctx context.Context, msg *Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deadline := time.Now().Add(natsTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if s.conn != nil && s.conn.isClosed() {
+		s.conn = nil
+	}
+	if s.conn == nil {
+		conn, err := s.dial(ctx, deadline)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	} else {
+		s.conn.dropReplies()
+	}
+
+	if err := s.conn.publish(ctx, deadline, s.subject+"."+msg.Event, msg.Body); err != nil {
+		s.conn.close(err)
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the server
+func (s *natsSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != nil {
+		s.conn.close(errors.New("the sink is closed"))
+		s.conn = nil
+	}
+	return nil
+}
+
+// dial connects to the server, over TLS when the server requires it, and
+// introduces the sink with its credentials
+func (s *natsSink) dial(ctx context.Context, deadline time.Time) (*natsConn, error) {
+	dialer := &net.Dialer{Timeout: natsTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to NATS: %v", err)
+	}
+	conn.SetDeadline(deadline)
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading NATS server info: %v", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS greeting: %s", strings.TrimSpace(line))
+	}
+	info := &natsInfo{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), info); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading NATS server info: %v", err)
+	}
+
+	// the credentials in CONNECT are only sent once the connection is
+	// encrypted when the server asks for it
+	if info.TLSRequired {
+		tlsConn := tls.Client(conn, s.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("connecting to NATS over TLS: %v", err)
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	c := &natsConn{
+		conn:    conn,
+		w:       bufio.NewWriter(conn),
+		replies: make(chan error, 1),
+		closed:  make(chan struct{}),
+	}
+	c.w.WriteString("CONNECT ")
+	c.w.Write(s.connect)
+	c.w.WriteString("\r\n")
+	if err := c.w.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to NATS: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	go c.read(r)
+	return c, nil
+}
+
+// natsConn is an open connection to a NATS server. Its reader answers the
+// PINGs of the server, which closes connections that don't.
+type natsConn struct {
+	conn net.Conn
+
+	writeMutex sync.Mutex
+	w          *bufio.Writer
+
+	// replies gets the PONG or -ERR answering a PING
+	replies   chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func (c *natsConn) read(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.close(err)
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			c.reply(nil)
+		case line == "PING":
+			c.write(time.Now().Add(natsTimeout), func(w *bufio.Writer) { w.WriteString("PONG\r\n") })
+		case strings.HasPrefix(line, "-ERR"):
+			c.reply(fmt.Errorf("NATS error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))))
+		}
+	}
+}
+
+func (c *natsConn) reply(err error) {
+	select {
+	case c.replies <- err:
+	default:
+	}
+}
+
+// dropReplies forgets what the server said since the last message, like an
+// -ERR that didn't close the connection
+func (c *natsConn) dropReplies() {
+	select {
+	case <-c.replies:
+	default:
+	}
+}
+
+func (c *natsConn) write(deadline time.Time, fn func(w *bufio.Writer)) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(deadline)
+	fn(c.w)
+	return c.w.Flush()
+}
+
+func (c *natsConn) publish(ctx context.Context, deadline time.Time, subject string, body []byte) error {
+	err := c.write(deadline, func(w *bufio.Writer) {
+		fmt.Fprintf(w, "PUB %s %d\r\n", subject, len(body))
+		w.Write(body)
+		w.WriteString("\r\nPING\r\n")
+	})
+	if err != nil {
+		return fmt.Errorf("publishing to NATS: %v", err)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case err := <-c.replies:
+		return err
+	case <-c.closed:
+		// an -ERR is usually followed by the server closing the connection
+		select {
+		case err := <-c.replies:
+			if err != nil {
+				return err
+			}
+		default:
+		}
+		return fmt.Errorf("waiting for NATS: %v", c.err)
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for NATS: %v", ctx.Err())
+	case <-timer.C:
+		return fmt.Errorf("waiting for NATS: timed out")
+	}
+}
+
+func (c *natsConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *natsConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.closed)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,259 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testMessage = &Message{
+	ID:    "42",
+	Event: "order",
+	Key:   "order-1",
+	Body:  []byte(`{"event":"order","data":{"id":"order-1"}}`),
+}
+
+func TestNewSinkValidation(t *testing.T) {
+	valid := []string{
+		"nats://localhost:4222/gocommerce",
+		"kafka+https://proxy.example.com/topics/orders",
+		"sqs+https://sqs.eu-west-1.amazonaws.com/123456789012/orders",
+		"sqs+http://localhost:9324/queue/orders?region=us-east-1",
+	}
+	for _, u := range valid {
+		assert.NoError(t, Validate(u), u)
+	}
+
+	invalid := []string{
+		"https://example.com/hooks",
+		"nats://localhost:4222",
+		"kafka+https://proxy.example.com/orders",
+		"sqs+http://localhost:9324/queue/orders",
+	}
+	for _, u := range invalid {
+		assert.Error(t, Validate(u), u)
+	}
+}
+
+// natsServer accepts one connection, over TLS when config is set, and
+// answers the PINGs, sending the lines read up to each PING to received
+func natsServer(t *testing.T, config *tls.Config) (net.Listener, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	received := make(chan []string, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if config != nil {
+			fmt.Fprint(conn, "INFO {\"server_id\":\"test\",\"tls_required\":true}\r\n")
+			conn = tls.Server(conn, config)
+		} else {
+			fmt.Fprint(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		}
+		r := bufio.NewReader(conn)
+		lines := []string{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			lines = append(lines, line)
+			if line == "PING" {
+				fmt.Fprint(conn, "PONG\r\n")
+				received <- lines
+				lines = []string{}
+			}
+		}
+	}()
+	return l, received
+}
+
+func TestNATSPublish(t *testing.T) {
+	l, received := natsServer(t, nil)
+	defer l.Close()
+
+	sink, err := New("nats://secret-token@"+l.Addr().String()+"/gocommerce/events", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.(*natsSink).Close()
+	if !assert.NoError(t, sink.Publish(context.Background(), testMessage)) {
+		return
+	}
+
+	lines := <-received
+	if assert.Len(t, lines, 4) {
+		connect := &natsConnect{}
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[0], "CONNECT ")), connect))
+		assert.Equal(t, "secret-token", connect.AuthToken)
+		assert.Equal(t, fmt.Sprintf("PUB gocommerce.events.order %d", len(testMessage.Body)), lines[1])
+		assert.Equal(t, string(testMessage.Body), lines[2])
+	}
+
+	// the server only accepts one connection
+	if assert.NoError(t, sink.Publish(context.Background(), testMessage), "the connection is kept open") {
+		lines = <-received
+		assert.Equal(t, fmt.Sprintf("PUB gocommerce.events.order %d", len(testMessage.Body)), lines[0])
+	}
+}
+
+func TestNATSPublishOverTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	l, received := natsServer(t, &tls.Config{Certificates: server.TLS.Certificates})
+	defer l.Close()
+
+	sink, err := New("nats://user:secret@"+l.Addr().String()+"/gocommerce", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	nats := sink.(*natsSink)
+	defer nats.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	nats.tlsConfig.RootCAs = roots
+
+	if assert.NoError(t, sink.Publish(context.Background(), testMessage)) {
+		lines := <-received
+		connect := &natsConnect{}
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[0], "CONNECT ")), connect))
+		assert.Equal(t, "secret", connect.Pass, "the credentials are sent over TLS")
+	}
+}
+
+func TestNATSPublishRequiresTrustedTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	l, received := natsServer(t, &tls.Config{Certificates: server.TLS.Certificates})
+	defer l.Close()
+
+	sink, err := New("nats://user:secret@"+l.Addr().String()+"/gocommerce", nil)
+	if assert.NoError(t, err) {
+		assert.Error(t, sink.Publish(context.Background(), testMessage))
+		assert.Empty(t, received, "no credentials are sent to a server that isn't trusted")
+	}
+}
+
+func TestNATSPublishError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "INFO {}\r\n-ERR 'Authorization Violation'\r\n")
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	sink, err := New("nats://"+l.Addr().String()+"/gocommerce", nil)
+	if assert.NoError(t, err) {
+		err = sink.Publish(context.Background(), testMessage)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "Authorization Violation")
+		}
+	}
+}
+
+func TestKafkaPublish(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/orders", r.URL.Path)
+		assert.Equal(t, kafkaContentType, r.Header.Get("Content-Type"))
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "pass", pass)
+
+		body := struct {
+			Records []kafkaRecord `json:"records"`
+		}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if assert.Len(t, body.Records, 1) {
+			assert.Equal(t, "order-1", body.Records[0].Key)
+			assert.JSONEq(t, string(testMessage.Body), string(body.Records[0].Value))
+		}
+		fmt.Fprint(w, `{"offsets": [{"partition": 0, "offset": 12}]}`)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	sink, err := New("kafka+http://user:pass@"+u.Host+"/topics/orders", nil)
+	if assert.NoError(t, err) {
+		assert.NoError(t, sink.Publish(context.Background(), testMessage))
+	}
+}
+
+func TestKafkaPublishError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"offsets": [{"error_code": 50003, "error": "Kafka error"}]}`)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	sink, err := New("kafka+http://"+u.Host+"/topics/orders", nil)
+	if assert.NoError(t, err) {
+		assert.Error(t, sink.Publish(context.Background(), testMessage))
+	}
+}
+
+func TestSQSPublish(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/123456789012/orders.fifo", r.URL.Path)
+		assert.Equal(t, "20170301T120000Z", r.Header.Get("X-Amz-Date"))
+		auth := r.Header.Get("Authorization")
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20170301/eu-west-1/sqs/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature="), auth)
+
+		data, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(data))
+		assert.Equal(t, "SendMessage", form.Get("Action"))
+		assert.Equal(t, string(testMessage.Body), form.Get("MessageBody"))
+		assert.Equal(t, "order", form.Get("MessageAttribute.1.Value.StringValue"))
+		assert.Equal(t, "order-1", form.Get("MessageGroupId"))
+		assert.Equal(t, "42", form.Get("MessageDeduplicationId"))
+		fmt.Fprint(w, "<SendMessageResponse></SendMessageResponse>")
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	sink, err := New("sqs+http://"+u.Host+"/123456789012/orders.fifo?region=eu-west-1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sink.(*sqsSink).now = func() time.Time { return time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC) }
+	assert.NoError(t, sink.Publish(context.Background(), testMessage))
+}
+
+func TestSQSRegion(t *testing.T) {
+	assert.Equal(t, "eu-west-1", sqsRegion("sqs.eu-west-1.amazonaws.com"))
+	assert.Equal(t, "", sqsRegion("localhost"))
+}
@@ -0,0 +1,100 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/sigv4"
+)
+
+const (
+	sqsAPIVersion = "2012-11-05"
+	sqsService    = "sqs"
+)
+
+// sqsSink sends messages to an SQS queue, the URL is the one of the queue
+type sqsSink struct {
+	client   *http.Client
+	queueURL string
+	region   string
+	fifo     bool
+	now      func() time.Time
+}
+
+func newSQSSink(u *url.URL, client *http.Client) (*sqsSink, error) {
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("the SQS sink needs the URL of a queue, like sqs+https://sqs.eu-west-1.amazonaws.com/123456789012/orders")
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = sqsRegion(u.Hostname())
+	}
+	if region == "" {
+		return nil, fmt.Errorf("can't tell the region of SQS queue %s, add ?region= to the URL", u.Host)
+	}
+	return &sqsSink{
+		client:   client,
+		queueURL: baseURL(u).String(),
+		region:   region,
+		fifo:     strings.HasSuffix(u.Path, ".fifo"),
+		now:      time.Now,
+	}, nil
+}
+
+// sqsRegion finds the region in hosts like sqs.eu-west-1.amazonaws.com
+func sqsRegion(host string) string {
+	parts := strings.Split(host, ".")
+	if len(parts) >= 4 && parts[0] == "sqs" && strings.HasSuffix(host, ".amazonaws.com") {
+		return parts[1]
+	}
+	return ""
+}
+
+// Publish sends one message with the event type as a message attribute.
+// FIFO queues group the messages by key and drop duplicates by ID.
+func (s *sqsSink) Publish(ctx context.Context, msg *Message) error {
+	form := url.Values{
+		"Action":                               {"SendMessage"},
+		"Version":                              {sqsAPIVersion},
+		"QueueUrl":                             {s.queueURL},
+		"MessageBody":                          {string(msg.Body)},
+		"MessageAttribute.1.Name":              {"event"},
+		"MessageAttribute.1.Value.DataType":    {"String"},
+		"MessageAttribute.1.Value.StringValue": {msg.Event},
+	}
+	if s.fifo {
+		group := msg.Key
+		if group == "" {
+			group = msg.Event
+		}
+		form.Set("MessageGroupId", group)
+		form.Set("MessageDeduplicationId", msg.ID)
+	}
+	body := form.Encode()
+
+	req, err := http.NewRequest("POST", s.queueURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := sigv4.Sign(req, body, sqsService, s.region, s.now()); err != nil {
+		return err
+	}
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending to SQS: %v", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("sending to SQS: %s %s", rsp.Status, data)
+	}
+	return nil
+}
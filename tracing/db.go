@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	contextKey = "tracing:context"
+	spanKey    = "tracing:span"
+)
+
+// WithContext returns a db handle whose queries are traced as children of
+// the span in ctx
+func WithContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	return db.Set(contextKey, ctx)
+}
+
+// RegisterCallbacks traces the queries made with a handle from WithContext.
+// Queries without a context, like the ones from background workers, aren't
+// traced.
+func RegisterCallbacks(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:begin_transaction").Register("tracing:before", startQuerySpan("create"))
+	callbacks.Create().After("gorm:commit_or_rollback_transaction").Register("tracing:after", endQuerySpan)
+	callbacks.Update().Before("gorm:assign_updating_attributes").Register("tracing:before", startQuerySpan("update"))
+	callbacks.Update().After("gorm:commit_or_rollback_transaction").Register("tracing:after", endQuerySpan)
+	callbacks.Delete().Before("gorm:begin_transaction").Register("tracing:before", startQuerySpan("delete"))
+	callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register("tracing:after", endQuerySpan)
+	callbacks.Query().Before("gorm:query").Register("tracing:before", startQuerySpan("query"))
+	callbacks.Query().After("gorm:after_query").Register("tracing:after", endQuerySpan)
+	callbacks.RowQuery().Before("gorm:row_query").Register("tracing:before", startQuerySpan("query"))
+	callbacks.RowQuery().After("gorm:row_query").Register("tracing:after", endQuerySpan)
+}
+
+func startQuerySpan(operation string) func(*gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		value, ok := scope.Get(contextKey)
+		if !ok {
+			return
+		}
+		ctx, ok := value.(context.Context)
+		if !ok {
+			return
+		}
+
+		_, span := StartSpan(ctx, "db."+operation,
+			attribute.String("db.system", scope.Dialect().GetName()),
+			attribute.String("db.operation.name", operation),
+			attribute.String("db.collection.name", scope.TableName()),
+		)
+		scope.Set(spanKey, span)
+	}
+}
+
+func endQuerySpan(scope *gorm.Scope) {
+	value, ok := scope.Get(spanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	span.SetAttributes(attribute.String("db.query.text", scope.SQL))
+	var err error
+	if scope.HasError() && scope.DB().Error != gorm.ErrRecordNotFound {
+		err = scope.DB().Error
+	}
+	EndSpan(span, err)
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const incomingParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+type widget struct {
+	ID   uint64
+	Name string
+}
+
+func recordSpans() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	return exporter
+}
+
+func TestMiddlewareContinuesTrace(t *testing.T) {
+	exporter := recordSpans()
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := StartSpan(r.Context(), "child")
+		span.End()
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	r := httptest.NewRequest("GET", "/v1/orders", nil)
+	r.Header.Set("traceparent", incomingParent)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 2) {
+		child, server := spans[0], spans[1]
+		assert.Equal(t, "HTTP GET", server.Name)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String())
+		assert.Equal(t, server.SpanContext.SpanID(), child.Parent.SpanID())
+	}
+}
+
+func TestDatabaseSpans(t *testing.T) {
+	exporter := recordSpans()
+
+	f, _ := ioutil.TempFile("", "tracing-db")
+	defer os.Remove(f.Name())
+	db, err := gorm.Open("sqlite3", f.Name())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer db.Close()
+	db.AutoMigrate(&widget{})
+	RegisterCallbacks(db)
+
+	// untraced queries don't create spans
+	db.Create(&widget{Name: "untraced"})
+	assert.Len(t, exporter.GetSpans(), 0)
+
+	ctx, parent := StartSpan(httptest.NewRequest("GET", "/", nil).Context(), "request")
+	traced := WithContext(db, ctx)
+	traced.Create(&widget{Name: "traced"})
+	traced.Find(&[]widget{})
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 3) {
+		assert.Equal(t, "db.create", spans[0].Name)
+		assert.Equal(t, "db.query", spans[1].Name)
+		for _, span := range spans[:2] {
+			assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The formats webhooks can be sent in. JSONFormat, the default, sends the
+// payload as is, or in an Envelope to endpoints that get every event.
+// CloudEventsFormat sends a CloudEvents 1.0 event in structured mode.
+const (
+	JSONFormat        = "json"
+	CloudEventsFormat = "cloudevents"
+)
+
+// CloudEvents constants
+const (
+	CloudEventsSpecVersion = "1.0"
+	CloudEventsContentType = "application/cloudevents+json"
+	// CloudEventsTypePrefix comes before the event type in the type of a
+	// CloudEvent, like com.netlify.gocommerce.payment
+	CloudEventsTypePrefix = "com.netlify.gocommerce."
+)
+
+// ValidFormat checks if a webhook format is known, empty is JSONFormat
+func ValidFormat(format string) bool {
+	return format == "" || format == JSONFormat || format == CloudEventsFormat
+}
+
+// CloudEvent is the body of webhooks sent in CloudEventsFormat. Data is the
+// payload the URL for the type would get.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// NewCloudEvent wraps the payload of an event. The subject is the order the
+// event is about, if any.
+func NewCloudEvent(id, source, eventType, subject string, data json.RawMessage, at time.Time) *CloudEvent {
+	return &CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              id,
+		Source:          source,
+		Type:            CloudEventsTypePrefix + eventType,
+		Subject:         subject,
+		Time:            at.UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
@@ -0,0 +1,248 @@
+// Package webhooks verifies and decodes the webhooks sent by GoCommerce.
+//
+// Every webhook has an X-Commerce-Signature header like
+//
+//	t=1492774577,v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//
+// where t is when it was sent and v1 is the hex encoded HMAC-SHA256 of
+// "<t>.<delivery id>.<body>" with the shared webhook secret. The delivery ID is
+// in the X-Commerce-Delivery header and stays the same when a delivery is
+// retried. Checking the signature tells a consumer that the payload wasn't
+// tampered with, and checking t that the request isn't being replayed:
+//
+//	verifier := webhooks.NewVerifier(os.Getenv("GOCOMMERCE_WEBHOOK_SECRET"))
+//	http.HandleFunc("/hooks/order", func(w http.ResponseWriter, r *http.Request) {
+//		event, err := verifier.Parse(r)
+//		if err != nil {
+//			http.Error(w, err.Error(), http.StatusUnauthorized)
+//			return
+//		}
+//		order := map[string]interface{}{}
+//		event.Decode(&order)
+//	})
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers set on every webhook request
+const (
+	SignatureHeader = "X-Commerce-Signature"
+	DeliveryHeader  = "X-Commerce-Delivery"
+	EventHeader     = "X-Commerce-Event"
+	VersionHeader   = "X-Commerce-Webhook-Version"
+)
+
+// SignatureScheme is the key of the signatures in the signature header
+const SignatureScheme = "v1"
+
+// The types of events, sent in the X-Commerce-Event header
+const (
+	OrderEvent            = "order"
+	PaymentEvent          = "payment"
+	UpdateEvent           = "update"
+	RefundEvent           = "refund"
+	CancellationEvent     = "cancellation"
+	FulfillmentEvent      = "fulfillment"
+	DisputeEvent          = "dispute"
+	DownloadEvent         = "download"
+	CouponRedemptionEvent = "coupon_redemption"
+	StockEvent            = "stock"
+	ReferralCreditEvent   = "referral_credit"
+
+	// PingEvent is only sent when testing webhook endpoints
+	PingEvent = "ping"
+)
+
+// Events are the types of events GoCommerce sends
+var Events = []string{
+	OrderEvent, PaymentEvent, UpdateEvent, RefundEvent, CancellationEvent,
+	FulfillmentEvent, DisputeEvent, DownloadEvent, CouponRedemptionEvent, StockEvent,
+	ReferralCreditEvent,
+}
+
+// Version is the current version of the webhook payloads
+const Version = "1"
+
+// DefaultTolerance is how far the time of a signature can be from the time
+// it is checked, which covers the clock skew between GoCommerce and a
+// consumer and how long a captured request could be replayed
+const DefaultTolerance = 5 * time.Minute
+
+// Errors returned when a webhook fails verification
+var (
+	ErrMissingSecret    = errors.New("no webhook secret configured")
+	ErrMissingSignature = errors.New("missing webhook signature")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStaleSignature   = errors.New("webhook signature is outside the allowed time window")
+)
+
+// Event is a verified webhook
+type Event struct {
+	Type       string
+	Version    string
+	DeliveryID string
+	// SignedAt is when the delivery was signed
+	SignedAt time.Time
+	Data     json.RawMessage
+}
+
+// Decode unmarshals the webhook payload
+func (e *Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// Envelope is the body of the webhooks sent to the shared URL, which gets
+// events of every type. Data is the payload the URL for the type would get.
+type Envelope struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// Sign creates the signature header for a delivery. It's what GoCommerce
+// uses when sending webhooks, and is useful to test consumers.
+func Sign(secret, deliveryID string, body []byte, now time.Time) string {
+	return SignAll([]string{secret}, deliveryID, body, now)
+}
+
+// SignAll creates a signature header with a signature for every secret, so
+// consumers can verify it with any of them while a secret is rotated
+func SignAll(secrets []string, deliveryID string, body []byte, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header := "t=" + timestamp
+	for _, secret := range secrets {
+		if secret != "" {
+			header += fmt.Sprintf(",%s=%s", SignatureScheme, signature(secret, timestamp, deliveryID, body))
+		}
+	}
+	return header
+}
+
+// Verifier checks webhook signatures
+type Verifier struct {
+	Secret string
+	// SecondarySecret is accepted next to Secret, so a consumer can switch to
+	// a new secret before or after GoCommerce does
+	SecondarySecret string
+	// Tolerance is how old or how far in the future a signature can be,
+	// DefaultTolerance if not set
+	Tolerance time.Duration
+
+	now func() time.Time
+}
+
+// NewVerifier creates a verifier for the webhook secret
+func NewVerifier(secret string) *Verifier {
+	return &Verifier{Secret: secret, Tolerance: DefaultTolerance}
+}
+
+// Verify checks that the signature header is valid for the delivery and body
+// and was made within the tolerance window. It returns when the delivery was
+// signed. The header can hold more than one signature, any of them matching
+// either secret is enough.
+func (v *Verifier) Verify(header, deliveryID string, body []byte) (time.Time, error) {
+	if v.Secret == "" && v.SecondarySecret == "" {
+		return time.Time{}, ErrMissingSecret
+	}
+	if header == "" {
+		return time.Time{}, ErrMissingSignature
+	}
+
+	timestamp := ""
+	signatures := []string{}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return time.Time{}, ErrInvalidSignature
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case SignatureScheme:
+			signatures = append(signatures, kv[1])
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return time.Time{}, ErrInvalidSignature
+	}
+
+	valid := false
+	for _, secret := range []string{v.Secret, v.SecondarySecret} {
+		if secret == "" {
+			continue
+		}
+		expected := []byte(signature(secret, timestamp, deliveryID, body))
+		for _, sig := range signatures {
+			if hmac.Equal(expected, []byte(sig)) {
+				valid = true
+			}
+		}
+	}
+	if !valid {
+		return time.Time{}, ErrInvalidSignature
+	}
+
+	tolerance := v.Tolerance
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+	signed := time.Unix(unix, 0)
+	if signed.After(now.Add(tolerance)) || signed.Before(now.Add(-tolerance)) {
+		return time.Time{}, ErrStaleSignature
+	}
+
+	return signed, nil
+}
+
+// Parse reads and verifies a webhook request
+func (v *Verifier) Parse(r *http.Request) (*Event, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook body: %v", err)
+	}
+
+	deliveryID := r.Header.Get(DeliveryHeader)
+	signed, err := v.Verify(r.Header.Get(SignatureHeader), deliveryID, body)
+	if err != nil {
+		return nil, err
+	}
+
+	version := r.Header.Get(VersionHeader)
+	if version == "" {
+		version = Version
+	}
+	if version != Version {
+		return nil, fmt.Errorf("unsupported webhook version '%s'", version)
+	}
+
+	return &Event{
+		Type:       r.Header.Get(EventHeader),
+		Version:    version,
+		DeliveryID: deliveryID,
+		SignedAt:   signed,
+		Data:       json.RawMessage(body),
+	}, nil
+}
+
+func signature(secret, timestamp, deliveryID string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + deliveryID + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
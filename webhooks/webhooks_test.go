@@ -0,0 +1,130 @@
+package webhooks
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecret = "shhh"
+
+var testBody = []byte(`{"id":"first-order","total":120}`)
+
+const testDelivery = "42"
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	signature := Sign(testSecret, testDelivery, testBody, now)
+	assert.Regexp(t, `^t=\d+,v1=[0-9a-f]{64}$`, signature)
+
+	signed, err := NewVerifier(testSecret).Verify(signature, testDelivery, testBody)
+	if assert.NoError(t, err) {
+		assert.Equal(t, now.Unix(), signed.Unix())
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	signature := Sign(testSecret, testDelivery, testBody, time.Now())
+	old := Sign(testSecret, testDelivery, testBody, time.Now().Add(-time.Hour))
+	future := Sign(testSecret, testDelivery, testBody, time.Now().Add(time.Hour))
+
+	for name, test := range map[string]struct {
+		secret    string
+		signature string
+		delivery  string
+		body      []byte
+		err       error
+	}{
+		"no secret":         {"", signature, testDelivery, testBody, ErrMissingSecret},
+		"no signature":      {testSecret, "", testDelivery, testBody, ErrMissingSignature},
+		"wrong secret":      {"guess", signature, testDelivery, testBody, ErrInvalidSignature},
+		"garbage":           {testSecret, "not.a.signature", testDelivery, testBody, ErrInvalidSignature},
+		"no timestamp":      {testSecret, signature[strings.Index(signature, ",")+1:], testDelivery, testBody, ErrInvalidSignature},
+		"other timestamp":   {testSecret, "t=1" + signature[strings.Index(signature, ","):], testDelivery, testBody, ErrInvalidSignature},
+		"other delivery":    {testSecret, signature, "43", testBody, ErrInvalidSignature},
+		"old":               {testSecret, old, testDelivery, testBody, ErrStaleSignature},
+		"future":            {testSecret, future, testDelivery, testBody, ErrStaleSignature},
+		"tampered":          {testSecret, signature, testDelivery, []byte(`{"id":"first-order","total":1}`), ErrInvalidSignature},
+		"unknown scheme":    {testSecret, strings.Replace(signature, "v1=", "v0=", 1), testDelivery, testBody, ErrInvalidSignature},
+		"missing signature": {testSecret, "t=1492774577", testDelivery, testBody, ErrInvalidSignature},
+	} {
+		_, err := NewVerifier(test.secret).Verify(test.signature, test.delivery, test.body)
+		assert.Equal(t, test.err, err, name)
+	}
+}
+
+func TestVerifyMultipleSignatures(t *testing.T) {
+	now := time.Now()
+	other := Sign("other-secret", testDelivery, testBody, now)
+	signature := Sign(testSecret, testDelivery, testBody, now)
+	header := other + "," + signature[strings.Index(signature, ",")+1:]
+
+	_, err := NewVerifier(testSecret).Verify(header, testDelivery, testBody)
+	assert.NoError(t, err)
+	_, err = NewVerifier("other-secret").Verify(header, testDelivery, testBody)
+	assert.NoError(t, err)
+}
+
+func TestSignAllAndSecondarySecret(t *testing.T) {
+	header := SignAll([]string{"new-secret", "old-secret"}, testDelivery, testBody, time.Now())
+	assert.Equal(t, 2, strings.Count(header, SignatureScheme+"="))
+
+	_, err := NewVerifier("old-secret").Verify(header, testDelivery, testBody)
+	assert.NoError(t, err)
+	_, err = NewVerifier("new-secret").Verify(header, testDelivery, testBody)
+	assert.NoError(t, err)
+
+	// a consumer that switched first accepts webhooks signed with either
+	v := NewVerifier("new-secret")
+	v.SecondarySecret = "old-secret"
+	_, err = v.Verify(Sign("old-secret", testDelivery, testBody, time.Now()), testDelivery, testBody)
+	assert.NoError(t, err)
+	_, err = v.Verify(Sign("unrelated", testDelivery, testBody, time.Now()), testDelivery, testBody)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	signature := Sign(testSecret, testDelivery, testBody, time.Now())
+
+	v := NewVerifier(testSecret)
+	v.now = func() time.Time { return time.Now().Add(DefaultTolerance - time.Minute) }
+	_, err := v.Verify(signature, testDelivery, testBody)
+	assert.NoError(t, err)
+
+	v.Tolerance = time.Second
+	_, err = v.Verify(signature, testDelivery, testBody)
+	assert.Equal(t, ErrStaleSignature, err)
+}
+
+func TestParse(t *testing.T) {
+	signature := Sign(testSecret, testDelivery, testBody, time.Now())
+	r, _ := http.NewRequest("POST", "http://consumer/hooks", bytes.NewReader(testBody))
+	r.Header.Set(SignatureHeader, signature)
+	r.Header.Set(DeliveryHeader, testDelivery)
+	r.Header.Set(EventHeader, "order")
+	r.Header.Set(VersionHeader, Version)
+
+	event, err := NewVerifier(testSecret).Parse(r)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "order", event.Type)
+		assert.Equal(t, testDelivery, event.DeliveryID)
+		order := struct {
+			ID    string `json:"id"`
+			Total uint64 `json:"total"`
+		}{}
+		assert.NoError(t, event.Decode(&order))
+		assert.Equal(t, "first-order", order.ID)
+		assert.EqualValues(t, 120, order.Total)
+	}
+
+	r, _ = http.NewRequest("POST", "http://consumer/hooks", bytes.NewReader(testBody))
+	r.Header.Set(SignatureHeader, signature)
+	r.Header.Set(DeliveryHeader, testDelivery)
+	r.Header.Set(VersionHeader, "2")
+	_, err = NewVerifier(testSecret).Parse(r)
+	assert.Error(t, err)
+}
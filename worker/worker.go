@@ -0,0 +1,194 @@
+// Package worker runs the jobs queued in the database, so the work that
+// doesn't have to happen within a request is done outside of the API
+// processes. Any number of workers can run at once, every job is locked by
+// the one running it.
+//
+//	w := worker.New(db, log, config)
+//	w.Handle("event", runEvent)
+//	stop := w.Run()
+//	defer stop()
+package worker
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// Handler runs a job. Jobs are retried when it returns an error, unless the
+// error is Permanent.
+type Handler func(ctx context.Context, job *models.Job) error
+
+type permanentError struct {
+	error
+}
+
+// Permanent marks an error that running the job again won't fix, like a
+// payload that can't be read
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent tells if an error was marked Permanent
+func IsPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// Enqueue adds a job to the queue. Pass the transaction that makes the
+// change the job follows up on, so the job is only queued if it commits.
+func Enqueue(tx *gorm.DB, jobType, instanceID string, payload interface{}) error {
+	job, err := models.NewJob(jobType, instanceID, payload)
+	if err != nil {
+		return err
+	}
+	return tx.Create(job).Error
+}
+
+// Worker runs the queued jobs with the handlers for their types
+type Worker struct {
+	db     *gorm.DB
+	log    *logrus.Entry
+	config *conf.Configuration
+
+	mutex    sync.RWMutex
+	handlers map[string]Handler
+}
+
+// New creates a worker without handlers
+func New(db *gorm.DB, log *logrus.Entry, config *conf.Configuration) *Worker {
+	return &Worker{
+		db:       db,
+		log:      log,
+		config:   config,
+		handlers: map[string]Handler{},
+	}
+}
+
+// Handle runs h for the jobs of a type
+func (w *Worker) Handle(jobType string, h Handler) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.handlers[jobType] = h
+}
+
+// Work runs the jobs that are due, up to config.Worker.Concurrency at once,
+// and returns how many of them ran. Jobs are locked a batch at a time, right
+// before they run, so a backlog doesn't sit locked waiting for its turn.
+// Cancelling ctx stops locking more jobs, the ones running finish.
+func (w *Worker) Work(ctx context.Context, lockedBy string, now time.Time) int {
+	concurrency := w.config.Worker.Concurrency
+	if concurrency <= 0 {
+		concurrency = conf.DefaultWorkerConcurrency
+	}
+
+	ran := 0
+	for ctx.Err() == nil {
+		jobs, err := models.LockJobs(w.db, lockedBy, now, concurrency)
+		if err != nil {
+			w.log.WithError(err).Error("Error looking for jobs")
+			break
+		}
+
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		for _, job := range jobs {
+			wg.Add(1)
+			go func(job *models.Job) {
+				defer wg.Done()
+				if w.run(context.WithoutCancel(ctx), job, now) {
+					mutex.Lock()
+					ran++
+					mutex.Unlock()
+				}
+			}(job)
+		}
+		wg.Wait()
+		if len(jobs) < concurrency {
+			break
+		}
+	}
+	return ran
+}
+
+// run runs a job and records how it went
+func (w *Worker) run(ctx context.Context, job *models.Job, now time.Time) bool {
+	log := w.log.WithFields(logrus.Fields{"job_id": job.ID, "job_type": job.Type})
+	err := w.handle(ctx, job)
+	if err == nil {
+		if err := job.Done(w.db); err != nil {
+			log.WithError(err).Error("Error removing job that ran")
+		}
+		return true
+	}
+
+	worker := w.config.Worker
+	if err := job.Fail(w.db, err, !IsPermanent(err), now, worker.MaxRetries, worker.RetryPeriod, worker.MaxRetryPeriod); err != nil {
+		log.WithError(err).Error("Error recording failed job")
+	}
+	if job.Failed {
+		log.WithError(err).Errorf("Job failed %d times, giving up", job.Tries)
+	} else {
+		log.WithError(err).Warnf("Job failed, retrying at %v", job.RunAfter)
+	}
+	return false
+}
+
+func (w *Worker) handle(ctx context.Context, job *models.Job) (err error) {
+	w.mutex.RLock()
+	h, ok := w.handlers[job.Type]
+	w.mutex.RUnlock()
+	if !ok {
+		return Permanent(fmt.Errorf("no handler for jobs of type %s", job.Type))
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = Permanent(fmt.Errorf("job panicked: %v\n%s", r, debug.Stack()))
+		}
+	}()
+	return h(ctx, job)
+}
+
+// Run runs the jobs in the background, looking for new ones every
+// config.Worker.PollInterval, until it's stopped. Stopping waits for the
+// jobs that are running to finish.
+func (w *Worker) Run() (stop func()) {
+	interval := w.config.Worker.PollInterval
+	if interval <= 0 {
+		interval = conf.DefaultWorkerPollInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		id := uuid.NewRandom().String()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if ran := w.Work(ctx, id, time.Now()); ran > 0 {
+				w.log.Debugf("Ran %d jobs", ran)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
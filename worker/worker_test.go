@@ -0,0 +1,174 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+var now = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func testWorker(t *testing.T) (*Worker, *gorm.DB) {
+	f, err := ioutil.TempFile("", "worker-db")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	f.Close()
+
+	config := new(conf.Configuration)
+	config.DB.Driver = "sqlite3"
+	config.DB.ConnURL = f.Name()
+	config.DB.Automigrate = true
+	config.Worker.Concurrency = 2
+	config.Worker.MaxRetries = 3
+	config.Worker.RetryPeriod = time.Minute
+	config.Worker.MaxRetryPeriod = time.Hour
+	db, err := models.Connect(config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return New(db, logrus.WithField("test", t.Name()), config), db
+}
+
+type greeting struct {
+	Name string `json:"name"`
+}
+
+func TestWorkRunsJobs(t *testing.T) {
+	w, db := testWorker(t)
+	greeted := make(chan string, 10)
+	w.Handle("greet", func(ctx context.Context, job *models.Job) error {
+		payload := &greeting{}
+		if err := job.Decode(payload); err != nil {
+			return Permanent(err)
+		}
+		greeted <- payload.Name
+		return nil
+	})
+
+	for _, name := range []string{"alice", "bob", "chloe"} {
+		assert.NoError(t, Enqueue(db, "greet", "", &greeting{Name: name}))
+	}
+	assert.Equal(t, 3, w.Work(context.Background(), "test", now))
+	close(greeted)
+	names := []string{}
+	for name := range greeted {
+		names = append(names, name)
+	}
+	assert.ElementsMatch(t, []string{"alice", "bob", "chloe"}, names)
+
+	count := 0
+	db.Model(&models.Job{}).Count(&count)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 0, w.Work(context.Background(), "test", now))
+}
+
+func TestWorkRetriesFailedJobs(t *testing.T) {
+	w, db := testWorker(t)
+	tries := 0
+	w.Handle("flaky", func(ctx context.Context, job *models.Job) error {
+		tries++
+		return errors.New("provider unavailable")
+	})
+	assert.NoError(t, Enqueue(db, "flaky", "", nil))
+
+	assert.Equal(t, 0, w.Work(context.Background(), "test", now))
+	job := &models.Job{}
+	if !assert.NoError(t, db.First(job).Error) {
+		return
+	}
+	assert.Equal(t, 1, job.Tries)
+	assert.False(t, job.Failed)
+	assert.Nil(t, job.LockedBy)
+	assert.Equal(t, "provider unavailable", *job.ErrorMessage)
+	if assert.NotNil(t, job.RunAfter) {
+		assert.True(t, job.RunAfter.After(now))
+		assert.False(t, job.RunAfter.After(now.Add(time.Minute)))
+	}
+
+	// not due yet
+	w.Work(context.Background(), "test", now.Add(30*time.Second))
+	assert.Equal(t, 1, tries)
+
+	w.Work(context.Background(), "test", now.Add(2*time.Minute))
+	w.Work(context.Background(), "test", now.Add(time.Hour))
+	assert.Equal(t, 3, tries)
+	db.First(job, job.ID)
+	assert.True(t, job.Failed, "gives up after the retries")
+
+	w.Work(context.Background(), "test", now.Add(24*time.Hour))
+	assert.Equal(t, 3, tries)
+}
+
+func TestWorkGivesUpOnPermanentErrors(t *testing.T) {
+	w, db := testWorker(t)
+	w.Handle("broken", func(ctx context.Context, job *models.Job) error {
+		return Permanent(errors.New("bad payload"))
+	})
+	w.Handle("panics", func(ctx context.Context, job *models.Job) error {
+		panic("boom")
+	})
+	for _, jobType := range []string{"broken", "panics", "unknown"} {
+		assert.NoError(t, Enqueue(db, jobType, "", nil))
+	}
+
+	assert.Equal(t, 0, w.Work(context.Background(), "test", now))
+	jobs := []*models.Job{}
+	db.Order("id").Find(&jobs)
+	if assert.Len(t, jobs, 3) {
+		for _, job := range jobs {
+			assert.True(t, job.Failed, job.Type)
+			assert.Equal(t, 1, job.Tries, job.Type)
+		}
+		assert.Contains(t, *jobs[1].ErrorMessage, "boom")
+		assert.Contains(t, *jobs[2].ErrorMessage, "no handler")
+	}
+}
+
+func TestLockedJobsArentRunTwice(t *testing.T) {
+	w, db := testWorker(t)
+	assert.NoError(t, Enqueue(db, "greet", "", &greeting{Name: "alice"}))
+	jobs, err := models.LockJobs(db, "other", now, 10)
+	if assert.NoError(t, err) {
+		assert.Len(t, jobs, 1)
+	}
+
+	ran := 0
+	w.Handle("greet", func(ctx context.Context, job *models.Job) error {
+		ran++
+		return nil
+	})
+	w.Work(context.Background(), "test", now.Add(time.Minute))
+	assert.Equal(t, 0, ran)
+
+	// picked up once the other worker's lock timed out
+	w.Work(context.Background(), "test", now.Add(10*time.Minute))
+	assert.Equal(t, 1, ran)
+}
+
+func TestLockJobsLocksABatch(t *testing.T) {
+	_, db := testWorker(t)
+	for _, name := range []string{"alice", "bob", "chloe"} {
+		assert.NoError(t, Enqueue(db, "greet", "", &greeting{Name: name}))
+	}
+
+	first, err := models.LockJobs(db, "first", now, 2)
+	if assert.NoError(t, err) {
+		assert.Len(t, first, 2)
+	}
+	second, err := models.LockJobs(db, "second", now, 2)
+	if assert.NoError(t, err) && assert.Len(t, second, 1) {
+		assert.Equal(t, "second", *second[0].LockedBy)
+		assert.NotEqual(t, first[0].ID, second[0].ID)
+		assert.NotEqual(t, first[1].ID, second[0].ID)
+	}
+}